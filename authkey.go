@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// loadOrInitAuthKey loads the key JWT api keys are signed with, making one
+// the first time
+func loadOrInitAuthKey(kf string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(kf))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ioutil.WriteFile(kf, data, 0600); err != nil {
+			return nil, err
+		}
+
+		return k, nil
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	edk, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("auth key in %s is a %T, not an ed25519 key", kf, k)
+	}
+	return edk, nil
+}
+
+// newJWTAuthToken makes a JWT api key for user. Shuttles check these
+// against the primary's public key without asking the primary.
+func (s *Server) newJWTAuthToken(user *User, expiry time.Time, scopes []string) (string, error) {
+	return util.SignAuthToken(s.authKey, &util.AuthClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: expiry.Unix(),
+		},
+		Username:        user.Username,
+		Perms:           user.Perm,
+		Scopes:          scopes,
+		Flags:           user.Flags,
+		MaxUploadSize:   user.MaxUploadSize,
+		StorageDisabled: user.StorageDisabled,
+	})
+}
+
+// shuttleAuthKey is what a shuttle needs to check JWT api keys itself: the
+// public key, and the revoked keys that would still pass the check
+func (s *Server) shuttleAuthKey() (*drpc.SetAuthKey, error) {
+	var revoked []string
+	if err := s.DB.Unscoped().Model(&AuthToken{}).
+		Where("deleted_at is not null and expiry > ? and token like ?", time.Now(), "ey%").
+		Pluck("token", &revoked).Error; err != nil {
+		return nil, err
+	}
+
+	out := &drpc.SetAuthKey{
+		PublicKey: s.authKey.Public().(ed25519.PublicKey),
+	}
+	for _, t := range revoked {
+		out.Revoked = append(out.Revoked, util.GetTokenHash(t))
+	}
+	return out, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+)
+
+// blocks are at most a couple MiB, anything longer is not a block
+const maxBlockSize = 4 << 20
+
+var errReadOnly = fmt.Errorf("the mount is read-only")
+
+// gatewayDAG reads the nodes of dags as raw blocks from the gateway of a
+// shuttle, checking each against its cid. Recently read nodes are kept in
+// memory so listing and reading the same files does not refetch them.
+type gatewayDAG struct {
+	host  string
+	cache *lru.ARCCache
+}
+
+func newGatewayDAG(host string, cacheSize int) (*gatewayDAG, error) {
+	cache, err := lru.NewARC(cacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gatewayDAG{
+		host:  strings.TrimSuffix(host, "/"),
+		cache: cache,
+	}, nil
+}
+
+func (gd *gatewayDAG) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if nd, ok := gd.cache.Get(c); ok {
+		return nd.(ipld.Node), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", gd.host+"/gw/ipfs/"+c.String()+"?format=raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ipld.ErrNotFound
+	default:
+		return nil, fmt.Errorf("fetching block %s returned status %d", c, resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBlockSize {
+		return nil, fmt.Errorf("block %s is larger than %d bytes", c, maxBlockSize)
+	}
+
+	chk, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !chk.Equals(c) {
+		return nil, fmt.Errorf("block %s does not match its cid", c)
+	}
+
+	blk, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var nd ipld.Node
+	switch c.Type() {
+	case cid.DagProtobuf:
+		nd, err = merkledag.DecodeProtobufBlock(blk)
+	case cid.Raw:
+		nd, err = merkledag.DecodeRawBlock(blk)
+	default:
+		return nil, fmt.Errorf("unsupported codec for block %s", c)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	gd.cache.Add(c, nd)
+	return nd, nil
+}
+
+func (gd *gatewayDAG) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		for _, c := range cids {
+			nd, err := gd.Get(ctx, c)
+			select {
+			case out <- &ipld.NodeOption{Node: nd, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (gd *gatewayDAG) Add(context.Context, ipld.Node) error        { return errReadOnly }
+func (gd *gatewayDAG) AddMany(context.Context, []ipld.Node) error  { return errReadOnly }
+func (gd *gatewayDAG) Remove(context.Context, cid.Cid) error       { return errReadOnly }
+func (gd *gatewayDAG) RemoveMany(context.Context, []cid.Cid) error { return errReadOnly }
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	"golang.org/x/xerrors"
+)
+
+// The mount shows the content of the user under content/, named like it was
+// added, and their collections under collections/. Listings come from the
+// api and are refreshed after listingTTL, the data is read block by block
+// from the shuttle gateway.
+
+const listingTTL = time.Minute
+
+type apiClient struct {
+	host  string
+	token string
+}
+
+func (ac *apiClient) get(ctx context.Context, endpoint string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(ac.host, "/")+endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+ac.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		var herr util.HttpErrorResponse
+		if err := json.Unmarshal(body, &herr); err == nil && herr.Error.Reason != "" {
+			return &herr.Error
+		}
+		return fmt.Errorf("GET %s returned %d: %s", endpoint, resp.StatusCode, body)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type collection struct {
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type estuaryFS struct {
+	api *apiClient
+	dag ipld.DAGService
+}
+
+func (efs *estuaryFS) Root() (fs.Node, error) {
+	return &staticDir{
+		children: map[string]fs.Node{
+			"content":     &listDir{list: efs.listContent},
+			"collections": &listDir{list: efs.listCollections},
+		},
+	}, nil
+}
+
+// listContent names the active content of the user, content with the same
+// name as another gets its id appended
+func (efs *estuaryFS) listContent(ctx context.Context) (map[string]fs.Node, error) {
+	var contents []util.Content
+	if err := efs.api.get(ctx, "/content/list", &contents); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]fs.Node)
+	for _, c := range contents {
+		name := entryName(c.Name, c.Cid.CID)
+		if _, ok := out[name]; ok {
+			name = fmt.Sprintf("%s (%d)", name, c.ID)
+		}
+		out[name] = efs.contentNode(c)
+	}
+	return out, nil
+}
+
+func (efs *estuaryFS) listCollections(ctx context.Context) (map[string]fs.Node, error) {
+	var cols []collection
+	if err := efs.api.get(ctx, "/collections/list", &cols); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]fs.Node)
+	for _, col := range cols {
+		name := entryName(col.Name, cid.Undef)
+		if name == "" {
+			name = col.UUID
+		}
+		if _, ok := out[name]; ok {
+			name = fmt.Sprintf("%s (%s)", name, col.UUID)
+		}
+
+		col := col
+		out[name] = &listDir{
+			mod: col.CreatedAt,
+			list: func(ctx context.Context) (map[string]fs.Node, error) {
+				return efs.listCollection(ctx, col)
+			},
+		}
+	}
+	return out, nil
+}
+
+// listCollection builds the directory tree of a collection from the paths
+// of its content
+func (efs *estuaryFS) listCollection(ctx context.Context, col collection) (map[string]fs.Node, error) {
+	var refs []util.ContentWithPath
+	if err := efs.api.get(ctx, "/collections/content?coluuid="+url.QueryEscape(col.UUID), &refs); err != nil {
+		return nil, err
+	}
+
+	root := &staticDir{mod: col.CreatedAt, children: make(map[string]fs.Node)}
+	for _, r := range refs {
+		segs := strings.Split(strings.Trim(r.FullPath(), "/"), "/")
+
+		dir := root
+		for _, seg := range segs[:len(segs)-1] {
+			sub, ok := dir.children[seg].(*staticDir)
+			if !ok {
+				sub = &staticDir{mod: col.CreatedAt, children: make(map[string]fs.Node)}
+				dir.children[seg] = sub
+			}
+			dir = sub
+		}
+		dir.children[segs[len(segs)-1]] = efs.contentNode(r.Content)
+	}
+	return root.children, nil
+}
+
+func (efs *estuaryFS) contentNode(c util.Content) *dagNode {
+	return &dagNode{
+		dag:  efs.dag,
+		cid:  c.Cid.CID,
+		mod:  c.UpdatedAt,
+		size: c.Size,
+		dir:  c.Type == util.Directory,
+		// files and directories are known from the api, anything else is
+		// found out from the root block
+		known: c.Type == util.File || c.Type == util.Directory,
+	}
+}
+
+// entryName makes a name usable as a directory entry, falling back to the
+// cid for content added without a name
+func entryName(name string, c cid.Cid) string {
+	name = strings.ReplaceAll(name, "/", "_")
+	if name == "" || name == "." || name == ".." {
+		if !c.Defined() {
+			return ""
+		}
+		return c.String()
+	}
+	return name
+}
+
+func dirAttr(a *fuse.Attr, mod time.Time) {
+	a.Mode = os.ModeDir | 0555
+	a.Mtime = mod
+	a.Ctime = mod
+	a.Valid = listingTTL
+}
+
+// staticDir is a directory whose entries are known up front
+type staticDir struct {
+	mod      time.Time
+	children map[string]fs.Node
+}
+
+func (d *staticDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	dirAttr(a, d.mod)
+	return nil
+}
+
+func (d *staticDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	n, ok := d.children[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return n, nil
+}
+
+func (d *staticDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return direntsOf(d.children), nil
+}
+
+// listDir is a directory whose entries are listed from the api
+type listDir struct {
+	mod  time.Time
+	list func(context.Context) (map[string]fs.Node, error)
+
+	lk       sync.Mutex
+	children map[string]fs.Node
+	listed   time.Time
+}
+
+func (d *listDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	dirAttr(a, d.mod)
+	return nil
+}
+
+func (d *listDir) entries(ctx context.Context) (map[string]fs.Node, error) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	if d.children != nil && time.Since(d.listed) < listingTTL {
+		return d.children, nil
+	}
+
+	children, err := d.list(ctx)
+	if err != nil {
+		log.Errorw("failed to list directory", "err", err)
+		return nil, syscall.EIO
+	}
+
+	d.children = children
+	d.listed = time.Now()
+	return children, nil
+}
+
+func (d *listDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	children, err := d.entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	n, ok := children[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return n, nil
+}
+
+func (d *listDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	children, err := d.entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return direntsOf(children), nil
+}
+
+func direntsOf(children map[string]fs.Node) []fuse.Dirent {
+	out := make([]fuse.Dirent, 0, len(children))
+	for name, n := range children {
+		ent := fuse.Dirent{Name: name}
+		switch n := n.(type) {
+		case *staticDir, *listDir:
+			ent.Type = fuse.DT_Dir
+		case *dagNode:
+			n.lk.Lock()
+			if n.known {
+				ent.Type = fuse.DT_File
+				if n.dir {
+					ent.Type = fuse.DT_Dir
+				}
+			}
+			n.lk.Unlock()
+		}
+		out = append(out, ent)
+	}
+	return out
+}
+
+// dagNode is a unixfs file or directory in the dag of some content
+type dagNode struct {
+	dag ipld.DAGService
+	cid cid.Cid
+	mod time.Time
+
+	lk sync.Mutex
+	// known is set when size and dir are already known, otherwise they are
+	// read from the root block on first use
+	known bool
+	size  int64
+	dir   bool
+}
+
+func (n *dagNode) node(ctx context.Context) (ipld.Node, error) {
+	nd, err := n.dag.Get(ctx, n.cid)
+	if err != nil {
+		if xerrors.Is(err, ipld.ErrNotFound) {
+			return nil, syscall.ENOENT
+		}
+		log.Errorw("failed to fetch block", "cid", n.cid, "err", err)
+		return nil, syscall.EIO
+	}
+	return nd, nil
+}
+
+func (n *dagNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	if !n.known {
+		nd, err := n.node(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch nd := nd.(type) {
+		case *merkledag.ProtoNode:
+			fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+			if err != nil {
+				return syscall.EIO
+			}
+			n.dir = fsn.IsDir()
+			n.size = int64(fsn.FileSize())
+		default:
+			n.size = int64(len(nd.RawData()))
+		}
+		n.known = true
+	}
+
+	if n.dir {
+		dirAttr(a, n.mod)
+		// the dag of a cid never changes
+		a.Valid = time.Hour
+		return nil
+	}
+
+	a.Mode = 0444
+	a.Size = uint64(n.size)
+	a.Mtime = n.mod
+	a.Ctime = n.mod
+	a.Valid = time.Hour
+	return nil
+}
+
+func (n *dagNode) directory(ctx context.Context) (uio.Directory, error) {
+	nd, err := n.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := uio.NewDirectoryFromNode(n.dag, nd)
+	if err != nil {
+		return nil, syscall.ENOTDIR
+	}
+	return dir, nil
+}
+
+func (n *dagNode) child(c cid.Cid) *dagNode {
+	return &dagNode{dag: n.dag, cid: c, mod: n.mod}
+}
+
+func (n *dagNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	dir, err := n.directory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	nd, err := dir.Find(ctx, name)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	return n.child(nd.Cid()), nil
+}
+
+func (n *dagNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dir, err := n.directory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := dir.Links(ctx)
+	if err != nil {
+		log.Errorw("failed to list directory", "cid", n.cid, "err", err)
+		return nil, syscall.EIO
+	}
+
+	out := make([]fuse.Dirent, 0, len(links))
+	for _, l := range links {
+		out = append(out, fuse.Dirent{Name: l.Name})
+	}
+	return out, nil
+}
+
+func (n *dagNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, syscall.EROFS
+	}
+
+	nd, err := n.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reader is not tied to the context of the open request, reads
+	// pass their own
+	r, err := uio.NewDagReader(context.Background(), nd, n.dag)
+	if err != nil {
+		// directories are listed without a reader
+		return n, nil
+	}
+
+	// the data of a cid never changes, the kernel can keep it cached
+	resp.Flags |= fuse.OpenKeepCache
+	return &fileHandle{r: r}, nil
+}
+
+type fileHandle struct {
+	lk sync.Mutex
+	r  uio.DagReader
+}
+
+func (fh *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	fh.lk.Lock()
+	defer fh.lk.Unlock()
+
+	if _, err := fh.r.Seek(req.Offset, io.SeekStart); err != nil {
+		return syscall.EIO
+	}
+
+	buf := make([]byte, req.Size)
+	read, err := fh.r.CtxReadFull(ctx, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Errorw("failed to read file", "err", err)
+		return syscall.EIO
+	}
+
+	resp.Data = buf[:read]
+	return nil
+}
+
+func (fh *fileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return fh.r.Close()
+}
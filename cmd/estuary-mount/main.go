@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	logging "github.com/ipfs/go-log/v2"
+	cli "github.com/urfave/cli/v2"
+)
+
+var log = logging.Logger("estuary-mount")
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "estuary-mount"
+	app.Usage = "mount the content and collections of an estuary user as a read-only filesystem"
+	app.ArgsUsage = "<mountpoint>"
+
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name:    "api",
+			Usage:   "estuary api endpoint listing the content",
+			EnvVars: []string{"ESTUARY_API"},
+			Value:   "https://api.estuary.tech",
+		},
+		&cli.StringFlag{
+			Name:     "shuttle",
+			Usage:    "shuttle whose gateway the data is read from",
+			EnvVars:  []string{"ESTUARY_SHUTTLE"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "api-key",
+			Usage:    "api key of the user whose data is mounted",
+			EnvVars:  []string{"ESTUARY_API_KEY"},
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "block-cache",
+			Usage: "number of blocks kept in memory",
+			Value: 4096,
+		},
+		&cli.BoolFlag{
+			Name:  "allow-other",
+			Usage: "let other users access the mount",
+		},
+	}
+
+	app.Action = func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("must specify the mountpoint")
+		}
+		mountpoint := cctx.Args().First()
+
+		dag, err := newGatewayDAG(cctx.String("shuttle"), cctx.Int("block-cache"))
+		if err != nil {
+			return err
+		}
+
+		efs := &estuaryFS{
+			api: &apiClient{
+				host:  cctx.String("api"),
+				token: cctx.String("api-key"),
+			},
+			dag: dag,
+		}
+
+		opts := []fuse.MountOption{
+			fuse.FSName("estuary"),
+			fuse.Subtype("estuaryfs"),
+			fuse.ReadOnly(),
+		}
+		if cctx.Bool("allow-other") {
+			opts = append(opts, fuse.AllowOther())
+		}
+
+		conn, err := fuse.Mount(mountpoint, opts...)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sigCh
+			log.Infow("unmounting", "mountpoint", mountpoint)
+			if err := fuse.Unmount(mountpoint); err != nil {
+				log.Errorw("failed to unmount", "mountpoint", mountpoint, "err", err)
+			}
+		}()
+
+		if err := fs.Serve(conn, efs); err != nil {
+			return err
+		}
+
+		<-conn.Ready
+		return conn.MountError
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	adminPinsDefaultLimit = 100
+	adminPinsMaxLimit     = 1000
+)
+
+type adminPin struct {
+	Pin
+
+	// Estimate is set for pins that are queued or being fetched
+	Estimate *pinner.PinEstimate `json:"estimate,omitempty"`
+}
+
+type adminPinsResponse struct {
+	Pins  []adminPin `json:"pins"`
+	Total int64      `json:"total"`
+}
+
+// handleAdminListPins godoc
+// @Summary      List pins
+// @Description  This endpoint pages through the pins of this shuttle, newest first, optionally filtered by user, cid and state. Queued and running pins come with their queue position and estimated start or completion.
+// @Tags         admin
+// @Produce      json
+// @Param        user    query  int     false  "User ID"
+// @Param        cid     query  string  false  "Root cid"
+// @Param        state   query  string  false  "active, pinning, failed, cancelled, retrying or corrupted"
+// @Param        limit   query  int     false  "Limit"
+// @Param        offset  query  int     false  "Offset"
+// @Router       /admin/pins [get]
+func (s *Shuttle) handleAdminListPins(c echo.Context) error {
+	limit := adminPinsDefaultLimit
+	if limstr := c.QueryParam("limit"); limstr != "" {
+		l, err := strconv.Atoi(limstr)
+		if err != nil || l <= 0 {
+			return invalidQueryParam("limit", limstr)
+		}
+		limit = l
+	}
+	if limit > adminPinsMaxLimit {
+		limit = adminPinsMaxLimit
+	}
+
+	var offset int
+	if offstr := c.QueryParam("offset"); offstr != "" {
+		o, err := strconv.Atoi(offstr)
+		if err != nil || o < 0 {
+			return invalidQueryParam("offset", offstr)
+		}
+		offset = o
+	}
+
+	q := s.readDB().Model(&Pin{})
+	if ustr := c.QueryParam("user"); ustr != "" {
+		uid, err := strconv.Atoi(ustr)
+		if err != nil {
+			return invalidQueryParam("user", ustr)
+		}
+		q = q.Where("user_id = ?", uid)
+	}
+
+	if cstr := c.QueryParam("cid"); cstr != "" {
+		cc, err := cid.Decode(cstr)
+		if err != nil {
+			return invalidQueryParam("cid", cstr)
+		}
+		q = q.Where("cid = ?", util.DbCID{CID: cc})
+	}
+
+	switch state := c.QueryParam("state"); state {
+	case "":
+	case "active":
+		q = q.Where("active")
+	case "pinning":
+		q = q.Where("pinning and not active")
+	case "failed":
+		q = q.Where("failed")
+	case "cancelled":
+		q = q.Where("cancelled")
+	case "retrying":
+		q = q.Where("retry_at is not null")
+	case "corrupted":
+		q = q.Where("corrupted")
+	default:
+		return invalidQueryParam("state", state)
+	}
+
+	var out adminPinsResponse
+	if err := q.Count(&out.Total).Error; err != nil {
+		return err
+	}
+
+	var pins []Pin
+	if err := q.Order("id desc").Limit(limit).Offset(offset).Find(&pins).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	out.Pins = make([]adminPin, 0, len(pins))
+	for _, p := range pins {
+		ap := adminPin{Pin: p}
+		if p.Pinning && !p.Active {
+			ap.Estimate, _ = s.PinMgr.Estimate(p.Content, now)
+		}
+		out.Pins = append(out.Pins, ap)
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+func invalidQueryParam(name, val string) error {
+	return &util.HttpError{
+		Code:    http.StatusBadRequest,
+		Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+		Details: fmt.Sprintf("invalid value %q for query param %s", val, name),
+	}
+}
+
+type adminTransfer struct {
+	*filclient.ChannelState
+
+	// DealDBID is set for the transfers of deals this shuttle tracks
+	DealDBID uint `json:"dealDbid,omitempty"`
+
+	// rates in bytes per second since the previous listing
+	SendRate    float64 `json:"sendRate"`
+	ReceiveRate float64 `json:"receiveRate"`
+}
+
+// handleAdminActiveTransfers godoc
+// @Summary      List active transfers
+// @Description  This endpoint lists the data transfer channels in progress with their status, and their rates since the previous call
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/transfers/active [get]
+func (s *Shuttle) handleAdminActiveTransfers(c echo.Context) error {
+	transfers, err := s.Filc.TransfersInProgress(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	out := make(map[string]*adminTransfer, len(transfers))
+	for id, st := range transfers {
+		t := &adminTransfer{ChannelState: st}
+		t.SendRate, t.ReceiveRate = s.transferRates.update(id, st.Sent, st.Received, now)
+
+		s.tcLk.Lock()
+		if trk, ok := s.trackingChannels[id]; ok {
+			t.DealDBID = trk.dbid
+		}
+		s.tcLk.Unlock()
+
+		out[id] = t
+	}
+	s.transferRates.prune(now)
+
+	return c.JSON(http.StatusOK, out)
+}
+
+// transferRates remembers how many bytes each transfer had moved when it was
+// last listed, to tell the rate since then
+type transferRates struct {
+	lk   sync.Mutex
+	last map[string]transferSample
+}
+
+type transferSample struct {
+	sent     uint64
+	received uint64
+	at       time.Time
+}
+
+// transfers not listed for this long are forgotten
+const transferRateMaxAge = time.Hour
+
+func (tr *transferRates) update(id string, sent, received uint64, now time.Time) (float64, float64) {
+	tr.lk.Lock()
+	defer tr.lk.Unlock()
+
+	if tr.last == nil {
+		tr.last = make(map[string]transferSample)
+	}
+
+	prev, ok := tr.last[id]
+	tr.last[id] = transferSample{sent: sent, received: received, at: now}
+	if !ok {
+		return 0, 0
+	}
+
+	secs := now.Sub(prev.at).Seconds()
+	if secs <= 0 {
+		return 0, 0
+	}
+
+	var sendRate, recvRate float64
+	if sent > prev.sent {
+		sendRate = float64(sent-prev.sent) / secs
+	}
+	if received > prev.received {
+		recvRate = float64(received-prev.received) / secs
+	}
+	return sendRate, recvRate
+}
+
+func (tr *transferRates) prune(now time.Time) {
+	tr.lk.Lock()
+	defer tr.lk.Unlock()
+
+	for id, smp := range tr.last {
+		if now.Sub(smp.at) > transferRateMaxAge {
+			delete(tr.last, id)
+		}
+	}
+}
+
+// handleAdminStagingUsage godoc
+// @Summary      Staging blockstore usage
+// @Description  This endpoint returns the number and disk usage of the staging blockstores uploads are imported into
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/storage/staging [get]
+func (s *Shuttle) handleAdminStagingUsage(c echo.Context) error {
+	usage, err := s.StagingMgr.Usage()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, usage)
+}
+
+type userStorage struct {
+	UserID      uint  `json:"userId"`
+	Pins        int64 `json:"pins"`
+	ActivePins  int64 `json:"activePins"`
+	ActiveBytes int64 `json:"activeBytes"`
+	FailedPins  int64 `json:"failedPins"`
+}
+
+// handleAdminUserStorage godoc
+// @Summary      Storage per user
+// @Description  This endpoint returns the pin counts and stored bytes of every user with pins on this shuttle
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/storage/users [get]
+func (s *Shuttle) handleAdminUserStorage(c echo.Context) error {
+	out := []userStorage{}
+	if err := s.readDB().Model(&Pin{}).
+		Select("user_id, count(*) as pins, " +
+			"sum(case when active then 1 else 0 end) as active_pins, " +
+			"sum(case when active then size else 0 end) as active_bytes, " +
+			"sum(case when failed then 1 else 0 end) as failed_pins").
+		Group("user_id").
+		Order("active_bytes desc").
+		Scan(&out).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, out)
+}
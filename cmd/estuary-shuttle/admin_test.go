@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferRates(t *testing.T) {
+	var tr transferRates
+	now := time.Now()
+
+	send, recv := tr.update("a", 1000, 0, now)
+	assert.Zero(t, send)
+	assert.Zero(t, recv)
+
+	send, recv = tr.update("a", 3000, 500, now.Add(2*time.Second))
+	assert.Equal(t, 1000.0, send)
+	assert.Equal(t, 250.0, recv)
+
+	// a restarted transfer counts from zero again
+	send, _ = tr.update("a", 100, 500, now.Add(3*time.Second))
+	assert.Zero(t, send)
+
+	tr.prune(now.Add(3*time.Second + transferRateMaxAge + time.Second))
+	assert.Empty(t, tr.last)
+}
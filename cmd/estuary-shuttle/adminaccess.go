@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+)
+
+// adminAccess limits the admin api and the debug endpoints to the
+// configured networks
+type adminAccess struct {
+	allowed []*net.IPNet
+	proxies []*net.IPNet
+}
+
+func newAdminAccess(cfg config.AdminAccess) (*adminAccess, error) {
+	allowed, err := config.ParseNetworks(cfg.AllowedIPs)
+	if err != nil {
+		return nil, err
+	}
+	proxies, err := config.ParseNetworks(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &adminAccess{allowed: allowed, proxies: proxies}, nil
+}
+
+func (aa *adminAccess) allows(ip net.IP) bool {
+	if len(aa.allowed) == 0 {
+		return true
+	}
+	for _, n := range aa.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipExtractor takes the client address from X-Forwarded-For only when the
+// request came through a trusted proxy, so clients cannot claim any address
+func (aa *adminAccess) ipExtractor() echo.IPExtractor {
+	if len(aa.proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, n := range aa.proxies {
+		opts = append(opts, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
+
+func (aa *adminAccess) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ip := c.RealIP()
+		if !aa.allows(net.ParseIP(ip)) {
+			log.Warnw("admin request from address that is not allowed", "ip", ip, "path", c.Request().URL.Path)
+			return &util.HttpError{
+				Code:    http.StatusForbidden,
+				Reason:  util.ERR_NOT_AUTHORIZED,
+				Details: fmt.Sprintf("admin endpoints are not reachable from %s", ip),
+			}
+		}
+		return next(c)
+	}
+}
+
+// handler guards debug endpoints served outside of the api, which are
+// reached directly
+func (aa *adminAccess) handler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !aa.allows(net.ParseIP(host)) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAccess(t *testing.T) {
+	aa, err := newAdminAccess(config.AdminAccess{
+		AllowedIPs:     []string{"10.1.0.0/16", "192.0.2.7"},
+		TrustedProxies: []string{"10.9.9.9"},
+	})
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.HTTPErrorHandler = util.ErrorHandler
+	e.IPExtractor = aa.ipExtractor()
+	e.GET("/admin/pins", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, aa.middleware)
+
+	status := func(remote, xff string) int {
+		req := httptest.NewRequest(http.MethodGet, "/admin/pins", nil)
+		req.RemoteAddr = remote + ":1234"
+		if xff != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, xff)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status("10.1.2.3", ""))
+	assert.Equal(t, http.StatusOK, status("192.0.2.7", ""))
+	assert.Equal(t, http.StatusForbidden, status("192.0.2.8", ""))
+	assert.Equal(t, http.StatusForbidden, status("203.0.113.5", "10.1.2.3"), "an untrusted client picked its address")
+	assert.Equal(t, http.StatusOK, status("10.9.9.9", "10.1.2.3"))
+	assert.Equal(t, http.StatusForbidden, status("10.9.9.9", "203.0.113.5"))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	aa.handler(func(w http.ResponseWriter, r *http.Request) {})(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	open, err := newAdminAccess(config.AdminAccess{})
+	require.NoError(t, err)
+	assert.True(t, open.allows(nil), "no allowlist limits access")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	ipld "github.com/ipfs/go-ipld-format"
+	unixfs "github.com/ipfs/go-unixfs"
+	"gorm.io/gorm"
+)
+
+const (
+	aggregationInterval = time.Minute * 10
+
+	// stagedAggregateTimeout is how long an aggregate waits for the primary
+	// to create its content before its contents are aggregated again
+	stagedAggregateTimeout = time.Hour * 24
+)
+
+// StagedAggregate is an aggregate the shuttle made of small contents of a
+// user. Content is zero until the primary created the content for it.
+type StagedAggregate struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+
+	UserID  uint       `gorm:"index"`
+	Root    util.DbCID `gorm:"index"`
+	Size    int64
+	Content uint `gorm:"index"`
+}
+
+// AggregateEntry is where a content sits in the aggregate it was put in.
+// LinkIndex is its link in the aggregate directory.
+type AggregateEntry struct {
+	ID        uint `gorm:"primarykey"`
+	Aggregate uint `gorm:"index"`
+	Content   uint `gorm:"index"`
+	LinkIndex int
+	Size      int64
+}
+
+// runAggregator groups the small contents of each user into aggregates and
+// reports them to the primary, which makes deals for the aggregates instead
+// of for each of them.
+func (s *Shuttle) runAggregator() {
+	cfg := s.shuttleConfig.Aggregation
+	if cfg.MaxContentSize == 0 {
+		return
+	}
+
+	for range time.Tick(aggregationInterval) {
+		if s.isShuttingDown() {
+			return
+		}
+
+		now := time.Now()
+		if err := s.dropUnconfirmedAggregates(now); err != nil {
+			log.Errorf("failed to drop unconfirmed aggregates: %s", err)
+		}
+		// the content of a draining shuttle is moved off as it is
+		if s.isDraining() {
+			continue
+		}
+		if err := s.aggregateSmallContent(context.Background(), cfg, now); err != nil {
+			log.Errorf("failed to aggregate small content: %s", err)
+		}
+	}
+}
+
+func (s *Shuttle) aggregateSmallContent(ctx context.Context, cfg config.Aggregation, now time.Time) error {
+	ctx, span := s.Tracer.Start(ctx, "aggregateSmallContent")
+	defer span.End()
+
+	var pins []Pin
+	if err := s.DB.Where("active and not aggregate and aggregated_in = 0 and not dag_split and max_depth = 0 and size > 0 and size <= ?", cfg.MaxContentSize).
+		Where("content not in (?)", s.DB.Model(AggregateEntry{}).Select("content")).
+		Order("id asc").
+		Find(&pins).Error; err != nil {
+		return err
+	}
+
+	byUser := make(map[uint][]Pin)
+	for _, p := range pins {
+		byUser[p.UserID] = append(byUser[p.UserID], p)
+	}
+
+	for user, pins := range byUser {
+		for _, group := range groupForAggregate(pins, cfg, now) {
+			if err := s.stageAggregate(ctx, user, group); err != nil {
+				return fmt.Errorf("failed to aggregate content of user %d: %w", user, err)
+			}
+		}
+	}
+	return nil
+}
+
+// groupForAggregate splits the pins of a user, oldest first, into the
+// aggregates that are ready to be made. An aggregate is ready once it is
+// full, or once its oldest content waited MaxAge and it is big enough for a
+// deal. The pins left over wait for more content.
+func groupForAggregate(pins []Pin, cfg config.Aggregation, now time.Time) [][]Pin {
+	var out [][]Pin
+	var cur []Pin
+	var size int64
+	for _, p := range pins {
+		if len(cur) > 0 && (size+p.Size > cfg.TargetSize || len(cur) >= constants.MaxBucketItems) {
+			out = append(out, cur)
+			cur, size = nil, 0
+		}
+		cur = append(cur, p)
+		size += p.Size
+	}
+
+	if len(cur) > 0 && size >= constants.MinDealSize && now.Sub(cur[0].CreatedAt) >= cfg.MaxAge {
+		out = append(out, cur)
+	}
+	return out
+}
+
+// stageAggregate makes the aggregate directory of pins, records where each
+// of them sits in it and asks the primary to create its content. The
+// aggregate is pinned once the primary answers with CMD_AggregateContent.
+func (s *Shuttle) stageAggregate(ctx context.Context, user uint, pins []Pin) error {
+	byContent := make(map[string]Pin, len(pins))
+	dir := unixfs.EmptyDirNode()
+	for _, p := range pins {
+		name := strconv.FormatUint(uint64(p.Content), 10)
+		if err := dir.AddRawLink(name, &ipld.Link{
+			Size: uint64(p.Size),
+			Cid:  p.Cid.CID,
+		}); err != nil {
+			return err
+		}
+		byContent[name] = p
+	}
+
+	// links may be reordered when the directory is encoded, the index
+	// follows the encoded order
+	blob := dir.RawData()
+
+	entries := make([]*AggregateEntry, 0, len(pins))
+	contents := make([]uint, 0, len(pins))
+	size := int64(len(blob))
+	for i, l := range dir.Links() {
+		p := byContent[l.Name]
+		entries = append(entries, &AggregateEntry{
+			Content:   p.Content,
+			LinkIndex: i,
+			Size:      p.Size,
+		})
+		contents = append(contents, p.Content)
+		size += p.Size
+	}
+
+	aggr := &StagedAggregate{
+		UserID: user,
+		Root:   util.DbCID{CID: dir.Cid()},
+		Size:   size,
+	}
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(aggr).Error; err != nil {
+			return err
+		}
+		for _, e := range entries {
+			e.Aggregate = aggr.ID
+		}
+		return tx.Create(entries).Error
+	}); err != nil {
+		return err
+	}
+
+	log.Infow("aggregated small content", "user", user, "root", dir.Cid(), "contents", len(contents), "size", aggr.Size)
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_AggregateStaged,
+		Params: drpc.MsgParams{
+			AggregateStaged: &drpc.AggregateStaged{
+				UserID:   user,
+				Root:     dir.Cid(),
+				ObjData:  blob,
+				Size:     aggr.Size,
+				Contents: contents,
+			},
+		},
+	})
+}
+
+// confirmStagedAggregate records the content the primary created for a
+// staged aggregate, and that its contents are aggregated in it
+func (s *Shuttle) confirmStagedAggregate(cmd *drpc.AggregateContent) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(StagedAggregate{}).
+			Where("root = ? and user_id = ? and content = 0", util.DbCID{CID: cmd.Root}, cmd.UserID).
+			Update("content", cmd.DBID).Error; err != nil {
+			return err
+		}
+		return tx.Model(Pin{}).Where("content in ?", cmd.Contents).Update("aggregated_in", cmd.DBID).Error
+	})
+}
+
+// dropUnconfirmedAggregates forgets aggregates the primary never created the
+// content of, so their contents are aggregated again
+func (s *Shuttle) dropUnconfirmedAggregates(now time.Time) error {
+	var stale []StagedAggregate
+	if err := s.DB.Find(&stale, "content = 0 and created_at < ?", now.Add(-stagedAggregateTimeout)).Error; err != nil {
+		return err
+	}
+
+	for _, a := range stale {
+		log.Warnw("primary never created the content of a staged aggregate, dropping it", "aggregate", a.ID, "root", a.Root.CID, "user", a.UserID)
+		if err := s.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("aggregate = ?", a.ID).Delete(&AggregateEntry{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&StagedAggregate{}, a.ID).Error
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
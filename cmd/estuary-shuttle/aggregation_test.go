@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupForAggregate(t *testing.T) {
+	now := time.Now()
+	cfg := config.Aggregation{MaxContentSize: 300 << 20, TargetSize: 600 << 20, MaxAge: time.Hour}
+
+	pin := func(content uint, size int64, age time.Duration) Pin {
+		return Pin{Content: content, Size: size, CreatedAt: now.Add(-age)}
+	}
+
+	groups := groupForAggregate([]Pin{
+		pin(1, 300<<20, 0),
+		pin(2, 200<<20, 0),
+		pin(3, 200<<20, 0),
+	}, cfg, now)
+	require.Len(t, groups, 1, "the leftover content is too young and too small")
+	assert.Len(t, groups[0], 2)
+
+	groups = groupForAggregate([]Pin{
+		pin(1, 100<<20, 2*time.Hour),
+		pin(2, 100<<20, 0),
+	}, cfg, now)
+	assert.Empty(t, groups, "an aggregate too small for a deal was made")
+
+	groups = groupForAggregate([]Pin{
+		pin(1, 200<<20, 2*time.Hour),
+		pin(2, 100<<20, 0),
+	}, cfg, now)
+	require.Len(t, groups, 1)
+	assert.Len(t, groups[0], 2)
+}
+
+func TestStageAggregate(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.resend = newResendQueue(nil)
+
+	for i, data := range []string{"one", "two", "three"} {
+		addTestPin(t, s, uint(i+1), blocks.NewBlock([]byte(data)))
+	}
+	require.NoError(t, s.DB.Model(Pin{}).Where("id > 0").Updates(map[string]interface{}{"user_id": 1, "size": 100}).Error)
+
+	var pins []Pin
+	require.NoError(t, s.DB.Order("id asc").Find(&pins, "content in ?", []uint{1, 2}).Error)
+	require.NoError(t, s.stageAggregate(ctx, 1, pins))
+	assert.Equal(t, 1, s.resend.len(), "primary was not told about the aggregate")
+
+	var entries []AggregateEntry
+	require.NoError(t, s.DB.Order("link_index asc").Find(&entries).Error)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 0, entries[0].LinkIndex)
+	assert.Equal(t, 1, entries[1].LinkIndex)
+	assert.Equal(t, int64(100), entries[1].Size)
+
+	var aggr StagedAggregate
+	require.NoError(t, s.DB.First(&aggr).Error)
+	assert.Greater(t, aggr.Size, int64(200))
+
+	// staged contents are not aggregated again, the third is too small to
+	// be aggregated on its own
+	cfg := config.Aggregation{MaxContentSize: 100, TargetSize: 1000, MaxAge: 0}
+	require.NoError(t, s.aggregateSmallContent(ctx, cfg, time.Now()))
+	var n int64
+	require.NoError(t, s.DB.Model(StagedAggregate{}).Count(&n).Error)
+	assert.Equal(t, int64(1), n)
+
+	require.NoError(t, s.confirmStagedAggregate(&drpc.AggregateContent{
+		DBID:     10,
+		UserID:   1,
+		Root:     aggr.Root.CID,
+		Contents: []uint{1, 2},
+	}))
+	require.NoError(t, s.DB.First(&aggr, aggr.ID).Error)
+	assert.Equal(t, uint(10), aggr.Content)
+	require.NoError(t, s.DB.Model(Pin{}).Where("aggregated_in = ?", 10).Count(&n).Error)
+	assert.Equal(t, int64(2), n)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+	archiveZip   = "zip"
+)
+
+// maxArchiveFiles bounds the files taken out of one archive, the root node
+// of each of them is kept until the directory is built
+const maxArchiveFiles = 100000
+
+var (
+	zipMagic  = []byte("PK\x03\x04")
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// archiveFormat returns the format of the archive read from br, format is
+// what the client said it is and is sniffed from the first bytes if empty
+func archiveFormat(format string, br *bufio.Reader) (string, error) {
+	switch format {
+	case archiveTar, archiveTarGz, archiveZip:
+		return format, nil
+	case "tgz":
+		return archiveTarGz, nil
+	case "":
+	default:
+		return "", &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("unsupported archive format %q, must be tar, tar.gz or zip", format),
+		}
+	}
+
+	head, err := br.Peek(len(zipMagic))
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	switch {
+	case bytes.HasPrefix(head, zipMagic):
+		return archiveZip, nil
+	case bytes.HasPrefix(head, gzipMagic):
+		return archiveTarGz, nil
+	default:
+		return archiveTar, nil
+	}
+}
+
+// archiveFiles collects the files of an archive by their cleaned path
+type archiveFiles map[string]ipld.Node
+
+func (af archiveFiles) add(name string, nd ipld.Node) error {
+	p, err := util.CleanUploadPath(name)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid path in archive: %s", err),
+		}
+	}
+	if _, ok := af[p]; ok {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("archive has more than one file with the path %s", p),
+		}
+	}
+	if len(af) >= maxArchiveFiles {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("archive has more than %d files", maxArchiveFiles),
+		}
+	}
+	af[p] = nd
+	return nil
+}
+
+// importTar imports the regular files of a tar stream one after the other.
+// Directories come from the paths of the files, links and special files are
+// skipped.
+func (s *Shuttle) importTar(ctx context.Context, dserv ipld.DAGService, r io.Reader, params util.ImportParams) (archiveFiles, error) {
+	files := make(archiveFiles)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("failed to read tar archive: %s", err),
+			}
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		nd, err := s.importFile(ctx, dserv, tr, params)
+		if err != nil {
+			return nil, err
+		}
+		if err := files.add(hdr.Name, nd); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// importZip imports the regular files of a zip archive. The central
+// directory is at the end, so the archive has to be spooled to disk first.
+func (s *Shuttle) importZip(ctx context.Context, dserv ipld.DAGService, r io.Reader, params util.ImportParams) (archiveFiles, error) {
+	tmp, err := ioutil.TempFile(s.shuttleConfig.UploadDataDir, "estuary-zip-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("failed to read zip archive: %s", err),
+		}
+	}
+
+	files := make(archiveFiles)
+	for _, zf := range zr.File {
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+
+		fi, err := zf.Open()
+		if err != nil {
+			return nil, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("failed to open %s in zip archive: %s", zf.Name, err),
+			}
+		}
+		nd, err := s.importFile(ctx, dserv, fi, params)
+		fi.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := files.add(zf.Name, nd); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// importArchive imports the files of an archive in the given format and
+// builds the directory holding them
+func (s *Shuttle) importArchive(ctx context.Context, dserv ipld.DAGService, format string, r io.Reader, params util.ImportParams) (ipld.Node, error) {
+	var files archiveFiles
+	var err error
+	switch format {
+	case archiveZip:
+		files, err = s.importZip(ctx, dserv, r, params)
+	case archiveTarGz:
+		gzr, gerr := gzip.NewReader(r)
+		if gerr != nil {
+			return nil, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("failed to read gzip stream: %s", gerr),
+			}
+		}
+		defer gzr.Close()
+		files, err = s.importTar(ctx, dserv, gzr, params)
+	default:
+		files, err = s.importTar(ctx, dserv, r, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "archive has no files",
+		}
+	}
+
+	root, err := util.BuildUnixFSDirectory(ctx, dserv, files, params)
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+	return root, nil
+}
+
+// handleAddArchive godoc
+// @Summary      Upload a tar or zip archive as a directory
+// @Description  This endpoint unpacks the tar, tar.gz or zip archive in the request body into a directory, each file of the archive keeps its path. The format is detected unless it is given.
+// @Tags         content
+// @Produce      json
+// @Param        format    query  string  false  "Archive format: tar, tar.gz or zip"
+// @Param        filename  query  string  false  "Name of the content"
+// @Router       /content/add-archive [post]
+func (s *Shuttle) handleAddArchive(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	if err := util.ErrorIfContentAddingDisabled(u.StorageDisabled || s.addingDisabled()); err != nil {
+		return err
+	}
+
+	if !u.FlagSplitContent() && c.Request().ContentLength > constants.DefaultContentSizeLimit {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_CONTENT_SIZE_OVER_LIMIT,
+			Details: fmt.Sprintf("content size %d bytes, is over upload size limit of %d bytes, and content splitting is not enabled, please reduce the content size", c.Request().ContentLength, constants.DefaultContentSizeLimit),
+		}
+	}
+
+	params, err := s.parseImportParams(c.QueryParam)
+	if err != nil {
+		return err
+	}
+
+	opts, err := parseAddOptions(c.QueryParam)
+	if err != nil {
+		return err
+	}
+
+	cic, err := collectionFromParams(c.QueryParam)
+	if err != nil {
+		return err
+	}
+
+	defer c.Request().Body.Close()
+	br := bufio.NewReader(c.Request().Body)
+	format, err := archiveFormat(c.QueryParam("format"), br)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.addStagedContent(ctx, u, c.QueryParam("filename"), cic, opts, func(bs blockstore.Blockstore, dserv ipld.DAGService) (cid.Cid, error) {
+		root, err := s.importArchive(ctx, dserv, format, br, params)
+		if err != nil {
+			return cid.Undef, err
+		}
+		return root.Cid(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
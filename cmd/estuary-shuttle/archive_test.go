@@ -0,0 +1,91 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var archiveTestFiles = map[string]string{
+	"readme.txt":     "hello",
+	"data/a.csv":     "1,2,3",
+	"data/sub/b.bin": "bbbb",
+}
+
+func tarArchive(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "readme.txt"}))
+	for name, data := range archiveTestFiles {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}))
+		_, err := tw.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	_, err := zw.Create("data/")
+	require.NoError(t, err)
+	for name, data := range archiveTestFiles {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestImportArchive(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.shuttleConfig.UploadDataDir = t.TempDir()
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+
+	var roots []string
+	for _, archive := range [][]byte{tarArchive(t), zipArchive(t)} {
+		br := bufio.NewReader(bytes.NewReader(archive))
+		format, err := archiveFormat("", br)
+		require.NoError(t, err)
+
+		root, err := s.importArchive(ctx, dserv, format, br, util.ImportParams{})
+		require.NoError(t, err)
+		roots = append(roots, root.Cid().String())
+
+		dir, err := uio.NewDirectoryFromNode(dserv, root)
+		require.NoError(t, err)
+		links, err := dir.Links(ctx)
+		require.NoError(t, err)
+		assert.Len(t, links, 2, "symlink or directory entry was imported as a file")
+	}
+	assert.Equal(t, roots[0], roots[1], "tar and zip of the same files differ")
+}
+
+func TestArchiveFormat(t *testing.T) {
+	sniff := func(b []byte) string {
+		f, err := archiveFormat("", bufio.NewReader(bytes.NewReader(b)))
+		require.NoError(t, err)
+		return f
+	}
+	assert.Equal(t, archiveZip, sniff(zipArchive(t)))
+	assert.Equal(t, archiveTarGz, sniff([]byte{0x1f, 0x8b, 8, 0}))
+	assert.Equal(t, archiveTar, sniff(tarArchive(t)))
+
+	_, err := archiveFormat("rar", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// AuditEntry records a change made to the content on this shuttle, who asked
+// for it and how it went. Entries are only ever appended, nothing in the
+// shuttle updates or deletes them.
+type AuditEntry struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"createdAt"`
+
+	// Actor is "primary" for rpc commands, "user" or "admin" for api calls
+	// and "shuttle" for changes the shuttle makes on its own
+	Actor  string `json:"actor"`
+	UserID uint   `gorm:"index" json:"userId,omitempty"`
+
+	Action  string `gorm:"index" json:"action"`
+	Content uint   `gorm:"index" json:"content,omitempty"`
+	Cid     string `json:"cid,omitempty"`
+
+	// Result is "ok" or "failed", Error says why it failed
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	auditActorPrimary = "primary"
+	auditActorUser    = "user"
+	auditActorAdmin   = "admin"
+	auditActorShuttle = "shuttle"
+
+	auditResultOK     = "ok"
+	auditResultFailed = "failed"
+)
+
+// audit appends e to the audit log, a failure to do so is logged but does
+// not fail the change it records
+func (s *Shuttle) audit(e *AuditEntry, err error) {
+	e.Result = auditResultOK
+	if err != nil {
+		e.Result = auditResultFailed
+		e.Error = err.Error()
+	}
+
+	if dberr := s.DB.Create(e).Error; dberr != nil {
+		log.Errorw("failed to write audit log entry", "action", e.Action, "content", e.Content, "err", dberr)
+	}
+}
+
+// auditCommandContents returns the contents changed by the commands that are
+// audited, ok is false for commands that are not
+func auditCommandContents(cmd *drpc.Command) ([]uint, bool) {
+	switch cmd.Op {
+	case drpc.CMD_AddPin, drpc.CMD_AddPins, drpc.CMD_TakeContent, drpc.CMD_AggregateContent,
+		drpc.CMD_SplitContent, drpc.CMD_RetrieveContent:
+		return commandContents(cmd), true
+	case drpc.CMD_UnpinContent:
+		if cmd.Params.UnpinContent == nil {
+			return nil, true
+		}
+		return cmd.Params.UnpinContent.Contents, true
+	case drpc.CMD_CancelPin:
+		if cmd.Params.CancelPin == nil {
+			return nil, true
+		}
+		return []uint{cmd.Params.CancelPin.DBID}, true
+	case drpc.CMD_StartTransfer:
+		if cmd.Params.StartTransfer == nil {
+			return nil, true
+		}
+		return []uint{cmd.Params.StartTransfer.ContentID}, true
+	case drpc.CMD_RestartTransfer:
+		return nil, true
+	default:
+		return nil, false
+	}
+}
+
+// auditCommand records the result of a command from the primary, one entry
+// for every content it changed
+func (d *Shuttle) auditCommand(cmd *drpc.Command, err error) {
+	contents, ok := auditCommandContents(cmd)
+	if !ok {
+		return
+	}
+
+	if len(contents) == 0 {
+		contents = []uint{0}
+	}
+
+	var userID uint
+	if cmd.Op == drpc.CMD_AddPin && cmd.Params.AddPin != nil {
+		userID = cmd.Params.AddPin.UserId
+	}
+
+	for _, c := range contents {
+		d.audit(&AuditEntry{
+			Actor:   auditActorPrimary,
+			UserID:  userID,
+			Action:  cmd.Op,
+			Content: c,
+		}, err)
+	}
+}
+
+const auditExportBatch = 1000
+
+// handleAuditExport godoc
+// @Summary      Export the audit log
+// @Description  This endpoint streams audit log entries as json lines, oldest first. Pass the id of the last entry received as "after" to continue an export.
+// @Tags         admin
+// @Produce      json
+// @Param        after    query  int     false  "Only entries after this id"
+// @Param        since    query  string  false  "Only entries at or after this time, RFC3339"
+// @Param        until    query  string  false  "Only entries before this time, RFC3339"
+// @Param        action   query  string  false  "Action"
+// @Param        user     query  int     false  "User ID"
+// @Param        content  query  int     false  "Content ID"
+// @Router       /admin/audit [get]
+func (s *Shuttle) handleAuditExport(c echo.Context) error {
+	q := s.readDB().Model(&AuditEntry{})
+
+	var after uint64
+	if astr := c.QueryParam("after"); astr != "" {
+		a, err := strconv.ParseUint(astr, 10, 64)
+		if err != nil {
+			return invalidQueryParam("after", astr)
+		}
+		after = a
+	}
+
+	for _, p := range []struct{ param, where string }{
+		{"since", "created_at >= ?"},
+		{"until", "created_at < ?"},
+	} {
+		if tstr := c.QueryParam(p.param); tstr != "" {
+			t, err := time.Parse(time.RFC3339, tstr)
+			if err != nil {
+				return invalidQueryParam(p.param, tstr)
+			}
+			q = q.Where(p.where, t)
+		}
+	}
+
+	if action := c.QueryParam("action"); action != "" {
+		q = q.Where("action = ?", action)
+	}
+
+	for _, p := range []struct{ param, where string }{
+		{"user", "user_id = ?"},
+		{"content", "content = ?"},
+	} {
+		if istr := c.QueryParam(p.param); istr != "" {
+			id, err := strconv.ParseUint(istr, 10, 64)
+			if err != nil {
+				return invalidQueryParam(p.param, istr)
+			}
+			q = q.Where(p.where, id)
+		}
+	}
+
+	// the conditions are shared by every batch
+	q = q.Session(&gorm.Session{})
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	c.Response().WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(c.Response())
+	for {
+		var entries []AuditEntry
+		if err := q.Where("id > ?", after).Order("id asc").Limit(auditExportBatch).Find(&entries).Error; err != nil {
+			// the status is sent already, all that can be done is to end
+			// the stream early
+			return fmt.Errorf("audit export failed after entry %d: %w", after, err)
+		}
+
+		for i := range entries {
+			if err := enc.Encode(&entries[i]); err != nil {
+				return err
+			}
+			after = uint64(entries[i].ID)
+		}
+		c.Response().Flush()
+
+		if len(entries) < auditExportBatch {
+			return nil
+		}
+	}
+}
+
+// auditAdmin records a change an admin made through the api
+func (s *Shuttle) auditAdmin(c echo.Context, action string, content uint, err error) {
+	e := &AuditEntry{Actor: auditActorAdmin, Action: action, Content: content}
+	if u, ok := c.Get("user").(*User); ok {
+		e.UserID = u.ID
+	}
+	s.audit(e, err)
+}
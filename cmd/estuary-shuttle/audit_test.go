@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditCommandContents(t *testing.T) {
+	contents, ok := auditCommandContents(&drpc.Command{
+		Op:     drpc.CMD_UnpinContent,
+		Params: drpc.CmdParams{UnpinContent: &drpc.UnpinContent{Contents: []uint{4, 5}}},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, []uint{4, 5}, contents)
+
+	contents, ok = auditCommandContents(&drpc.Command{
+		Op:     drpc.CMD_StartTransfer,
+		Params: drpc.CmdParams{StartTransfer: &drpc.StartTransfer{ContentID: 7}},
+	})
+	assert.True(t, ok)
+	assert.Equal(t, []uint{7}, contents)
+
+	_, ok = auditCommandContents(&drpc.Command{Op: drpc.CMD_SetPinWorkers})
+	assert.False(t, ok)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"gorm.io/gorm"
+)
+
+// backfillCmd checks the object tracking of the active pins, or only of the
+// given contents, against their dags in the blockstore and regenerates the
+// objects and refs of the pins where they dont match. It is run with the
+// node stopped, so nothing else touches the pins meanwhile.
+func backfillCmd(ctx context.Context, cfg *config.Shuttle, contents []uint, dryRun bool) error {
+	s, closer, err := openOfflineShuttle(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	var checked, fixed, failed int
+	q := s.DB.Model(Pin{}).Where("active and tier = ?", tierHot)
+	if len(contents) > 0 {
+		q = q.Where("content in ?", contents)
+	}
+
+	var pins []Pin
+	err = q.FindInBatches(&pins, 100, func(tx *gorm.DB, batch int) error {
+		for _, pin := range pins {
+			checked++
+			res, err := s.backfillPin(ctx, pin, dryRun)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				fmt.Printf("content %d: %s\n", pin.Content, err)
+				failed++
+				continue
+			}
+			if res == nil {
+				continue
+			}
+
+			fixed++
+			fmt.Printf("content %d: %d refs tracked, %d blocks in dag (%d bytes, was %d)\n",
+				pin.Content, res.Tracked, res.Objects, res.Size, pin.Size)
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	verb := "regenerated"
+	if dryRun {
+		verb = "would regenerate"
+	}
+	fmt.Printf("checked %d pins, %s tracking of %d\n", checked, verb, fixed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d pins could not be walked, if the node ran with a write log run verify-wal --repair first", failed)
+	}
+	return nil
+}
+
+type backfillResult struct {
+	// Tracked is the number of refs the pin had, Objects and Size are what
+	// its dag holds
+	Tracked int
+	Objects int
+	Size    int64
+}
+
+// backfillPin walks the dag of pin in the local blockstore and compares it to
+// the objects tracked for the pin. If they differ, the refs of the pin are
+// replaced by new objects for its dag and its size is updated, unless dryRun
+// is set. It returns nil if the tracking was right.
+func (s *Shuttle) backfillPin(ctx context.Context, pin Pin, dryRun bool) (*backfillResult, error) {
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+
+	var objects []*Object
+	var size int64
+	cset := cid.NewSet()
+	err := merkledag.WalkDepth(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		nd, err := dserv.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, &Object{
+			Cid:  util.DbCID{CID: c},
+			Size: len(nd.RawData()),
+		})
+		size += int64(len(nd.RawData()))
+
+		if c.Type() == cid.Raw {
+			return nil, nil
+		}
+		return util.FilterUnwalkableLinks(nd.Links()), nil
+	}, pin.Cid.CID, func(c cid.Cid, depth int) bool {
+		if pin.MaxDepth > 0 && depth >= pin.MaxDepth {
+			return false
+		}
+		return cset.Visit(c)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk dag: %w", err)
+	}
+
+	// refs to objects that are gone are counted, but do not join
+	var refs int64
+	if err := s.DB.Model(ObjRef{}).Where("pin = ?", pin.ID).Count(&refs).Error; err != nil {
+		return nil, err
+	}
+
+	var tracked []*Object
+	if err := s.DB.Model(ObjRef{}).Where("pin = ?", pin.ID).
+		Joins("join objects on obj_refs.object = objects.id").
+		Select("objects.*").
+		Scan(&tracked).Error; err != nil {
+		return nil, err
+	}
+
+	if int(refs) == len(tracked) && trackingMatches(tracked, cset) && pin.Size == size {
+		return nil, nil
+	}
+
+	res := &backfillResult{
+		Tracked: int(refs),
+		Objects: len(objects),
+		Size:    size,
+	}
+	if dryRun {
+		return res, nil
+	}
+
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("pin = ?", pin.ID).Delete(ObjRef{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.CreateInBatches(objects, 300).Error; err != nil {
+			return err
+		}
+
+		refs := make([]ObjRef, len(objects))
+		for i := range refs {
+			refs[i].Pin = pin.ID
+			refs[i].Object = objects[i].ID
+		}
+		if err := tx.CreateInBatches(refs, 500).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumn("size", size).Error
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := s.clearUnreferencedObjects(ctx, tracked); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// trackingMatches reports whether the tracked objects are exactly the blocks
+// in cset, once each
+func trackingMatches(tracked []*Object, cset *cid.Set) bool {
+	if len(tracked) != cset.Len() {
+		return false
+	}
+
+	seen := cid.NewSet()
+	for _, o := range tracked {
+		if !cset.Has(o.Cid.CID) || !seen.Visit(o.Cid.CID) {
+			return false
+		}
+	}
+	return true
+}
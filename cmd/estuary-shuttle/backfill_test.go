@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackfillPin(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	leaf := merkledag.NewRawNode([]byte("leaf"))
+	root := &merkledag.ProtoNode{}
+	require.NoError(t, root.AddNodeLink("leaf", leaf))
+	addTestPin(t, s, 1, root, leaf)
+	size := int64(len(root.RawData()) + len(leaf.RawData()))
+	require.NoError(t, s.DB.Model(Pin{}).Where("content = ?", 1).UpdateColumn("size", size).Error)
+
+	var pin Pin
+	require.NoError(t, s.DB.First(&pin, "content = ?", 1).Error)
+
+	res, err := s.backfillPin(ctx, pin, false)
+	require.NoError(t, err)
+	assert.Nil(t, res, "pins tracked right are left alone")
+
+	// a ref left pointing at an object that is gone
+	require.NoError(t, s.DB.Where("cid = ?", util.DbCID{CID: leaf.Cid()}).Delete(Object{}).Error)
+
+	res, err = s.backfillPin(ctx, pin, true)
+	require.NoError(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, 2, res.Tracked)
+	assert.Equal(t, 2, res.Objects)
+
+	res, err = s.backfillPin(ctx, pin, false)
+	require.NoError(t, err)
+	require.NotNil(t, res)
+
+	objs, err := s.objectsForPin(ctx, pin.ID)
+	require.NoError(t, err)
+	assert.Len(t, objs, 2)
+
+	var total int64
+	require.NoError(t, s.DB.Model(Object{}).Count(&total).Error)
+	assert.Equal(t, int64(2), total, "objects replaced by the backfill are cleared")
+
+	res, err = s.backfillPin(ctx, pin, false)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+}
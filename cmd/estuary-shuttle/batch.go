@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// maxBatchFiles bounds the files of one batch add
+const maxBatchFiles = 1000
+
+// addBatch adds every file as its own content, or none of them. All files
+// are imported before any content is registered, and if registering one of
+// them fails the contents registered before it are removed again.
+func (s *Shuttle) addBatch(ctx context.Context, u *User, files []*multipart.FileHeader, cic util.ContentInCollection, params util.ImportParams, opts addOptions) (_ []*util.ContentAddResponse, err error) {
+	ae := &AuditEntry{Actor: auditActorUser, UserID: u.ID, Action: "add-batch"}
+	defer func() {
+		s.audit(ae, err)
+	}()
+
+	st, err := s.newStagedImport()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		st.finish(err == nil)
+	}()
+
+	roots := make([]cid.Cid, len(files))
+	for i, mpf := range files {
+		fi, err := mpf.Open()
+		if err != nil {
+			return nil, err
+		}
+		nd, err := s.importFile(ctx, st.dserv, fi, params)
+		fi.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to import %s: %w", mpf.Filename, err)
+		}
+		roots[i] = nd.Cid()
+	}
+
+	var contids []uint
+	defer func() {
+		if err != nil && len(contids) > 0 {
+			s.rollbackBatch(u, contids)
+		}
+	}()
+	for i, root := range roots {
+		contid, err := s.registerContent(ctx, u, st, root, files[i].Filename, cic, opts)
+		if contid != 0 {
+			contids = append(contids, contid)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to add %s: %w", files[i].Filename, err)
+		}
+	}
+
+	if err := s.storeStaged(ctx, st); err != nil {
+		return nil, err
+	}
+
+	resps := make([]*util.ContentAddResponse, len(roots))
+	for i, root := range roots {
+		s.announceContent(ctx, root, contids[i])
+		resps[i] = s.contentAddResponse(root, contids[i], false)
+	}
+	return resps, nil
+}
+
+// rollbackBatch removes the contents a failed batch registered, here and on
+// the primary
+func (s *Shuttle) rollbackBatch(u *User, contids []uint) {
+	ctx := context.Background()
+	for _, contid := range contids {
+		if err := s.Unpin(ctx, contid); err != nil && !xerrors.Is(err, gorm.ErrRecordNotFound) {
+			log.Errorw("failed to unpin content of failed batch", "content", contid, "err", err)
+		}
+		if err := s.primaryAPI(ctx, u, "DELETE", fmt.Sprintf("/pinning/pins/%d", contid), nil, nil); err != nil {
+			log.Errorw("failed to remove content of failed batch from the primary", "content", contid, "err", err)
+		}
+	}
+}
+
+// handleAddBatch godoc
+// @Summary      Upload several files at once
+// @Description  This endpoint adds each file of the multipart request, given as data fields, as its own content. Either all of them are added or none are, a batch that fails part way leaves nothing behind. Contents the user already has are added again rather than reused.
+// @Tags         content
+// @Accept       multipart/form-data
+// @Produce      json
+// @Param        data  formData  file  true  "Files to upload"
+// @Router       /content/add-batch [post]
+func (s *Shuttle) handleAddBatch(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	if err := util.ErrorIfContentAddingDisabled(u.StorageDisabled || s.addingDisabled()); err != nil {
+		return err
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return err
+	}
+	defer form.RemoveAll()
+
+	files := form.File["data"]
+	if len(files) == 0 || len(files) > maxBatchFiles {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("a batch needs between 1 and %d files, got %d", maxBatchFiles, len(files)),
+		}
+	}
+
+	for _, mpf := range files {
+		if !u.FlagSplitContent() && mpf.Size > constants.DefaultContentSizeLimit {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_CONTENT_SIZE_OVER_LIMIT,
+				Details: fmt.Sprintf("%s is %d bytes, over the upload size limit of %d bytes, and content splitting is not enabled", mpf.Filename, mpf.Size, constants.DefaultContentSizeLimit),
+			}
+		}
+	}
+
+	cic, err := collectionFromParams(c.QueryParam)
+	if err != nil {
+		return err
+	}
+	if cic.CollectionPath != "" && !strings.HasSuffix(cic.CollectionPath, "/") {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "the collection path of a batch must be a directory ending in /",
+		}
+	}
+
+	params, err := s.importParamsFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	opts, err := parseAddOptions(func(key string) string {
+		return firstNonEmpty(c.QueryParam(key), c.FormValue(key))
+	})
+	if err != nil {
+		return err
+	}
+
+	resps, err := s.addBatch(ctx, u, files, cic, params, opts)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resps)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePrimary creates contents and records the pins removed, creating the
+// content of a file named fail.txt fails
+type fakePrimary struct {
+	lk      sync.Mutex
+	next    uint
+	created []string
+	deleted []string
+}
+
+func (fp *fakePrimary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fp.lk.Lock()
+	defer fp.lk.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/content/create":
+		var body util.ContentCreateBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "fail.txt" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fp.next++
+		fp.created = append(fp.created, body.Name)
+		_ = json.NewEncoder(w).Encode(&util.ContentCreateResponse{ID: fp.next})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/pinning/pins/"):
+		fp.deleted = append(fp.deleted, strings.TrimPrefix(r.URL.Path, "/pinning/pins/"))
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func batchFiles(t *testing.T, names ...string) []*multipart.FileHeader {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, name := range names {
+		fw, err := mw.CreateFormFile("data", name)
+		require.NoError(t, err)
+		_, err = fw.Write([]byte("contents of " + name))
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+
+	form, err := multipart.NewReader(&buf, mw.Boundary()).ReadForm(1 << 20)
+	require.NoError(t, err)
+	t.Cleanup(func() { form.RemoveAll() })
+	return form.File["data"]
+}
+
+func newBatchTestShuttle(t *testing.T) (*Shuttle, *fakePrimary) {
+	fp := &fakePrimary{}
+	srv := httptest.NewServer(fp)
+	t.Cleanup(srv.Close)
+
+	s := newTestShuttle(t)
+	s.Node.Config = &config.Node{Provider: config.Provider{Strategy: config.ProvideDisabled}}
+	s.shuttleConfig.Content.StreamingImport = true
+	s.primaries = newPrimarySet(strings.TrimPrefix(srv.URL, "http://"))
+	s.resend = newResendQueue(datastore.NewMapDatastore())
+	s.dev = true
+	return s, fp
+}
+
+func TestAddBatch(t *testing.T) {
+	s, fp := newBatchTestShuttle(t)
+
+	resps, err := s.addBatch(context.Background(), &User{ID: 1}, batchFiles(t, "a.txt", "b.txt"), util.ContentInCollection{}, util.ImportParams{}, addOptions{})
+	require.NoError(t, err)
+	require.Len(t, resps, 2)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, fp.created)
+	assert.Empty(t, fp.deleted)
+
+	var pins int64
+	require.NoError(t, s.DB.Model(&Pin{}).Where("active").Count(&pins).Error)
+	assert.Equal(t, int64(2), pins)
+}
+
+func TestAddBatchRollsBack(t *testing.T) {
+	s, fp := newBatchTestShuttle(t)
+
+	_, err := s.addBatch(context.Background(), &User{ID: 1}, batchFiles(t, "a.txt", "b.txt", "fail.txt"), util.ContentInCollection{}, util.ImportParams{}, addOptions{})
+	require.Error(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt"}, fp.created)
+	assert.Equal(t, []string{"1", "2"}, fp.deleted, "the contents registered before the failure were kept on the primary")
+
+	var pins, objs int64
+	require.NoError(t, s.DB.Model(&Pin{}).Count(&pins).Error)
+	require.NoError(t, s.DB.Model(&Object{}).Count(&objs).Error)
+	assert.Zero(t, pins)
+	assert.Zero(t, objs)
+
+	keys, err := s.Node.Blockstore.AllKeysChan(context.Background())
+	require.NoError(t, err)
+	for k := range keys {
+		t.Errorf("block %s of the failed batch was left behind", k)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+)
+
+const (
+	carExportQueued  = "queued"
+	carExportRunning = "running"
+	carExportDone    = "done"
+	carExportFailed  = "failed"
+)
+
+// carExportCleanInterval is how often the files of expired exports are
+// removed
+const carExportCleanInterval = 10 * time.Minute
+
+type carExportFile struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Roots int    `json:"roots"`
+
+	// URL downloads the file from this shuttle without a token until the
+	// export expires
+	URL string `json:"url,omitempty"`
+}
+
+// carExport writes all of the pinned content of a user to car files
+type carExport struct {
+	ID     uint64 `json:"id"`
+	userID uint
+
+	Status  string    `json:"status"`
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+
+	// Pins is how many pins are exported, Exported how many of them were
+	// written so far and Bytes the size of the finished files
+	Pins     int   `json:"pins"`
+	Exported int   `json:"exported"`
+	Bytes    int64 `json:"bytes"`
+
+	Files []carExportFile `json:"files,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// carExports keeps the exports in memory like urlFetches. The download urls
+// are signed with a key made when the first export starts, so they end with
+// the exports on restart, and the cleaner removes the files left behind.
+type carExports struct {
+	lk      sync.Mutex
+	next    uint64
+	exports map[uint64]*carExport
+	key     []byte
+
+	// running makes the exports run one after the other
+	running sync.Mutex
+}
+
+func (ce *carExports) start(uid uint, now time.Time) (*carExport, error) {
+	ce.lk.Lock()
+	defer ce.lk.Unlock()
+
+	if ce.key == nil {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		ce.key = key
+	}
+	if ce.exports == nil {
+		ce.exports = make(map[uint64]*carExport)
+	}
+
+	for _, e := range ce.exports {
+		if e.userID == uid && (e.Status == carExportQueued || e.Status == carExportRunning) {
+			return nil, &util.HttpError{
+				Code:    http.StatusConflict,
+				Reason:  util.ERR_EXPORT_IN_PROGRESS,
+				Details: fmt.Sprintf("export %d is not done yet", e.ID),
+			}
+		}
+	}
+
+	ce.next++
+	e := &carExport{ID: ce.next, userID: uid, Status: carExportQueued, Started: now}
+	ce.exports[e.ID] = e
+	return e, nil
+}
+
+// get returns a copy of the export with the download urls of its files, nil
+// if the user has no such export
+func (ce *carExports) get(uid uint, id uint64) *carExport {
+	ce.lk.Lock()
+	defer ce.lk.Unlock()
+
+	e, ok := ce.exports[id]
+	if !ok || e.userID != uid {
+		return nil
+	}
+	cp := *e
+	cp.Files = append([]carExportFile(nil), e.Files...)
+	if e.Status == carExportDone {
+		for i, f := range cp.Files {
+			expires := e.Expires.Unix()
+			cp.Files[i].URL = fmt.Sprintf("/export/%d/%s?expires=%d&sig=%s", e.ID, f.Name, expires, ce.sign(e.ID, f.Name, expires))
+		}
+	}
+	return &cp
+}
+
+func (ce *carExports) update(e *carExport, f func(*carExport)) {
+	ce.lk.Lock()
+	defer ce.lk.Unlock()
+	f(e)
+}
+
+// sign returns the signature of the download url of an export file, the
+// caller holds lk
+func (ce *carExports) sign(id uint64, name string, expires int64) string {
+	mac := hmac.New(sha256.New, ce.key)
+	fmt.Fprintf(mac, "%d/%s/%d", id, name, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// download checks the signature of a download url and returns the file of
+// the export it points at
+func (ce *carExports) download(id uint64, name string, expires int64, sig string, now time.Time) (*carExportFile, bool) {
+	ce.lk.Lock()
+	defer ce.lk.Unlock()
+
+	e, ok := ce.exports[id]
+	if !ok || e.Status != carExportDone || ce.key == nil {
+		return nil, false
+	}
+	if expires != e.Expires.Unix() || !now.Before(e.Expires) {
+		return nil, false
+	}
+	if !hmac.Equal([]byte(sig), []byte(ce.sign(id, name, expires))) {
+		return nil, false
+	}
+	for _, f := range e.Files {
+		if f.Name == name {
+			return &f, true
+		}
+	}
+	return nil, false
+}
+
+// expire forgets the exports whose files expired, and failed exports after a
+// day. It returns the ids of the exports that are kept.
+func (ce *carExports) expire(now time.Time) map[uint64]bool {
+	ce.lk.Lock()
+	defer ce.lk.Unlock()
+
+	live := make(map[uint64]bool)
+	for id, e := range ce.exports {
+		switch {
+		case e.Status == carExportDone && !now.Before(e.Expires):
+			delete(ce.exports, id)
+		case e.Status == carExportFailed && now.Sub(e.Ended) > urlFetchKeep:
+			delete(ce.exports, id)
+		default:
+			live[id] = true
+		}
+	}
+	return live
+}
+
+// planCarExport splits the pins of an export into car files, starting
+// another file where the pins of the current one would pass maxSize. Pins
+// are never split, a pin larger than maxSize gets a file of its own.
+func planCarExport(pins []Pin, maxSize int64) [][]Pin {
+	var files [][]Pin
+	var cur []Pin
+	var size int64
+	for _, pin := range pins {
+		if len(cur) > 0 && size+pin.Size > maxSize {
+			files = append(files, cur)
+			cur, size = nil, 0
+		}
+		cur = append(cur, pin)
+		size += pin.Size
+	}
+	if len(cur) > 0 {
+		files = append(files, cur)
+	}
+	return files
+}
+
+// exportBlock reads a block of exported content. Tiered content is read
+// from the cold store without bringing it back.
+func (s *Shuttle) exportBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := s.Node.Blockstore.Get(ctx, c)
+	if xerrors.Is(err, blockstore.ErrNotFound) && s.coldStore != nil {
+		return s.coldStore.Get(ctx, c)
+	}
+	return blk, err
+}
+
+// writeExportCar writes the pins to a car file with their roots as the roots
+// of the car, calling done after each pin. Blocks shared by pins are written
+// once.
+func (s *Shuttle) writeExportCar(ctx context.Context, path string, pins []Pin, done func()) (int64, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".export-")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	roots := make([]cid.Cid, 0, len(pins))
+	for _, pin := range pins {
+		roots = append(roots, pin.Cid.CID)
+	}
+
+	bw := bufio.NewWriterSize(tmp, 1<<20)
+	if err := car.WriteHeader(&car.CarHeader{Roots: roots, Version: 1}, bw); err != nil {
+		return 0, err
+	}
+
+	seen := cid.NewSet()
+	for _, pin := range pins {
+		objs, err := s.objectsForPin(ctx, pin.ID)
+		if err != nil {
+			return 0, err
+		}
+		for _, o := range objs {
+			if !seen.Visit(o.Cid.CID) {
+				continue
+			}
+			blk, err := s.exportBlock(ctx, o.Cid.CID)
+			if err != nil {
+				return 0, fmt.Errorf("failed to read block %s of content %d: %w", o.Cid.CID, pin.Content, err)
+			}
+			if err := carutil.LdWrite(bw, o.Cid.CID.Bytes(), blk.RawData()); err != nil {
+				return 0, err
+			}
+		}
+		done()
+	}
+
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	fi, err := tmp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// runCarExport writes the completed pins of the user to the car files of
+// the export, the aggregates holding them are left out
+func (s *Shuttle) runCarExport(ctx context.Context, e *carExport) error {
+	s.carExports.running.Lock()
+	defer s.carExports.running.Unlock()
+
+	var pins []Pin
+	if err := s.readDB().Where("user_id = ? and active and not aggregate", e.userID).Order("id asc").Find(&pins).Error; err != nil {
+		return err
+	}
+	s.carExports.update(e, func(e *carExport) {
+		e.Status = carExportRunning
+		e.Pins = len(pins)
+	})
+
+	dir := filepath.Join(s.shuttleConfig.CarExport.Dir, strconv.FormatUint(e.ID, 10))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for i, filePins := range planCarExport(pins, s.shuttleConfig.CarExport.MaxCarSize) {
+		name := fmt.Sprintf("export-%d-%d.car", e.ID, i+1)
+		size, err := s.writeExportCar(ctx, filepath.Join(dir, name), filePins, func() {
+			s.carExports.update(e, func(e *carExport) {
+				e.Exported++
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		s.carExports.update(e, func(e *carExport) {
+			e.Bytes += size
+			e.Files = append(e.Files, carExportFile{Name: name, Size: size, Roots: len(filePins)})
+		})
+	}
+	return nil
+}
+
+// runCarExportCleaner removes the files of expired exports, and the ones
+// left behind by exports from before the last restart
+func (s *Shuttle) runCarExportCleaner() {
+	for {
+		if err := s.cleanCarExports(time.Now()); err != nil {
+			log.Errorf("failed to clean up content exports: %s", err)
+		}
+
+		time.Sleep(carExportCleanInterval)
+		if s.isShuttingDown() {
+			return
+		}
+	}
+}
+
+func (s *Shuttle) cleanCarExports(now time.Time) error {
+	live := s.carExports.expire(now)
+
+	entries, err := ioutil.ReadDir(s.shuttleConfig.CarExport.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, ent := range entries {
+		id, err := strconv.ParseUint(ent.Name(), 10, 64)
+		if err == nil && live[id] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.shuttleConfig.CarExport.Dir, ent.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleStartCarExport godoc
+// @Summary      Export all content as car files
+// @Description  This endpoint writes all of the content the user has pinned on this shuttle to one or more car files in the background, the roots of each car are the contents in it. It returns right away, the export is followed with the returned id and the files are downloaded from the urls it lists once it is done.
+// @Tags         content
+// @Produce      json
+// @Router       /content/export [post]
+func (s *Shuttle) handleStartCarExport(c echo.Context, u *User) error {
+	if s.shuttleConfig.CarExport.MaxCarSize == 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "content exports are disabled on this shuttle",
+		}
+	}
+
+	e, err := s.carExports.start(u.ID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := s.runCarExport(context.Background(), e)
+		if err != nil {
+			log.Warnw("failed to export content", "user", u.ID, "export", e.ID, "err", err)
+		}
+		s.carExports.update(e, func(e *carExport) {
+			e.Ended = time.Now()
+			e.Status = carExportDone
+			e.Expires = e.Ended.Add(s.shuttleConfig.CarExport.Expiry)
+			if err != nil {
+				e.Status = carExportFailed
+				e.Error = err.Error()
+				e.Expires = time.Time{}
+			}
+		})
+	}()
+
+	return c.JSON(http.StatusAccepted, s.carExports.get(u.ID, e.ID))
+}
+
+// handleGetCarExport godoc
+// @Summary      Follow a content export
+// @Description  This endpoint returns how many of the pins an export wrote so far, and once it is done the car files with urls to download them from this shuttle until the export expires
+// @Tags         content
+// @Produce      json
+// @Param        id  path  int  true  "Export id"
+// @Router       /content/export/{id} [get]
+func (s *Shuttle) handleGetCarExport(c echo.Context, u *User) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid export id %q", c.Param("id")),
+		}
+	}
+
+	e := s.carExports.get(u.ID, id)
+	if e == nil {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_EXPORT_NOT_FOUND,
+			Details: fmt.Sprintf("no export %d", id),
+		}
+	}
+	return c.JSON(http.StatusOK, e)
+}
+
+// handleDownloadCarExport serves the car files of finished exports, the
+// signed url stands in for the token
+func (s *Shuttle) handleDownloadCarExport(c echo.Context) error {
+	id, idErr := strconv.ParseUint(c.Param("id"), 10, 64)
+	expires, expErr := strconv.ParseInt(c.QueryParam("expires"), 10, 64)
+
+	var f *carExportFile
+	ok := idErr == nil && expErr == nil
+	if ok {
+		f, ok = s.carExports.download(id, c.Param("file"), expires, c.QueryParam("sig"), time.Now())
+	}
+	if !ok {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: "the download url is invalid or expired",
+		}
+	}
+
+	return c.Attachment(filepath.Join(s.shuttleConfig.CarExport.Dir, strconv.FormatUint(id, 10), f.Name), f.Name)
+}
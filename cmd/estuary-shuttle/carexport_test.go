@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanCarExport(t *testing.T) {
+	pins := []Pin{{ID: 1, Size: 40}, {ID: 2, Size: 50}, {ID: 3, Size: 20}, {ID: 4, Size: 300}, {ID: 5, Size: 10}}
+
+	var ids [][]uint
+	for _, file := range planCarExport(pins, 100) {
+		var fids []uint
+		for _, p := range file {
+			fids = append(fids, p.ID)
+		}
+		ids = append(ids, fids)
+	}
+	assert.Equal(t, [][]uint{{1, 2}, {3}, {4}, {5}}, ids)
+	assert.Empty(t, planCarExport(nil, 100))
+}
+
+func readExportCar(t *testing.T, path string) ([]cid.Cid, []cid.Cid) {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	cr, err := car.NewCarReader(f)
+	require.NoError(t, err)
+
+	var blks []cid.Cid
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		blks = append(blks, blk.Cid())
+	}
+	return cr.Header.Roots, blks
+}
+
+func TestRunCarExport(t *testing.T) {
+	s := newTestShuttle(t)
+	s.shuttleConfig.CarExport.Dir = t.TempDir()
+	s.shuttleConfig.CarExport.MaxCarSize = 10
+
+	shared := blocks.NewBlock([]byte("shared"))
+	a := blocks.NewBlock([]byte("a"))
+	b := blocks.NewBlock([]byte("b"))
+	other := blocks.NewBlock([]byte("other user"))
+	addTestPin(t, s, 1, a, shared)
+	addTestPin(t, s, 2, b, shared)
+	addTestPin(t, s, 3, other)
+	require.NoError(t, s.DB.Model(&Pin{}).Where("content in ?", []uint{1, 2}).Updates(map[string]interface{}{"user_id": 1, "size": 7}).Error)
+	require.NoError(t, s.DB.Model(&Pin{}).Where("content = ?", 3).Update("user_id", 2).Error)
+
+	e, err := s.carExports.start(1, time.Now())
+	require.NoError(t, err)
+	_, err = s.carExports.start(1, time.Now())
+	assert.Error(t, err, "a second export was started while the first one runs")
+
+	require.NoError(t, s.runCarExport(context.Background(), e))
+	assert.Equal(t, 2, e.Pins)
+	assert.Equal(t, 2, e.Exported)
+	require.Len(t, e.Files, 2)
+
+	dir := filepath.Join(s.shuttleConfig.CarExport.Dir, strconv.FormatUint(e.ID, 10))
+	roots, blks := readExportCar(t, filepath.Join(dir, e.Files[0].Name))
+	assert.Equal(t, []cid.Cid{a.Cid()}, roots)
+	assert.ElementsMatch(t, []cid.Cid{a.Cid(), shared.Cid()}, blks)
+
+	roots, blks = readExportCar(t, filepath.Join(dir, e.Files[1].Name))
+	assert.Equal(t, []cid.Cid{b.Cid()}, roots)
+	assert.ElementsMatch(t, []cid.Cid{b.Cid(), shared.Cid()}, blks)
+
+	assert.Equal(t, e.Files[0].Size+e.Files[1].Size, e.Bytes)
+}
+
+func TestCarExportDownloadURL(t *testing.T) {
+	s := newTestShuttle(t)
+	s.shuttleConfig.CarExport.Dir = t.TempDir()
+
+	now := time.Now()
+	e, err := s.carExports.start(1, now)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(s.shuttleConfig.CarExport.Dir, strconv.FormatUint(e.ID, 10)), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(s.shuttleConfig.CarExport.Dir, "99"), 0755))
+
+	assert.Empty(t, s.carExports.get(1, e.ID).Files)
+	assert.Nil(t, s.carExports.get(2, e.ID), "another user sees the export")
+
+	s.carExports.update(e, func(e *carExport) {
+		e.Status = carExportDone
+		e.Expires = now.Add(time.Hour)
+		e.Files = []carExportFile{{Name: "export-1-1.car"}}
+	})
+
+	u, err := url.Parse(s.carExports.get(1, e.ID).Files[0].URL)
+	require.NoError(t, err)
+	assert.Equal(t, "/export/1/export-1-1.car", u.Path)
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	require.NoError(t, err)
+	sig := u.Query().Get("sig")
+
+	_, ok := s.carExports.download(e.ID, "export-1-1.car", expires, sig, now)
+	assert.True(t, ok)
+	_, ok = s.carExports.download(e.ID, "export-1-2.car", expires, sig, now)
+	assert.False(t, ok, "the signature is good for another file")
+	_, ok = s.carExports.download(e.ID, "export-1-1.car", expires+3600, sig, now)
+	assert.False(t, ok, "the expiry can be pushed out")
+	_, ok = s.carExports.download(e.ID, "export-1-1.car", expires, sig, now.Add(2*time.Hour))
+	assert.False(t, ok, "an expired url is served")
+
+	// the cleaner keeps the export that has not expired and removes what is
+	// left of others, then the files of the expired one
+	require.NoError(t, s.cleanCarExports(now))
+	entries, err := os.ReadDir(s.shuttleConfig.CarExport.Dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "1", entries[0].Name())
+
+	require.NoError(t, s.cleanCarExports(now.Add(2*time.Hour)))
+	entries, err = os.ReadDir(s.shuttleConfig.CarExport.Dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Nil(t, s.carExports.get(1, e.ID))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/application-research/estuary/util"
+)
+
+// collectionFromParams reads the collection an upload is added to. The
+// collectionPath parameter is where the content lands in the collection, a
+// path ending in / is the directory it is put in under its own name. The
+// older dir parameter always names the directory.
+func collectionFromParams(param func(string) string) (util.ContentInCollection, error) {
+	cic := util.ContentInCollection{CollectionID: param(ColUuid)}
+
+	p := param(ColPath)
+	if p == "" {
+		if dir := param(ColDir); dir != "" {
+			p = strings.TrimSuffix(dir, "/") + "/"
+		}
+	}
+	if p == "" {
+		return cic, nil
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		return cic, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid collection path %q, must start with /", p),
+		}
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." || seg == "." {
+			return cic, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid collection path %q, must not have . or .. in it", p),
+			}
+		}
+	}
+
+	cic.CollectionPath = p
+	return cic, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectionFromParams(t *testing.T) {
+	params := func(kv ...string) func(string) string {
+		m := make(map[string]string)
+		for i := 0; i < len(kv); i += 2 {
+			m[kv[i]] = kv[i+1]
+		}
+		return func(key string) string { return m[key] }
+	}
+
+	cic, err := collectionFromParams(params(ColUuid, "col", ColPath, "/photos/2023/"))
+	require.NoError(t, err)
+	assert.Equal(t, "col", cic.CollectionID)
+	assert.Equal(t, "/photos/2023/", cic.CollectionPath)
+
+	cic, err = collectionFromParams(params(ColUuid, "col", ColPath, "/photos/2023/beach.jpg"))
+	require.NoError(t, err)
+	assert.Equal(t, "/photos/2023/beach.jpg", cic.CollectionPath)
+
+	// dir always names a directory
+	cic, err = collectionFromParams(params(ColUuid, "col", ColDir, "/photos"))
+	require.NoError(t, err)
+	assert.Equal(t, "/photos/", cic.CollectionPath)
+
+	cic, err = collectionFromParams(params(ColUuid, "col", ColDir, "/photos", ColPath, "/docs/"))
+	require.NoError(t, err)
+	assert.Equal(t, "/docs/", cic.CollectionPath)
+
+	cic, err = collectionFromParams(params(ColUuid, "col"))
+	require.NoError(t, err)
+	assert.Empty(t, cic.CollectionPath)
+
+	for _, p := range []string{"photos/", "/photos/../../etc/", "/./x"} {
+		_, err := collectionFromParams(params(ColUuid, "col", ColPath, p))
+		assert.Error(t, err, p)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PieceCommRecord keeps the piece commitment computed for a dag, so it
+// survives restarts instead of being recomputed
+type PieceCommRecord struct {
+	Data    util.DbCID `gorm:"unique"`
+	Piece   util.DbCID
+	CarSize uint64
+	Size    abi.UnpaddedPieceSize
+}
+
+// validate checks that the record holds an unsealed piece commitment with a
+// valid piece size
+func (pcr *PieceCommRecord) validate() error {
+	if !pcr.Piece.CID.Defined() {
+		return fmt.Errorf("piece cid is undefined")
+	}
+
+	pref := pcr.Piece.CID.Prefix()
+	if pref.Codec != cid.FilCommitmentUnsealed || pref.MhType != multihash.SHA2_256_TRUNC254_PADDED {
+		return fmt.Errorf("%s is not a piece commitment", pcr.Piece.CID)
+	}
+
+	if err := pcr.Size.Validate(); err != nil {
+		return err
+	}
+
+	if pcr.CarSize == 0 || pcr.CarSize > uint64(pcr.Size) {
+		return fmt.Errorf("car size %d does not fit piece size %d", pcr.CarSize, pcr.Size)
+	}
+	return nil
+}
+
+// lookupPieceCommRecord returns the stored piece commitment of data, or nil if
+// there is none. Records that fail validation are removed so the commitment
+// gets computed again.
+func lookupPieceCommRecord(db *gorm.DB, data cid.Cid) (*commpResult, error) {
+	var pcrs []PieceCommRecord
+	if err := db.Find(&pcrs, "data = ?", data.Bytes()).Error; err != nil {
+		return nil, err
+	}
+
+	if len(pcrs) == 0 {
+		return nil, nil
+	}
+
+	pcr := pcrs[0]
+	if err := pcr.validate(); err != nil {
+		log.Warnf("dropping invalid piece commitment record for %s: %s", data, err)
+		if err := db.Delete(&PieceCommRecord{}, "data = ?", data.Bytes()).Error; err != nil {
+			return nil, xerrors.Errorf("failed to delete invalid piece commitment record: %w", err)
+		}
+		return nil, nil
+	}
+
+	return &commpResult{
+		CommP:   pcr.Piece.CID,
+		Size:    pcr.Size,
+		CarSize: pcr.CarSize,
+	}, nil
+}
+
+func savePieceCommRecord(db *gorm.DB, data cid.Cid, res *commpResult) error {
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&PieceCommRecord{
+		Data:    util.DbCID{CID: data},
+		Piece:   util.DbCID{CID: res.CommP},
+		CarSize: res.CarSize,
+		Size:    res.Size,
+	}).Error
+}
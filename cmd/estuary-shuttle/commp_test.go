@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-state-types/abi"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPieceCommRecords(t *testing.T) {
+	s := newTestShuttle(t)
+
+	mh, err := multihash.Encode(make([]byte, 32), multihash.SHA2_256_TRUNC254_PADDED)
+	require.NoError(t, err)
+	piece := cid.NewCidV1(cid.FilCommitmentUnsealed, mh)
+
+	data := blocks.NewBlock([]byte("data")).Cid()
+	res, err := lookupPieceCommRecord(s.DB, data)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	want := &commpResult{CommP: piece, Size: abi.PaddedPieceSize(2048).Unpadded(), CarSize: 1500}
+	require.NoError(t, savePieceCommRecord(s.DB, data, want))
+
+	res, err = lookupPieceCommRecord(s.DB, data)
+	require.NoError(t, err)
+	assert.Equal(t, want, res)
+
+	// a record that isnt a valid piece commitment is dropped
+	bad := blocks.NewBlock([]byte("bad")).Cid()
+	require.NoError(t, s.DB.Create(&PieceCommRecord{
+		Data:    util.DbCID{CID: bad},
+		Piece:   util.DbCID{CID: data},
+		CarSize: 1500,
+		Size:    abi.PaddedPieceSize(2048).Unpadded(),
+	}).Error)
+
+	res, err = lookupPieceCommRecord(s.DB, bad)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	var count int64
+	require.NoError(t, s.DB.Model(PieceCommRecord{}).Where("data = ?", bad.Bytes()).Count(&count).Error)
+	assert.Zero(t, count)
+}
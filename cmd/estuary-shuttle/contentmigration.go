@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/util"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// takeContent pins content that is moving here from another shuttle. It is
+// fetched straight from the sources, and the shuttle it came from is told to
+// release it once all of it is here.
+func (d *Shuttle) takeContent(ctx context.Context, c drpc.ContentFetch, sources []peer.AddrInfo) error {
+	peers := make([]*peer.AddrInfo, 0, len(sources))
+	for i := range sources {
+		peers = append(peers, &sources[i])
+	}
+
+	var origins string
+	if len(peers) > 0 {
+		b, err := json.Marshal(peers)
+		if err != nil {
+			return err
+		}
+		origins = string(b)
+	}
+
+	// the pin is recorded with where it comes from before it is queued, so
+	// the pin completing can't miss it
+	pin := &Pin{
+		Content:      c.ID,
+		Cid:          util.DbCID{CID: c.Cid},
+		UserID:       c.UserID,
+		Pinning:      true,
+		Priority:     int(pinner.PriorityBackfill),
+		SkipLimiter:  true,
+		Origins:      origins,
+		QueuedAt:     time.Now(),
+		MigratedFrom: c.Location,
+	}
+	if err := d.DB.Create(pin).Error; err != nil {
+		return err
+	}
+
+	// content moved over from other nodes should not hold up new pins
+	return d.addPin(ctx, c.ID, c.Cid, c.UserID, peers, true, pinner.PriorityBackfill, 0)
+}
+
+// verifyLocal checks that all objects of a pin are in the blockstore, before
+// the copy it was taken from is released
+func (d *Shuttle) verifyLocal(ctx context.Context, objects []*Object) error {
+	for _, o := range objects {
+		has, err := d.Node.Blockstore.Has(ctx, o.Cid.CID)
+		if err != nil {
+			return err
+		}
+		if !has {
+			return fmt.Errorf("block %s of migrated content is missing", o.Cid.CID)
+		}
+	}
+	return nil
+}
+
+// reportMigrated tells the primary that content taken from another shuttle
+// is complete here, so the other shuttle can release it
+func (d *Shuttle) reportMigrated(ctx context.Context, cont uint) {
+	var pin Pin
+	if err := d.DB.Select("migrated_from").First(&pin, "content = ?", cont).Error; err != nil {
+		log.Errorf("failed to look up pin of content %d: %s", cont, err)
+		return
+	}
+	if pin.MigratedFrom == "" {
+		return
+	}
+
+	if err := d.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ContentMigrated,
+		Params: drpc.MsgParams{
+			ContentMigrated: &drpc.ContentMigrated{
+				Content: cont,
+				From:    pin.MigratedFrom,
+			},
+		},
+	}); err != nil {
+		log.Errorf("failed to send content migrated message for content %d: %s", cont, err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyLocal(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	here := blocks.NewBlock([]byte("here"))
+	missing := blocks.NewBlock([]byte("missing"))
+	require.NoError(t, s.Node.Blockstore.Put(ctx, here))
+
+	objs := []*Object{{Cid: util.DbCID{CID: here.Cid()}}}
+	assert.NoError(t, s.verifyLocal(ctx, objs))
+
+	objs = append(objs, &Object{Cid: util.DbCID{CID: missing.Cid()}})
+	assert.Error(t, s.verifyLocal(ctx, objs))
+}
+
+func TestReportMigrated(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.resend = newResendQueue(nil)
+
+	addTestPin(t, s, 1, blocks.NewBlock([]byte("local")))
+	addTestPin(t, s, 2, blocks.NewBlock([]byte("migrated")))
+	require.NoError(t, s.DB.Model(Pin{}).Where("content = ?", 2).Update("migrated_from", "shuttle-1").Error)
+
+	s.reportMigrated(ctx, 1)
+	assert.Equal(t, 0, s.resend.len(), "content that was not migrated was reported")
+
+	s.reportMigrated(ctx, 2)
+	assert.Equal(t, 1, s.resend.len())
+}
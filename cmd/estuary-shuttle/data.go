@@ -1,9 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/pinner/types"
 	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/dbmigrate"
 	"gorm.io/gorm"
 )
 
@@ -15,8 +19,9 @@ type Pin struct {
 	Content uint `gorm:"index"`
 
 	Cid util.DbCID `json:"cid"`
-	//Name        string     `json:"name"`
-	UserID uint `json:"userId" gorm:"index"`
+	// Name is the name given to pins added through the pinning api
+	Name   string `json:"name"`
+	UserID uint   `json:"userId" gorm:"index"`
 	//Description string     `json:"description"`
 	Size   int64 `json:"size"`
 	Active bool  `json:"active"`
@@ -29,9 +34,51 @@ type Pin struct {
 	Pinning bool   `json:"pinning"`
 	PinMeta string `json:"pinMeta"`
 	Failed  bool   `json:"failed"`
+	// Cancelled is set on pins an admin aborted before they completed
+	Cancelled bool `json:"cancelled"`
 
 	DagSplit  bool `json:"dagSplit"`
 	SplitFrom uint `json:"splitFrom"`
+
+	// MaxDepth is the number of levels of the dag pinned, zero for all of it
+	MaxDepth int `json:"maxDepth"`
+
+	// queue state, kept so a restart requeues pins the way they were
+	Priority    int       `json:"priority"`
+	SkipLimiter bool      `json:"skipLimiter"`
+	Origins     string    `json:"origins"`
+	QueuedAt    time.Time `json:"queuedAt"`
+
+	// failed fetches are retried with a backoff until the attempts run out,
+	// RetryAt is set while the pin waits for its next attempt
+	Attempts      int              `json:"attempts"`
+	RetryAt       *time.Time       `json:"retryAt,omitempty" gorm:"index"`
+	AttemptErrors pinAttemptErrors `json:"attemptErrors" gorm:"type:text"`
+
+	// FailureReason is why the last attempt of the pin failed
+	FailureReason types.PinFailureReason `json:"failureReason,omitempty"`
+
+	// Corrupted is set once the integrity check found a block of the pin
+	// that did not match its cid and could not be fetched again
+	Corrupted bool `json:"corrupted,omitempty" gorm:"index"`
+
+	// ExpiresAt is when the content is unpinned on its own, nil to keep it
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" gorm:"index"`
+
+	// Tier says where the blocks of a pin went once its deals sealed, empty
+	// while they are in the main blockstore. TierDeals are the deals they
+	// can be retrieved from.
+	Tier      string       `json:"tier,omitempty"`
+	TierDeals storageDeals `json:"-" gorm:"type:text"`
+
+	// MigratedFrom is the shuttle the pin was taken from, it releases its
+	// copy once the pin is complete here
+	MigratedFrom string `json:"migratedFrom,omitempty"`
+
+	// DedupBlocks and DedupBytes are the blocks of the pin that were already
+	// stored for other pins when it completed
+	DedupBlocks int64 `json:"dedupBlocks"`
+	DedupBytes  int64 `json:"dedupBytes"`
 }
 
 type Object struct {
@@ -49,24 +96,60 @@ type ObjRef struct {
 	//Offloaded bool
 }
 
-func setupDatabase(dbval string) (*gorm.DB, error) {
-	db, err := util.SetupDatabase(dbval)
+// setupDatabase opens the database and applies the migrations it is missing
+func setupDatabase(dbval string, pool util.DatabasePool) (*gorm.DB, error) {
+	db, err := util.SetupDatabaseWithPool(dbval, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := dbmigrate.New(db, shuttleMigrations)
 	if err != nil {
 		return nil, err
 	}
-	if err := migrateSchemas(db); err != nil {
+	if _, err := m.Up(""); err != nil {
 		return nil, err
 	}
 
 	return db, nil
 }
 
-func migrateSchemas(db *gorm.DB) error {
-	if err := db.AutoMigrate(
-		&Pin{},
-		&Object{},
-		&ObjRef{}); err != nil {
-		return err
+// openDatabase opens the database and fails if it is missing migrations
+func openDatabase(dbval string, pool util.DatabasePool) (*gorm.DB, error) {
+	db, err := util.SetupDatabaseWithPool(dbval, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := dbmigrate.New(db, shuttleMigrations)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := m.Pending()
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("database is missing migrations %v, run 'estuary-shuttle migrate up' first", pending)
+	}
+
+	return db, nil
+}
+
+func databasePool(cfg config.Database) util.DatabasePool {
+	return util.DatabasePool{
+		MaxOpenConns:    cfg.MaxOpenConns,
+		MaxIdleConns:    cfg.MaxIdleConns,
+		ConnMaxLifetime: cfg.ConnMaxLifetime,
+		ConnMaxIdleTime: cfg.ConnMaxIdleTime,
+	}
+}
+
+// readDB is the database for listings and stats that may lag behind writes,
+// the read replica if one is configured
+func (s *Shuttle) readDB() *gorm.DB {
+	if s.replicaDB != nil {
+		return s.replicaDB
 	}
-	return nil
+	return s.DB
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+)
+
+// transferBatcher coalesces the deal transfers started against the same
+// miner. Transfers queued for a miner are started size at a time, waiting
+// pacing between batches, so a burst of deals doesnt open all of them on the
+// miner at once.
+type transferBatcher struct {
+	size   int
+	pacing time.Duration
+
+	lk      sync.Mutex
+	pending map[address.Address][]func()
+}
+
+func newTransferBatcher(size int, pacing time.Duration) *transferBatcher {
+	return &transferBatcher{
+		size:    size,
+		pacing:  pacing,
+		pending: make(map[address.Address][]func()),
+	}
+}
+
+// add queues start to be called in the next batch for miner
+func (tb *transferBatcher) add(miner address.Address, start func()) {
+	if tb.size <= 0 {
+		go start()
+		return
+	}
+
+	tb.lk.Lock()
+	defer tb.lk.Unlock()
+
+	q, running := tb.pending[miner]
+	tb.pending[miner] = append(q, start)
+	if !running {
+		go tb.run(miner)
+	}
+}
+
+// queued returns the number of transfers waiting for their batch
+func (tb *transferBatcher) queued() int {
+	tb.lk.Lock()
+	defer tb.lk.Unlock()
+
+	var n int
+	for _, q := range tb.pending {
+		n += len(q)
+	}
+	return n
+}
+
+func (tb *transferBatcher) run(miner address.Address) {
+	for {
+		tb.lk.Lock()
+		q := tb.pending[miner]
+		if len(q) == 0 {
+			delete(tb.pending, miner)
+			tb.lk.Unlock()
+			return
+		}
+
+		n := tb.size
+		if n > len(q) {
+			n = len(q)
+		}
+		batch := q[:n]
+		tb.pending[miner] = q[n:]
+		tb.lk.Unlock()
+
+		var wg sync.WaitGroup
+		for _, start := range batch {
+			wg.Add(1)
+			go func(start func()) {
+				defer wg.Done()
+				start()
+			}(start)
+		}
+		wg.Wait()
+
+		log.Debugw("started batch of deal transfers", "miner", miner, "count", len(batch))
+		time.Sleep(tb.pacing)
+	}
+}
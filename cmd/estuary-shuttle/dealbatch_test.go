@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferBatcher(t *testing.T) {
+	m1, err := address.NewIDAddress(1000)
+	assert.NoError(t, err)
+	m2, err := address.NewIDAddress(1001)
+	assert.NoError(t, err)
+
+	tb := newTransferBatcher(2, 50*time.Millisecond)
+
+	var lk sync.Mutex
+	started := make(map[address.Address][]time.Time)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		for _, m := range []address.Address{m1, m2} {
+			m := m
+			wg.Add(1)
+			tb.add(m, func() {
+				defer wg.Done()
+				lk.Lock()
+				started[m] = append(started[m], time.Now())
+				lk.Unlock()
+			})
+		}
+	}
+	wg.Wait()
+
+	for _, m := range []address.Address{m1, m2} {
+		times := started[m]
+		assert.Len(t, times, 5)
+		// the fifth transfer is in the third batch, two pacing intervals in
+		assert.GreaterOrEqual(t, times[4].Sub(times[0]), 100*time.Millisecond)
+	}
+
+	// two miners are batched independently, so they overlap
+	first := started[m2][0].Sub(started[m1][0])
+	assert.Less(t, first, 50*time.Millisecond)
+	assert.Greater(t, first, -50*time.Millisecond)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	//#nosec G108 - the profiling endpoints are only served when configured
+	httpprof "net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"time"
+
+	estumetrics "github.com/application-research/estuary/metrics"
+	"github.com/labstack/echo/v4"
+)
+
+// metricsMux serves the metrics and, if enabled, the pprof endpoints on the
+// metrics listener
+func (s *Shuttle) metricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	exporter := estumetrics.Exporter()
+	mux.Handle("/metrics", exporter)
+	mux.Handle("/debug/metrics", exporter)
+	mux.HandleFunc("/debug/stack", s.adminAccess.handler(func(w http.ResponseWriter, r *http.Request) {
+		if err := writeAllGoroutineStacks(w); err != nil {
+			log.Error(err)
+		}
+	}))
+
+	if s.shuttleConfig.Debug.Pprof {
+		mux.HandleFunc("/debug/pprof/", s.adminAccess.handler(httpprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", s.adminAccess.handler(httpprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", s.adminAccess.handler(httpprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", s.adminAccess.handler(httpprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", s.adminAccess.handler(httpprof.Trace))
+	}
+	return mux
+}
+
+// handleApiPprof serves the pprof endpoints under /admin/debug/pprof
+func (s *Shuttle) handleApiPprof(c echo.Context) error {
+	w, r := c.Response(), c.Request()
+	switch name := c.Param("*"); name {
+	case "":
+		httpprof.Index(w, r)
+	case "cmdline":
+		httpprof.Cmdline(w, r)
+	case "profile":
+		httpprof.Profile(w, r)
+	case "symbol":
+		httpprof.Symbol(w, r)
+	case "trace":
+		httpprof.Trace(w, r)
+	default:
+		if pprof.Lookup(name) == nil {
+			return echo.ErrNotFound
+		}
+		httpprof.Handler(name).ServeHTTP(w, r)
+	}
+	return nil
+}
+
+type debugSnapshot struct {
+	Goroutines string `json:"goroutines"`
+	Heap       string `json:"heap"`
+}
+
+// handleDebugSnapshot godoc
+// @Summary      Write a debug snapshot
+// @Description  This endpoint writes the stacks of all goroutines and a heap profile to the snapshot dir of the shuttle, and returns their paths
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/debug/snapshot [post]
+func (s *Shuttle) handleDebugSnapshot(c echo.Context) error {
+	snap, err := writeDebugSnapshot(s.shuttleConfig.Debug.SnapshotDir, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Infow("wrote debug snapshot", "goroutines", snap.Goroutines, "heap", snap.Heap)
+	return c.JSON(http.StatusOK, snap)
+}
+
+func writeDebugSnapshot(dir string, now time.Time) (*debugSnapshot, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	ts := now.UTC().Format("20060102T150405.000Z")
+	snap := &debugSnapshot{
+		Goroutines: filepath.Join(dir, fmt.Sprintf("goroutines-%s.txt", ts)),
+		Heap:       filepath.Join(dir, fmt.Sprintf("heap-%s.pprof", ts)),
+	}
+
+	if err := writeSnapshotFile(snap.Goroutines, func(f *os.File) error {
+		return writeAllGoroutineStacks(f)
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := writeSnapshotFile(snap.Heap, func(f *os.File) error {
+		return pprof.Lookup("heap").WriteTo(f, 0)
+	}); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func writeSnapshotFile(name string, write func(*os.File) error) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	if err := write(f); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteDebugSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	snap, err := writeDebugSnapshot(dir, time.Now())
+	require.NoError(t, err)
+
+	for _, name := range []string{snap.Goroutines, snap.Heap} {
+		fi, err := os.Stat(name)
+		require.NoError(t, err)
+		assert.Greater(t, fi.Size(), int64(0))
+	}
+}
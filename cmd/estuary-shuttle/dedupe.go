@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// existingPinFor returns the active pin the user already has for root, or
+// nil if there is none.
+func (s *Shuttle) existingPinFor(userID uint, root cid.Cid) (*Pin, error) {
+	var pin Pin
+	err := s.DB.Where("user_id = ? and cid = ? and active", userID, util.DbCID{CID: root}).
+		Order("id asc").
+		First(&pin).Error
+	if err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &pin, nil
+}
+
+// extendExpiry pushes the expiry of an existing pin out to exp when a
+// duplicate of it asked to be kept longer, a nil exp keeps it for good.
+func (s *Shuttle) extendExpiry(pin *Pin, exp *time.Time) error {
+	if pin.ExpiresAt == nil || (exp != nil && !exp.After(*pin.ExpiresAt)) {
+		return nil
+	}
+	return s.DB.Model(Pin{}).Where("id = ?", pin.ID).Update("expires_at", exp).Error
+}
+
+// forceNewContent parses the "force" option of an upload, which makes it
+// create new content even if the user already has the same root.
+func forceNewContent(val string) (bool, error) {
+	if val == "" {
+		return false, nil
+	}
+
+	force, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid value for force: %q", val),
+		}
+	}
+	return force, nil
+}
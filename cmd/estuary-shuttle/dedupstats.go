@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// dedupLookupBatch is how many cids are looked up in one query
+const dedupLookupBatch = 500
+
+// countStoredObjects returns how many of the objects of a new pin, and how
+// many bytes of them, are already tracked for other pins and so were in the
+// blockstore before the pin. It runs before the objects are created.
+func (s *Shuttle) countStoredObjects(objects []*Object) (int64, int64, error) {
+	var blocks, bytes int64
+	for i := 0; i < len(objects); i += dedupLookupBatch {
+		batch := objects[i:]
+		if len(batch) > dedupLookupBatch {
+			batch = batch[:dedupLookupBatch]
+		}
+
+		cids := make([]util.DbCID, 0, len(batch))
+		for _, o := range batch {
+			cids = append(cids, o.Cid)
+		}
+
+		var found []util.DbCID
+		if err := s.DB.Model(Object{}).Where("cid in ?", cids).Distinct("cid").Pluck("cid", &found).Error; err != nil {
+			return 0, 0, err
+		}
+		stored := make(map[string]bool, len(found))
+		for _, c := range found {
+			stored[c.CID.KeyString()] = true
+		}
+
+		for _, o := range batch {
+			if stored[o.Cid.CID.KeyString()] {
+				blocks++
+				bytes += int64(o.Size)
+			}
+		}
+	}
+	return blocks, bytes, nil
+}
+
+// dedupRatio is the share of bytes that were already stored
+func dedupRatio(dedupBytes, size int64) float64 {
+	if size <= 0 {
+		return 0
+	}
+	return float64(dedupBytes) / float64(size)
+}
+
+type contentDedup struct {
+	Content uint  `json:"content"`
+	Blocks  int64 `json:"blocks"`
+	Size    int64 `json:"size"`
+
+	// DedupBlocks and DedupBytes are what was already stored on the shuttle
+	// when the content was added
+	DedupBlocks int64   `json:"dedupBlocks"`
+	DedupBytes  int64   `json:"dedupBytes"`
+	DedupRatio  float64 `json:"dedupRatio"`
+}
+
+func (s *Shuttle) contentDedup(pin *Pin) (*contentDedup, error) {
+	out := &contentDedup{
+		Content:     pin.Content,
+		Size:        pin.Size,
+		DedupBlocks: pin.DedupBlocks,
+		DedupBytes:  pin.DedupBytes,
+		DedupRatio:  dedupRatio(pin.DedupBytes, pin.Size),
+	}
+	if err := s.readDB().Model(ObjRef{}).Where("pin = ?", pin.ID).Count(&out.Blocks).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type shuttleDedup struct {
+	Pins        int64   `json:"pins"`
+	Size        int64   `json:"size"`
+	DedupBlocks int64   `json:"dedupBlocks"`
+	DedupBytes  int64   `json:"dedupBytes"`
+	DedupRatio  float64 `json:"dedupRatio"`
+}
+
+// shuttleDedupStats sums up the dedup of the completed pins. Pins completed
+// before the shuttle counted it have none recorded.
+func (s *Shuttle) shuttleDedupStats() (*shuttleDedup, error) {
+	var out shuttleDedup
+	if err := s.readDB().Model(&Pin{}).
+		Select("count(1) as pins, " +
+			"coalesce(sum(size), 0) as size, " +
+			"coalesce(sum(dedup_blocks), 0) as dedup_blocks, " +
+			"coalesce(sum(dedup_bytes), 0) as dedup_bytes").
+		Where("active and not aggregate").
+		Scan(&out).Error; err != nil {
+		return nil, err
+	}
+	out.DedupRatio = dedupRatio(out.DedupBytes, out.Size)
+	return &out, nil
+}
+
+// handleGetContentDedup godoc
+// @Summary      Block dedup of a content
+// @Description  This endpoint returns how many of the blocks and bytes of a content were already stored on this shuttle when it was added, so incremental uploads can be checked to only add what changed
+// @Tags         content
+// @Produce      json
+// @Param        cont  path  int  true  "Content id"
+// @Router       /content/dedup/{cont} [get]
+func (s *Shuttle) handleGetContentDedup(c echo.Context, u *User) error {
+	cont, err := strconv.ParseUint(c.Param("cont"), 10, 64)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id %q", c.Param("cont")),
+		}
+	}
+
+	var pin Pin
+	if err := s.readDB().First(&pin, "content = ? and user_id = ?", cont, u.ID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("no content %d on this shuttle", cont),
+			}
+		}
+		return err
+	}
+
+	out, err := s.contentDedup(&pin)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+func (s *Shuttle) handleAdminDedupStats(c echo.Context) error {
+	out, err := s.shuttleDedupStats()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, out)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountStoredObjects(t *testing.T) {
+	s := newTestShuttle(t)
+
+	stored := blocks.NewBlock([]byte("stored for another pin"))
+	addTestPin(t, s, 1, blocks.NewBlock([]byte("root")), stored)
+
+	fresh := blocks.NewBlock([]byte("fresh"))
+	blks, bytes, err := s.countStoredObjects([]*Object{
+		{Cid: util.DbCID{CID: fresh.Cid()}, Size: len(fresh.RawData())},
+		{Cid: util.DbCID{CID: stored.Cid()}, Size: len(stored.RawData())},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), blks)
+	assert.Equal(t, int64(len(stored.RawData())), bytes)
+
+	blks, _, err = s.countStoredObjects(nil)
+	require.NoError(t, err)
+	assert.Zero(t, blks)
+}
+
+func TestDedupStats(t *testing.T) {
+	s := newTestShuttle(t)
+
+	addTestPin(t, s, 1, blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("b")))
+	addTestPin(t, s, 2, blocks.NewBlock([]byte("c")))
+	require.NoError(t, s.DB.Model(&Pin{}).Where("content = ?", 1).Updates(map[string]interface{}{"size": 100, "dedup_blocks": 1, "dedup_bytes": 25}).Error)
+	require.NoError(t, s.DB.Model(&Pin{}).Where("content = ?", 2).Update("size", 100).Error)
+
+	var pin Pin
+	require.NoError(t, s.DB.First(&pin, "content = ?", 1).Error)
+	cd, err := s.contentDedup(&pin)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), cd.Blocks)
+	assert.Equal(t, int64(1), cd.DedupBlocks)
+	assert.Equal(t, 0.25, cd.DedupRatio)
+
+	st, err := s.shuttleDedupStats()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), st.Pins)
+	assert.Equal(t, int64(200), st.Size)
+	assert.Equal(t, int64(25), st.DedupBytes)
+	assert.Equal(t, 0.125, st.DedupRatio)
+}
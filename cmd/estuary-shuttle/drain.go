@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-datastore"
+	"github.com/labstack/echo/v4"
+)
+
+// drainKey is set in the node datastore while the shuttle is draining, so it
+// keeps draining across restarts
+var drainKey = datastore.NewKey("/shuttle/draining")
+
+func (s *Shuttle) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// loadDraining picks up the drain state from before the last restart
+func (s *Shuttle) loadDraining(ctx context.Context) error {
+	has, err := s.Node.Datastore.Has(ctx, drainKey)
+	if err != nil {
+		return err
+	}
+	if has {
+		atomic.StoreInt32(&s.draining, 1)
+		log.Warn("shuttle is draining, refusing new content")
+	}
+	return nil
+}
+
+func (s *Shuttle) storeDraining(ctx context.Context, draining bool) error {
+	if draining {
+		if err := s.Node.Datastore.Put(ctx, drainKey, []byte{1}); err != nil {
+			return err
+		}
+		atomic.StoreInt32(&s.draining, 1)
+		return nil
+	}
+
+	if err := s.Node.Datastore.Delete(ctx, drainKey); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&s.draining, 0)
+	return nil
+}
+
+// setDraining starts or stops draining the shuttle. The primary is told right
+// away, it stops placing content here and moves the content off the shuttle.
+func (s *Shuttle) setDraining(ctx context.Context, draining bool, actor string) error {
+	if s.isDraining() == draining {
+		return nil
+	}
+
+	action := "drain-start"
+	if !draining {
+		action = "drain-stop"
+	}
+
+	err := s.storeDraining(ctx, draining)
+	s.audit(&AuditEntry{Actor: actor, Action: action}, err)
+	if err != nil {
+		return err
+	}
+
+	if draining {
+		log.Warn("shuttle is draining, refusing new content")
+	} else {
+		log.Info("shuttle stopped draining, taking new content")
+	}
+
+	if err := s.sendShuttleUpdate(ctx); err != nil {
+		log.Errorf("failed to send shuttle update: %s", err)
+	}
+	return nil
+}
+
+func (s *Shuttle) handleRpcSetDraining(ctx context.Context, req *drpc.SetDraining) error {
+	return s.setDraining(ctx, req.Draining, auditActorPrimary)
+}
+
+type drainStatus struct {
+	Draining bool `json:"draining"`
+
+	// PinsLeft are the pins still on the shuttle, PinsInProgress the ones
+	// still being fetched
+	PinsLeft       int64 `json:"pinsLeft"`
+	PinsInProgress int64 `json:"pinsInProgress"`
+
+	TransfersInProgress int `json:"transfersInProgress"`
+
+	// Done is set once a draining shuttle has nothing left on it
+	Done bool `json:"done"`
+}
+
+func (s *Shuttle) getDrainStatus() (*drainStatus, error) {
+	st := &drainStatus{Draining: s.isDraining()}
+
+	if err := s.readDB().Model(Pin{}).Where("active").Count(&st.PinsLeft).Error; err != nil {
+		return nil, err
+	}
+	if err := s.readDB().Model(Pin{}).Where("pinning").Count(&st.PinsInProgress).Error; err != nil {
+		return nil, err
+	}
+
+	s.tcLk.Lock()
+	for _, trk := range s.trackingChannels {
+		if trk.last == nil || !util.TransferTerminated(trk.last) {
+			st.TransfersInProgress++
+		}
+	}
+	s.tcLk.Unlock()
+
+	st.Done = st.Draining && st.PinsLeft == 0 && st.PinsInProgress == 0 && st.TransfersInProgress == 0
+	return st, nil
+}
+
+func (s *Shuttle) handleGetDrainStatus(c echo.Context) error {
+	st, err := s.getDrainStatus()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, st)
+}
+
+func (s *Shuttle) handleSetDraining(draining bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := s.setDraining(c.Request().Context(), draining, auditActorAdmin); err != nil {
+			return err
+		}
+		return s.handleGetDrainStatus(c)
+	}
+}
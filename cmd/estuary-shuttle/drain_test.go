@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainStateSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.Node.Datastore = datastore.NewMapDatastore()
+
+	require.NoError(t, s.storeDraining(ctx, true))
+	assert.True(t, s.addingDisabled())
+
+	restarted := newTestShuttle(t)
+	restarted.Node.Datastore = s.Node.Datastore
+	require.NoError(t, restarted.loadDraining(ctx))
+	assert.True(t, restarted.isDraining())
+
+	require.NoError(t, restarted.storeDraining(ctx, false))
+	s.draining = 0
+	require.NoError(t, s.loadDraining(ctx))
+	assert.False(t, s.isDraining())
+}
+
+func TestDrainStatus(t *testing.T) {
+	s := newTestShuttle(t)
+	s.draining = 1
+	s.trackingChannels = make(map[string]*chanTrack)
+
+	st, err := s.getDrainStatus()
+	require.NoError(t, err)
+	assert.True(t, st.Done)
+
+	addTestPin(t, s, 1, blocks.NewBlock([]byte("left")))
+	s.trackingChannels["chan"] = &chanTrack{}
+
+	st, err = s.getDrainStatus()
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, st.PinsLeft)
+	assert.Equal(t, 1, st.TransfersInProgress)
+	assert.False(t, st.Done)
+}
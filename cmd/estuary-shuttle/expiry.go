@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"golang.org/x/xerrors"
+)
+
+const (
+	expiryCheckInterval = time.Minute
+
+	// expiryBatchSize bounds how many contents are unpinned per check
+	expiryBatchSize = 100
+)
+
+var errContentExpired = errors.New("content expired")
+
+// parseExpiry reads the expiry of new content, either as an absolute RFC3339
+// time in expires or as a duration from now in ttl. It returns nil if
+// neither is set.
+func parseExpiry(expires, ttl string, now time.Time) (*time.Time, error) {
+	invalid := func(details string) error {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: details,
+		}
+	}
+
+	var exp time.Time
+	switch {
+	case expires != "" && ttl != "":
+		return nil, invalid("only one of expires and ttl can be set")
+	case expires != "":
+		t, err := time.Parse(time.RFC3339, expires)
+		if err != nil {
+			return nil, invalid(fmt.Sprintf("invalid expires %q, must be an RFC3339 time", expires))
+		}
+		exp = t
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, invalid(fmt.Sprintf("invalid ttl %q: %s", ttl, err))
+		}
+		exp = now.Add(d)
+	default:
+		return nil, nil
+	}
+
+	if !exp.After(now) {
+		return nil, invalid("the expiry must be in the future")
+	}
+	return &exp, nil
+}
+
+// expiryFromMeta reads the expiry of a pin from the "expires" or "ttl" keys
+// of its meta
+func expiryFromMeta(meta map[string]interface{}, now time.Time) (*time.Time, error) {
+	expires, _ := meta["expires"].(string)
+	ttl, _ := meta["ttl"].(string)
+	return parseExpiry(expires, ttl, now)
+}
+
+// runExpiryReaper unpins content whose expiry passed and tells the primary
+// about it. Pins that are still being fetched are left alone until they
+// complete or fail.
+func (s *Shuttle) runExpiryReaper() {
+	for range time.Tick(expiryCheckInterval) {
+		if s.isShuttingDown() {
+			return
+		}
+
+		if err := s.reapExpired(context.Background(), time.Now()); err != nil {
+			log.Errorf("failed to unpin expired content: %s", err)
+		}
+	}
+}
+
+func (s *Shuttle) reapExpired(ctx context.Context, now time.Time) error {
+	for {
+		var expired []Pin
+		if err := s.DB.Where("expires_at <= ? and not pinning", now).
+			Order("expires_at asc").
+			Limit(expiryBatchSize).
+			Find(&expired).Error; err != nil {
+			return err
+		}
+		if len(expired) == 0 {
+			return nil
+		}
+
+		contents := make([]uint, 0, len(expired))
+		for _, p := range expired {
+			contents = append(contents, p.Content)
+		}
+		s.cancelContentCommands(contents, errContentExpired)
+
+		var unpinned []uint
+		for _, p := range expired {
+			err := s.Unpin(ctx, p.Content)
+			s.audit(&AuditEntry{
+				Actor:   auditActorShuttle,
+				UserID:  p.UserID,
+				Action:  "expire",
+				Content: p.Content,
+				Cid:     p.Cid.CID.String(),
+			}, err)
+			if err != nil {
+				return xerrors.Errorf("failed to unpin expired content %d: %w", p.Content, err)
+			}
+			unpinned = append(unpinned, p.Content)
+		}
+
+		log.Infow("unpinned expired content", "count", len(unpinned))
+		if err := s.sendRpcMessage(ctx, &drpc.Message{
+			Op: drpc.OP_ContentExpired,
+			Params: drpc.MsgParams{
+				ContentExpired: &drpc.ContentExpired{
+					Contents: unpinned,
+				},
+			},
+		}); err != nil {
+			log.Errorf("failed to send content expired message: %s", err)
+		}
+
+		if len(expired) < expiryBatchSize {
+			return nil
+		}
+	}
+}
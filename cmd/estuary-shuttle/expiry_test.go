@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	exp, err := parseExpiry("", "", now)
+	require.NoError(t, err)
+	assert.Nil(t, exp)
+
+	exp, err = parseExpiry("", "24h", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(24*time.Hour), *exp)
+
+	exp, err = parseExpiry("2022-06-02T00:00:00Z", "", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC), exp.UTC())
+
+	for _, c := range [][2]string{
+		{"2022-06-02T00:00:00Z", "1h"},
+		{"2022-05-01T00:00:00Z", ""},
+		{"tomorrow", ""},
+		{"", "-1h"},
+	} {
+		_, err := parseExpiry(c[0], c[1], now)
+		assert.Error(t, err, "expires %q ttl %q", c[0], c[1])
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.resend = newResendQueue(nil)
+
+	expired := blocks.NewBlock([]byte("expired"))
+	kept := blocks.NewBlock([]byte("kept"))
+	addTestPin(t, s, 1, expired)
+	addTestPin(t, s, 2, kept)
+
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+	require.NoError(t, s.DB.Model(Pin{}).Where("content = ?", 1).Update("expires_at", past).Error)
+	require.NoError(t, s.DB.Model(Pin{}).Where("content = ?", 2).Update("expires_at", future).Error)
+
+	require.NoError(t, s.reapExpired(ctx, now))
+
+	assert.False(t, hasBlock(t, s, expired))
+	assert.True(t, hasBlock(t, s, kept))
+
+	var pins int64
+	require.NoError(t, s.DB.Model(Pin{}).Count(&pins).Error)
+	assert.Equal(t, int64(1), pins)
+	assert.Equal(t, 1, s.resend.len(), "primary was not told about the expired content")
+}
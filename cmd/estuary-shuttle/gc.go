@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+)
+
+type gcStatus struct {
+	Running  bool      `json:"running"`
+	DryRun   bool      `json:"dryRun"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	OrphanedObjects int64 `json:"orphanedObjects"`
+	BlocksChecked   int   `json:"blocksChecked"`
+	BlocksDeleted   int   `json:"blocksDeleted"`
+	BytesDeleted    int64 `json:"bytesDeleted"`
+
+	Error string `json:"error,omitempty"`
+}
+
+var ErrGCRunning = fmt.Errorf("garbage collection is already running")
+
+// runScheduledGC periodically runs garbage collection if an interval is
+// configured
+func (s *Shuttle) runScheduledGC() {
+	cfg := s.shuttleConfig.GarbageCollection
+	if cfg.Interval <= 0 {
+		return
+	}
+
+	for range time.Tick(cfg.Interval) {
+		if s.isShuttingDown() {
+			return
+		}
+
+		if _, err := s.GarbageCollect(context.Background(), cfg.DryRun); err != nil {
+			log.Errorf("scheduled garbage collection failed: %s", err)
+		}
+	}
+}
+
+// GarbageCollectStatus returns the progress of the running garbage
+// collection, or the result of the last one
+func (s *Shuttle) GarbageCollectStatus() gcStatus {
+	s.gcLk.Lock()
+	defer s.gcLk.Unlock()
+	return s.gcStatus
+}
+
+func (s *Shuttle) updateGCStatus(f func(st *gcStatus)) {
+	s.gcLk.Lock()
+	defer s.gcLk.Unlock()
+	f(&s.gcStatus)
+}
+
+// GarbageCollect removes every block from the blockstore that no pin
+// references. First object entries left without any refs (e.g. by failed
+// imports or interrupted unpins) are cleared, then the blockstore is walked
+// in batches, sleeping between batches to limit the load on the database and
+// disk. With dryRun set nothing is deleted, only counted.
+func (s *Shuttle) GarbageCollect(ctx context.Context, dryRun bool) (gcStatus, error) {
+	ctx, span := s.Tracer.Start(ctx, "garbageCollect")
+	defer span.End()
+
+	s.gcLk.Lock()
+	if s.gcStatus.Running {
+		s.gcLk.Unlock()
+		return gcStatus{}, ErrGCRunning
+	}
+	s.gcStatus = gcStatus{
+		Running: true,
+		DryRun:  dryRun,
+		Started: time.Now(),
+	}
+	s.gcLk.Unlock()
+
+	err := s.garbageCollect(ctx, dryRun)
+
+	s.updateGCStatus(func(st *gcStatus) {
+		st.Running = false
+		st.Finished = time.Now()
+		if err != nil {
+			st.Error = err.Error()
+		}
+	})
+
+	st := s.GarbageCollectStatus()
+	log.Infow("garbage collection finished", "dryRun", dryRun, "orphanedObjects", st.OrphanedObjects,
+		"checked", st.BlocksChecked, "deleted", st.BlocksDeleted, "bytes", st.BytesDeleted, "took", st.Finished.Sub(st.Started))
+	return st, err
+}
+
+func (s *Shuttle) garbageCollect(ctx context.Context, dryRun bool) error {
+	n, err := s.clearOrphanedObjects(ctx, dryRun)
+	if err != nil {
+		return err
+	}
+	s.updateGCStatus(func(st *gcStatus) {
+		st.OrphanedObjects = n
+	})
+
+	release, err := s.protectPendingPins(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	keys, err := s.Node.Blockstore.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+
+	cfg := s.shuttleConfig.GarbageCollection
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	batch := make([]cid.Cid, 0, batchSize)
+	for c := range keys {
+		batch = append(batch, c)
+		if len(batch) < batchSize {
+			continue
+		}
+
+		if err := s.collectBatch(ctx, batch, dryRun); err != nil {
+			return err
+		}
+		batch = batch[:0]
+
+		select {
+		case <-time.After(cfg.BatchDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		// AllKeysChan closes the channel early when the context is cancelled
+		return err
+	}
+	return s.collectBatch(ctx, batch, dryRun)
+}
+
+// clearOrphanedObjects removes object entries that no pin references. Objects
+// are created before their refs while a pin is being tracked, so entries of
+// inflight cids are left alone.
+func (s *Shuttle) clearOrphanedObjects(ctx context.Context, dryRun bool) (int64, error) {
+	var orphans []Object
+	if err := s.DB.Model(Object{}).Select("id", "cid").
+		Where("(?) = 0", s.DB.Model(ObjRef{}).Where("object = objects.id").Select("count(1)")).
+		Find(&orphans).Error; err != nil {
+		return 0, err
+	}
+
+	s.inflightCidsLk.Lock()
+	defer s.inflightCidsLk.Unlock()
+
+	ids := make([]uint, 0, len(orphans))
+	for _, o := range orphans {
+		if !s.isInflight(o.Cid.CID) {
+			ids = append(ids, o.ID)
+		}
+	}
+
+	if dryRun {
+		return int64(len(ids)), nil
+	}
+
+	batchSize := 500
+	for i := 0; i < len(ids); i += batchSize {
+		end := i + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		if err := s.DB.Where("id in ? and (?) = 0",
+			ids[i:end], s.DB.Model(ObjRef{}).Where("object = objects.id").Select("count(1)")).
+			Delete(Object{}).Error; err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(ids)), nil
+}
+
+func (s *Shuttle) collectBatch(ctx context.Context, batch []cid.Cid, dryRun bool) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	// find the candidates without holding the inflight lock, so pins,
+	// uploads and imports are not blocked while the database is queried
+	candidates, err := s.unreferencedBlocks(ctx, s.withoutInflight(batch))
+	if err != nil {
+		return err
+	}
+
+	deleted, deletedBytes, err := s.deleteUnreferencedBlocks(ctx, candidates, dryRun)
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		s.metrics.gcDeletedBlocks.Add(float64(deleted))
+	}
+
+	s.updateGCStatus(func(st *gcStatus) {
+		st.BlocksChecked += len(batch)
+		st.BlocksDeleted += deleted
+		st.BytesDeleted += deletedBytes
+	})
+
+	log.Debugf("garbage collected %d of %d blocks in batch", deleted, len(batch))
+	return nil
+}
+
+// withoutInflight returns the blocks of batch that no pin is fetching right
+// now
+func (s *Shuttle) withoutInflight(batch []cid.Cid) []cid.Cid {
+	s.inflightCidsLk.Lock()
+	defer s.inflightCidsLk.Unlock()
+
+	out := make([]cid.Cid, 0, len(batch))
+	for _, c := range batch {
+		if !s.isInflight(c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// unreferencedBlocks returns the blocks that no object references
+func (s *Shuttle) unreferencedBlocks(ctx context.Context, cids []cid.Cid) ([]cid.Cid, error) {
+	if len(cids) == 0 {
+		return nil, nil
+	}
+
+	dbcids := make([]util.DbCID, 0, len(cids))
+	for _, c := range cids {
+		dbcids = append(dbcids, util.DbCID{CID: c})
+	}
+
+	var referenced []Object
+	if err := s.DB.Model(Object{}).Select("cid").Where("cid in ?", dbcids).Find(&referenced).Error; err != nil {
+		return nil, err
+	}
+
+	keep := cid.NewSet()
+	for _, o := range referenced {
+		keep.Add(o.Cid.CID)
+	}
+
+	var out []cid.Cid
+	for _, c := range cids {
+		if !keep.Has(c) {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// deleteUnreferencedBlocks deletes the given candidate blocks, returning how
+// many blocks and bytes it deleted. The candidates are checked again with the
+// inflight lock held until they are deleted, so a pin that started or
+// finished since they were found cant lose its blocks.
+func (s *Shuttle) deleteUnreferencedBlocks(ctx context.Context, candidates []cid.Cid, dryRun bool) (int, int64, error) {
+	if len(candidates) == 0 {
+		return 0, 0, nil
+	}
+
+	s.inflightCidsLk.Lock()
+	defer s.inflightCidsLk.Unlock()
+
+	unreferenced, err := s.unreferencedBlocks(ctx, candidates)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var deleted int
+	var deletedBytes int64
+	for _, c := range unreferenced {
+		if s.isInflight(c) {
+			continue
+		}
+
+		size, err := s.Node.Blockstore.GetSize(ctx, c)
+		if err != nil {
+			log.Warnf("failed to get size of unreferenced block %s: %s", c, err)
+		}
+
+		if !dryRun {
+			if err := s.Node.Blockstore.DeleteBlock(ctx, c); err != nil {
+				return deleted, deletedBytes, err
+			}
+		}
+
+		deleted++
+		deletedBytes += int64(size)
+	}
+	return deleted, deletedBytes, nil
+}
+
+// gcCmd runs a full garbage collection on a stopped shuttle, printing its
+// progress as it goes and what it reclaimed once done. There is no load to
+// spare while the node is down, so batches are not spaced out.
+func gcCmd(ctx context.Context, cfg *config.Shuttle, dryRun bool) error {
+	s, closer, err := openOfflineShuttle(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	s.shuttleConfig.GarbageCollection.BatchDelay = 0
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				st := s.GarbageCollectStatus()
+				fmt.Printf("checked %d blocks, %d unreferenced (%d bytes)\n",
+					st.BlocksChecked, st.BlocksDeleted, st.BytesDeleted)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	st, err := s.GarbageCollect(ctx, dryRun)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Printf("would clear %d orphaned objects and delete %d of %d blocks, reclaiming %d bytes\n",
+			st.OrphanedObjects, st.BlocksDeleted, st.BlocksChecked, st.BytesDeleted)
+	} else {
+		fmt.Printf("cleared %d orphaned objects and deleted %d of %d blocks, reclaimed %d bytes\n",
+			st.OrphanedObjects, st.BlocksDeleted, st.BlocksChecked, st.BytesDeleted)
+	}
+	fmt.Printf("took %s\n", st.Finished.Sub(st.Started).Round(time.Second))
+	return nil
+}
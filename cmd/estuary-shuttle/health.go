@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	healthOK        = "ok"
+	healthDegraded  = "degraded"
+	healthUnhealthy = "unhealthy"
+)
+
+const (
+	healthCheckTimeout = 5 * time.Second
+
+	// the share of blockstore disk space left below which the shuttle is
+	// reported degraded, and unhealthy
+	healthDiskDegradedFree  = 0.10
+	healthDiskUnhealthyFree = 0.02
+)
+
+type healthComponent struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency"`
+}
+
+type healthResponse struct {
+	Status     string                      `json:"status"`
+	Components map[string]*healthComponent `json:"components"`
+}
+
+// healthCheck checks one part of the shuttle, an error makes it failStatus
+type healthCheck struct {
+	name       string
+	failStatus string
+	check      func(ctx context.Context) error
+}
+
+func (s *Shuttle) healthChecks() []healthCheck {
+	return []healthCheck{
+		{name: "database", failStatus: healthUnhealthy, check: s.checkDatabaseHealth},
+		{name: "blockstore", failStatus: healthUnhealthy, check: s.checkBlockstoreHealth},
+		{name: "primary", failStatus: healthDegraded, check: s.checkPrimaryHealth},
+		{name: "lotus", failStatus: healthDegraded, check: s.checkLotusHealth},
+	}
+}
+
+// worseHealth returns the worse of two statuses
+func worseHealth(a, b string) string {
+	rank := map[string]int{healthOK: 0, healthDegraded: 1, healthUnhealthy: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// handleHealth godoc
+// @Summary      Health of the shuttle
+// @Description  This endpoint checks the database, blockstore, primary connection, lotus gateway and disk space of the shuttle. It returns 503 when the shuttle is unhealthy or shutting down, a degraded shuttle still returns 200.
+// @Tags         net
+// @Produce      json
+// @Router       /health [get]
+func (s *Shuttle) handleHealth(c echo.Context) error {
+	if s.isShuttingDown() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"status": "shutting down",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), healthCheckTimeout)
+	defer cancel()
+
+	resp := s.runHealthChecks(ctx)
+	if resp.Status == healthUnhealthy {
+		return c.JSON(http.StatusServiceUnavailable, resp)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (s *Shuttle) runHealthChecks(ctx context.Context) *healthResponse {
+	resp := &healthResponse{
+		Status:     healthOK,
+		Components: make(map[string]*healthComponent),
+	}
+
+	var lk sync.Mutex
+	var wg sync.WaitGroup
+	for _, hc := range s.healthChecks() {
+		wg.Add(1)
+		go func(hc healthCheck) {
+			defer wg.Done()
+
+			start := time.Now()
+			comp := &healthComponent{Status: healthOK}
+			if err := hc.check(ctx); err != nil {
+				comp.Status = hc.failStatus
+				comp.Error = err.Error()
+			}
+			comp.Latency = time.Since(start).String()
+
+			lk.Lock()
+			resp.Components[hc.name] = comp
+			lk.Unlock()
+		}(hc)
+	}
+	wg.Wait()
+
+	resp.Components["disk"] = s.diskHealth()
+
+	for _, comp := range resp.Components {
+		resp.Status = worseHealth(resp.Status, comp.Status)
+	}
+	return resp
+}
+
+func (s *Shuttle) checkDatabaseHealth(ctx context.Context) error {
+	sqldb, err := s.DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqldb.PingContext(ctx)
+}
+
+// checkBlockstoreHealth writes a small block and reads it back, it is the
+// same block every time so checks do not grow the blockstore
+func (s *Shuttle) checkBlockstoreHealth(ctx context.Context) error {
+	blk := blocks.NewBlock([]byte("estuary shuttle health check"))
+	if err := s.Node.Blockstore.Put(ctx, blk); err != nil {
+		return fmt.Errorf("write failed: %w", err)
+	}
+
+	got, err := s.Node.Blockstore.Get(ctx, blk.Cid())
+	if err != nil {
+		return fmt.Errorf("read failed: %w", err)
+	}
+	if string(got.RawData()) != string(blk.RawData()) {
+		return fmt.Errorf("read back different data than was written")
+	}
+	return nil
+}
+
+func (s *Shuttle) checkPrimaryHealth(ctx context.Context) error {
+	if atomic.LoadInt32(&s.primaryConnected) == 0 {
+		return fmt.Errorf("not connected to primary %s", s.primaries.host())
+	}
+	return nil
+}
+
+func (s *Shuttle) checkLotusHealth(ctx context.Context) error {
+	_, err := s.Api.ChainHead(ctx)
+	return err
+}
+
+func (s *Shuttle) diskHealth() *healthComponent {
+	start := time.Now()
+	comp := &healthComponent{Status: healthOK}
+
+	disks := s.blockstoreDisks()
+	if len(disks) == 0 {
+		comp.Status = healthUnhealthy
+		comp.Error = "could not read the usage of any blockstore disk"
+	}
+
+	for _, d := range disks {
+		if d.Size == 0 {
+			continue
+		}
+
+		free := float64(d.Free) / float64(d.Size)
+		status := healthOK
+		switch {
+		case free < healthDiskUnhealthyFree:
+			status = healthUnhealthy
+		case free < healthDiskDegradedFree:
+			status = healthDegraded
+		}
+		if status != healthOK {
+			comp.Status = worseHealth(comp.Status, status)
+			comp.Error = fmt.Sprintf("%s has %.1f%% free", d.Dir, free*100)
+		}
+	}
+	comp.Latency = time.Since(start).String()
+	return comp
+}
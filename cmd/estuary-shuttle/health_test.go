@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorseHealth(t *testing.T) {
+	assert.Equal(t, healthOK, worseHealth(healthOK, healthOK))
+	assert.Equal(t, healthDegraded, worseHealth(healthOK, healthDegraded))
+	assert.Equal(t, healthDegraded, worseHealth(healthDegraded, healthOK))
+	assert.Equal(t, healthUnhealthy, worseHealth(healthDegraded, healthUnhealthy))
+	assert.Equal(t, healthUnhealthy, worseHealth(healthUnhealthy, healthDegraded))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+)
+
+// idempotent makes retries of an add with the same Idempotency-Key return
+// the content the first request added rather than adding it again
+func (s *Shuttle) idempotent(endpoint string) echo.MiddlewareFunc {
+	return util.Idempotent(s.DB, endpoint, func(c echo.Context) uint {
+		if u, ok := c.Get("user").(*User); ok {
+			return u.ID
+		}
+		return 0
+	})
+}
+
+func (s *Shuttle) runIdempotencyKeyCleaner() {
+	for range time.Tick(time.Hour) {
+		n, err := util.ExpireIdempotencyKeys(s.DB, time.Now())
+		if err != nil {
+			log.Errorf("failed to remove expired idempotency keys: %s", err)
+			continue
+		}
+
+		if n > 0 {
+			log.Infof("removed %d expired idempotency keys", n)
+		}
+	}
+}
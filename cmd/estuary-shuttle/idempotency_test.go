@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotentAdd(t *testing.T) {
+	s := newTestShuttle(t)
+
+	var adds int
+	fail := false
+	setUser := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			uid, _ := strconv.Atoi(c.Request().Header.Get("X-User"))
+			c.Set("user", &User{ID: uint(uid)})
+			return next(c)
+		}
+	}
+	add := func(c echo.Context, u *User) error {
+		if fail {
+			return &util.HttpError{Code: http.StatusInternalServerError, Reason: "ERR_TEST"}
+		}
+		adds++
+		return c.JSON(http.StatusOK, &util.ContentAddResponse{EstuaryId: uint(adds)})
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = util.ErrorHandler
+	e.POST("/content/add", withUser(add), setUser, s.idempotent("add"))
+	e.POST("/content/other", withUser(add), setUser, s.idempotent("other"))
+
+	post := func(path, user, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("X-User", user)
+		if key != "" {
+			req.Header.Set(util.IdempotencyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := post("/content/add", "1", "k1")
+	require.Equal(t, http.StatusOK, first.Code)
+
+	retry := post("/content/add", "1", "k1")
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get(util.IdempotencyReplayedHeader))
+	assert.Equal(t, 1, adds, "a retry must not add again")
+
+	assert.Equal(t, http.StatusOK, post("/content/add", "2", "k1").Code, "keys are per user")
+	assert.Equal(t, http.StatusOK, post("/content/add", "1", "").Code)
+	assert.Equal(t, 3, adds)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, post("/content/other", "1", "k1").Code)
+
+	fail = true
+	assert.Equal(t, http.StatusInternalServerError, post("/content/add", "1", "k2").Code)
+	fail = false
+	assert.Equal(t, http.StatusOK, post("/content/add", "1", "k2").Code, "a failed request releases its key")
+	assert.Equal(t, 4, adds)
+
+	require.NoError(t, s.DB.Create(&util.IdempotencyKey{UserID: 1, RequestKey: "k3", Endpoint: "add", ExpiresAt: time.Now().Add(time.Hour)}).Error)
+	assert.Equal(t, http.StatusConflict, post("/content/add", "1", "k3").Code)
+
+	n, err := util.ExpireIdempotencyKeys(s.DB, time.Now().Add(util.IdempotencyKeyTTL+time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+	assert.Equal(t, http.StatusOK, post("/content/add", "1", "k1").Code)
+	assert.Equal(t, 5, adds)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// importBlockstore writes the blocks of an import straight into the main
+// blockstore instead of going through a staging blockstore. Every block
+// written is marked as inflight until the import finishes so it cant be
+// garbage collected from under us, and blocks that were not present before
+// the import are removed again if the import fails.
+type importBlockstore struct {
+	blockstore.Blockstore
+
+	s *Shuttle
+
+	lk      sync.Mutex
+	written map[cid.Cid]bool
+}
+
+func (s *Shuttle) newImportBlockstore() *importBlockstore {
+	return &importBlockstore{
+		Blockstore: s.Node.Blockstore,
+		s:          s,
+		written:    make(map[cid.Cid]bool),
+	}
+}
+
+func (ibs *importBlockstore) track(ctx context.Context, c cid.Cid) error {
+	ibs.lk.Lock()
+	_, seen := ibs.written[c]
+	ibs.lk.Unlock()
+	if seen {
+		return nil
+	}
+
+	ibs.s.inflightCidsLk.Lock()
+	ibs.s.inflightCids[c]++
+	ibs.s.inflightCidsLk.Unlock()
+
+	has, err := ibs.Blockstore.Has(ctx, c)
+	if err != nil {
+		ibs.s.releaseInflight(c)
+		return err
+	}
+
+	ibs.lk.Lock()
+	defer ibs.lk.Unlock()
+	if _, seen := ibs.written[c]; seen {
+		// raced with another put of the same block
+		ibs.s.releaseInflight(c)
+		return nil
+	}
+	ibs.written[c] = !has
+	return nil
+}
+
+func (ibs *importBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	if err := ibs.track(ctx, blk.Cid()); err != nil {
+		return err
+	}
+	return ibs.Blockstore.Put(ctx, blk)
+}
+
+func (ibs *importBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	for _, blk := range blks {
+		if err := ibs.track(ctx, blk.Cid()); err != nil {
+			return err
+		}
+	}
+	return ibs.Blockstore.PutMany(ctx, blks)
+}
+
+// AllKeysChan only lists the blocks written as part of this import
+func (ibs *importBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	ibs.lk.Lock()
+	keys := make([]cid.Cid, 0, len(ibs.written))
+	for c := range ibs.written {
+		keys = append(keys, c)
+	}
+	ibs.lk.Unlock()
+
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		for _, c := range keys {
+			select {
+			case out <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// finish releases the inflight marks held by the import. If the import
+// failed, any block it introduced that nothing else references is deleted.
+func (ibs *importBlockstore) finish(ctx context.Context, success bool) {
+	ibs.lk.Lock()
+	defer ibs.lk.Unlock()
+
+	s := ibs.s
+	s.inflightCidsLk.Lock()
+	defer s.inflightCidsLk.Unlock()
+
+	var deleted int
+	for c, fresh := range ibs.written {
+		s.inflightCids[c]--
+		if s.inflightCids[c] <= 0 {
+			delete(s.inflightCids, c)
+		}
+
+		if success || !fresh {
+			continue
+		}
+
+		del, err := s.deleteIfNotPinnedLocked(ctx, &Object{Cid: util.DbCID{CID: c}})
+		if err != nil {
+			log.Errorf("failed to roll back block %s of failed import: %s", c, err)
+			continue
+		}
+		if del {
+			deleted++
+		}
+	}
+
+	if !success {
+		log.Infof("rolled back failed import, deleted %d of %d blocks", deleted, len(ibs.written))
+	}
+	ibs.written = make(map[cid.Cid]bool)
+}
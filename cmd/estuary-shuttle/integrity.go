@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/xerrors"
+)
+
+type integrityStatus struct {
+	Running  bool      `json:"running"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	Checked   int `json:"checked"`
+	Corrupted int `json:"corrupted"`
+	Missing   int `json:"missing"`
+	Repaired  int `json:"repaired"`
+
+	// Flagged are the pins holding blocks that could not be repaired
+	Flagged []uint `json:"flagged,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+var ErrIntegrityCheckRunning = fmt.Errorf("integrity check is already running")
+
+// runIntegrityChecks periodically checks a sample of the stored blocks if an
+// interval is configured
+func (s *Shuttle) runIntegrityChecks() {
+	cfg := s.shuttleConfig.Integrity
+	if cfg.Interval <= 0 {
+		return
+	}
+
+	for range time.Tick(cfg.Interval) {
+		if s.isShuttingDown() {
+			return
+		}
+
+		if _, err := s.CheckIntegrity(context.Background(), cfg.SampleSize); err != nil {
+			log.Errorf("scheduled integrity check failed: %s", err)
+		}
+	}
+}
+
+// IntegrityStatus returns the progress of the running integrity check, or
+// the result of the last one
+func (s *Shuttle) IntegrityStatus() integrityStatus {
+	s.integrityLk.Lock()
+	defer s.integrityLk.Unlock()
+	return s.integrityStatus
+}
+
+func (s *Shuttle) updateIntegrityStatus(f func(st *integrityStatus)) {
+	s.integrityLk.Lock()
+	defer s.integrityLk.Unlock()
+	f(&s.integrityStatus)
+}
+
+// CheckIntegrity checks up to sampleSize randomly picked blocks against
+// their cids. Blocks that do not match, or that hot pins reference but are
+// gone, are fetched again over bitswap if refetching is enabled. The pins
+// holding blocks that cannot be repaired are flagged as corrupted.
+func (s *Shuttle) CheckIntegrity(ctx context.Context, sampleSize int) (integrityStatus, error) {
+	ctx, span := s.Tracer.Start(ctx, "checkIntegrity")
+	defer span.End()
+
+	s.integrityLk.Lock()
+	if s.integrityStatus.Running {
+		s.integrityLk.Unlock()
+		return integrityStatus{}, ErrIntegrityCheckRunning
+	}
+	s.integrityStatus = integrityStatus{
+		Running: true,
+		Started: time.Now(),
+	}
+	s.integrityLk.Unlock()
+
+	err := s.checkIntegrity(ctx, sampleSize)
+
+	s.updateIntegrityStatus(func(st *integrityStatus) {
+		st.Running = false
+		st.Finished = time.Now()
+		if err != nil {
+			st.Error = err.Error()
+		}
+	})
+
+	st := s.IntegrityStatus()
+	log.Infow("integrity check finished", "checked", st.Checked, "corrupted", st.Corrupted,
+		"missing", st.Missing, "repaired", st.Repaired, "flagged", len(st.Flagged), "took", st.Finished.Sub(st.Started))
+	return st, err
+}
+
+func (s *Shuttle) checkIntegrity(ctx context.Context, sampleSize int) error {
+	objs, err := s.sampleObjects(sampleSize)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := s.checkBlock(ctx, o.Cid.CID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sampleObjects picks up to n objects at random. Ids are drawn up to the
+// highest one in use, so with gaps left by deleted objects fewer than n may
+// come back.
+func (s *Shuttle) sampleObjects(n int) ([]Object, error) {
+	var maxID uint
+	if err := s.readDB().Model(Object{}).Select("coalesce(max(id), 0)").Scan(&maxID).Error; err != nil {
+		return nil, err
+	}
+	if maxID == 0 || n <= 0 {
+		return nil, nil
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	seen := make(map[uint]bool)
+	ids := make([]uint, 0, n)
+	for len(ids) < n && uint(len(ids)) < maxID {
+		id := uint(rng.Int63n(int64(maxID))) + 1
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	var out []Object
+	batchSize := 500
+	for i := 0; i < len(ids); i += batchSize {
+		end := i + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var objs []Object
+		if err := s.readDB().Where("id in ?", ids[i:end]).Find(&objs).Error; err != nil {
+			return nil, err
+		}
+		out = append(out, objs...)
+	}
+	return out, nil
+}
+
+// verifyBlock reports whether data hashes to c
+func verifyBlock(c cid.Cid, data []byte) bool {
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return false
+	}
+	return sum.Equals(c)
+}
+
+// checkBlock checks a single block and tries to repair it if it is corrupted
+// or missing
+func (s *Shuttle) checkBlock(ctx context.Context, c cid.Cid) error {
+	// blocks of tiered pins are legitimately absent from the main
+	// blockstore, only blocks a hot pin uses are expected there
+	hot, err := s.tierRefs(c, tierHot)
+	if err != nil {
+		return err
+	}
+	if hot == 0 {
+		return nil
+	}
+
+	blk, err := s.Node.Blockstore.Get(ctx, c)
+	switch {
+	case xerrors.Is(err, blockstore.ErrNotFound):
+		s.updateIntegrityStatus(func(st *integrityStatus) {
+			st.Checked++
+			st.Missing++
+		})
+	case err != nil:
+		// a block that can not be read back is treated as corrupted
+		log.Warnf("failed to read block %s during integrity check: %s", c, err)
+		s.updateIntegrityStatus(func(st *integrityStatus) {
+			st.Checked++
+			st.Corrupted++
+		})
+	case !verifyBlock(c, blk.RawData()):
+		log.Warnf("block %s does not match its cid", c)
+		s.updateIntegrityStatus(func(st *integrityStatus) {
+			st.Checked++
+			st.Corrupted++
+		})
+	default:
+		s.updateIntegrityStatus(func(st *integrityStatus) {
+			st.Checked++
+		})
+		return nil
+	}
+	s.metrics.integrityFailures.Inc()
+
+	if s.shuttleConfig.Integrity.Refetch {
+		err := s.refetchBlock(ctx, c)
+		if err == nil {
+			s.updateIntegrityStatus(func(st *integrityStatus) {
+				st.Repaired++
+			})
+			return nil
+		}
+		log.Warnf("failed to fetch block %s again: %s", c, err)
+	}
+
+	return s.flagCorruptedPins(c)
+}
+
+// refetchBlock replaces c in the blockstore with a copy fetched over bitswap
+func (s *Shuttle) refetchBlock(ctx context.Context, c cid.Cid) error {
+	ctx, cancel := context.WithTimeout(ctx, s.shuttleConfig.Integrity.RefetchTimeout)
+	defer cancel()
+
+	// the bad copy has to go first, bitswap would serve it otherwise
+	if err := s.Node.Blockstore.DeleteBlock(ctx, c); err != nil && !xerrors.Is(err, blockstore.ErrNotFound) {
+		return err
+	}
+
+	blk, err := s.Node.Bitswap.GetBlock(ctx, c)
+	if err != nil {
+		return err
+	}
+	if !verifyBlock(c, blk.RawData()) {
+		return blocks.ErrWrongHash
+	}
+	return s.Node.Blockstore.Put(ctx, blk)
+}
+
+// flagCorruptedPins marks the hot pins referencing c as corrupted
+func (s *Shuttle) flagCorruptedPins(c cid.Cid) error {
+	var pins []uint
+	if err := s.DB.Model(Object{}).
+		Joins("join obj_refs on obj_refs.object = objects.id").
+		Joins("join pins on pins.id = obj_refs.pin").
+		Where("objects.cid = ? and pins.tier = ?", util.DbCID{CID: c}, tierHot).
+		Select("distinct pins.id").Scan(&pins).Error; err != nil {
+		return err
+	}
+	if len(pins) == 0 {
+		return nil
+	}
+
+	if err := s.DB.Model(Pin{}).Where("id in ?", pins).Update("corrupted", true).Error; err != nil {
+		return err
+	}
+
+	s.updateIntegrityStatus(func(st *integrityStatus) {
+		st.Flagged = append(st.Flagged, pins...)
+	})
+	return nil
+}
+
+// integritySummary returns the result of the last integrity check for the
+// update sent to the primary, nil if none finished yet
+func (s *Shuttle) integritySummary() (*drpc.IntegrityCheck, error) {
+	st := s.IntegrityStatus()
+	if st.Finished.IsZero() {
+		return nil, nil
+	}
+
+	out := &drpc.IntegrityCheck{
+		Finished:  st.Finished,
+		Checked:   st.Checked,
+		Corrupted: st.Corrupted,
+		Missing:   st.Missing,
+		Repaired:  st.Repaired,
+	}
+	if err := s.readDB().Model(Pin{}).Where("corrupted").Count(&out.FlaggedPins).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
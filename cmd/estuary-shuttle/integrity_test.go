@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckIntegrityFlagsCorruptedPins(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.shuttleConfig.Integrity.Refetch = false
+
+	good := blocks.NewBlock([]byte("good"))
+	bad := blocks.NewBlock([]byte("bad"))
+	gone := blocks.NewBlock([]byte("gone"))
+	cold := blocks.NewBlock([]byte("cold"))
+
+	addTestPin(t, s, 1, good)
+	addTestPin(t, s, 2, bad)
+	addTestPin(t, s, 3, gone)
+	addTestPin(t, s, 4, cold)
+
+	corrupt, err := blocks.NewBlockWithCid([]byte("flipped"), bad.Cid())
+	require.NoError(t, err)
+	require.NoError(t, s.Node.Blockstore.Put(ctx, corrupt))
+	require.NoError(t, s.Node.Blockstore.DeleteBlock(ctx, gone.Cid()))
+
+	// blocks of tiered pins are expected to be gone from the blockstore
+	require.NoError(t, s.Node.Blockstore.DeleteBlock(ctx, cold.Cid()))
+	require.NoError(t, s.DB.Model(Pin{}).Where("content = ?", 4).Update("tier", tierCold).Error)
+
+	st, err := s.CheckIntegrity(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 3, st.Checked)
+	assert.Equal(t, 1, st.Corrupted)
+	assert.Equal(t, 1, st.Missing)
+	assert.Equal(t, 0, st.Repaired)
+	assert.Len(t, st.Flagged, 2)
+
+	var flagged []uint
+	require.NoError(t, s.DB.Model(Pin{}).Where("corrupted").Order("content").Pluck("content", &flagged).Error)
+	assert.Equal(t, []uint{2, 3}, flagged)
+
+	sum, err := s.integritySummary()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), sum.FlaggedPins)
+}
+
+func TestVerifyBlock(t *testing.T) {
+	blk := blocks.NewBlock([]byte("data"))
+	assert.True(t, verifyBlock(blk.Cid(), blk.RawData()))
+	assert.False(t, verifyBlock(blk.Cid(), []byte("other")))
+}
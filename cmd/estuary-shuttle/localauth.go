@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+)
+
+// localAuth checks JWT api keys against the primary's public key, so they
+// do not need a /viewer request. Keys it cannot vouch for, revoked ones and
+// ones issued before their user's settings changed, are left to the primary.
+type localAuth struct {
+	lk  sync.Mutex
+	key ed25519.PublicKey
+
+	// revoked holds the hashes of revoked keys, as of the last connection to
+	// the primary and since
+	revoked map[string]bool
+
+	// userChanged is when the primary last invalidated all keys of a user
+	userChanged map[uint]time.Time
+}
+
+func (la *localAuth) setKey(key ed25519.PublicKey, revoked []string) {
+	la.lk.Lock()
+	defer la.lk.Unlock()
+
+	la.key = key
+	la.revoked = make(map[string]bool, len(revoked))
+	for _, h := range revoked {
+		la.revoked[h] = true
+	}
+}
+
+func (la *localAuth) invalidate(tokenHashes []string, userID uint, now time.Time) {
+	la.lk.Lock()
+	defer la.lk.Unlock()
+
+	if la.revoked == nil {
+		la.revoked = make(map[string]bool)
+	}
+	for _, h := range tokenHashes {
+		la.revoked[h] = true
+	}
+
+	if userID != 0 {
+		if la.userChanged == nil {
+			la.userChanged = make(map[uint]time.Time)
+		}
+		la.userChanged[userID] = now
+	}
+}
+
+// verify returns the user of token if it is a JWT the shuttle can check
+// itself, and nil if it has to be checked with the primary
+func (la *localAuth) verify(token string) *User {
+	if !util.IsJWT(token) {
+		return nil
+	}
+
+	la.lk.Lock()
+	defer la.lk.Unlock()
+
+	if la.key == nil || la.revoked[util.GetTokenHash(token)] {
+		return nil
+	}
+
+	claims, err := util.VerifyAuthToken(la.key, token)
+	if err != nil {
+		log.Debugw("api key failed local verification", "err", err)
+		return nil
+	}
+	uid, _ := claims.UserID()
+
+	if changed, ok := la.userChanged[uid]; ok && !time.Unix(claims.IssuedAt, 0).After(changed) {
+		return nil
+	}
+
+	return &User{
+		ID:              uid,
+		Username:        claims.Username,
+		Perms:           claims.Perms,
+		AuthToken:       token,
+		AuthExpiry:      time.Unix(claims.ExpiresAt, 0),
+		StorageDisabled: claims.StorageDisabled,
+		MaxUploadSize:   claims.MaxUploadSize,
+		Flags:           claims.Flags,
+		Scopes:          claims.Scopes,
+	}
+}
+
+func (s *Shuttle) handleRpcSetAuthKey(ctx context.Context, req *drpc.SetAuthKey) error {
+	if len(req.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("auth key is %d bytes, expected %d", len(req.PublicKey), ed25519.PublicKeySize)
+	}
+	s.localAuth.setKey(ed25519.PublicKey(req.PublicKey), req.Revoked)
+
+	// keys revoked while the shuttle was not connected may still be cached
+	for _, h := range req.Revoked {
+		s.authCache.Remove(h)
+	}
+	return nil
+}
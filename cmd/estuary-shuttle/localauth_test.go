@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalAuth(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	issued := time.Now().Add(-time.Minute)
+	tok, err := util.SignAuthToken(priv, &util.AuthClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        "1",
+			Subject:   "7",
+			IssuedAt:  issued.Unix(),
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Username: "alice",
+		Perms:    util.PermLevelUser,
+		Scopes:   []string{util.ScopeRead},
+	})
+	require.NoError(t, err)
+
+	var la localAuth
+	assert.Nil(t, la.verify(tok), "verified without the primary's key")
+
+	la.setKey(pub, nil)
+	u := la.verify(tok)
+	require.NotNil(t, u)
+	assert.Equal(t, uint(7), u.ID)
+	assert.Equal(t, "alice", u.Username)
+	assert.Equal(t, []string{util.ScopeRead}, u.Scopes)
+	assert.Nil(t, la.verify("EST1c4e6b2a-ffff-4c3d-9a3e-1d2c3b4a5f6eARY"), "an opaque key was verified locally")
+
+	// settings changed after the key was made, the primary has the current ones
+	la.invalidate(nil, 7, issued.Add(time.Second))
+	assert.Nil(t, la.verify(tok))
+	delete(la.userChanged, 7)
+
+	la.setKey(pub, []string{util.GetTokenHash(tok)})
+	assert.Nil(t, la.verify(tok), "a revoked key was verified locally")
+
+	la.setKey(pub, nil)
+	require.NotNil(t, la.verify(tok))
+	la.invalidate([]string{util.GetTokenHash(tok)}, 0, time.Now())
+	assert.Nil(t, la.verify(tok), "a revoked key was verified locally")
+}
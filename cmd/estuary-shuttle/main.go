@@ -3,20 +3,24 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
-
-	//#nosec G108 - exposing the profiling endpoint is expected
-	_ "net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/application-research/estuary/constants"
@@ -38,6 +42,8 @@ import (
 	"github.com/urfave/cli/v2"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/webdav"
 	"golang.org/x/net/websocket"
 	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
@@ -47,6 +53,7 @@ import (
 	node "github.com/application-research/estuary/node"
 	"github.com/application-research/estuary/pinner"
 	"github.com/application-research/estuary/stagingbs"
+	"github.com/application-research/estuary/uploads"
 	"github.com/application-research/estuary/util"
 	"github.com/application-research/filclient"
 	"github.com/cenkalti/backoff/v4"
@@ -56,7 +63,6 @@ import (
 	"github.com/filecoin-project/lotus/api"
 	lotusTypes "github.com/filecoin-project/lotus/chain/types"
 	lcli "github.com/filecoin-project/lotus/cli"
-	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
@@ -82,26 +88,50 @@ var log = logging.Logger("shuttle").With("app_version", appVersion)
 const (
 	ColUuid = "coluuid"
 	ColDir  = "dir"
+	ColPath = "collectionPath"
 )
 
-//#nosec G104 - it's not common to treat SetLogLevel error return
+var logSubsystems = []string{
+	"dt-impl",
+	"shuttle",
+	"paych",
+	"filclient",
+	"dt_graphsync",
+	"graphsync_allocator",
+	"dt-chanmon",
+	"markets",
+	"data_transfer_network",
+	"rpc",
+	"bs-wal",
+	"bs-migrate",
+	"bs-s3",
+	"rcmgr",
+}
+
+// #nosec G104 - it's not common to treat SetLogLevel error return
 func before(cctx *cli.Context) error {
-	level := util.LogLevel
-
-	logging.SetLogLevel("dt-impl", level)
-	logging.SetLogLevel("shuttle", level)
-	logging.SetLogLevel("paych", level)
-	logging.SetLogLevel("filclient", level)
-	logging.SetLogLevel("dt_graphsync", level)
-	logging.SetLogLevel("graphsync_allocator", level)
-	logging.SetLogLevel("dt-chanmon", level)
-	logging.SetLogLevel("markets", level)
-	logging.SetLogLevel("data_transfer_network", level)
-	logging.SetLogLevel("rpc", level)
-	logging.SetLogLevel("bs-wal", level)
-	logging.SetLogLevel("bs-migrate", level)
-	logging.SetLogLevel("rcmgr", level)
+	for _, sys := range logSubsystems {
+		logging.SetLogLevel(sys, util.LogLevel)
+	}
+	return nil
+}
+
+// applyLogConfig sets the log levels from the config file, after the
+// defaults from the command line have been set in before
+func applyLogConfig(cfg config.Logging) error {
+	if cfg.Level != "" {
+		for _, sys := range logSubsystems {
+			if err := logging.SetLogLevel(sys, cfg.Level); err != nil {
+				return fmt.Errorf("invalid log level %q: %w", cfg.Level, err)
+			}
+		}
+	}
 
+	for sys, level := range cfg.Subsystems {
+		if err := logging.SetLogLevel(sys, level); err != nil {
+			return fmt.Errorf("failed to set log level of %s to %q: %w", sys, level, err)
+		}
+	}
 	return nil
 }
 
@@ -115,6 +145,8 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 		}
 
 		switch name {
+		case "log-level":
+			cfg.Logging.Level = cctx.String("log-level")
 		case "node-api-url":
 			cfg.Node.ApiURL = cctx.String("node-api-url")
 		case "datadir":
@@ -123,8 +155,18 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.Node.Blockstore = cctx.String("blockstore")
 		case "no-blockstore-cache":
 			cfg.Node.NoBlockstoreCache = cctx.Bool("no-blockstore-cache")
+		case "blockstore-bloom-filter-size":
+			cfg.Node.BlockstoreCache.BloomFilterSize = cctx.Int("blockstore-bloom-filter-size")
+		case "blockstore-block-cache-size":
+			cfg.Node.BlockstoreCache.BlockCacheSize = cctx.Int("blockstore-block-cache-size")
+		case "compress-blocks":
+			cfg.Node.CompressBlocks = cctx.Bool("compress-blocks")
 		case "write-log-truncate":
 			cfg.Node.WriteLogTruncate = cctx.Bool("write-log-truncate")
+		case "write-log-max-size":
+			cfg.Node.WriteLogMaxSize = cctx.Int64("write-log-max-size")
+		case "write-log-max-age":
+			cfg.Node.WriteLogMaxAge = cctx.Duration("write-log-max-age")
 		case "write-log-flush":
 			cfg.Node.HardFlushWriteLog = cctx.Bool("write-log-flush")
 		case "write-log":
@@ -141,6 +183,16 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.Node.EnableWebsocketListenAddr = cctx.Bool("libp2p-websockets")
 		case "announce-addr":
 			cfg.Node.AnnounceAddrs = cctx.StringSlice("announce-addr")
+		case "no-announce-addr":
+			cfg.Node.NoAnnounceAddrs = cctx.StringSlice("no-announce-addr")
+		case "swarm-key":
+			cfg.Node.SwarmKeyFile = cctx.String("swarm-key")
+		case "relay-client":
+			cfg.Node.Relay.Client = cctx.Bool("relay-client")
+		case "relay-service":
+			cfg.Node.Relay.Service = cctx.Bool("relay-service")
+		case "hole-punching":
+			cfg.Node.Relay.HolePunching = cctx.Bool("hole-punching")
 		case "peering-peers":
 			//	The peer is an array of multiaddress so we need to allow
 			//	the user to specify ID and Addrs
@@ -153,10 +205,26 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			}
 			cfg.Node.PeeringPeers = append(cfg.Node.PeeringPeers, peers...)
 
+		case "tls-cert":
+			cfg.TLS.CertFile = cctx.String("tls-cert")
+		case "tls-key":
+			cfg.TLS.KeyFile = cctx.String("tls-key")
+		case "tls-autocert":
+			cfg.TLS.Autocert = cctx.Bool("tls-autocert")
 		case "host":
 			cfg.Hostname = cctx.String("host")
 		case "disable-local-content-adding":
 			cfg.Content.DisableLocalAdding = cctx.Bool("disable-local-content-adding")
+		case "streaming-import":
+			cfg.Content.StreamingImport = cctx.Bool("streaming-import")
+		case "commp-on-import":
+			cfg.Content.CommPOnImport = cctx.Bool("commp-on-import")
+		case "staging-copy-workers":
+			cfg.Content.StagingCopy.Workers = cctx.Int("staging-copy-workers")
+		case "max-upload-size":
+			cfg.Content.MaxUploadSize = cctx.Int64("max-upload-size")
+		case "max-chunk-size":
+			cfg.Content.MaxChunkSize = cctx.Int64("max-chunk-size")
 		case "jaeger-tracing":
 			cfg.Jaeger.EnableTracing = cctx.Bool("jaeger-tracing")
 		case "jaeger-provider-url":
@@ -169,18 +237,163 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Shuttle
 			cfg.Node.Bitswap.MaxOutstandingBytesPerPeer = cctx.Int64("bitswap-max-work-per-peer")
 		case "bitswap-target-message-size":
 			cfg.Node.Bitswap.TargetMessageSize = cctx.Int("bitswap-target-message-size")
+		case "bitswap-engine-task-workers":
+			cfg.Node.Bitswap.EngineTaskWorkers = cctx.Int("bitswap-engine-task-workers")
+		case "bitswap-engine-blockstore-workers":
+			cfg.Node.Bitswap.EngineBlockstoreWorkers = cctx.Int("bitswap-engine-blockstore-workers")
+		case "bitswap-task-workers":
+			cfg.Node.Bitswap.TaskWorkers = cctx.Int("bitswap-task-workers")
+		case "bitswap-no-provide":
+			cfg.Node.Bitswap.NoProvide = cctx.Bool("bitswap-no-provide")
+		case "bandwidth-max-out":
+			cfg.Node.Bandwidth.MaxOut = cctx.Int64("bandwidth-max-out")
+		case "bandwidth-max-out-per-peer":
+			cfg.Node.Bandwidth.MaxOutPerPeer = cctx.Int64("bandwidth-max-out-per-peer")
+		case "provide-strategy":
+			cfg.Node.Provider.Strategy = cctx.String("provide-strategy")
+		case "no-limiter":
+			cfg.Node.NoLimiter = cctx.Bool("no-limiter")
+		case "limit-memory":
+			cfg.Node.Limits.SystemLimit.MaxMemory = cctx.Int64("limit-memory")
+		case "limit-conns-inbound":
+			cfg.Node.Limits.SystemLimit.ConnsInbound = cctx.Int("limit-conns-inbound")
+		case "limit-streams-inbound":
+			cfg.Node.Limits.SystemLimit.StreamsInbound = cctx.Int("limit-streams-inbound")
+		case "limit-peer-streams-inbound":
+			cfg.Node.Limits.PeerLimit.StreamsInbound = cctx.Int("limit-peer-streams-inbound")
 		case "estuary-api":
 			cfg.EstuaryRemote.Api = cctx.String("estuary-api")
 		case "handle":
 			cfg.EstuaryRemote.Handle = cctx.String("handle")
 		case "auth-token":
 			cfg.EstuaryRemote.AuthToken = cctx.String("auth-token")
+		case "primary-client-cert":
+			cfg.EstuaryRemote.TLS.CertFile = cctx.String("primary-client-cert")
+		case "primary-client-key":
+			cfg.EstuaryRemote.TLS.KeyFile = cctx.String("primary-client-key")
+		case "primary-ca":
+			cfg.EstuaryRemote.TLS.CAFile = cctx.String("primary-ca")
 		case "private":
 			cfg.Private = cctx.Bool("private")
+		case "verified-deals":
+			verified := cctx.Bool("verified-deals")
+			cfg.VerifiedDeals = &verified
 		case "dev":
 			cfg.Dev = cctx.Bool("dev")
 		case "no-reload-pin-queue":
 			cfg.NoReloadPinQueue = cctx.Bool("no-reload-pin-queue")
+		case "no-auto-migrate":
+			cfg.NoAutoMigrate = cctx.Bool("no-auto-migrate")
+		case "db-max-open-conns":
+			cfg.Database.MaxOpenConns = cctx.Int("db-max-open-conns")
+		case "db-max-idle-conns":
+			cfg.Database.MaxIdleConns = cctx.Int("db-max-idle-conns")
+		case "db-conn-max-lifetime":
+			cfg.Database.ConnMaxLifetime = cctx.Duration("db-conn-max-lifetime")
+		case "db-read-replica":
+			cfg.Database.ReadReplicaConnString = cctx.String("db-read-replica")
+		case "tiering-min-sealed-deals":
+			cfg.Tiering.MinSealedDeals = cctx.Int("tiering-min-sealed-deals")
+		case "tiering-policy":
+			cfg.Tiering.Policy = cctx.String("tiering-policy")
+		case "tiering-cold-dir":
+			cfg.Tiering.ColdDir = cctx.String("tiering-cold-dir")
+		case "disk-high-watermark":
+			cfg.DiskWatermarks.High = cctx.Float64("disk-high-watermark")
+		case "disk-low-watermark":
+			cfg.DiskWatermarks.Low = cctx.Float64("disk-low-watermark")
+		case "aggregate-max-content-size":
+			cfg.Aggregation.MaxContentSize = cctx.Int64("aggregate-max-content-size")
+		case "aggregate-target-size":
+			cfg.Aggregation.TargetSize = cctx.Int64("aggregate-target-size")
+		case "aggregate-max-age":
+			cfg.Aggregation.MaxAge = cctx.Duration("aggregate-max-age")
+		case "metrics-listen":
+			cfg.MetricsListen = cctx.String("metrics-listen")
+		case "pprof":
+			cfg.Debug.Pprof = cctx.Bool("pprof")
+		case "pprof-on-api":
+			cfg.Debug.PprofOnApi = cctx.Bool("pprof-on-api")
+		case "admin-allowed-ips":
+			cfg.AdminAccess.AllowedIPs = cctx.StringSlice("admin-allowed-ips")
+		case "trusted-proxies":
+			cfg.AdminAccess.TrustedProxies = cctx.StringSlice("trusted-proxies")
+		case "gc-interval":
+			cfg.GarbageCollection.Interval = cctx.Duration("gc-interval")
+		case "gc-dry-run":
+			cfg.GarbageCollection.DryRun = cctx.Bool("gc-dry-run")
+		case "rate-limit-requests":
+			cfg.RateLimit.RequestsPerSecond = cctx.Float64("rate-limit-requests")
+		case "rate-limit-upload":
+			cfg.RateLimit.UploadBytesPerSecond = cctx.Int64("rate-limit-upload")
+		case "rpc-encoding":
+			cfg.Rpc.Encoding = cctx.String("rpc-encoding")
+		case "rpc-compression":
+			cfg.Rpc.Compression = cctx.Bool("rpc-compression")
+		case "rpc-heartbeat-interval":
+			cfg.Rpc.HeartbeatInterval = cctx.Duration("rpc-heartbeat-interval")
+		case "rpc-heartbeat-timeout":
+			cfg.Rpc.HeartbeatTimeout = cctx.Duration("rpc-heartbeat-timeout")
+		case "pin-workers":
+			cfg.Pinning.Workers = cctx.Int("pin-workers")
+		case "pin-max-attempts":
+			cfg.Pinning.MaxAttempts = cctx.Int("pin-max-attempts")
+		case "pin-preflight":
+			cfg.Pinning.Preflight = cctx.Bool("pin-preflight")
+		case "pin-preflight-reject":
+			cfg.Pinning.PreflightReject = cctx.Bool("pin-preflight-reject")
+		case "pin-max-size":
+			cfg.Pinning.MaxPinSize = cctx.Int64("pin-max-size")
+		case "deal-batch-size":
+			cfg.DealBatching.BatchSize = cctx.Int("deal-batch-size")
+		case "deal-batch-pacing":
+			cfg.DealBatching.Pacing = cctx.Duration("deal-batch-pacing")
+		case "transfer-stall-timeout":
+			cfg.TransferRestart.StallTimeout = cctx.Duration("transfer-stall-timeout")
+		case "transfer-max-restarts":
+			cfg.TransferRestart.MaxRestarts = cctx.Int("transfer-max-restarts")
+		case "region":
+			cfg.Placement.Region = cctx.String("region")
+		case "storage-class":
+			cfg.Placement.StorageClass = cctx.String("storage-class")
+		case "url-fetch-max-size":
+			cfg.UrlFetch.MaxSize = cctx.Int64("url-fetch-max-size")
+		case "url-fetch-timeout":
+			cfg.UrlFetch.Timeout = cctx.Duration("url-fetch-timeout")
+		case "export-dir":
+			cfg.CarExport.Dir = cctx.String("export-dir")
+		case "export-max-car-size":
+			cfg.CarExport.MaxCarSize = cctx.Int64("export-max-car-size")
+		case "export-expiry":
+			cfg.CarExport.Expiry = cctx.Duration("export-expiry")
+		case "rpc-command-timeout":
+			cfg.Rpc.CommandTimeout = cctx.Duration("rpc-command-timeout")
+		case "rpc-max-concurrent-commands":
+			cfg.Rpc.MaxConcurrentCommands = cctx.Int("rpc-max-concurrent-commands")
+		case "auth-cache-ttl":
+			cfg.AuthCache.TTL = cctx.Duration("auth-cache-ttl")
+		case "auth-local":
+			cfg.AuthCache.LocalAuth = cctx.Bool("auth-local")
+		case "webhooks":
+			cfg.Webhooks.Enabled = cctx.Bool("webhooks")
+		case "webhook-max-attempts":
+			cfg.Webhooks.MaxAttempts = cctx.Int("webhook-max-attempts")
+		case "webhook-allow-private":
+			cfg.Webhooks.AllowPrivate = cctx.Bool("webhook-allow-private")
+		case "integrity-check-interval":
+			cfg.Integrity.Interval = cctx.Duration("integrity-check-interval")
+		case "integrity-sample-size":
+			cfg.Integrity.SampleSize = cctx.Int("integrity-sample-size")
+		case "integrity-refetch":
+			cfg.Integrity.Refetch = cctx.Bool("integrity-refetch")
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = cctx.Duration("shutdown-timeout")
+		case "wallet-deal-addrs":
+			cfg.Wallet.DealAddrs = cctx.StringSlice("wallet-deal-addrs")
+		case "wallet-rotate-interval":
+			cfg.Wallet.RotateInterval = cctx.Duration("wallet-rotate-interval")
+		case "wallet-retrieval-addr":
+			cfg.Wallet.RetrievalAddr = cctx.String("wallet-retrieval-addr")
 		default:
 		}
 	}
@@ -217,9 +430,10 @@ func main() {
 			EnvVars: []string{"FULLNODE_API_INFO"},
 		},
 		&cli.StringFlag{
-			Name:  "config",
-			Usage: "specify configuration file location",
-			Value: filepath.Join(hDir, ".estuary-shuttle"),
+			Name:    "config",
+			Usage:   "specify configuration file location, files ending in .toml or .yaml are read in that format and JSON otherwise",
+			Value:   filepath.Join(hDir, ".estuary-shuttle"),
+			EnvVars: []string{"ESTUARY_SHUTTLE_CONFIG"},
 		},
 		&cli.StringFlag{
 			Name:    "database",
@@ -251,7 +465,7 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:  "estuary-api",
-			Usage: "api endpoint for master estuary node",
+			Usage: "api endpoint for master estuary node, a comma separated list of hosts fails over between them",
 			Value: cfg.EstuaryRemote.Api,
 		},
 		&cli.StringFlag{
@@ -264,11 +478,41 @@ func main() {
 			Usage: "estuary shuttle handle to use",
 			Value: cfg.EstuaryRemote.Handle,
 		},
+		&cli.StringFlag{
+			Name:  "primary-client-cert",
+			Usage: "client certificate to present to the primary, issued for the shuttle handle and reloaded when it changes",
+			Value: cfg.EstuaryRemote.TLS.CertFile,
+		},
+		&cli.StringFlag{
+			Name:  "primary-client-key",
+			Usage: "key file of the client certificate",
+			Value: cfg.EstuaryRemote.TLS.KeyFile,
+		},
+		&cli.StringFlag{
+			Name:  "primary-ca",
+			Usage: "CA file to verify the primary's certificate with instead of the system roots",
+			Value: cfg.EstuaryRemote.TLS.CAFile,
+		},
 		&cli.StringFlag{
 			Name:  "host",
 			Usage: "url that this node is publicly dialable at",
 			Value: cfg.Hostname,
 		},
+		&cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "certificate file to serve the api over tls with",
+			Value: cfg.TLS.CertFile,
+		},
+		&cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "private key file for the tls certificate",
+			Value: cfg.TLS.KeyFile,
+		},
+		&cli.BoolFlag{
+			Name:  "tls-autocert",
+			Usage: "serve the api over tls with certificates from letsencrypt for the --host name, the api has to be reachable on port 443",
+			Value: cfg.TLS.Autocert,
+		},
 		&cli.BoolFlag{
 			Name:  "logging",
 			Usage: "enable api endpoint logging",
@@ -284,36 +528,392 @@ func main() {
 			Usage: "truncates old logs with new ones",
 			Value: cfg.Node.WriteLogTruncate,
 		},
+		&cli.Int64Flag{
+			Name:  "write-log-max-size",
+			Usage: "flush the write log out in full once it takes up this many bytes, 0 to disable",
+			Value: cfg.Node.WriteLogMaxSize,
+		},
+		&cli.DurationFlag{
+			Name:  "write-log-max-age",
+			Usage: "flush the write log out in full at least this often, 0 to disable",
+			Value: cfg.Node.WriteLogMaxAge,
+		},
 		&cli.BoolFlag{
 			Name:  "no-blockstore-cache",
 			Usage: "disable blockstore caching",
 			Value: cfg.Node.NoBlockstoreCache,
 		},
+		&cli.IntFlag{
+			Name:  "blockstore-bloom-filter-size",
+			Usage: "size in bytes of the bloom filter answering whether blocks are stored, built at startup, 0 to disable",
+			Value: cfg.Node.BlockstoreCache.BloomFilterSize,
+		},
+		&cli.IntFlag{
+			Name:  "blockstore-block-cache-size",
+			Usage: "number of recently read blocks kept in memory, 0 to disable",
+			Value: cfg.Node.BlockstoreCache.BlockCacheSize,
+		},
+		&cli.BoolFlag{
+			Name:  "compress-blocks",
+			Usage: "compress blocks with zstd before writing them to the blockstore",
+			Value: cfg.Node.CompressBlocks,
+		},
 		&cli.BoolFlag{
 			Name:  "private",
 			Usage: "sets shuttle as private",
 			Value: cfg.Private,
 		},
+		&cli.BoolFlag{
+			Name:  "verified-deals",
+			Usage: "have deals for content on this shuttle made verified (true) or unverified (false), instead of following the primary",
+		},
 		&cli.BoolFlag{
 			Name:  "disable-local-content-adding",
 			Usage: "disallow new content ingestion on this node",
 			Value: cfg.Content.DisableLocalAdding,
 		},
+		&cli.BoolFlag{
+			Name:  "streaming-import",
+			Usage: "write uploaded data directly into the main blockstore instead of a staging blockstore",
+			Value: cfg.Content.StreamingImport,
+		},
+		&cli.BoolFlag{
+			Name:  "commp-on-import",
+			Usage: "compute the piece commitment of uploaded content right after it is imported",
+			Value: cfg.Content.CommPOnImport,
+		},
+		&cli.IntFlag{
+			Name:  "staging-copy-workers",
+			Usage: "number of workers copying staged uploads into the blockstore",
+			Value: cfg.Content.StagingCopy.Workers,
+		},
+		&cli.Int64Flag{
+			Name:  "max-upload-size",
+			Usage: "largest upload in bytes a user may send unless overridden for them on the primary, 0 disables the limit",
+			Value: cfg.Content.MaxUploadSize,
+		},
+		&cli.Int64Flag{
+			Name:  "max-chunk-size",
+			Usage: "largest chunk size in bytes that uploaders may request",
+			Value: cfg.Content.MaxChunkSize,
+		},
 		&cli.BoolFlag{
 			Name:  "no-reload-pin-queue",
 			Usage: "disable reloading pin queue on shuttle start",
 			Value: cfg.NoReloadPinQueue,
 		},
+		&cli.IntFlag{
+			Name:  "db-max-open-conns",
+			Usage: "maximum number of open database connections",
+			Value: cfg.Database.MaxOpenConns,
+		},
+		&cli.IntFlag{
+			Name:  "db-max-idle-conns",
+			Usage: "maximum number of idle database connections kept open",
+			Value: cfg.Database.MaxIdleConns,
+		},
+		&cli.DurationFlag{
+			Name:  "db-conn-max-lifetime",
+			Usage: "how long a database connection may be reused, 0 for no limit",
+			Value: cfg.Database.ConnMaxLifetime,
+		},
+		&cli.StringFlag{
+			Name:    "db-read-replica",
+			Usage:   "connection string of a read replica of the database, listings and stats are read from it",
+			EnvVars: []string{"ESTUARY_SHUTTLE_DATABASE_REPLICA"},
+		},
+		&cli.IntFlag{
+			Name:  "tiering-min-sealed-deals",
+			Usage: "move content off the blockstore once it has this many sealed deals, 0 to keep it",
+			Value: cfg.Tiering.MinSealedDeals,
+		},
+		&cli.StringFlag{
+			Name:  "tiering-policy",
+			Usage: "what happens to the blocks of tiered content: 'offload' moves them to the cold store, 'delete' drops them",
+			Value: cfg.Tiering.Policy,
+		},
+		&cli.Float64Flag{
+			Name:  "disk-high-watermark",
+			Usage: "share of a blockstore disk in use past which new content is refused, 0 to never refuse it",
+			Value: cfg.DiskWatermarks.High,
+		},
+		&cli.Float64Flag{
+			Name:  "disk-low-watermark",
+			Usage: "share of the blockstore disks in use below which new content is taken again",
+			Value: cfg.DiskWatermarks.Low,
+		},
+		&cli.Int64Flag{
+			Name:  "aggregate-max-content-size",
+			Usage: "aggregate content up to this size on the shuttle so it is stored in deals together, 0 to leave it to the primary",
+			Value: cfg.Aggregation.MaxContentSize,
+		},
+		&cli.Int64Flag{
+			Name:  "aggregate-target-size",
+			Usage: "size aggregates of small content are filled up to",
+			Value: cfg.Aggregation.TargetSize,
+		},
+		&cli.DurationFlag{
+			Name:  "aggregate-max-age",
+			Usage: "how long small content waits for its aggregate to fill up",
+			Value: cfg.Aggregation.MaxAge,
+		},
+		&cli.StringFlag{
+			Name:  "tiering-cold-dir",
+			Usage: "directory of the cold store tiered content is offloaded to, defaults to the cold directory in the data directory",
+		},
+		&cli.BoolFlag{
+			Name:  "no-auto-migrate",
+			Usage: "refuse to start with pending database migrations instead of applying them, they are applied with the migrate command",
+			Value: cfg.NoAutoMigrate,
+		},
+		&cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "address to serve prometheus metrics and debug endpoints on, empty to not serve them",
+			Value: cfg.MetricsListen,
+		},
+		&cli.BoolFlag{
+			Name:  "pprof",
+			Usage: "serve the pprof endpoints on the metrics listener",
+			Value: cfg.Debug.Pprof,
+		},
+		&cli.BoolFlag{
+			Name:  "pprof-on-api",
+			Usage: "serve the pprof endpoints on the api under /admin/debug/pprof, behind admin auth",
+			Value: cfg.Debug.PprofOnApi,
+		},
+		&cli.StringSliceFlag{
+			Name:  "admin-allowed-ips",
+			Usage: "addresses and cidr ranges the admin api and debug endpoints can be reached from, all if unset",
+			Value: cli.NewStringSlice(cfg.AdminAccess.AllowedIPs...),
+		},
+		&cli.StringSliceFlag{
+			Name:  "trusted-proxies",
+			Usage: "addresses and cidr ranges of proxies whose X-Forwarded-For header gives the client address",
+			Value: cli.NewStringSlice(cfg.AdminAccess.TrustedProxies...),
+		},
+		&cli.DurationFlag{
+			Name:  "gc-interval",
+			Usage: "how often to garbage collect unreferenced blocks, 0 disables scheduled collection",
+			Value: cfg.GarbageCollection.Interval,
+		},
+		&cli.BoolFlag{
+			Name:  "gc-dry-run",
+			Usage: "only count unreferenced blocks during scheduled garbage collection",
+			Value: cfg.GarbageCollection.DryRun,
+		},
+		&cli.Float64Flag{
+			Name:  "rate-limit-requests",
+			Usage: "api requests per second allowed for each user, 0 disables the limit",
+			Value: cfg.RateLimit.RequestsPerSecond,
+		},
+		&cli.Int64Flag{
+			Name:  "rate-limit-upload",
+			Usage: "upload bytes per second allowed for each user, 0 disables the limit",
+			Value: cfg.RateLimit.UploadBytesPerSecond,
+		},
+		&cli.StringFlag{
+			Name:  "rpc-encoding",
+			Usage: "encoding to offer the primary for rpc messages, cbor or json",
+			Value: cfg.Rpc.Encoding,
+		},
+		&cli.BoolFlag{
+			Name:  "rpc-compression",
+			Usage: "offer the primary to gzip large rpc messages",
+			Value: cfg.Rpc.Compression,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-heartbeat-interval",
+			Usage: "how often heartbeats are exchanged with the primary, 0 disables them",
+			Value: cfg.Rpc.HeartbeatInterval,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-heartbeat-timeout",
+			Usage: "how long the primary may go silent before the connection is considered dead",
+			Value: cfg.Rpc.HeartbeatTimeout,
+		},
+		&cli.IntFlag{
+			Name:  "pin-workers",
+			Usage: "number of pins fetched at once",
+			Value: cfg.Pinning.Workers,
+		},
+		&cli.IntFlag{
+			Name:  "pin-max-attempts",
+			Usage: "how many times a pin is attempted before it is given up on",
+			Value: cfg.Pinning.MaxAttempts,
+		},
+		&cli.BoolFlag{
+			Name:  "pin-preflight",
+			Usage: "estimate the size of dags from their root before pinning them",
+			Value: cfg.Pinning.Preflight,
+		},
+		&cli.BoolFlag{
+			Name:  "pin-preflight-reject",
+			Usage: "fail pins the preflight check estimates to be too large instead of only logging them",
+			Value: cfg.Pinning.PreflightReject,
+		},
+		&cli.Int64Flag{
+			Name:  "pin-max-size",
+			Usage: "largest dag size in bytes the preflight check lets through, 0 for no limit",
+			Value: cfg.Pinning.MaxPinSize,
+		},
+		&cli.IntFlag{
+			Name:  "deal-batch-size",
+			Usage: "how many deal transfers to the same miner are started at once, 0 starts them all right away",
+			Value: cfg.DealBatching.BatchSize,
+		},
+		&cli.DurationFlag{
+			Name:  "deal-batch-pacing",
+			Usage: "how long to wait between batches of deal transfers to the same miner",
+			Value: cfg.DealBatching.Pacing,
+		},
+		&cli.DurationFlag{
+			Name:  "transfer-stall-timeout",
+			Usage: "restart deal transfers that made no progress for this long, 0 to never restart them",
+			Value: cfg.TransferRestart.StallTimeout,
+		},
+		&cli.IntFlag{
+			Name:  "transfer-max-restarts",
+			Usage: "how many times a deal transfer is restarted before its deal is failed",
+			Value: cfg.TransferRestart.MaxRestarts,
+		},
+		&cli.StringFlag{
+			Name:  "region",
+			Usage: "region label reported to the primary, which points uploads from that region here",
+			Value: cfg.Placement.Region,
+		},
+		&cli.StringFlag{
+			Name:  "storage-class",
+			Usage: "label for the kind of storage the blockstore is on, reported to the primary",
+			Value: cfg.Placement.StorageClass,
+		},
+		&cli.Int64Flag{
+			Name:  "url-fetch-max-size",
+			Usage: "largest download made for add-from-url, 0 disables add-from-url",
+			Value: cfg.UrlFetch.MaxSize,
+		},
+		&cli.DurationFlag{
+			Name:  "url-fetch-timeout",
+			Usage: "how long a download made for add-from-url may take",
+			Value: cfg.UrlFetch.Timeout,
+		},
+		&cli.StringFlag{
+			Name:  "export-dir",
+			Usage: "directory the car files of content exports are written to, defaults to the exports directory in the data directory",
+		},
+		&cli.Int64Flag{
+			Name:  "export-max-car-size",
+			Usage: "size at which a content export continues in another car file, 0 disables exports",
+			Value: cfg.CarExport.MaxCarSize,
+		},
+		&cli.DurationFlag{
+			Name:  "export-expiry",
+			Usage: "how long the car files of a finished content export can be downloaded",
+			Value: cfg.CarExport.Expiry,
+		},
+		&cli.DurationFlag{
+			Name:  "rpc-command-timeout",
+			Usage: "how long a command from the primary may take to handle, 0 disables the timeout",
+			Value: cfg.Rpc.CommandTimeout,
+		},
+		&cli.IntFlag{
+			Name:  "rpc-max-concurrent-commands",
+			Usage: "how many commands from the primary are handled at once",
+			Value: cfg.Rpc.MaxConcurrentCommands,
+		},
+		&cli.DurationFlag{
+			Name:  "auth-cache-ttl",
+			Usage: "how long api token checks against the primary are cached for",
+			Value: cfg.AuthCache.TTL,
+		},
+		&cli.BoolFlag{
+			Name:  "auth-local",
+			Usage: "check JWT api keys against the primary's public key instead of asking the primary",
+			Value: cfg.AuthCache.LocalAuth,
+		},
+		&cli.BoolFlag{
+			Name:  "webhooks",
+			Usage: "deliver the events of users' webhooks",
+			Value: cfg.Webhooks.Enabled,
+		},
+		&cli.IntFlag{
+			Name:  "webhook-max-attempts",
+			Usage: "how often a webhook delivery is tried before it is given up on",
+			Value: cfg.Webhooks.MaxAttempts,
+		},
+		&cli.BoolFlag{
+			Name:  "webhook-allow-private",
+			Usage: "let webhooks point at loopback and private addresses",
+		},
+		&cli.DurationFlag{
+			Name:  "integrity-check-interval",
+			Usage: "how often to check a sample of the stored blocks against their cids, 0 to disable",
+			Value: cfg.Integrity.Interval,
+		},
+		&cli.IntFlag{
+			Name:  "integrity-sample-size",
+			Usage: "number of blocks each integrity check samples",
+			Value: cfg.Integrity.SampleSize,
+		},
+		&cli.BoolFlag{
+			Name:  "integrity-refetch",
+			Usage: "fetch corrupted and missing blocks again over bitswap instead of only flagging their pins",
+			Value: cfg.Integrity.Refetch,
+		},
+		&cli.DurationFlag{
+			Name:  "shutdown-timeout",
+			Usage: "how long to wait for active pins, transfers and uploads to finish on shutdown",
+			Value: cfg.ShutdownTimeout,
+		},
+		&cli.StringSliceFlag{
+			Name:  "wallet-deal-addrs",
+			Usage: "wallet addresses to make deals with, used in turn when rotating",
+			Value: cli.NewStringSlice(cfg.Wallet.DealAddrs...),
+		},
+		&cli.DurationFlag{
+			Name:  "wallet-rotate-interval",
+			Usage: "how often to move on to the next deal address, 0 to only rotate when asked through the admin api",
+			Value: cfg.Wallet.RotateInterval,
+		},
+		&cli.StringFlag{
+			Name:  "wallet-retrieval-addr",
+			Usage: "wallet address to pay for retrievals from, the wallet default if unset",
+			Value: cfg.Wallet.RetrievalAddr,
+		},
 		&cli.BoolFlag{
 			Name:  "dev",
 			Usage: "use http:// and ws:// when connecting to estuary in a development environment",
 			Value: cfg.Dev,
 		},
 		&cli.StringSliceFlag{
-			Name: "announce-addr",
-			Usage: "specify multiaddrs that this node can be connected to	",
+			Name:  "announce-addr",
+			Usage: "specify multiaddrs that this node can be connected to",
 			Value: cli.NewStringSlice(cfg.Node.AnnounceAddrs...),
 		},
+		&cli.StringSliceFlag{
+			Name:  "no-announce-addr",
+			Usage: "specify multiaddrs or ranges like /ip4/10.0.0.0/ipcidr/8 that this node should not advertise",
+			Value: cli.NewStringSlice(cfg.Node.NoAnnounceAddrs...),
+		},
+		&cli.StringFlag{
+			Name:  "swarm-key",
+			Usage: "join the private libp2p network of this swarm.key file, every node of the deployment needs the same key",
+			Value: cfg.Node.SwarmKeyFile,
+		},
+		&cli.BoolFlag{
+			Name:  "relay-client",
+			Usage: "dial peers through circuit relays when they cant be reached directly",
+			Value: cfg.Node.Relay.Client,
+		},
+		&cli.BoolFlag{
+			Name:  "relay-service",
+			Usage: "act as a circuit relay for other peers",
+			Value: cfg.Node.Relay.Service,
+		},
+		&cli.BoolFlag{
+			Name:  "hole-punching",
+			Usage: "upgrade relayed connections to direct ones with hole punching",
+			Value: cfg.Node.Relay.HolePunching,
+		},
 		&cli.StringFlag{
 			Name:  "peering-peers",
 			Usage: "specify peering peers that this node can be connected to",
@@ -348,6 +948,66 @@ func main() {
 			Usage: "sets the bitswap target message size",
 			Value: cfg.Node.Bitswap.TargetMessageSize,
 		},
+		&cli.IntFlag{
+			Name:  "bitswap-engine-task-workers",
+			Usage: "sets the number of bitswap engine workers processing peer requests",
+			Value: cfg.Node.Bitswap.EngineTaskWorkers,
+		},
+		&cli.IntFlag{
+			Name:  "bitswap-engine-blockstore-workers",
+			Usage: "sets the number of bitswap workers reading blocks from the blockstore",
+			Value: cfg.Node.Bitswap.EngineBlockstoreWorkers,
+		},
+		&cli.IntFlag{
+			Name:  "bitswap-task-workers",
+			Usage: "sets the number of bitswap workers sending messages to peers",
+			Value: cfg.Node.Bitswap.TaskWorkers,
+		},
+		&cli.Int64Flag{
+			Name:  "bandwidth-max-out",
+			Usage: "bytes per second bitswap and deal transfers may send in total, 0 for no cap",
+			Value: cfg.Node.Bandwidth.MaxOut,
+		},
+		&cli.Int64Flag{
+			Name:  "bandwidth-max-out-per-peer",
+			Usage: "bytes per second bitswap and deal transfers may send to a single peer, 0 for no cap",
+			Value: cfg.Node.Bandwidth.MaxOutPerPeer,
+		},
+		&cli.BoolFlag{
+			Name:  "bitswap-no-provide",
+			Usage: "stop bitswap from announcing the blocks it receives",
+			Value: cfg.Node.Bitswap.NoProvide,
+		},
+		&cli.StringFlag{
+			Name:  "provide-strategy",
+			Usage: "what to announce to the dht: disabled, roots, pinned (every block of stored content) or all (every block in the blockstore)",
+			Value: cfg.Node.Provider.Strategy,
+		},
+		&cli.BoolFlag{
+			Name:  "no-limiter",
+			Usage: "run the libp2p host without resource limits",
+			Value: cfg.Node.NoLimiter,
+		},
+		&cli.Int64Flag{
+			Name:  "limit-memory",
+			Usage: "sets the most memory libp2p may reserve, in bytes",
+			Value: cfg.Node.Limits.SystemLimit.MaxMemory,
+		},
+		&cli.IntFlag{
+			Name:  "limit-conns-inbound",
+			Usage: "sets the most inbound libp2p connections",
+			Value: cfg.Node.Limits.SystemLimit.ConnsInbound,
+		},
+		&cli.IntFlag{
+			Name:  "limit-streams-inbound",
+			Usage: "sets the most inbound libp2p streams",
+			Value: cfg.Node.Limits.SystemLimit.StreamsInbound,
+		},
+		&cli.IntFlag{
+			Name:  "limit-peer-streams-inbound",
+			Usage: "sets the most inbound libp2p streams a single peer may open",
+			Value: cfg.Node.Limits.PeerLimit.StreamsInbound,
+		},
 	}
 
 	app.Commands = []*cli.Command{
@@ -366,6 +1026,180 @@ func main() {
 				return cfg.Save(configFile)
 			},
 		},
+		{
+			Name:  "wallet",
+			Usage: "Manage the keys of the shuttle wallet",
+			Before: func(cctx *cli.Context) error {
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+				return overrideSetOptions(app.Flags, cctx, cfg)
+			},
+			Subcommands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "Lists the addresses in the wallet with their balances",
+					Action: func(cctx *cli.Context) error {
+						return walletListCmd(cctx.Context, cfg)
+					},
+				},
+				{
+					Name:      "export",
+					Usage:     "Prints the key of an address in the format of lotus wallet export",
+					ArgsUsage: "<address>",
+					Action: func(cctx *cli.Context) error {
+						if cctx.Args().Len() != 1 {
+							return fmt.Errorf("must specify the address to export")
+						}
+						return walletExportCmd(cctx.Context, cfg, cctx.Args().First())
+					},
+				},
+				{
+					Name:      "import",
+					Usage:     "Adds a key exported by a shuttle or lotus to the wallet, read from stdin if no file is given",
+					ArgsUsage: "[file]",
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "default",
+							Usage: "make the imported address the wallet default",
+						},
+					},
+					Action: func(cctx *cli.Context) error {
+						return walletImportCmd(cctx.Context, cfg, cctx.Args().First(), cctx.Bool("default"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "migrate",
+			Usage: "Manage the versioned migrations of the shuttle database, run with the node stopped",
+			Before: func(cctx *cli.Context) error {
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+				return overrideSetOptions(app.Flags, cctx, cfg)
+			},
+			Subcommands: []*cli.Command{
+				{
+					Name:  "status",
+					Usage: "Lists the migrations and whether they are applied",
+					Action: func(cctx *cli.Context) error {
+						return migrateStatusCmd(cfg.DatabaseConnString)
+					},
+				},
+				{
+					Name:  "up",
+					Usage: "Applies the pending migrations",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "to",
+							Usage: "only apply migrations up to and including this one",
+						},
+					},
+					Action: func(cctx *cli.Context) error {
+						return migrateUpCmd(cfg.DatabaseConnString, cctx.String("to"))
+					},
+				},
+				{
+					Name:  "down",
+					Usage: "Rolls back the latest applied migrations",
+					Flags: []cli.Flag{
+						&cli.IntFlag{
+							Name:  "steps",
+							Usage: "number of migrations to roll back",
+							Value: 1,
+						},
+					},
+					Action: func(cctx *cli.Context) error {
+						return migrateDownCmd(cfg.DatabaseConnString, cctx.Int("steps"))
+					},
+				},
+			},
+		},
+		{
+			Name:      "migrate-blockstore",
+			Usage:     "Copies all blocks from one blockstore to another, run with the node stopped",
+			ArgsUsage: "<from> <to>",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "delete",
+					Usage: "delete blocks from the source blockstore once copied",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if cctx.Args().Len() != 2 {
+					return fmt.Errorf("must specify source and destination blockstores")
+				}
+				return node.MigrateBlockstore(cctx.Context, cctx.Args().Get(0), cctx.Args().Get(1), cctx.Bool("delete"))
+			},
+		},
+		{
+			Name:  "verify-wal",
+			Usage: "Checks the write log against the blockstore for blocks that were not flushed or got damaged, run with the node stopped",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "repair",
+					Usage: "write the missing and damaged blocks from the write log into the blockstore, and drop corrupt blocks from the log",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+				return verifyWalCmd(cctx.Context, &cfg.Node, cctx.Bool("repair"))
+			},
+		},
+		{
+			Name:      "backfill",
+			Usage:     "Regenerates the tracked objects of pins that do not match their dags in the blockstore, run with the node stopped",
+			ArgsUsage: "[content ids...]",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only list the pins whose tracking is wrong",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+
+				var contents []uint
+				for _, arg := range cctx.Args().Slice() {
+					id, err := strconv.ParseUint(arg, 10, 64)
+					if err != nil {
+						return fmt.Errorf("invalid content id %q", arg)
+					}
+					contents = append(contents, uint(id))
+				}
+				return backfillCmd(cctx.Context, cfg, contents, cctx.Bool("dry-run"))
+			},
+		},
+		{
+			Name:  "gc",
+			Usage: "Removes every block no pin references from the blockstore, run with the node stopped",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only count the unreferenced blocks and the bytes they take",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if err := cfg.Load(cctx.String("config")); err != nil && err != config.ErrNotInitialized {
+					return err
+				}
+				if err := overrideSetOptions(app.Flags, cctx, cfg); err != nil {
+					return err
+				}
+				return gcCmd(cctx.Context, cfg, cctx.Bool("dry-run"))
+			},
+		},
 	}
 
 	app.Action = func(cctx *cli.Context) error {
@@ -383,11 +1217,27 @@ func main() {
 			return err
 		}
 
-		db, err := setupDatabase(cfg.DatabaseConnString)
+		if err := applyLogConfig(cfg.Logging); err != nil {
+			return err
+		}
+
+		openDB := setupDatabase
+		if cfg.NoAutoMigrate {
+			openDB = openDatabase
+		}
+		db, err := openDB(cfg.DatabaseConnString, databasePool(cfg.Database))
 		if err != nil {
 			return err
 		}
 
+		var replicaDB *gorm.DB
+		if cfg.Database.ReadReplicaConnString != "" {
+			replicaDB, err = util.SetupDatabaseWithPool(cfg.Database.ReadReplicaConnString, databasePool(cfg.Database))
+			if err != nil {
+				return fmt.Errorf("failed to open read replica: %w", err)
+			}
+		}
+
 		if cfg.Node.EnableWebsocketListenAddr {
 			cfg.Node.ListenAddrs = append(cfg.Node.ListenAddrs, config.DefaultWebsocketAddr)
 		}
@@ -398,29 +1248,20 @@ func main() {
 			return err
 		}
 
-		// send a CLI context to lotus that contains only the node "api-url" flag set, so that other flags don't accidentally conflict with lotus cli flags
-		// https://github.com/filecoin-project/lotus/blob/731da455d46cb88ee5de9a70920a2d29dec9365c/cli/util/api.go#L37
-		flset := flag.NewFlagSet("lotus", flag.ExitOnError)
-		flset.String("api-url", "", "node api url")
-		err = flset.Set("api-url", cfg.Node.ApiURL)
-		if err != nil {
-			return err
-		}
-
-		ncctx := cli.NewContext(cli.NewApp(), flset, nil)
-		api, closer, err := lcli.GetGatewayAPI(ncctx)
+		api, closer, err := openGatewayAPI(cfg.Node.ApiURL)
 		if err != nil {
 			return err
 		}
 		defer closer()
 
-		defaddr, err := nd.Wallet.GetDefault()
+		wallets, err := newWalletAddrs(cctx.Context, nd.Wallet, cfg.Wallet)
 		if err != nil {
 			return err
 		}
 
+		// the shuttle only pays from its wallet for retrievals
 		rhost := routed.Wrap(nd.Host, nd.FilDht)
-		filc, err := filclient.NewClient(rhost, api, nd.Wallet, defaddr, nd.Blockstore, nd.Datastore, cfg.DataDir)
+		filc, err := filclient.NewClient(rhost, api, nd.Wallet, wallets.retrievalAddr(), nd.Blockstore, nd.Datastore, cfg.DataDir)
 		if err != nil {
 			return err
 		}
@@ -438,6 +1279,13 @@ func main() {
 				return nil, err
 			}
 
+			stored, err := lookupPieceCommRecord(db, c)
+			if err != nil {
+				log.Errorf("failed to look up piece commitment record for %s: %s", c, err)
+			} else if stored != nil {
+				return stored, nil
+			}
+
 			commpcid, carSize, size, err := filclient.GeneratePieceCommitmentFFI(ctx, c, nd.Blockstore)
 			if err != nil {
 				return nil, err
@@ -451,6 +1299,9 @@ func main() {
 				CarSize: carSize,
 			}
 
+			if err := savePieceCommRecord(db, c, res); err != nil {
+				log.Errorf("failed to save piece commitment record for %s: %s", c, err)
+			}
 			return res, nil
 		})
 		commpMemo.SetConcurrencyLimit(4)
@@ -460,8 +1311,34 @@ func main() {
 			return err
 		}
 
-		// TODO: Paramify this? also make a proper constructor for the shuttle
-		cache, err := lru.New2Q(1000)
+		upmgr, err := uploads.NewManager(cfg.UploadDataDir)
+		if err != nil {
+			return err
+		}
+
+		coldStore, err := openColdStore(cfg.Tiering)
+		if err != nil {
+			return err
+		}
+
+		// TODO: make a proper constructor for the shuttle
+		cache, err := lru.New2Q(cfg.AuthCache.Size)
+		if err != nil {
+			return err
+		}
+
+		primaryTLS, err := newPrimaryTLSConfig(cfg.EstuaryRemote.TLS)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate for the primary: %w", err)
+		}
+
+		adminAccess, err := newAdminAccess(cfg.AdminAccess)
+		if err != nil {
+			return err
+		}
+
+		rl := cfg.RateLimit
+		limiter, err := newUserLimiter(rl.RequestsPerSecond, rl.RequestBurst, rl.UploadBytesPerSecond, rl.UploadBurst)
 		if err != nil {
 			return err
 		}
@@ -479,35 +1356,95 @@ func main() {
 			Node:        nd,
 			Api:         api,
 			DB:          db,
+			replicaDB:   replicaDB,
 			Filc:        filc,
 			StagingMgr:  sbm,
+			Uploads:     upmgr,
 			Private:     cfg.Private,
 			gwayHandler: gateway.NewGatewayHandler(nd.Blockstore),
 
 			Tracer: otel.Tracer(fmt.Sprintf("shuttle_%s", cfg.Hostname)),
 
 			commpMemo: commpMemo,
+			metrics:   newShuttleMetrics(metCtx),
 
 			trackingChannels: make(map[string]*chanTrack),
 			inflightCids:     make(map[cid.Cid]uint),
+			davLocks:         webdav.NewMemLS(),
+			urlFetchClient:   newUrlFetchClient(cfg.UrlFetch),
+			coldStore:        coldStore,
 			splitsInProgress: make(map[uint]bool),
+			cmdSem:           make(chan struct{}, cfg.Rpc.MaxConcurrentCommands),
+			runningCmds:      make(map[uint]map[*runningCmd]struct{}),
 
 			outgoing:  make(chan *drpc.Message),
+			nextMsgID: uint64(time.Now().UnixNano()),
+			resend:    newResendQueue(nd.Datastore),
 			authCache: cache,
+			limiter:   limiter,
+			transfers: newTransferBatcher(cfg.DealBatching.BatchSize, cfg.DealBatching.Pacing),
+			wallets:   wallets,
+			mpusher:   filclient.NewMsgPusher(api, nd.Wallet),
+
+			adminAccess: adminAccess,
+			primaryTLS:  primaryTLS,
+			primaryHTTP: newPrimaryClient(primaryTLS),
+			webhooks:    newWebhooks(cfg.Webhooks),
+
+			shuttingDown: make(chan struct{}),
+			goodbyeSent:  make(chan struct{}),
 
 			hostname:           cfg.Hostname,
-			estuaryHost:        cfg.EstuaryRemote.Api,
+			primaries:          newPrimarySet(cfg.EstuaryRemote.Api),
 			shuttleHandle:      cfg.EstuaryRemote.Handle,
 			shuttleToken:       cfg.EstuaryRemote.AuthToken,
 			disableLocalAdding: cfg.Content.DisableLocalAdding,
 			dev:                cfg.Dev,
 			shuttleConfig:      cfg,
 		}
+		lastMsgID, err := s.resend.load(cctx.Context)
+		if err != nil {
+			return fmt.Errorf("failed to load rpc outbox: %w", err)
+		}
+		if lastMsgID >= s.nextMsgID {
+			s.nextMsgID = lastMsgID
+		}
+		if n := s.resend.len(); n > 0 {
+			log.Infof("loaded %d rpc messages that were not delivered before the last shutdown", n)
+		}
+
+		if err := s.loadDraining(cctx.Context); err != nil {
+			return fmt.Errorf("failed to load drain state: %w", err)
+		}
+
+		if cfg.Tiering.MinSealedDeals > 0 {
+			// reads of tiered content bring it back
+			s.gwayHandler = gateway.NewGatewayHandler(&tieredBlockstore{Blockstore: nd.Blockstore, s: s})
+		}
+
 		s.PinMgr = pinner.NewPinManager(s.doPinning, s.onPinStatusUpdate, &pinner.PinManagerOpts{
 			MaxActivePerUser: 30,
 		})
 
-		go s.PinMgr.Run(100)
+		go s.PinMgr.Run(cfg.Pinning.Workers)
+		go s.runUploadCleaner()
+		go s.runMetricsUpdater()
+		go s.runScheduledGC()
+		go s.runPinRetries()
+		go s.runExpiryReaper()
+		go s.runDiskWatermarks()
+		go s.runAggregator()
+		go s.runTransferWatchdog()
+		go s.runCarExportCleaner()
+		go s.runIdempotencyKeyCleaner()
+		go s.runPinProgressReports()
+		go s.runIntegrityChecks()
+		if s.webhooks != nil {
+			go s.runWebhookDeliveries()
+		}
+		if cfg.Wallet.RotateInterval > 0 {
+			go s.runWalletRotation(cfg.Wallet.RotateInterval)
+		}
 
 		if !cfg.NoReloadPinQueue {
 			if err := s.refreshPinQueue(); err != nil {
@@ -582,22 +1519,19 @@ func main() {
 			return fmt.Errorf("subscribing to libp2p transfer manager: %w", err)
 		}
 
-		go func() {
-			http.Handle("/debug/metrics", estumetrics.Exporter())
-			http.HandleFunc("/debug/stack", func(w http.ResponseWriter, r *http.Request) {
-				if err := writeAllGoroutineStacks(w); err != nil {
-					log.Error(err)
+		if cfg.MetricsListen != "" {
+			go func() {
+				server := &http.Server{
+					Addr:              cfg.MetricsListen,
+					Handler:           s.metricsMux(),
+					ReadHeaderTimeout: 5 * time.Second,
 				}
-			})
-			server := &http.Server{
-				Addr:              "127.0.0.1:3105",
-				ReadHeaderTimeout: 5 * time.Second,
-			}
 
-			if err := server.ListenAndServe(); err != nil {
-				log.Errorf("failed to start http server for pprof endpoints: %s", err)
-			}
-		}()
+				if err := server.ListenAndServe(); err != nil {
+					log.Errorf("failed to start http server for metrics and debug endpoints: %s", err)
+				}
+			}()
+		}
 
 		go func() {
 			if err := s.RunRpcConnection(); err != nil {
@@ -605,41 +1539,9 @@ func main() {
 			}
 		}()
 
-		blockstoreSize := metrics.NewCtx(metCtx, "blockstore_size", "total size of blockstore filesystem directory").Gauge()
-		blockstoreFree := metrics.NewCtx(metCtx, "blockstore_free", "free space in blockstore filesystem directory").Gauge()
-
 		go func() {
-			upd, err := s.getUpdatePacket()
-			if err != nil {
-				log.Errorf("failed to get update packet: %s", err)
-			}
-
-			blockstoreSize.Set(float64(upd.BlockstoreSize))
-			blockstoreFree.Set(float64(upd.BlockstoreFree))
-
-			if err := s.sendRpcMessage(context.TODO(), &drpc.Message{
-				Op: drpc.OP_ShuttleUpdate,
-				Params: drpc.MsgParams{
-					ShuttleUpdate: upd,
-				},
-			}); err != nil {
-				log.Errorf("failed to send shuttle update: %s", err)
-			}
-			for range time.Tick(time.Minute) {
-				upd, err := s.getUpdatePacket()
-				if err != nil {
-					log.Errorf("failed to get update packet: %s", err)
-				}
-
-				blockstoreSize.Set(float64(upd.BlockstoreSize))
-				blockstoreFree.Set(float64(upd.BlockstoreFree))
-
-				if err := s.sendRpcMessage(context.TODO(), &drpc.Message{
-					Op: drpc.OP_ShuttleUpdate,
-					Params: drpc.MsgParams{
-						ShuttleUpdate: upd,
-					},
-				}); err != nil {
+			for ; ; time.Sleep(time.Minute) {
+				if err := s.sendShuttleUpdate(context.TODO()); err != nil {
 					log.Errorf("failed to send shuttle update: %s", err)
 				}
 			}
@@ -721,7 +1623,29 @@ func main() {
 			}
 		}()
 
-		return s.ServeAPI()
+		apiErr := make(chan error, 1)
+		go func() {
+			apiErr <- s.ServeAPI()
+		}()
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+		select {
+		case err := <-apiErr:
+			return err
+		case sig := <-sigs:
+			log.Infof("received %s, shutting down (send again to exit immediately)", sig)
+			go func() {
+				<-sigs
+				log.Warnf("received second signal, exiting without draining")
+				os.Exit(1)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			defer cancel()
+			return s.Shutdown(ctx)
+		}
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -744,6 +1668,7 @@ type Shuttle struct {
 	PinMgr     *pinner.PinManager
 	Filc       *filclient.FilClient
 	StagingMgr *stagingbs.StagingBSMgr
+	Uploads    *uploads.Manager
 
 	gwayHandler *gateway.GatewayHandler
 
@@ -751,26 +1676,68 @@ type Shuttle struct {
 
 	tcLk             sync.Mutex
 	trackingChannels map[string]*chanTrack
+	transferRates    transferRates
 
 	splitLk          sync.Mutex
 	splitsInProgress map[uint]bool
 
 	addPinLk sync.Mutex
 
-	outgoing chan *drpc.Message
+	// limits the rpc commands handled at once, see runRpcCmd
+	cmdSem      chan struct{}
+	cmdsLk      sync.Mutex
+	runningCmds map[uint]map[*runningCmd]struct{}
+
+	outgoing        chan *drpc.Message
+	pendingMessages int64
+
+	// messages are numbered from the startup time so ids stay unique across
+	// restarts
+	nextMsgID   uint64
+	resend      *resendQueue
+	primaryAcks int32
+
+	// set while a connection to a primary is up
+	primaryConnected int32
+
+	// set while the blockstore disks are past their high watermark
+	diskPaused int32
+
+	// set while the shuttle is being emptied, see drain.go
+	draining int32
+
+	shuttingDown chan struct{}
+	shutdownOnce sync.Once
+	goodbyeSent  chan struct{}
+	goodbyeOnce  sync.Once
+
+	apiLk sync.Mutex
+	api   *echo.Echo
 
 	Private            bool
 	disableLocalAdding bool
 	dev                bool
 
 	hostname      string
-	estuaryHost   string
+	primaries     *primarySet
 	shuttleHandle string
 	shuttleToken  string
 
 	commpMemo *memo.Memoizer
 
+	metrics   *shuttleMetrics
+	telemetry telemetrySampler
+
 	authCache *lru.TwoQueueCache
+	localAuth localAuth
+	limiter   *userLimiter
+	transfers *transferBatcher
+	wallets   *walletAddrs
+	mpusher   *filclient.MsgPusher
+
+	adminAccess *adminAccess
+	primaryTLS  *tls.Config
+	primaryHTTP *http.Client
 
 	retrLk               sync.Mutex
 	retrievalsInProgress map[uint]*retrievalProgress
@@ -778,6 +1745,29 @@ type Shuttle struct {
 	inflightCids   map[cid.Cid]uint
 	inflightCidsLk sync.Mutex
 
+	gcLk     sync.Mutex
+	gcStatus gcStatus
+
+	integrityLk     sync.Mutex
+	integrityStatus integrityStatus
+
+	davLocks webdav.LockSystem
+	davDirs  davDirs
+
+	urlFetchClient *http.Client
+	urlFetches     urlFetches
+	pinImports     pinImports
+	carExports     carExports
+	webhooks       *webhooks
+
+	// replicaDB is a read replica of DB, nil if there is none
+	replicaDB *gorm.DB
+
+	// coldStore keeps the blocks of tiered content, nil unless tiering
+	// offloads them. tierLk serializes moving blocks between the stores.
+	coldStore blockstore.Blockstore
+	tierLk    sync.Mutex
+
 	shuttleConfig *config.Shuttle
 }
 
@@ -786,19 +1776,43 @@ func (d *Shuttle) isInflight(c cid.Cid) bool {
 	return ok && v > 0
 }
 
+func (d *Shuttle) releaseInflight(c cid.Cid) {
+	d.inflightCidsLk.Lock()
+	defer d.inflightCidsLk.Unlock()
+
+	d.inflightCids[c]--
+	if d.inflightCids[c] <= 0 {
+		delete(d.inflightCids, c)
+	}
+}
+
 type chanTrack struct {
 	dbid uint
 	last *filclient.ChannelState
+
+	// sent is how much the channel had sent when it last made progress, at
+	// progressAt. restarts counts the times the watchdog restarted it,
+	// restartMsg is the channel message it was last restarted over.
+	sent       uint64
+	progressAt time.Time
+	restarts   int
+	restartMsg string
 }
 
 func (d *Shuttle) RunRpcConnection() error {
 	for {
 		conn, err := d.dialConn()
 		if err != nil {
-			log.Errorf("failed to dial estuary rpc endpoint: %s", err)
-			time.Sleep(backoffTimer.NextBackOff())
+			log.Errorw("failed to dial estuary rpc endpoint", "primary", d.primaries.host(), "err", err)
+
+			// try the other primaries right away, back off once all of
+			// them failed
+			if d.primaries.next() {
+				time.Sleep(backoffTimer.NextBackOff())
+			}
 			continue
 		}
+		log.Infow("connected to primary", "primary", d.primaries.host())
 
 		if err := d.runRpc(conn); err != nil {
 			log.Errorf("rpc routine exited with an error: %s", err)
@@ -823,6 +1837,23 @@ func (d *Shuttle) runRpc(conn *websocket.Conn) (err error) {
 
 	readDone := make(chan struct{})
 
+	// messages are sent as uncompressed JSON until the primary agrees to
+	// something else
+	var codec atomic.Value
+	codec.Store(drpc.NewCodec(drpc.EncodingJSON, ""))
+
+	// closed once the primary confirmed it acknowledges messages
+	acksEnabled := make(chan struct{})
+	var acksOnce sync.Once
+	atomic.StoreInt32(&d.primaryAcks, 0)
+	defer atomic.StoreInt32(&d.primaryAcks, 0)
+
+	// set once the primary sent its first heartbeat, from then on it is
+	// expected to keep sending them
+	var heartbeats int32
+	hbInterval := d.shuttleConfig.Rpc.HeartbeatInterval
+	hbTimeout := d.shuttleConfig.Rpc.HeartbeatTimeout
+
 	// Send hello message
 	hello, err := d.getHelloMessage()
 	if err != nil {
@@ -832,49 +1863,161 @@ func (d *Shuttle) runRpc(conn *websocket.Conn) (err error) {
 	if err := websocket.JSON.Send(conn, hello); err != nil {
 		return err
 	}
+	atomic.StoreInt32(&d.primaryConnected, 1)
+	defer atomic.StoreInt32(&d.primaryConnected, 0)
 
 	go func() {
 		defer close(readDone)
 
 		for {
 			var cmd drpc.Command
-			if err := websocket.JSON.Receive(conn, &cmd); err != nil {
+			if err := drpc.NewCodec(drpc.EncodingJSON, "").Receive(conn, &cmd); err != nil {
 				log.Errorf("failed to read command from websocket: %s", err)
 				return
 			}
+			d.metrics.rpcCommandsRecv.Inc()
 
-			go func(cmd *drpc.Command) {
-				if err := d.handleRpcCmd(cmd); err != nil {
-					log.Errorf("failed to handle rpc command: %s", err)
+			if cmd.Op == drpc.CMD_Heartbeat && hbInterval > 0 {
+				atomic.StoreInt32(&heartbeats, 1)
+			}
+			if atomic.LoadInt32(&heartbeats) == 1 {
+				if err := conn.SetReadDeadline(time.Now().Add(hbTimeout)); err != nil {
+					log.Errorf("failed to set the connection's network read deadline: %s", err)
 				}
-			}(&cmd)
+			}
+
+			switch {
+			case cmd.Op == drpc.CMD_Heartbeat:
+				continue
+			case cmd.Op == drpc.CMD_SetRpcEncoding && cmd.Params.SetRpcEncoding != nil:
+				enc := cmd.Params.SetRpcEncoding
+				log.Infow("primary set rpc encoding", "encoding", enc.Encoding, "compression", enc.Compression)
+				codec.Store(drpc.NewCodec(enc.Encoding, enc.Compression))
+				continue
+			case cmd.Op == drpc.CMD_AckMessages && cmd.Params.AckMessages != nil:
+				acksOnce.Do(func() {
+					atomic.StoreInt32(&d.primaryAcks, 1)
+					close(acksEnabled)
+				})
+				d.resend.ack(cmd.Params.AckMessages.IDs)
+				continue
+			}
+
+			d.runRpcCmd(&cmd)
 		}
 	}()
 
+	send := func(msg *drpc.Message) {
+		if err := conn.SetWriteDeadline(time.Now().Add(time.Second * 30)); err != nil {
+			log.Errorf("failed to set the connection's network write deadline: %s", err)
+		}
+		if err := codec.Load().(websocket.Codec).Send(conn, msg); err != nil {
+			d.metrics.sendFailed()
+			log.Errorf("failed to send message: %s", err)
+		} else {
+			d.metrics.rpcMessagesSent.Inc()
+			if msg.Op == drpc.OP_Goodbye {
+				d.goodbyeOnce.Do(func() {
+					close(d.goodbyeSent)
+				})
+			}
+		}
+		if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+			log.Errorf("failed to set the connection's network write deadline: %s", err)
+		}
+	}
+
+	// give the primary a moment to confirm it acknowledges messages before
+	// sending anything. Older primaries never confirm, messages to them are
+	// sent once like before.
+	select {
+	case <-acksEnabled:
+	case <-time.After(time.Second * 5):
+		log.Warnf("primary does not acknowledge rpc messages, they will not be resent")
+	case <-readDone:
+		return fmt.Errorf("read routine exited, assuming socket is closed")
+	}
+
+	// sendQueued sends the messages from the resend queue that were not sent
+	// on this connection yet. On connecting that includes everything left
+	// unacknowledged by earlier connections or runs.
+	var lastSent uint64
+	sendQueued := func(resend bool) error {
+		for _, id := range d.resend.after(lastSent) {
+			lastSent = id
+
+			msg, err := d.resend.get(context.TODO(), id)
+			if err != nil {
+				return fmt.Errorf("failed to read message %d from rpc outbox: %w", id, err)
+			}
+			if msg == nil {
+				continue
+			}
+
+			if resend {
+				d.metrics.rpcMessagesResent.Inc()
+			}
+			send(msg)
+
+			if atomic.LoadInt32(&d.primaryAcks) == 0 {
+				// nothing is going to acknowledge it
+				d.resend.ack([]uint64{id})
+			}
+		}
+		return nil
+	}
+
+	if n := d.resend.len(); n > 0 {
+		log.Infof("sending %d queued rpc messages", n)
+	}
+	if err := sendQueued(true); err != nil {
+		return err
+	}
+
+	var heartbeat <-chan time.Time
+	if hbInterval > 0 {
+		ticker := time.NewTicker(hbInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
 	for {
 		select {
 		case <-readDone:
 			return fmt.Errorf("read routine exited, assuming socket is closed")
-		case msg := <-d.outgoing:
-			if err := conn.SetWriteDeadline(time.Now().Add(time.Second * 30)); err != nil {
-				log.Errorf("failed to set the connection's network write deadline: %s", err)
-
-			}
-			if err := websocket.JSON.Send(conn, msg); err != nil {
-				log.Errorf("failed to send message: %s", err)
+		case <-heartbeat:
+			if atomic.LoadInt32(&heartbeats) == 1 {
+				send(&drpc.Message{Op: drpc.OP_Heartbeat})
 			}
-			if err := conn.SetWriteDeadline(time.Time{}); err != nil {
-				log.Errorf("failed to set the connection's network write deadline: %s", err)
+		case <-d.resend.notify:
+			if err := sendQueued(false); err != nil {
+				return err
 			}
+		case msg := <-d.outgoing:
+			send(msg)
 		}
 	}
 }
 
-func (d *Shuttle) getHelloMessage() (*drpc.Hello, error) {
-	addr, err := d.Node.Wallet.GetDefault()
+func openGatewayAPI(apiURL string) (api.Gateway, func(), error) {
+	// send a CLI context to lotus that contains only the node "api-url" flag set, so that other flags don't accidentally conflict with lotus cli flags
+	// https://github.com/filecoin-project/lotus/blob/731da455d46cb88ee5de9a70920a2d29dec9365c/cli/util/api.go#L37
+	flset := flag.NewFlagSet("lotus", flag.ExitOnError)
+	flset.String("api-url", "", "node api url")
+	if err := flset.Set("api-url", apiURL); err != nil {
+		return nil, nil, err
+	}
+
+	ncctx := cli.NewContext(cli.NewApp(), flset, nil)
+	gw, closer, err := lcli.GetGatewayAPI(ncctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return gw, func() { closer() }, nil
+}
+
+func (d *Shuttle) getHelloMessage() (*drpc.Hello, error) {
+	addr := d.wallets.dealAddr()
 
 	hostname := d.hostname
 	if d.dev {
@@ -882,11 +2025,33 @@ func (d *Shuttle) getHelloMessage() (*drpc.Hello, error) {
 	}
 
 	log.Infow("sending hello", "hostname", hostname, "address", addr, "pid", d.Node.Host.ID())
+	var compressions []string
+	if d.shuttleConfig.Rpc.Compression {
+		compressions = append(compressions, drpc.CompressionGzip)
+	}
+
 	return &drpc.Hello{
 		Host:    hostname,
 		PeerID:  d.Node.Host.ID().Pretty(),
 		Address: addr,
 		Private: d.Private,
+
+		RetrievalAddress: d.wallets.retrievalAddr(),
+
+		RpcEncodings:    []string{d.shuttleConfig.Rpc.Encoding},
+		RpcCompressions: compressions,
+		RpcAcks:         true,
+
+		HeartbeatInterval: d.shuttleConfig.Rpc.HeartbeatInterval,
+		HeartbeatTimeout:  d.shuttleConfig.Rpc.HeartbeatTimeout,
+		VerifiedDeals:     d.shuttleConfig.VerifiedDeals,
+		TieringMinDeals:   d.shuttleConfig.Tiering.MinSealedDeals,
+		AggregateMaxSize:  d.shuttleConfig.Aggregation.MaxContentSize,
+		Draining:          d.isDraining(),
+		LocalAuth:         d.shuttleConfig.AuthCache.LocalAuth,
+		Webhooks:          d.webhooks != nil,
+		Region:            d.shuttleConfig.Placement.Region,
+		StorageClass:      d.shuttleConfig.Placement.StorageClass,
 		AddrInfo: peer.AddrInfo{
 			ID:    d.Node.Host.ID(),
 			Addrs: d.Node.Host.Addrs(),
@@ -900,12 +2065,13 @@ func (d *Shuttle) dialConn() (*websocket.Conn, error) {
 		scheme = "ws"
 	}
 
-	cfg, err := websocket.NewConfig(scheme+"://"+d.estuaryHost+"/shuttle/conn", "http://localhost")
+	cfg, err := websocket.NewConfig(scheme+"://"+d.primaries.host()+"/shuttle/conn", "http://localhost")
 	if err != nil {
 		return nil, err
 	}
 
 	cfg.Header.Set("Authorization", "Bearer "+d.shuttleToken)
+	cfg.TlsConfig = d.primaryTLS
 
 	conn, err := websocket.DialConfig(cfg)
 	if err != nil {
@@ -923,43 +2089,107 @@ type User struct {
 	AuthToken       string `json:"-"` // this struct shouldnt ever be serialized, but just in case...
 	StorageDisabled bool
 	AuthExpiry      time.Time
+	MaxUploadSize   int64
 
 	Flags int
+
+	// Scopes are what the api key is limited to, see util.ScopesAllow
+	Scopes []string
 }
 
 func (u *User) FlagSplitContent() bool {
 	return u.Flags&8 != 0
 }
 
-func (d *Shuttle) checkTokenAuth(token string) (*User, error) {
+type authCacheEntry struct {
+	user    *User
+	err     error
+	expires time.Time
+}
+
+// checkTokenAuth resolves an api token to its user, checking JWT keys
+// locally when it can and asking the primary otherwise.
+// Results are cached by token hash; tokens the primary rejected are cached
+// for a shorter time so repeated bad requests dont all hit the primary.
+func (d *Shuttle) checkTokenAuth(token string) (*User, error) {
+	key := util.GetTokenHash(token)
+
+	val, ok := d.authCache.Get(key)
+	if ok {
+		ent, ok := val.(*authCacheEntry)
+		if !ok {
+			return nil, xerrors.Errorf("value in user auth cache was not an auth entry (got %T)", val)
+		}
+
+		if time.Now().Before(ent.expires) {
+			return ent.user, ent.err
+		}
+		d.authCache.Remove(key)
+	}
+
+	usr := d.localAuth.verify(token)
+	if usr == nil {
+		var err error
+		usr, err = d.fetchTokenAuth(token)
+		if err != nil {
+			var herr *util.HttpError
+			if xerrors.As(err, &herr) && (herr.Code == http.StatusUnauthorized || herr.Code == http.StatusForbidden) {
+				d.authCache.Add(key, &authCacheEntry{
+					err:     err,
+					expires: time.Now().Add(d.shuttleConfig.AuthCache.NegativeTTL),
+				})
+			}
+			return nil, err
+		}
+	}
+
+	expires := time.Now().Add(d.shuttleConfig.AuthCache.TTL)
+	if !usr.AuthExpiry.IsZero() && usr.AuthExpiry.Before(expires) {
+		expires = usr.AuthExpiry
+	}
+	d.authCache.Add(key, &authCacheEntry{user: usr, expires: expires})
+
+	return usr, nil
+}
+
+// invalidateAuth drops cached auth results for the given token hashes, and
+// for every token of userID if it is set
+func (d *Shuttle) invalidateAuth(tokenHashes []string, userID uint) {
+	d.localAuth.invalidate(tokenHashes, userID, time.Now())
 
-	val, ok := d.authCache.Get(token)
-	if ok {
-		usr, ok := val.(*User)
+	for _, h := range tokenHashes {
+		d.authCache.Remove(h)
+	}
+
+	if userID == 0 {
+		return
+	}
+
+	for _, k := range d.authCache.Keys() {
+		val, ok := d.authCache.Peek(k)
 		if !ok {
-			return nil, xerrors.Errorf("value in user auth cache was not a user (got %T)", val)
+			continue
 		}
-
-		if usr.AuthExpiry.After(time.Now()) {
-			d.authCache.Remove(token)
-		} else {
-			return usr, nil
+		if ent, ok := val.(*authCacheEntry); ok && ent.user != nil && ent.user.ID == userID {
+			d.authCache.Remove(k)
 		}
 	}
+}
 
+func (d *Shuttle) fetchTokenAuth(token string) (*User, error) {
 	scheme := "https"
 	if d.dev {
 		scheme = "http"
 	}
 
-	req, err := http.NewRequest("GET", scheme+"://"+d.estuaryHost+"/viewer", nil)
+	req, err := http.NewRequest("GET", scheme+"://"+d.primaries.host()+"/viewer", nil)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Authorization", "Bearer "+token)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := d.primaryClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -970,6 +2200,12 @@ func (d *Shuttle) checkTokenAuth(token string) (*User, error) {
 		if err != nil {
 			return nil, err
 		}
+
+		var herr util.HttpErrorResponse
+		if err := json.Unmarshal(bodyBytes, &herr); err == nil && herr.Error.Reason != "" {
+			herr.Error.Code = resp.StatusCode
+			return nil, &herr.Error
+		}
 		return nil, fmt.Errorf("authentication check returned unexpected error: %s", bodyBytes)
 	}
 
@@ -985,15 +2221,17 @@ func (d *Shuttle) checkTokenAuth(token string) (*User, error) {
 		AuthToken:       token,
 		AuthExpiry:      out.AuthExpiry,
 		StorageDisabled: out.Settings.ContentAddingDisabled,
+		MaxUploadSize:   out.Settings.MaxUploadSize,
 		Flags:           out.Settings.Flags,
+		Scopes:          out.Scopes,
 	}
 
-	d.authCache.Add(token, usr)
-
 	return usr, nil
 }
 
-func (d *Shuttle) AuthRequired(level int) echo.MiddlewareFunc {
+// AuthRequired checks that the user has at least perm level and that the api
+// key has one of scopes, or of the default scopes for level if none are given.
+func (d *Shuttle) AuthRequired(level int, scopes ...string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			auth, err := util.ExtractAuth(c)
@@ -1006,7 +2244,25 @@ func (d *Shuttle) AuthRequired(level int) echo.MiddlewareFunc {
 				return err
 			}
 
+			required := scopes
+			if len(required) == 0 {
+				required = util.DefaultScopes(level, c.Request().Method)
+			}
+			if !util.ScopesAllow(u.Scopes, required) {
+				log.Warnw("api key scopes do not allow route", "user", u.ID, "scopes", u.Scopes, "required", required)
+
+				return &util.HttpError{
+					Code:    http.StatusForbidden,
+					Reason:  util.ERR_NOT_AUTHORIZED,
+					Details: fmt.Sprintf("api key is limited to %s", strings.Join(u.Scopes, ",")),
+				}
+			}
+
 			if u.Perms >= level {
+				if err := d.checkRequestRate(c, u); err != nil {
+					return err
+				}
+
 				c.Set("user", u)
 				return next(c)
 			}
@@ -1040,48 +2296,147 @@ func (s *Shuttle) ServeAPI() error {
 	}
 
 	e.Use(middleware.CORS())
+	e.Use(s.shutdownMiddleware)
+	e.Use(s.apiMetricsMiddleware)
 	e.Use(s.tracingMiddleware)
 	e.Use(util.AppVersionMiddleware(s.shuttleConfig.AppVersion))
+	e.Use(s.davMiddleware)
 
 	e.HTTPErrorHandler = util.ErrorHandler
+	e.IPExtractor = s.adminAccess.ipExtractor()
 
 	e.GET("/health", s.handleHealth)
 	e.GET("/net/addrs", s.handleGetNetAddress)
 	e.GET("/viewer", withUser(s.handleGetViewer), s.AuthRequired(util.PermLevelUser))
+	e.GET("/webhooks/deliveries", withUser(s.handleGetWebhookDeliveries), s.AuthRequired(util.PermLevelUser))
 
-	e.GET("/gw/:path", func(e echo.Context) error {
-		p := "/" + e.Param("path")
-
-		req := e.Request().Clone(e.Request().Context())
-		req.URL.Path = p
-
-		s.gwayHandler.ServeHTTP(e.Response().Writer, req)
-		return nil
-	})
+	e.GET("/gw/*", s.handleGateway)
+	e.HEAD("/gw/*", s.handleGateway)
+	e.GET("/export/:id/:file", s.handleDownloadCarExport)
 
+	// upload keys may only add content, reading and exporting it takes a
+	// read key, and aborting uploads a key without scopes
 	content := e.Group("/content")
-	content.Use(s.AuthRequired(util.PermLevelUpload))
-	content.POST("/add", withUser(s.handleAdd))
-	content.POST("/add-car", util.WithContentLengthCheck(withUser(s.handleAddCar)))
-	content.GET("/read/:cont", withUser(s.handleReadContent))
-	content.POST("/importdeal", withUser(s.handleImportDeal))
+	uploads := content.Group("", s.AuthRequired(util.PermLevelUpload, util.ScopeUpload))
+	reads := content.Group("", s.AuthRequired(util.PermLevelUpload, util.ScopeRead))
+	owner := content.Group("", s.AuthRequired(util.PermLevelUpload))
+	for _, g := range []*echo.Group{uploads, reads, owner} {
+		g.Use(s.uploadMetricsMiddleware)
+		g.Use(s.uploadRateLimitMiddleware)
+		g.Use(s.uploadSizeMiddleware)
+	}
+	uploads.POST("/add", withUser(s.handleAdd), s.idempotent("add"))
+	uploads.POST("/add-car", util.WithContentLengthCheck(withUser(s.handleAddCar)))
+	uploads.POST("/add-archive", withUser(s.handleAddArchive))
+	uploads.POST("/add-batch", withUser(s.handleAddBatch))
+	uploads.POST("/add-from-url", withUser(s.handleAddFromURL))
+	uploads.GET("/add-from-url/:id", withUser(s.handleGetURLFetch))
+	reads.GET("/read/:cont", withUser(s.handleReadContent))
+	reads.GET("/usage", withUser(s.handleContentUsage))
+	reads.GET("/dedup/:cont", withUser(s.handleGetContentDedup))
+	reads.GET("/status/:cont", withUser(s.handleGetPinStatus))
+	reads.POST("/export", withUser(s.handleStartCarExport))
+	reads.GET("/export/:id", withUser(s.handleGetCarExport))
+	uploads.POST("/importdeal", withUser(s.handleImportDeal))
+	uploads.OPTIONS("/uploads", s.handleUploadOptions)
+	uploads.POST("/uploads", withUser(s.handleCreateUpload))
+	uploads.HEAD("/uploads/:id", withUser(s.handleUploadStatus))
+	uploads.PATCH("/uploads/:id", withUser(s.handleUploadChunk))
+	owner.DELETE("/uploads/:id", withUser(s.handleDeleteUpload))
 	//content.POST("/add-ipfs", withUser(d.handleAddIpfs))
 
+	pinning := e.Group("/pinning")
+	pinning.Use(util.OpenApiMiddleware)
+	pinning.Use(s.AuthRequired(util.PermLevelUser))
+	pinning.GET("/pins", withUser(s.handleListPins))
+	pinning.POST("/pins", withUser(s.handleAddPin))
+	pinning.GET("/pins/:pinid", withUser(s.handleGetPin))
+	pinning.POST("/pins/:pinid", withUser(s.handleReplacePin))
+	pinning.DELETE("/pins/:pinid", withUser(s.handleDeletePin))
+	pinning.POST("/import", withUser(s.handleImportPins))
+	pinning.GET("/import/:id", withUser(s.handleGetPinImport))
+
 	admin := e.Group("/admin")
-	admin.Use(s.AuthRequired(util.PermLevelAdmin))
+	admin.Use(s.adminAccess.middleware, s.AuthRequired(util.PermLevelAdmin))
 	admin.GET("/health/:cid", s.handleContentHealthCheck)
+	admin.GET("/pins", s.handleAdminListPins)
 	admin.POST("/resend/pincomplete/:content", s.handleResendPinComplete)
+	admin.POST("/pins/:content/boost", s.handleBoostPin)
+	admin.POST("/pins/:content/cancel", s.handleCancelPin)
+	admin.GET("/pins/workers", s.handleGetPinWorkers)
+	admin.PUT("/pins/workers", s.handleSetPinWorkers)
 	admin.POST("/loglevel", s.handleLogLevel)
 	admin.POST("/transfers/restartall", s.handleRestartAllTransfers)
 	admin.GET("/transfers/list", s.handleListAllTransfers)
+	admin.GET("/transfers/active", s.handleAdminActiveTransfers)
 	admin.GET("/transfers/:miner", s.handleMinerTransferDiagnostics)
 	admin.GET("/bitswap/wantlist/:peer", s.handleGetWantlist)
 	admin.POST("/garbage/check", s.handleManualGarbageCheck)
 	admin.POST("/garbage/collect", s.handleGarbageCollect)
+	admin.GET("/garbage/status", s.handleGarbageCollectStatus)
+	admin.POST("/integrity/check", s.handleCheckIntegrity)
+	admin.GET("/integrity/status", s.handleIntegrityStatus)
 	admin.GET("/net/rcmgr/stats", s.handleRcmgrStats)
+	admin.GET("/provider/stats", s.handleProviderStats)
+	admin.GET("/wallet/list", s.handleListWallet)
+	admin.GET("/wallet/export/:addr", s.handleExportWallet)
+	admin.POST("/wallet/import", s.handleImportWallet)
+	admin.POST("/wallet/rotate", s.handleRotateWallet)
+	admin.GET("/market/balance", s.handleMarketBalance)
+	admin.POST("/market/add/:amt", s.handleMarketFunds(s.addMarketFunds))
+	admin.POST("/market/withdraw/:amt", s.handleMarketFunds(s.withdrawMarketFunds))
 	admin.GET("/system/config", s.handleGetSystemConfig)
+	admin.GET("/storage/staging", s.handleAdminStagingUsage)
+	admin.GET("/storage/users", s.handleAdminUserStorage)
+	admin.GET("/storage/dedup", s.handleAdminDedupStats)
+	admin.GET("/audit", s.handleAuditExport)
+	admin.POST("/debug/snapshot", s.handleDebugSnapshot)
+	admin.GET("/drain", s.handleGetDrainStatus)
+	admin.POST("/drain", s.handleSetDraining(true))
+	admin.DELETE("/drain", s.handleSetDraining(false))
+	if s.shuttleConfig.Debug.PprofOnApi {
+		admin.Match([]string{http.MethodGet, http.MethodPost}, "/debug/pprof/*", s.handleApiPprof)
+	}
+
+	s.apiLk.Lock()
+	s.api = e
+	s.apiLk.Unlock()
+
+	tlscfg := s.shuttleConfig.TLS
+	switch {
+	case tlscfg.Autocert:
+		host, err := hostnameFromURL(s.shuttleConfig.Hostname)
+		if err != nil {
+			return err
+		}
+
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(host)
+		e.AutoTLSManager.Cache = autocert.DirCache(tlscfg.AutocertCacheDir)
+		log.Infof("serving api with tls certificates from letsencrypt for %s", host)
+		return e.StartAutoTLS(s.shuttleConfig.ApiListen)
+	case tlscfg.CertFile != "":
+		return e.StartTLS(s.shuttleConfig.ApiListen, tlscfg.CertFile, tlscfg.KeyFile)
+	default:
+		return e.Start(s.shuttleConfig.ApiListen)
+	}
+}
+
+// hostnameFromURL returns the bare hostname of the public url given with
+// --host, which may or may not include a scheme and port
+func hostnameFromURL(s string) (string, error) {
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid host %q: %w", s, err)
+	}
 
-	return e.Start(s.shuttleConfig.ApiListen)
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid host %q: no hostname", s)
+	}
+	return u.Hostname(), nil
 }
 
 func (s *Shuttle) tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
@@ -1151,11 +2506,12 @@ func (s *Shuttle) handleLogLevel(c echo.Context) error {
 // @Description  This endpoint uploads a file.
 // @Tags         content
 // @Produce      json
+// @Param        Idempotency-Key header string false "Key for safely retrying the request, retries with the same key return the first response"
 // @Router       /content/add [post]
 func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
 
-	if u.StorageDisabled || s.disableLocalAdding {
+	if u.StorageDisabled || s.addingDisabled() {
 		return &util.HttpError{
 			Code:    http.StatusBadRequest,
 			Reason:  util.ERR_CONTENT_ADDING_DISABLED,
@@ -1169,6 +2525,27 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 	}
 	defer form.RemoveAll()
 
+	cic, err := collectionFromParams(c.QueryParam)
+	if err != nil {
+		return err
+	}
+
+	params, err := s.importParamsFromRequest(c)
+	if err != nil {
+		return err
+	}
+
+	opts, err := parseAddOptions(func(key string) string {
+		return firstNonEmpty(c.QueryParam(key), c.FormValue(key))
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(form.File["data"]) > 1 {
+		return s.handleAddDirectory(c, u, form, cic, params, opts)
+	}
+
 	mpf, err := c.FormFile("data")
 	if err != nil {
 		return err
@@ -1191,71 +2568,368 @@ func (s *Shuttle) handleAdd(c echo.Context, u *User) error {
 	}
 	defer fi.Close()
 
-	cic := util.ContentInCollection{
-		CollectionID:  c.QueryParam(ColUuid),
-		CollectionDir: c.QueryParam(ColDir),
+	resp, err := s.addFileContent(ctx, u, fi, filename, cic, params, opts)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// importParamsFromRequest reads the optional import parameters of an upload
+// from either the query string or the multipart form.
+func (s *Shuttle) importParamsFromRequest(c echo.Context) (util.ImportParams, error) {
+	return s.parseImportParams(func(key string) string {
+		return firstNonEmpty(c.QueryParam(key), c.FormValue(key))
+	})
+}
+
+// parseImportParams builds and validates import parameters out of the
+// "chunker", "cid-version" and "hash" options looked up through get.
+func (s *Shuttle) parseImportParams(get func(string) string) (util.ImportParams, error) {
+	params := util.ImportParams{
+		Chunker:      get("chunker"),
+		HashFunction: get("hash"),
+	}
+
+	if v := get("cid-version"); v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return util.ImportParams{}, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid cid-version %q", v),
+			}
+		}
+		params.CidVersion = version
+		params.CidVersionSet = true
+	}
+
+	if err := params.Validate(s.shuttleConfig.Content.MaxChunkSize); err != nil {
+		return util.ImportParams{}, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+	return params, nil
+}
+
+// addOptions control how new content is recorded once it is imported
+type addOptions struct {
+	// Force adds new content even if the user already has the same root
+	Force bool
+
+	// ExpiresAt is when the content is unpinned on its own, nil to keep it
+	ExpiresAt *time.Time
+}
+
+// parseAddOptions builds add options out of the "force", "expires" and "ttl"
+// options looked up through get.
+func parseAddOptions(get func(string) string) (addOptions, error) {
+	force, err := forceNewContent(get("force"))
+	if err != nil {
+		return addOptions{}, err
+	}
+
+	exp, err := parseExpiry(get("expires"), get("ttl"), time.Now())
+	if err != nil {
+		return addOptions{}, err
+	}
+
+	return addOptions{Force: force, ExpiresAt: exp}, nil
+}
+
+// handleAddDirectory imports every file of a multi-file upload and links them
+// together into a single unixfs directory. The relative path of each file can
+// be given with a "path" form value per file, in the same order as the files.
+func (s *Shuttle) handleAddDirectory(c echo.Context, u *User, form *multipart.Form, cic util.ContentInCollection, params util.ImportParams, opts addOptions) error {
+	ctx := c.Request().Context()
+
+	files := form.File["data"]
+	paths := form.Value["path"]
+	if len(paths) > 0 && len(paths) != len(files) {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("got %d paths for %d files", len(paths), len(files)),
+		}
+	}
+
+	var totalSize int64
+	for _, f := range files {
+		totalSize += f.Size
+	}
+
+	if !u.FlagSplitContent() && totalSize > constants.DefaultContentSizeLimit {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_CONTENT_SIZE_OVER_LIMIT,
+			Details: fmt.Sprintf("content size %d bytes, is over upload size limit of %d bytes, and content splitting is not enabled, please reduce the content size", totalSize, constants.DefaultContentSizeLimit),
+		}
 	}
 
-	bsid, bs, err := s.StagingMgr.AllocNew()
+	dirname := c.FormValue("dirname")
+
+	resp, err := s.addStagedContent(ctx, u, dirname, cic, opts, func(bs blockstore.Blockstore, dserv ipld.DAGService) (cid.Cid, error) {
+		nodes := make(map[string]ipld.Node, len(files))
+		for i, mpf := range files {
+			p := mpf.Filename
+			if len(paths) > 0 {
+				p = paths[i]
+			}
+
+			cp, err := util.CleanUploadPath(p)
+			if err != nil {
+				return cid.Undef, &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Reason:  util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("invalid path for file %d: %s", i, err),
+				}
+			}
+
+			if _, ok := nodes[cp]; ok {
+				return cid.Undef, &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Reason:  util.ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("more than one file has the path %s", cp),
+				}
+			}
+
+			fi, err := mpf.Open()
+			if err != nil {
+				return cid.Undef, err
+			}
+
+			nd, err := s.importFile(ctx, dserv, fi, params)
+			fi.Close()
+			if err != nil {
+				return cid.Undef, err
+			}
+			nodes[cp] = nd
+		}
+
+		root, err := util.BuildUnixFSDirectory(ctx, dserv, nodes, params)
+		if err != nil {
+			return cid.Undef, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+		return root.Cid(), nil
+	})
 	if err != nil {
 		return err
 	}
 
+	return c.JSON(http.StatusOK, resp)
+}
+
+// addFileContent imports the data read from fi as a unixfs file and adds it
+// as new content.
+func (s *Shuttle) addFileContent(ctx context.Context, u *User, fi io.Reader, filename string, cic util.ContentInCollection, params util.ImportParams, opts addOptions) (*util.ContentAddResponse, error) {
+	return s.addStagedContent(ctx, u, filename, cic, opts, func(bs blockstore.Blockstore, dserv ipld.DAGService) (cid.Cid, error) {
+		nd, err := s.importFile(ctx, dserv, fi, params)
+		if err != nil {
+			return cid.Undef, err
+		}
+		return nd.Cid(), nil
+	})
+}
+
+// addStagedContent runs the given import function against a staging
+// blockstore, registers the resulting root with the primary node and moves
+// the blocks into the main blockstore.
+//
+// When streaming imports are enabled, blocks are written directly into the
+// main blockstore and removed again if the import fails.
+//
+// If the user already has the root pinned here the existing content is
+// returned instead, unless Force is set or the content goes into a collection.
+func (s *Shuttle) addStagedContent(ctx context.Context, u *User, filename string, cic util.ContentInCollection, opts addOptions, importFn func(blockstore.Blockstore, ipld.DAGService) (cid.Cid, error)) (_ *util.ContentAddResponse, err error) {
+	ae := &AuditEntry{Actor: auditActorUser, UserID: u.ID, Action: "add"}
 	defer func() {
-		go func() {
-			if err := s.StagingMgr.CleanUp(bsid); err != nil {
-				log.Errorf("failed to clean up staging blockstore: %s", err)
-			}
-		}()
+		s.audit(ae, err)
 	}()
 
-	bserv := blockservice.New(bs, nil)
-	dserv := merkledag.NewDAGService(bserv)
+	st, err := s.newStagedImport()
+	if err != nil {
+		return nil, err
+	}
+
+	var duplicate bool
+	defer func() {
+		// blocks a duplicate brought in are not referenced by anything
+		st.finish(err == nil && !duplicate)
+	}()
 
-	nd, err := s.importFile(ctx, dserv, fi)
+	root, err := importFn(st.bs, st.dserv)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if filename == "" {
+		filename = root.String()
+	}
+
+	ae.Cid = root.String()
+	if !opts.Force && cic.CollectionID == "" {
+		existing, err := s.existingPinFor(u.ID, root)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			duplicate = true
+			ae.Action = "add-duplicate"
+			ae.Content = existing.Content
+			if err := s.extendExpiry(existing, opts.ExpiresAt); err != nil {
+				return nil, err
+			}
+			return s.contentAddResponse(root, existing.Content, true), nil
+		}
 	}
 
-	contid, err := s.createContent(ctx, u, nd.Cid(), filename, cic)
+	contid, err := s.registerContent(ctx, u, st, root, filename, cic, opts)
+	ae.Content = contid
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if err := s.storeStaged(ctx, st); err != nil {
+		return nil, err
+	}
+	s.announceContent(ctx, root, contid)
+
+	return s.contentAddResponse(root, contid, false), nil
+}
+
+// stagedImport holds the blocks of an upload until its content is registered
+type stagedImport struct {
+	bs    blockstore.Blockstore
+	dserv ipld.DAGService
+
+	// finish releases the staged blocks, keep says whether the import
+	// succeeded
+	finish func(keep bool)
+}
+
+func (s *Shuttle) newStagedImport() (*stagedImport, error) {
+	if s.shuttleConfig.Content.StreamingImport {
+		ibs := s.newImportBlockstore()
+		return &stagedImport{
+			bs:    ibs,
+			dserv: merkledag.NewDAGService(blockservice.New(ibs, nil)),
+			finish: func(keep bool) {
+				ibs.finish(context.Background(), keep)
+			},
+		}, nil
+	}
+
+	bsid, sbs, err := s.StagingMgr.AllocNew()
+	if err != nil {
+		return nil, err
+	}
+	return &stagedImport{
+		bs:    sbs,
+		dserv: merkledag.NewDAGService(blockservice.New(sbs, nil)),
+		finish: func(bool) {
+			go func() {
+				if err := s.StagingMgr.CleanUp(bsid); err != nil {
+					log.Errorf("failed to clean up staging blockstore: %s", err)
+				}
+			}()
+		},
+	}, nil
+}
+
+// registerContent has the primary create the content of a staged root and
+// tracks its pin here. The content id is returned once the primary created
+// the content, even if tracking it fails after that.
+func (s *Shuttle) registerContent(ctx context.Context, u *User, st *stagedImport, root cid.Cid, filename string, cic util.ContentInCollection, opts addOptions) (uint, error) {
+	contid, err := s.createContent(ctx, u, root, filename, cic)
+	if err != nil {
+		return 0, err
 	}
 
 	pin := &Pin{
 		Content: contid,
-		Cid:     util.DbCID{CID: nd.Cid()},
+		Cid:     util.DbCID{CID: root},
 		UserID:  u.ID,
 
-		Active:  false,
-		Pinning: true,
+		Active:    false,
+		Pinning:   true,
+		ExpiresAt: opts.ExpiresAt,
 	}
 
 	if err := s.DB.Create(pin).Error; err != nil {
-		return err
+		return contid, err
 	}
 
-	if err := s.addDatabaseTrackingToContent(ctx, contid, dserv, bs, nd.Cid(), func(int64) {}); err != nil {
-		return xerrors.Errorf("encountered problem computing object references: %w", err)
+	if err := s.addDatabaseTrackingToContent(ctx, contid, st.dserv, st.bs, root, func(int64) {}); err != nil {
+		return contid, xerrors.Errorf("encountered problem computing object references: %w", err)
 	}
+	return contid, nil
+}
 
-	if err := s.dumpBlockstoreTo(ctx, bs, s.Node.Blockstore); err != nil {
+// storeStaged moves the staged blocks into the main blockstore, streaming
+// imports wrote them there already
+func (s *Shuttle) storeStaged(ctx context.Context, st *stagedImport) error {
+	if s.shuttleConfig.Content.StreamingImport {
+		return nil
+	}
+	if err := s.dumpBlockstoreTo(ctx, st.bs, s.Node.Blockstore); err != nil {
 		return xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
 	}
+	return nil
+}
 
-	if err := s.Provide(ctx, nd.Cid()); err != nil {
+// announceContent provides newly added content and starts computing its
+// piece commitment if that is done on import
+func (s *Shuttle) announceContent(ctx context.Context, root cid.Cid, contid uint) {
+	if err := s.Provide(ctx, root); err != nil {
 		log.Warnf("failed to provide: %+v", err)
 	}
 
-	return c.JSON(http.StatusOK, &util.ContentAddResponse{
-		Cid:          nd.Cid().String(),
-		RetrievalURL: util.CreateRetrievalURL(nd.Cid().String()),
+	if s.shuttleConfig.Content.CommPOnImport {
+		// the blocks were just written and are likely still cached, compute
+		// the piece commitment now rather than when the first deal needs it
+		go func() {
+			if err := s.computeCommP(context.Background(), root); err != nil {
+				log.Errorf("failed to compute piece commitment of imported content %d: %s", contid, err)
+			}
+		}()
+	}
+}
+
+func (s *Shuttle) contentAddResponse(root cid.Cid, contid uint, duplicate bool) *util.ContentAddResponse {
+	codec, hash := util.DescribeCid(root)
+	return &util.ContentAddResponse{
+		Cid:          root.String(),
+		RetrievalURL: util.CreateRetrievalURL(root.String()),
 		EstuaryId:    contid,
 		Providers:    s.addrsForShuttle(),
-	})
+		CidVersion:   root.Version(),
+		Codec:        codec,
+		HashFunction: hash,
+		IsDuplicate:  duplicate,
+	}
 }
 
 func (s *Shuttle) Provide(ctx context.Context, c cid.Cid) error {
+	if !s.Node.ProvidesContent() {
+		return nil
+	}
+
 	subCtx, cancel := context.WithTimeout(ctx, time.Second*15)
 	defer cancel()
 
@@ -1271,7 +2945,7 @@ func (s *Shuttle) Provide(ctx context.Context, c cid.Cid) error {
 	}
 
 	go func() {
-		if err := s.Node.Provider.Provide(c); err != nil {
+		if err := s.Node.ProvideRoot(c); err != nil {
 			log.Warnf("providing failed: %s", err)
 			return
 		}
@@ -1290,7 +2964,7 @@ func (s *Shuttle) Provide(ctx context.Context, c cid.Cid) error {
 func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
 
-	if err := util.ErrorIfContentAddingDisabled(u.StorageDisabled || s.disableLocalAdding); err != nil {
+	if err := util.ErrorIfContentAddingDisabled(u.StorageDisabled || s.addingDisabled()); err != nil {
 		return err
 	}
 
@@ -1316,80 +2990,39 @@ func (s *Shuttle) handleAddCar(c echo.Context, u *User) error {
 	// 	c.Request().Body = ioutil.NopCloser(bdWriter)
 	// }
 
-	bsid, bs, err := s.StagingMgr.AllocNew()
+	opts, err := parseAddOptions(c.QueryParam)
 	if err != nil {
 		return err
 	}
 
-	defer func() {
-		go func() {
-			if err := s.StagingMgr.CleanUp(bsid); err != nil {
-				log.Errorf("failed to clean up staging blockstore: %s", err)
-			}
-		}()
-	}()
-
-	defer c.Request().Body.Close()
-	header, err := s.loadCar(ctx, bs, c.Request().Body)
+	cic, err := collectionFromParams(c.QueryParam)
 	if err != nil {
 		return err
 	}
 
-	if len(header.Roots) != 1 {
-		// if someone wants this feature, let me know
-		return c.JSON(400, map[string]string{"error": "cannot handle uploading car files with multiple roots"})
-	}
-
-	// TODO: how to specify filename?
-	filename := header.Roots[0].String()
-	if qpname := c.QueryParam("filename"); qpname != "" {
-		filename = qpname
-	}
-
-	bserv := blockservice.New(bs, nil)
-	dserv := merkledag.NewDAGService(bserv)
+	defer c.Request().Body.Close()
 
-	root := header.Roots[0]
+	resp, err := s.addStagedContent(ctx, u, c.QueryParam("filename"), cic, opts, func(bs blockstore.Blockstore, dserv ipld.DAGService) (cid.Cid, error) {
+		header, err := s.loadCar(ctx, bs, c.Request().Body)
+		if err != nil {
+			return cid.Undef, err
+		}
 
-	contid, err := s.createContent(ctx, u, root, filename, util.ContentInCollection{
-		CollectionID:  c.QueryParam(ColUuid),
-		CollectionDir: c.QueryParam(ColDir),
+		if len(header.Roots) != 1 {
+			// if someone wants this feature, let me know
+			return cid.Undef, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: "cannot handle uploading car files with multiple roots",
+			}
+		}
+		return header.Roots[0], nil
 	})
 	if err != nil {
 		return err
 	}
 
-	pin := &Pin{
-		Content: contid,
-		Cid:     util.DbCID{CID: root},
-		UserID:  u.ID,
-
-		Active:  false,
-		Pinning: true,
-	}
-
-	if err := s.DB.Create(pin).Error; err != nil {
-		return err
-	}
-
-	if err := s.addDatabaseTrackingToContent(ctx, contid, dserv, bs, root, func(int64) {}); err != nil {
-		return xerrors.Errorf("encountered problem computing object references: %w", err)
-	}
-
-	if err := s.dumpBlockstoreTo(ctx, bs, s.Node.Blockstore); err != nil {
-		return xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
-	}
-
-	if err := s.Provide(ctx, root); err != nil {
-		log.Warn(err)
-	}
-
-	return c.JSON(http.StatusOK, &util.ContentAddResponse{
-		Cid:          root.String(),
-		RetrievalURL: util.CreateRetrievalURL(root.String()),
-		EstuaryId:    contid,
-		Providers:    s.addrsForShuttle(),
-	})
+	return c.JSON(http.StatusOK, resp)
 }
 
 func (s *Shuttle) loadCar(ctx context.Context, bs blockstore.Blockstore, r io.Reader) (*car.CarHeader, error) {
@@ -1410,12 +3043,18 @@ func (s *Shuttle) addrsForShuttle() []string {
 func (s *Shuttle) createContent(ctx context.Context, u *User, root cid.Cid, filename string, cic util.ContentInCollection) (uint, error) {
 	log.Debugf("createContent> cid: %v, filename: %s, collection: %+v", root, filename, cic)
 
-	data, err := json.Marshal(util.ContentCreateBody{
+	return s.createContentWithBody(ctx, u, util.ContentCreateBody{
 		ContentInCollection: cic,
 		Root:                root.String(),
 		Name:                filename,
-		Location:            s.shuttleHandle,
 	})
+}
+
+// createContentWithBody has the primary create the content described by
+// body, located on this shuttle
+func (s *Shuttle) createContentWithBody(ctx context.Context, u *User, body util.ContentCreateBody) (uint, error) {
+	body.Location = s.shuttleHandle
+	data, err := json.Marshal(body)
 	if err != nil {
 		return 0, err
 	}
@@ -1425,15 +3064,16 @@ func (s *Shuttle) createContent(ctx context.Context, u *User, root cid.Cid, file
 		scheme = "http"
 	}
 
-	req, err := http.NewRequest("POST", scheme+"://"+s.estuaryHost+"/content/create", bytes.NewReader(data))
+	req, err := http.NewRequest("POST", scheme+"://"+s.primaries.host()+"/content/create", bytes.NewReader(data))
 	if err != nil {
 		return 0, err
 	}
 
 	req.Header.Set("Authorization", "Bearer "+u.AuthToken)
 	req.Header.Set("Content-Type", "application/json")
+	s.signPrimaryRequest(req, data)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.primaryClient().Do(req)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to Do createContent")
 	}
@@ -1480,7 +3120,7 @@ func (s *Shuttle) shuttleCreateContent(ctx context.Context, uid uint, root cid.C
 		scheme = "http"
 	}
 
-	req, err := http.NewRequest("POST", scheme+"://"+s.estuaryHost+"/shuttle/content/create", bytes.NewReader(data))
+	req, err := http.NewRequest("POST", scheme+"://"+s.primaries.host()+"/shuttle/content/create", bytes.NewReader(data))
 	if err != nil {
 		return 0, err
 	}
@@ -1488,7 +3128,7 @@ func (s *Shuttle) shuttleCreateContent(ctx context.Context, uid uint, root cid.C
 	req.Header.Set("Authorization", "Bearer "+s.shuttleToken)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.primaryClient().Do(req)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to do shuttle content create request")
 	}
@@ -1514,9 +3154,21 @@ func (d *Shuttle) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 	ctx, span := d.Tracer.Start(ctx, "doPinning")
 	defer span.End()
 
+	reused, err := d.pinFromExistingPin(ctx, op.ContId, op.Obj, op.MaxDepth)
+	if err != nil {
+		log.Warnf("failed to reuse existing pin of %s for content %d, fetching it instead: %s", op.Obj, op.ContId, err)
+	}
+	if reused {
+		if err := d.Provide(ctx, op.Obj); err != nil {
+			return errors.Wrapf(err, "failed to provide - contID(%d), cid(%s)", op.ContId, op.Obj.String())
+		}
+		return nil
+	}
+
 	for _, pi := range op.Peers {
 		if err := d.Node.Host.Connect(ctx, *pi); err != nil {
-			log.Warnf("failed to connect to origin node for pinning operation: %s", err)
+			d.metrics.originConnectFailures.Inc()
+			log.Warnf("failed to connect to origin node %s for pinning operation: %s", pi.ID, err)
 		}
 	}
 
@@ -1524,15 +3176,40 @@ func (d *Shuttle) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 	dserv := merkledag.NewDAGService(bserv)
 	dsess := dserv.Session(ctx)
 
-	if err := d.addDatabaseTrackingToContent(ctx, op.ContId, dsess, d.Node.Blockstore, op.Obj, cb); err != nil {
-		// pinning failed, we wont try again. mark pin as dead
-		/* maybe its fine if we retry later?
-		if err := d.DB.Model(Pin{}).Where("content = ?", op.ContId).UpdateColumns(map[string]interface{}{
-			"pinning": false,
-		}).Error; err != nil {
-			log.Errorf("failed to update failed pin status: %s", err)
+	if err := d.preflightPin(ctx, op, dsess); err != nil {
+		if _, derr := d.deletePartialPin(context.Background(), op.Obj); derr != nil {
+			log.Errorf("failed to delete blocks of rejected pin %d: %s", op.ContId, derr)
+		}
+		if rerr := d.recordPinFailure(op, err); rerr != nil {
+			log.Errorf("failed to record pin failure: %s", rerr)
+		}
+		return err
+	}
+
+	// blocks fetched by an earlier attempt are read from the blockstore
+	// rather than fetched again
+	rg := &resumeGetter{NodeGetter: dsess, bs: d.Node.Blockstore}
+	err = d.addDatabaseTrackingToContent(ctx, op.ContId, rg, d.Node.Blockstore, op.Obj, cb)
+	if n := rg.localBlocks(); n > 0 {
+		log.Infow("resumed pin from blocks already in the blockstore", "content", op.ContId, "blocks", n)
+		d.metrics.pinBlocksResumed.Add(float64(n))
+	}
+	if err != nil {
+		if op.Cancelled() {
+			// nothing references what was fetched so far, drop it
+			deleted, derr := d.deletePartialPin(context.Background(), op.Obj)
+			if derr != nil {
+				log.Errorf("failed to delete blocks of cancelled pin %d: %s", op.ContId, derr)
+			}
+			log.Infof("pin %d cancelled, deleted %d fetched blocks", op.ContId, deleted)
+			return err
+		}
+
+		// record the attempt before the pin manager reports the failure, so
+		// onPinStatusUpdate knows whether the pin will be retried
+		if rerr := d.recordPinFailure(op, err); rerr != nil {
+			log.Errorf("failed to record pin failure: %s", rerr)
 		}
-		*/
 
 		return errors.Wrapf(err, "failed to addDatabaseTrackingToContent - contID(%d), cid(%s)", op.ContId, op.Obj.String())
 	}
@@ -1551,6 +3228,86 @@ func (d *Shuttle) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 	return nil
 }
 
+// pinFromExistingPin completes the pin for contid without fetching anything
+// if the shuttle already has an active pin of root, possibly for another
+// user. The new pin references the objects of the existing one, so they stay
+// around for as long as either pin does.
+func (d *Shuttle) pinFromExistingPin(ctx context.Context, contid uint, root cid.Cid, maxDepth int) (bool, error) {
+	ctx, span := d.Tracer.Start(ctx, "pinFromExistingPin")
+	defer span.End()
+
+	// only a pin of the same depth has the same objects
+	var existing Pin
+	if err := d.DB.Where("cid = ? and active and not aggregate and content != ? and max_depth = ?", util.DbCID{CID: root}, contid, maxDepth).
+		First(&existing).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	has, err := d.Node.Blockstore.Has(ctx, root)
+	if err != nil {
+		return false, err
+	}
+	if !has {
+		log.Warnf("active pin %d is missing its root block %s", existing.ID, root)
+		return false, nil
+	}
+
+	objects, err := d.objectsForPin(ctx, existing.ID)
+	if err != nil {
+		return false, err
+	}
+	if len(objects) == 0 {
+		return false, nil
+	}
+
+	var dbpin Pin
+	if err := d.DB.First(&dbpin, "content = ?", contid).Error; err != nil {
+		return false, errors.Wrap(err, "failed to retrieve content")
+	}
+
+	if err := d.DB.Transaction(func(tx *gorm.DB) error {
+		// the existing pin may have been unpinned since we looked it up,
+		// its objects cant be relied on then
+		if err := tx.First(&Pin{}, existing.ID).Error; err != nil {
+			return err
+		}
+
+		refs := make([]ObjRef, len(objects))
+		for i := range refs {
+			refs[i].Pin = dbpin.ID
+			refs[i].Object = objects[i].ID
+		}
+		if err := tx.CreateInBatches(refs, 500).Error; err != nil {
+			return err
+		}
+
+		// every block of the pin was already stored
+		return tx.Model(Pin{}).Where("id = ?", dbpin.ID).UpdateColumns(map[string]interface{}{
+			"active":       true,
+			"size":         existing.Size,
+			"pinning":      false,
+			"dedup_blocks": len(objects),
+			"dedup_bytes":  existing.Size,
+		}).Error
+	}); err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	log.Infow("completed pin from existing pin", "content", contid, "existing", existing.Content, "objects", len(objects))
+	d.metrics.pinsReused.Inc()
+	d.metrics.dedupBlocks.Add(float64(len(objects)))
+	d.metrics.dedupBytes.Add(float64(existing.Size))
+	d.sendPinCompleteMessage(ctx, contid, existing.Size, objects)
+	go d.notifyPinWebhooks(contid, util.WebhookPinComplete)
+	return true, nil
+}
+
 const noDataTimeout = time.Minute * 10
 
 // TODO: mostly copy paste from estuary, dedup code
@@ -1605,7 +3362,7 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		d.inflightCidsLk.Unlock()
 	}()
 
-	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+	err := merkledag.WalkDepth(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
 		d.inflightCidsLk.Lock()
 		d.inflightCids[c]++
 		d.inflightCidsLk.Unlock()
@@ -1636,7 +3393,12 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		}
 
 		return util.FilterUnwalkableLinks(node.Links()), nil
-	}, root, cset.Visit, merkledag.Concurrent())
+	}, root, func(c cid.Cid, depth int) bool {
+		if dbpin.MaxDepth > 0 && depth >= dbpin.MaxDepth {
+			return false
+		}
+		return cset.Visit(c)
+	}, merkledag.Concurrent())
 	if err != nil {
 		return errors.Wrap(err, "failed to walk DAG")
 	}
@@ -1646,17 +3408,33 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 		attribute.Int("numObjects", len(objects)),
 	)
 
+	if dbpin.MigratedFrom != "" {
+		if err := d.verifyLocal(ctx, objects); err != nil {
+			return err
+		}
+	}
+
+	dedupBlocks, dedupBytes, err := d.countStoredObjects(objects)
+	if err != nil {
+		return errors.Wrap(err, "failed to look up stored objects")
+	}
+
 	if err := d.DB.CreateInBatches(objects, 300).Error; err != nil {
 		return errors.Wrap(err, "failed to create objects in db")
 	}
 
 	if err := d.DB.Model(Pin{}).Where("content = ?", contid).UpdateColumns(map[string]interface{}{
-		"active":  true,
-		"size":    totalSize,
-		"pinning": false,
+		"active":       true,
+		"size":         totalSize,
+		"pinning":      false,
+		"dedup_blocks": dedupBlocks,
+		"dedup_bytes":  dedupBytes,
 	}).Error; err != nil {
 		return errors.Wrap(err, "failed to update content in database")
 	}
+	d.metrics.ingested(totalSize)
+	d.metrics.dedupBlocks.Add(float64(dedupBlocks))
+	d.metrics.dedupBytes.Add(float64(dedupBytes))
 
 	refs := make([]ObjRef, len(objects))
 	for i := range refs {
@@ -1669,13 +3447,33 @@ func (d *Shuttle) addDatabaseTrackingToContent(ctx context.Context, contid uint,
 	}
 
 	d.sendPinCompleteMessage(ctx, dbpin.Content, totalSize, objects)
+	go d.notifyPinWebhooks(dbpin.Content, util.WebhookPinComplete)
 
 	return nil
 }
 
 func (d *Shuttle) onPinStatusUpdate(cont uint, location string, status types.PinningStatus) error {
 	log.Debugf("updating pin status: %d %s", cont, status)
+	if status == types.PinningStatusCancelled {
+		if err := d.DB.Model(Pin{}).Where("content = ?", cont).UpdateColumns(map[string]interface{}{
+			"pinning":   false,
+			"active":    false,
+			"cancelled": true,
+			"retry_at":  nil,
+		}).Error; err != nil {
+			log.Errorf("failed to mark pin as cancelled in database: %s", err)
+		}
+	}
+
 	if status == types.PinningStatusFailed {
+		d.metrics.pinFailed()
+
+		if d.pinWillRetry(cont) {
+			// the primary keeps seeing the pin as pinning until it is
+			// abandoned or completes
+			return nil
+		}
+
 		if err := d.DB.Model(Pin{}).Where("content = ?", cont).UpdateColumns(map[string]interface{}{
 			"pinning": false,
 			"active":  false,
@@ -1683,15 +3481,24 @@ func (d *Shuttle) onPinStatusUpdate(cont uint, location string, status types.Pin
 		}).Error; err != nil {
 			log.Errorf("failed to mark pin as failed in database: %s", err)
 		}
+
+		go d.sendPinAbandoned(context.TODO(), cont)
+		go d.notifyPinWebhooks(cont, util.WebhookPinFailed)
 	}
 
 	go func() {
+		var reason types.PinFailureReason
+		if status == types.PinningStatusFailed {
+			reason = d.pinFailureReason(cont)
+		}
+
 		if err := d.sendRpcMessage(context.TODO(), &drpc.Message{
 			Op: drpc.OP_UpdatePinStatus,
 			Params: drpc.MsgParams{
 				UpdatePinStatus: &drpc.UpdatePinStatus{
 					DBID:   cont,
 					Status: status,
+					Reason: reason,
 				},
 			},
 		}); err != nil {
@@ -1703,7 +3510,8 @@ func (d *Shuttle) onPinStatusUpdate(cont uint, location string, status types.Pin
 
 func (s *Shuttle) refreshPinQueue() error {
 	var toPin []Pin
-	if err := s.DB.Find(&toPin, "active = false and pinning = true").Error; err != nil {
+	// pins waiting for a retry are requeued by runPinRetries once they are due
+	if err := s.DB.Order("queued_at, id").Find(&toPin, "active = false and pinning = true and retry_at is null").Error; err != nil {
 		return err
 	}
 
@@ -1715,24 +3523,16 @@ func (s *Shuttle) refreshPinQueue() error {
 	// to content, could be interesting to see the graph of replacements
 	// anyways
 	log.Infof("refreshing %d pins", len(toPin))
+	ops := make([]*pinner.PinningOperation, 0, len(toPin))
 	for _, c := range toPin {
-		s.addPinToQueue(c, nil, 0)
+		ops = append(ops, s.pinOperation(c))
 	}
+	s.PinMgr.AddAll(ops)
 
 	return nil
 }
 
-func (s *Shuttle) addPinToQueue(p Pin, peers []*peer.AddrInfo, replace uint) {
-	op := &pinner.PinningOperation{
-		ContId:  p.Content,
-		UserId:  p.UserID,
-		Obj:     p.Cid.CID,
-		Peers:   peers,
-		Started: p.CreatedAt,
-		Status:  types.PinningStatusQueued,
-		Replace: replace,
-	}
-
+func (s *Shuttle) addPinToQueue(p Pin) {
 	/*
 
 		s.pinLk.Lock()
@@ -1741,77 +3541,129 @@ func (s *Shuttle) addPinToQueue(p Pin, peers []*peer.AddrInfo, replace uint) {
 		s.pinLk.Unlock()
 	*/
 
-	s.PinMgr.Add(op)
+	s.PinMgr.Add(s.pinOperation(p))
+}
+
+// pinOperation builds the pinning operation for p from the queue state
+// stored with it
+func (s *Shuttle) pinOperation(p Pin) *pinner.PinningOperation {
+	var peers []*peer.AddrInfo
+	if p.Origins != "" {
+		if err := json.Unmarshal([]byte(p.Origins), &peers); err != nil {
+			log.Warnf("pin %d has invalid origins: %s", p.ID, err)
+		}
+	}
+
+	return &pinner.PinningOperation{
+		ContId:      p.Content,
+		UserId:      p.UserID,
+		Obj:         p.Cid.CID,
+		Peers:       peers,
+		Started:     p.CreatedAt,
+		Status:      types.PinningStatusQueued,
+		SkipLimiter: p.SkipLimiter,
+		Priority:    pinner.PinPriority(p.Priority),
+		MaxDepth:    p.MaxDepth,
+	}
 }
 
-func (s *Shuttle) importFile(ctx context.Context, dserv ipld.DAGService, fi io.Reader) (ipld.Node, error) {
-	_, span := s.Tracer.Start(ctx, "importFile")
+func (s *Shuttle) importFile(ctx context.Context, dserv ipld.DAGService, fi io.Reader, params util.ImportParams) (ipld.Node, error) {
+	_, span := s.Tracer.Start(ctx, "importFile", trace.WithAttributes(
+		attribute.String("chunker", params.Chunker),
+	))
 	defer span.End()
 
-	return util.ImportFile(dserv, fi)
+	return util.ImportFileWithParams(dserv, fi, params)
 }
 
 func (s *Shuttle) dumpBlockstoreTo(ctx context.Context, from, to blockstore.Blockstore) error {
 	ctx, span := s.Tracer.Start(ctx, "blockstoreCopy")
 	defer span.End()
 
-	// TODO: smarter batching... im sure ive written this logic before, just gotta go find it
-	keys, err := from.AllKeysChan(ctx)
-	if err != nil {
-		return err
-	}
+	cfg := s.shuttleConfig.Content.StagingCopy
+	return util.CopyBlockstore(ctx, from, to, util.CopyOptions{
+		Workers:        cfg.Workers,
+		MaxBatchBlocks: cfg.MaxBatchBlocks,
+		MaxBatchBytes:  cfg.MaxBatchBytes,
+	})
+}
 
-	var batch []blocks.Block
+// blockstoreDisks reports the usage of every disk the blockstore is spread
+// over, blockstore dirs on the same filesystem are only counted once
+func (s *Shuttle) blockstoreDisks() []drpc.BlockstoreDisk {
+	var disks []drpc.BlockstoreDisk
+	seen := make(map[unix.Fsid]bool)
+	for _, dir := range s.Node.StorageDirs {
+		var st unix.Statfs_t
+		if err := unix.Statfs(dir, &st); err != nil {
+			log.Errorf("failed to get blockstore disk usage of %q: %s", dir, err)
+			continue
+		}
 
-	for k := range keys {
-		blk, err := from.Get(ctx, k)
-		if err != nil {
-			return err
+		if seen[st.Fsid] {
+			continue
 		}
+		seen[st.Fsid] = true
 
-		batch = append(batch, blk)
+		disks = append(disks, drpc.BlockstoreDisk{
+			Dir:  dir,
+			Size: st.Blocks * uint64(st.Bsize),
+			Free: st.Bavail * uint64(st.Bsize),
+		})
+	}
+	return disks
+}
 
-		if len(batch) > 500 {
-			if err := to.PutMany(ctx, batch); err != nil {
-				return err
-			}
-			batch = batch[:0]
-		}
+func blockstoreUsage(disks []drpc.BlockstoreDisk) (uint64, uint64) {
+	var size, free uint64
+	for _, d := range disks {
+		size += d.Size
+		free += d.Free
 	}
+	return size, free
+}
 
-	if len(batch) > 0 {
-		if err := to.PutMany(ctx, batch); err != nil {
-			return err
-		}
+func (s *Shuttle) sendShuttleUpdate(ctx context.Context) error {
+	upd, err := s.getUpdatePacket()
+	if err != nil {
+		return fmt.Errorf("failed to get update packet: %w", err)
 	}
 
-	return nil
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ShuttleUpdate,
+		Params: drpc.MsgParams{
+			ShuttleUpdate: upd,
+		},
+	})
 }
 
 func (s *Shuttle) getUpdatePacket() (*drpc.ShuttleUpdate, error) {
 	var upd drpc.ShuttleUpdate
 
+	upd.AddingPaused = s.addingPaused()
+	upd.Draining = s.isDraining()
+
 	upd.PinQueueSize = s.PinMgr.PinQueueSize()
 
-	var st unix.Statfs_t
-	if err := unix.Statfs(s.Node.StorageDir, &st); err != nil {
-		log.Errorf("failed to get blockstore disk usage: %s", err)
+	disks := s.blockstoreDisks()
+	upd.BlockstoreSize, upd.BlockstoreFree = blockstoreUsage(disks)
+	if len(disks) > 1 {
+		upd.BlockstoreDisks = disks
 	}
 
-	upd.BlockstoreSize = st.Blocks * uint64(st.Bsize)
-	upd.BlockstoreFree = st.Bavail * uint64(st.Bsize)
+	if err := s.readDB().Model(Pin{}).Where("active").Count(&upd.NumPins).Error; err != nil {
+		return nil, err
+	}
 
-	if err := s.DB.Model(Pin{}).Where("active").Count(&upd.NumPins).Error; err != nil {
+	integrity, err := s.integritySummary()
+	if err != nil {
 		return nil, err
 	}
+	upd.Integrity = integrity
 
-	return &upd, nil
-}
+	s.addTelemetry(context.TODO(), &upd)
 
-func (s *Shuttle) handleHealth(c echo.Context) error {
-	return c.JSON(http.StatusOK, map[string]string{
-		"status": "ok",
-	})
+	return &upd, nil
 }
 
 // handleGetNetAddress godoc
@@ -1880,6 +3732,11 @@ func (s *Shuttle) deleteIfNotPinned(ctx context.Context, o *Object) (bool, error
 	s.inflightCidsLk.Lock()
 	defer s.inflightCidsLk.Unlock()
 
+	return s.deleteIfNotPinnedLocked(ctx, o)
+}
+
+// deleteIfNotPinnedLocked must be called with inflightCidsLk held
+func (s *Shuttle) deleteIfNotPinnedLocked(ctx context.Context, o *Object) (bool, error) {
 	if s.isInflight(o.Cid.CID) {
 		return false, nil
 	}
@@ -1888,13 +3745,20 @@ func (s *Shuttle) deleteIfNotPinned(ctx context.Context, o *Object) (bool, error
 		return false, err
 	}
 	if c == 0 {
+		coldDel, err := s.deleteColdBlock(ctx, o.Cid.CID)
+		if err != nil {
+			return false, err
+		}
+
 		has, err := s.Node.Blockstore.Has(ctx, o.Cid.CID)
 		if err != nil {
 			return false, err
 		}
 		if !has {
-			log.Warnf("dont have block %s that we expected to delete", o.Cid.CID)
-			return false, nil
+			if !coldDel {
+				log.Warnf("dont have block %s that we expected to delete", o.Cid.CID)
+			}
+			return coldDel, nil
 		}
 
 		return true, s.Node.Blockstore.DeleteBlock(ctx, o.Cid.CID)
@@ -1902,18 +3766,18 @@ func (s *Shuttle) deleteIfNotPinned(ctx context.Context, o *Object) (bool, error
 	return false, nil
 }
 
+// clearUnreferencedObjects removes the database entries of the given objects
+// that no pin references anymore. Objects are tracked per pin, so a block
+// shared between pins keeps the entries of the other pins and is not deleted
+// by deleteIfNotPinned. Inflight cids dont need to be skipped here, whatever
+// is pinning them creates its own object entries.
 func (s *Shuttle) clearUnreferencedObjects(ctx context.Context, objs []*Object) error {
 	_, span := s.Tracer.Start(ctx, "clearUnreferencedObjects")
 	defer span.End()
 
-	s.inflightCidsLk.Lock()
-	defer s.inflightCidsLk.Unlock()
-
-	var ids []uint
+	ids := make([]uint, 0, len(objs))
 	for _, o := range objs {
-		if !s.isInflight(o.Cid.CID) {
-			ids = append(ids, o.ID)
-		}
+		ids = append(ids, o.ID)
 	}
 
 	batchSize := 100
@@ -1934,28 +3798,6 @@ func (s *Shuttle) clearUnreferencedObjects(ctx context.Context, objs []*Object)
 	return nil
 }
 
-func (s *Shuttle) GarbageCollect(ctx context.Context) error {
-	keys, err := s.Node.Blockstore.AllKeysChan(ctx)
-	if err != nil {
-		return err
-	}
-
-	count := 0
-	for c := range keys {
-		del, err := s.deleteIfNotPinned(ctx, &Object{Cid: util.DbCID{CID: c}})
-		if err != nil {
-			return err
-		}
-
-		if del {
-			count++
-		}
-	}
-
-	log.Infof("garbage collect deleted %d blocks", count)
-	return nil
-}
-
 // handleReadContent godoc
 // @Summary      Read content
 // @Description  This endpoint reads content from the blockstore
@@ -2006,14 +3848,14 @@ func (s *Shuttle) handleContentHealthCheck(c echo.Context) error {
 	}
 
 	var obj Object
-	if err := s.DB.First(&obj, "cid = ?", cc.Bytes()).Error; err != nil {
+	if err := s.readDB().First(&obj, "cid = ?", cc.Bytes()).Error; err != nil {
 		return c.JSON(404, map[string]interface{}{
 			"error": "object not found in database",
 		})
 	}
 
 	var pins []Pin
-	if err := s.DB.Model(ObjRef{}).Joins("left join pins on obj_refs.pin = pins.id").Where("object = ?", obj.ID).Select("pins.*").Scan(&pins).Error; err != nil {
+	if err := s.readDB().Model(ObjRef{}).Joins("left join pins on obj_refs.pin = pins.id").Where("object = ?", obj.ID).Select("pins.*").Scan(&pins).Error; err != nil {
 		log.Errorf("failed to find pins for cid: %s", err)
 	}
 
@@ -2085,11 +3927,133 @@ func (s *Shuttle) handleResendPinComplete(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{})
 }
 
+// handleBoostPin moves a queued pin to the front of the pin queue
+func (s *Shuttle) handleBoostPin(c echo.Context) error {
+	cont, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
+
+	if !s.PinMgr.Boost(uint(cont), pinner.PriorityUrgent) {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("no queued pin for content %d", cont),
+		}
+	}
+
+	if err := s.DB.Model(Pin{}).Where("content = ?", cont).UpdateColumn("priority", pinner.PriorityUrgent).Error; err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
+// cancelPin aborts the pin for cont, whether it is queued, being fetched or
+// waiting to be retried
+func (s *Shuttle) cancelPin(cont uint) error {
+	if s.PinMgr.Cancel(cont) {
+		return nil
+	}
+
+	// pins waiting for their next attempt are not in the pin manager
+	var retrying []Pin
+	if err := s.DB.Find(&retrying, "content = ? and pinning = true and retry_at is not null", cont).Error; err != nil {
+		return err
+	}
+	if len(retrying) == 0 {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("no pin in progress for content %d", cont),
+		}
+	}
+
+	if err := s.onPinStatusUpdate(cont, "", types.PinningStatusCancelled); err != nil {
+		return err
+	}
+
+	go func() {
+		if _, err := s.deletePartialPin(context.Background(), retrying[0].Cid.CID); err != nil {
+			log.Errorf("failed to delete blocks of cancelled pin %d: %s", cont, err)
+		}
+	}()
+	return nil
+}
+
+// deletePartialPin deletes the blocks under root that were fetched for a pin
+// that did not complete, unless something else references them
+func (s *Shuttle) deletePartialPin(ctx context.Context, root cid.Cid) (int, error) {
+	fetched, err := s.localDagBlocks(ctx, root)
+	if err != nil {
+		return 0, err
+	}
+
+	s.inflightCidsLk.Lock()
+	defer s.inflightCidsLk.Unlock()
+
+	deleted, _, err := s.deleteUnreferencedBlocks(ctx, fetched, false)
+	return deleted, err
+}
+
+// handleCancelPin aborts a pin that has not completed yet
+func (s *Shuttle) handleCancelPin(c echo.Context) error {
+	cont, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
+
+	err = s.cancelPin(uint(cont))
+	s.auditAdmin(c, drpc.CMD_CancelPin, uint(cont), err)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
+// maxPinWorkers bounds the number of pin workers that can be set at runtime
+const maxPinWorkers = 2000
+
+func (s *Shuttle) setPinWorkers(n int) error {
+	if n < 1 || n > maxPinWorkers {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("pin workers must be between 1 and %d", maxPinWorkers),
+		}
+	}
+
+	log.Infof("setting pin workers from %d to %d", s.PinMgr.Workers(), n)
+	s.PinMgr.SetWorkers(n)
+	return nil
+}
+
+type pinWorkersBody struct {
+	Workers int `json:"workers"`
+}
+
+func (s *Shuttle) handleGetPinWorkers(c echo.Context) error {
+	return c.JSON(http.StatusOK, &pinWorkersBody{Workers: s.PinMgr.Workers()})
+}
+
+func (s *Shuttle) handleSetPinWorkers(c echo.Context) error {
+	var body pinWorkersBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if err := s.setPinWorkers(body.Workers); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &body)
+}
+
 func (s *Shuttle) handleGetViewer(c echo.Context, u *User) error {
 	return c.JSON(http.StatusOK, &util.ViewerResponse{
 		ID:       u.ID,
 		Username: u.Username,
 		Perms:    u.Perms,
+		Scopes:   u.Scopes,
 	})
 }
 
@@ -2183,8 +4147,79 @@ func (s *Shuttle) handleManualGarbageCheck(c echo.Context) error {
 	})
 }
 
+// handleGarbageCollect godoc
+// @Summary      Run garbage collection
+// @Description  This endpoint removes all blocks that no pin references from the blockstore. With dry-run set, unreferenced blocks are only counted.
+// @Tags         admin
+// @Produce      json
+// @Param        dry-run query bool false "Only count unreferenced blocks"
+// @Router       /admin/garbage/collect [post]
 func (s *Shuttle) handleGarbageCollect(c echo.Context) error {
-	return s.GarbageCollect(c.Request().Context())
+	dryRun := c.QueryParam("dry-run") == "true"
+
+	st, err := s.GarbageCollect(c.Request().Context(), dryRun)
+	if err != nil {
+		if xerrors.Is(err, ErrGCRunning) {
+			return &util.HttpError{
+				Code:    http.StatusConflict,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, st)
+}
+
+// handleGarbageCollectStatus godoc
+// @Summary      Garbage collection status
+// @Description  This endpoint returns the progress of the running garbage collection, or the result of the last one.
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/garbage/status [get]
+func (s *Shuttle) handleGarbageCollectStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.GarbageCollectStatus())
+}
+
+// handleCheckIntegrity godoc
+// @Summary      Check blockstore integrity
+// @Description  This endpoint checks a random sample of the stored blocks against their cids. Corrupted and missing blocks are fetched again over bitswap if enabled, the pins holding blocks that could not be repaired are flagged as corrupted.
+// @Tags         admin
+// @Produce      json
+// @Param        sample query int false "Number of blocks to check, the configured sample size by default"
+// @Router       /admin/integrity/check [post]
+func (s *Shuttle) handleCheckIntegrity(c echo.Context) error {
+	sample := s.shuttleConfig.Integrity.SampleSize
+	if v := c.QueryParam("sample"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return invalidQueryParam("sample", v)
+		}
+		sample = n
+	}
+
+	st, err := s.CheckIntegrity(c.Request().Context(), sample)
+	if err != nil {
+		if xerrors.Is(err, ErrIntegrityCheckRunning) {
+			return &util.HttpError{
+				Code:    http.StatusConflict,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: err.Error(),
+			}
+		}
+		return err
+	}
+	return c.JSON(http.StatusOK, st)
+}
+
+// handleIntegrityStatus godoc
+// @Summary      Integrity check status
+// @Description  This endpoint returns the progress of the running integrity check, or the result of the last one.
+// @Tags         admin
+// @Produce      json
+// @Router       /admin/integrity/status [get]
+func (s *Shuttle) handleIntegrityStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.IntegrityStatus())
 }
 
 func (s *Shuttle) handleGetWantlist(c echo.Context) error {
@@ -2286,10 +4321,50 @@ func (s *Shuttle) handleImportDeal(c echo.Context, u *User) error {
 	})
 }
 
+// handleGateway godoc
+// @Summary      Serve content from the shuttle
+// @Description  This endpoint serves UnixFS content held by this shuttle straight out of its blockstore, e.g. /gw/ipfs/{cid}/path/to/file. Range requests are supported.
+// @Tags         gateway
+// @Param        path path string true "Path of the form ipfs/{cid}[/path]"
+// @Router       /gw/{path} [get]
+func (s *Shuttle) handleGateway(c echo.Context) error {
+	req := c.Request().Clone(c.Request().Context())
+	req.URL.Path = "/" + c.Param("*")
+
+	s.gwayHandler.ServeHTTP(c.Response().Writer, req)
+	return nil
+}
+
 func (s *Shuttle) handleRcmgrStats(e echo.Context) error {
-	rcm := s.Node.Host.Network().ResourceManager()
+	rcm, ok := s.Node.Host.Network().ResourceManager().(rcmgr.ResourceManagerState)
+	if !ok {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "resource manager is disabled on this node",
+		}
+	}
+
+	return e.JSON(http.StatusOK, rcm.Stat())
+}
+
+func (s *Shuttle) handleProviderStats(e echo.Context) error {
+	st, err := s.Node.ProvideStats(e.Request().Context())
+	if err != nil {
+		return err
+	}
+	return e.JSON(http.StatusOK, st)
+}
 
-	return e.JSON(http.StatusOK, rcm.(rcmgr.ResourceManagerState).Stat())
+func (s *Shuttle) handleRotateWallet(e echo.Context) error {
+	if err := s.rotateDealAddr(e.Request().Context()); err != nil {
+		return err
+	}
+
+	return e.JSON(http.StatusOK, map[string]interface{}{
+		"dealAddress":      s.wallets.dealAddr(),
+		"retrievalAddress": s.wallets.retrievalAddr(),
+	})
 }
 
 func (s *Shuttle) handleGetSystemConfig(e echo.Context) error {
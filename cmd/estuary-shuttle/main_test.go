@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/node"
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+)
+
+func newTestShuttle(t *testing.T) *Shuttle {
+	db, err := setupDatabase("sqlite="+filepath.Join(t.TempDir(), "shuttle.db"), util.DefaultDatabasePool)
+	require.NoError(t, err)
+
+	return &Shuttle{
+		Node: &node.Node{
+			Blockstore: blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore())),
+		},
+		DB:            db,
+		Tracer:        otel.Tracer("test"),
+		inflightCids:  make(map[cid.Cid]uint),
+		metrics:       newShuttleMetrics(context.Background()),
+		shuttleConfig: config.NewShuttle("test"),
+	}
+}
+
+// addTestPin stores the given blocks and tracks them as a pin of content
+// contid, the same way addDatabaseTrackingToContent does.
+func addTestPin(t *testing.T, s *Shuttle, contid uint, blks ...blocks.Block) {
+	ctx := context.Background()
+
+	pin := &Pin{Content: contid, Cid: util.DbCID{CID: blks[0].Cid()}, Active: true}
+	require.NoError(t, s.DB.Create(pin).Error)
+
+	for _, blk := range blks {
+		require.NoError(t, s.Node.Blockstore.Put(ctx, blk))
+
+		obj := &Object{Cid: util.DbCID{CID: blk.Cid()}, Size: len(blk.RawData())}
+		require.NoError(t, s.DB.Create(obj).Error)
+		require.NoError(t, s.DB.Create(&ObjRef{Pin: pin.ID, Object: obj.ID}).Error)
+	}
+}
+
+func hasBlock(t *testing.T, s *Shuttle, blk blocks.Block) bool {
+	has, err := s.Node.Blockstore.Has(context.Background(), blk.Cid())
+	require.NoError(t, err)
+	return has
+}
+
+func TestUnpinKeepsSharedBlocks(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	shared := blocks.NewBlock([]byte("shared"))
+	onlyA := blocks.NewBlock([]byte("only a"))
+	onlyB := blocks.NewBlock([]byte("only b"))
+
+	addTestPin(t, s, 1, onlyA, shared)
+	addTestPin(t, s, 2, onlyB, shared)
+
+	require.NoError(t, s.Unpin(ctx, 1))
+
+	assert.False(t, hasBlock(t, s, onlyA))
+	assert.True(t, hasBlock(t, s, shared), "block still referenced by pin 2 was deleted")
+	assert.True(t, hasBlock(t, s, onlyB))
+
+	var objs int64
+	require.NoError(t, s.DB.Model(Object{}).Count(&objs).Error)
+	assert.Equal(t, int64(2), objs)
+
+	require.NoError(t, s.Unpin(ctx, 2))
+
+	assert.False(t, hasBlock(t, s, shared))
+	assert.False(t, hasBlock(t, s, onlyB))
+
+	require.NoError(t, s.DB.Model(Object{}).Count(&objs).Error)
+	assert.Equal(t, int64(0), objs)
+}
+
+func TestUnpinSkipsInflightBlocks(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	blk := blocks.NewBlock([]byte("being pinned again"))
+	addTestPin(t, s, 1, blk)
+
+	s.inflightCids[blk.Cid()]++
+	require.NoError(t, s.Unpin(ctx, 1))
+	assert.True(t, hasBlock(t, s, blk), "inflight block was deleted")
+
+	// once nothing is using the block anymore it can be collected
+	s.releaseInflight(blk.Cid())
+	st, err := s.GarbageCollect(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, st.BlocksDeleted)
+	assert.False(t, hasBlock(t, s, blk))
+}
+
+func TestGarbageCollectOrphans(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+
+	pinned := blocks.NewBlock([]byte("pinned"))
+	addTestPin(t, s, 1, pinned)
+
+	// a block left behind by a failed import, with an object entry but no ref
+	leftover := blocks.NewBlock([]byte("leftover"))
+	require.NoError(t, s.Node.Blockstore.Put(ctx, leftover))
+	require.NoError(t, s.DB.Create(&Object{Cid: util.DbCID{CID: leftover.Cid()}}).Error)
+
+	untracked := blocks.NewBlock([]byte("untracked"))
+	require.NoError(t, s.Node.Blockstore.Put(ctx, untracked))
+
+	st, err := s.GarbageCollect(ctx, true)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), st.OrphanedObjects)
+	assert.Equal(t, 1, st.BlocksDeleted, "dry run only sees the untracked block as the orphan entry is kept")
+	assert.True(t, hasBlock(t, s, leftover))
+	assert.True(t, hasBlock(t, s, untracked))
+
+	st, err = s.GarbageCollect(ctx, false)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), st.OrphanedObjects)
+	assert.Equal(t, 2, st.BlocksDeleted)
+	assert.Equal(t, 3, st.BlocksChecked)
+	assert.True(t, hasBlock(t, s, pinned))
+	assert.False(t, hasBlock(t, s, leftover))
+	assert.False(t, hasBlock(t, s, untracked))
+}
+
+func TestHostnameFromURL(t *testing.T) {
+	for in, out := range map[string]string{
+		"shuttle-1.estuary.tech":              "shuttle-1.estuary.tech",
+		"https://shuttle-1.estuary.tech":      "shuttle-1.estuary.tech",
+		"https://shuttle-1.estuary.tech:3005": "shuttle-1.estuary.tech",
+	} {
+		host, err := hostnameFromURL(in)
+		require.NoError(t, err)
+		assert.Equal(t, out, host)
+	}
+
+	_, err := hostnameFromURL("https://")
+	assert.Error(t, err)
+}
+
+func TestExistingPinFor(t *testing.T) {
+	s := newTestShuttle(t)
+
+	root := blocks.NewBlock([]byte("root")).Cid()
+	require.NoError(t, s.DB.Create(&Pin{Content: 1, Cid: util.DbCID{CID: root}, UserID: 1, Pinning: true}).Error)
+	require.NoError(t, s.DB.Create(&Pin{Content: 2, Cid: util.DbCID{CID: root}, UserID: 2, Active: true}).Error)
+
+	pin, err := s.existingPinFor(1, root)
+	require.NoError(t, err)
+	assert.Nil(t, pin, "a pin still in progress is not a duplicate")
+
+	require.NoError(t, s.DB.Create(&Pin{Content: 3, Cid: util.DbCID{CID: root}, UserID: 1, Active: true}).Error)
+	pin, err = s.existingPinFor(1, root)
+	require.NoError(t, err)
+	require.NotNil(t, pin)
+	assert.Equal(t, uint(3), pin.Content)
+
+	_, err = forceNewContent("nope")
+	assert.Error(t, err)
+	force, err := forceNewContent("true")
+	require.NoError(t, err)
+	assert.True(t, force)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/api"
+	lotusTypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v6/actors/builtin/market"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+)
+
+// marketBalance returns the wallet and escrow balance of the deal address
+func (s *Shuttle) marketBalance(ctx context.Context) (*drpc.MarketBalance, error) {
+	addr := s.wallets.dealAddr()
+
+	act, err := s.Api.StateGetActor(ctx, addr, lotusTypes.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+
+	mb, err := s.Api.StateMarketBalance(ctx, addr, lotusTypes.EmptyTSK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &drpc.MarketBalance{
+		Address: addr,
+		Balance: act.Balance,
+		Escrow:  mb.Escrow,
+		Locked:  mb.Locked,
+	}, nil
+}
+
+// addMarketFunds sends amt from the deal address to its escrow in the
+// storage market actor
+func (s *Shuttle) addMarketFunds(ctx context.Context, amt abi.TokenAmount) (cid.Cid, error) {
+	bal, err := s.marketBalance(ctx)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if amt.LessThanEqual(big.Zero()) {
+		return cid.Undef, fmt.Errorf("amount to add must be positive")
+	}
+	if amt.GreaterThan(bal.Balance) {
+		return cid.Undef, fmt.Errorf("not enough funds to add: %s < %s", lotusTypes.FIL(bal.Balance), lotusTypes.FIL(amt))
+	}
+
+	params, err := cborutil.Dump(&bal.Address)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return s.pushMarketMessage(ctx, &lotusTypes.Message{
+		From:   bal.Address,
+		To:     builtin.StorageMarketActorAddr,
+		Method: builtin.MethodsMarket.AddBalance,
+		Value:  amt,
+		Params: params,
+	})
+}
+
+// withdrawMarketFunds moves amt of the escrow that is not locked as deal
+// collateral back to the deal address
+func (s *Shuttle) withdrawMarketFunds(ctx context.Context, amt abi.TokenAmount) (cid.Cid, error) {
+	bal, err := s.marketBalance(ctx)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if amt.LessThanEqual(big.Zero()) {
+		return cid.Undef, fmt.Errorf("amount to withdraw must be positive")
+	}
+	avail := big.Sub(bal.Escrow, bal.Locked)
+	if amt.GreaterThan(avail) {
+		return cid.Undef, fmt.Errorf("not enough unlocked escrow to withdraw: %s < %s", lotusTypes.FIL(avail), lotusTypes.FIL(amt))
+	}
+
+	params, err := cborutil.Dump(&market.WithdrawBalanceParams{
+		ProviderOrClientAddress: bal.Address,
+		Amount:                  amt,
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return s.pushMarketMessage(ctx, &lotusTypes.Message{
+		From:   bal.Address,
+		To:     builtin.StorageMarketActorAddr,
+		Method: builtin.MethodsMarket.WithdrawBalance,
+		Value:  big.Zero(),
+		Params: params,
+	})
+}
+
+func (s *Shuttle) pushMarketMessage(ctx context.Context, msg *lotusTypes.Message) (cid.Cid, error) {
+	smsg, err := s.mpusher.MpoolPushMessage(ctx, msg, &api.MessageSendSpec{})
+	if err != nil {
+		return cid.Undef, err
+	}
+	log.Infow("pushed market funds message", "method", msg.Method, "from", msg.From, "amount", lotusTypes.FIL(msg.Value), "msg", smsg.Cid())
+	return smsg.Cid(), nil
+}
+
+func (s *Shuttle) handleRpcAddMarketFunds(ctx context.Context, req *drpc.MarketFunds) error {
+	if req == nil {
+		return fmt.Errorf("add market funds command is missing its market funds params")
+	}
+
+	_, err := s.addMarketFunds(ctx, req.Amount)
+	return err
+}
+
+func (s *Shuttle) handleRpcWithdrawMarketFunds(ctx context.Context, req *drpc.MarketFunds) error {
+	if req == nil {
+		return fmt.Errorf("withdraw market funds command is missing its market funds params")
+	}
+
+	_, err := s.withdrawMarketFunds(ctx, req.Amount)
+	return err
+}
+
+func (s *Shuttle) handleMarketBalance(c echo.Context) error {
+	bal, err := s.marketBalance(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"address":   bal.Address,
+		"balance":   lotusTypes.FIL(bal.Balance),
+		"escrow":    lotusTypes.FIL(bal.Escrow),
+		"locked":    lotusTypes.FIL(bal.Locked),
+		"available": lotusTypes.FIL(big.Sub(bal.Escrow, bal.Locked)),
+	})
+}
+
+func (s *Shuttle) handleMarketFunds(move func(context.Context, abi.TokenAmount) (cid.Cid, error)) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		amt, err := lotusTypes.ParseFIL(c.Param("amt"))
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid amount: %s", err),
+			}
+		}
+
+		mcid, err := move(c.Request().Context(), abi.TokenAmount(amt))
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"msgCid": mcid,
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-metrics-interface"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+)
+
+type shuttleMetrics struct {
+	pinQueueSize metrics.Gauge
+	activePins   metrics.Gauge
+	pinFailures  metrics.Counter
+	pinsReused   metrics.Counter
+	pinsFlagged  metrics.Counter
+
+	pinBlocksResumed metrics.Counter
+
+	dedupBlocks metrics.Counter
+	dedupBytes  metrics.Counter
+
+	originConnectFailures metrics.Counter
+
+	transfersQueued metrics.Gauge
+
+	blockstoreSize metrics.Gauge
+	blockstoreFree metrics.Gauge
+
+	rpcMessagesSent      metrics.Counter
+	rpcMessagesResent    metrics.Counter
+	rpcSendErrors        metrics.Counter
+	rpcCommandsRecv      metrics.Counter
+	rpcCommandFailures   metrics.Counter
+	rpcCommandsCancelled metrics.Counter
+
+	gcDeletedBlocks   metrics.Counter
+	integrityFailures metrics.Counter
+
+	uploadBytes metrics.Counter
+	apiRequests metrics.Counter
+	apiErrors   metrics.Counter
+
+	// totals of the error counters, reported to the primary in updates
+	pinFailureCount     int64
+	commandFailureCount int64
+	sendErrorCount      int64
+
+	// ingestedBytes is the total size of the pins completed, the ingest
+	// rate reported to the primary is taken from it
+	ingestedBytes int64
+}
+
+func (m *shuttleMetrics) pinFailed() {
+	m.pinFailures.Inc()
+	atomic.AddInt64(&m.pinFailureCount, 1)
+}
+
+func (m *shuttleMetrics) commandFailed() {
+	m.rpcCommandFailures.Inc()
+	atomic.AddInt64(&m.commandFailureCount, 1)
+}
+
+func (m *shuttleMetrics) sendFailed() {
+	m.rpcSendErrors.Inc()
+	atomic.AddInt64(&m.sendErrorCount, 1)
+}
+
+func (m *shuttleMetrics) ingested(size int64) {
+	atomic.AddInt64(&m.ingestedBytes, size)
+}
+
+func newShuttleMetrics(ctx context.Context) *shuttleMetrics {
+	return &shuttleMetrics{
+		pinQueueSize: metrics.NewCtx(ctx, "pin_queue_size", "number of pins waiting to be started").Gauge(),
+		activePins:   metrics.NewCtx(ctx, "pins_active", "number of pins currently being fetched").Gauge(),
+		pinFailures:  metrics.NewCtx(ctx, "pin_failures", "total number of failed pins").Counter(),
+		pinsReused:   metrics.NewCtx(ctx, "pins_reused", "total number of pins completed from the objects of an existing pin").Counter(),
+		pinsFlagged:  metrics.NewCtx(ctx, "pins_flagged", "total number of pins the preflight check estimated to be too large").Counter(),
+
+		pinBlocksResumed: metrics.NewCtx(ctx, "pin_blocks_resumed", "total number of blocks pins found in the blockstore instead of fetching them").Counter(),
+
+		dedupBlocks: metrics.NewCtx(ctx, "dedup_blocks", "total number of blocks of completed pins that were already stored for other pins").Counter(),
+		dedupBytes:  metrics.NewCtx(ctx, "dedup_bytes", "total bytes of completed pins that were already stored for other pins").Counter(),
+
+		originConnectFailures: metrics.NewCtx(ctx, "origin_connect_failures", "total number of origin peers of pins that could not be connected to").Counter(),
+
+		transfersQueued: metrics.NewCtx(ctx, "deal_transfers_queued", "number of deal transfers waiting for their batch to start").Gauge(),
+
+		blockstoreSize: metrics.NewCtx(ctx, "blockstore_size", "total size of blockstore filesystem directory").Gauge(),
+		blockstoreFree: metrics.NewCtx(ctx, "blockstore_free", "free space in blockstore filesystem directory").Gauge(),
+
+		rpcMessagesSent:      metrics.NewCtx(ctx, "rpc_messages_sent", "total number of rpc messages sent to the primary").Counter(),
+		rpcMessagesResent:    metrics.NewCtx(ctx, "rpc_messages_resent", "total number of queued rpc messages sent after reconnecting").Counter(),
+		rpcSendErrors:        metrics.NewCtx(ctx, "rpc_send_errors", "total number of rpc messages that failed to send").Counter(),
+		rpcCommandsRecv:      metrics.NewCtx(ctx, "rpc_commands_received", "total number of rpc commands received from the primary").Counter(),
+		rpcCommandFailures:   metrics.NewCtx(ctx, "rpc_command_failures", "total number of rpc commands that failed to be handled").Counter(),
+		rpcCommandsCancelled: metrics.NewCtx(ctx, "rpc_commands_cancelled", "total number of rpc commands revoked by the primary while running").Counter(),
+
+		gcDeletedBlocks:   metrics.NewCtx(ctx, "gc_deleted_blocks", "total number of blocks removed by garbage collection").Counter(),
+		integrityFailures: metrics.NewCtx(ctx, "integrity_failures", "total number of corrupted or missing blocks found by integrity checks").Counter(),
+
+		uploadBytes: metrics.NewCtx(ctx, "upload_bytes", "total bytes received by upload endpoints").Counter(),
+		apiRequests: metrics.NewCtx(ctx, "api_requests", "total number of api requests handled").Counter(),
+		apiErrors:   metrics.NewCtx(ctx, "api_errors", "total number of api requests that failed with a server error").Counter(),
+	}
+}
+
+// runMetricsUpdater periodically refreshes the gauges that are sampled
+// rather than updated as things happen
+func (s *Shuttle) runMetricsUpdater() {
+	for ; ; time.Sleep(time.Second * 10) {
+		s.metrics.pinQueueSize.Set(float64(s.PinMgr.PinQueueSize()))
+		s.metrics.activePins.Set(float64(s.PinMgr.ActivePinCount()))
+		s.metrics.transfersQueued.Set(float64(s.transfers.queued()))
+
+		size, free := blockstoreUsage(s.blockstoreDisks())
+		s.metrics.blockstoreSize.Set(float64(size))
+		s.metrics.blockstoreFree.Set(float64(free))
+	}
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	counter metrics.Counter
+}
+
+func (crc *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := crc.ReadCloser.Read(p)
+	crc.counter.Add(float64(n))
+	return n, err
+}
+
+// uploadMetricsMiddleware counts the request body bytes read by upload
+// endpoints, the rate of which is the upload throughput of the shuttle
+func (s *Shuttle) uploadMetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countingReadCloser{ReadCloser: r.Body, counter: s.metrics.uploadBytes}
+		}
+		return next(c)
+	}
+}
+
+func (s *Shuttle) apiMetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+
+		code := c.Response().Status
+		var herr *util.HttpError
+		var eerr *echo.HTTPError
+		switch {
+		case err == nil:
+		case xerrors.As(err, &herr):
+			code = herr.Code
+		case xerrors.As(err, &eerr):
+			code = eerr.Code
+		default:
+			code = http.StatusInternalServerError
+		}
+
+		s.metrics.apiRequests.Inc()
+		if code >= http.StatusInternalServerError {
+			s.metrics.apiErrors.Inc()
+		}
+		return err
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/estuary/util/dbmigrate"
+	"gorm.io/gorm"
+)
+
+// shuttleMigrations are the changes to the shuttle database schema and data,
+// in the order they are applied. Applied migrations must never be edited or
+// reordered, every change needs a new migration at the end. Migrations should
+// create and alter tables with explicit Migrator calls rather than
+// AutoMigrate, so they keep doing the same thing as the models change.
+var shuttleMigrations = []dbmigrate.Migration{
+	{
+		// adopts databases created before migrations were versioned, which
+		// were auto migrated to the models at that point
+		ID: "0001_initial_schema",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Pin{}, &Object{}, &ObjRef{}, &PieceCommRecord{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&Pin{}, &Object{}, &ObjRef{}, &PieceCommRecord{})
+		},
+	},
+	{
+		ID: "0002_audit_log",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasTable(&AuditEntry{}) {
+				return nil
+			}
+			return tx.Migrator().CreateTable(&AuditEntry{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&AuditEntry{})
+		},
+	},
+	{
+		ID: "0003_pin_expiry",
+		Up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&Pin{}, "ExpiresAt") {
+				if err := tx.Migrator().AddColumn(&Pin{}, "ExpiresAt"); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasIndex(&Pin{}, "ExpiresAt") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&Pin{}, "ExpiresAt")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&Pin{}, "ExpiresAt"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&Pin{}, "ExpiresAt")
+		},
+	},
+	{
+		ID: "0004_pin_tiering",
+		Up: func(tx *gorm.DB) error {
+			for _, col := range []string{"Tier", "TierDeals"} {
+				if tx.Migrator().HasColumn(&Pin{}, col) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&Pin{}, col); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropColumn(&Pin{}, "TierDeals"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&Pin{}, "Tier")
+		},
+	},
+	{
+		ID: "0005_staged_aggregates",
+		Up: func(tx *gorm.DB) error {
+			for _, t := range []interface{}{&StagedAggregate{}, &AggregateEntry{}} {
+				if tx.Migrator().HasTable(t) {
+					continue
+				}
+				if err := tx.Migrator().CreateTable(t); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&AggregateEntry{}, &StagedAggregate{})
+		},
+	},
+	{
+		ID: "0006_pin_migrated_from",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&Pin{}, "MigratedFrom") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&Pin{}, "MigratedFrom")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&Pin{}, "MigratedFrom")
+		},
+	},
+	{
+		ID: "0007_pin_dedup",
+		Up: func(tx *gorm.DB) error {
+			for _, col := range []string{"DedupBlocks", "DedupBytes"} {
+				if tx.Migrator().HasColumn(&Pin{}, col) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&Pin{}, col); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropColumn(&Pin{}, "DedupBytes"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&Pin{}, "DedupBlocks")
+		},
+	},
+	{
+		ID: "0008_idempotency_keys",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasTable(&util.IdempotencyKey{}) {
+				return nil
+			}
+			return tx.Migrator().CreateTable(&util.IdempotencyKey{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&util.IdempotencyKey{})
+		},
+	},
+	{
+		ID: "0009_webhook_deliveries",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasTable(&WebhookDelivery{}) {
+				return nil
+			}
+			return tx.Migrator().CreateTable(&WebhookDelivery{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&WebhookDelivery{})
+		},
+	},
+	{
+		ID: "0010_pin_failure_reason",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&Pin{}, "FailureReason") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&Pin{}, "FailureReason")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&Pin{}, "FailureReason")
+		},
+	},
+	{
+		ID: "0011_pin_corrupted",
+		Up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&Pin{}, "Corrupted") {
+				if err := tx.Migrator().AddColumn(&Pin{}, "Corrupted"); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasIndex(&Pin{}, "Corrupted") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&Pin{}, "Corrupted")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&Pin{}, "Corrupted")
+		},
+	},
+	{
+		ID: "0012_pin_name",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&Pin{}, "Name") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&Pin{}, "Name")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&Pin{}, "Name")
+		},
+	},
+}
+
+func openMigrator(dbval string) (*dbmigrate.Migrator, error) {
+	db, err := util.SetupDatabase(dbval)
+	if err != nil {
+		return nil, err
+	}
+	return dbmigrate.New(db, shuttleMigrations)
+}
+
+func migrateStatusCmd(dbval string) error {
+	m, err := openMigrator(dbval)
+	if err != nil {
+		return err
+	}
+
+	sts, err := m.Status()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sts)
+}
+
+func migrateUpCmd(dbval, to string) error {
+	m, err := openMigrator(dbval)
+	if err != nil {
+		return err
+	}
+
+	done, err := m.Up(to)
+	for _, id := range done {
+		fmt.Println("applied", id)
+	}
+	if err != nil {
+		return err
+	}
+	if len(done) == 0 {
+		fmt.Println("database is up to date")
+	}
+	return nil
+}
+
+func migrateDownCmd(dbval string, steps int) error {
+	if steps < 1 {
+		return fmt.Errorf("must roll back at least one migration")
+	}
+
+	m, err := openMigrator(dbval)
+	if err != nil {
+		return err
+	}
+
+	done, err := m.Down(steps)
+	for _, id := range done {
+		fmt.Println("rolled back", id)
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/node"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel"
+)
+
+// openOfflineShuttle sets up the database and blockstore of a stopped
+// shuttle, for maintenance commands that work on them directly. Nothing runs
+// in the background and there is no libp2p node. The returned func closes
+// the blockstore.
+func openOfflineShuttle(ctx context.Context, cfg *config.Shuttle) (*Shuttle, func(), error) {
+	db, err := openDatabase(cfg.DatabaseConnString, databasePool(cfg.Database))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bs, closer, err := node.OpenBlockstore(ctx, &cfg.Node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &Shuttle{
+		Node:          &node.Node{Blockstore: bs},
+		DB:            db,
+		Tracer:        otel.Tracer("shuttle"),
+		inflightCids:  make(map[cid.Cid]uint),
+		metrics:       newShuttleMetrics(ctx),
+		shuttleConfig: cfg,
+	}, closer, nil
+}
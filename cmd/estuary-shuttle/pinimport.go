@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+)
+
+// pinningServices are the endpoints of well known pinning services, so users
+// can give their name instead
+var pinningServices = map[string]string{
+	"pinata":       "https://api.pinata.cloud/psa",
+	"web3.storage": "https://api.web3.storage",
+}
+
+const (
+	pinImportListing  = "listing"
+	pinImportQueueing = "queueing"
+	pinImportDone     = "done"
+	pinImportFailed   = "failed"
+)
+
+// pinImportPage is how many pins are listed at once, the most the pinning
+// service api allows
+const pinImportPage = 1000
+
+// maxImportedPins bounds the pins taken over in one import
+const maxImportedPins = 100000
+
+// maxPinImportErrors is how many of the pins that could not be queued are
+// listed in the report
+const maxPinImportErrors = 100
+
+type pinImportError struct {
+	Cid   string `json:"cid"`
+	Error string `json:"error"`
+}
+
+// pinImport takes over the pins of a user from another pinning service
+type pinImport struct {
+	ID     uint64 `json:"id"`
+	userID uint
+
+	Endpoint string    `json:"endpoint"`
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started"`
+	Ended    time.Time `json:"ended,omitempty"`
+
+	// Listed is how many pins were found at the other service, Queued and
+	// Failed how many of them were queued here or could not be
+	Listed int `json:"listed"`
+	Queued int `json:"queued"`
+	Failed int `json:"failed"`
+
+	Errors []pinImportError `json:"errors,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// pinImports keeps the imports of the last day in memory, like urlFetches
+type pinImports struct {
+	lk      sync.Mutex
+	next    uint64
+	imports map[uint64]*pinImport
+}
+
+func (pi *pinImports) start(uid uint, endpoint string, now time.Time) *pinImport {
+	pi.lk.Lock()
+	defer pi.lk.Unlock()
+
+	if pi.imports == nil {
+		pi.imports = make(map[uint64]*pinImport)
+	}
+	for id, imp := range pi.imports {
+		if !imp.Ended.IsZero() && now.Sub(imp.Ended) > urlFetchKeep {
+			delete(pi.imports, id)
+		}
+	}
+
+	pi.next++
+	imp := &pinImport{ID: pi.next, userID: uid, Endpoint: endpoint, Status: pinImportListing, Started: now}
+	pi.imports[imp.ID] = imp
+	return imp
+}
+
+// get returns a copy of the import, nil if the user has no such import
+func (pi *pinImports) get(uid uint, id uint64) *pinImport {
+	pi.lk.Lock()
+	defer pi.lk.Unlock()
+
+	imp, ok := pi.imports[id]
+	if !ok || imp.userID != uid {
+		return nil
+	}
+	cp := *imp
+	cp.Errors = append([]pinImportError(nil), imp.Errors...)
+	return &cp
+}
+
+func (pi *pinImports) update(imp *pinImport, f func(*pinImport)) {
+	pi.lk.Lock()
+	defer pi.lk.Unlock()
+	f(imp)
+}
+
+// pinServiceEndpoint resolves the name of a well known pinning service, or
+// checks the url of another one
+func pinServiceEndpoint(service string) (string, error) {
+	if ep, ok := pinningServices[strings.ToLower(service)]; ok {
+		return ep, nil
+	}
+	pu, err := parseFetchURL(service)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(pu.String(), "/"), nil
+}
+
+// listRemotePins lists the pinned objects of the token's owner at a pinning
+// service, newest first, and calls f with each page
+func (s *Shuttle) listRemotePins(ctx context.Context, endpoint, token string, f func([]*types.IpfsPinStatusResponse) error) error {
+	seen := make(map[string]bool)
+	var before time.Time
+	for len(seen) < maxImportedPins {
+		q := url.Values{}
+		q.Set("status", string(types.PinningStatusPinned))
+		q.Set("limit", strconv.Itoa(pinImportPage))
+		if !before.IsZero() {
+			// pins created at the same time as the oldest one so far are
+			// listed again rather than skipped
+			q.Set("before", before.Add(time.Nanosecond).Format(time.RFC3339Nano))
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/pins?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := s.urlFetchClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		var page types.IpfsListPinStatusResponse
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("pinning service responded with %s", resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode pin list: %w", err)
+		}
+
+		var fresh []*types.IpfsPinStatusResponse
+		for _, st := range page.Results {
+			if seen[st.RequestID] {
+				continue
+			}
+			seen[st.RequestID] = true
+			fresh = append(fresh, st)
+			if before.IsZero() || st.Created.Before(before) {
+				before = st.Created
+			}
+		}
+		if len(fresh) == 0 {
+			return nil
+		}
+		if err := f(fresh); err != nil {
+			return err
+		}
+		if len(page.Results) < pinImportPage {
+			return nil
+		}
+	}
+	return nil
+}
+
+// importPins queues the pins of the user at another pinning service here
+func (s *Shuttle) importPins(ctx context.Context, u *User, imp *pinImport, token string) error {
+	return s.listRemotePins(ctx, imp.Endpoint, token, func(sts []*types.IpfsPinStatusResponse) error {
+		s.pinImports.update(imp, func(imp *pinImport) {
+			imp.Status = pinImportQueueing
+			imp.Listed += len(sts)
+		})
+
+		for _, st := range sts {
+			pin := st.Pin
+			if pin.Meta == nil {
+				pin.Meta = make(map[string]interface{})
+			}
+			pin.Meta["importedFrom"] = imp.Endpoint
+
+			_, err := s.pinForUser(ctx, u, pin)
+			s.pinImports.update(imp, func(imp *pinImport) {
+				if err == nil {
+					imp.Queued++
+					return
+				}
+				imp.Failed++
+				if len(imp.Errors) < maxPinImportErrors {
+					imp.Errors = append(imp.Errors, pinImportError{Cid: pin.CID, Error: err.Error()})
+				}
+			})
+
+			var herr *util.HttpError
+			if xerrors.As(err, &herr) && herr.Reason == util.ERR_CONTENT_ADDING_DISABLED {
+				// the rest would fail the same way
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type pinImportBody struct {
+	// Service is the name of a well known pinning service or the url of
+	// the pinning service api of another one
+	Service string `json:"service"`
+	Token   string `json:"token"`
+}
+
+// handleImportPins godoc
+// @Summary      Import pins from another pinning service
+// @Description  This endpoint lists the pinned objects at another pinning service with the given access token, and pins all of them here. It returns right away, the import is followed with the returned id. The token is only used for listing and is not kept.
+// @Tags         pinning
+// @Produce      json
+// @Param        body  body  pinImportBody  true  "Pinning service and access token"
+// @Router       /pinning/import [post]
+func (s *Shuttle) handleImportPins(c echo.Context, u *User) error {
+	if err := util.ErrorIfContentAddingDisabled(u.StorageDisabled || s.addingDisabled()); err != nil {
+		return err
+	}
+
+	var body pinImportBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	endpoint, err := pinServiceEndpoint(body.Service)
+	if err != nil {
+		return err
+	}
+	if body.Token == "" {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "an access token for the pinning service is required",
+		}
+	}
+
+	imp := s.pinImports.start(u.ID, endpoint, time.Now())
+	go func() {
+		err := s.importPins(context.Background(), u, imp, body.Token)
+		if err != nil {
+			log.Warnw("failed to import pins", "user", u.ID, "endpoint", endpoint, "err", err)
+		}
+		s.pinImports.update(imp, func(imp *pinImport) {
+			imp.Ended = time.Now()
+			imp.Status = pinImportDone
+			if err != nil {
+				imp.Status = pinImportFailed
+				imp.Error = err.Error()
+			}
+		})
+	}()
+
+	return c.JSON(http.StatusAccepted, s.pinImports.get(u.ID, imp.ID))
+}
+
+// handleGetPinImport godoc
+// @Summary      Follow a pin import
+// @Description  This endpoint returns how many pins an import found and queued so far, and why pins could not be queued
+// @Tags         pinning
+// @Produce      json
+// @Param        id  path  int  true  "Import id"
+// @Router       /pinning/import/{id} [get]
+func (s *Shuttle) handleGetPinImport(c echo.Context, u *User) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid import id %q", c.Param("id")),
+		}
+	}
+
+	imp := s.pinImports.get(u.ID, id)
+	if imp == nil {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_IMPORT_NOT_FOUND,
+			Details: fmt.Sprintf("no import %d", id),
+		}
+	}
+	return c.JSON(http.StatusOK, imp)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePinningService lists n pins, newest first, the way the pinning
+// service api pages them
+func fakePinningService(t *testing.T, n int) *httptest.Server {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	var pins []*types.IpfsPinStatusResponse
+	for i := 0; i < n; i++ {
+		pins = append(pins, &types.IpfsPinStatusResponse{
+			RequestID: fmt.Sprint(i),
+			Status:    types.PinningStatusPinned,
+			// pairs of pins share a creation time
+			Created: start.Add(time.Duration(i/2) * time.Second),
+			Pin:     types.IpfsPin{CID: fmt.Sprintf("cid-%d", i)},
+		})
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Created.After(pins[j].Created) })
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var page []*types.IpfsPinStatusResponse
+		before, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("before"))
+		for _, p := range pins {
+			if err == nil && !p.Created.Before(before) {
+				continue
+			}
+			if len(page) == pinImportPage {
+				break
+			}
+			page = append(page, p)
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(&types.IpfsListPinStatusResponse{Count: len(pins), Results: page}))
+	}))
+}
+
+func TestListRemotePins(t *testing.T) {
+	srv := fakePinningService(t, 2501)
+	defer srv.Close()
+
+	s := &Shuttle{urlFetchClient: newUrlFetchClient(config.UrlFetch{AllowPrivate: true})}
+
+	seen := make(map[string]int)
+	require.NoError(t, s.listRemotePins(context.Background(), srv.URL, "secret", func(sts []*types.IpfsPinStatusResponse) error {
+		for _, st := range sts {
+			seen[st.Pin.CID]++
+		}
+		return nil
+	}))
+	assert.Len(t, seen, 2501)
+	for c, n := range seen {
+		assert.Equal(t, 1, n, "%s was listed more than once", c)
+	}
+
+	err := s.listRemotePins(context.Background(), srv.URL, "wrong", func([]*types.IpfsPinStatusResponse) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestPinServiceEndpoint(t *testing.T) {
+	ep, err := pinServiceEndpoint("Pinata")
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.pinata.cloud/psa", ep)
+
+	ep, err = pinServiceEndpoint("https://pins.example.com/api/")
+	require.NoError(t, err)
+	assert.Equal(t, "https://pins.example.com/api", ep)
+
+	_, err = pinServiceEndpoint("nowhere")
+	assert.Error(t, err)
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+var errPinRemoved = errors.New("pin was removed by its owner")
+
+// The shuttle serves the pinning service api so pins land on the shuttle the
+// user talks to. New pins are created with the primary and fetched here.
+// Listing, getting and removing pins works on the pins held on this shuttle,
+// the primary is told about removed pins and lists the pins on every node.
+// Replaced pins are fetched here like new ones and the replaced pin, which
+// may be held anywhere, is removed through the primary.
+
+func (s *Shuttle) pinDelegates() []string {
+	var out []string
+	for _, a := range s.Node.Host.Addrs() {
+		out = append(out, fmt.Sprintf("%s/p2p/%s", a, s.Node.Host.ID()))
+	}
+	return out
+}
+
+// handleAddPin godoc
+// @Summary      Add and pin object
+// @Description  This endpoint pins an object on this shuttle. A "depth" in the pin meta limits the pin to that many levels of the dag, 1 pins only the root block.
+// @Tags         pinning
+// @Produce      json
+// @Param        pin  body  types.IpfsPin  true  "Pin"
+// @Router       /pinning/pins [post]
+func (s *Shuttle) handleAddPin(c echo.Context, u *User) error {
+	var pin types.IpfsPin
+	if err := c.Bind(&pin); err != nil {
+		return err
+	}
+
+	st, err := s.pinForUser(c.Request().Context(), u, pin)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, st)
+}
+
+// handleReplacePin godoc
+// @Summary      Replace a pinned object
+// @Description  This endpoint pins an object on this shuttle in place of an existing pin, which is removed once the new one is queued.
+// @Tags         pinning
+// @Produce      json
+// @Param        pinid  path  string  true  "Pin ID"
+// @Param        pin    body  types.IpfsPin  true  "Pin"
+// @Router       /pinning/pins/{pinid} [post]
+func (s *Shuttle) handleReplacePin(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	pinID, err := strconv.Atoi(c.Param("pinid"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid pin id %q", c.Param("pinid")),
+		}
+	}
+
+	var pin types.IpfsPin
+	if err := c.Bind(&pin); err != nil {
+		return err
+	}
+
+	// the primary knows whether the pin exists and belongs to the user
+	var old types.IpfsPinStatusResponse
+	if err := s.primaryAPI(ctx, u, "GET", fmt.Sprintf("/pinning/pins/%d", pinID), nil, &old); err != nil {
+		return err
+	}
+
+	st, err := s.pinForUser(ctx, u, pin)
+	if err != nil {
+		return err
+	}
+
+	if err := s.primaryAPI(ctx, u, "DELETE", fmt.Sprintf("/pinning/pins/%d", pinID), nil, nil); err != nil {
+		return fmt.Errorf("pin %s was added but the replaced pin %d could not be removed: %w", st.RequestID, pinID, err)
+	}
+	return c.JSON(http.StatusAccepted, st)
+}
+
+// pinForUser creates the content of a pin with the primary, located on this
+// shuttle, and queues fetching it here
+func (s *Shuttle) pinForUser(ctx context.Context, u *User, pin types.IpfsPin) (_ *types.IpfsPinStatusResponse, err error) {
+	ae := &AuditEntry{Actor: auditActorUser, UserID: u.ID, Action: "pin", Cid: pin.CID}
+	defer func() {
+		s.audit(ae, err)
+	}()
+
+	if u.StorageDisabled || s.addingDisabled() {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_CONTENT_ADDING_DISABLED,
+			Details: "pinning content to this node is not allowed at the moment",
+		}
+	}
+
+	obj, err := cid.Decode(pin.CID)
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid cid %q: %s", pin.CID, err),
+		}
+	}
+
+	var origins []*peer.AddrInfo
+	for _, p := range pin.Origins {
+		ai, err := peer.AddrInfoFromString(p)
+		if err != nil {
+			return nil, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid origin %q: %s", p, err),
+			}
+		}
+		origins = append(origins, ai)
+	}
+
+	depth, err := util.PinDepthFromMeta(pin.Meta)
+	if err != nil {
+		return nil, err
+	}
+
+	exp, err := expiryFromMeta(pin.Meta, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var cic util.ContentInCollection
+	if col, ok := pin.Meta["collection"].(string); ok && col != "" {
+		cic.CollectionID = col
+		cic.CollectionDir, _ = pin.Meta["colpath"].(string)
+	}
+
+	var pinMeta string
+	if len(pin.Meta) > 0 {
+		b, err := json.Marshal(pin.Meta)
+		if err != nil {
+			return nil, err
+		}
+		pinMeta = string(b)
+	}
+
+	contid, err := s.createContentWithBody(ctx, u, util.ContentCreateBody{
+		ContentInCollection: cic,
+		Root:                obj.String(),
+		Name:                pin.Name,
+		Pinning:             true,
+		PinMeta:             pinMeta,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ae.Content = contid
+
+	s.addPinLk.Lock()
+	err = s.addPin(ctx, contid, obj, u.ID, origins, false, pinner.PriorityNormal, depth)
+	s.addPinLk.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// name and meta are kept for listing the pin here
+	updates := map[string]interface{}{
+		"name":     pin.Name,
+		"pin_meta": pinMeta,
+	}
+	if exp != nil {
+		updates["expires_at"] = exp
+	}
+	if err := s.DB.Model(Pin{}).Where("content = ?", contid).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+
+	if pin.Meta == nil {
+		pin.Meta = make(map[string]interface{})
+	}
+	if pin.Origins == nil {
+		pin.Origins = []string{}
+	}
+
+	return &types.IpfsPinStatusResponse{
+		RequestID: strconv.Itoa(int(contid)),
+		Status:    types.PinningStatusQueued,
+		Created:   time.Now().UTC(),
+		Delegates: s.pinDelegates(),
+		Info:      make(map[string]interface{}),
+		Pin:       pin,
+	}, nil
+}
+
+const (
+	defaultPinListLimit = 10
+	maxPinListLimit     = 1000
+)
+
+// handleListPins godoc
+// @Summary      List pins on this shuttle
+// @Description  This endpoint lists the pins of the user held on this shuttle, newest first. The primary lists the pins of the user on every node. Queued and pinning pins cannot be told apart in the filter, either status matches both.
+// @Tags         pinning
+// @Produce      json
+// @Param        cid        query  string  false  "Comma separated cids"
+// @Param        name       query  string  false  "Name"
+// @Param        match      query  string  false  "exact, iexact, partial or ipartial"
+// @Param        status     query  string  false  "Comma separated statuses"
+// @Param        before     query  string  false  "Created before, RFC 3339"
+// @Param        after      query  string  false  "Created after, RFC 3339"
+// @Param        requestid  query  string  false  "Comma separated pin ids"
+// @Param        limit      query  int     false  "Limit"
+// @Router       /pinning/pins [get]
+func (s *Shuttle) handleListPins(c echo.Context, u *User) error {
+	q, limit, err := pinListQuery(s.readDB(), u, c.QueryParams())
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	if err := q.Count(&count).Error; err != nil {
+		return err
+	}
+
+	var pins []Pin
+	if err := q.Order("created_at desc").Limit(limit).Find(&pins).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	out := make([]*types.IpfsPinStatusResponse, 0, len(pins))
+	for _, p := range pins {
+		out = append(out, s.ipfsPinStatus(p, now))
+	}
+
+	return c.JSON(http.StatusOK, types.IpfsListPinStatusResponse{
+		Count:   int(count),
+		Results: out,
+	})
+}
+
+// pinListQuery selects the pins of u matching the pinning service api list
+// filters in params, and returns how many of them to list
+func pinListQuery(db *gorm.DB, u *User, params url.Values) (*gorm.DB, int, error) {
+	badParam := func(format string, args ...interface{}) error {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+			Details: fmt.Sprintf(format, args...),
+		}
+	}
+
+	limit := defaultPinListLimit
+	if ql := params.Get("limit"); ql != "" {
+		l, err := strconv.Atoi(ql)
+		if err != nil || l < 1 || l > maxPinListLimit {
+			return nil, 0, badParam("specify a valid limit between 1 and %d", maxPinListLimit)
+		}
+		limit = l
+	}
+
+	q := db.Model(Pin{}).Where("user_id = ? and not aggregate", u.ID)
+
+	if qcids := params.Get("cid"); qcids != "" {
+		var cids []util.DbCID
+		for _, cs := range strings.Split(qcids, ",") {
+			c, err := cid.Decode(cs)
+			if err != nil {
+				return nil, 0, badParam("invalid cid %q: %s", cs, err)
+			}
+			cids = append(cids, util.DbCID{CID: c})
+		}
+		q = q.Where("cid in ?", cids)
+	}
+
+	if name := params.Get("name"); name != "" {
+		switch strings.ToLower(params.Get("match")) {
+		case "ipartial":
+			q = q.Where("lower(name) like ?", "%"+strings.ToLower(name)+"%")
+		case "partial":
+			q = q.Where("name like ?", "%"+name+"%")
+		case "iexact":
+			q = q.Where("lower(name) = ?", strings.ToLower(name))
+		default:
+			q = q.Where("name = ?", name)
+		}
+	}
+
+	if qbefore := params.Get("before"); qbefore != "" {
+		before, err := time.Parse(time.RFC3339, qbefore)
+		if err != nil {
+			return nil, 0, badParam("invalid before time %q: %s", qbefore, err)
+		}
+		q = q.Where("created_at <= ?", before)
+	}
+
+	if qafter := params.Get("after"); qafter != "" {
+		after, err := time.Parse(time.RFC3339, qafter)
+		if err != nil {
+			return nil, 0, badParam("invalid after time %q: %s", qafter, err)
+		}
+		q = q.Where("created_at > ?", after)
+	}
+
+	if qids := params.Get("requestid"); qids != "" {
+		var ids []uint
+		for _, is := range strings.Split(qids, ",") {
+			id, err := strconv.ParseUint(is, 10, 64)
+			if err != nil {
+				return nil, 0, badParam("invalid request id %q", is)
+			}
+			ids = append(ids, uint(id))
+		}
+		q = q.Where("content in ?", ids)
+	}
+
+	if qstatus := params.Get("status"); qstatus != "" {
+		var conds []string
+		for _, st := range strings.Split(qstatus, ",") {
+			switch types.PinningStatus(st) {
+			case types.PinningStatusPinned:
+				conds = append(conds, "active")
+			case types.PinningStatusFailed:
+				conds = append(conds, "(failed and not active)")
+			case types.PinningStatusQueued, types.PinningStatusPinning:
+				// the pin manager knows which pins are being fetched, the
+				// database does not
+				conds = append(conds, "(not active and not failed and not cancelled)")
+			default:
+				return nil, 0, &util.HttpError{
+					Code:    http.StatusBadRequest,
+					Reason:  util.ERR_INVALID_PINNING_STATUS,
+					Details: fmt.Sprintf("unrecognized pin status in query: %q", st),
+				}
+			}
+		}
+		q = q.Where(strings.Join(conds, " or "))
+	}
+
+	return q, limit, nil
+}
+
+// handleGetPin godoc
+// @Summary      Get a pin on this shuttle
+// @Description  This endpoint returns the status of a pin of the user held on this shuttle.
+// @Tags         pinning
+// @Produce      json
+// @Param        pinid  path  string  true  "Pin ID"
+// @Router       /pinning/pins/{pinid} [get]
+func (s *Shuttle) handleGetPin(c echo.Context, u *User) error {
+	pin, err := s.userPin(u, c.Param("pinid"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, s.ipfsPinStatus(*pin, time.Now()))
+}
+
+// handleDeletePin godoc
+// @Summary      Remove a pin on this shuttle
+// @Description  This endpoint unpins a pin of the user held on this shuttle and has the primary remove its content.
+// @Tags         pinning
+// @Param        pinid  path  string  true  "Pin ID"
+// @Router       /pinning/pins/{pinid} [delete]
+func (s *Shuttle) handleDeletePin(c echo.Context, u *User) error {
+	pin, err := s.userPin(u, c.Param("pinid"))
+	if err != nil {
+		return err
+	}
+
+	if err := s.removeUserPin(c.Request().Context(), u, *pin); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusAccepted)
+}
+
+// userPin looks up the pin of u held on this shuttle for the pin id pinid
+func (s *Shuttle) userPin(u *User, pinid string) (*Pin, error) {
+	id, err := strconv.ParseUint(pinid, 10, 64)
+	if err != nil {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid pin id %q", pinid),
+		}
+	}
+
+	var pin Pin
+	if err := s.readDB().First(&pin, "content = ? and user_id = ? and not aggregate", id, u.ID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("pin %d is not held on this shuttle", id),
+			}
+		}
+		return nil, err
+	}
+	return &pin, nil
+}
+
+// removeUserPin unpins p for its owner u, aborting it first if it is still
+// being fetched, and tells the primary the content is gone
+func (s *Shuttle) removeUserPin(ctx context.Context, u *User, p Pin) (err error) {
+	ae := &AuditEntry{Actor: auditActorUser, UserID: u.ID, Action: "unpin", Content: p.Content, Cid: p.Cid.CID.String()}
+	defer func() {
+		s.audit(ae, err)
+	}()
+
+	s.cancelContentCommands([]uint{p.Content}, errPinRemoved)
+	if p.Pinning {
+		s.PinMgr.Cancel(p.Content)
+	}
+
+	if err := s.Unpin(ctx, p.Content); err != nil {
+		return err
+	}
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_ContentRemoved,
+		Params: drpc.MsgParams{
+			ContentRemoved: &drpc.ContentRemoved{
+				Contents: []uint{p.Content},
+			},
+		},
+	})
+}
+
+// ipfsPinStatus returns p the way the pinning service api describes pins
+func (s *Shuttle) ipfsPinStatus(p Pin, now time.Time) *types.IpfsPinStatusResponse {
+	st := s.pinStatus(&p, now)
+
+	meta := make(map[string]interface{})
+	if p.PinMeta != "" {
+		if err := json.Unmarshal([]byte(p.PinMeta), &meta); err != nil {
+			log.Warnf("pin %d has invalid pin meta: %s", p.ID, err)
+		}
+	}
+
+	origins := make([]string, 0)
+	if p.Origins != "" {
+		var peers []*peer.AddrInfo
+		if err := json.Unmarshal([]byte(p.Origins), &peers); err != nil {
+			log.Warnf("pin %d has invalid origins: %s", p.ID, err)
+		}
+		for _, ai := range peers {
+			addrs, err := peer.AddrInfoToP2pAddrs(ai)
+			if err != nil {
+				continue
+			}
+			for _, a := range addrs {
+				origins = append(origins, a.String())
+			}
+		}
+	}
+
+	info := make(map[string]interface{})
+	if p.FailureReason != "" {
+		info["failure_reason"] = p.FailureReason
+	}
+	st.Estimate.AddInfo(info)
+
+	return &types.IpfsPinStatusResponse{
+		RequestID: strconv.FormatUint(uint64(p.Content), 10),
+		Status:    st.Status,
+		Created:   p.CreatedAt,
+		Delegates: s.pinDelegates(),
+		Info:      info,
+		Pin: types.IpfsPin{
+			CID:     p.Cid.CID.String(),
+			Name:    p.Name,
+			Meta:    meta,
+			Origins: origins,
+		},
+	}
+}
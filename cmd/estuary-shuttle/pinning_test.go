@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinListQuery(t *testing.T) {
+	s := newTestShuttle(t)
+	u := &User{ID: 1}
+
+	for i, data := range []string{"one", "two", "three", "other user"} {
+		addTestPin(t, s, uint(i+1), blocks.NewBlock([]byte(data)))
+	}
+	require.NoError(t, s.DB.Model(Pin{}).Where("content < 4").Update("user_id", 1).Error)
+	require.NoError(t, s.DB.Model(Pin{}).Where("content = 1").Update("name", "Photos").Error)
+	require.NoError(t, s.DB.Model(Pin{}).Where("content = 2").Updates(map[string]interface{}{"active": false, "failed": true}).Error)
+
+	list := func(query string) []uint {
+		params, err := url.ParseQuery(query)
+		require.NoError(t, err)
+		q, _, err := pinListQuery(s.DB, u, params)
+		require.NoError(t, err)
+
+		var out []uint
+		require.NoError(t, q.Order("content").Pluck("content", &out).Error)
+		return out
+	}
+
+	assert.Equal(t, []uint{1, 2, 3}, list(""), "pins of other users were listed")
+	assert.Equal(t, []uint{1, 3}, list("status=pinned"))
+	assert.Equal(t, []uint{1, 2, 3}, list("status=pinned,failed"))
+	assert.Equal(t, []uint{1}, list("name=photo&match=ipartial"))
+	assert.Empty(t, list("name=photo"))
+	assert.Equal(t, []uint{2}, list("requestid=2,4"))
+
+	for _, query := range []string{"limit=0", "limit=1001", "status=done", "cid=nope", "before=yesterday"} {
+		params, err := url.ParseQuery(query)
+		require.NoError(t, err)
+		_, _, err = pinListQuery(s.DB, u, params)
+		assert.Error(t, err, query)
+	}
+}
+
+func TestRemoveUserPin(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.resend = newResendQueue(nil)
+	u := &User{ID: 1}
+
+	blk := blocks.NewBlock([]byte("removed"))
+	addTestPin(t, s, 1, blk)
+	require.NoError(t, s.DB.Model(Pin{}).Where("content = 1").Update("user_id", 1).Error)
+
+	_, err := s.userPin(&User{ID: 2}, "1")
+	assert.Error(t, err, "pins of other users must not be found")
+
+	pin, err := s.userPin(u, "1")
+	require.NoError(t, err)
+	require.NoError(t, s.removeUserPin(ctx, u, *pin))
+
+	assert.False(t, hasBlock(t, s, blk))
+	_, err = s.userPin(u, "1")
+	assert.Error(t, err)
+	assert.Equal(t, 1, s.resend.len(), "primary was not told about the removed pin")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+const (
+	// pinProgressInterval is how often the progress of running pins is sent
+	// to the primary
+	pinProgressInterval = 5 * time.Second
+
+	// pinProgressMaxQueued bounds the queued pins whose position is sent to
+	// the primary, pins further back are reported once they move up
+	pinProgressMaxQueued = 100
+)
+
+// pinProgressChanges returns the pins that fetched more since the last
+// report and updates last to the current progress. Pins that are no longer
+// running are dropped from last.
+func pinProgressChanges(last map[uint]int64, cur []pinner.PinProgress) []drpc.PinFetchProgress {
+	var out []drpc.PinFetchProgress
+	running := make(map[uint]bool, len(cur))
+	for _, p := range cur {
+		running[p.ContID] = true
+		if prev, ok := last[p.ContID]; ok && prev == p.SizeFetched {
+			continue
+		}
+		last[p.ContID] = p.SizeFetched
+
+		fp := drpc.PinFetchProgress{
+			DBID:   p.ContID,
+			Blocks: p.NumFetched,
+			Bytes:  p.SizeFetched,
+		}
+		if p.Estimate != nil {
+			fp.BytesPerSecond = p.Estimate.BytesPerSecond
+			fp.EstimatedCompletion = p.Estimate.EstimatedCompletion
+		}
+		out = append(out, fp)
+	}
+
+	for cont := range last {
+		if !running[cont] {
+			delete(last, cont)
+		}
+	}
+	return out
+}
+
+// queuePositionChanges returns the queued pins that moved in line since the
+// last report and updates last to their current positions. Pins that are no
+// longer among the reported ones are dropped from last.
+func queuePositionChanges(last map[uint]int, cur map[uint]*pinner.PinEstimate) []drpc.PinQueuePosition {
+	var out []drpc.PinQueuePosition
+	for cont, est := range cur {
+		if last[cont] == est.Position {
+			continue
+		}
+		last[cont] = est.Position
+		out = append(out, drpc.PinQueuePosition{
+			DBID:           cont,
+			Position:       est.Position,
+			EstimatedStart: est.EstimatedStart,
+		})
+	}
+
+	for cont := range last {
+		if _, ok := cur[cont]; !ok {
+			delete(last, cont)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Position < out[j].Position
+	})
+	return out
+}
+
+// runPinProgressReports tells the primary how far the running pins got and
+// where the queued ones stand, so it can show their progress
+func (s *Shuttle) runPinProgressReports() {
+	last := make(map[uint]int64)
+	lastQueued := make(map[uint]int)
+	for range time.Tick(pinProgressInterval) {
+		if s.isShuttingDown() {
+			return
+		}
+
+		changed := pinProgressChanges(last, s.PinMgr.RunningProgress())
+		moved := queuePositionChanges(lastQueued, s.PinMgr.QueuedEstimates(time.Now(), pinProgressMaxQueued))
+		if len(changed) == 0 && len(moved) == 0 {
+			continue
+		}
+
+		if err := s.sendRpcMessage(context.TODO(), &drpc.Message{
+			Op: drpc.OP_PinProgress,
+			Params: drpc.MsgParams{
+				PinProgress: &drpc.PinProgress{Pins: changed, Queued: moved},
+			},
+		}); err != nil {
+			log.Debugf("failed to send pin progress: %s", err)
+		}
+	}
+}
+
+type pinStatusResponse struct {
+	Content uint                `json:"content"`
+	Status  types.PinningStatus `json:"status"`
+
+	// RetryAt is set while a failed pin waits for its next attempt
+	RetryAt  *time.Time          `json:"retryAt,omitempty"`
+	Estimate *pinner.PinEstimate `json:"estimate,omitempty"`
+}
+
+// pinStatus returns the status of p, with its queue position and estimated
+// start while it is queued or its rate and estimated completion while it is
+// fetched
+func (s *Shuttle) pinStatus(p *Pin, now time.Time) *pinStatusResponse {
+	out := &pinStatusResponse{
+		Content: p.Content,
+		RetryAt: p.RetryAt,
+	}
+
+	switch {
+	case p.Active:
+		out.Status = types.PinningStatusPinned
+	case p.Cancelled:
+		out.Status = types.PinningStatusCancelled
+	case p.Failed:
+		out.Status = types.PinningStatusFailed
+	default:
+		// pins waiting to be retried are not in the pin manager
+		out.Status = types.PinningStatusQueued
+		if est, ok := s.PinMgr.Estimate(p.Content, now); ok {
+			out.Estimate = est
+			if est.Position == 0 {
+				out.Status = types.PinningStatusPinning
+			}
+		}
+	}
+	return out
+}
+
+// handleGetPinStatus godoc
+// @Summary      Pin status of a content
+// @Description  This endpoint returns the status of the pin of a content on this shuttle. Queued pins come with their position in line and estimated start, pins being fetched with the rate they fetch at and, if the size of the dag is known, their estimated completion.
+// @Tags         content
+// @Produce      json
+// @Param        cont  path  int  true  "Content id"
+// @Router       /content/status/{cont} [get]
+func (s *Shuttle) handleGetPinStatus(c echo.Context, u *User) error {
+	cont, err := strconv.ParseUint(c.Param("cont"), 10, 64)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id %q", c.Param("cont")),
+		}
+	}
+
+	var pin Pin
+	if err := s.readDB().First(&pin, "content = ? and user_id = ?", cont, u.ID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("no content %d on this shuttle", cont),
+			}
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, s.pinStatus(&pin, time.Now()))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/application-research/estuary/pinner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinProgressChanges(t *testing.T) {
+	last := make(map[uint]int64)
+
+	out := pinProgressChanges(last, []pinner.PinProgress{
+		{ContID: 1, NumFetched: 2, SizeFetched: 100},
+		{ContID: 2, NumFetched: 0, SizeFetched: 0},
+	})
+	assert.Len(t, out, 2, "new pins are reported")
+
+	out = pinProgressChanges(last, []pinner.PinProgress{
+		{ContID: 1, NumFetched: 3, SizeFetched: 150},
+		{ContID: 2, NumFetched: 0, SizeFetched: 0},
+	})
+	if assert.Len(t, out, 1, "pins that made no progress are skipped") {
+		assert.Equal(t, uint(1), out[0].DBID)
+		assert.Equal(t, int64(150), out[0].Bytes)
+	}
+
+	pinProgressChanges(last, nil)
+	assert.Empty(t, last, "finished pins are forgotten")
+}
+
+func TestQueuePositionChanges(t *testing.T) {
+	last := make(map[uint]int)
+
+	out := queuePositionChanges(last, map[uint]*pinner.PinEstimate{
+		1: {Position: 1},
+		2: {Position: 2},
+	})
+	if assert.Len(t, out, 2) {
+		assert.Equal(t, uint(1), out[0].DBID, "positions are sent in order")
+	}
+
+	out = queuePositionChanges(last, map[uint]*pinner.PinEstimate{
+		2: {Position: 1},
+		3: {Position: 3},
+	})
+	assert.Len(t, out, 2, "pins that moved or are new are reported")
+	assert.NotContains(t, last, uint(1), "started pins are forgotten")
+
+	out = queuePositionChanges(last, map[uint]*pinner.PinEstimate{
+		2: {Position: 1},
+		3: {Position: 3},
+	})
+	assert.Empty(t, out)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/pinner/types"
+	"golang.org/x/xerrors"
+)
+
+// maxAttemptErrorLen bounds the length of each error kept in a pins history
+const maxAttemptErrorLen = 512
+
+// pinRetryInterval is how often pins are checked for a due retry
+const pinRetryInterval = time.Second * 30
+
+type pinAttemptError struct {
+	Time   time.Time              `json:"time"`
+	Error  string                 `json:"error"`
+	Reason types.PinFailureReason `json:"reason,omitempty"`
+}
+
+// pinAttemptErrors is the error history of a pin, stored as JSON
+type pinAttemptErrors []pinAttemptError
+
+func (pe pinAttemptErrors) Value() (driver.Value, error) {
+	if len(pe) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(pe)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (pe *pinAttemptErrors) Scan(v interface{}) error {
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("cannot scan %T into pin attempt errors", v)
+	}
+
+	if len(b) == 0 {
+		*pe = nil
+		return nil
+	}
+	return json.Unmarshal(b, pe)
+}
+
+// retryBackoff returns how long to wait before the next attempt after the
+// given number of failed ones
+func (s *Shuttle) retryBackoff(attempts int) time.Duration {
+	cfg := s.shuttleConfig.Pinning
+	backoff := cfg.RetryBackoff
+	for i := 1; i < attempts && backoff < cfg.MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > cfg.MaxRetryBackoff {
+		backoff = cfg.MaxRetryBackoff
+	}
+	return backoff
+}
+
+// recordPinFailure adds a failed attempt to the pins history, along with
+// why it failed, and schedules the next attempt, unless it ran out of
+// attempts
+func (s *Shuttle) recordPinFailure(op *pinner.PinningOperation, pinErr error) error {
+	cont := op.ContId
+
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", cont).Error; err != nil {
+		return err
+	}
+
+	msg := pinErr.Error()
+	if len(msg) > maxAttemptErrorLen {
+		msg = msg[:maxAttemptErrorLen]
+	}
+
+	_, blocks, _ := op.Progress()
+	reason := pinner.ClassifyFailure(pinErr, blocks > 0)
+
+	pin.Attempts++
+	pin.AttemptErrors = append(pin.AttemptErrors, pinAttemptError{
+		Time:   time.Now(),
+		Error:  msg,
+		Reason: reason,
+	})
+
+	var retryAt *time.Time
+	// pins the preflight check rejected would only be rejected again
+	if pin.Attempts < s.shuttleConfig.Pinning.MaxAttempts && !xerrors.Is(pinErr, errPinRejected) {
+		t := time.Now().Add(s.retryBackoff(pin.Attempts))
+		retryAt = &t
+		log.Infow("pin failed, retrying later", "content", cont, "attempt", pin.Attempts, "retryAt", t, "reason", reason, "err", msg)
+	}
+
+	return s.DB.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumns(map[string]interface{}{
+		"attempts":       pin.Attempts,
+		"attempt_errors": pin.AttemptErrors,
+		"retry_at":       retryAt,
+		"failure_reason": reason,
+	}).Error
+}
+
+// pinFailureReason returns why the failed pin for cont failed
+func (s *Shuttle) pinFailureReason(cont uint) types.PinFailureReason {
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", cont).Error; err != nil {
+		log.Errorf("failed to look up failed pin %d: %s", cont, err)
+		return types.PinFailureUnknown
+	}
+	if pin.FailureReason == "" {
+		return types.PinFailureUnknown
+	}
+	return pin.FailureReason
+}
+
+// pinWillRetry reports whether the failed pin for cont has another attempt
+// scheduled
+func (s *Shuttle) pinWillRetry(cont uint) bool {
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", cont).Error; err != nil {
+		log.Errorf("failed to look up failed pin %d: %s", cont, err)
+		return false
+	}
+	return pin.RetryAt != nil
+}
+
+// sendPinAbandoned tells the primary a pin was given up on after it ran out
+// of attempts
+func (s *Shuttle) sendPinAbandoned(ctx context.Context, cont uint) {
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", cont).Error; err != nil {
+		log.Errorf("failed to look up abandoned pin %d: %s", cont, err)
+		return
+	}
+
+	errs := make([]string, 0, len(pin.AttemptErrors))
+	for _, e := range pin.AttemptErrors {
+		errs = append(errs, e.Error)
+	}
+
+	if err := s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_PinAbandoned,
+		Params: drpc.MsgParams{
+			PinAbandoned: &drpc.PinAbandoned{
+				DBID:     cont,
+				Attempts: pin.Attempts,
+				Errors:   errs,
+			},
+		},
+	}); err != nil {
+		log.Errorf("failed to send pin abandoned message: %s", err)
+	}
+}
+
+// runPinRetries requeues failed pins once their next attempt is due
+func (s *Shuttle) runPinRetries() {
+	for range time.Tick(pinRetryInterval) {
+		if s.isShuttingDown() {
+			return
+		}
+
+		var due []Pin
+		if err := s.DB.Find(&due, "active = false and pinning = true and retry_at <= ?", time.Now()).Error; err != nil {
+			log.Errorf("failed to query pins due for retry: %s", err)
+			continue
+		}
+
+		for _, p := range due {
+			// a retried pin goes to the back of the queue
+			if err := s.DB.Model(Pin{}).Where("id = ?", p.ID).UpdateColumns(map[string]interface{}{
+				"retry_at":  nil,
+				"queued_at": time.Now(),
+			}).Error; err != nil {
+				log.Errorf("failed to clear retry time of pin %d: %s", p.ID, err)
+				continue
+			}
+
+			log.Infow("retrying pin", "content", p.Content, "attempt", p.Attempts+1)
+			s.addPinToQueue(p)
+			go s.onPinStatusUpdate(p.Content, "", types.PinningStatusQueued)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	s := &Shuttle{shuttleConfig: &config.Shuttle{
+		Pinning: config.Pinning{
+			RetryBackoff:    time.Minute,
+			MaxRetryBackoff: 10 * time.Minute,
+		},
+	}}
+
+	assert.Equal(t, time.Minute, s.retryBackoff(1))
+	assert.Equal(t, 2*time.Minute, s.retryBackoff(2))
+	assert.Equal(t, 8*time.Minute, s.retryBackoff(4))
+	assert.Equal(t, 10*time.Minute, s.retryBackoff(5))
+	assert.Equal(t, 10*time.Minute, s.retryBackoff(50))
+}
+
+func TestPinAttemptErrorsRoundTrip(t *testing.T) {
+	in := pinAttemptErrors{
+		{Time: time.Unix(1000, 0).UTC(), Error: "failed to walk DAG"},
+		{Time: time.Unix(2000, 0).UTC(), Error: "context deadline exceeded"},
+	}
+
+	v, err := in.Value()
+	assert.NoError(t, err)
+
+	var out pinAttemptErrors
+	assert.NoError(t, out.Scan(v))
+	assert.Equal(t, in, out)
+
+	var empty pinAttemptErrors
+	assert.NoError(t, empty.Scan(""))
+	assert.Nil(t, empty)
+}
+
+func TestRecordPinFailureReason(t *testing.T) {
+	s := newTestShuttle(t)
+	s.shuttleConfig.Pinning.MaxAttempts = 2
+	require.NoError(t, s.DB.Create(&Pin{Content: 1, Pinning: true}).Error)
+
+	assert.Equal(t, types.PinFailureUnknown, s.pinFailureReason(1), "pins that did not fail yet have no reason")
+
+	op := &pinner.PinningOperation{ContId: 1}
+	require.NoError(t, s.recordPinFailure(op, errors.Wrap(context.DeadlineExceeded, "failed to fetch")))
+	assert.Equal(t, types.PinFailureNoProviders, s.pinFailureReason(1))
+
+	op.SetProgress(3, 300)
+	require.NoError(t, s.recordPinFailure(op, errors.Wrap(context.DeadlineExceeded, "failed to fetch")))
+	assert.Equal(t, types.PinFailureTimeout, s.pinFailureReason(1))
+
+	var pin Pin
+	require.NoError(t, s.DB.First(&pin, "content = ?", 1).Error)
+	require.Len(t, pin.AttemptErrors, 2)
+	assert.Equal(t, types.PinFailureNoProviders, pin.AttemptErrors[0].Reason)
+	assert.Equal(t, types.PinFailureTimeout, pin.AttemptErrors[1].Reason)
+	assert.Nil(t, pin.RetryAt, "pins out of attempts are not retried")
+}
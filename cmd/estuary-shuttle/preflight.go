@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/pinner/types"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"golang.org/x/xerrors"
+)
+
+var errPinRejected = errors.New("pin rejected by preflight check")
+
+// preflightTimeout bounds how long the preflight check waits for a root block
+const preflightTimeout = time.Minute
+
+// estimateDagSize returns the size of the dag under nd as recorded in nd
+// itself. Only dag-pb nodes carry the sizes of their children, for other
+// codecs the size is not known without walking the dag.
+func estimateDagSize(nd ipld.Node) (uint64, bool) {
+	switch nd := nd.(type) {
+	case *merkledag.RawNode:
+		return uint64(len(nd.RawData())), true
+	case *merkledag.ProtoNode:
+		size, err := nd.Size()
+		if err != nil {
+			return 0, false
+		}
+		return size, true
+	default:
+		return 0, false
+	}
+}
+
+// preflightPin fetches the root of the pin and records the size it holds,
+// which the completion estimate of the pin is based on. With the preflight
+// check enabled the size is checked against the per-pin limit and the free
+// space of the blockstore.
+func (s *Shuttle) preflightPin(ctx context.Context, op *pinner.PinningOperation, dserv ipld.NodeGetter) error {
+	cfg := s.shuttleConfig.Pinning
+	if op.MaxDepth > 0 {
+		// the size recorded in the root is that of the whole dag
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	nd, err := dserv.Get(ctx, op.Obj)
+	if err != nil {
+		// the pin itself fails properly if the root cant be found
+		log.Warnf("could not get root %s of content %d: %s", op.Obj, op.ContId, err)
+		return nil
+	}
+
+	size, ok := estimateDagSize(nd)
+	if !ok {
+		return nil
+	}
+
+	op.SetExpectedSize(int64(size))
+	if !cfg.Preflight {
+		return nil
+	}
+
+	var reason string
+	var failure types.PinFailureReason
+	if cfg.MaxPinSize > 0 && size > uint64(cfg.MaxPinSize) {
+		reason = fmt.Sprintf("estimated size %d exceeds the limit of %d bytes per pin", size, cfg.MaxPinSize)
+		failure = types.PinFailureTooLarge
+	} else {
+		disks := s.blockstoreDisks()
+		if _, free := blockstoreUsage(disks); len(disks) > 0 && size > free {
+			reason = fmt.Sprintf("estimated size %d exceeds the %d bytes free in the blockstore", size, free)
+			failure = types.PinFailureBlockstoreFull
+		}
+	}
+
+	if reason == "" {
+		return nil
+	}
+
+	s.metrics.pinsFlagged.Inc()
+	if !cfg.PreflightReject {
+		log.Warnw("pin flagged by preflight check", "content", op.ContId, "cid", op.Obj, "reason", reason)
+		return nil
+	}
+	return pinner.WithFailureReason(failure, xerrors.Errorf("%w: %s", errPinRejected, reason))
+}
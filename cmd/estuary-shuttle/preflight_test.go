@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateDagSize(t *testing.T) {
+	raw := merkledag.NewRawNode(make([]byte, 1000))
+	size, ok := estimateDagSize(raw)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1000), size)
+
+	child := merkledag.NewRawNode(make([]byte, 5000))
+	root := &merkledag.ProtoNode{}
+	require.NoError(t, root.AddNodeLink("child", child))
+
+	size, ok = estimateDagSize(root)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(len(root.RawData())+5000), size)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// primarySet holds the primary hosts the shuttle can connect to, for
+// deployments running more than one primary. The host that last accepted a
+// connection is used until it stops doing so.
+type primarySet struct {
+	lk      sync.Mutex
+	hosts   []string
+	current int
+}
+
+// newPrimarySet parses a comma separated list of primary hosts
+func newPrimarySet(hosts string) *primarySet {
+	ps := &primarySet{}
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			ps.hosts = append(ps.hosts, h)
+		}
+	}
+	return ps
+}
+
+// host returns the primary to talk to
+func (ps *primarySet) host() string {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	if len(ps.hosts) == 0 {
+		return ""
+	}
+	return ps.hosts[ps.current]
+}
+
+// next moves on to the next primary after failing to reach the current one.
+// It returns true when it wrapped around to the first host, meaning every
+// host was tried once.
+func (ps *primarySet) next() bool {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	if len(ps.hosts) == 0 {
+		return true
+	}
+	ps.current = (ps.current + 1) % len(ps.hosts)
+	return ps.current == 0
+}
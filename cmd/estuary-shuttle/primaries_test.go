@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrimarySet(t *testing.T) {
+	ps := newPrimarySet(" api.estuary.tech, backup.estuary.tech ,,")
+	assert.Equal(t, []string{"api.estuary.tech", "backup.estuary.tech"}, ps.hosts)
+	assert.Equal(t, "api.estuary.tech", ps.host())
+
+	assert.False(t, ps.next())
+	assert.Equal(t, "backup.estuary.tech", ps.host())
+
+	// the host that worked last is kept until it fails
+	assert.Equal(t, "backup.estuary.tech", ps.host())
+
+	assert.True(t, ps.next(), "should report having tried every host")
+	assert.Equal(t, "api.estuary.tech", ps.host())
+
+	single := newPrimarySet("localhost:3004")
+	assert.True(t, single.next())
+	assert.Equal(t, "localhost:3004", single.host())
+}
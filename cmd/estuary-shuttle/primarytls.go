@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+)
+
+// newPrimaryTLSConfig presents the configured client certificate to the
+// primary, nil if none is configured
+func newPrimaryTLSConfig(cfg config.ClientTLS) (*tls.Config, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	cr, err := util.NewCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tls.Config{
+		GetClientCertificate: cr.GetClientCertificate,
+		MinVersion:           tls.VersionTLS12,
+	}
+	if cfg.CAFile != "" {
+		pool, err := util.LoadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	return tc, nil
+}
+
+func newPrimaryClient(tc *tls.Config) *http.Client {
+	if tc == nil {
+		return http.DefaultClient
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tc
+	return &http.Client{Transport: tr}
+}
+
+// signPrimaryRequest signs a request with body that the shuttle makes to the
+// primary for a user, so the primary knows which shuttle made it
+func (s *Shuttle) signPrimaryRequest(req *http.Request, body []byte) {
+	util.SignShuttleRequest(req, s.shuttleHandle, s.shuttleToken, body, time.Now())
+}
+
+// primaryClient is the client for requests to the primary, it presents the
+// shuttle's client certificate if it has one
+func (s *Shuttle) primaryClient() *http.Client {
+	if s.primaryHTTP == nil {
+		return http.DefaultClient
+	}
+	return s.primaryHTTP
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/labstack/echo/v4"
+)
+
+// tokenBucket refills at rate tokens per second up to burst. Upload bytes
+// are charged as they are read, which can take the bucket below zero; the
+// user then has to wait for it to refill before the next upload is accepted.
+type tokenBucket struct {
+	lk     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take removes n tokens from the bucket if it holds at least n, otherwise it
+// returns how long until it will
+func (b *tokenBucket) take(n float64) time.Duration {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < n {
+		return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	}
+	b.tokens -= n
+	return 0
+}
+
+// charge removes n tokens regardless of how many are left
+func (b *tokenBucket) charge(n float64) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= n
+}
+
+type userLimits struct {
+	requests *tokenBucket
+	upload   *tokenBucket
+}
+
+// userLimiter hands out the rate limit buckets of each user. Users that
+// haven't made requests in a while fall out of the cache and start over
+// with full buckets.
+type userLimiter struct {
+	lk    sync.Mutex
+	users *lru.Cache
+
+	requestRate  float64
+	requestBurst float64
+	uploadRate   float64
+	uploadBurst  float64
+}
+
+func newUserLimiter(requestRate float64, requestBurst int, uploadRate, uploadBurst int64) (*userLimiter, error) {
+	users, err := lru.New(10000)
+	if err != nil {
+		return nil, err
+	}
+
+	return &userLimiter{
+		users:        users,
+		requestRate:  requestRate,
+		requestBurst: float64(requestBurst),
+		uploadRate:   float64(uploadRate),
+		uploadBurst:  float64(uploadBurst),
+	}, nil
+}
+
+func (ul *userLimiter) limitsFor(uid uint) *userLimits {
+	ul.lk.Lock()
+	defer ul.lk.Unlock()
+
+	if val, ok := ul.users.Get(uid); ok {
+		return val.(*userLimits)
+	}
+
+	lim := &userLimits{}
+	if ul.requestRate > 0 {
+		lim.requests = newTokenBucket(ul.requestRate, math.Max(ul.requestBurst, 1))
+	}
+	if ul.uploadRate > 0 {
+		lim.upload = newTokenBucket(ul.uploadRate, ul.uploadBurst)
+	}
+	ul.users.Add(uid, lim)
+	return lim
+}
+
+func rateLimitedError(c echo.Context, wait time.Duration, what string) error {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(secs))
+
+	return &util.HttpError{
+		Code:    http.StatusTooManyRequests,
+		Reason:  util.ERR_RATE_LIMITED,
+		Details: fmt.Sprintf("%s rate limit exceeded, retry in %ds", what, secs),
+	}
+}
+
+// checkRequestRate is called by AuthRequired once the user is known.
+// Admins are not limited.
+func (s *Shuttle) checkRequestRate(c echo.Context, u *User) error {
+	if s.limiter == nil || u.Perms >= util.PermLevelAdmin {
+		return nil
+	}
+
+	lim := s.limiter.limitsFor(u.ID)
+	if lim.requests == nil {
+		return nil
+	}
+
+	if wait := lim.requests.take(1); wait > 0 {
+		return rateLimitedError(c, wait, "request")
+	}
+	return nil
+}
+
+type limitedReadCloser struct {
+	io.ReadCloser
+	bucket *tokenBucket
+}
+
+func (lrc *limitedReadCloser) Read(p []byte) (int, error) {
+	n, err := lrc.ReadCloser.Read(p)
+	lrc.bucket.charge(float64(n))
+	return n, err
+}
+
+// uploadRateLimitMiddleware refuses uploads from users that have used up
+// their upload bytes, and charges the request body to them as it is read.
+// It has to run after AuthRequired.
+func (s *Shuttle) uploadRateLimitMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u, ok := c.Get("user").(*User)
+		if !ok || s.limiter == nil || u.Perms >= util.PermLevelAdmin {
+			return next(c)
+		}
+
+		lim := s.limiter.limitsFor(u.ID)
+		r := c.Request()
+		if lim.upload == nil || r.Body == nil || r.Body == http.NoBody {
+			return next(c)
+		}
+
+		if wait := lim.upload.take(0); wait > 0 {
+			return rateLimitedError(c, wait, "upload")
+		}
+
+		r.Body = &limitedReadCloser{ReadCloser: r.Body, bucket: lim.upload}
+		return next(c)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 2)
+
+	assert.Zero(t, b.take(1))
+	assert.Zero(t, b.take(1))
+	assert.Greater(t, int64(b.take(1)), int64(0), "empty bucket should make the caller wait")
+
+	// uploads can overdraw the bucket, after which nothing is accepted until
+	// it has refilled
+	b.charge(10)
+	wait := b.take(0)
+	assert.Greater(t, wait, 900*time.Millisecond)
+	assert.LessOrEqual(t, wait, time.Second)
+}
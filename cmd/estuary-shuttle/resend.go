@@ -0,0 +1,241 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// maxUnackedMessages bounds the resend queue, when it is full the oldest
+// messages are dropped
+const maxUnackedMessages = 100000
+
+var outboxPrefix = datastore.NewKey("/rpc/outbox")
+
+// needsAck reports whether messages with the given op are kept until the
+// primary acknowledges them. Periodic updates are superseded by the next
+// one anyway and are not worth resending.
+func needsAck(op string) bool {
+	switch op {
+	case drpc.OP_UpdatePinStatus, drpc.OP_PinComplete, drpc.OP_PinCompleteBegin,
+		drpc.OP_PinCompletePart, drpc.OP_PinCompleteCommit, drpc.OP_CommPComplete,
+		drpc.OP_TransferStarted, drpc.OP_TransferStatus, drpc.OP_SplitComplete,
+		drpc.OP_PinAbandoned, drpc.OP_ContentExpired, drpc.OP_AggregateStaged,
+		drpc.OP_TransferRestarted, drpc.OP_ContentMigrated, drpc.OP_ContentRemoved:
+		return true
+	default:
+		return false
+	}
+}
+
+type queuedMessage struct {
+	id uint64
+	op string
+
+	// msg is only kept in memory when there is no datastore to keep it in
+	msg *drpc.Message
+}
+
+// resendQueue holds messages until the primary acknowledges them, in the
+// order they were queued. Messages are written to the datastore so they
+// survive restarts and dont pile up in memory while the primary is away;
+// only their ids are kept in memory.
+type resendQueue struct {
+	lk    sync.Mutex
+	ds    datastore.Datastore
+	order *list.List
+	msgs  map[uint64]*list.Element
+
+	// notify has a pending value whenever messages were added
+	notify chan struct{}
+}
+
+func newResendQueue(ds datastore.Datastore) *resendQueue {
+	return &resendQueue{
+		ds:     ds,
+		order:  list.New(),
+		msgs:   make(map[uint64]*list.Element),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func outboxKey(id uint64) datastore.Key {
+	// zero padded so keys sort in id order
+	return outboxPrefix.ChildString(fmt.Sprintf("%020d", id))
+}
+
+// load reads the messages left in the datastore by the last run. It
+// returns the highest message id found.
+func (q *resendQueue) load(ctx context.Context) (uint64, error) {
+	if q.ds == nil {
+		return 0, nil
+	}
+
+	res, err := q.ds.Query(ctx, query.Query{Prefix: outboxPrefix.String()})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	var msgs []*drpc.Message
+	for r := range res.Next() {
+		if r.Error != nil {
+			return 0, r.Error
+		}
+
+		var msg drpc.Message
+		if err := json.Unmarshal(r.Value, &msg); err != nil {
+			log.Errorf("dropping undecodable message %s from rpc outbox: %s", r.Key, err)
+			if err := q.ds.Delete(ctx, datastore.NewKey(r.Key)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		msgs = append(msgs, &msg)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].ID < msgs[j].ID
+	})
+
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	var maxID uint64
+	for _, msg := range msgs {
+		q.msgs[msg.ID] = q.order.PushBack(&queuedMessage{id: msg.ID, op: msg.Op})
+		maxID = msg.ID
+	}
+
+	if len(msgs) > 0 {
+		q.signal()
+	}
+	return maxID, nil
+}
+
+func (q *resendQueue) add(ctx context.Context, msg *drpc.Message) error {
+	qm := &queuedMessage{id: msg.ID, op: msg.Op}
+
+	var data []byte
+	if q.ds != nil {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		data = b
+	} else {
+		qm.msg = msg
+	}
+
+	// the message is stored with the lock held, so an ack for it can not
+	// arrive before it is in msgs and be missed
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	if _, ok := q.msgs[msg.ID]; ok {
+		return nil
+	}
+
+	if data != nil {
+		if err := q.ds.Put(ctx, outboxKey(msg.ID), data); err != nil {
+			return err
+		}
+	}
+
+	if q.order.Len() >= maxUnackedMessages {
+		oldest := q.order.Remove(q.order.Front()).(*queuedMessage)
+		delete(q.msgs, oldest.id)
+		q.deleteStored(oldest.id)
+		log.Warnf("resend queue full, dropping unacknowledged %s message %d", oldest.op, oldest.id)
+	}
+
+	q.msgs[msg.ID] = q.order.PushBack(qm)
+	q.signal()
+	return nil
+}
+
+func (q *resendQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *resendQueue) deleteStored(id uint64) {
+	if q.ds == nil {
+		return
+	}
+	if err := q.ds.Delete(context.TODO(), outboxKey(id)); err != nil {
+		log.Errorf("failed to remove message %d from rpc outbox: %s", id, err)
+	}
+}
+
+func (q *resendQueue) ack(ids []uint64) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	for _, id := range ids {
+		if e, ok := q.msgs[id]; ok {
+			q.order.Remove(e)
+			delete(q.msgs, id)
+			q.deleteStored(id)
+		}
+	}
+}
+
+// after returns the ids of queued messages with an id greater than id,
+// oldest first
+func (q *resendQueue) after(id uint64) []uint64 {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	var out []uint64
+	for e := q.order.Front(); e != nil; e = e.Next() {
+		if qm := e.Value.(*queuedMessage); qm.id > id {
+			out = append(out, qm.id)
+		}
+	}
+	return out
+}
+
+// get returns the queued message with the given id, or nil if it has been
+// acknowledged or dropped in the meantime
+func (q *resendQueue) get(ctx context.Context, id uint64) (*drpc.Message, error) {
+	q.lk.Lock()
+	e, ok := q.msgs[id]
+	q.lk.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	if qm := e.Value.(*queuedMessage); qm.msg != nil {
+		return qm.msg, nil
+	}
+
+	data, err := q.ds.Get(ctx, outboxKey(id))
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var msg drpc.Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (q *resendQueue) len() int {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return q.order.Len()
+}
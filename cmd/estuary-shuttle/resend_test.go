@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResendQueue(t *testing.T) {
+	ctx := context.Background()
+	q := newResendQueue(nil)
+	for i := uint64(1); i <= 5; i++ {
+		require.NoError(t, q.add(ctx, &drpc.Message{ID: i, Op: drpc.OP_PinComplete}))
+	}
+	require.NoError(t, q.add(ctx, &drpc.Message{ID: 3, Op: drpc.OP_PinComplete}))
+	assert.Equal(t, 5, q.len(), "re-adding a queued message should not duplicate it")
+
+	q.ack([]uint64{2, 4, 42})
+	assert.Equal(t, []uint64{1, 3, 5}, q.after(0))
+	assert.Equal(t, []uint64{5}, q.after(3))
+
+	msg, err := q.get(ctx, 2)
+	require.NoError(t, err)
+	assert.Nil(t, msg, "acknowledged message should be gone")
+}
+
+func TestResendQueuePersists(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+
+	q := newResendQueue(ds)
+	for i := uint64(10); i <= 12; i++ {
+		require.NoError(t, q.add(ctx, &drpc.Message{
+			ID: i,
+			Op: drpc.OP_UpdatePinStatus,
+			Params: drpc.MsgParams{
+				UpdatePinStatus: &drpc.UpdatePinStatus{DBID: uint(i), Status: "pinned"},
+			},
+		}))
+	}
+	q.ack([]uint64{11})
+
+	// a new queue over the same datastore, as after a restart
+	q = newResendQueue(ds)
+	last, err := q.load(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(12), last)
+	assert.Equal(t, []uint64{10, 12}, q.after(0))
+
+	msg, err := q.get(ctx, 12)
+	require.NoError(t, err)
+	require.NotNil(t, msg.Params.UpdatePinStatus)
+	assert.Equal(t, uint(12), msg.Params.UpdatePinStatus.DBID)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+)
+
+// resumeGetter counts the nodes of a pin that were already in the
+// blockstore, left there by an earlier attempt or another pin. The
+// blockservice only asks the network for blocks it doesnt have, so those
+// are not fetched again.
+type resumeGetter struct {
+	ipld.NodeGetter
+	bs    blockstore.Blockstore
+	local int64
+}
+
+func (rg *resumeGetter) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if has, err := rg.bs.Has(ctx, c); err == nil && has {
+		atomic.AddInt64(&rg.local, 1)
+	}
+	return rg.NodeGetter.Get(ctx, c)
+}
+
+func (rg *resumeGetter) localBlocks() int64 {
+	return atomic.LoadInt64(&rg.local)
+}
+
+// localDagBlocks returns the blocks of the dag under root that are in the
+// blockstore, not descending past missing ones
+func (s *Shuttle) localDagBlocks(ctx context.Context, root cid.Cid) ([]cid.Cid, error) {
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, offline.Exchange(s.Node.Blockstore)))
+
+	var local []cid.Cid
+	if err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+		node, err := dserv.Get(ctx, c)
+		if err != nil {
+			// not fetched (yet)
+			return nil, nil
+		}
+		local = append(local, c)
+
+		if c.Type() == cid.Raw {
+			return nil, nil
+		}
+		return util.FilterUnwalkableLinks(node.Links()), nil
+	}, root, cid.NewSet().Visit); err != nil {
+		return nil, err
+	}
+	return local, nil
+}
+
+// protectPendingPins marks the blocks already fetched for pins that have not
+// completed yet as inflight, so garbage collection keeps them for when the
+// pins are resumed. The returned function releases them again.
+func (s *Shuttle) protectPendingPins(ctx context.Context) (func(), error) {
+	var pending []Pin
+	if err := s.DB.Select("id", "cid").Find(&pending, "active = false and pinning = true").Error; err != nil {
+		return nil, err
+	}
+
+	var protected []cid.Cid
+	release := func() {
+		for _, c := range protected {
+			s.releaseInflight(c)
+		}
+	}
+
+	for _, p := range pending {
+		blks, err := s.localDagBlocks(ctx, p.Cid.CID)
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		s.inflightCidsLk.Lock()
+		for _, c := range blks {
+			s.inflightCids[c]++
+		}
+		s.inflightCidsLk.Unlock()
+		protected = append(protected, blks...)
+	}
+
+	if len(protected) > 0 {
+		log.Infof("keeping %d blocks of %d pending pins", len(protected), len(pending))
+	}
+	return release, nil
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/ipld/go-ipld-prime"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/xerrors"
 )
 
 // NOTE: Copy pasted from the content manager in the top level estuary code
@@ -78,6 +79,12 @@ func (s *Shuttle) runRetrieval(ctx context.Context, contentToFetch uint, deals [
 
 	// we already have this data locally
 	if pin.ID > 0 {
+		if pin.Tier != tierHot {
+			if err := s.rehydrate(ctx, &pin, deals); err != nil {
+				return xerrors.Errorf("failed to bring back tiered content: %w", err)
+			}
+		}
+
 		objects, err := s.objectsForPin(ctx, pin.ID)
 		if err != nil {
 			// weird case... probably should handle better?
@@ -88,6 +95,24 @@ func (s *Shuttle) runRetrieval(ctx context.Context, contentToFetch uint, deals [
 		return nil
 	}
 
+	if err := s.retrieveFromDeals(ctx, contentToFetch, deals, root, sel); err != nil {
+		return err
+	}
+
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
+	if err := s.addDatabaseTrackingToContent(ctx, contentToFetch, dserv, s.Node.Blockstore, root, func(int64) {}); err != nil {
+		log.Errorw("failed adding content to database after successful retrieval", "cont", contentToFetch, "err", err.Error())
+		return err
+	}
+	return nil
+}
+
+// retrieveFromDeals retrieves root into the main blockstore from the first
+// of the deals that works
+func (s *Shuttle) retrieveFromDeals(ctx context.Context, contentToFetch uint, deals []drpc.StorageDeal, root cid.Cid, sel ipld.Node) error {
+	ctx, span := s.Tracer.Start(ctx, "retrieveFromDeals")
+	defer span.End()
+
 	for _, deal := range deals {
 		log.Infow("attempting retrieval deal", "content", contentToFetch, "miner", deal.Miner, "selector", sel != nil)
 
@@ -120,12 +145,6 @@ func (s *Shuttle) runRetrieval(ctx context.Context, contentToFetch uint, deals [
 			continue
 		}
 
-		dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, nil))
-		if err := s.addDatabaseTrackingToContent(ctx, contentToFetch, dserv, s.Node.Blockstore, root, func(int64) {}); err != nil {
-			log.Errorw("failed adding content to database after successful retrieval", "cont", contentToFetch, "err", err.Error())
-			return err
-		}
-
 		// success
 		return nil
 	}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/application-research/estuary/drpc"
 	"github.com/application-research/estuary/pinner"
@@ -16,15 +19,14 @@ import (
 	"github.com/ipfs/go-cid"
 	cbor "github.com/ipfs/go-ipld-cbor"
 	"github.com/ipfs/go-merkledag"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/xerrors"
 	"gorm.io/gorm"
 )
 
-func (d *Shuttle) handleRpcCmd(cmd *drpc.Command) error {
-	ctx := context.TODO()
-
+func (d *Shuttle) handleRpcCmd(ctx context.Context, cmd *drpc.Command) error {
 	// If the command contains a trace continue it here.
 	if cmd.HasTraceCarrier() {
 		if sc := cmd.TraceCarrier.AsSpanContext(); sc.IsValid() {
@@ -33,9 +35,34 @@ func (d *Shuttle) handleRpcCmd(cmd *drpc.Command) error {
 	}
 
 	log.Debugf("handling rpc command: %s", cmd.Op)
+
+	if d.isShuttingDown() {
+		switch cmd.Op {
+		case drpc.CMD_AddPin, drpc.CMD_AddPins, drpc.CMD_TakeContent, drpc.CMD_AggregateContent, drpc.CMD_StartTransfer,
+			drpc.CMD_SplitContent, drpc.CMD_RetrieveContent, drpc.CMD_ComputeCommP:
+			return fmt.Errorf("refusing %s command, shuttle is shutting down", cmd.Op)
+		}
+	}
+
+	if d.addingPaused() {
+		switch cmd.Op {
+		case drpc.CMD_AddPin, drpc.CMD_AddPins, drpc.CMD_TakeContent:
+			return fmt.Errorf("refusing %s command, blockstore disks are past their high watermark", cmd.Op)
+		}
+	}
+
+	if d.isDraining() {
+		switch cmd.Op {
+		case drpc.CMD_AddPin, drpc.CMD_AddPins, drpc.CMD_TakeContent, drpc.CMD_AggregateContent, drpc.CMD_SplitContent:
+			return fmt.Errorf("refusing %s command, shuttle is draining", cmd.Op)
+		}
+	}
+
 	switch cmd.Op {
 	case drpc.CMD_AddPin:
 		return d.handleRpcAddPin(ctx, cmd.Params.AddPin)
+	case drpc.CMD_AddPins:
+		return d.handleRpcAddPins(ctx, cmd.Params.AddPins)
 	case drpc.CMD_ComputeCommP:
 		return d.handleRpcComputeCommP(ctx, cmd.Params.ComputeCommP)
 	case drpc.CMD_TakeContent:
@@ -58,6 +85,26 @@ func (d *Shuttle) handleRpcCmd(cmd *drpc.Command) error {
 		return d.handleRpcSplitContent(ctx, cmd.Params.SplitContent)
 	case drpc.CMD_RestartTransfer:
 		return d.handleRpcRestartTransfer(ctx, cmd.Params.RestartTransfer)
+	case drpc.CMD_InvalidateAuth:
+		return d.handleRpcInvalidateAuth(ctx, cmd.Params.InvalidateAuth)
+	case drpc.CMD_SetPinWorkers:
+		return d.handleRpcSetPinWorkers(ctx, cmd.Params.SetPinWorkers)
+	case drpc.CMD_CancelPin:
+		return d.handleRpcCancelPin(ctx, cmd.Params.CancelPin)
+	case drpc.CMD_SetPeers:
+		return d.handleRpcSetPeers(ctx, cmd.Params.SetPeers)
+	case drpc.CMD_AddMarketFunds:
+		return d.handleRpcAddMarketFunds(ctx, cmd.Params.MarketFunds)
+	case drpc.CMD_WithdrawMarketFunds:
+		return d.handleRpcWithdrawMarketFunds(ctx, cmd.Params.MarketFunds)
+	case drpc.CMD_TierContent:
+		return d.handleRpcTierContent(ctx, cmd.Params.TierContent)
+	case drpc.CMD_SetDraining:
+		return d.handleRpcSetDraining(ctx, cmd.Params.SetDraining)
+	case drpc.CMD_SetAuthKey:
+		return d.handleRpcSetAuthKey(ctx, cmd.Params.SetAuthKey)
+	case drpc.CMD_SetWebhooks:
+		return d.handleRpcSetWebhooks(ctx, cmd.Params.SetWebhooks)
 	default:
 		return fmt.Errorf("unrecognized command op: %q", cmd.Op)
 	}
@@ -68,6 +115,17 @@ func (d *Shuttle) sendRpcMessage(ctx context.Context, msg *drpc.Message) error {
 	// a noopspan context will be carried and ignored by the receiver.
 	msg.TraceCarrier = drpc.NewTraceCarrier(trace.SpanFromContext(ctx).SpanContext())
 	log.Debugf("sending rpc message: %s", msg.Op)
+
+	// messages that have to arrive go through the resend queue, which keeps
+	// them on disk until the primary acknowledges them
+	if needsAck(msg.Op) {
+		msg.ID = atomic.AddUint64(&d.nextMsgID, 1)
+		return d.resend.add(ctx, msg)
+	}
+
+	atomic.AddInt64(&d.pendingMessages, 1)
+	defer atomic.AddInt64(&d.pendingMessages, -1)
+
 	select {
 	case d.outgoing <- msg:
 		return nil
@@ -79,18 +137,42 @@ func (d *Shuttle) sendRpcMessage(ctx context.Context, msg *drpc.Message) error {
 func (d *Shuttle) handleRpcAddPin(ctx context.Context, apo *drpc.AddPin) error {
 	d.addPinLk.Lock()
 	defer d.addPinLk.Unlock()
-	return d.addPin(ctx, apo.DBID, apo.Cid, apo.UserId, false)
+	return d.addPin(ctx, apo.DBID, apo.Cid, apo.UserId, apo.Peers, false, pinner.PinPriority(apo.Priority), apo.MaxDepth)
+}
+
+func (d *Shuttle) handleRpcAddPins(ctx context.Context, req *drpc.AddPins) error {
+	d.addPinLk.Lock()
+	defer d.addPinLk.Unlock()
+
+	for _, apo := range req.Pins {
+		peers := append([]*peer.AddrInfo{}, apo.Peers...)
+		peers = append(peers, req.Peers...)
+		if err := d.addPin(ctx, apo.DBID, apo.Cid, apo.UserId, peers, false, pinner.PinPriority(apo.Priority), apo.MaxDepth); err != nil {
+			return xerrors.Errorf("failed to add pin for content %d: %w", apo.DBID, err)
+		}
+	}
+	return nil
 }
 
-func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user uint, skipLimiter bool) error {
+func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user uint, peers []*peer.AddrInfo, skipLimiter bool, prio pinner.PinPriority, maxDepth int) error {
 	ctx, span := d.Tracer.Start(ctx, "addPin", trace.WithAttributes(
 		attribute.Int64("contID", int64(contid)),
 		attribute.Int64("userID", int64(user)),
 		attribute.String("data", data.String()),
 		attribute.Bool("skipLimiter", skipLimiter),
+		attribute.Int("maxDepth", maxDepth),
 	))
 	defer span.End()
 
+	var origins string
+	if len(peers) > 0 {
+		b, err := json.Marshal(peers)
+		if err != nil {
+			return err
+		}
+		origins = string(b)
+	}
+
 	var search []Pin
 	if err := d.DB.Find(&search, "content = ?", contid).Error; err != nil {
 		return err
@@ -114,6 +196,7 @@ func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user ui
 					UpdatePinStatus: &drpc.UpdatePinStatus{
 						DBID:   contid,
 						Status: types.PinningStatusFailed,
+						Reason: existing.FailureReason,
 					},
 				},
 			}); err != nil {
@@ -127,7 +210,7 @@ func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user ui
 			// This implies that the pin complete message got lost, need to resend all the objects
 
 			go func() {
-				if err := d.resendPinComplete(ctx, existing); err != nil {
+				if err := d.resendPinComplete(detachedContext(ctx), existing); err != nil {
 					log.Error(err)
 				}
 			}()
@@ -135,18 +218,31 @@ func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user ui
 		}
 
 		if !existing.Active && !existing.Pinning {
-			if err := d.DB.Model(Pin{}).Where("id = ?", existing.ID).UpdateColumn("pinning", true).Error; err != nil {
+			if err := d.DB.Model(Pin{}).Where("id = ?", existing.ID).UpdateColumns(map[string]interface{}{
+				"pinning":      true,
+				"cancelled":    false,
+				"priority":     int(prio),
+				"skip_limiter": skipLimiter,
+				"origins":      origins,
+				"queued_at":    time.Now(),
+				"max_depth":    maxDepth,
+			}).Error; err != nil {
 				return xerrors.Errorf("failed to update pin pinning state to true: %s", err)
 			}
 		}
 	} else {
 		// good, no pin found with this content id, lets create it
 		pin := &Pin{
-			Content: contid,
-			Cid:     util.DbCID{CID: data},
-			UserID:  user,
-			Active:  false,
-			Pinning: true,
+			Content:     contid,
+			Cid:         util.DbCID{CID: data},
+			UserID:      user,
+			Active:      false,
+			Pinning:     true,
+			Priority:    int(prio),
+			SkipLimiter: skipLimiter,
+			Origins:     origins,
+			QueuedAt:    time.Now(),
+			MaxDepth:    maxDepth,
 		}
 
 		if err := d.DB.Create(pin).Error; err != nil {
@@ -158,8 +254,11 @@ func (d *Shuttle) addPin(ctx context.Context, contid uint, data cid.Cid, user ui
 		Obj:         data,
 		ContId:      contid,
 		UserId:      user,
+		Peers:       peers,
 		Status:      types.PinningStatusQueued,
 		SkipLimiter: skipLimiter,
+		Priority:    prio,
+		MaxDepth:    maxDepth,
 	}
 
 	d.PinMgr.Add(op)
@@ -203,9 +302,15 @@ func (d *Shuttle) handleRpcComputeCommP(ctx context.Context, cmd *drpc.ComputeCo
 	))
 	defer span.End()
 
-	res, err := d.commpMemo.Do(ctx, cmd.Data.String(), nil)
+	return d.computeCommP(ctx, cmd.Data)
+}
+
+// computeCommP gets the piece commitment of data, computing it unless it is
+// already known, and sends it to the primary
+func (d *Shuttle) computeCommP(ctx context.Context, data cid.Cid) error {
+	res, err := d.commpMemo.Do(ctx, data.String(), nil)
 	if err != nil {
-		return xerrors.Errorf("failed to compute commP for %s: %w", cmd.Data, err)
+		return xerrors.Errorf("failed to compute commP for %s: %w", data, err)
 	}
 
 	commpRes, ok := res.(*commpResult)
@@ -217,7 +322,7 @@ func (d *Shuttle) handleRpcComputeCommP(ctx context.Context, cmd *drpc.ComputeCo
 		Op: drpc.OP_CommPComplete,
 		Params: drpc.MsgParams{
 			CommPComplete: &drpc.CommPComplete{
-				Data:    cmd.Data,
+				Data:    data,
 				CommP:   commpRes.CommP,
 				CarSize: commpRes.CarSize,
 				Size:    commpRes.Size,
@@ -251,7 +356,11 @@ func (d *Shuttle) sendPinCompleteMessage(ctx context.Context, cont uint, size in
 		})
 	}
 
-	if err := d.sendRpcMessage(ctx, &drpc.Message{
+	if len(objs) > drpc.PinCompletePartSize {
+		if err := d.sendPinCompleteParts(ctx, cont, size, objs); err != nil {
+			log.Errorf("failed to send pin complete parts for content %d: %s", cont, err)
+		}
+	} else if err := d.sendRpcMessage(ctx, &drpc.Message{
 		Op: drpc.OP_PinComplete,
 		Params: drpc.MsgParams{
 			PinComplete: &drpc.PinComplete{
@@ -263,6 +372,59 @@ func (d *Shuttle) sendPinCompleteMessage(ctx context.Context, cont uint, size in
 	}); err != nil {
 		log.Errorf("failed to send pin complete message for content %d: %s", cont, err)
 	}
+
+	d.reportMigrated(ctx, cont)
+}
+
+// sendPinCompleteParts reports a pin with too many objects for one message
+// as a PinCompleteBegin, its objects in PinCompleteParts and a
+// PinCompleteCommit
+func (d *Shuttle) sendPinCompleteParts(ctx context.Context, cont uint, size int64, objs []drpc.PinObj) error {
+	if len(objs) > drpc.MaxPinCompleteObjects {
+		return fmt.Errorf("pin has %d objects, more than the %d the primary accepts", len(objs), drpc.MaxPinCompleteObjects)
+	}
+
+	parts := (len(objs) + drpc.PinCompletePartSize - 1) / drpc.PinCompletePartSize
+
+	if err := d.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_PinCompleteBegin,
+		Params: drpc.MsgParams{
+			PinCompleteBegin: &drpc.PinCompleteBegin{
+				DBID:  cont,
+				Size:  size,
+				Parts: parts,
+			},
+		},
+	}); err != nil {
+		return err
+	}
+
+	for i := 0; i < parts; i++ {
+		end := (i + 1) * drpc.PinCompletePartSize
+		if end > len(objs) {
+			end = len(objs)
+		}
+
+		if err := d.sendRpcMessage(ctx, &drpc.Message{
+			Op: drpc.OP_PinCompletePart,
+			Params: drpc.MsgParams{
+				PinCompletePart: &drpc.PinCompletePart{
+					DBID:    cont,
+					Part:    i,
+					Objects: objs[i*drpc.PinCompletePartSize : end],
+				},
+			},
+		}); err != nil {
+			return xerrors.Errorf("failed to send part %d: %w", i, err)
+		}
+	}
+
+	return d.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_PinCompleteCommit,
+		Params: drpc.MsgParams{
+			PinCompleteCommit: &drpc.PinCompleteCommit{DBID: cont},
+		},
+	})
 }
 
 func (d *Shuttle) handleRpcTakeContent(ctx context.Context, cmd *drpc.TakeContent) error {
@@ -285,7 +447,7 @@ func (d *Shuttle) handleRpcTakeContent(ctx context.Context, cmd *drpc.TakeConten
 			continue
 		}
 
-		if err := d.addPin(ctx, c.ID, c.Cid, c.UserID, true); err != nil {
+		if err := d.takeContent(ctx, c, cmd.Sources); err != nil {
 			return err
 		}
 	}
@@ -374,7 +536,11 @@ func (d *Shuttle) handleRpcAggregateContent(ctx context.Context, cmd *drpc.Aggre
 		return err
 	}
 
-	go d.sendPinCompleteMessage(ctx, cmd.DBID, totalSize, nil)
+	if err := d.confirmStagedAggregate(cmd); err != nil {
+		return err
+	}
+
+	go d.sendPinCompleteMessage(detachedContext(ctx), cmd.DBID, totalSize, nil)
 	return nil
 }
 
@@ -383,7 +549,8 @@ func (s *Shuttle) trackTransfer(chanid *datatransfer.ChannelID, dealdbid uint) {
 	defer s.tcLk.Unlock()
 
 	s.trackingChannels[chanid.String()] = &chanTrack{
-		dbid: dealdbid,
+		dbid:       dealdbid,
+		progressAt: time.Now(),
 	}
 }
 
@@ -396,6 +563,18 @@ func (s *Shuttle) handleRpcPrepareForDataRequest(ctx context.Context, cmd *drpc.
 	))
 	defer span.End()
 
+	// the provider pulls the data, it has to be here by then
+	if err := s.ensureHotCid(ctx, cmd.PayloadCid); err != nil {
+		return fmt.Errorf("preparing for data request: %w", err)
+	}
+
+	if s.webhooks != nil {
+		var pin Pin
+		if err := s.DB.First(&pin, "cid = ?", util.DbCID{CID: cmd.PayloadCid}).Error; err == nil {
+			s.webhooks.trackDeal(cmd.DealDBID, pin.Content)
+		}
+	}
+
 	// Tell server to prepare to receive a new pull transfer
 	err := s.Filc.Libp2pTransferMgr.PrepareForDataRequest(ctx, cmd.DealDBID, cmd.AuthToken, cmd.ProposalCid, cmd.PayloadCid, cmd.Size)
 	if err != nil {
@@ -428,7 +607,17 @@ func (d *Shuttle) handleRpcStartTransfer(ctx context.Context, cmd *drpc.StartTra
 	))
 	defer span.End()
 
-	go func() {
+	if err := d.ensureHot(ctx, cmd.ContentID); err != nil {
+		return xerrors.Errorf("failed to bring back tiered content for transfer: %w", err)
+	}
+
+	if d.webhooks != nil {
+		d.webhooks.trackDeal(cmd.DealDBID, cmd.ContentID)
+	}
+
+	// the transfer outlives the command
+	ctx = detachedContext(ctx)
+	d.transfers.add(cmd.Miner, func() {
 		chanid, err := d.Filc.StartDataTransfer(ctx, cmd.Miner, cmd.PropCid, cmd.DataCid)
 		if err != nil {
 			errMsg := fmt.Sprintf("failed to start data transfer: %s", err)
@@ -454,7 +643,7 @@ func (d *Shuttle) handleRpcStartTransfer(ctx context.Context, cmd *drpc.StartTra
 		}); err != nil {
 			log.Errorf("failed to notify estuary primary node about transfer start: %s", err)
 		}
-	}()
+	})
 	return nil
 }
 
@@ -467,6 +656,7 @@ func (d *Shuttle) sendTransferStatusUpdate(ctx context.Context, st *drpc.Transfe
 		extra = fmt.Sprintf("%d %s", st.State.Status, st.State.Message)
 	}
 	log.Debugf("sending transfer status update: %d %s", st.DealDBID, extra)
+	d.notifyTransferWebhooks(st)
 	if err := d.sendRpcMessage(ctx, &drpc.Message{
 		Op: drpc.OP_TransferStatus,
 		Params: drpc.MsgParams{
@@ -506,15 +696,18 @@ func (s *Shuttle) handleRpcReqTxStatus(ctx context.Context, req *drpc.ReqTxStatu
 }
 
 func (s *Shuttle) handleRpcRetrieveContent(ctx context.Context, req *drpc.RetrieveContent) error {
-	go func() {
-		if err := s.retrieveContent(ctx, req.Content, req.Cid, req.Deals); err != nil {
-			log.Errorf("failed to retrieve content: %s", err)
-		}
-	}()
+	// retrievals run within the command so they are bounded by its timeout
+	// and stop when the content is unpinned
+	if err := s.retrieveContent(ctx, req.Content, req.Cid, req.Deals); err != nil {
+		return xerrors.Errorf("failed to retrieve content: %w", err)
+	}
 	return nil
 }
 
 func (s *Shuttle) handleRpcUnpinContent(ctx context.Context, req *drpc.UnpinContent) error {
+	// stop anything still working on these contents before removing them
+	s.cancelContentCommands(req.Contents, errCommandRevoked)
+
 	for _, c := range req.Contents {
 		if err := s.Unpin(ctx, c); err != nil {
 			return err
@@ -653,3 +846,32 @@ func (s *Shuttle) handleRpcRestartTransfer(ctx context.Context, req *drpc.Restar
 	}
 	return s.Filc.RestartTransfer(ctx, &req.ChanID)
 }
+
+func (s *Shuttle) handleRpcInvalidateAuth(ctx context.Context, req *drpc.InvalidateAuth) error {
+	s.invalidateAuth(req.TokenHashes, req.UserID)
+	return nil
+}
+
+func (s *Shuttle) handleRpcSetPinWorkers(ctx context.Context, req *drpc.SetPinWorkers) error {
+	return s.setPinWorkers(req.Workers)
+}
+
+func (s *Shuttle) handleRpcCancelPin(ctx context.Context, req *drpc.CancelPin) error {
+	return s.cancelPin(req.DBID)
+}
+
+// handleRpcSetPeers keeps the shuttle peered with the primary and its
+// sibling shuttles, peers from the config stay as they are
+func (s *Shuttle) handleRpcSetPeers(ctx context.Context, req *drpc.SetPeers) error {
+	var peers []peer.AddrInfo
+	for _, pi := range req.Peers {
+		if pi.ID == "" || pi.ID == s.Node.Host.ID() {
+			continue
+		}
+		peers = append(peers, pi)
+	}
+
+	s.Node.Peering.SetTransientPeers(peers)
+	log.Debugf("peering with %d peers from the primary", len(peers))
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errCommandRevoked = errors.New("command was revoked by the primary")
+
+// runningCmd is a command being handled, tracked so that it can be
+// cancelled when the primary revokes it
+type runningCmd struct {
+	op     string
+	cancel context.CancelFunc
+	cause  error
+}
+
+// commandTimeout returns how long a command with the given op may run for
+func (d *Shuttle) commandTimeout(op string) time.Duration {
+	if t, ok := d.shuttleConfig.Rpc.CommandTimeouts[op]; ok {
+		return t
+	}
+	return d.shuttleConfig.Rpc.CommandTimeout
+}
+
+// commandContents returns the contents a command works on
+func commandContents(cmd *drpc.Command) []uint {
+	switch {
+	case cmd.Op == drpc.CMD_AddPin && cmd.Params.AddPin != nil:
+		return []uint{cmd.Params.AddPin.DBID}
+	case cmd.Op == drpc.CMD_AddPins && cmd.Params.AddPins != nil:
+		var out []uint
+		for _, p := range cmd.Params.AddPins.Pins {
+			out = append(out, p.DBID)
+		}
+		return out
+	case cmd.Op == drpc.CMD_TakeContent && cmd.Params.TakeContent != nil:
+		var out []uint
+		for _, c := range cmd.Params.TakeContent.Contents {
+			out = append(out, c.ID)
+		}
+		return out
+	case cmd.Op == drpc.CMD_AggregateContent && cmd.Params.AggregateContent != nil:
+		return []uint{cmd.Params.AggregateContent.DBID}
+	case cmd.Op == drpc.CMD_SplitContent && cmd.Params.SplitContent != nil:
+		return []uint{cmd.Params.SplitContent.Content}
+	case cmd.Op == drpc.CMD_RetrieveContent && cmd.Params.RetrieveContent != nil:
+		return []uint{cmd.Params.RetrieveContent.Content}
+	case cmd.Op == drpc.CMD_TierContent && cmd.Params.TierContent != nil:
+		return []uint{cmd.Params.TierContent.Content}
+	default:
+		return nil
+	}
+}
+
+// runRpcCmd handles cmd in the background with its own timeout. At most
+// MaxConcurrentCommands commands are handled at once, the rest wait for a
+// free slot.
+func (d *Shuttle) runRpcCmd(cmd *drpc.Command) {
+	go func() {
+		d.cmdSem <- struct{}{}
+		defer func() { <-d.cmdSem }()
+
+		ctx := context.Background()
+		var cancel context.CancelFunc
+		if t := d.commandTimeout(cmd.Op); t > 0 {
+			ctx, cancel = context.WithTimeout(ctx, t)
+		} else {
+			ctx, cancel = context.WithCancel(ctx)
+		}
+		defer cancel()
+
+		rc := &runningCmd{op: cmd.Op, cancel: cancel}
+		contents := commandContents(cmd)
+		d.trackCommand(rc, contents)
+		defer d.untrackCommand(rc, contents)
+
+		err := d.handleRpcCmd(ctx, cmd)
+		d.auditCommand(cmd, err)
+		if err == nil {
+			return
+		}
+
+		d.cmdsLk.Lock()
+		cause := rc.cause
+		d.cmdsLk.Unlock()
+		switch {
+		case cause != nil:
+			d.metrics.rpcCommandsCancelled.Inc()
+			log.Infof("stopped handling %s command: %s", cmd.Op, cause)
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			d.metrics.commandFailed()
+			log.Errorf("%s command timed out after %s: %s", cmd.Op, d.commandTimeout(cmd.Op), err)
+		default:
+			d.metrics.commandFailed()
+			log.Errorf("failed to handle rpc command: %s", err)
+		}
+	}()
+}
+
+func (d *Shuttle) trackCommand(rc *runningCmd, contents []uint) {
+	d.cmdsLk.Lock()
+	defer d.cmdsLk.Unlock()
+
+	for _, c := range contents {
+		if d.runningCmds[c] == nil {
+			d.runningCmds[c] = make(map[*runningCmd]struct{})
+		}
+		d.runningCmds[c][rc] = struct{}{}
+	}
+}
+
+func (d *Shuttle) untrackCommand(rc *runningCmd, contents []uint) {
+	d.cmdsLk.Lock()
+	defer d.cmdsLk.Unlock()
+
+	for _, c := range contents {
+		delete(d.runningCmds[c], rc)
+		if len(d.runningCmds[c]) == 0 {
+			delete(d.runningCmds, c)
+		}
+	}
+}
+
+// cancelContentCommands cancels the running commands working on any of the
+// given contents
+func (d *Shuttle) cancelContentCommands(contents []uint, cause error) {
+	d.cmdsLk.Lock()
+	defer d.cmdsLk.Unlock()
+
+	for _, c := range contents {
+		for rc := range d.runningCmds[c] {
+			log.Infow("cancelling rpc command", "op", rc.op, "content", c, "reason", cause)
+			rc.cause = cause
+			rc.cancel()
+		}
+	}
+}
+
+// detachedContext returns a context carrying the span of ctx that is not
+// cancelled with it, for work that outlives the command that started it
+func detachedContext(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
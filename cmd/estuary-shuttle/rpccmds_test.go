@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelContentCommands(t *testing.T) {
+	s := &Shuttle{runningCmds: make(map[uint]map[*runningCmd]struct{})}
+
+	take := &drpc.Command{
+		Op: drpc.CMD_TakeContent,
+		Params: drpc.CmdParams{
+			TakeContent: &drpc.TakeContent{
+				Contents: []drpc.ContentFetch{{ID: 1}, {ID: 2}},
+			},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rc := &runningCmd{op: take.Op, cancel: cancel}
+	s.trackCommand(rc, commandContents(take))
+
+	s.cancelContentCommands([]uint{3}, errCommandRevoked)
+	assert.NoError(t, ctx.Err(), "commands for other contents should keep running")
+
+	s.cancelContentCommands([]uint{2}, errCommandRevoked)
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	assert.Equal(t, errCommandRevoked, rc.cause)
+
+	s.untrackCommand(rc, commandContents(take))
+	assert.Empty(t, s.runningCmds)
+}
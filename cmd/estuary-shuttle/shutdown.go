@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/labstack/echo/v4"
+)
+
+func (s *Shuttle) isShuttingDown() bool {
+	select {
+	case <-s.shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdownMiddleware refuses requests that would start new work once the
+// shuttle is shutting down. Reads are still served until the API is closed.
+func (s *Shuttle) shutdownMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		m := c.Request().Method
+		if s.isShuttingDown() && m != http.MethodGet && m != http.MethodHead && m != http.MethodOptions {
+			return &util.HttpError{
+				Code:    http.StatusServiceUnavailable,
+				Reason:  util.ERR_SHUTTING_DOWN,
+				Details: "shuttle is shutting down, please retry against another shuttle",
+			}
+		}
+		return next(c)
+	}
+}
+
+const (
+	// shutdownGoodbyeTimeout bounds telling the primary we are going away,
+	// it is sent before anything else so no new pins are placed here
+	shutdownGoodbyeTimeout = time.Second * 5
+	// shutdownFlushReserve is kept out of the drain so pending rpc messages
+	// can still be flushed when pins or transfers take all the time given
+	shutdownFlushReserve = time.Second * 10
+)
+
+// Shutdown drains the shuttle before the process exits. New API work and
+// rpc commands are refused and the primary is told we are going away, so it
+// stops placing content here. Running pins, then transfers and API requests
+// get their own share of the time until ctx is done to complete, and pending
+// rpc messages are flushed in the time reserved at the end. Anything left
+// unfinished is picked up again on the next start: queued pins are reloaded
+// from the database, tus uploads keep their data and transfers are
+// restarted by the primary.
+func (s *Shuttle) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		close(s.shuttingDown)
+	})
+	log.Infof("shutting down, draining active work")
+
+	gctx, cancel := context.WithTimeout(ctx, shutdownGoodbyeTimeout)
+	if err := s.sendGoodbye(gctx); err != nil {
+		log.Warnf("failed to say goodbye to the primary: %s", err)
+	}
+	cancel()
+
+	pinCtx, xferCtx := ctx, ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		now := time.Now()
+		reserve := shutdownFlushReserve
+		if total := deadline.Sub(now); reserve > total/4 {
+			reserve = total / 4
+		}
+		workEnd := deadline.Add(-reserve)
+
+		var pinCancel, xferCancel context.CancelFunc
+		pinCtx, pinCancel = context.WithDeadline(ctx, now.Add(workEnd.Sub(now)/2))
+		defer pinCancel()
+		xferCtx, xferCancel = context.WithDeadline(ctx, workEnd)
+		defer xferCancel()
+	}
+
+	if err := s.PinMgr.Drain(pinCtx); err != nil {
+		log.Warnf("not all active pins finished before shutdown: %s", err)
+	}
+
+	if err := s.waitForTransfers(xferCtx); err != nil {
+		log.Warnf("not all transfers finished before shutdown, they will be restarted on reconnect: %s", err)
+	}
+
+	s.apiLk.Lock()
+	e := s.api
+	s.apiLk.Unlock()
+	if e != nil {
+		if err := e.Shutdown(xferCtx); err != nil {
+			log.Warnf("failed to wait for active api requests: %s", err)
+		}
+	}
+
+	if err := s.flushOutgoing(ctx); err != nil {
+		log.Warnf("failed to flush pending rpc messages: %s", err)
+	}
+
+	log.Infof("shutdown complete")
+	return nil
+}
+
+func (s *Shuttle) waitForTransfers(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	for {
+		txs, err := s.Filc.TransfersInProgress(ctx)
+		if err != nil {
+			return err
+		}
+
+		var active int
+		for _, xfer := range txs {
+			if xfer.Status == datatransfer.Ongoing || xfer.Status == datatransfer.Requested {
+				active++
+			}
+		}
+
+		if active == 0 {
+			return nil
+		}
+		log.Infof("waiting for %d active transfers to finish", active)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// flushOutgoing waits until every message handed to sendRpcMessage has been
+// picked up by the rpc connection and, if the primary acknowledges messages,
+// until it has acknowledged them.
+func (s *Shuttle) flushOutgoing(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.pendingMessages) > 0 ||
+		(atomic.LoadInt32(&s.primaryAcks) == 1 && s.resend.len() > 0) {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *Shuttle) sendGoodbye(ctx context.Context) error {
+	if err := s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_Goodbye,
+		Params: drpc.MsgParams{
+			Goodbye: &drpc.Goodbye{
+				Reason: "shutdown",
+			},
+		},
+	}); err != nil {
+		return err
+	}
+
+	select {
+	case <-s.goodbyeSent:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"golang.org/x/sys/unix"
+)
+
+// telemetrySampler keeps the state needed to turn the counters sampled for
+// each update packet into rates
+type telemetrySampler struct {
+	lk       sync.Mutex
+	last     time.Time
+	lastCPU  time.Duration
+	lastSent map[string]uint64
+
+	lastIngested int64
+	lastFree     uint64
+	freeTrend    float64
+}
+
+// freeTrendWeight is the weight of the newest sample in the free space
+// trend, the older ones fade out over about ten updates
+const freeTrendWeight = 0.2
+
+// nextFreeTrend folds the change in free space since the last sample into
+// the trend, in bytes per second
+func nextFreeTrend(trend float64, lastFree, free uint64, elapsed time.Duration) float64 {
+	rate := (float64(free) - float64(lastFree)) / elapsed.Seconds()
+	return trend + freeTrendWeight*(rate-trend)
+}
+
+func cpuTime() (time.Duration, error) {
+	var ru unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &ru); err != nil {
+		return 0, err
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
+
+// addTelemetry fills in the process, transfer, ingest, bitswap, provider,
+// market and error stats of upd, the blockstore usage has to be set already
+func (s *Shuttle) addTelemetry(ctx context.Context, upd *drpc.ShuttleUpdate) {
+	ts := &s.telemetry
+	ts.lk.Lock()
+	defer ts.lk.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(ts.last)
+	first := ts.last.IsZero()
+	ts.last = now
+
+	upd.Version = appVersion
+	upd.NumCPU = runtime.NumCPU()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	upd.MemoryUsed = ms.Sys - ms.HeapReleased
+
+	if cpu, err := cpuTime(); err != nil {
+		log.Errorf("failed to get cpu usage: %s", err)
+	} else {
+		if !first && elapsed > 0 {
+			upd.CPUUsage = float64(cpu-ts.lastCPU) / float64(elapsed)
+		}
+		ts.lastCPU = cpu
+	}
+
+	txs, err := s.Filc.TransfersInProgress(ctx)
+	if err != nil {
+		log.Errorf("failed to get transfers in progress: %s", err)
+	} else {
+		// count what each transfer sent since the last sample, transfers
+		// that finished in between are not counted
+		var sent uint64
+		lastSent := make(map[string]uint64, len(txs))
+		for chid, tx := range txs {
+			if tx.Status == datatransfer.Ongoing {
+				upd.ActiveTransfers++
+			}
+
+			lastSent[chid] = tx.Sent
+			if prev, ok := ts.lastSent[chid]; ok && tx.Sent > prev {
+				sent += tx.Sent - prev
+			}
+		}
+		if !first && elapsed > 0 {
+			upd.TransferRate = uint64(float64(sent) / elapsed.Seconds())
+		}
+		ts.lastSent = lastSent
+	}
+
+	ingested := atomic.LoadInt64(&s.metrics.ingestedBytes)
+	if !first && elapsed > 0 {
+		upd.IngestRate = uint64(float64(ingested-ts.lastIngested) / elapsed.Seconds())
+		ts.freeTrend = nextFreeTrend(ts.freeTrend, ts.lastFree, upd.BlockstoreFree, elapsed)
+		upd.FreeSpaceTrend = int64(ts.freeTrend)
+	}
+	ts.lastIngested = ingested
+	ts.lastFree = upd.BlockstoreFree
+
+	if st, err := s.Node.Bitswap.Stat(); err != nil {
+		log.Errorf("failed to get bitswap stats: %s", err)
+	} else {
+		upd.Bitswap = &drpc.BitswapStats{
+			Peers:          len(st.Peers),
+			BlocksSent:     st.BlocksSent,
+			DataSent:       st.DataSent,
+			BlocksReceived: st.BlocksReceived,
+			DataReceived:   st.DataReceived,
+		}
+	}
+
+	if st, err := s.Node.ProvideStats(ctx); err != nil {
+		log.Errorf("failed to get provider stats: %s", err)
+	} else {
+		upd.Provider = &drpc.ProviderStats{
+			Strategy:      st.Strategy,
+			QueueLength:   st.QueueLength,
+			LastReprovide: st.LastReprovide,
+			Failures:      st.Failures,
+		}
+	}
+
+	if bal, err := s.marketBalance(ctx); err != nil {
+		log.Errorf("failed to get market balance: %s", err)
+	} else {
+		upd.Market = bal
+	}
+
+	upd.PinFailures = atomic.LoadInt64(&s.metrics.pinFailureCount)
+	upd.CommandFailures = atomic.LoadInt64(&s.metrics.commandFailureCount)
+	upd.SendErrors = atomic.LoadInt64(&s.metrics.sendErrorCount)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextFreeTrend(t *testing.T) {
+	// filling up at 100 bytes per second
+	var trend float64
+	for i := 0; i < 50; i++ {
+		trend = nextFreeTrend(trend, 10000, 4000, time.Minute)
+	}
+	assert.InDelta(t, -100, trend, 1)
+
+	// a single minute of freeing space does not turn it around
+	trend = nextFreeTrend(trend, 4000, 10000, time.Minute)
+	assert.Less(t, trend, 0.0)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+const (
+	// tierHot pins have their blocks in the main blockstore
+	tierHot = ""
+
+	// tierCold pins have their blocks in the cold store
+	tierCold = "cold"
+
+	// tierRemoved pins only have their blocks in their deals
+	tierRemoved = "removed"
+)
+
+// storageDeals are kept as json in the pins table
+type storageDeals []drpc.StorageDeal
+
+func (sd storageDeals) Value() (driver.Value, error) {
+	if len(sd) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (sd *storageDeals) Scan(v interface{}) error {
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("cannot scan %T into storage deals", v)
+	}
+
+	if len(b) == 0 {
+		*sd = nil
+		return nil
+	}
+	return json.Unmarshal(b, sd)
+}
+
+// openColdStore opens the blockstore tiered content is moved to, nil if
+// tiering is disabled or drops the blocks instead
+func openColdStore(cfg config.Tiering) (blockstore.Blockstore, error) {
+	if cfg.MinSealedDeals == 0 || cfg.Policy != config.TierPolicyOffload {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(cfg.ColdDir, 0775); err != nil {
+		return nil, err
+	}
+
+	ds, err := flatfs.CreateOrOpen(cfg.ColdDir, flatfs.NextToLast(2), false)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open cold store: %w", err)
+	}
+	return blockstore.NewBlockstoreNoPrefix(ds), nil
+}
+
+func (s *Shuttle) handleRpcTierContent(ctx context.Context, req *drpc.TierContent) error {
+	if req == nil {
+		return fmt.Errorf("tier content command is missing its params")
+	}
+
+	min := s.shuttleConfig.Tiering.MinSealedDeals
+	if min == 0 || len(req.Deals) < min {
+		return nil
+	}
+
+	return s.tierContent(ctx, req.Content, req.Deals)
+}
+
+// tierContent moves the blocks of a content out of the main blockstore,
+// into the cold store or nowhere depending on the policy. Blocks other
+// content in the main blockstore still uses stay where they are.
+func (s *Shuttle) tierContent(ctx context.Context, contid uint, deals []drpc.StorageDeal) (err error) {
+	ctx, span := s.Tracer.Start(ctx, "tierContent")
+	defer span.End()
+
+	ae := &AuditEntry{Actor: auditActorPrimary, Action: "tier", Content: contid}
+	defer func() {
+		s.audit(ae, err)
+	}()
+
+	s.tierLk.Lock()
+	defer s.tierLk.Unlock()
+
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", contid).Error; err != nil {
+		return err
+	}
+	ae.UserID = pin.UserID
+	ae.Cid = pin.Cid.CID.String()
+
+	if !pin.Active || pin.Tier != tierHot {
+		return nil
+	}
+
+	tier := tierRemoved
+	if s.coldStore != nil {
+		tier = tierCold
+	}
+
+	// the pin stops counting as hot before its blocks move, so the ones only
+	// it uses are the ones moved below
+	if err := s.DB.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumns(map[string]interface{}{
+		"tier":       tier,
+		"tier_deals": storageDeals(deals),
+	}).Error; err != nil {
+		return err
+	}
+
+	objs, err := s.objectsForPin(ctx, pin.ID)
+	if err != nil {
+		return err
+	}
+
+	var moved int
+	for _, o := range objs {
+		ok, err := s.moveToColdIfUnused(ctx, o.Cid.CID)
+		if err != nil {
+			return xerrors.Errorf("failed to tier block %s: %w", o.Cid.CID, err)
+		}
+		if ok {
+			moved++
+		}
+	}
+
+	log.Infow("tiered content", "content", contid, "tier", tier, "blocks", moved, "objects", len(objs))
+	return nil
+}
+
+// moveToColdIfUnused removes c from the main blockstore, copying it into the
+// cold store if there is one, unless a hot pin uses it or it is inflight
+func (s *Shuttle) moveToColdIfUnused(ctx context.Context, c cid.Cid) (bool, error) {
+	s.inflightCidsLk.Lock()
+	defer s.inflightCidsLk.Unlock()
+
+	if s.isInflight(c) {
+		return false, nil
+	}
+
+	refs, err := s.tierRefs(c, tierHot)
+	if err != nil {
+		return false, err
+	}
+	if refs > 0 {
+		return false, nil
+	}
+
+	blk, err := s.Node.Blockstore.Get(ctx, c)
+	if err != nil {
+		if xerrors.Is(err, blockstore.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if s.coldStore != nil {
+		if err := s.coldStore.Put(ctx, blk); err != nil {
+			return false, err
+		}
+	}
+	return true, s.Node.Blockstore.DeleteBlock(ctx, c)
+}
+
+// tierRefs counts the pins of the given tier that reference c
+func (s *Shuttle) tierRefs(c cid.Cid, tier string) (int64, error) {
+	var n int64
+	err := s.DB.Model(Object{}).
+		Joins("join obj_refs on obj_refs.object = objects.id").
+		Joins("join pins on pins.id = obj_refs.pin").
+		Where("objects.cid = ? and pins.tier = ?", util.DbCID{CID: c}, tier).
+		Count(&n).Error
+	return n, err
+}
+
+// deleteColdBlock removes c from the cold store, the caller checks that no
+// pin references it anymore
+func (s *Shuttle) deleteColdBlock(ctx context.Context, c cid.Cid) (bool, error) {
+	if s.coldStore == nil {
+		return false, nil
+	}
+
+	has, err := s.coldStore.Has(ctx, c)
+	if err != nil || !has {
+		return false, err
+	}
+	return true, s.coldStore.DeleteBlock(ctx, c)
+}
+
+// rehydrate brings the blocks of a tiered pin back into the main blockstore,
+// from the cold store or by retrieving them from the deals of the pin and
+// the given ones
+func (s *Shuttle) rehydrate(ctx context.Context, pin *Pin, deals []drpc.StorageDeal) error {
+	ctx, span := s.Tracer.Start(ctx, "rehydrate")
+	defer span.End()
+
+	log.Infow("bringing back tiered content", "content", pin.Content, "tier", pin.Tier)
+
+	switch pin.Tier {
+	case tierHot:
+		return nil
+	case tierCold:
+		if s.coldStore == nil {
+			return fmt.Errorf("content %d is in the cold store but there is none configured", pin.Content)
+		}
+
+		s.tierLk.Lock()
+		defer s.tierLk.Unlock()
+
+		if err := s.copyFromCold(ctx, pin); err != nil {
+			return err
+		}
+		if err := s.markHot(pin); err != nil {
+			return err
+		}
+		return s.clearColdCopies(ctx, pin)
+	case tierRemoved:
+		all := append(append([]drpc.StorageDeal{}, pin.TierDeals...), deals...)
+		if err := s.retrieveFromDeals(ctx, pin.Content, all, pin.Cid.CID, nil); err != nil {
+			return err
+		}
+
+		s.tierLk.Lock()
+		defer s.tierLk.Unlock()
+		return s.markHot(pin)
+	default:
+		return fmt.Errorf("content %d is in unknown tier %q", pin.Content, pin.Tier)
+	}
+}
+
+func (s *Shuttle) copyFromCold(ctx context.Context, pin *Pin) error {
+	objs, err := s.objectsForPin(ctx, pin.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objs {
+		has, err := s.Node.Blockstore.Has(ctx, o.Cid.CID)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+
+		blk, err := s.coldStore.Get(ctx, o.Cid.CID)
+		if err != nil {
+			return xerrors.Errorf("failed to read block %s from the cold store: %w", o.Cid.CID, err)
+		}
+		if err := s.Node.Blockstore.Put(ctx, blk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Shuttle) markHot(pin *Pin) error {
+	if err := s.DB.Model(Pin{}).Where("id = ?", pin.ID).UpdateColumns(map[string]interface{}{
+		"tier":       tierHot,
+		"tier_deals": storageDeals(nil),
+	}).Error; err != nil {
+		return err
+	}
+	pin.Tier = tierHot
+	pin.TierDeals = nil
+	return nil
+}
+
+// clearColdCopies drops the blocks of a pin that was brought back from the
+// cold store, unless another cold pin still needs them
+func (s *Shuttle) clearColdCopies(ctx context.Context, pin *Pin) error {
+	objs, err := s.objectsForPin(ctx, pin.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objs {
+		refs, err := s.tierRefs(o.Cid.CID, tierCold)
+		if err != nil {
+			return err
+		}
+		if refs > 0 {
+			continue
+		}
+		if _, err := s.deleteColdBlock(ctx, o.Cid.CID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureHot brings a tiered content back into the main blockstore
+func (s *Shuttle) ensureHot(ctx context.Context, contid uint) error {
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", contid).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if pin.Tier == tierHot {
+		return nil
+	}
+	return s.retrieveContent(ctx, pin.Content, pin.Cid.CID, nil)
+}
+
+// ensureHotCid brings back the tiered contents with the given root
+func (s *Shuttle) ensureHotCid(ctx context.Context, root cid.Cid) error {
+	var pins []Pin
+	if err := s.DB.Find(&pins, "cid = ? and tier != ?", util.DbCID{CID: root}, tierHot).Error; err != nil {
+		return err
+	}
+
+	for _, p := range pins {
+		if err := s.ensureHot(ctx, p.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tieredBlockstore serves reads of tiered blocks. Blocks in the cold store
+// are read from there, either way the content they belong to is brought
+// back in the background so the following reads find it hot.
+type tieredBlockstore struct {
+	blockstore.Blockstore
+
+	s *Shuttle
+}
+
+func (tb *tieredBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := tb.Blockstore.Get(ctx, c)
+	if !xerrors.Is(err, blockstore.ErrNotFound) {
+		return blk, err
+	}
+	return tb.s.getTiered(ctx, c)
+}
+
+func (tb *tieredBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	size, err := tb.Blockstore.GetSize(ctx, c)
+	if !xerrors.Is(err, blockstore.ErrNotFound) {
+		return size, err
+	}
+
+	blk, err := tb.s.getTiered(ctx, c)
+	if err != nil {
+		return -1, err
+	}
+	return len(blk.RawData()), nil
+}
+
+func (s *Shuttle) getTiered(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	var pin Pin
+	err := s.DB.Model(Object{}).
+		Joins("join obj_refs on obj_refs.object = objects.id").
+		Joins("join pins on pins.id = obj_refs.pin").
+		Where("objects.cid = ? and pins.tier != ?", util.DbCID{CID: c}, tierHot).
+		Select("pins.*").
+		Limit(1).
+		Scan(&pin).Error
+	if err != nil {
+		return nil, err
+	}
+	if pin.ID == 0 {
+		return nil, blockstore.ErrNotFound
+	}
+
+	go func() {
+		if err := s.retrieveContent(context.Background(), pin.Content, pin.Cid.CID, nil); err != nil {
+			log.Errorf("failed to bring back tiered content %d: %s", pin.Content, err)
+		}
+	}()
+
+	if s.coldStore == nil {
+		return nil, blockstore.ErrNotFound
+	}
+	return s.coldStore.Get(ctx, c)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/filecoin-project/go-address"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTierToColdAndBack(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.coldStore = blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+
+	root := blocks.NewBlock([]byte("root"))
+	shared := blocks.NewBlock([]byte("shared"))
+	other := blocks.NewBlock([]byte("other"))
+	addTestPin(t, s, 1, root, shared)
+	addTestPin(t, s, 2, other, shared)
+
+	maddr, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	deals := []drpc.StorageDeal{{Miner: maddr, DealID: 5}}
+
+	require.NoError(t, s.tierContent(ctx, 1, deals))
+
+	assert.False(t, hasBlock(t, s, root))
+	assert.True(t, hasBlock(t, s, shared), "block a hot pin uses was tiered")
+	has, err := s.coldStore.Has(ctx, root.Cid())
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	var pin Pin
+	require.NoError(t, s.DB.First(&pin, "content = ?", 1).Error)
+	assert.Equal(t, tierCold, pin.Tier)
+	assert.Equal(t, storageDeals(deals), pin.TierDeals)
+
+	require.NoError(t, s.rehydrate(ctx, &pin, nil))
+
+	assert.True(t, hasBlock(t, s, root))
+	has, err = s.coldStore.Has(ctx, root.Cid())
+	require.NoError(t, err)
+	assert.False(t, has, "cold copy was kept after bringing the content back")
+
+	require.NoError(t, s.DB.First(&pin, "content = ?", 1).Error)
+	assert.Equal(t, tierHot, pin.Tier)
+	assert.Empty(t, pin.TierDeals)
+}
+
+func TestUnpinTieredContent(t *testing.T) {
+	ctx := context.Background()
+	s := newTestShuttle(t)
+	s.coldStore = blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+
+	blk := blocks.NewBlock([]byte("tiered"))
+	addTestPin(t, s, 1, blk)
+	require.NoError(t, s.tierContent(ctx, 1, nil))
+
+	require.NoError(t, s.Unpin(ctx, 1))
+
+	has, err := s.coldStore.Has(ctx, blk.Cid())
+	require.NoError(t, err)
+	assert.False(t, has)
+}
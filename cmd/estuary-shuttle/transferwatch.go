@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/application-research/filclient"
+)
+
+const transferWatchdogInterval = time.Minute
+
+// retryableTransferErrors are parts of the channel messages of transfers
+// that broke over something a restart can get past
+var retryableTransferErrors = []string{
+	"stream reset",
+	"connection reset",
+	"connection refused",
+	"i/o timeout",
+	"context deadline exceeded",
+	"failed to dial",
+	"no route to host",
+	"disconnected",
+}
+
+// needsRestart records the progress of a tracked channel and returns why it
+// should be restarted, empty if it is fine
+func (trk *chanTrack) needsRestart(st *filclient.ChannelState, stall time.Duration, now time.Time) string {
+	if st.Sent > trk.sent {
+		trk.sent = st.Sent
+		trk.progressAt = now
+	}
+
+	if st.Message != trk.restartMsg {
+		msg := strings.ToLower(st.Message)
+		for _, e := range retryableTransferErrors {
+			if strings.Contains(msg, e) {
+				return st.Message
+			}
+		}
+	}
+
+	if now.Sub(trk.progressAt) >= stall {
+		return fmt.Sprintf("no progress for %s", now.Sub(trk.progressAt).Round(time.Second))
+	}
+	return ""
+}
+
+// runTransferWatchdog restarts the deal transfers of the shuttle that
+// stalled or broke, transfers of the v1.2.0 deal protocol are left to the
+// storage provider which restarts them itself
+func (s *Shuttle) runTransferWatchdog() {
+	cfg := s.shuttleConfig.TransferRestart
+	if cfg.StallTimeout == 0 {
+		return
+	}
+
+	for range time.Tick(transferWatchdogInterval) {
+		if s.isShuttingDown() {
+			return
+		}
+
+		if err := s.checkTransfers(context.Background(), cfg, time.Now()); err != nil {
+			log.Errorf("failed to check transfers: %s", err)
+		}
+	}
+}
+
+func (s *Shuttle) checkTransfers(ctx context.Context, cfg config.TransferRestart, now time.Time) error {
+	transfers, err := s.Filc.V110TransfersInProgress(ctx)
+	if err != nil {
+		return err
+	}
+
+	for id, st := range transfers {
+		cst := filclient.ChannelStateConv(st)
+		if util.TransferTerminated(cst) {
+			continue
+		}
+
+		chid := id.String()
+		s.tcLk.Lock()
+		trk, ok := s.trackingChannels[chid]
+		if !ok {
+			s.tcLk.Unlock()
+			continue
+		}
+		reason := trk.needsRestart(cst, cfg.StallTimeout, now)
+		if reason == "" {
+			s.tcLk.Unlock()
+			continue
+		}
+		trk.restarts++
+		trk.progressAt = now
+		trk.restartMsg = cst.Message
+		attempt, dbid := trk.restarts, trk.dbid
+		if attempt > cfg.MaxRestarts {
+			// the deal is failed below, nothing to watch anymore
+			delete(s.trackingChannels, chid)
+		}
+		s.tcLk.Unlock()
+
+		if attempt > cfg.MaxRestarts {
+			log.Warnw("giving up on deal transfer", "chanid", chid, "deal", dbid, "reason", reason, "restarts", cfg.MaxRestarts)
+			s.sendTransferStatusUpdate(ctx, &drpc.TransferStatus{
+				Chanid:   chid,
+				DealDBID: dbid,
+				Failed:   true,
+				Message:  fmt.Sprintf("transfer gave up after %d restarts: %s", cfg.MaxRestarts, reason),
+			})
+			continue
+		}
+
+		log.Infow("restarting deal transfer", "chanid", chid, "deal", dbid, "reason", reason, "attempt", attempt)
+		idcp := id
+		rst := &drpc.TransferRestarted{
+			Chanid:   chid,
+			DealDBID: dbid,
+			Attempt:  attempt,
+			Reason:   reason,
+		}
+		if err := s.Filc.RestartTransfer(ctx, &idcp); err != nil {
+			log.Warnf("failed to restart transfer %s: %s", chid, err)
+			rst.Error = err.Error()
+		}
+
+		if err := s.sendRpcMessage(ctx, &drpc.Message{
+			Op: drpc.OP_TransferRestarted,
+			Params: drpc.MsgParams{
+				TransferRestarted: rst,
+			},
+		}); err != nil {
+			log.Errorf("failed to send transfer restarted message: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/application-research/filclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferNeedsRestart(t *testing.T) {
+	start := time.Now()
+	stall := 10 * time.Minute
+	trk := &chanTrack{progressAt: start}
+
+	assert.Empty(t, trk.needsRestart(&filclient.ChannelState{Sent: 100}, stall, start.Add(5*time.Minute)))
+	assert.Empty(t, trk.needsRestart(&filclient.ChannelState{Sent: 100}, stall, start.Add(12*time.Minute)), "progress at 5 minutes was missed")
+	assert.NotEmpty(t, trk.needsRestart(&filclient.ChannelState{Sent: 100}, stall, start.Add(16*time.Minute)))
+
+	trk = &chanTrack{progressAt: start}
+	broken := &filclient.ChannelState{Message: "graphsync stream reset"}
+	assert.Equal(t, broken.Message, trk.needsRestart(broken, stall, start))
+
+	// the same message does not restart it again
+	trk.restartMsg = broken.Message
+	assert.Empty(t, trk.needsRestart(broken, stall, start))
+
+	assert.Empty(t, trk.needsRestart(&filclient.ChannelState{Message: "provider rejected the deal"}, stall, start))
+}
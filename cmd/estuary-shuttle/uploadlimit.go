@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+)
+
+// maxUploadSize returns the largest request body u may send to the upload
+// endpoints. A limit set for the user on the primary overrides the shuttle
+// default, 0 means no limit.
+func (s *Shuttle) maxUploadSize(u *User) int64 {
+	if u.MaxUploadSize > 0 {
+		return u.MaxUploadSize
+	}
+	return s.shuttleConfig.Content.MaxUploadSize
+}
+
+func uploadTooLargeError(limit int64) error {
+	return &util.HttpError{
+		Code:    http.StatusRequestEntityTooLarge,
+		Reason:  util.ERR_CONTENT_SIZE_OVER_LIMIT,
+		Details: fmt.Sprintf("upload is over the size limit of %d bytes", limit),
+	}
+}
+
+// sizeLimitedReadCloser fails reads once more than limit bytes have been
+// read, like http.MaxBytesReader, but remembers that it did so
+type sizeLimitedReadCloser struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+	exceeded  bool
+}
+
+func (r *sizeLimitedReadCloser) Read(p []byte) (int, error) {
+	if r.exceeded {
+		return 0, uploadTooLargeError(r.limit)
+	}
+
+	// read one byte more than allowed to tell a body of exactly limit bytes
+	// from a larger one
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if int64(n) <= r.remaining {
+		r.remaining -= int64(n)
+		return n, err
+	}
+
+	n = int(r.remaining)
+	r.remaining = 0
+	r.exceeded = true
+	return n, uploadTooLargeError(r.limit)
+}
+
+// uploadSizeMiddleware stops reading request bodies once they go over the
+// users upload size limit, so oversized uploads are refused while they are
+// streamed in rather than after they have been written to disk. It has to
+// run after AuthRequired.
+func (s *Shuttle) uploadSizeMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u, ok := c.Get("user").(*User)
+		if !ok {
+			return next(c)
+		}
+
+		limit := s.maxUploadSize(u)
+		r := c.Request()
+		if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+			return next(c)
+		}
+
+		if r.ContentLength > limit {
+			return uploadTooLargeError(limit)
+		}
+
+		body := &sizeLimitedReadCloser{ReadCloser: r.Body, limit: limit, remaining: limit}
+		r.Body = body
+
+		err := next(c)
+		if body.exceeded {
+			// handlers may wrap or replace the read error, make sure the
+			// client is told why the upload failed
+			return uploadTooLargeError(limit)
+		}
+		return err
+	}
+}
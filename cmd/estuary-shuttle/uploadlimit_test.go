@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestSizeLimitedReadCloser(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 100)
+
+	r := &sizeLimitedReadCloser{ReadCloser: io.NopCloser(bytes.NewReader(data)), limit: 100, remaining: 100}
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Len(t, out, 100)
+	assert.False(t, r.exceeded)
+
+	r = &sizeLimitedReadCloser{ReadCloser: io.NopCloser(bytes.NewReader(data)), limit: 99, remaining: 99}
+	out, err = ioutil.ReadAll(r)
+	var herr *util.HttpError
+	require.True(t, xerrors.As(err, &herr))
+	assert.Equal(t, 413, herr.Code)
+	assert.Len(t, out, 99)
+	assert.True(t, r.exceeded)
+}
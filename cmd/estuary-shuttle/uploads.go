@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/uploads"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+)
+
+// Resumable uploads follow the core tus protocol (https://tus.io/protocols/resumable-upload.html)
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+
+	headerTusResumable  = "Tus-Resumable"
+	headerUploadLength  = "Upload-Length"
+	headerUploadOffset  = "Upload-Offset"
+	headerUploadMeta    = "Upload-Metadata"
+	offsetOctetStream   = "application/offset+octet-stream"
+	staleUploadLifetime = time.Hour * 24
+)
+
+func parseUploadMetadata(hdr string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if hdr == "" {
+		return meta, nil
+	}
+
+	for _, kv := range strings.Split(hdr, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), " ", 2)
+		if parts[0] == "" {
+			continue
+		}
+
+		var val string
+		if len(parts) == 2 {
+			b, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for upload metadata key %q: %w", parts[0], err)
+			}
+			val = string(b)
+		}
+		meta[parts[0]] = val
+	}
+	return meta, nil
+}
+
+func (s *Shuttle) getUserUpload(id string, u *User) (*uploads.Info, error) {
+	info, err := s.Uploads.Get(id)
+	if err != nil {
+		if xerrors.Is(err, uploads.ErrUploadNotFound) || xerrors.Is(err, uploads.ErrInvalidUploadID) {
+			return nil, &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_UPLOAD_NOT_FOUND,
+				Details: fmt.Sprintf("upload %s not found", id),
+			}
+		}
+		return nil, err
+	}
+
+	if info.UserID != u.ID {
+		return nil, &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_UPLOAD_NOT_FOUND,
+			Details: fmt.Sprintf("upload %s not found", id),
+		}
+	}
+	return info, nil
+}
+
+func (s *Shuttle) handleUploadOptions(c echo.Context) error {
+	c.Response().Header().Set(headerTusResumable, tusVersion)
+	c.Response().Header().Set("Tus-Version", tusVersion)
+	c.Response().Header().Set("Tus-Extension", tusExtensions)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// handleCreateUpload godoc
+// @Summary      Create a resumable upload
+// @Description  This endpoint creates a new resumable (tus) upload. The total size of the upload must be given in the Upload-Length header.
+// @Tags         content
+// @Produce      json
+// @Router       /content/uploads [post]
+func (s *Shuttle) handleCreateUpload(c echo.Context, u *User) error {
+	if err := util.ErrorIfContentAddingDisabled(u.StorageDisabled || s.addingDisabled()); err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(headerTusResumable, tusVersion)
+
+	length, err := strconv.ParseInt(c.Request().Header.Get(headerUploadLength), 10, 64)
+	if err != nil || length < 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "a valid Upload-Length header is required",
+		}
+	}
+
+	if !u.FlagSplitContent() && length > constants.DefaultContentSizeLimit {
+		return &util.HttpError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Reason:  util.ERR_CONTENT_SIZE_OVER_LIMIT,
+			Details: fmt.Sprintf("content size %d bytes, is over upload size limit of %d bytes, and content splitting is not enabled, please reduce the content size", length, constants.DefaultContentSizeLimit),
+		}
+	}
+
+	if limit := s.maxUploadSize(u); limit > 0 && length > limit {
+		return uploadTooLargeError(limit)
+	}
+
+	meta, err := parseUploadMetadata(c.Request().Header.Get(headerUploadMeta))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	if _, err := s.parseImportParams(func(key string) string { return meta[key] }); err != nil {
+		return err
+	}
+	if _, err := collectionFromParams(func(key string) string { return meta[key] }); err != nil {
+		return err
+	}
+
+	info, err := s.Uploads.Create(u.ID, length, meta)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("Location", "/content/uploads/"+info.ID)
+	return c.JSON(http.StatusCreated, map[string]string{
+		"id": info.ID,
+	})
+}
+
+// handleUploadStatus godoc
+// @Summary      Get the status of a resumable upload
+// @Description  This endpoint returns the current offset of a resumable upload in the Upload-Offset header.
+// @Tags         content
+// @Param        id path string true "Upload ID"
+// @Router       /content/uploads/{id} [head]
+func (s *Shuttle) handleUploadStatus(c echo.Context, u *User) error {
+	info, err := s.getUserUpload(c.Param("id"), u)
+	if err != nil {
+		return err
+	}
+
+	offset, err := s.Uploads.Offset(info.ID)
+	if err != nil {
+		return err
+	}
+
+	h := c.Response().Header()
+	h.Set(headerTusResumable, tusVersion)
+	h.Set(headerUploadOffset, strconv.FormatInt(offset, 10))
+	h.Set(headerUploadLength, strconv.FormatInt(info.Length, 10))
+	h.Set("Cache-Control", "no-store")
+	return c.NoContent(http.StatusOK)
+}
+
+// handleUploadChunk godoc
+// @Summary      Upload a chunk of a resumable upload
+// @Description  This endpoint appends data to a resumable upload at the offset given in the Upload-Offset header. Once all data has been received the content is imported and added.
+// @Tags         content
+// @Produce      json
+// @Param        id path string true "Upload ID"
+// @Router       /content/uploads/{id} [patch]
+func (s *Shuttle) handleUploadChunk(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	if err := util.ErrorIfContentAddingDisabled(u.StorageDisabled || s.addingDisabled()); err != nil {
+		return err
+	}
+
+	c.Response().Header().Set(headerTusResumable, tusVersion)
+
+	if c.Request().Header.Get("Content-Type") != offsetOctetStream {
+		return &util.HttpError{
+			Code:    http.StatusUnsupportedMediaType,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "content type must be " + offsetOctetStream,
+		}
+	}
+
+	info, err := s.getUserUpload(c.Param("id"), u)
+	if err != nil {
+		return err
+	}
+
+	offset, err := strconv.ParseInt(c.Request().Header.Get(headerUploadOffset), 10, 64)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "a valid Upload-Offset header is required",
+		}
+	}
+
+	// the final chunk runs the importer over the whole upload, while the
+	// upload is still locked so no other request imports it as well
+	var resp *util.ContentAddResponse
+	complete := func(info *uploads.Info, fi *os.File) error {
+		cic, err := collectionFromParams(func(key string) string { return info.Metadata[key] })
+		if err != nil {
+			return err
+		}
+
+		filename := info.Metadata["filename"]
+		if filename == "" {
+			filename = info.ID
+		}
+
+		params, err := s.parseImportParams(func(key string) string { return info.Metadata[key] })
+		if err != nil {
+			return err
+		}
+
+		opts, err := parseAddOptions(func(key string) string { return info.Metadata[key] })
+		if err != nil {
+			return err
+		}
+
+		// on failure the data is kept around so the client can retry the
+		// import by sending an empty chunk at the final offset
+		r, err := s.addFileContent(ctx, u, fi, filename, cic, params, opts)
+		if err != nil {
+			return err
+		}
+		resp = r
+		return nil
+	}
+
+	defer c.Request().Body.Close()
+	newOffset, err := s.Uploads.Append(info.ID, offset, c.Request().Body, complete)
+	c.Response().Header().Set(headerUploadOffset, strconv.FormatInt(newOffset, 10))
+	switch {
+	case err == nil:
+	case xerrors.Is(err, uploads.ErrOffsetMismatch):
+		return &util.HttpError{
+			Code:    http.StatusConflict,
+			Reason:  util.ERR_UPLOAD_OFFSET_MISMATCH,
+			Details: fmt.Sprintf("upload is at offset %d", newOffset),
+		}
+	case xerrors.Is(err, uploads.ErrUploadLocked):
+		return &util.HttpError{
+			Code:    http.StatusLocked,
+			Reason:  util.ERR_UPLOAD_IN_PROGRESS,
+			Details: "another request is currently writing to this upload",
+		}
+	case xerrors.Is(err, uploads.ErrUploadTooLarge):
+		return &util.HttpError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Reason:  util.ERR_CONTENT_SIZE_OVER_LIMIT,
+			Details: fmt.Sprintf("upload data exceeds declared length of %d bytes", info.Length),
+		}
+	case xerrors.Is(err, uploads.ErrUploadNotFound):
+		// completed by a concurrent request
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_UPLOAD_NOT_FOUND,
+			Details: fmt.Sprintf("upload %s not found", info.ID),
+		}
+	default:
+		return err
+	}
+
+	if resp == nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handleDeleteUpload godoc
+// @Summary      Terminate a resumable upload
+// @Description  This endpoint discards a resumable upload and all data received for it.
+// @Tags         content
+// @Param        id path string true "Upload ID"
+// @Router       /content/uploads/{id} [delete]
+func (s *Shuttle) handleDeleteUpload(c echo.Context, u *User) error {
+	c.Response().Header().Set(headerTusResumable, tusVersion)
+
+	info, err := s.getUserUpload(c.Param("id"), u)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Uploads.Remove(info.ID); err != nil {
+		if xerrors.Is(err, uploads.ErrUploadLocked) {
+			return &util.HttpError{
+				Code:    http.StatusLocked,
+				Reason:  util.ERR_UPLOAD_IN_PROGRESS,
+				Details: "the upload is currently being written to or imported",
+			}
+		}
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Shuttle) runUploadCleaner() {
+	for range time.Tick(time.Hour) {
+		n, err := s.Uploads.RemoveStale(staleUploadLifetime)
+		if err != nil {
+			log.Errorf("failed to remove stale uploads: %s", err)
+			continue
+		}
+
+		if n > 0 {
+			log.Infof("removed %d stale uploads", n)
+		}
+	}
+}
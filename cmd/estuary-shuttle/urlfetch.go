@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	urlFetchRunning = "fetching"
+	urlFetchDone    = "done"
+	urlFetchFailed  = "failed"
+)
+
+// urlFetchKeep is how long finished fetches can still be looked up
+const urlFetchKeep = 24 * time.Hour
+
+// urlFetch is a download made for add-from-url
+type urlFetch struct {
+	ID     uint64 `json:"id"`
+	userID uint
+
+	URL     string    `json:"url"`
+	Status  string    `json:"status"`
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended,omitempty"`
+
+	// Fetched is how much was downloaded so far, Size the length the server
+	// announced, zero if it did not
+	Fetched int64 `json:"fetched"`
+	Size    int64 `json:"size,omitempty"`
+	fetched *int64
+
+	Error   string                   `json:"error,omitempty"`
+	Content *util.ContentAddResponse `json:"content,omitempty"`
+}
+
+// urlFetches keeps the fetches of the last day in memory, they are lost on
+// restart along with the downloads that were running
+type urlFetches struct {
+	lk      sync.Mutex
+	next    uint64
+	fetches map[uint64]*urlFetch
+}
+
+func (uf *urlFetches) start(uid uint, u string, now time.Time) *urlFetch {
+	uf.lk.Lock()
+	defer uf.lk.Unlock()
+
+	if uf.fetches == nil {
+		uf.fetches = make(map[uint64]*urlFetch)
+	}
+	for id, f := range uf.fetches {
+		if f.Status != urlFetchRunning && now.Sub(f.Ended) > urlFetchKeep {
+			delete(uf.fetches, id)
+		}
+	}
+
+	uf.next++
+	f := &urlFetch{ID: uf.next, userID: uid, URL: u, Status: urlFetchRunning, Started: now, fetched: new(int64)}
+	uf.fetches[f.ID] = f
+	return f
+}
+
+// get returns a copy of the fetch, nil if the user has no such fetch
+func (uf *urlFetches) get(uid uint, id uint64) *urlFetch {
+	uf.lk.Lock()
+	defer uf.lk.Unlock()
+
+	f, ok := uf.fetches[id]
+	if !ok || f.userID != uid {
+		return nil
+	}
+	cp := *f
+	cp.Fetched = atomic.LoadInt64(f.fetched)
+	return &cp
+}
+
+func (uf *urlFetches) finish(f *urlFetch, resp *util.ContentAddResponse, err error) {
+	uf.lk.Lock()
+	defer uf.lk.Unlock()
+
+	f.Ended = time.Now()
+	if err != nil {
+		f.Status = urlFetchFailed
+		f.Error = err.Error()
+		return
+	}
+	f.Status = urlFetchDone
+	f.Content = resp
+}
+
+func (uf *urlFetches) setSize(f *urlFetch, size int64) {
+	uf.lk.Lock()
+	defer uf.lk.Unlock()
+	f.Size = size
+}
+
+// fetchReader counts what is read into the fetch it belongs to
+type fetchReader struct {
+	io.Reader
+	fetched *int64
+}
+
+func (fr *fetchReader) Read(p []byte) (int, error) {
+	n, err := fr.Reader.Read(p)
+	atomic.AddInt64(fr.fetched, int64(n))
+	return n, err
+}
+
+// refusePrivateAddrs is a dialer control that refuses connections to
+// loopback, private and link local addresses. It runs for every connection,
+// redirects included, after the name was resolved.
+func refusePrivateAddrs(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("refusing to connect to %s", host)
+	}
+	return nil
+}
+
+func newUrlFetchClient(cfg config.UrlFetch) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if !cfg.AllowPrivate {
+		dialer.Control = refusePrivateAddrs
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   30 * time.Second,
+			ResponseHeaderTimeout: 2 * time.Minute,
+		},
+	}
+}
+
+// parseFetchURL checks that u is an absolute http or https url
+func parseFetchURL(u string) (*url.URL, error) {
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+		return nil, &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid url %q, must be an http or https url", u),
+		}
+	}
+	return pu, nil
+}
+
+// fetchURL downloads the url of f and imports it as a file
+func (s *Shuttle) fetchURL(ctx context.Context, u *User, f *urlFetch, filename string, limit int64, cic util.ContentInCollection, params util.ImportParams, opts addOptions) (*util.ContentAddResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.urlFetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server responded with %s", resp.Status)
+	}
+	if resp.ContentLength > limit {
+		return nil, uploadTooLargeError(limit)
+	}
+	if resp.ContentLength > 0 {
+		s.urlFetches.setSize(f, resp.ContentLength)
+	}
+
+	body := &sizeLimitedReadCloser{ReadCloser: resp.Body, limit: limit, remaining: limit}
+	return s.addFileContent(ctx, u, &fetchReader{Reader: body, fetched: f.fetched}, filename, cic, params, opts)
+}
+
+type addFromURLBody struct {
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+}
+
+// handleAddFromURL godoc
+// @Summary      Add content from a url
+// @Description  This endpoint has the shuttle download the given http or https url itself and add it as a file. It returns right away, the download is followed with the returned id.
+// @Tags         content
+// @Produce      json
+// @Param        body  body  addFromURLBody  true  "Url to download and the name of the file"
+// @Router       /content/add-from-url [post]
+func (s *Shuttle) handleAddFromURL(c echo.Context, u *User) error {
+	if err := util.ErrorIfContentAddingDisabled(u.StorageDisabled || s.addingDisabled()); err != nil {
+		return err
+	}
+
+	cfg := s.shuttleConfig.UrlFetch
+	if cfg.MaxSize == 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_CONTENT_ADDING_DISABLED,
+			Details: "adding content from urls is disabled on this shuttle",
+		}
+	}
+
+	var body addFromURLBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	pu, err := parseFetchURL(body.URL)
+	if err != nil {
+		return err
+	}
+
+	params, err := s.parseImportParams(c.QueryParam)
+	if err != nil {
+		return err
+	}
+
+	opts, err := parseAddOptions(c.QueryParam)
+	if err != nil {
+		return err
+	}
+
+	cic, err := collectionFromParams(c.QueryParam)
+	if err != nil {
+		return err
+	}
+
+	filename := body.Filename
+	if filename == "" {
+		filename = path.Base(pu.Path)
+		if filename == "." || filename == "/" {
+			filename = pu.Host
+		}
+	}
+
+	limit := cfg.MaxSize
+	if ul := s.maxUploadSize(u); ul > 0 && ul < limit {
+		limit = ul
+	}
+
+	f := s.urlFetches.start(u.ID, pu.String(), time.Now())
+	go func() {
+		ctx := context.Background()
+		if cfg.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+			defer cancel()
+		}
+
+		resp, err := s.fetchURL(ctx, u, f, filename, limit, cic, params, opts)
+		if err != nil {
+			log.Warnw("failed to add content from url", "user", u.ID, "url", f.URL, "err", err)
+		}
+		s.urlFetches.finish(f, resp, err)
+	}()
+
+	return c.JSON(http.StatusAccepted, s.urlFetches.get(u.ID, f.ID))
+}
+
+// handleGetURLFetch godoc
+// @Summary      Follow an add from url
+// @Description  This endpoint returns how far the download of an add-from-url got, and the added content once it is done
+// @Tags         content
+// @Produce      json
+// @Param        id  path  int  true  "Fetch id"
+// @Router       /content/add-from-url/{id} [get]
+func (s *Shuttle) handleGetURLFetch(c echo.Context, u *User) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid fetch id %q", c.Param("id")),
+		}
+	}
+
+	f := s.urlFetches.get(u.ID, id)
+	if f == nil {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_FETCH_NOT_FOUND,
+			Details: fmt.Sprintf("no fetch %d", id),
+		}
+	}
+	return c.JSON(http.StatusOK, f)
+}
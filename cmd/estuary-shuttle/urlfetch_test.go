@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefusePrivateAddrs(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:80", "10.1.2.3:443", "192.168.0.1:80", "169.254.169.254:80", "[::1]:80", "0.0.0.0:80"} {
+		assert.Error(t, refusePrivateAddrs("tcp", addr, nil), addr)
+	}
+	assert.NoError(t, refusePrivateAddrs("tcp", "93.184.216.34:443", nil))
+}
+
+func TestParseFetchURL(t *testing.T) {
+	_, err := parseFetchURL("https://example.com/data.bin")
+	assert.NoError(t, err)
+
+	for _, u := range []string{"", "example.com/data.bin", "file:///etc/passwd", "ftp://example.com/a", "http://"} {
+		_, err := parseFetchURL(u)
+		assert.Error(t, err, u)
+	}
+}
+
+func TestURLFetches(t *testing.T) {
+	var uf urlFetches
+	now := time.Now()
+
+	f := uf.start(1, "https://example.com/a", now)
+	assert.Nil(t, uf.get(2, f.ID), "fetch of another user was returned")
+
+	n, err := (&fetchReader{Reader: &zeroReader{}, fetched: f.fetched}).Read(make([]byte, 100))
+	require.NoError(t, err)
+	assert.Equal(t, 100, n)
+	assert.EqualValues(t, 100, uf.get(1, f.ID).Fetched)
+
+	uf.finish(f, &util.ContentAddResponse{EstuaryId: 5}, nil)
+	got := uf.get(1, f.ID)
+	assert.Equal(t, urlFetchDone, got.Status)
+	assert.EqualValues(t, 5, got.Content.EstuaryId)
+
+	failed := uf.start(1, "https://example.com/b", now)
+	uf.finish(failed, nil, errors.New("server responded with 404 Not Found"))
+	assert.Equal(t, urlFetchFailed, uf.get(1, failed.ID).Status)
+
+	// finished fetches are dropped a day after they ended
+	uf.start(1, "https://example.com/c", time.Now().Add(urlFetchKeep+time.Minute))
+	assert.Nil(t, uf.get(1, f.ID))
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// contentUsage is what a user stores on this shuttle
+type contentUsage struct {
+	// PinnedBytes is the total size of the completed pins
+	PinnedBytes int64 `json:"pinnedBytes"`
+
+	Pins        int64 `json:"pins"`
+	PinningPins int64 `json:"pinningPins"`
+	FailedPins  int64 `json:"failedPins"`
+
+	// InProgressBytes is what the running pins fetched so far
+	InProgressBytes int64 `json:"inProgressBytes"`
+}
+
+func (s *Shuttle) userUsage(uid uint) (*contentUsage, error) {
+	var out contentUsage
+	if err := s.readDB().Model(&Pin{}).
+		Select("coalesce(sum(case when active then size else 0 end), 0) as pinned_bytes, "+
+			"coalesce(sum(case when active then 1 else 0 end), 0) as pins, "+
+			"coalesce(sum(case when pinning then 1 else 0 end), 0) as pinning_pins, "+
+			"coalesce(sum(case when failed then 1 else 0 end), 0) as failed_pins").
+		Where("user_id = ?", uid).
+		Scan(&out).Error; err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// handleContentUsage godoc
+// @Summary      Storage usage
+// @Description  This endpoint returns the pinned size and pin counts of the user on this shuttle, and how much the pins in progress fetched so far
+// @Tags         content
+// @Produce      json
+// @Router       /content/usage [get]
+func (s *Shuttle) handleContentUsage(c echo.Context, u *User) error {
+	usage, err := s.userUsage(u.ID)
+	if err != nil {
+		return err
+	}
+	usage.InProgressBytes = s.PinMgr.FetchedBytes(u.ID)
+	return c.JSON(http.StatusOK, usage)
+}
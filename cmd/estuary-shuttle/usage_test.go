@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserUsage(t *testing.T) {
+	s := newTestShuttle(t)
+
+	usage, err := s.userUsage(1)
+	require.NoError(t, err)
+	assert.Equal(t, contentUsage{}, *usage)
+
+	addTestPin(t, s, 1, blocks.NewBlock([]byte("one")))
+	addTestPin(t, s, 2, blocks.NewBlock([]byte("two")))
+	require.NoError(t, s.DB.Model(Pin{}).Where("content = ?", 1).Updates(map[string]interface{}{"user_id": 1, "size": 100}).Error)
+	require.NoError(t, s.DB.Create(&Pin{Content: 3, UserID: 1, Pinning: true}).Error)
+
+	usage, err = s.userUsage(1)
+	require.NoError(t, err)
+	assert.Equal(t, contentUsage{PinnedBytes: 100, Pins: 1, PinningPins: 1}, *usage)
+}
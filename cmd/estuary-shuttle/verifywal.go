@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/node"
+)
+
+// verifyWalCmd checks the write log against the blockstore and prints what
+// it found. Unflushed blocks are still served from the log once the node
+// runs, but damaged ones are not, so it fails if any are left and scripts
+// restarting a shuttle after a crash can stop before it serves bad content.
+func verifyWalCmd(ctx context.Context, cfg *config.Node, repair bool) error {
+	rep, err := node.VerifyWriteLog(ctx, cfg, repair)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("blocks in write log:    %d\n", rep.Blocks)
+	fmt.Printf("corrupt in write log:   %d\n", rep.Corrupt)
+	fmt.Printf("unflushed:              %d\n", rep.Unflushed)
+	fmt.Printf("damaged in blockstore:  %d\n", rep.Damaged)
+	if repair {
+		fmt.Printf("repaired:               %d\n", rep.Repaired)
+	}
+
+	if rep.Damaged > 0 && !repair {
+		return fmt.Errorf("%d blocks are damaged in the blockstore, rerun with --repair to write them from the write log", rep.Damaged)
+	}
+	return nil
+}
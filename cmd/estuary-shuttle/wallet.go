@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/node"
+	"github.com/application-research/estuary/util"
+	"github.com/filecoin-project/go-address"
+	lotusTypes "github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet"
+	"github.com/labstack/echo/v4"
+)
+
+type addrWallet interface {
+	WalletHas(context.Context, address.Address) (bool, error)
+	GetDefault() (address.Address, error)
+}
+
+// walletAddrs tracks which wallet addresses the shuttle uses, deals go
+// through the active one of deals
+type walletAddrs struct {
+	lk        sync.Mutex
+	deals     []address.Address
+	active    int
+	retrieval address.Address
+}
+
+func newWalletAddrs(ctx context.Context, w addrWallet, cfg config.Wallet) (*walletAddrs, error) {
+	def, err := w.GetDefault()
+	if err != nil {
+		return nil, err
+	}
+
+	parse := func(s string) (address.Address, error) {
+		a, err := address.NewFromString(s)
+		if err != nil {
+			return address.Undef, fmt.Errorf("invalid wallet address %q: %w", s, err)
+		}
+
+		has, err := w.WalletHas(ctx, a)
+		if err != nil {
+			return address.Undef, err
+		}
+		if !has {
+			return address.Undef, fmt.Errorf("wallet address %s is not in the wallet", a)
+		}
+		return a, nil
+	}
+
+	wa := &walletAddrs{retrieval: def}
+	for _, s := range cfg.DealAddrs {
+		a, err := parse(s)
+		if err != nil {
+			return nil, err
+		}
+		wa.deals = append(wa.deals, a)
+	}
+	if len(wa.deals) == 0 {
+		wa.deals = []address.Address{def}
+	}
+
+	if cfg.RetrievalAddr != "" {
+		wa.retrieval, err = parse(cfg.RetrievalAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return wa, nil
+}
+
+func (wa *walletAddrs) dealAddr() address.Address {
+	wa.lk.Lock()
+	defer wa.lk.Unlock()
+	return wa.deals[wa.active]
+}
+
+func (wa *walletAddrs) retrievalAddr() address.Address {
+	wa.lk.Lock()
+	defer wa.lk.Unlock()
+	return wa.retrieval
+}
+
+// rotate moves on to the next deal address, it returns false if there is
+// only one
+func (wa *walletAddrs) rotate() (address.Address, bool) {
+	wa.lk.Lock()
+	defer wa.lk.Unlock()
+	if len(wa.deals) < 2 {
+		return wa.deals[wa.active], false
+	}
+	wa.active = (wa.active + 1) % len(wa.deals)
+	return wa.deals[wa.active], true
+}
+
+// rotateDealAddr switches to the next deal address and tells the primary
+func (s *Shuttle) rotateDealAddr(ctx context.Context) error {
+	addr, changed := s.wallets.rotate()
+	if !changed {
+		return nil
+	}
+	log.Infof("rotated deal address to %s", addr)
+
+	return s.sendRpcMessage(ctx, &drpc.Message{
+		Op: drpc.OP_WalletAddresses,
+		Params: drpc.MsgParams{
+			WalletAddresses: &drpc.WalletAddresses{
+				Deals:     addr,
+				Retrieval: s.wallets.retrievalAddr(),
+			},
+		},
+	})
+}
+
+func (s *Shuttle) runWalletRotation(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.rotateDealAddr(context.TODO()); err != nil {
+				log.Errorf("failed to rotate deal address: %s", err)
+			}
+		case <-s.shuttingDown:
+			return
+		}
+	}
+}
+
+// exportWalletKey returns the key of addr in the hex encoded format lotus
+// wallet export uses, so keys can be moved between shuttles and lotus
+func exportWalletKey(ctx context.Context, w *wallet.LocalWallet, addr address.Address) (string, error) {
+	ki, err := w.WalletExport(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(ki)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// importWalletKey adds a key exported with exportWalletKey or lotus to the
+// wallet, making it the default if asked to
+func importWalletKey(ctx context.Context, w *wallet.LocalWallet, key string, makeDefault bool) (address.Address, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return address.Undef, fmt.Errorf("key is not hex encoded: %w", err)
+	}
+
+	var ki lotusTypes.KeyInfo
+	if err := json.Unmarshal(b, &ki); err != nil {
+		return address.Undef, fmt.Errorf("failed to decode key: %w", err)
+	}
+
+	addr, err := w.WalletImport(ctx, &ki)
+	if err != nil {
+		return address.Undef, err
+	}
+
+	if makeDefault {
+		if err := w.SetDefault(addr); err != nil {
+			return address.Undef, err
+		}
+	}
+	return addr, nil
+}
+
+type walletAddrInfo struct {
+	Address address.Address `json:"address"`
+	Balance lotusTypes.FIL  `json:"balance"`
+	Default bool            `json:"default"`
+	Deals   bool            `json:"deals"`
+}
+
+type walletImportBody struct {
+	Key     string `json:"key"`
+	Default bool   `json:"default"`
+}
+
+func (s *Shuttle) handleListWallet(c echo.Context) error {
+	ctx := c.Request().Context()
+	addrs, err := s.Node.Wallet.WalletList(ctx)
+	if err != nil {
+		return err
+	}
+
+	def, err := s.Node.Wallet.GetDefault()
+	if err != nil {
+		return err
+	}
+
+	dealAddr := s.wallets.dealAddr()
+	out := make([]walletAddrInfo, 0, len(addrs))
+	for _, a := range addrs {
+		bal, err := s.Api.WalletBalance(ctx, a)
+		if err != nil {
+			return fmt.Errorf("failed to get balance of %s: %w", a, err)
+		}
+
+		out = append(out, walletAddrInfo{
+			Address: a,
+			Balance: lotusTypes.FIL(bal),
+			Default: a == def,
+			Deals:   a == dealAddr,
+		})
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+func (s *Shuttle) handleExportWallet(c echo.Context) error {
+	addr, err := address.NewFromString(c.Param("addr"))
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid wallet address: %s", err),
+		}
+	}
+
+	key, err := exportWalletKey(c.Request().Context(), s.Node.Wallet, addr)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{
+		"address": addr.String(),
+		"key":     key,
+	})
+}
+
+func (s *Shuttle) handleImportWallet(c echo.Context) error {
+	var body walletImportBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	addr, err := importWalletKey(c.Request().Context(), s.Node.Wallet, body.Key, body.Default)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+	log.Infof("imported wallet address %s", addr)
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"address": addr.String(),
+	})
+}
+
+func walletListCmd(ctx context.Context, cfg *config.Shuttle) error {
+	w, err := node.OpenWallet(cfg.Node.WalletDir)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := w.WalletList(ctx)
+	if err != nil {
+		return err
+	}
+
+	// a missing default only means the wallet has not been used yet
+	def, _ := w.GetDefault()
+
+	gw, closer, err := openGatewayAPI(cfg.Node.ApiURL)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	for _, a := range addrs {
+		bal, err := gw.WalletBalance(ctx, a)
+		if err != nil {
+			return fmt.Errorf("failed to get balance of %s: %w", a, err)
+		}
+
+		mark := ""
+		if a == def {
+			mark = " (default)"
+		}
+		fmt.Printf("%s\t%s%s\n", a, lotusTypes.FIL(bal), mark)
+	}
+	return nil
+}
+
+func walletExportCmd(ctx context.Context, cfg *config.Shuttle, addrStr string) error {
+	addr, err := address.NewFromString(addrStr)
+	if err != nil {
+		return fmt.Errorf("invalid wallet address: %w", err)
+	}
+
+	w, err := node.OpenWallet(cfg.Node.WalletDir)
+	if err != nil {
+		return err
+	}
+
+	key, err := exportWalletKey(ctx, w, addr)
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+func walletImportCmd(ctx context.Context, cfg *config.Shuttle, file string, makeDefault bool) error {
+	var (
+		b   []byte
+		err error
+	)
+	if file == "" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+
+	w, err := node.OpenWallet(cfg.Node.WalletDir)
+	if err != nil {
+		return err
+	}
+
+	addr, err := importWalletKey(ctx, w, string(b), makeDefault)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported key %s\n", addr)
+	return nil
+}
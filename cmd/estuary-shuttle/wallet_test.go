@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/wallet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeWallet struct {
+	def  address.Address
+	addr map[address.Address]bool
+}
+
+func (w *fakeWallet) WalletHas(ctx context.Context, a address.Address) (bool, error) {
+	return w.addr[a], nil
+}
+
+func (w *fakeWallet) GetDefault() (address.Address, error) {
+	return w.def, nil
+}
+
+func TestWalletAddrs(t *testing.T) {
+	ctx := context.Background()
+	def, _ := address.NewIDAddress(1000)
+	a1, _ := address.NewIDAddress(1001)
+	a2, _ := address.NewIDAddress(1002)
+	missing, _ := address.NewIDAddress(1003)
+	w := &fakeWallet{def: def, addr: map[address.Address]bool{def: true, a1: true, a2: true}}
+
+	wa, err := newWalletAddrs(ctx, w, config.Wallet{})
+	require.NoError(t, err)
+	assert.Equal(t, def, wa.dealAddr())
+	assert.Equal(t, def, wa.retrievalAddr())
+	_, changed := wa.rotate()
+	assert.False(t, changed, "a single address cant be rotated")
+
+	wa, err = newWalletAddrs(ctx, w, config.Wallet{
+		DealAddrs:     []string{a1.String(), a2.String()},
+		RetrievalAddr: def.String(),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, a1, wa.dealAddr())
+
+	next, changed := wa.rotate()
+	assert.True(t, changed)
+	assert.Equal(t, a2, next)
+	next, _ = wa.rotate()
+	assert.Equal(t, a1, next)
+	assert.Equal(t, def, wa.retrievalAddr())
+
+	_, err = newWalletAddrs(ctx, w, config.Wallet{DealAddrs: []string{missing.String()}})
+	assert.Error(t, err)
+	_, err = newWalletAddrs(ctx, w, config.Wallet{RetrievalAddr: "not an address"})
+	assert.Error(t, err)
+}
+
+func TestWalletKeyRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	require.NoError(t, err)
+	addr, err := src.WalletNew(ctx, types.KTSecp256k1)
+	require.NoError(t, err)
+
+	key, err := exportWalletKey(ctx, src, addr)
+	require.NoError(t, err)
+
+	dst, err := wallet.NewWallet(wallet.NewMemKeyStore())
+	require.NoError(t, err)
+	imported, err := importWalletKey(ctx, dst, key+"\n", true)
+	require.NoError(t, err)
+	assert.Equal(t, addr, imported)
+
+	def, err := dst.GetDefault()
+	require.NoError(t, err)
+	assert.Equal(t, addr, def)
+
+	_, err = importWalletKey(ctx, dst, "not hex", false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+)
+
+const diskWatermarkInterval = time.Second * 10
+
+// diskUsedShare returns the share of the fullest of the disks in use, one
+// full disk is enough for writes to fail
+func diskUsedShare(disks []drpc.BlockstoreDisk) float64 {
+	var worst float64
+	for _, d := range disks {
+		if d.Size == 0 {
+			continue
+		}
+		if used := float64(d.Size-d.Free) / float64(d.Size); used > worst {
+			worst = used
+		}
+	}
+	return worst
+}
+
+// pastWatermark returns whether adding stays paused, it pauses at the high
+// watermark and resumes below the low one
+func pastWatermark(paused bool, used float64, wm config.DiskWatermarks) bool {
+	if wm.High == 0 {
+		return false
+	}
+	if paused {
+		return used >= wm.Low
+	}
+	return used >= wm.High
+}
+
+func (s *Shuttle) addingPaused() bool {
+	return atomic.LoadInt32(&s.diskPaused) == 1
+}
+
+// addingDisabled reports whether new content is refused, by configuration,
+// because the disks are full or because the shuttle is draining
+func (s *Shuttle) addingDisabled() bool {
+	return s.disableLocalAdding || s.addingPaused() || s.isDraining()
+}
+
+// runDiskWatermarks pauses and resumes adding as the blockstore disks fill
+// up and free up. The primary is told right away so it stops sending pins.
+func (s *Shuttle) runDiskWatermarks() {
+	wm := s.shuttleConfig.DiskWatermarks
+	if wm.High == 0 {
+		return
+	}
+
+	for ; ; time.Sleep(diskWatermarkInterval) {
+		if s.isShuttingDown() {
+			return
+		}
+
+		used := diskUsedShare(s.blockstoreDisks())
+		paused := s.addingPaused()
+		next := pastWatermark(paused, used, wm)
+		if next == paused {
+			continue
+		}
+
+		if next {
+			atomic.StoreInt32(&s.diskPaused, 1)
+			log.Warnw("blockstore disks past their high watermark, refusing new content", "used", used, "high", wm.High)
+		} else {
+			atomic.StoreInt32(&s.diskPaused, 0)
+			log.Infow("blockstore disks back below their low watermark, taking new content", "used", used, "low", wm.Low)
+		}
+
+		if err := s.sendShuttleUpdate(context.TODO()); err != nil {
+			log.Errorf("failed to send shuttle update: %s", err)
+		}
+	}
+}
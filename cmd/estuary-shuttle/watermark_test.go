@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPastWatermark(t *testing.T) {
+	wm := config.DiskWatermarks{High: 0.9, Low: 0.8}
+
+	assert.False(t, pastWatermark(false, 0.85, wm))
+	assert.True(t, pastWatermark(false, 0.9, wm))
+	assert.True(t, pastWatermark(true, 0.85, wm), "resumed before dropping below the low watermark")
+	assert.False(t, pastWatermark(true, 0.79, wm))
+	assert.False(t, pastWatermark(false, 1, config.DiskWatermarks{}))
+}
+
+func TestDiskUsedShare(t *testing.T) {
+	assert.Equal(t, 0.0, diskUsedShare(nil))
+	assert.Equal(t, 0.75, diskUsedShare([]drpc.BlockstoreDisk{
+		{Size: 100, Free: 50},
+		{Size: 100, Free: 25},
+		{Size: 0, Free: 0},
+	}))
+}
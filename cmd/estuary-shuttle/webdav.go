@@ -0,0 +1,741 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/webdav"
+	"golang.org/x/xerrors"
+)
+
+// The webdav interface shows the collections of a user as the top level
+// directories, with the content of each under its collection path. Files put
+// into a collection are added like uploads, removing a file unpins its
+// content. Only content stored on this shuttle can be read.
+
+const davPrefix = "/dav"
+
+// davMiddleware serves webdav requests before echo routes them, the echo
+// router does not know methods like MKCOL or MOVE
+func (s *Shuttle) davMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		p := c.Request().URL.Path
+		if p != davPrefix && !strings.HasPrefix(p, davPrefix+"/") {
+			return next(c)
+		}
+
+		u, err := s.davAuth(c.Request())
+		if err != nil {
+			c.Response().Header().Set("WWW-Authenticate", `Basic realm="estuary"`)
+			return err
+		}
+
+		h := &webdav.Handler{
+			Prefix:     davPrefix,
+			FileSystem: &davFS{s: s, u: u},
+			LockSystem: s.davLocks,
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					log.Debugw("webdav request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+				}
+			},
+		}
+		h.ServeHTTP(c.Response(), c.Request())
+		return nil
+	}
+}
+
+// davAuth takes the api key from the password of basic auth, which is what
+// webdav clients support, or from a bearer token
+func (s *Shuttle) davAuth(r *http.Request) (*User, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, pass, ok := r.BasicAuth(); ok {
+		token = pass
+	}
+	if token == "" {
+		return nil, &util.HttpError{
+			Code:    http.StatusUnauthorized,
+			Reason:  util.ERR_AUTH_MISSING,
+			Details: "no api key was specified",
+		}
+	}
+
+	u, err := s.checkTokenAuth(token)
+	if err != nil {
+		return nil, err
+	}
+	if u.Perms < util.PermLevelUser || !util.ScopesAllow(u.Scopes, util.DefaultScopes(util.PermLevelUser, r.Method)) {
+		return nil, &util.HttpError{
+			Code:   http.StatusUnauthorized,
+			Reason: util.ERR_NOT_AUTHORIZED,
+		}
+	}
+	return u, nil
+}
+
+// primaryAPI calls an endpoint of the primary as u, decoding the response
+// into out if it is set
+func (s *Shuttle) primaryAPI(ctx context.Context, u *User, method, endpoint string, body, out interface{}) error {
+	scheme := "https"
+	if s.dev {
+		scheme = "http"
+	}
+
+	var data []byte
+	var rbody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		data = b
+		rbody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, scheme+"://"+s.primaries.host()+endpoint, rbody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+u.AuthToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	s.signPrimaryRequest(req, data)
+
+	resp, err := s.primaryClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		bodyBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		var herr util.HttpErrorResponse
+		if err := json.Unmarshal(bodyBytes, &herr); err == nil && herr.Error.Reason != "" {
+			herr.Error.Code = resp.StatusCode
+			return &herr.Error
+		}
+		return fmt.Errorf("%s %s returned %d: %s", method, endpoint, resp.StatusCode, bodyBytes)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type davCollection struct {
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// davDirs remembers the directories made in collections until something is
+// put in them, collections only know the paths of their content
+type davDirs struct {
+	lk   sync.Mutex
+	dirs map[uint]map[string]bool
+}
+
+func (dd *davDirs) add(user uint, dir string) {
+	dd.lk.Lock()
+	defer dd.lk.Unlock()
+	if dd.dirs == nil {
+		dd.dirs = make(map[uint]map[string]bool)
+	}
+	if dd.dirs[user] == nil {
+		dd.dirs[user] = make(map[string]bool)
+	}
+	dd.dirs[user][dir] = true
+}
+
+func (dd *davDirs) remove(user uint, prefix string) {
+	dd.lk.Lock()
+	defer dd.lk.Unlock()
+	for d := range dd.dirs[user] {
+		if d == prefix || strings.HasPrefix(d, prefix+"/") {
+			delete(dd.dirs[user], d)
+		}
+	}
+}
+
+func (dd *davDirs) list(user uint) []string {
+	dd.lk.Lock()
+	defer dd.lk.Unlock()
+	var out []string
+	for d := range dd.dirs[user] {
+		out = append(out, d)
+	}
+	return out
+}
+
+// davFS is the webdav view of the collections of one user for a single
+// request, collections and their content are fetched from the primary once
+type davFS struct {
+	s *Shuttle
+	u *User
+
+	lk   sync.Mutex
+	cols []davCollection
+	refs map[string][]util.ContentWithPath
+}
+
+func (fs *davFS) collections(ctx context.Context) ([]davCollection, error) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	if fs.cols == nil {
+		var cols []davCollection
+		if err := fs.s.primaryAPI(ctx, fs.u, "GET", "/collections/list", nil, &cols); err != nil {
+			return nil, err
+		}
+		fs.cols = append([]davCollection{}, cols...)
+	}
+	return fs.cols, nil
+}
+
+func (fs *davFS) collection(ctx context.Context, name string) (*davCollection, error) {
+	cols, err := fs.collections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range cols {
+		if cols[i].Name == name {
+			return &cols[i], nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// contents returns the content of a collection, with the full path of each
+func (fs *davFS) contents(ctx context.Context, col *davCollection) ([]util.ContentWithPath, error) {
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	if refs, ok := fs.refs[col.UUID]; ok {
+		return refs, nil
+	}
+
+	var refs []util.ContentWithPath
+	if err := fs.s.primaryAPI(ctx, fs.u, "GET", "/collections/content?coluuid="+col.UUID, nil, &refs); err != nil {
+		return nil, err
+	}
+	for i := range refs {
+		refs[i].Path = refs[i].FullPath()
+	}
+
+	if fs.refs == nil {
+		fs.refs = make(map[string][]util.ContentWithPath)
+	}
+	fs.refs[col.UUID] = refs
+	return refs, nil
+}
+
+func (fs *davFS) dag() ipld.DAGService {
+	bs := fs.s.Node.Blockstore
+	return merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+}
+
+// splitDavPath splits a path into its collection and the path in it
+func splitDavPath(name string) (string, string) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return "", ""
+	}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], "/"
+	}
+	return parts[0], "/" + parts[1]
+}
+
+// davNode is what a path resolved to, a directory listed from the
+// collections or a node of the dag of some content
+type davNode struct {
+	info *davFileInfo
+
+	// children of directories that are not part of a dag
+	children []*davFileInfo
+
+	// nd is set for files and directories in a dag
+	nd ipld.Node
+}
+
+func (fs *davFS) resolve(ctx context.Context, name string) (*davNode, error) {
+	colName, p := splitDavPath(name)
+	if colName == "" {
+		cols, err := fs.collections(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		n := &davNode{info: &davFileInfo{name: "/", dir: true}}
+		for _, col := range cols {
+			n.children = append(n.children, &davFileInfo{name: col.Name, dir: true, mod: col.CreatedAt})
+		}
+		return n, nil
+	}
+
+	col, err := fs.collection(ctx, colName)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := fs.contents(ctx, col)
+	if err != nil {
+		return nil, err
+	}
+
+	// content at or above the path
+	for _, r := range refs {
+		if r.Path == p || (p != "/" && strings.HasPrefix(p, r.Path+"/")) {
+			return fs.resolveContent(ctx, r, strings.TrimPrefix(p, r.Path))
+		}
+	}
+
+	// a directory of the collection holding content
+	dir := &davNode{info: &davFileInfo{name: path.Base(p), dir: true}}
+	if p == "/" {
+		dir.info.name = col.Name
+		dir.info.mod = col.CreatedAt
+	}
+	found := p == "/"
+	seen := make(map[string]bool)
+	addChild := func(rest string, r *util.ContentWithPath) {
+		child := strings.SplitN(rest, "/", 2)
+		if seen[child[0]] {
+			return
+		}
+		seen[child[0]] = true
+
+		if len(child) == 1 && r != nil {
+			dir.children = append(dir.children, contentFileInfo(*r))
+		} else {
+			dir.children = append(dir.children, &davFileInfo{name: child[0], dir: true})
+		}
+	}
+
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for i, r := range refs {
+		if rest := strings.TrimPrefix(r.Path, prefix); rest != r.Path {
+			found = true
+			addChild(rest, &refs[i])
+		}
+	}
+	for _, d := range fs.s.davDirs.list(fs.u.ID) {
+		dc, dp := splitDavPath(d)
+		if dc != colName {
+			continue
+		}
+		if dp == p {
+			found = true
+		}
+		if rest := strings.TrimPrefix(dp, prefix); rest != dp {
+			found = true
+			addChild(rest, nil)
+		}
+	}
+
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return dir, nil
+}
+
+func contentFileInfo(r util.ContentWithPath) *davFileInfo {
+	return &davFileInfo{
+		name: path.Base(r.Path),
+		size: r.Size,
+		dir:  r.Type == util.Directory,
+		mod:  r.UpdatedAt,
+		cid:  r.Cid.CID,
+	}
+}
+
+// resolveContent finds the node at rest in the dag of content r
+func (fs *davFS) resolveContent(ctx context.Context, r util.ContentWithPath, rest string) (*davNode, error) {
+	info := contentFileInfo(r)
+	if rest == "" && !info.dir {
+		// the size and kind of files are known without reading their root
+		return &davNode{info: info}, nil
+	}
+
+	dserv := fs.dag()
+	nd, err := dserv.Get(ctx, r.Cid.CID)
+	if err != nil {
+		if xerrors.Is(err, ipld.ErrNotFound) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+
+	for _, seg := range strings.Split(strings.Trim(rest, "/"), "/") {
+		if seg == "" {
+			continue
+		}
+
+		dir, err := uio.NewDirectoryFromNode(dserv, nd)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+
+		nd, err = dir.Find(ctx, seg)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+		info = dagFileInfo(seg, nd)
+		info.mod = r.UpdatedAt
+	}
+	return &davNode{info: info, nd: nd}, nil
+}
+
+func dagFileInfo(name string, nd ipld.Node) *davFileInfo {
+	info := &davFileInfo{name: name, cid: nd.Cid()}
+	switch nd := nd.(type) {
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return info
+		}
+		info.dir = fsn.IsDir()
+		info.size = int64(fsn.FileSize())
+	default:
+		info.size = int64(len(nd.RawData()))
+	}
+	return info
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	n, err := fs.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info, nil
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) != 0 {
+		return fs.create(ctx, name)
+	}
+
+	n, err := fs.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.info.dir {
+		if n.nd != nil {
+			links, err := uio.NewDirectoryFromNode(fs.dag(), n.nd)
+			if err != nil {
+				return nil, err
+			}
+			lnks, err := links.Links(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range lnks {
+				child, err := l.GetNode(ctx, fs.dag())
+				if err != nil {
+					return nil, err
+				}
+				ci := dagFileInfo(l.Name, child)
+				ci.mod = n.info.mod
+				n.children = append(n.children, ci)
+			}
+		}
+		return &davDir{info: n.info, children: n.children}, nil
+	}
+
+	nd := n.nd
+	if nd == nil {
+		nd, err = fs.dag().Get(ctx, n.info.cid)
+		if err != nil {
+			if xerrors.Is(err, ipld.ErrNotFound) {
+				return nil, os.ErrNotExist
+			}
+			return nil, err
+		}
+	}
+
+	r, err := uio.NewDagReader(ctx, nd, fs.dag())
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{info: n.info, DagReader: r}, nil
+}
+
+func (fs *davFS) create(ctx context.Context, name string) (webdav.File, error) {
+	colName, p := splitDavPath(name)
+	if colName == "" || p == "/" {
+		return nil, os.ErrPermission
+	}
+
+	if fs.u.StorageDisabled || fs.s.addingDisabled() {
+		return nil, os.ErrPermission
+	}
+
+	col, err := fs.collection(ctx, colName)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(fs.s.shuttleConfig.UploadDataDir, "estuary-dav-")
+	if err != nil {
+		return nil, err
+	}
+	return &davUpload{fs: fs, col: col, path: p, limit: fs.s.maxUploadSize(fs.u), File: tmp}, nil
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := fs.resolve(ctx, name); err == nil {
+		return os.ErrExist
+	}
+
+	colName, p := splitDavPath(name)
+	if colName == "" {
+		return os.ErrPermission
+	}
+
+	if p == "/" {
+		return fs.s.primaryAPI(ctx, fs.u, "POST", "/collections/create", map[string]string{
+			"name": colName,
+		}, nil)
+	}
+
+	if _, err := fs.collection(ctx, colName); err != nil {
+		return err
+	}
+	fs.s.davDirs.add(fs.u.ID, "/"+colName+p)
+	return nil
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	colName, p := splitDavPath(name)
+	if colName == "" {
+		return os.ErrPermission
+	}
+
+	col, err := fs.collection(ctx, colName)
+	if err != nil {
+		return err
+	}
+
+	if p == "/" {
+		fs.s.davDirs.remove(fs.u.ID, "/"+colName)
+		return fs.s.primaryAPI(ctx, fs.u, "DELETE", "/collections/"+col.UUID, nil, nil)
+	}
+
+	refs, err := fs.contents(ctx, col)
+	if err != nil {
+		return err
+	}
+
+	var removed bool
+	for _, r := range refs {
+		if r.Path != p && !strings.HasPrefix(r.Path, p+"/") {
+			if strings.HasPrefix(p, r.Path+"/") {
+				// files in the dag of some content can not be removed alone
+				return os.ErrPermission
+			}
+			continue
+		}
+
+		if err := fs.s.primaryAPI(ctx, fs.u, "DELETE", fmt.Sprintf("/pinning/pins/%d", r.ID), nil, nil); err != nil {
+			return err
+		}
+		removed = true
+	}
+	fs.s.davDirs.remove(fs.u.ID, "/"+colName+p)
+
+	fs.lk.Lock()
+	delete(fs.refs, col.UUID)
+	fs.lk.Unlock()
+
+	if !removed {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+type davFileInfo struct {
+	name string
+	size int64
+	dir  bool
+	mod  time.Time
+	cid  cid.Cid
+}
+
+func (fi *davFileInfo) Name() string       { return fi.name }
+func (fi *davFileInfo) Size() int64        { return fi.size }
+func (fi *davFileInfo) ModTime() time.Time { return fi.mod }
+func (fi *davFileInfo) IsDir() bool        { return fi.dir }
+func (fi *davFileInfo) Sys() interface{}   { return nil }
+
+func (fi *davFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// ETag uses the cid of content so clients see it only changes with the data
+func (fi *davFileInfo) ETag(ctx context.Context) (string, error) {
+	if !fi.cid.Defined() {
+		return "", webdav.ErrNotImplemented
+	}
+	return fmt.Sprintf("%q", fi.cid.String()), nil
+}
+
+// ContentType guesses from the file name, the default would read every file
+// listed
+func (fi *davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if ct := mime.TypeByExtension(path.Ext(fi.name)); ct != "" {
+		return ct, nil
+	}
+	return "application/octet-stream", nil
+}
+
+type davDir struct {
+	info     *davFileInfo
+	children []*davFileInfo
+	read     bool
+}
+
+func (d *davDir) Close() error                                 { return nil }
+func (d *davDir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (d *davDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+func (d *davDir) Stat() (os.FileInfo, error)                   { return d.info, nil }
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	if d.read && count > 0 {
+		return nil, io.EOF
+	}
+	d.read = true
+
+	out := make([]os.FileInfo, 0, len(d.children))
+	for _, c := range d.children {
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+type davFile struct {
+	info *davFileInfo
+	uio.DagReader
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+func (f *davFile) Write(p []byte) (int, error)              { return 0, os.ErrPermission }
+func (f *davFile) Stat() (os.FileInfo, error)               { return f.info, nil }
+
+// davUpload buffers a file put over webdav on disk, it is added to the
+// collection once it is closed and replaces what was at its path before
+type davUpload struct {
+	fs      *davFS
+	col     *davCollection
+	path    string
+	limit   int64
+	written int64
+	*os.File
+}
+
+func (f *davUpload) Write(p []byte) (int, error) {
+	if f.limit > 0 && f.written+int64(len(p)) > f.limit {
+		return 0, uploadTooLargeError(f.limit)
+	}
+
+	n, err := f.File.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *davUpload) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (f *davUpload) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &davFileInfo{name: path.Base(f.path), size: fi.Size(), mod: fi.ModTime()}, nil
+}
+
+func (f *davUpload) Close() error {
+	defer os.Remove(f.File.Name())
+	defer f.File.Close()
+
+	fi, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+
+	u := f.fs.u
+	if !u.FlagSplitContent() && fi.Size() > constants.DefaultContentSizeLimit {
+		return fmt.Errorf("content size %d bytes is over the upload size limit of %d bytes", fi.Size(), constants.DefaultContentSizeLimit)
+	}
+
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	resp, err := f.fs.s.addFileContent(ctx, u, f.File, path.Base(f.path), util.ContentInCollection{
+		CollectionID:  f.col.UUID,
+		CollectionDir: f.path,
+	}, util.ImportParams{}, addOptions{Force: true})
+	if err != nil {
+		return err
+	}
+
+	f.fs.s.davDirs.remove(u.ID, "/"+f.col.Name+path.Dir(f.path))
+	f.fs.lk.Lock()
+	delete(f.fs.refs, f.col.UUID)
+	f.fs.lk.Unlock()
+
+	// a put to an existing file replaces it, the content that was there is
+	// removed now that the new one is in place
+	refs, err := f.fs.contents(ctx, f.col)
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		if r.Path != f.path || r.ID == resp.EstuaryId {
+			continue
+		}
+		if err := f.fs.s.primaryAPI(ctx, u, "DELETE", fmt.Sprintf("/pinning/pins/%d", r.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+
+	f.fs.lk.Lock()
+	delete(f.fs.refs, f.col.UUID)
+	f.fs.lk.Unlock()
+	return nil
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// webhookPollInterval is how often due deliveries are looked for when
+	// no new event wakes up the delivery loop
+	webhookPollInterval = 5 * time.Second
+
+	// webhookWorkers bounds the deliveries made at once
+	webhookWorkers = 4
+
+	// webhookMaxBackoff caps the wait between the attempts of a delivery
+	webhookMaxBackoff = 6 * time.Hour
+
+	webhookDeliveryBatch = 100
+)
+
+// WebhookDelivery is an event posted, or still to be posted, to a webhook.
+// NextAttempt is set while the delivery is pending, it is cleared once the
+// event was delivered or given up on.
+type WebhookDelivery struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	WebhookID uint   `gorm:"index" json:"webhook"`
+	UserID    uint   `gorm:"index" json:"-"`
+	EventID   string `json:"eventId"`
+	Event     string `json:"event"`
+	Payload   []byte `json:"-"`
+
+	Attempts    int        `json:"attempts"`
+	NextAttempt *time.Time `gorm:"index" json:"nextAttempt,omitempty"`
+	Delivered   bool       `json:"delivered"`
+	LastStatus  int        `json:"lastStatus,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// webhooks holds the users' webhooks as last sent by the primary, and the
+// deals whose transfers are reported to them
+type webhooks struct {
+	cfg    config.Webhooks
+	client *http.Client
+	kick   chan struct{}
+
+	lk     sync.Mutex
+	loaded bool
+	byUser map[uint][]drpc.Webhook
+	byID   map[uint]drpc.Webhook
+	deals  map[uint]*webhookDeal
+}
+
+type webhookDeal struct {
+	content uint
+	status  string
+}
+
+// newWebhooks returns nil if webhooks are disabled
+func newWebhooks(cfg config.Webhooks) *webhooks {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &webhooks{
+		cfg:    cfg,
+		client: newUrlFetchClient(config.UrlFetch{AllowPrivate: cfg.AllowPrivate}),
+		kick:   make(chan struct{}, 1),
+		byUser: make(map[uint][]drpc.Webhook),
+		byID:   make(map[uint]drpc.Webhook),
+		deals:  make(map[uint]*webhookDeal),
+	}
+}
+
+func (wh *webhooks) set(sw *drpc.SetWebhooks) {
+	wh.lk.Lock()
+	defer wh.lk.Unlock()
+
+	if sw.All {
+		wh.byUser = make(map[uint][]drpc.Webhook)
+		wh.byID = make(map[uint]drpc.Webhook)
+		wh.loaded = true
+	} else {
+		for _, h := range wh.byUser[sw.UserID] {
+			delete(wh.byID, h.ID)
+		}
+		delete(wh.byUser, sw.UserID)
+	}
+
+	for _, h := range sw.Webhooks {
+		wh.byUser[h.UserID] = append(wh.byUser[h.UserID], h)
+		wh.byID[h.ID] = h
+	}
+}
+
+func (wh *webhooks) isLoaded() bool {
+	wh.lk.Lock()
+	defer wh.lk.Unlock()
+	return wh.loaded
+}
+
+// forEvent returns the webhooks of a user that get event
+func (wh *webhooks) forEvent(userID uint, event string) []drpc.Webhook {
+	wh.lk.Lock()
+	defer wh.lk.Unlock()
+
+	var out []drpc.Webhook
+	for _, h := range wh.byUser[userID] {
+		for _, ev := range h.Events {
+			if ev == event {
+				out = append(out, h)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (wh *webhooks) get(id uint) (drpc.Webhook, bool) {
+	wh.lk.Lock()
+	defer wh.lk.Unlock()
+	h, ok := wh.byID[id]
+	return h, ok
+}
+
+func (wh *webhooks) trackDeal(deal, content uint) {
+	wh.lk.Lock()
+	defer wh.lk.Unlock()
+	if _, ok := wh.deals[deal]; !ok {
+		wh.deals[deal] = &webhookDeal{content: content}
+	}
+}
+
+// dealStatus records the transfer status of a deal. It returns the content
+// of the deal if it is tracked and the status changed. Deals are forgotten
+// once their transfer is over.
+func (wh *webhooks) dealStatus(deal uint, status string, done bool) (uint, bool) {
+	wh.lk.Lock()
+	defer wh.lk.Unlock()
+
+	d, ok := wh.deals[deal]
+	if !ok {
+		return 0, false
+	}
+	if done {
+		delete(wh.deals, deal)
+	}
+	if d.status == status {
+		return 0, false
+	}
+	d.status = status
+	return d.content, true
+}
+
+func (wh *webhooks) wake() {
+	select {
+	case wh.kick <- struct{}{}:
+	default:
+	}
+}
+
+// nextAttempt returns when a delivery that failed attempts times is tried
+// again, nil once it is given up on
+func (wh *webhooks) nextAttempt(attempts int, now time.Time) *time.Time {
+	if attempts >= wh.cfg.MaxAttempts {
+		return nil
+	}
+
+	backoff := wh.cfg.RetryBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+
+	next := now.Add(backoff)
+	return &next
+}
+
+// emitWebhookEvent queues ev for delivery to the webhooks of the user that
+// get it
+func (s *Shuttle) emitWebhookEvent(userID uint, ev *util.WebhookEvent) {
+	if s.webhooks == nil {
+		return
+	}
+
+	hooks := s.webhooks.forEvent(userID, ev.Event)
+	if len(hooks) == 0 {
+		return
+	}
+
+	now := time.Now()
+	ev.ID = uuid.New().String()
+	ev.CreatedAt = now
+	ev.Shuttle = s.shuttleHandle
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Errorf("failed to encode webhook event: %s", err)
+		return
+	}
+
+	for _, h := range hooks {
+		d := &WebhookDelivery{
+			WebhookID:   h.ID,
+			UserID:      userID,
+			EventID:     ev.ID,
+			Event:       ev.Event,
+			Payload:     body,
+			NextAttempt: &now,
+		}
+		if err := s.DB.Create(d).Error; err != nil {
+			log.Errorw("failed to queue webhook delivery", "webhook", h.ID, "event", ev.Event, "err", err)
+		}
+	}
+	s.webhooks.wake()
+}
+
+// notifyPinWebhooks reports a completed or failed pin to the webhooks of
+// its user
+func (s *Shuttle) notifyPinWebhooks(cont uint, event string) {
+	if s.webhooks == nil {
+		return
+	}
+
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", cont).Error; err != nil {
+		log.Errorf("failed to look up pin %d for webhooks: %s", cont, err)
+		return
+	}
+
+	ev := &util.WebhookEvent{
+		Event:   event,
+		Content: cont,
+		Size:    pin.Size,
+	}
+	if pin.Cid.CID.Defined() {
+		ev.Cid = pin.Cid.CID.String()
+	}
+	if n := len(pin.AttemptErrors); event == util.WebhookPinFailed && n > 0 {
+		ev.Error = pin.AttemptErrors[n-1].Error
+		ev.Reason = string(pin.FailureReason)
+	}
+	s.emitWebhookEvent(pin.UserID, ev)
+}
+
+// notifyTransferWebhooks reports the changes of the transfer status of a
+// deal to the webhooks of the user of its content
+func (s *Shuttle) notifyTransferWebhooks(st *drpc.TransferStatus) {
+	if s.webhooks == nil {
+		return
+	}
+
+	var status string
+	var done bool
+	switch {
+	case st.Failed:
+		status, done = datatransfer.Statuses[datatransfer.Failed], true
+	case st.State != nil:
+		status = datatransfer.Statuses[st.State.Status]
+		switch st.State.Status {
+		case datatransfer.Completed, datatransfer.Failed, datatransfer.Cancelled:
+			done = true
+		}
+	default:
+		return
+	}
+
+	cont, changed := s.webhooks.dealStatus(st.DealDBID, status, done)
+	if !changed {
+		return
+	}
+
+	var pin Pin
+	if err := s.DB.First(&pin, "content = ?", cont).Error; err != nil {
+		log.Errorf("failed to look up pin %d for webhooks: %s", cont, err)
+		return
+	}
+
+	ev := &util.WebhookEvent{
+		Event:          util.WebhookTransferStatus,
+		Content:        cont,
+		Deal:           st.DealDBID,
+		TransferStatus: status,
+		Message:        st.Message,
+	}
+	if pin.Cid.CID.Defined() {
+		ev.Cid = pin.Cid.CID.String()
+	}
+	if st.State != nil && ev.Message == "" {
+		ev.Message = st.State.Message
+	}
+	s.emitWebhookEvent(pin.UserID, ev)
+}
+
+func (s *Shuttle) handleRpcSetWebhooks(ctx context.Context, req *drpc.SetWebhooks) error {
+	if s.webhooks == nil {
+		return nil
+	}
+	s.webhooks.set(req)
+	s.webhooks.wake()
+	return nil
+}
+
+// runWebhookDeliveries posts the queued webhook events and prunes the
+// delivery log. Nothing is delivered before the primary sent the webhooks.
+func (s *Shuttle) runWebhookDeliveries() {
+	poll := time.NewTicker(webhookPollInterval)
+	defer poll.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-poll.C:
+		case <-s.webhooks.kick:
+		case <-prune.C:
+			if err := s.pruneWebhookDeliveries(time.Now()); err != nil {
+				log.Errorf("failed to prune webhook deliveries: %s", err)
+			}
+			continue
+		case <-s.shuttingDown:
+			return
+		}
+
+		if !s.webhooks.isLoaded() {
+			continue
+		}
+		if err := s.deliverDueWebhooks(context.Background(), time.Now()); err != nil {
+			log.Errorf("failed to deliver webhooks: %s", err)
+		}
+	}
+}
+
+func (s *Shuttle) deliverDueWebhooks(ctx context.Context, now time.Time) error {
+	var due []WebhookDelivery
+	if err := s.DB.Where("next_attempt <= ?", now).Order("next_attempt").Limit(webhookDeliveryBatch).Find(&due).Error; err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, webhookWorkers)
+	var wg sync.WaitGroup
+	for i := range due {
+		d := &due[i]
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			s.attemptWebhookDelivery(ctx, d)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (s *Shuttle) attemptWebhookDelivery(ctx context.Context, d *WebhookDelivery) {
+	updates := map[string]interface{}{}
+
+	h, ok := s.webhooks.get(d.WebhookID)
+	if !ok {
+		updates["next_attempt"] = nil
+		updates["last_error"] = "the webhook was removed"
+	} else {
+		status, err := s.postWebhook(ctx, h, d)
+		d.Attempts++
+		updates["attempts"] = d.Attempts
+		updates["last_status"] = status
+		if err == nil {
+			updates["delivered"] = true
+			updates["next_attempt"] = nil
+			updates["last_error"] = ""
+		} else {
+			log.Debugw("webhook delivery failed", "webhook", h.ID, "event", d.EventID, "attempt", d.Attempts, "err", err)
+			updates["next_attempt"] = s.webhooks.nextAttempt(d.Attempts, time.Now())
+			updates["last_error"] = err.Error()
+		}
+	}
+
+	if err := s.DB.Model(&WebhookDelivery{}).Where("id = ?", d.ID).UpdateColumns(updates).Error; err != nil {
+		log.Errorf("failed to update webhook delivery %d: %s", d.ID, err)
+	}
+}
+
+// postWebhook posts the event of a delivery to its webhook, signed with
+// the webhook's secret
+func (s *Shuttle) postWebhook(ctx context.Context, h drpc.Webhook, d *WebhookDelivery) (int, error) {
+	if s.webhooks.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.webhooks.cfg.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(util.WebhookEventHeader, d.Event)
+	req.Header.Set(util.WebhookDeliveryHeader, d.EventID)
+	req.Header.Set(util.WebhookSignatureHeader, util.WebhookSignature(h.Secret, time.Now().Unix(), d.Payload))
+
+	resp, err := s.webhooks.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// pruneWebhookDeliveries removes the finished deliveries older than the log
+// retention
+func (s *Shuttle) pruneWebhookDeliveries(now time.Time) error {
+	return s.DB.Where("next_attempt is null and updated_at < ?", now.Add(-s.webhooks.cfg.LogRetention)).Delete(&WebhookDelivery{}).Error
+}
+
+// handleGetWebhookDeliveries godoc
+// @Summary      Webhook delivery log
+// @Description  This endpoint lists the latest deliveries of the user's webhook events made by this shuttle, pending ones included, optionally of one webhook
+// @Tags         webhooks
+// @Produce      json
+// @Param        webhook  query  int  false  "Webhook id"
+// @Param        limit    query  int  false  "Most deliveries listed, 100 by default and at most 1000"
+// @Router       /webhooks/deliveries [get]
+func (s *Shuttle) handleGetWebhookDeliveries(c echo.Context, u *User) error {
+	limit := 100
+	if l := c.QueryParam("limit"); l != "" {
+		v, err := strconv.Atoi(l)
+		if err != nil || v < 1 || v > 1000 {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: fmt.Sprintf("invalid limit %q, must be between 1 and 1000", l),
+			}
+		}
+		limit = v
+	}
+
+	q := s.readDB().Where("user_id = ?", u.ID)
+	if wid := c.QueryParam("webhook"); wid != "" {
+		v, err := strconv.ParseUint(wid, 10, 64)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_QUERY_PARAM_VALUE,
+				Details: fmt.Sprintf("invalid webhook id %q", wid),
+			}
+		}
+		q = q.Where("webhook_id = ?", v)
+	}
+
+	deliveries := []WebhookDelivery{}
+	if err := q.Order("id desc").Limit(limit).Find(&deliveries).Error; err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
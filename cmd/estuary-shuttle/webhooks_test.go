@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSet(t *testing.T) {
+	cfg := newTestShuttle(t).shuttleConfig.Webhooks
+	wh := newWebhooks(cfg)
+
+	wh.set(&drpc.SetWebhooks{All: true, Webhooks: []drpc.Webhook{
+		{ID: 1, UserID: 7, Events: []string{util.WebhookPinComplete}},
+		{ID: 2, UserID: 7, Events: util.WebhookEvents},
+		{ID: 3, UserID: 8, Events: util.WebhookEvents},
+	}})
+	assert.True(t, wh.isLoaded())
+	assert.Len(t, wh.forEvent(7, util.WebhookPinComplete), 2)
+	assert.Len(t, wh.forEvent(7, util.WebhookPinFailed), 1)
+
+	wh.set(&drpc.SetWebhooks{UserID: 7})
+	assert.Empty(t, wh.forEvent(7, util.WebhookPinComplete))
+	_, ok := wh.get(1)
+	assert.False(t, ok, "removed webhooks are forgotten")
+	assert.Len(t, wh.forEvent(8, util.WebhookPinComplete), 1, "other users keep their webhooks")
+
+	wh.trackDeal(5, 42)
+	cont, changed := wh.dealStatus(5, "Ongoing", false)
+	assert.True(t, changed)
+	assert.Equal(t, uint(42), cont)
+	_, changed = wh.dealStatus(5, "Ongoing", false)
+	assert.False(t, changed, "only changes are reported")
+	_, changed = wh.dealStatus(5, "Completed", true)
+	assert.True(t, changed)
+	_, changed = wh.dealStatus(5, "Failed", true)
+	assert.False(t, changed, "finished transfers are forgotten")
+
+	now := time.Now()
+	assert.Equal(t, now.Add(cfg.RetryBackoff), *wh.nextAttempt(1, now))
+	assert.Equal(t, now.Add(4*cfg.RetryBackoff), *wh.nextAttempt(3, now))
+	assert.Nil(t, wh.nextAttempt(cfg.MaxAttempts, now))
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	s := newTestShuttle(t)
+	s.shuttleHandle = "SHUTTLE1"
+	s.shuttleConfig.Webhooks.AllowPrivate = true
+	s.webhooks = newWebhooks(s.shuttleConfig.Webhooks)
+
+	fail := true
+	var got []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		assert.NoError(t, util.VerifyWebhookSignature("whsec_test", r.Header.Get(util.WebhookSignatureHeader), body, time.Minute, time.Now()))
+		assert.Equal(t, util.WebhookPinComplete, r.Header.Get(util.WebhookEventHeader))
+		got = body
+	}))
+	defer srv.Close()
+
+	s.webhooks.set(&drpc.SetWebhooks{All: true, Webhooks: []drpc.Webhook{
+		{ID: 1, UserID: 0, URL: srv.URL, Secret: "whsec_test", Events: util.WebhookEvents},
+	}})
+
+	addTestPin(t, s, 1, blocks.NewBlock([]byte("root")))
+	s.notifyPinWebhooks(1, util.WebhookPinComplete)
+
+	ctx := context.Background()
+	require.NoError(t, s.deliverDueWebhooks(ctx, time.Now()))
+
+	var d WebhookDelivery
+	require.NoError(t, s.DB.First(&d).Error)
+	assert.Equal(t, 1, d.Attempts)
+	assert.Equal(t, http.StatusBadGateway, d.LastStatus)
+	require.NotNil(t, d.NextAttempt, "failed deliveries are retried")
+
+	fail = false
+	require.NoError(t, s.deliverDueWebhooks(ctx, d.NextAttempt.Add(time.Second)))
+	require.NoError(t, s.DB.First(&d).Error)
+	assert.True(t, d.Delivered)
+	assert.Nil(t, d.NextAttempt)
+	assert.Contains(t, string(got), `"shuttle":"SHUTTLE1"`)
+
+	require.NoError(t, s.pruneWebhookDeliveries(time.Now().Add(s.shuttleConfig.Webhooks.LogRetention+time.Hour)))
+	assert.Error(t, s.DB.First(&d).Error, "old deliveries are pruned")
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AdminAccess limits where the admin api and the debug endpoints, pprof
+// included, can be reached from. A leaked admin token is then of no use
+// from anywhere else.
+type AdminAccess struct {
+	// AllowedIPs are the addresses and CIDR ranges allowed, empty allows all
+	AllowedIPs []string `json:"allowed_ips"`
+
+	// TrustedProxies are the addresses and CIDR ranges of the proxies in
+	// front of the api. The client address is taken from the X-Forwarded-For
+	// header they set, and is the address of the connection otherwise.
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// ParseNetworks parses addresses and CIDR ranges, an address is a range of
+// only itself
+func ParseNetworks(addrs []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, a := range addrs {
+		if !strings.Contains(a, "/") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address %q", a)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr range %q: %w", a, err)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
@@ -0,0 +1,20 @@
+package config
+
+import "time"
+
+// Aggregation groups the small contents of each user on the shuttle into
+// aggregates big enough to make deals for, instead of leaving that to the
+// staging zones of the primary.
+type Aggregation struct {
+	// MaxContentSize is the size up to which content is aggregated, zero
+	// disables aggregation
+	MaxContentSize int64 `json:"max_content_size"`
+
+	// TargetSize is the size aggregates are filled up to
+	TargetSize int64 `json:"target_size"`
+
+	// MaxAge is how long content waits for an aggregate to fill up, after
+	// that the aggregate is made with what there is as long as it is big
+	// enough for a deal
+	MaxAge time.Duration `json:"max_age"`
+}
@@ -0,0 +1,10 @@
+package config
+
+import "time"
+
+type AuthCache struct {
+	Size        int           `json:"size"`
+	TTL         time.Duration `json:"ttl"`
+	NegativeTTL time.Duration `json:"negative_ttl"` // how long rejected tokens are remembered
+	LocalAuth   bool          `json:"local_auth"`   // check JWT api keys without asking the primary
+}
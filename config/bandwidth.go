@@ -0,0 +1,9 @@
+package config
+
+// Bandwidth caps what the node sends over bitswap and deal transfers, in
+// bytes per second. Other traffic, like the api and the rpc connection of a
+// shuttle, is not counted.
+type Bandwidth struct {
+	MaxOut        int64 `json:"max_out"`          // zero for no cap
+	MaxOutPerPeer int64 `json:"max_out_per_peer"` // zero for no cap
+}
@@ -3,4 +3,13 @@ package config
 type Bitswap struct {
 	MaxOutstandingBytesPerPeer int64 `json:"max_outstanding_bytes_per_peer"`
 	TargetMessageSize          int   `json:"target_message_size"`
+
+	// worker counts, zero leaves the node's defaults
+	EngineTaskWorkers       int `json:"engine_task_workers"`
+	EngineBlockstoreWorkers int `json:"engine_blockstore_workers"`
+	TaskWorkers             int `json:"task_workers"`
+
+	// NoProvide stops bitswap from announcing the blocks it receives, content
+	// is still announced by the node's own provider
+	NoProvide bool `json:"no_provide"`
 }
@@ -0,0 +1,21 @@
+package config
+
+// BlockstoreCache sizes the caches in front of the blockstore, they are all
+// skipped with Node.NoBlockstoreCache
+type BlockstoreCache struct {
+	// HasCacheSize is the number of blocks whose presence and size are
+	// remembered, about 32 bytes each
+	HasCacheSize int `json:"has_cache_size"`
+
+	// BloomFilterSize is the size in bytes of the bloom filter answering Has
+	// for blocks that are not stored, zero disables it. The filter is built
+	// by listing every block at startup.
+	BloomFilterSize   int `json:"bloom_filter_size"`
+	BloomFilterHashes int `json:"bloom_filter_hashes"`
+
+	// BlockCacheSize is the number of blocks whose data is kept in memory,
+	// zero disables it. Blocks larger than BlockCacheMaxBlockSize are not
+	// cached, so it takes at most the product of both.
+	BlockCacheSize         int `json:"block_cache_size"`
+	BlockCacheMaxBlockSize int `json:"block_cache_max_block_size"`
+}
@@ -0,0 +1,15 @@
+package config
+
+import "time"
+
+// CarExport controls the exports of all of a user's content as car files
+type CarExport struct {
+	Dir string `json:"dir"`
+
+	// MaxCarSize is the size at which an export continues in another car
+	// file. Zero disables exports.
+	MaxCarSize int64 `json:"max_car_size"`
+
+	// Expiry is how long the files of a finished export can be downloaded
+	Expiry time.Duration `json:"expiry"`
+}
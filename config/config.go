@@ -1,18 +1,41 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/BurntSushi/toml"
 	"github.com/facebookgo/atomicfile"
+	"gopkg.in/yaml.v3"
 )
 
 var ErrNotInitialized = errors.New("node not initialized, please run configure")
 
+const (
+	formatJSON = "json"
+	formatTOML = "toml"
+	formatYAML = "yaml"
+)
+
+// fileFormat picks the config encoding from the file extension, anything
+// other than toml or yaml is JSON
+func fileFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".toml":
+		return formatTOML
+	case ".yaml", ".yml":
+		return formatYAML
+	default:
+		return formatJSON
+	}
+}
+
 // encode configuration with JSON
 func encode(cfg interface{}, w io.Writer) error {
 	// need to prettyprint, hence MarshalIndent, instead of Encoder
@@ -24,25 +47,111 @@ func encode(cfg interface{}, w io.Writer) error {
 	return err
 }
 
-func load(cfg interface{}, filename string) (err error) {
-	f, err := os.Open(filepath.Clean(filename))
+// encodeAs writes the config in the given format. TOML and YAML files use
+// the same keys as the JSON config, so the config is converted through its
+// JSON form rather than needing separate struct tags.
+func encodeAs(format string, cfg interface{}, w io.Writer) error {
+	if format == formatJSON {
+		return encode(cfg, w)
+	}
+
+	buf, err := json.Marshal(cfg)
 	if err != nil {
-		if os.IsNotExist(err) {
-			err = ErrNotInitialized
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var m interface{}
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+	m = fromJSONValue(m)
+
+	switch format {
+	case formatTOML:
+		return toml.NewEncoder(w).Encode(m)
+	case formatYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+		return enc.Close()
+	default:
+		return fmt.Errorf("unknown config format %q", format)
+	}
+}
+
+// fromJSONValue turns json numbers back into ints or floats and drops null
+// values, which TOML cant represent
+func fromJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if val == nil {
+				delete(v, k)
+				continue
+			}
+			v[k] = fromJSONValue(val)
+		}
+		return v
+	case []interface{}:
+		for i, val := range v {
+			v[i] = fromJSONValue(val)
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
 		}
+		f, _ := v.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+func decodeAs(format string, data []byte, cfg interface{}) error {
+	var m map[string]interface{}
+	switch format {
+	case formatJSON:
+		return json.Unmarshal(data, cfg)
+	case formatTOML:
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return err
+		}
+	case formatYAML:
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown config format %q", format)
+	}
+
+	buf, err := json.Marshal(m)
+	if err != nil {
 		return err
 	}
+	return json.Unmarshal(buf, cfg)
+}
 
-	defer func() {
-		if errC := f.Close(); errC != nil {
-			err = errC
+// load reads the config from `filename` into `cfg`, in JSON, TOML or YAML
+// depending on the file extension. Settings missing from the file keep the
+// values already in `cfg`.
+func load(cfg interface{}, filename string) error {
+	data, err := os.ReadFile(filepath.Clean(filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = ErrNotInitialized
 		}
-	}()
+		return err
+	}
 
-	if err := json.NewDecoder(f).Decode(cfg); err != nil {
+	if err := decodeAs(fileFormat(filename), data, cfg); err != nil {
 		return fmt.Errorf("failure to decode config: %s", err)
 	}
-	return err
+	return nil
 }
 
 // save writes the config from `cfg` into `filename`.
@@ -58,7 +167,7 @@ func save(cfg interface{}, filename string) error {
 	}
 	defer f.Close()
 
-	return encode(cfg, f)
+	return encodeAs(fileFormat(filename), cfg, f)
 }
 
 var ErrEmptyPath = errors.New("node not initialized, please run configure")
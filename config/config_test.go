@@ -65,6 +65,7 @@ func TestShuttleDefaultSanity(t *testing.T) {
 
 	assert.NotEmpty(config.DataDir)
 	assert.NotEmpty(config.StagingDataDir)
+	assert.NotEmpty(config.UploadDataDir)
 	assert.NotEmpty(config.DatabaseConnString)
 	assert.NotEmpty(config.ApiListen)
 	assert.NotEmpty(config.EstuaryRemote.Api)
@@ -93,6 +94,10 @@ func TestApplyLimits(t *testing.T) {
 	assert.Equal(limiter.TransientLimits.GetStreamTotalLimit(), config.TransientLimit.Streams)
 	assert.Equal(limiter.SystemLimits.GetFDLimit(), config.SystemLimit.FD)
 	assert.Equal(limiter.TransientLimits.GetFDLimit(), config.TransientLimit.FD)
+	assert.Equal(limiter.DefaultPeerLimits.GetStreamLimit(network.DirInbound), config.PeerLimit.StreamsInbound)
+	assert.Equal(limiter.DefaultPeerLimits.GetStreamTotalLimit(), config.PeerLimit.Streams)
+	assert.Equal(limiter.DefaultPeerLimits.GetConnTotalLimit(), config.PeerLimit.Conns)
+	assert.Equal(limiter.DefaultPeerLimits.GetFDLimit(), config.PeerLimit.FD)
 }
 
 func TestEstuaryJSONRoundtrip(t *testing.T) {
@@ -114,3 +119,55 @@ func TestShuttleJSONRoundtrip(t *testing.T) {
 	load(&config2, path)
 	assert.Equal(config, &config2)
 }
+
+func TestShuttleTOMLRoundtrip(t *testing.T) {
+	assert := assert.New(t)
+	config := NewShuttle("test-version")
+	path := filepath.Join(t.TempDir(), "shuttle.toml")
+	assert.NoError(save(config, path))
+	config2 := Shuttle{}
+	assert.NoError(load(&config2, path))
+	assert.Equal(config, &config2)
+}
+
+func TestShuttleYAMLRoundtrip(t *testing.T) {
+	assert := assert.New(t)
+	config := NewShuttle("test-version")
+	path := filepath.Join(t.TempDir(), "shuttle.yaml")
+	assert.NoError(save(config, path))
+	config2 := Shuttle{}
+	assert.NoError(load(&config2, path))
+	assert.Equal(config, &config2)
+}
+
+func TestShuttlePartialYAML(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "shuttle.yml")
+	assert.NoError(os.WriteFile(path, []byte(`
+api_listen: ":4000"
+logging:
+  level: debug
+node:
+  blockstore: /mnt/blocks
+`), 0600))
+
+	config := NewShuttle("test-version")
+	assert.NoError(load(config, path))
+	assert.Equal(":4000", config.ApiListen)
+	assert.Equal("debug", config.Logging.Level)
+	assert.Equal("/mnt/blocks", config.Node.Blockstore)
+	assert.Equal(NewShuttle("test-version").Hostname, config.Hostname, "settings missing from the file keep their defaults")
+}
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := ParseNetworks([]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::1"})
+	assert.NoError(t, err)
+	assert.Len(t, nets, 3)
+	assert.Equal(t, "192.0.2.7/32", nets[1].String())
+	assert.Equal(t, "2001:db8::1/128", nets[2].String())
+
+	_, err = ParseNetworks([]string{"10.0.0.300"})
+	assert.Error(t, err)
+	_, err = ParseNetworks([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
@@ -1,6 +1,19 @@
 package config
 
 type Content struct {
-	DisableLocalAdding  bool `json:"disable_local_adding"`
-	DisableGlobalAdding bool `json:"disable_global_adding"` // not valid for shuttle
+	DisableLocalAdding       bool        `json:"disable_local_adding"`
+	DisableGlobalAdding      bool        `json:"disable_global_adding"`      // not valid for shuttle
+	RequireShuttleSignatures bool        `json:"require_shuttle_signatures"` // not valid for shuttle
+	StreamingImport          bool        `json:"streaming_import"`           // only valid for shuttle
+	CommPOnImport            bool        `json:"commp_on_import"`            // only valid for shuttle
+	MaxChunkSize             int64       `json:"max_chunk_size"`             // only valid for shuttle
+	MaxUploadSize            int64       `json:"max_upload_size"`            // only valid for shuttle, zero disables the limit
+	StagingCopy              StagingCopy `json:"staging_copy"`               // only valid for shuttle
+}
+
+// StagingCopy tunes copying staged uploads into the main blockstore
+type StagingCopy struct {
+	Workers        int   `json:"workers"`
+	MaxBatchBlocks int   `json:"max_batch_blocks"`
+	MaxBatchBytes  int64 `json:"max_batch_bytes"`
 }
@@ -0,0 +1,15 @@
+package config
+
+import "time"
+
+type Database struct {
+	MaxOpenConns    int           `json:"max_open_conns"`
+	MaxIdleConns    int           `json:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `json:"conn_max_lifetime"` // zero keeps connections forever
+	ConnMaxIdleTime time.Duration `json:"conn_max_idle_time"`
+
+	// ReadReplicaConnString is a database in the same format as the main one
+	// that replicates it. Admin listings and stats are read from it, reads
+	// that have to see writes just made always go to the main database.
+	ReadReplicaConnString string `json:"read_replica_conn_string"`
+}
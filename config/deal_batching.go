@@ -0,0 +1,10 @@
+package config
+
+import "time"
+
+// DealBatching paces the data transfers a shuttle opens for deals, transfers
+// to the same miner are started BatchSize at a time with Pacing in between
+type DealBatching struct {
+	BatchSize int           `json:"batch_size"` // zero starts every transfer right away
+	Pacing    time.Duration `json:"pacing"`
+}
@@ -0,0 +1,15 @@
+package config
+
+type Debug struct {
+	// Pprof serves the pprof endpoints on the metrics listener, which has no
+	// auth and should only listen on a private address
+	Pprof bool `json:"pprof"`
+
+	// PprofOnApi serves the pprof endpoints under /admin/debug/pprof on the
+	// api, behind admin auth
+	PprofOnApi bool `json:"pprof_on_api"`
+
+	// SnapshotDir is where goroutine and heap snapshots taken through the
+	// admin api are written
+	SnapshotDir string `json:"snapshot_dir"`
+}
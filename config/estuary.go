@@ -1,7 +1,9 @@
 package config
 
 import (
+	"errors"
 	"path/filepath"
+	"time"
 
 	"github.com/application-research/estuary/node/modules/peering"
 	"github.com/application-research/filclient"
@@ -30,6 +32,8 @@ type Estuary struct {
 	Logging                Logging   `json:"logging"`
 	FilClient              FilClient `json:"fil_client"`
 	ShuttleMessageHandlers int       `json:"shuttle_message_Handlers"`
+	AuthKeyFile            string    `json:"auth_key_file"` // signs JWT api keys
+	TLS                    ServerTLS `json:"tls"`
 }
 
 func (cfg *Estuary) Load(filename string) error {
@@ -49,10 +53,18 @@ func (cfg *Estuary) SetRequiredOptions() error {
 	cfg.Node.WalletDir = filepath.Join(cfg.DataDir, "estuary-wallet")
 	cfg.Node.DatastoreDir = filepath.Join(cfg.DataDir, "estuary-leveldb")
 	cfg.Node.Libp2pKeyFile = filepath.Join(cfg.DataDir, "estuary-peer.key")
+	cfg.AuthKeyFile = filepath.Join(cfg.DataDir, "estuary-auth.key")
 
 	if cfg.Node.Blockstore == "" {
 		cfg.Node.Blockstore = filepath.Join(cfg.DataDir, "estuary-blocks")
 	}
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return errors.New("both a tls certificate and key file have to be specified")
+	}
+	if cfg.TLS.ShuttleCAFile != "" && !cfg.TLS.Enabled() {
+		return errors.New("shuttle client certificates can only be checked when the api is served over tls")
+	}
 	return nil
 }
 
@@ -103,7 +115,13 @@ func NewEstuary(appVersion string) *Estuary {
 			WriteLogDir:       "",
 			HardFlushWriteLog: false,
 			WriteLogTruncate:  false,
+			WriteLogMaxSize:   16 << 30,
+			WriteLogMaxAge:    time.Hour,
 			NoBlockstoreCache: false,
+			BlockstoreCache: BlockstoreCache{
+				HasCacheSize:      8 << 20,
+				BloomFilterHashes: 7,
+			},
 
 			IndexerURL:          "https://cid.contact",
 			IndexerTickInterval: 720,
@@ -113,6 +131,8 @@ func NewEstuary(appVersion string) *Estuary {
 			Bitswap: Bitswap{
 				MaxOutstandingBytesPerPeer: 5 << 20,
 				TargetMessageSize:          0,
+				EngineBlockstoreWorkers:    600,
+				TaskWorkers:                600,
 			},
 
 			NoLimiter: true,
@@ -143,11 +163,34 @@ func NewEstuary(appVersion string) *Estuary {
 
 					FD: 1024,
 				},
+				PeerLimit: PeerLimit{
+					MinMemory:      64 << 20,
+					MaxMemory:      256 << 20,
+					MemoryFraction: 1.0 / 64,
+
+					StreamsInbound:  256,
+					StreamsOutbound: 512,
+					Streams:         1024,
+
+					ConnsInbound:  8,
+					ConnsOutbound: 8,
+					Conns:         16,
+
+					FD: 8,
+				},
 			},
 			ConnectionManager: ConnectionManager{
 				LowWater:  2000,
 				HighWater: 3000,
 			},
+			Relay: Relay{
+				Client:       true,
+				Service:      false,
+				HolePunching: false,
+			},
+			Provider: Provider{
+				Strategy: ProvideRoots,
+			},
 		},
 		ShuttleMessageHandlers: 30,
 	}
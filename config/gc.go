@@ -0,0 +1,10 @@
+package config
+
+import "time"
+
+type GarbageCollection struct {
+	Interval   time.Duration `json:"interval"` // zero disables scheduled collection
+	BatchSize  int           `json:"batch_size"`
+	BatchDelay time.Duration `json:"batch_delay"`
+	DryRun     bool          `json:"dry_run"`
+}
@@ -0,0 +1,18 @@
+package config
+
+import "time"
+
+// Integrity controls the background check of the blocks in the blockstore
+// against their cids
+type Integrity struct {
+	// Interval is how often a sample of the stored blocks is checked, zero
+	// disables the check
+	Interval   time.Duration `json:"interval"`
+	SampleSize int           `json:"sample_size"`
+
+	// Refetch fetches corrupted and missing blocks again over bitswap,
+	// otherwise the pins holding them are only flagged. Pins are flagged
+	// as well when the block cannot be fetched within RefetchTimeout.
+	Refetch        bool          `json:"refetch"`
+	RefetchTimeout time.Duration `json:"refetch_timeout"`
+}
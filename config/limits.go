@@ -38,12 +38,36 @@ func (tl *TransientLimit) apply(lim *rcmgr.BasicLimiter) {
 	lim.TransientLimits = lim.TransientLimits.WithFDLimit(tl.FD).WithConnLimit(tl.ConnsInbound, tl.ConnsOutbound, tl.Conns).WithStreamLimit(tl.StreamsInbound, tl.StreamsOutbound, tl.Streams)
 }
 
+// PeerLimit applies to each remote peer on its own, it keeps a single peer
+// from taking up the system limits
+type PeerLimit struct {
+	MinMemory      int64   `json:"min_memory"`
+	MaxMemory      int64   `json:"max_memory"`
+	MemoryFraction float64 `json:"memory_fraction"`
+
+	StreamsInbound  int `json:"streams_inbound"`
+	StreamsOutbound int `json:"streams_outbound"`
+	Streams         int `json:"streams"`
+
+	ConnsInbound  int `json:"conns_inbound"`
+	ConnsOutbound int `json:"conns_outbound"`
+	Conns         int `json:"conns"`
+
+	FD int `json:"fd"`
+}
+
+func (pl *PeerLimit) apply(lim *rcmgr.BasicLimiter) {
+	lim.DefaultPeerLimits = lim.DefaultPeerLimits.WithFDLimit(pl.FD).WithConnLimit(pl.ConnsInbound, pl.ConnsOutbound, pl.Conns).WithStreamLimit(pl.StreamsInbound, pl.StreamsOutbound, pl.Streams).WithMemoryLimit(pl.MemoryFraction, pl.MinMemory, pl.MaxMemory)
+}
+
 type Limits struct {
 	SystemLimit    SystemLimit    `json:"system_limit"`
 	TransientLimit TransientLimit `json:"transient_limit"`
+	PeerLimit      PeerLimit      `json:"peer_limit"`
 }
 
 func (limits *Limits) apply(lim *rcmgr.BasicLimiter) {
 	limits.SystemLimit.apply(lim)
 	limits.TransientLimit.apply(lim)
+	limits.PeerLimit.apply(lim)
 }
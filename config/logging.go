@@ -2,4 +2,9 @@ package config
 
 type Logging struct {
 	ApiEndpointLogging bool `json:"api_endpoint_logging"`
+
+	// Level sets the log level of all subsystems, Subsystems overrides it
+	// for individual ones
+	Level      string            `json:"level,omitempty"`
+	Subsystems map[string]string `json:"subsystems,omitempty"`
 }
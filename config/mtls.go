@@ -0,0 +1,31 @@
+package config
+
+// ClientTLS is the client certificate a shuttle presents to the primary, on
+// its websocket and its api calls. The files are read again when they
+// change, so certificates can be rotated in place.
+type ClientTLS struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// CAFile verifies the primary's certificate, the system roots are used
+	// if it is unset
+	CAFile string `json:"ca_file"`
+}
+
+func (t ClientTLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// ServerTLS has the primary serve its api over TLS itself. With
+// ShuttleCAFile set shuttles have to present a certificate signed by that
+// CA and issued for their handle. Certificates are read again when their
+// files change.
+type ServerTLS struct {
+	CertFile      string `json:"cert_file"`
+	KeyFile       string `json:"key_file"`
+	ShuttleCAFile string `json:"shuttle_ca_file"`
+}
+
+func (t ServerTLS) Enabled() bool {
+	return t.CertFile != ""
+}
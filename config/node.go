@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/application-research/estuary/node/modules/peering"
 	rcmgr "github.com/libp2p/go-libp2p-resource-manager"
 )
@@ -8,23 +10,32 @@ import (
 type Node struct {
 	ListenAddrs               []string              `json:"listen_addrs"`
 	AnnounceAddrs             []string              `json:"announce_addrs"`
+	NoAnnounceAddrs           []string              `json:"no_announce_addrs"`
 	PeeringPeers              []peering.PeeringPeer `json:"peering_peers"`
 	IndexerTickInterval       int                   `json:"indexer_tick_interval"`
 	EnableWebsocketListenAddr bool                  `json:"enable_websocket_listen_addr"`
 	HardFlushWriteLog         bool                  `json:"hard_flush_write_log"`
 	WriteLogTruncate          bool                  `json:"write_log_truncate"`
 	NoBlockstoreCache         bool                  `json:"no_blockstore_cache"`
+	BlockstoreCache           BlockstoreCache       `json:"blockstore_cache"`
+	CompressBlocks            bool                  `json:"compress_blocks"`
 	NoLimiter                 bool                  `json:"no_limiter"`
 	IndexerURL                string                `json:"indexer_url"`
 	Blockstore                string                `json:"blockstore"`
 	WriteLogDir               string                `json:"write_log_dir"`
+	WriteLogMaxSize           int64                 `json:"write_log_max_size"`
+	WriteLogMaxAge            time.Duration         `json:"write_log_max_age"`
 	Libp2pKeyFile             string                `json:"libp2p_key_file"`
+	SwarmKeyFile              string                `json:"swarm_key_file"`
 	DatastoreDir              string                `json:"datastore_dir"`
 	WalletDir                 string                `json:"wallet_dir"`
 	ApiURL                    string                `json:"api_url"`
 	Bitswap                   Bitswap               `json:"bitswap"`
+	Bandwidth                 Bandwidth             `json:"bandwidth"`
 	Limits                    Limits                `json:"limits"`
 	ConnectionManager         ConnectionManager     `json:"connection_manager"`
+	Relay                     Relay                 `json:"relay"`
+	Provider                  Provider              `json:"provider"`
 }
 
 func (cfg *Node) GetLimiter() *rcmgr.BasicLimiter {
@@ -0,0 +1,23 @@
+package config
+
+import "time"
+
+type Pinning struct {
+	Workers int `json:"workers"` // number of pins fetched at once, can be changed at runtime
+
+	// failed pins are retried up to MaxAttempts times in total, waiting
+	// RetryBackoff after the first failure and twice as long after each
+	// further one, up to MaxRetryBackoff
+	MaxAttempts     int           `json:"max_attempts"`
+	RetryBackoff    time.Duration `json:"retry_backoff"`
+	MaxRetryBackoff time.Duration `json:"max_retry_backoff"`
+
+	// Preflight estimates the size of a dag from its root block before
+	// fetching the rest of it. Pins estimated larger than MaxPinSize, or
+	// than the free space of the blockstore, fail right away when
+	// PreflightReject is set and are only logged otherwise. A MaxPinSize
+	// of 0 means no limit.
+	Preflight       bool  `json:"preflight"`
+	PreflightReject bool  `json:"preflight_reject"`
+	MaxPinSize      int64 `json:"max_pin_size"`
+}
@@ -0,0 +1,9 @@
+package config
+
+// Placement describes where a shuttle runs and what it stores content on.
+// The shuttle reports it to the primary, which prefers shuttles in the
+// region an upload comes from.
+type Placement struct {
+	Region       string `json:"region"`
+	StorageClass string `json:"storage_class"` // free form, e.g. "ssd" or "hdd"
+}
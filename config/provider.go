@@ -0,0 +1,23 @@
+package config
+
+// Strategies for announcing content to the dht, named after the matching
+// go-ipfs reprovider strategies
+const (
+	// ProvideDisabled announces nothing, content is only found through
+	// peers already connected to the node
+	ProvideDisabled = "disabled"
+	// ProvideRoots announces the root of every content
+	ProvideRoots = "roots"
+	// ProvidePinned announces every block of every content
+	ProvidePinned = "pinned"
+	// ProvideAll announces every block in the blockstore, including blocks
+	// no content references anymore
+	ProvideAll = "all"
+)
+
+type Provider struct {
+	// Strategy picks what the node announces. New content has its root
+	// announced right away under every strategy but ProvideDisabled, its
+	// other blocks are announced with the next reprovide.
+	Strategy string `json:"strategy"`
+}
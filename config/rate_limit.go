@@ -0,0 +1,8 @@
+package config
+
+type RateLimit struct {
+	RequestsPerSecond    float64 `json:"requests_per_second"` // zero disables request limiting
+	RequestBurst         int     `json:"request_burst"`
+	UploadBytesPerSecond int64   `json:"upload_bytes_per_second"` // zero disables upload limiting
+	UploadBurst          int64   `json:"upload_burst"`
+}
@@ -0,0 +1,15 @@
+package config
+
+// Relay configures circuit relay and hole punching on the libp2p host
+type Relay struct {
+	// Client lets the node dial peers through relays, peers behind a NAT are
+	// often only reachable that way
+	Client bool `json:"client"`
+
+	// Service lets other peers relay their connections through this node
+	Service bool `json:"service"`
+
+	// HolePunching upgrades relayed connections to direct ones, it needs the
+	// relay client
+	HolePunching bool `json:"hole_punching"`
+}
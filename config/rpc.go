@@ -0,0 +1,27 @@
+package config
+
+import "time"
+
+type Rpc struct {
+	// Encoding is the encoding the shuttle offers for messages to the
+	// primary, "cbor" or "json". The primary may still choose JSON.
+	Encoding string `json:"encoding"`
+
+	// Compression lets the shuttle compress large messages if the primary
+	// supports it
+	Compression bool `json:"compression"`
+
+	// HeartbeatInterval is how often heartbeats are exchanged with the
+	// primary, HeartbeatTimeout how long the connection may go without
+	// hearing from the other side before it is considered dead
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+	HeartbeatTimeout  time.Duration `json:"heartbeat_timeout"`
+
+	// CommandTimeout bounds how long a command from the primary may run,
+	// CommandTimeouts overrides it for individual ops. Zero means no limit.
+	CommandTimeout  time.Duration            `json:"command_timeout"`
+	CommandTimeouts map[string]time.Duration `json:"command_timeouts"`
+
+	// MaxConcurrentCommands is how many commands are handled at once
+	MaxConcurrentCommands int `json:"max_concurrent_commands"`
+}
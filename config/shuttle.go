@@ -2,7 +2,9 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"path/filepath"
+	"time"
 
 	"github.com/application-research/estuary/node/modules/peering"
 )
@@ -10,27 +12,54 @@ import (
 const DefaultWebsocketAddr = "/ip4/0.0.0.0/tcp/6747/ws"
 
 type EstuaryRemote struct {
-	Api       string `json:"api"`
-	Handle    string `json:"handle"`
-	AuthToken string `json:"auth_token"`
+	Api       string    `json:"api"`
+	Handle    string    `json:"handle"`
+	AuthToken string    `json:"auth_token"`
+	TLS       ClientTLS `json:"tls"`
 }
 
 type Shuttle struct {
 	AppVersion         string        `json:"app_version"`
 	DatabaseConnString string        `json:"database_conn_string"`
 	StagingDataDir     string        `json:"staging_data_dir"`
+	UploadDataDir      string        `json:"upload_data_dir"`
 	DataDir            string        `json:"data_dir"`
 	ApiListen          string        `json:"api_listen"`
+	MetricsListen      string        `json:"metrics_listen"`
 	Hostname           string        `json:"hostname"`
 	Private            bool          `json:"private"`
+	VerifiedDeals      *bool         `json:"verified_deals,omitempty"`
 	Dev                bool          `json:"dev"`
 	NoReloadPinQueue   bool          `json:"no_reload_pin_queue"`
+	NoAutoMigrate      bool          `json:"no_auto_migrate"`
+	ShutdownTimeout    time.Duration `json:"shutdown_timeout"`
 	Node               Node          `json:"node"`
 	Jaeger             Jaeger        `json:"jaeger"`
 	Content            Content       `json:"content"`
 	Logging            Logging       `json:"logging"`
 	EstuaryRemote      EstuaryRemote `json:"estuary_remote"`
 	FilClient          FilClient     `json:"fil_client"`
+	Wallet             Wallet        `json:"wallet"`
+
+	GarbageCollection GarbageCollection `json:"garbage_collection"`
+	AuthCache         AuthCache         `json:"auth_cache"`
+	RateLimit         RateLimit         `json:"rate_limit"`
+	TLS               TLS               `json:"tls"`
+	Rpc               Rpc               `json:"rpc"`
+	Pinning           Pinning           `json:"pinning"`
+	DealBatching      DealBatching      `json:"deal_batching"`
+	Debug             Debug             `json:"debug"`
+	AdminAccess       AdminAccess       `json:"admin_access"`
+	Database          Database          `json:"database"`
+	Tiering           Tiering           `json:"tiering"`
+	DiskWatermarks    DiskWatermarks    `json:"disk_watermarks"`
+	Aggregation       Aggregation       `json:"aggregation"`
+	TransferRestart   TransferRestart   `json:"transfer_restart"`
+	Placement         Placement         `json:"placement"`
+	UrlFetch          UrlFetch          `json:"url_fetch"`
+	CarExport         CarExport         `json:"car_export"`
+	Webhooks          Webhooks          `json:"webhooks"`
+	Integrity         Integrity         `json:"integrity"`
 }
 
 func (cfg *Shuttle) Load(filename string) error {
@@ -50,6 +79,141 @@ func (cfg *Shuttle) Validate() error {
 	if cfg.EstuaryRemote.Handle == "" {
 		return errors.New("no handle configured or specified on command line")
 	}
+
+	if cfg.TLS.Autocert && cfg.TLS.CertFile != "" {
+		return errors.New("tls certificate files and autocert cannot be used together")
+	}
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return errors.New("both a tls certificate and key file have to be specified")
+	}
+
+	if (cfg.EstuaryRemote.TLS.CertFile == "") != (cfg.EstuaryRemote.TLS.KeyFile == "") {
+		return errors.New("both a client certificate and key file have to be specified for the primary")
+	}
+
+	if cfg.EstuaryRemote.TLS.Enabled() && cfg.Dev {
+		return errors.New("client certificates cannot be used in dev mode, which connects to the primary without tls")
+	}
+
+	if _, err := ParseNetworks(cfg.AdminAccess.AllowedIPs); err != nil {
+		return fmt.Errorf("invalid admin allowed ips: %w", err)
+	}
+
+	if _, err := ParseNetworks(cfg.AdminAccess.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+
+	if cfg.Rpc.Encoding != "cbor" && cfg.Rpc.Encoding != "json" {
+		return fmt.Errorf("unknown rpc encoding %q", cfg.Rpc.Encoding)
+	}
+
+	switch cfg.Node.Provider.Strategy {
+	case ProvideDisabled, ProvideRoots, ProvidePinned, ProvideAll:
+	default:
+		return fmt.Errorf("unknown provide strategy %q", cfg.Node.Provider.Strategy)
+	}
+
+	if cfg.Pinning.Workers < 1 {
+		return errors.New("at least one pin worker is needed")
+	}
+
+	if cfg.Pinning.MaxAttempts < 1 {
+		return errors.New("pins need to be attempted at least once")
+	}
+
+	if cfg.Pinning.MaxPinSize < 0 {
+		return errors.New("the maximum pin size cannot be negative")
+	}
+
+	if cfg.Database.MaxOpenConns > 0 && cfg.Database.MaxIdleConns > cfg.Database.MaxOpenConns {
+		return errors.New("the database cannot keep more idle connections than it may open")
+	}
+
+	if cfg.DiskWatermarks.High > 0 {
+		wm := cfg.DiskWatermarks
+		if wm.High > 1 || wm.Low <= 0 || wm.Low > wm.High {
+			return errors.New("the disk watermarks must satisfy 0 < low <= high <= 1")
+		}
+	}
+
+	if cfg.Tiering.MinSealedDeals < 0 {
+		return errors.New("the sealed deals needed to tier content cannot be negative")
+	}
+
+	switch cfg.Tiering.Policy {
+	case TierPolicyOffload, TierPolicyDelete:
+	default:
+		return fmt.Errorf("unknown tiering policy %q", cfg.Tiering.Policy)
+	}
+
+	if cfg.Aggregation.MaxContentSize < 0 {
+		return errors.New("the maximum aggregated content size cannot be negative")
+	}
+
+	if cfg.Aggregation.MaxContentSize > 0 && cfg.Aggregation.TargetSize < cfg.Aggregation.MaxContentSize {
+		return errors.New("aggregates must be able to hold the largest aggregated content")
+	}
+
+	if cfg.DealBatching.BatchSize < 0 || cfg.DealBatching.Pacing < 0 {
+		return errors.New("the deal batch size and pacing cannot be negative")
+	}
+
+	if cfg.Node.Bandwidth.MaxOut < 0 || cfg.Node.Bandwidth.MaxOutPerPeer < 0 {
+		return errors.New("the bandwidth caps cannot be negative")
+	}
+
+	if bc := cfg.Node.BlockstoreCache; bc.HasCacheSize < 0 || bc.BloomFilterSize < 0 || bc.BlockCacheSize < 0 || bc.BlockCacheMaxBlockSize < 0 {
+		return errors.New("the blockstore cache sizes cannot be negative")
+	}
+
+	if bc := cfg.Node.BlockstoreCache; bc.BloomFilterSize > 0 && bc.BloomFilterHashes < 1 {
+		return errors.New("the blockstore bloom filter needs at least one hash")
+	}
+
+	if cfg.TransferRestart.StallTimeout < 0 || cfg.TransferRestart.MaxRestarts < 0 {
+		return errors.New("the transfer stall timeout and restarts cannot be negative")
+	}
+
+	if cfg.UrlFetch.MaxSize < 0 || cfg.UrlFetch.Timeout < 0 {
+		return errors.New("the url fetch size limit and timeout cannot be negative")
+	}
+
+	if cfg.CarExport.MaxCarSize < 0 || cfg.CarExport.Expiry < 0 {
+		return errors.New("the car export size and expiry cannot be negative")
+	}
+
+	if cfg.Webhooks.MaxAttempts < 1 {
+		return errors.New("webhook deliveries need to be attempted at least once")
+	}
+
+	if cfg.Webhooks.RetryBackoff < 0 || cfg.Webhooks.Timeout < 0 || cfg.Webhooks.LogRetention < 0 {
+		return errors.New("the webhook retry backoff, timeout and log retention cannot be negative")
+	}
+
+	if cfg.Integrity.Interval < 0 || cfg.Integrity.RefetchTimeout < 0 {
+		return errors.New("the integrity check interval and refetch timeout cannot be negative")
+	}
+
+	if cfg.Integrity.Interval > 0 && cfg.Integrity.SampleSize < 1 {
+		return errors.New("the integrity check has to sample at least one block")
+	}
+
+	if cfg.Wallet.RotateInterval < 0 {
+		return errors.New("the wallet rotate interval cannot be negative")
+	}
+
+	if cfg.Rpc.MaxConcurrentCommands < 1 {
+		return errors.New("at least one rpc command has to be allowed to run at a time")
+	}
+
+	if cfg.Rpc.HeartbeatInterval > 0 && cfg.Rpc.HeartbeatTimeout <= cfg.Rpc.HeartbeatInterval {
+		return errors.New("the rpc heartbeat timeout has to be longer than the heartbeat interval")
+	}
+
+	if cfg.TLS.Autocert && cfg.Hostname == "" {
+		return errors.New("autocert requires the public hostname of the shuttle to be set")
+	}
 	return nil
 }
 
@@ -57,10 +221,27 @@ func (cfg *Shuttle) SetRequiredOptions() error {
 	//TODO validate flags values - empty strings etc
 
 	cfg.StagingDataDir = filepath.Join(cfg.DataDir, "staging")
+	cfg.UploadDataDir = filepath.Join(cfg.DataDir, "uploads")
 	cfg.Node.WalletDir = filepath.Join(cfg.DataDir, "wallet")
 	cfg.Node.DatastoreDir = filepath.Join(cfg.DataDir, "leveldb")
 	cfg.Node.Libp2pKeyFile = filepath.Join(cfg.DataDir, "peer.key")
 
+	if cfg.TLS.AutocertCacheDir == "" {
+		cfg.TLS.AutocertCacheDir = filepath.Join(cfg.DataDir, "autocert")
+	}
+
+	if cfg.Debug.SnapshotDir == "" {
+		cfg.Debug.SnapshotDir = filepath.Join(cfg.DataDir, "snapshots")
+	}
+
+	if cfg.Tiering.ColdDir == "" {
+		cfg.Tiering.ColdDir = filepath.Join(cfg.DataDir, "cold")
+	}
+
+	if cfg.CarExport.Dir == "" {
+		cfg.CarExport.Dir = filepath.Join(cfg.DataDir, "exports")
+	}
+
 	if cfg.Node.Blockstore == "" {
 		cfg.Node.Blockstore = filepath.Join(cfg.DataDir, "blocks")
 	} else if cfg.Node.Blockstore[0] != '/' && cfg.Node.Blockstore[0] != ':' {
@@ -75,13 +256,23 @@ func NewShuttle(appVersion string) *Shuttle {
 		DataDir:            ".",
 		DatabaseConnString: "sqlite=estuary-shuttle.db",
 		ApiListen:          ":3005",
+		MetricsListen:      "127.0.0.1:3105",
 		Hostname:           "",
 		Private:            false,
 		Dev:                false,
 		NoReloadPinQueue:   false,
+		ShutdownTimeout:    5 * time.Minute,
 
 		Content: Content{
 			DisableLocalAdding: false,
+			CommPOnImport:      true,
+			MaxChunkSize:       1 << 20,
+			MaxUploadSize:      64 << 30,
+			StagingCopy: StagingCopy{
+				Workers:        8,
+				MaxBatchBlocks: 1024,
+				MaxBatchBytes:  32 << 20,
+			},
 		},
 
 		Jaeger: Jaeger{
@@ -106,13 +297,24 @@ func NewShuttle(appVersion string) *Shuttle {
 			WriteLogDir:       "",
 			HardFlushWriteLog: false,
 			WriteLogTruncate:  false,
+			WriteLogMaxSize:   16 << 30,
+			WriteLogMaxAge:    time.Hour,
 			NoBlockstoreCache: false,
+			BlockstoreCache: BlockstoreCache{
+				HasCacheSize:           8 << 20,
+				BloomFilterHashes:      7,
+				BlockCacheSize:         2048,
+				BlockCacheMaxBlockSize: 256 << 10,
+			},
 
 			ApiURL: "wss://api.chain.love",
 
 			Bitswap: Bitswap{
 				MaxOutstandingBytesPerPeer: 5 << 20,
 				TargetMessageSize:          16 << 10,
+				EngineTaskWorkers:          64,
+				EngineBlockstoreWorkers:    600,
+				TaskWorkers:                600,
 			},
 
 			NoLimiter: true,
@@ -143,11 +345,34 @@ func NewShuttle(appVersion string) *Shuttle {
 
 					FD: 1024,
 				},
+				PeerLimit: PeerLimit{
+					MinMemory:      64 << 20,
+					MaxMemory:      256 << 20,
+					MemoryFraction: 1.0 / 64,
+
+					StreamsInbound:  256,
+					StreamsOutbound: 512,
+					Streams:         1024,
+
+					ConnsInbound:  8,
+					ConnsOutbound: 8,
+					Conns:         16,
+
+					FD: 8,
+				},
 			},
 			ConnectionManager: ConnectionManager{
 				LowWater:  2000,
 				HighWater: 3000,
 			},
+			Relay: Relay{
+				Client:       true,
+				Service:      false,
+				HolePunching: true,
+			},
+			Provider: Provider{
+				Strategy: ProvideRoots,
+			},
 		},
 
 		EstuaryRemote: EstuaryRemote{
@@ -161,5 +386,93 @@ func NewShuttle(appVersion string) *Shuttle {
 				TTL:       30,
 			},
 		},
+		Pinning: Pinning{
+			Workers:         100,
+			MaxAttempts:     5,
+			RetryBackoff:    time.Minute,
+			MaxRetryBackoff: 6 * time.Hour,
+		},
+		DealBatching: DealBatching{
+			BatchSize: 10,
+			Pacing:    10 * time.Second,
+		},
+		GarbageCollection: GarbageCollection{
+			Interval:   0,
+			BatchSize:  1000,
+			BatchDelay: 100 * time.Millisecond,
+			DryRun:     false,
+		},
+		AuthCache: AuthCache{
+			Size:        1000,
+			TTL:         5 * time.Minute,
+			NegativeTTL: 30 * time.Second,
+			LocalAuth:   true,
+		},
+		Rpc: Rpc{
+			Encoding:          "cbor",
+			Compression:       true,
+			HeartbeatInterval: 5 * time.Second,
+			HeartbeatTimeout:  20 * time.Second,
+			CommandTimeout:    time.Hour,
+			CommandTimeouts: map[string]time.Duration{
+				// retrievals can take a long time for big deals
+				"RetrieveContent": 6 * time.Hour,
+			},
+			MaxConcurrentCommands: 64,
+		},
+		RateLimit: RateLimit{
+			RequestsPerSecond:    0,
+			RequestBurst:         50,
+			UploadBytesPerSecond: 0,
+			UploadBurst:          256 << 20,
+		},
+		Debug: Debug{
+			Pprof:      true,
+			PprofOnApi: false,
+		},
+		Database: Database{
+			MaxOpenConns:    99,
+			MaxIdleConns:    80,
+			ConnMaxIdleTime: time.Hour,
+		},
+		Tiering: Tiering{
+			MinSealedDeals: 0,
+			Policy:         TierPolicyOffload,
+		},
+		DiskWatermarks: DiskWatermarks{
+			High: 0.95,
+			Low:  0.9,
+		},
+		Aggregation: Aggregation{
+			MaxContentSize: 0,
+			// fills a 16GiB piece with room for the car overhead
+			TargetSize: 14 << 30,
+			MaxAge:     7 * 24 * time.Hour,
+		},
+		TransferRestart: TransferRestart{
+			StallTimeout: 30 * time.Minute,
+			MaxRestarts:  3,
+		},
+		UrlFetch: UrlFetch{
+			MaxSize: 32 << 30,
+			Timeout: 6 * time.Hour,
+		},
+		CarExport: CarExport{
+			MaxCarSize: 32 << 30,
+			Expiry:     7 * 24 * time.Hour,
+		},
+		Webhooks: Webhooks{
+			Enabled:      true,
+			MaxAttempts:  8,
+			RetryBackoff: 30 * time.Second,
+			Timeout:      10 * time.Second,
+			LogRetention: 7 * 24 * time.Hour,
+		},
+		Integrity: Integrity{
+			Interval:       time.Hour,
+			SampleSize:     1000,
+			Refetch:        true,
+			RefetchTimeout: 2 * time.Minute,
+		},
 	}
 }
@@ -0,0 +1,23 @@
+package config
+
+const (
+	// TierPolicyOffload moves the blocks of sealed content to the cold store
+	TierPolicyOffload = "offload"
+
+	// TierPolicyDelete drops the blocks of sealed content, they are
+	// retrieved from the deals when the content is needed again
+	TierPolicyDelete = "delete"
+)
+
+// Tiering moves content off the hot blockstore once it is safely stored in
+// filecoin deals. The database records of the content are kept either way.
+type Tiering struct {
+	// MinSealedDeals is how many sealed deals content needs before it is
+	// tiered, zero disables tiering
+	MinSealedDeals int `json:"min_sealed_deals"`
+
+	Policy string `json:"policy"`
+
+	// ColdDir is where the cold store of the offload policy keeps blocks
+	ColdDir string `json:"cold_dir"`
+}
@@ -0,0 +1,14 @@
+package config
+
+type TLS struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// Autocert gets certificates for the shuttle hostname from Let's Encrypt
+	Autocert         bool   `json:"autocert"`
+	AutocertCacheDir string `json:"autocert_cache_dir"`
+}
+
+func (t TLS) Enabled() bool {
+	return t.Autocert || t.CertFile != ""
+}
@@ -0,0 +1,11 @@
+package config
+
+import "time"
+
+// TransferRestart has the shuttle restart deal transfers that stop making
+// progress or fail in a way worth retrying, up to MaxRestarts times before
+// the deal is failed
+type TransferRestart struct {
+	StallTimeout time.Duration `json:"stall_timeout"` // zero disables the restarts
+	MaxRestarts  int           `json:"max_restarts"`
+}
@@ -0,0 +1,15 @@
+package config
+
+import "time"
+
+// UrlFetch bounds the downloads the shuttle makes for add-from-url
+type UrlFetch struct {
+	// MaxSize is the largest download, the users upload size limit applies
+	// as well. Zero disables add-from-url.
+	MaxSize int64         `json:"max_size"`
+	Timeout time.Duration `json:"timeout"`
+
+	// AllowPrivate lets urls point at loopback and private addresses, which
+	// are refused by default so users cannot reach the shuttle's own network
+	AllowPrivate bool `json:"allow_private"`
+}
@@ -0,0 +1,17 @@
+package config
+
+import "time"
+
+// Wallet picks the wallet addresses a shuttle uses for each purpose, all of
+// them have to be in its wallet. Unset addresses fall back to the wallet
+// default.
+type Wallet struct {
+	// DealAddrs are used for deals in turn, moving on to the next one every
+	// RotateInterval. A zero interval keeps the first one until rotated by
+	// an admin.
+	DealAddrs      []string      `json:"deal_addrs"`
+	RotateInterval time.Duration `json:"rotate_interval"`
+
+	// RetrievalAddr pays for retrievals
+	RetrievalAddr string `json:"retrieval_addr"`
+}
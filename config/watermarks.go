@@ -0,0 +1,9 @@
+package config
+
+// DiskWatermarks are shares of the blockstore disks in use. Once any disk is
+// filled past High the shuttle stops taking new content, and takes it again
+// once all of them are back below Low.
+type DiskWatermarks struct {
+	High float64 `json:"high"` // zero disables the watermarks
+	Low  float64 `json:"low"`
+}
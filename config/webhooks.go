@@ -0,0 +1,25 @@
+package config
+
+import "time"
+
+// Webhooks controls the delivery of users' webhook events
+type Webhooks struct {
+	// Enabled makes the shuttle ask the primary for the users' webhooks
+	// and deliver their events
+	Enabled bool `json:"enabled"`
+
+	// MaxAttempts is how often a delivery is tried before it is given up
+	// on, RetryBackoff the wait after the first failed attempt, which
+	// doubles with every further one
+	MaxAttempts  int           `json:"max_attempts"`
+	RetryBackoff time.Duration `json:"retry_backoff"`
+	Timeout      time.Duration `json:"timeout"`
+
+	// LogRetention is how long finished deliveries are kept in the log
+	LogRetention time.Duration `json:"log_retention"`
+
+	// AllowPrivate lets webhooks point at loopback and private addresses,
+	// which are refused by default so users cannot reach the shuttle's own
+	// network
+	AllowPrivate bool `json:"allow_private"`
+}
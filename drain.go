@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+)
+
+// drainInterval is how often content is moved off draining shuttles
+const drainInterval = time.Minute * 5
+
+// drainBatchSize is how many contents are sent to another shuttle at once
+const drainBatchSize = 200
+
+// drainRetry is how long content sent to another shuttle has to complete
+// there before it is sent again
+const drainRetry = time.Hour
+
+// shuttleIsDraining reports whether the shuttle is being emptied
+func (cm *ContentManager) shuttleIsDraining(handle string) bool {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	return ok && d.draining
+}
+
+// drainTarget picks the shuttle with the most free space that takes new
+// content, empty if there is none
+func drainTarget(conns []*ShuttleConnection) string {
+	var best *ShuttleConnection
+	for _, sc := range conns {
+		if sc.draining || sc.shuttingDown || sc.addingPaused || sc.spaceLow || sc.private {
+			continue
+		}
+		if best == nil || sc.blockstoreFree > best.blockstoreFree {
+			best = sc
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.handle
+}
+
+// runDrainer moves the content of draining shuttles to other shuttles. The
+// draining shuttles release each content once it is complete on the other
+// one, see handleRpcContentMigrated.
+func (cm *ContentManager) runDrainer(ctx context.Context) {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		cm.shuttlesLk.Lock()
+		var draining []string
+		for handle, sc := range cm.shuttles {
+			if sc.draining {
+				draining = append(draining, handle)
+			}
+		}
+		cm.shuttlesLk.Unlock()
+
+		for _, handle := range draining {
+			if err := cm.drainShuttle(ctx, handle, time.Now()); err != nil {
+				log.Errorw("failed to move content off draining shuttle", "shuttle", handle, "err", err)
+			}
+		}
+	}
+}
+
+func (cm *ContentManager) drainShuttle(ctx context.Context, handle string, now time.Time) error {
+	ctx, span := cm.tracer.Start(ctx, "drainShuttle")
+	defer span.End()
+
+	cm.drainLk.Lock()
+	for cont, sent := range cm.drainSent {
+		if now.Sub(sent) > drainRetry {
+			delete(cm.drainSent, cont)
+		}
+	}
+	skip := make([]uint, 0, len(cm.drainSent))
+	for cont := range cm.drainSent {
+		skip = append(skip, cont)
+	}
+	cm.drainLk.Unlock()
+
+	q := cm.DB.Where("location = ? and active and not offloaded", handle)
+	if len(skip) > 0 {
+		q = q.Where("id not in ?", skip)
+	}
+
+	var contents []util.Content
+	if err := q.Order("id asc").Limit(drainBatchSize).Find(&contents).Error; err != nil {
+		return err
+	}
+	if len(contents) == 0 {
+		return nil
+	}
+
+	cm.shuttlesLk.Lock()
+	conns := make([]*ShuttleConnection, 0, len(cm.shuttles))
+	for _, sc := range cm.shuttles {
+		conns = append(conns, sc)
+	}
+	target := drainTarget(conns)
+	cm.shuttlesLk.Unlock()
+	if target == "" {
+		return fmt.Errorf("no shuttle to move %d contents to", len(contents))
+	}
+
+	log.Infow("moving content off draining shuttle", "shuttle", handle, "to", target, "contents", len(contents))
+	if err := cm.sendConsolidateContentCmd(ctx, target, contents); err != nil {
+		return err
+	}
+
+	cm.drainLk.Lock()
+	for _, c := range contents {
+		cm.drainSent[c.ID] = now
+	}
+	cm.drainLk.Unlock()
+	return nil
+}
+
+type shuttleDrainBody struct {
+	Draining bool `json:"draining"`
+}
+
+// handleShuttleSetDraining godoc
+// @Summary      Start or stop draining a shuttle
+// @Description  This endpoint has a connected shuttle stop taking new content and moves its content to other shuttles, or takes it out of draining again. Progress shows up in the pin count of the shuttle list, the shuttle reports it in detail on its own drain endpoint.
+// @Tags         admin
+// @Produce      json
+// @Param        handle  path  string            true  "Shuttle handle"
+// @Param        body    body  shuttleDrainBody  true  "Whether the shuttle drains"
+// @Router       /admin/shuttle/{handle}/drain [put]
+func (s *Server) handleShuttleSetDraining(c echo.Context) error {
+	var body shuttleDrainBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if err := s.CM.sendShuttleCommand(c.Request().Context(), c.Param("handle"), &drpc.Command{
+		Op: drpc.CMD_SetDraining,
+		Params: drpc.CmdParams{
+			SetDraining: &drpc.SetDraining{Draining: body.Draining},
+		},
+	}); err != nil {
+		if xerrors.Is(err, ErrNoShuttleConnection) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("shuttle %s is not connected", c.Param("handle")),
+			}
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &body)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainTarget(t *testing.T) {
+	conns := []*ShuttleConnection{
+		{handle: "draining", draining: true, blockstoreFree: 900},
+		{handle: "paused", addingPaused: true, blockstoreFree: 800},
+		{handle: "private", private: true, blockstoreFree: 700},
+		{handle: "small", blockstoreFree: 100},
+		{handle: "large", blockstoreFree: 500},
+	}
+	assert.Equal(t, "large", drainTarget(conns))
+
+	assert.Empty(t, drainTarget(conns[:3]))
+}
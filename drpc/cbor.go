@@ -0,0 +1,459 @@
+package drpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+// Messages can be sent CBOR encoded once both sides agreed on it, see
+// CMD_SetRpcEncoding. PinComplete and PinCompletePart, which can list
+// hundreds of thousands of objects, have a native encoding. The remaining
+// params are small and are carried as embedded JSON so they dont each need a
+// CBOR encoding.
+//
+// A message is encoded as the array
+//   [ID, Op, Handle, TraceCarrier (JSON) or null, PinComplete or null, other params (JSON), PinCompletePart or null]
+// Messages without the last field are accepted as well.
+
+// maxPinObjects bounds the number of objects accepted in a single PinComplete
+const maxPinObjects = 1 << 24
+
+// decodePrealloc caps what is allocated up front for arrays and byte strings
+// read from the wire, their lengths are only trusted as the data arrives
+const decodePrealloc = 1 << 12
+
+// maxEmbeddedJSON bounds the size of JSON embedded in a CBOR message
+const maxEmbeddedJSON = 16 << 20
+
+type byteScanReader interface {
+	io.Reader
+	io.ByteScanner
+}
+
+func (m *Message) MarshalCBOR(w io.Writer) error {
+	if m == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajArray, 7); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, m.ID); err != nil {
+		return err
+	}
+
+	if err := writeString(scratch, w, m.Op); err != nil {
+		return err
+	}
+
+	if err := writeString(scratch, w, m.Handle); err != nil {
+		return err
+	}
+
+	if m.TraceCarrier == nil {
+		if _, err := w.Write(cbg.CborNull); err != nil {
+			return err
+		}
+	} else {
+		tc, err := json.Marshal(m.TraceCarrier)
+		if err != nil {
+			return err
+		}
+		if err := writeBytes(scratch, w, tc); err != nil {
+			return err
+		}
+	}
+
+	if err := m.Params.PinComplete.MarshalCBOR(w); err != nil {
+		return xerrors.Errorf("failed to write PinComplete: %w", err)
+	}
+
+	rest := m.Params
+	rest.PinComplete = nil
+	rest.PinCompletePart = nil
+	params, err := json.Marshal(rest)
+	if err != nil {
+		return err
+	}
+	if err := writeBytes(scratch, w, params); err != nil {
+		return err
+	}
+
+	if err := m.Params.PinCompletePart.MarshalCBOR(w); err != nil {
+		return xerrors.Errorf("failed to write PinCompletePart: %w", err)
+	}
+	return nil
+}
+
+func (m *Message) UnmarshalCBOR(r io.Reader) error {
+	*m = Message{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+	if extra != 6 && extra != 7 {
+		return fmt.Errorf("cbor input had wrong number of fields for Message (%d)", extra)
+	}
+	fields := extra
+
+	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint field ID")
+	}
+	m.ID = extra
+
+	op, err := cbg.ReadStringBuf(br, scratch)
+	if err != nil {
+		return xerrors.Errorf("failed to read Op: %w", err)
+	}
+	m.Op = op
+
+	handle, err := cbg.ReadStringBuf(br, scratch)
+	if err != nil {
+		return xerrors.Errorf("failed to read Handle: %w", err)
+	}
+	m.Handle = handle
+
+	isNull, err := readNull(br)
+	if err != nil {
+		return err
+	}
+	if !isNull {
+		tc, err := readBytes(br, scratch, maxEmbeddedJSON)
+		if err != nil {
+			return xerrors.Errorf("failed to read TraceCarrier: %w", err)
+		}
+		m.TraceCarrier = new(TraceCarrier)
+		if err := json.Unmarshal(tc, m.TraceCarrier); err != nil {
+			return xerrors.Errorf("failed to decode TraceCarrier: %w", err)
+		}
+	}
+
+	var pc *PinComplete
+	isNull, err = readNull(br)
+	if err != nil {
+		return err
+	}
+	if !isNull {
+		pc = new(PinComplete)
+		if err := pc.UnmarshalCBOR(br); err != nil {
+			return xerrors.Errorf("failed to read PinComplete: %w", err)
+		}
+	}
+
+	params, err := readBytes(br, scratch, maxEmbeddedJSON)
+	if err != nil {
+		return xerrors.Errorf("failed to read params: %w", err)
+	}
+	if err := json.Unmarshal(params, &m.Params); err != nil {
+		return xerrors.Errorf("failed to decode params: %w", err)
+	}
+	m.Params.PinComplete = pc
+
+	if fields < 7 {
+		return nil
+	}
+
+	isNull, err = readNull(br)
+	if err != nil {
+		return err
+	}
+	if !isNull {
+		m.Params.PinCompletePart = new(PinCompletePart)
+		if err := m.Params.PinCompletePart.UnmarshalCBOR(br); err != nil {
+			return xerrors.Errorf("failed to read PinCompletePart: %w", err)
+		}
+	}
+	return nil
+}
+
+// PinComplete is encoded as the array [DBID, Size, [[Cid, Size], ...]]
+func (t *PinComplete) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajArray, 3); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.DBID)); err != nil {
+		return err
+	}
+
+	if err := writeInt(scratch, w, t.Size); err != nil {
+		return err
+	}
+
+	return writePinObjs(scratch, w, t.Objects)
+}
+
+func (t *PinComplete) UnmarshalCBOR(r io.Reader) error {
+	*t = PinComplete{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+	if extra != 3 {
+		return fmt.Errorf("cbor input had wrong number of fields for PinComplete (%d)", extra)
+	}
+
+	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint field DBID")
+	}
+	t.DBID = uint(extra)
+
+	if t.Size, err = readInt(br, scratch); err != nil {
+		return xerrors.Errorf("failed to read Size: %w", err)
+	}
+
+	t.Objects, err = readPinObjs(br, scratch)
+	return err
+}
+
+// PinCompletePart is encoded as the array [DBID, Part, [[Cid, Size], ...]]
+func (t *PinCompletePart) MarshalCBOR(w io.Writer) error {
+	if t == nil {
+		_, err := w.Write(cbg.CborNull)
+		return err
+	}
+
+	scratch := make([]byte, 9)
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajArray, 3); err != nil {
+		return err
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(t.DBID)); err != nil {
+		return err
+	}
+
+	if err := writeInt(scratch, w, int64(t.Part)); err != nil {
+		return err
+	}
+
+	return writePinObjs(scratch, w, t.Objects)
+}
+
+func (t *PinCompletePart) UnmarshalCBOR(r io.Reader) error {
+	*t = PinCompletePart{}
+
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+	if extra != 3 {
+		return fmt.Errorf("cbor input had wrong number of fields for PinCompletePart (%d)", extra)
+	}
+
+	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajUnsignedInt {
+		return fmt.Errorf("wrong type for uint field DBID")
+	}
+	t.DBID = uint(extra)
+
+	part, err := readInt(br, scratch)
+	if err != nil {
+		return xerrors.Errorf("failed to read Part: %w", err)
+	}
+	t.Part = int(part)
+
+	t.Objects, err = readPinObjs(br, scratch)
+	return err
+}
+
+func writePinObjs(scratch []byte, w io.Writer, objs []PinObj) error {
+	if len(objs) > maxPinObjects {
+		return xerrors.Errorf("too many objects in message (%d)", len(objs))
+	}
+
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajArray, uint64(len(objs))); err != nil {
+		return err
+	}
+	for _, o := range objs {
+		if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajArray, 2); err != nil {
+			return err
+		}
+		if err := cbg.WriteCidBuf(scratch, w, o.Cid); err != nil {
+			return xerrors.Errorf("failed to write object cid: %w", err)
+		}
+		if err := writeInt(scratch, w, int64(o.Size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPinObjs(br io.Reader, scratch []byte) ([]PinObj, error) {
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return nil, err
+	}
+	if maj != cbg.MajArray {
+		return nil, fmt.Errorf("expected cbor array for Objects")
+	}
+	if extra > maxPinObjects {
+		return nil, fmt.Errorf("t.Objects: array too large (%d)", extra)
+	}
+
+	if extra == 0 {
+		return nil, nil
+	}
+
+	prealloc := extra
+	if prealloc > decodePrealloc {
+		prealloc = decodePrealloc
+	}
+
+	objs := make([]PinObj, 0, prealloc)
+	for i := 0; i < int(extra); i++ {
+		maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+		if err != nil {
+			return nil, err
+		}
+		if maj != cbg.MajArray || extra != 2 {
+			return nil, fmt.Errorf("expected cbor array of two fields for PinObj")
+		}
+
+		c, err := cbg.ReadCid(br)
+		if err != nil {
+			return nil, xerrors.Errorf("reading cid of object %d failed: %w", i, err)
+		}
+
+		size, err := readInt(br, scratch)
+		if err != nil {
+			return nil, xerrors.Errorf("reading size of object %d failed: %w", i, err)
+		}
+
+		objs = append(objs, PinObj{Cid: c, Size: int(size)})
+	}
+	return objs, nil
+}
+
+func writeString(scratch []byte, w io.Writer, s string) error {
+	if len(s) > cbg.MaxLength {
+		return xerrors.Errorf("string value too long (%d)", len(s))
+	}
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajTextString, uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func writeBytes(scratch []byte, w io.Writer, b []byte) error {
+	if err := cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajByteString, uint64(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readBytes(br io.Reader, scratch []byte, maxlen uint64) ([]byte, error) {
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return nil, err
+	}
+	if maj != cbg.MajByteString {
+		return nil, fmt.Errorf("expected cbor byte string")
+	}
+	if extra > maxlen {
+		return nil, fmt.Errorf("byte string too large (%d)", extra)
+	}
+
+	prealloc := extra
+	if prealloc > decodePrealloc {
+		prealloc = decodePrealloc
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, prealloc))
+	n, err := io.CopyN(buf, br, int64(extra))
+	if err != nil {
+		if err == io.EOF && n < int64(extra) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeInt(scratch []byte, w io.Writer, v int64) error {
+	if v >= 0 {
+		return cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajUnsignedInt, uint64(v))
+	}
+	return cbg.WriteMajorTypeHeaderBuf(scratch, w, cbg.MajNegativeInt, uint64(-v-1))
+}
+
+func readInt(br io.Reader, scratch []byte) (int64, error) {
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return 0, err
+	}
+	if extra > math.MaxInt64 {
+		return 0, fmt.Errorf("int overflow")
+	}
+
+	switch maj {
+	case cbg.MajUnsignedInt:
+		return int64(extra), nil
+	case cbg.MajNegativeInt:
+		return -1 - int64(extra), nil
+	default:
+		return 0, fmt.Errorf("wrong type for int field: %d", maj)
+	}
+}
+
+// readNull consumes a CBOR null if it is next in br
+func readNull(br byteScanReader) (bool, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return false, err
+	}
+	if b == cbg.CborNull[0] {
+		return true, nil
+	}
+	return false, br.UnreadByte()
+}
@@ -0,0 +1,181 @@
+package drpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/websocket"
+)
+
+func testPinComplete(n int) *Message {
+	objs := make([]PinObj, n)
+	for i := range objs {
+		blk := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+		objs[i] = PinObj{Cid: blk.Cid(), Size: len(blk.RawData())}
+	}
+
+	return &Message{
+		ID: 1234,
+		Op: OP_PinComplete,
+		Params: MsgParams{
+			PinComplete: &PinComplete{
+				DBID:    42,
+				Size:    12345,
+				Objects: objs,
+			},
+		},
+		TraceCarrier: &TraceCarrier{
+			TraceID: trace.TraceID{1, 2, 3},
+			SpanID:  trace.SpanID{4, 5, 6},
+		},
+		Handle: "SHUTTLE-HANDLE",
+	}
+}
+
+func TestMessageCBORRoundtrip(t *testing.T) {
+	msgs := []*Message{
+		testPinComplete(100),
+		{
+			Op: OP_UpdatePinStatus,
+			Params: MsgParams{
+				UpdatePinStatus: &UpdatePinStatus{DBID: 7, Status: "failed"},
+			},
+		},
+		{
+			ID: 99,
+			Op: OP_PinCompletePart,
+			Params: MsgParams{
+				PinCompletePart: &PinCompletePart{
+					DBID:    42,
+					Part:    3,
+					Objects: testPinComplete(10).Params.PinComplete.Objects,
+				},
+			},
+		},
+		{
+			Op: OP_ShuttleUpdate,
+			Params: MsgParams{
+				ShuttleUpdate: &ShuttleUpdate{BlockstoreSize: 1 << 40, NumPins: 12},
+			},
+		},
+	}
+
+	for _, msg := range msgs {
+		buf := new(bytes.Buffer)
+		require.NoError(t, msg.MarshalCBOR(buf))
+
+		var out Message
+		require.NoError(t, out.UnmarshalCBOR(buf))
+		assert.Equal(t, msg, &out)
+	}
+}
+
+func TestCodecDecodesEitherEncoding(t *testing.T) {
+	msg := testPinComplete(10)
+
+	for _, enc := range []string{EncodingJSON, EncodingCBOR} {
+		codec := NewCodec(enc, "")
+		data, frame, err := codec.Marshal(msg)
+		require.NoError(t, err)
+		if enc == EncodingCBOR {
+			assert.Equal(t, byte(websocket.BinaryFrame), frame)
+		}
+
+		var out Message
+		require.NoError(t, NewCodec(EncodingJSON, "").Unmarshal(data, frame, &out))
+		assert.Equal(t, msg, &out)
+	}
+
+	// commands have no cbor encoding and are always sent as json
+	_, frame, err := NewCodec(EncodingCBOR, "").Marshal(&Command{Op: CMD_AddPin})
+	require.NoError(t, err)
+	assert.Equal(t, byte(websocket.TextFrame), frame)
+}
+
+func TestCodecCompression(t *testing.T) {
+	for _, enc := range []string{EncodingJSON, EncodingCBOR} {
+		codec := NewCodec(enc, CompressionGzip)
+
+		msg := testPinComplete(1000)
+		plain, _, err := NewCodec(enc, "").Marshal(msg)
+		require.NoError(t, err)
+
+		data, frame, err := codec.Marshal(msg)
+		require.NoError(t, err)
+		assert.Equal(t, byte(websocket.BinaryFrame), frame)
+		assert.Less(t, len(data), len(plain))
+
+		var out Message
+		require.NoError(t, NewCodec(EncodingJSON, "").Unmarshal(data, frame, &out))
+		assert.Equal(t, msg, &out)
+
+		// small messages are sent as they are
+		small := &Message{Op: OP_UpdatePinStatus, Params: MsgParams{UpdatePinStatus: &UpdatePinStatus{DBID: 1}}}
+		data, _, err = codec.Marshal(small)
+		require.NoError(t, err)
+		assert.False(t, isGzip(data))
+	}
+}
+
+func BenchmarkPinCompleteJSON(b *testing.B) {
+	msg := testPinComplete(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		var out Message
+		if err := json.Unmarshal(data, &out); err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(data)))
+	}
+}
+
+func BenchmarkPinCompleteCBOR(b *testing.B) {
+	msg := testPinComplete(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buf := new(bytes.Buffer)
+		if err := msg.MarshalCBOR(buf); err != nil {
+			b.Fatal(err)
+		}
+		n := buf.Len()
+
+		var out Message
+		if err := out.UnmarshalCBOR(buf); err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(n))
+	}
+}
+
+func TestDecodeDoesNotTrustLengths(t *testing.T) {
+	scratch := make([]byte, 9)
+
+	// an array header claiming the most objects allowed, with nothing after it
+	buf := new(bytes.Buffer)
+	require.NoError(t, cbg.WriteMajorTypeHeaderBuf(scratch, buf, cbg.MajArray, maxPinObjects))
+	_, err := readPinObjs(buf, scratch)
+	assert.Error(t, err)
+
+	buf.Reset()
+	require.NoError(t, cbg.WriteMajorTypeHeaderBuf(scratch, buf, cbg.MajByteString, maxEmbeddedJSON))
+	buf.WriteString("short")
+	_, err = readBytes(buf, scratch, maxEmbeddedJSON)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
@@ -0,0 +1,122 @@
+package drpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	EncodingJSON = "json"
+	EncodingCBOR = "cbor"
+)
+
+// CompressionGzip compresses frames with gzip. Compressed frames are sent as
+// binary frames and recognized by the gzip header, so the receiving side
+// does not need to know whether compression is in use.
+const CompressionGzip = "gzip"
+
+// compressMinSize is the smallest encoded value that gets compressed,
+// compressing smaller ones is not worth the cpu
+const compressMinSize = 1024
+
+// maxDecompressedSize bounds the size a compressed frame may inflate to
+const maxDecompressedSize = 1 << 30
+
+// CMD_SetRpcEncoding is sent by the primary in reply to a Hello listing
+// encodings it supports. From then on the shuttle sends messages in that
+// encoding.
+const CMD_SetRpcEncoding = "SetRpcEncoding"
+
+type SetRpcEncoding struct {
+	Encoding    string
+	Compression string `json:",omitempty"`
+}
+
+// NewCodec returns a websocket codec sending values in the given encoding,
+// compressed if compression is set. Values without a CBOR encoding are
+// always sent as JSON. Received frames are decoded according to their frame
+// type and contents, so a connection can switch encodings at any point.
+func NewCodec(encoding, compression string) websocket.Codec {
+	return websocket.Codec{
+		Marshal: func(v interface{}) ([]byte, byte, error) {
+			data, frame, err := marshal(encoding, v)
+			if err != nil || compression != CompressionGzip || len(data) < compressMinSize {
+				return data, frame, err
+			}
+
+			buf := new(bytes.Buffer)
+			zw := gzip.NewWriter(buf)
+			if _, err := zw.Write(data); err != nil {
+				return nil, websocket.BinaryFrame, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, websocket.BinaryFrame, err
+			}
+			return buf.Bytes(), websocket.BinaryFrame, nil
+		},
+		Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+			if payloadType != websocket.BinaryFrame {
+				return json.Unmarshal(data, v)
+			}
+
+			if isGzip(data) {
+				var err error
+				data, err = gunzip(data)
+				if err != nil {
+					return fmt.Errorf("failed to decompress frame: %w", err)
+				}
+
+				// compressed frames may hold either encoding
+				if len(data) > 0 && data[0] == '{' {
+					return json.Unmarshal(data, v)
+				}
+			}
+
+			cu, ok := v.(cbg.CBORUnmarshaler)
+			if !ok {
+				return fmt.Errorf("received cbor frame for %T which has no cbor encoding", v)
+			}
+			return cu.UnmarshalCBOR(bytes.NewReader(data))
+		},
+	}
+}
+
+func marshal(encoding string, v interface{}) ([]byte, byte, error) {
+	if cm, ok := v.(cbg.CBORMarshaler); ok && encoding == EncodingCBOR {
+		buf := new(bytes.Buffer)
+		if err := cm.MarshalCBOR(buf); err != nil {
+			return nil, websocket.BinaryFrame, err
+		}
+		return buf.Bytes(), websocket.BinaryFrame, nil
+	}
+
+	data, err := json.Marshal(v)
+	return data, websocket.TextFrame, err
+}
+
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(zr, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxDecompressedSize {
+		return nil, fmt.Errorf("decompressed frame is over %d bytes", maxDecompressedSize)
+	}
+	return out, nil
+}
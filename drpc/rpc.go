@@ -1,6 +1,8 @@
 package drpc
 
 import (
+	"time"
+
 	"github.com/application-research/estuary/pinner/types"
 	"github.com/application-research/filclient"
 	"github.com/filecoin-project/go-address"
@@ -16,9 +18,58 @@ type Hello struct {
 
 	DiskSpaceFree int64
 
+	// Address is the wallet address the shuttle makes deals with
 	Address  address.Address
 	AddrInfo peer.AddrInfo
 	Private  bool
+
+	// RetrievalAddress pays for the shuttle's retrievals, it is unset by
+	// shuttles that use Address for everything
+	RetrievalAddress address.Address
+
+	// RpcEncodings lists the message encodings the shuttle can send
+	RpcEncodings []string `json:",omitempty"`
+
+	// RpcCompressions lists the compressions the shuttle can send messages with
+	RpcCompressions []string `json:",omitempty"`
+
+	// RpcAcks is set by shuttles that resend messages until the primary
+	// acknowledges them
+	RpcAcks bool `json:",omitempty"`
+
+	// HeartbeatInterval is how often the shuttle wants to exchange
+	// heartbeats, HeartbeatTimeout how long either side waits for one
+	// before giving up on the connection. Zero disables heartbeats.
+	HeartbeatInterval time.Duration `json:",omitempty"`
+	HeartbeatTimeout  time.Duration `json:",omitempty"`
+
+	// VerifiedDeals is set by shuttles that want deals for their content
+	// to be verified, or not, regardless of the primary's default
+	VerifiedDeals *bool `json:",omitempty"`
+
+	// TieringMinDeals is set by shuttles that move content off their hot
+	// storage once it has that many sealed deals, see CMD_TierContent
+	TieringMinDeals int `json:",omitempty"`
+
+	// AggregateMaxSize is set by shuttles that aggregate the content up to
+	// that size themselves, see OP_AggregateStaged
+	AggregateMaxSize int64 `json:",omitempty"`
+
+	// Draining is set by shuttles that are being emptied, see CMD_SetDraining
+	Draining bool `json:",omitempty"`
+
+	// LocalAuth is set by shuttles that check JWT api keys themselves, see
+	// CMD_SetAuthKey
+	LocalAuth bool `json:",omitempty"`
+
+	// Webhooks is set by shuttles that deliver webhook events, see
+	// CMD_SetWebhooks
+	Webhooks bool `json:",omitempty"`
+
+	// Region and StorageClass are free form labels from the shuttle's
+	// config, the primary prefers shuttles in the region of an upload
+	Region       string `json:",omitempty"`
+	StorageClass string `json:",omitempty"`
 }
 
 type Command struct {
@@ -45,6 +96,18 @@ type CmdParams struct {
 	RetrieveContent        *RetrieveContent        `json:",omitempty"`
 	UnpinContent           *UnpinContent           `json:",omitempty"`
 	RestartTransfer        *RestartTransfer        `json:",omitempty"`
+	InvalidateAuth         *InvalidateAuth         `json:",omitempty"`
+	SetRpcEncoding         *SetRpcEncoding         `json:",omitempty"`
+	AckMessages            *AckMessages            `json:",omitempty"`
+	SetPinWorkers          *SetPinWorkers          `json:",omitempty"`
+	CancelPin              *CancelPin              `json:",omitempty"`
+	AddPins                *AddPins                `json:",omitempty"`
+	SetPeers               *SetPeers               `json:",omitempty"`
+	MarketFunds            *MarketFunds            `json:",omitempty"`
+	TierContent            *TierContent            `json:",omitempty"`
+	SetDraining            *SetDraining            `json:",omitempty"`
+	SetAuthKey             *SetAuthKey             `json:",omitempty"`
+	SetWebhooks            *SetWebhooks            `json:",omitempty"`
 }
 
 const CMD_ComputeCommP = "ComputeCommP"
@@ -60,6 +123,21 @@ type AddPin struct {
 	UserId uint
 	Cid    cid.Cid
 	Peers  []*peer.AddrInfo
+
+	// Priority is the pinner.PinPriority to queue the pin with
+	Priority int `json:",omitempty"`
+
+	// MaxDepth is the number of levels of the dag to pin, zero for all of it
+	MaxDepth int `json:",omitempty"`
+}
+
+// CMD_AddPins queues a batch of pins at once, Peers are origin hints shared
+// by all of them on top of the ones of each pin
+const CMD_AddPins = "AddPins"
+
+type AddPins struct {
+	Pins  []AddPin
+	Peers []*peer.AddrInfo
 }
 
 const CMD_TakeContent = "TakeContent"
@@ -139,19 +217,131 @@ type UnpinContent struct {
 	Contents []uint
 }
 
+// CMD_CancelPin aborts the pin of a content that is queued or being fetched,
+// the shuttle reports it with the cancelled pin status
+const CMD_CancelPin = "CancelPin"
+
+type CancelPin struct {
+	DBID uint
+}
+
 const CMD_RestartTransfer = "RestartTransfer"
 
 type RestartTransfer struct {
 	ChanID datatransfer.ChannelID
 }
 
+const CMD_InvalidateAuth = "InvalidateAuth"
+
+// InvalidateAuth tells a shuttle to forget cached auth results, either for
+// the tokens with the given hashes or, if UserID is set, for all of a users
+// tokens
+type InvalidateAuth struct {
+	TokenHashes []string
+	UserID      uint
+}
+
+// CMD_AckMessages acknowledges messages received from a shuttle that set
+// RpcAcks in its Hello. An empty ack is sent right after the Hello to
+// confirm the primary acknowledges messages at all.
+const CMD_AckMessages = "AckMessages"
+
+type AckMessages struct {
+	IDs []uint64
+}
+
+// CMD_SetPinWorkers changes how many pins the shuttle fetches at once
+const CMD_SetPinWorkers = "SetPinWorkers"
+
+type SetPinWorkers struct {
+	Workers int
+}
+
+// CMD_SetPeers lists the peers a shuttle should stay connected to, the
+// primary and the other connected shuttles. Each list replaces the last one.
+const CMD_SetPeers = "SetPeers"
+
+type SetPeers struct {
+	Peers []peer.AddrInfo
+}
+
+// CMD_AddMarketFunds moves Amount from the shuttle's deal address into its
+// storage market escrow, CMD_WithdrawMarketFunds moves it back. The new
+// balances show up in the following updates.
+const CMD_AddMarketFunds = "AddMarketFunds"
+const CMD_WithdrawMarketFunds = "WithdrawMarketFunds"
+
+type MarketFunds struct {
+	Amount abi.TokenAmount
+}
+
+// CMD_TierContent lists the sealed deals of a content once it has as many
+// as the shuttle asked for in its Hello. The shuttle may then drop its hot
+// copy and retrieve it from the deals when it is needed again.
+const CMD_TierContent = "TierContent"
+
+type TierContent struct {
+	Content uint
+	Deals   []StorageDeal
+}
+
+// CMD_SetDraining starts or stops draining a shuttle. A draining shuttle
+// refuses new content and finishes the pins and transfers it has, while the
+// primary moves its content to other shuttles.
+const CMD_SetDraining = "SetDraining"
+
+type SetDraining struct {
+	Draining bool
+}
+
+// CMD_SetAuthKey gives shuttles that set LocalAuth in their Hello the key
+// the primary signs JWT api keys with, right after the Hello. Revoked lists
+// the hashes of revoked JWT api keys that have not expired yet, these are
+// checked with the primary, as are keys revoked later, see CMD_InvalidateAuth.
+const CMD_SetAuthKey = "SetAuthKey"
+
+type SetAuthKey struct {
+	PublicKey []byte
+	Revoked   []string
+}
+
+// CMD_SetWebhooks gives shuttles that set Webhooks in their Hello the
+// webhooks of every user right after the Hello, with All set, and the
+// webhooks of a user whenever they change.
+const CMD_SetWebhooks = "SetWebhooks"
+
+type Webhook struct {
+	ID     uint
+	UserID uint
+	URL    string
+	Secret string
+	Events []string
+}
+
+type SetWebhooks struct {
+	All      bool
+	UserID   uint
+	Webhooks []Webhook
+}
+
+// CMD_Heartbeat is sent periodically by primaries that support heartbeats
+// once a shuttle asked for them in its Hello. Shuttles answer with
+// OP_Heartbeat messages only after receiving the first one.
+const CMD_Heartbeat = "Heartbeat"
+
 type ContentFetch struct {
 	ID     uint
 	Cid    cid.Cid
 	UserID uint
+
+	// Location is the shuttle the content is taken from, it is told to
+	// release its copy once the content is complete on the new one
+	Location string `json:",omitempty"`
 }
 
 type Message struct {
+	// ID is set on messages the shuttle expects an AckMessages for
+	ID           uint64 `json:",omitempty"`
 	Op           string
 	Params       MsgParams
 	TraceCarrier *TraceCarrier `json:",omitempty"`
@@ -164,14 +354,26 @@ func (m *Message) HasTraceCarrier() bool {
 }
 
 type MsgParams struct {
-	UpdatePinStatus *UpdatePinStatus `json:",omitempty"`
-	PinComplete     *PinComplete     `json:",omitempty"`
-	CommPComplete   *CommPComplete   `json:",omitempty"`
-	TransferStatus  *TransferStatus  `json:",omitempty"`
-	TransferStarted *TransferStarted `json:",omitempty"`
-	ShuttleUpdate   *ShuttleUpdate   `json:",omitempty"`
-	GarbageCheck    *GarbageCheck    `json:",omitempty"`
-	SplitComplete   *SplitComplete   `json:",omitempty"`
+	UpdatePinStatus   *UpdatePinStatus   `json:",omitempty"`
+	PinComplete       *PinComplete       `json:",omitempty"`
+	PinCompleteBegin  *PinCompleteBegin  `json:",omitempty"`
+	PinCompletePart   *PinCompletePart   `json:",omitempty"`
+	PinCompleteCommit *PinCompleteCommit `json:",omitempty"`
+	CommPComplete     *CommPComplete     `json:",omitempty"`
+	TransferStatus    *TransferStatus    `json:",omitempty"`
+	TransferStarted   *TransferStarted   `json:",omitempty"`
+	ShuttleUpdate     *ShuttleUpdate     `json:",omitempty"`
+	GarbageCheck      *GarbageCheck      `json:",omitempty"`
+	SplitComplete     *SplitComplete     `json:",omitempty"`
+	Goodbye           *Goodbye           `json:",omitempty"`
+	PinAbandoned      *PinAbandoned      `json:",omitempty"`
+	WalletAddresses   *WalletAddresses   `json:",omitempty"`
+	ContentExpired    *ContentExpired    `json:",omitempty"`
+	AggregateStaged   *AggregateStaged   `json:",omitempty"`
+	TransferRestarted *TransferRestarted `json:",omitempty"`
+	ContentMigrated   *ContentMigrated   `json:",omitempty"`
+	PinProgress       *PinProgress       `json:",omitempty"`
+	ContentRemoved    *ContentRemoved    `json:",omitempty"`
 }
 
 const OP_UpdatePinStatus = "UpdatePinStatus"
@@ -179,6 +381,9 @@ const OP_UpdatePinStatus = "UpdatePinStatus"
 type UpdatePinStatus struct {
 	DBID   uint
 	Status types.PinningStatus
+
+	// Reason is set for failed pins
+	Reason types.PinFailureReason `json:",omitempty"`
 }
 
 type PinObj struct {
@@ -186,6 +391,41 @@ type PinObj struct {
 	Size int
 }
 
+// PinAbandoned is sent when a pin failed on every attempt the shuttle is
+// allowed to make, Errors lists the error of each attempt
+const OP_PinAbandoned = "PinAbandoned"
+
+type PinAbandoned struct {
+	DBID     uint
+	Attempts int
+	Errors   []string
+}
+
+// OP_PinProgress reports how far the running pins of a shuttle got, and
+// where its queued pins stand in line. It is sent periodically while pins
+// are queued or fetched and is not resent when lost.
+const OP_PinProgress = "PinProgress"
+
+type PinProgress struct {
+	Pins   []PinFetchProgress
+	Queued []PinQueuePosition
+}
+
+type PinFetchProgress struct {
+	DBID   uint
+	Blocks int
+	Bytes  int64
+
+	BytesPerSecond      float64
+	EstimatedCompletion *time.Time
+}
+
+type PinQueuePosition struct {
+	DBID           uint
+	Position       int
+	EstimatedStart *time.Time
+}
+
 const OP_PinComplete = "PinComplete"
 
 type PinComplete struct {
@@ -195,6 +435,42 @@ type PinComplete struct {
 	Objects []PinObj
 }
 
+// Pins with too many objects for a single message are reported with a
+// PinCompleteBegin, the objects split over PinCompleteParts and a
+// PinCompleteCommit in place of one PinComplete. Parts may arrive in any
+// order.
+const OP_PinCompleteBegin = "PinCompleteBegin"
+
+// PinCompletePartSize is the most objects sent in a single PinComplete or
+// PinCompletePart
+const PinCompletePartSize = 50000
+
+// MaxPinCompleteObjects bounds the objects of a pin reported in parts, and
+// so the number of parts
+const MaxPinCompleteObjects = 1 << 26
+
+const MaxPinCompleteParts = (MaxPinCompleteObjects + PinCompletePartSize - 1) / PinCompletePartSize
+
+type PinCompleteBegin struct {
+	DBID  uint
+	Size  int64
+	Parts int
+}
+
+const OP_PinCompletePart = "PinCompletePart"
+
+type PinCompletePart struct {
+	DBID    uint
+	Part    int
+	Objects []PinObj
+}
+
+const OP_PinCompleteCommit = "PinCompleteCommit"
+
+type PinCompleteCommit struct {
+	DBID uint
+}
+
 const OP_CommPComplete = "CommPComplete"
 
 type CommPComplete struct {
@@ -223,6 +499,18 @@ type TransferStatus struct {
 	Message string
 }
 
+// OP_TransferRestarted is sent for each time the shuttle restarts a deal
+// transfer that stalled or failed, Error is set if the restart failed
+const OP_TransferRestarted = "TransferRestarted"
+
+type TransferRestarted struct {
+	Chanid   string
+	DealDBID uint
+	Attempt  int
+	Reason   string
+	Error    string `json:",omitempty"`
+}
+
 const OP_ShuttleUpdate = "ShuttleUpdate"
 
 type ShuttleUpdate struct {
@@ -230,6 +518,105 @@ type ShuttleUpdate struct {
 	BlockstoreFree uint64
 	NumPins        int64
 	PinQueueSize   int
+
+	// the fields below are zero in updates from older shuttles
+
+	Version string `json:",omitempty"`
+
+	// CPUUsage is the number of cores the shuttle kept busy on average since
+	// its last update, NumCPU the number it has
+	CPUUsage float64 `json:",omitempty"`
+	NumCPU   int     `json:",omitempty"`
+
+	// MemoryUsed is the memory the shuttle process got from the os
+	MemoryUsed uint64 `json:",omitempty"`
+
+	ActiveTransfers int `json:",omitempty"`
+
+	// TransferRate is the bytes per second sent by storage deal transfers
+	// since the last update
+	TransferRate uint64 `json:",omitempty"`
+
+	Bitswap *BitswapStats `json:",omitempty"`
+
+	Provider *ProviderStats `json:",omitempty"`
+
+	Market *MarketBalance `json:",omitempty"`
+
+	// BlockstoreDisks breaks the blockstore size down per disk, when it is
+	// spread over more than one
+	BlockstoreDisks []BlockstoreDisk `json:",omitempty"`
+
+	// AddingPaused is set while the blockstore is past the shuttle's high
+	// disk watermark, it refuses new content until it is back below the low
+	// one
+	AddingPaused bool `json:",omitempty"`
+
+	// Draining is set while the shuttle is being emptied, see CMD_SetDraining
+	Draining bool `json:",omitempty"`
+
+	// Integrity is the result of the last check of the blockstore against
+	// the cids of its blocks
+	Integrity *IntegrityCheck `json:",omitempty"`
+
+	// IngestRate is the bytes per second of content the shuttle completed
+	// since the last update
+	IngestRate uint64 `json:",omitempty"`
+
+	// FreeSpaceTrend is how fast the blockstore free space changes in bytes
+	// per second, averaged over the recent updates; negative while it fills
+	FreeSpaceTrend int64 `json:",omitempty"`
+
+	// error counters, totals since the shuttle started
+	PinFailures     int64 `json:",omitempty"`
+	CommandFailures int64 `json:",omitempty"`
+	SendErrors      int64 `json:",omitempty"`
+}
+
+type BitswapStats struct {
+	Peers          int
+	BlocksSent     uint64
+	DataSent       uint64
+	BlocksReceived uint64
+	DataReceived   uint64
+}
+
+// ProviderStats summarizes how announcing content to the dht goes, Failures
+// counts the failed batches since the shuttle started
+type ProviderStats struct {
+	Strategy      string
+	QueueLength   int
+	LastReprovide time.Time
+	Failures      int64
+}
+
+// MarketBalance is the wallet and storage market escrow balance of the
+// shuttle's deal address, Locked is the part of Escrow held as deal
+// collateral
+type MarketBalance struct {
+	Address address.Address
+	Balance abi.TokenAmount
+	Escrow  abi.TokenAmount
+	Locked  abi.TokenAmount
+}
+
+// IntegrityCheck summarizes a check of a sample of the blocks of a shuttle.
+// Corrupted blocks do not match their cid, missing ones are referenced by
+// pins but not stored. FlaggedPins is the number of pins holding blocks
+// that could not be fetched again, in total.
+type IntegrityCheck struct {
+	Finished    time.Time
+	Checked     int
+	Corrupted   int
+	Missing     int
+	Repaired    int
+	FlaggedPins int64
+}
+
+type BlockstoreDisk struct {
+	Dir  string
+	Size uint64
+	Free uint64
 }
 
 const OP_GarbageCheck = "GarbageCheck"
@@ -243,3 +630,59 @@ const OP_SplitComplete = "SplitComplete"
 type SplitComplete struct {
 	ID uint
 }
+
+const OP_Heartbeat = "Heartbeat"
+
+// OP_Goodbye is sent by a shuttle when it starts shutting down, messages
+// about the work it still finishes may follow
+const OP_Goodbye = "Goodbye"
+
+type Goodbye struct {
+	Reason string
+}
+
+// OP_WalletAddresses is sent when the wallet addresses the shuttle uses
+// change, like when it rotates to its next deal address
+const OP_WalletAddresses = "WalletAddresses"
+
+type WalletAddresses struct {
+	Deals     address.Address
+	Retrieval address.Address
+}
+
+// OP_ContentExpired lists contents the shuttle unpinned because the expiry
+// they were added with passed
+const OP_ContentExpired = "ContentExpired"
+
+type ContentExpired struct {
+	Contents []uint
+}
+
+// OP_AggregateStaged asks the primary to create the content for an aggregate
+// the shuttle made of small contents, it answers with CMD_AggregateContent
+const OP_AggregateStaged = "AggregateStaged"
+
+type AggregateStaged struct {
+	UserID   uint
+	Root     cid.Cid
+	ObjData  []byte
+	Size     int64
+	Contents []uint
+}
+
+// OP_ContentMigrated is sent once content taken from another shuttle is
+// complete on this one, the primary moves it here and has From release it
+const OP_ContentMigrated = "ContentMigrated"
+
+type ContentMigrated struct {
+	Content uint
+	From    string
+}
+
+// OP_ContentRemoved lists contents the shuttle unpinned because their owner
+// removed the pins through the pinning api of the shuttle
+const OP_ContentRemoved = "ContentRemoved"
+
+type ContentRemoved struct {
+	Contents []uint
+}
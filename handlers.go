@@ -57,6 +57,7 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/libp2p/go-libp2p-core/peer"
+	rcmgr "github.com/libp2p/go-libp2p-resource-manager"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -106,6 +107,7 @@ func (s *Server) ServeAPI() error {
 
 	e.Use(s.tracingMiddleware)
 	e.Use(util.AppVersionMiddleware(s.estuaryCfg.AppVersion))
+	e.Use(s.shuttleSignatureMiddleware)
 	e.HTTPErrorHandler = util.ErrorHandler
 
 	e.GET("/debug/pprof/:prof", serveProfile)
@@ -129,7 +131,7 @@ func (s *Server) ServeAPI() error {
 	e.POST("/login", s.handleLoginUser)
 	e.GET("/health", s.handleHealth)
 
-	e.GET("/viewer", withUser(s.handleGetViewer), s.AuthRequired(util.PermLevelUpload))
+	e.GET("/viewer", withUser(s.handleGetViewer), s.AuthRequired(util.PermLevelUpload, util.ScopeUpload, util.ScopeRead))
 
 	e.GET("/retrieval-candidates/:cid", s.handleGetRetrievalCandidates)
 
@@ -144,6 +146,9 @@ func (s *Server) ServeAPI() error {
 	user.PUT("/password", withUser(s.handleUserChangePassword))
 	user.PUT("/address", withUser(s.handleUserChangeAddress))
 	user.GET("/stats", withUser(s.handleGetUserStats))
+	user.GET("/webhooks", withUser(s.handleUserGetWebhooks))
+	user.POST("/webhooks", withUser(s.handleUserCreateWebhook))
+	user.DELETE("/webhooks/:id", withUser(s.handleUserDeleteWebhook))
 
 	userMiner := user.Group("/miner")
 	userMiner.POST("/claim", withUser(s.handleUserClaimMiner))
@@ -153,9 +158,10 @@ func (s *Server) ServeAPI() error {
 	userMiner.PUT("/set-info/:miner", withUser(s.handleMinersSetInfo))
 
 	contmeta := e.Group("/content")
-	uploads := contmeta.Group("", s.AuthRequired(util.PermLevelUpload))
-	uploads.POST("/add", withUser(s.handleAdd))
-	uploads.POST("/add-ipfs", withUser(s.handleAddIpfs))
+	uploads := contmeta.Group("", s.AuthRequired(util.PermLevelUpload, util.ScopeUpload))
+	uploads.POST("/add", withUser(s.handleAdd), s.idempotent("add"))
+	uploads.POST("/add-ipfs", withUser(s.handleAddIpfs), s.idempotent("add-ipfs"))
+	uploads.POST("/add-ipfs/batch", withUser(s.handleAddIpfsBatch))
 	uploads.POST("/add-car", util.WithContentLengthCheck(withUser(s.handleAddCar)))
 	uploads.POST("/create", withUser(s.handleCreateContent))
 
@@ -164,6 +170,8 @@ func (s *Server) ServeAPI() error {
 	content.GET("/stats", withUser(s.handleStats))
 	content.GET("/ensure-replication/:datacid", s.handleEnsureReplication)
 	content.GET("/status/:id", withUser(s.handleContentStatus))
+	content.GET("/:id/status/stream", withUser(s.handleContentStatusStream))
+	content.GET("/add-ipfs/batch/:uuid", withUser(s.handleGetPinBatch))
 	content.GET("/list", withUser(s.handleListContent))
 	content.GET("/deals", withUser(s.handleListContentWithDeals))
 	content.GET("/failures/:content", withUser(s.handleGetContentFailures))
@@ -204,7 +212,7 @@ func (s *Server) ServeAPI() error {
 	colfs.POST("/add", withUser(s.handleColfsAdd))
 
 	pinning := e.Group("/pinning")
-	pinning.Use(openApiMiddleware)
+	pinning.Use(util.OpenApiMiddleware)
 	pinning.Use(s.AuthRequired(util.PermLevelUser))
 	pinning.GET("/pins", withUser(s.handleListPins))
 	pinning.POST("/pins", withUser(s.handleAddPin))
@@ -212,6 +220,19 @@ func (s *Server) ServeAPI() error {
 	pinning.POST("/pins/:pinid", withUser(s.handleReplacePin))
 	pinning.DELETE("/pins/:pinid", withUser(s.handleDeletePin))
 
+	// S3 compatible api over collections, it authenticates requests itself
+	// and answers with S3 xml errors
+	s3 := e.Group("/s3")
+	s3.GET("", s.s3Handler(s.handleS3ListBuckets))
+	s3.PUT("/:bucket", s.s3Handler(s.handleS3CreateBucket))
+	s3.HEAD("/:bucket", s.s3Handler(s.handleS3HeadBucket))
+	s3.GET("/:bucket", s.s3Handler(s.handleS3ListObjects))
+	s3.DELETE("/:bucket", s.s3Handler(s.handleS3DeleteBucket))
+	s3.PUT("/:bucket/*", s.s3Handler(s.handleS3PutObject))
+	s3.HEAD("/:bucket/*", s.s3Handler(s.handleS3GetObject))
+	s3.GET("/:bucket/*", s.s3Handler(s.handleS3GetObject))
+	s3.DELETE("/:bucket/*", s.s3Handler(s.handleS3DeleteObject))
+
 	// explicitly public, for now
 	public := e.Group("/public")
 
@@ -271,6 +292,8 @@ func (s *Server) ServeAPI() error {
 	admin.POST("/cm/break-aggregate/:content", s.handleAdminBreakAggregate)
 	admin.POST("/cm/transfer/restart/:chanid", s.handleTransferRestart)
 	admin.POST("/cm/repinall/:shuttle", s.handleShuttleRepinAll)
+	admin.POST("/cm/pins/:content/cancel", s.handleAdminCancelPin)
+	admin.POST("/cm/content/:content/verified-deal", s.handleAdminSetVerifiedDeal)
 
 	//	peering
 	adminPeering := admin.Group("/peering")
@@ -283,6 +306,9 @@ func (s *Server) ServeAPI() error {
 
 	admnetw := admin.Group("/net")
 	admnetw.GET("/peers", s.handleNetPeers)
+	admnetw.GET("/rcmgr/stats", s.handleRcmgrStats)
+
+	admin.GET("/provider/stats", s.handleProviderStats)
 
 	admin.GET("/retrieval/querytest/:content", s.handleRetrievalCheck)
 	admin.GET("/retrieval/stats", s.handleGetRetrievalInfo)
@@ -295,10 +321,15 @@ func (s *Server) ServeAPI() error {
 
 	users := admin.Group("/users")
 	users.GET("", s.handleAdminGetUsers)
+	users.PUT("/:id/max-upload-size", s.handleAdminSetUserMaxUploadSize)
 
 	shuttle := admin.Group("/shuttle")
 	shuttle.POST("/init", s.handleShuttleInit)
 	shuttle.GET("/list", s.handleShuttleList)
+	shuttle.PUT("/:handle/pin-workers", s.handleShuttleSetPinWorkers)
+	shuttle.POST("/:handle/market/add", s.handleShuttleAddMarketFunds)
+	shuttle.POST("/:handle/market/withdraw", s.handleShuttleWithdrawMarketFunds)
+	shuttle.PUT("/:handle/drain", s.handleShuttleSetDraining)
 
 	ar := admin.Group("/autoretrieve")
 	ar.POST("/init", s.handleAutoretrieveInit)
@@ -312,7 +343,19 @@ func (s *Server) ServeAPI() error {
 	if os.Getenv("ENABLE_SWAGGER_ENDPOINT") == "true" {
 		e.GET("/swagger/*", echoSwagger.WrapHandler)
 	}
-	return e.Start(s.estuaryCfg.ApiListen)
+
+	if !s.estuaryCfg.TLS.Enabled() {
+		return e.Start(s.estuaryCfg.ApiListen)
+	}
+
+	tc, err := s.serverTLSConfig()
+	if err != nil {
+		return err
+	}
+	return e.StartServer(&http.Server{
+		Addr:      s.estuaryCfg.ApiListen,
+		TLSConfig: tc,
+	})
 }
 
 type binder struct{}
@@ -603,6 +646,7 @@ func (s *Server) handlePeeringStatus(c echo.Context) error {
 // @Tags         content
 // @Produce      json
 // @Param        body body util.ContentAddIpfsBody true "IPFS Body"
+// @Param        Idempotency-Key header string false "Key for safely retrying the request, retries with the same key return the first response"
 // @Router       /content/add-ipfs [post]
 func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
@@ -670,6 +714,10 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 		return err
 	}
 
+	if err := util.ValidatePinDepth(params.Depth); err != nil {
+		return err
+	}
+
 	if c.QueryParam("ignore-dupes") == "true" {
 		var count int64
 		if err := s.DB.Model(util.Content{}).Where("cid = ? and user_id = ?", rcid.Bytes(), u.ID).Count(&count).Error; err != nil {
@@ -681,7 +729,7 @@ func (s *Server) handleAddIpfs(c echo.Context, u *User) error {
 	}
 
 	makeDeal := true
-	pinstatus, err := s.CM.pinContent(ctx, u.ID, rcid, filename, cols, origins, 0, nil, makeDeal)
+	pinstatus, err := s.CM.pinContent(ctx, u.ID, rcid, filename, cols, origins, 0, nil, params.Depth, makeDeal)
 	if err != nil {
 		return err
 	}
@@ -786,7 +834,7 @@ func (s *Server) handleAddCar(c echo.Context, u *User) error {
 	}()
 
 	go func() {
-		if err := s.Node.Provider.Provide(rootCID); err != nil {
+		if err := s.Node.ProvideRoot(rootCID); err != nil {
 			log.Warnf("failed to announce providers: %s", err)
 		}
 	}()
@@ -815,6 +863,7 @@ func (s *Server) loadCar(ctx context.Context, bs blockstore.Blockstore, r io.Rea
 // @Param        file formData file true "File to upload"
 // @Param        coluuid path string false "Collection UUID"
 // @Param        dir path string false "Directory"
+// @Param        Idempotency-Key header string false "Key for safely retrying the request, retries with the same key return the first response"
 // @Router       /content/add [post]
 func (s *Server) handleAdd(c echo.Context, u *User) error {
 	ctx, span := s.tracer.Start(c.Request().Context(), "handleAdd", trace.WithAttributes(attribute.Int("user", int(u.ID))))
@@ -947,7 +996,7 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 		s.CM.ToCheck <- content.ID
 	}()
 
-	if c.QueryParam("lazy-provide") != "true" {
+	if c.QueryParam("lazy-provide") != "true" && s.Node.ProvidesContent() {
 		subctx, cancel := context.WithTimeout(ctx, time.Second*10)
 		defer cancel()
 		if err := s.Node.FullRT.Provide(subctx, nd.Cid(), true); err != nil {
@@ -957,7 +1006,7 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 	}
 
 	go func() {
-		if err := s.Node.Provider.Provide(nd.Cid()); err != nil {
+		if err := s.Node.ProvideRoot(nd.Cid()); err != nil {
 			log.Warnf("failed to announce providers: %s", err)
 		}
 	}()
@@ -973,7 +1022,7 @@ func (s *Server) handleAdd(c echo.Context, u *User) error {
 // redirectContentAdding is called when localContentAddingDisabled is true
 // it finds available shuttles and adds the desired content in one of them
 func (s *Server) redirectContentAdding(c echo.Context, u *User) error {
-	uep, err := s.getPreferredUploadEndpoints(u)
+	uep, err := s.getPreferredUploadEndpoints(u, c.QueryParam("region"))
 	if err != nil {
 		return fmt.Errorf("failed to get preferred upload endpoints: %s", err)
 	}
@@ -1017,7 +1066,7 @@ func (s *Server) importFile(ctx context.Context, dserv ipld.DAGService, fi io.Re
 
 var noDataTimeout = time.Minute * 10
 
-func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont uint, dserv ipld.NodeGetter, root cid.Cid, cb func(int64)) error {
+func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont uint, dserv ipld.NodeGetter, root cid.Cid, maxDepth int, cb func(int64)) error {
 	ctx, span := cm.tracer.Start(ctx, "computeObjRefsUpdate")
 	defer span.End()
 
@@ -1062,7 +1111,7 @@ func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont
 		cm.inflightCidsLk.Unlock()
 	}()
 
-	err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+	err := merkledag.WalkDepth(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
 		// cset.Visit gets called first, so if we reach here we should immediately track the CID
 		cm.inflightCidsLk.Lock()
 		cm.inflightCids[c]++
@@ -1092,7 +1141,12 @@ func (cm *ContentManager) addDatabaseTrackingToContent(ctx context.Context, cont
 		}
 
 		return util.FilterUnwalkableLinks(node.Links()), nil
-	}, root, cset.Visit, merkledag.Concurrent())
+	}, root, func(c cid.Cid, depth int) bool {
+		if maxDepth > 0 && depth >= maxDepth {
+			return false
+		}
+		return cset.Visit(c)
+	}, merkledag.Concurrent())
 
 	if err != nil {
 		return err
@@ -1118,7 +1172,7 @@ func (cm *ContentManager) addDatabaseTracking(ctx context.Context, u *User, dser
 		return nil, xerrors.Errorf("failed to track new content in database: %w", err)
 	}
 
-	if err := cm.addDatabaseTrackingToContent(ctx, content.ID, dserv, root, func(int64) {}); err != nil {
+	if err := cm.addDatabaseTrackingToContent(ctx, content.ID, dserv, root, 0, func(int64) {}); err != nil {
 		return nil, err
 	}
 
@@ -2694,6 +2748,72 @@ func (s *Server) handleRefreshContent(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{})
 }
 
+// handleAdminCancelPin godoc
+// @Summary      Cancel a pin
+// @Description  This endpoint aborts the pin of a content that is queued or being fetched
+// @Tags         admin
+// @Produce      json
+// @Param        content path int true "Content ID"
+// @Router       /admin/cm/pins/{content}/cancel [post]
+func (s *Server) handleAdminCancelPin(c echo.Context) error {
+	cont, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
+
+	if err := s.CM.cancelPin(c.Request().Context(), uint(cont)); err != nil {
+		if xerrors.Is(err, ErrNoShuttleConnection) {
+			return &util.HttpError{
+				Code:    http.StatusServiceUnavailable,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("shuttle pinning content %d is not connected", cont),
+			}
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
+type setVerifiedDealBody struct {
+	// Verified is unset to go back to the default of the shuttle or node
+	Verified *bool `json:"verified"`
+}
+
+// handleAdminSetVerifiedDeal godoc
+// @Summary      Set whether deals for a content are verified
+// @Description  This endpoint overrides whether new deals for a content use datacap, a null value goes back to the default
+// @Tags         admin
+// @Produce      json
+// @Param        content path int true "Content ID"
+// @Param        body body main.setVerifiedDealBody true "Verified deal setting"
+// @Router       /admin/cm/content/{content}/verified-deal [post]
+func (s *Server) handleAdminSetVerifiedDeal(c echo.Context) error {
+	cont, err := strconv.Atoi(c.Param("content"))
+	if err != nil {
+		return err
+	}
+
+	var body setVerifiedDealBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	res := s.DB.Model(util.Content{}).Where("id = ?", cont).Update("verified_deal", body.Verified)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_CONTENT_NOT_FOUND,
+			Details: fmt.Sprintf("content with ID(%d) was not found", cont),
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
 func (s *Server) handleReadLocalContent(c echo.Context) error {
 	cont, err := strconv.Atoi(c.Param("content"))
 	if err != nil {
@@ -2766,7 +2886,9 @@ func (s *Server) checkTokenAuth(token string) (*User, error) {
 	return &user, nil
 }
 
-func (s *Server) AuthRequired(level int) echo.MiddlewareFunc {
+// AuthRequired checks that the user has at least perm level and that the api
+// key has one of scopes, or of the default scopes for level if none are given.
+func (s *Server) AuthRequired(level int, scopes ...string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 
@@ -2788,13 +2910,17 @@ func (s *Server) AuthRequired(level int) echo.MiddlewareFunc {
 
 			span.SetAttributes(attribute.Int("user", int(u.ID)))
 
-			if u.authToken.UploadOnly && level >= util.PermLevelUser {
-				log.Warnw("api key is upload only", "user", u.ID, "perm", u.Perm, "required", level)
+			required := scopes
+			if len(required) == 0 {
+				required = util.DefaultScopes(level, c.Request().Method)
+			}
+			if keyScopes := u.authToken.scopes(); !util.ScopesAllow(keyScopes, required) {
+				log.Warnw("api key scopes do not allow route", "user", u.ID, "scopes", keyScopes, "required", required)
 
 				return &util.HttpError{
 					Code:    http.StatusForbidden,
 					Reason:  util.ERR_NOT_AUTHORIZED,
-					Details: "api key is upload only",
+					Details: fmt.Sprintf("api key is limited to %s", strings.Join(keyScopes, ",")),
 				}
 			}
 
@@ -2935,7 +3061,7 @@ func (s *Server) handleLoginUser(c echo.Context) error {
 		}
 	}
 
-	authToken, err := s.newAuthTokenForUser(&user, time.Now().Add(time.Hour*24*30), nil)
+	authToken, err := s.newAuthTokenForUser(&user, time.Now().Add(time.Hour*24*30), nil, false)
 	if err != nil {
 		return err
 	}
@@ -3021,28 +3147,38 @@ func (s *Server) handleGetUserStats(c echo.Context, u *User) error {
 	return c.JSON(http.StatusOK, stats)
 }
 
-func (s *Server) newAuthTokenForUser(user *User, expiry time.Time, perms []string) (*AuthToken, error) {
-	if len(perms) > 1 {
-		return nil, fmt.Errorf("invalid perms")
+// newAuthTokenForUser makes an api key for user limited to perms, see
+// util.ParseScopes. asJWT makes a JWT key that shuttles check themselves.
+func (s *Server) newAuthTokenForUser(user *User, expiry time.Time, perms []string, asJWT bool) (*AuthToken, error) {
+	scopes, err := util.ParseScopes(strings.Join(perms, ","))
+	if err != nil {
+		return nil, err
 	}
 
-	var uploadOnly bool
-	if len(perms) == 1 {
-		switch perms[0] {
-		case "all":
-			uploadOnly = false
-		case "upload":
-			uploadOnly = true
-		default:
-			return nil, fmt.Errorf("invalid perm: %q", perms[0])
+	for _, sc := range scopes {
+		if sc == util.ScopeAdmin && user.Perm < util.PermLevelAdmin {
+			return nil, &util.HttpError{
+				Code:    http.StatusForbidden,
+				Reason:  util.ERR_NOT_AUTHORIZED,
+				Details: "only admins can create admin api keys",
+			}
+		}
+	}
+
+	token := "EST" + uuid.New().String() + "ARY"
+	if asJWT {
+		token, err = s.newJWTAuthToken(user, expiry, scopes)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	authToken := &AuthToken{
-		Token:      "EST" + uuid.New().String() + "ARY",
+		Token:      token,
 		User:       user.ID,
 		Expiry:     expiry,
-		UploadOnly: uploadOnly,
+		UploadOnly: len(scopes) == 1 && scopes[0] == util.ScopeUpload,
+		Scopes:     strings.Join(scopes, ","),
 	}
 
 	if err := s.DB.Create(authToken).Error; err != nil {
@@ -3053,7 +3189,7 @@ func (s *Server) newAuthTokenForUser(user *User, expiry time.Time, perms []strin
 }
 
 func (s *Server) handleGetViewer(c echo.Context, u *User) error {
-	uep, err := s.getPreferredUploadEndpoints(u)
+	uep, err := s.getPreferredUploadEndpoints(u, c.QueryParam("region"))
 	if err != nil {
 		return err
 	}
@@ -3074,8 +3210,10 @@ func (s *Server) handleGetViewer(c echo.Context, u *User) error {
 			DealMakingDisabled:    s.CM.dealMakingDisabled(),
 			UploadEndpoints:       uep,
 			Flags:                 u.Flags,
+			MaxUploadSize:         u.MaxUploadSize,
 		},
 		AuthExpiry: u.authToken.Expiry,
+		Scopes:     u.authToken.scopes(),
 	})
 }
 
@@ -3094,18 +3232,23 @@ func (s *Server) getMinersOwnedByUser(u *User) []string {
 	return out
 }
 
-func (s *Server) getPreferredUploadEndpoints(u *User) ([]string, error) {
-
-	// TODO: this should be a lotttttt smarter
+// getPreferredUploadEndpoints lists the upload endpoints of the shuttles that
+// take new content, best first. Shuttles in region come first when it is set.
+func (s *Server) getPreferredUploadEndpoints(u *User, region string) ([]string, error) {
 	s.CM.shuttlesLk.Lock()
 	defer s.CM.shuttlesLk.Unlock()
 	var shuttles []Shuttle
+	hints := make(map[string]uploadHints)
 	for hnd, sh := range s.CM.shuttles {
 		if sh.hostname == "" {
 			log.Debugf("shuttle %+v has empty hostname", sh)
 			continue
 		}
 
+		if sh.shuttingDown || sh.addingPaused || sh.draining {
+			continue
+		}
+
 		var shuttle Shuttle
 		if err := s.DB.First(&shuttle, "handle = ?", hnd).Error; err != nil {
 			log.Errorf("failed to look up shuttle by handle: %s", err)
@@ -3118,10 +3261,11 @@ func (s *Server) getPreferredUploadEndpoints(u *User) ([]string, error) {
 		}
 
 		shuttles = append(shuttles, shuttle)
+		hints[hnd] = sh.uploadHints(region)
 	}
 
-	sort.Slice(shuttles, func(i, j int) bool {
-		return shuttles[i].Priority > shuttles[j].Priority
+	sort.SliceStable(shuttles, func(i, j int) bool {
+		return hints[shuttles[i].Handle].better(hints[shuttles[j].Handle], shuttles[i].Priority, shuttles[j].Priority)
 	})
 
 	var out []string
@@ -3148,6 +3292,7 @@ func (s *Server) handleHealth(c echo.Context) error {
 type getApiKeysResp struct {
 	Token  string    `json:"token"`
 	Expiry time.Time `json:"expiry"`
+	Scopes []string  `json:"scopes,omitempty"`
 }
 
 // handleUserRevokeApiKey godoc
@@ -3164,14 +3309,19 @@ func (s *Server) handleUserRevokeApiKey(c echo.Context, u *User) error {
 		return err
 	}
 
+	s.CM.invalidateShuttleAuth(c.Request().Context(), 0, kval)
+
 	return c.NoContent(200)
 }
 
 // handleUserCreateApiKey godoc
 // @Summary      Create API keys for a user
-// @Description  This endpoint is used to create API keys for a user. In estuary, each user is given an API key to access all features.
+// @Description  This endpoint is used to create API keys for a user. In estuary, each user is given an API key to access all features. A key can be limited to scopes: upload keys can only add content, read keys can only read, and admin keys, which only admins can create, can do anything.
 // @Tags         User
 // @Produce      json
+// @Param        expiry  query  string  false  "Expiration of the key, or false for none"
+// @Param        perms   query  string  false  "Comma separated scopes of the key: upload, read, admin, or all for none"
+// @Param        format  query  string  false  "jwt for a signed key that shuttles check without asking the primary"
 // @Success      200  {object}  getApiKeysResp
 // @Failure      400  {object}  util.HttpError
 // @Failure      404  {object}  util.HttpError
@@ -3196,7 +3346,7 @@ func (s *Server) handleUserCreateApiKey(c echo.Context, u *User) error {
 		perms = strings.Split(p, ",")
 	}
 
-	authToken, err := s.newAuthTokenForUser(u, expiry, perms)
+	authToken, err := s.newAuthTokenForUser(u, expiry, perms, c.QueryParam("format") == "jwt")
 	if err != nil {
 		return err
 	}
@@ -3204,6 +3354,7 @@ func (s *Server) handleUserCreateApiKey(c echo.Context, u *User) error {
 	return c.JSON(http.StatusOK, &getApiKeysResp{
 		Token:  authToken.Token,
 		Expiry: authToken.Expiry,
+		Scopes: authToken.scopes(),
 	})
 }
 
@@ -3228,6 +3379,7 @@ func (s *Server) handleUserGetApiKeys(c echo.Context, u *User) error {
 		out = append(out, getApiKeysResp{
 			Token:  k.Token,
 			Expiry: k.Expiry,
+			Scopes: k.scopes(),
 		})
 	}
 
@@ -3446,7 +3598,7 @@ func (s *Server) handleCommitCollection(c echo.Context, u *User) error {
 	ctx := c.Request().Context()
 	makeDeal := false
 
-	pinstatus, err := s.CM.pinContent(ctx, u.ID, collectionNode.Cid(), collectionNode.Cid().String(), nil, origins, 0, nil, makeDeal)
+	pinstatus, err := s.CM.pinContent(ctx, u.ID, collectionNode.Cid(), collectionNode.Cid().String(), nil, origins, 0, nil, 0, makeDeal)
 	if err != nil {
 		return err
 	}
@@ -3688,6 +3840,54 @@ func (s *Server) handleAdminGetUsers(c echo.Context) error {
 	return c.JSON(http.StatusOK, resp)
 }
 
+type setMaxUploadSizeBody struct {
+	MaxUploadSize int64 `json:"maxUploadSize"`
+}
+
+// handleAdminSetUserMaxUploadSize godoc
+// @Summary      Set a users upload size limit
+// @Description  This endpoint sets the largest upload a user may send to shuttles, overriding the shuttle default. A limit of 0 resets it to the default.
+// @Tags         admin
+// @Produce      json
+// @Param        id    path  int                  true  "User ID"
+// @Param        body  body  setMaxUploadSizeBody true  "Upload size limit in bytes"
+// @Router       /admin/users/{id}/max-upload-size [put]
+func (s *Server) handleAdminSetUserMaxUploadSize(c echo.Context) error {
+	uid, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	var body setMaxUploadSizeBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if body.MaxUploadSize < 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "maxUploadSize must not be negative",
+		}
+	}
+
+	res := s.DB.Model(&User{}).Where("id = ?", uid).Update("max_upload_size", body.MaxUploadSize)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &util.HttpError{
+			Code:   http.StatusNotFound,
+			Reason: util.ERR_USER_NOT_FOUND,
+		}
+	}
+
+	// shuttles cache user settings along with the auth result
+	s.CM.invalidateShuttleAuth(c.Request().Context(), uint(uid))
+
+	return c.JSON(http.StatusOK, map[string]string{})
+}
+
 type publicStatsResponse struct {
 	TotalStorage       sql.NullInt64 `json:"totalStorage"`
 	TotalFilesStored   sql.NullInt64 `json:"totalFiles"`
@@ -3821,6 +4021,39 @@ func (s *Server) handleNetPeers(c echo.Context) error {
 	return c.JSON(http.StatusOK, s.Node.Host.Network().Peers())
 }
 
+// handleRcmgrStats godoc
+// @Summary      Resource manager stats
+// @Description  This endpoint returns the current usage of the libp2p resource manager
+// @Tags         admin,net
+// @Produce      json
+// @Router       /admin/net/rcmgr/stats [get]
+func (s *Server) handleRcmgrStats(c echo.Context) error {
+	rcm, ok := s.Node.Host.Network().ResourceManager().(rcmgr.ResourceManagerState)
+	if !ok {
+		return &util.HttpError{
+			Code:    http.StatusNotFound,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "resource manager is disabled on this node",
+		}
+	}
+
+	return c.JSON(http.StatusOK, rcm.Stat())
+}
+
+// handleProviderStats godoc
+// @Summary      Provider stats
+// @Description  This endpoint returns the state of the queue of content waiting to be announced to the dht, and of the last provides and reprovides
+// @Tags         admin,net
+// @Produce      json
+// @Router       /admin/provider/stats [get]
+func (s *Server) handleProviderStats(c echo.Context) error {
+	st, err := s.Node.ProvideStats(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, st)
+}
+
 // handleNetAddrs godoc
 // @Summary      Net Addrs
 // @Description  This endpoint is used to get net addrs
@@ -4351,6 +4584,113 @@ func (s *Server) handleShuttleInit(c echo.Context) error {
 	})
 }
 
+type setPinWorkersBody struct {
+	Workers int `json:"workers"`
+}
+
+// handleShuttleSetPinWorkers godoc
+// @Summary      Set a shuttles pin concurrency
+// @Description  This endpoint changes how many pins a connected shuttle fetches at once, without restarting it.
+// @Tags         admin
+// @Produce      json
+// @Param        handle  path  string             true  "Shuttle handle"
+// @Param        body    body  setPinWorkersBody  true  "Number of pin workers"
+// @Router       /admin/shuttle/{handle}/pin-workers [put]
+func (s *Server) handleShuttleSetPinWorkers(c echo.Context) error {
+	var body setPinWorkersBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if body.Workers < 1 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: "workers must be at least 1",
+		}
+	}
+
+	if err := s.CM.sendShuttleCommand(c.Request().Context(), c.Param("handle"), &drpc.Command{
+		Op: drpc.CMD_SetPinWorkers,
+		Params: drpc.CmdParams{
+			SetPinWorkers: &drpc.SetPinWorkers{Workers: body.Workers},
+		},
+	}); err != nil {
+		if xerrors.Is(err, ErrNoShuttleConnection) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("shuttle %s is not connected", c.Param("handle")),
+			}
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &body)
+}
+
+type shuttleMarketFundsBody struct {
+	Amount string `json:"amount"`
+}
+
+// handleShuttleAddMarketFunds godoc
+// @Summary      Add funds to a shuttles market escrow
+// @Description  This endpoint has a connected shuttle move FIL from its deal address into its storage market escrow. The new balance shows up in the shuttle list once the message lands.
+// @Tags         admin
+// @Produce      json
+// @Param        handle  path  string                  true  "Shuttle handle"
+// @Param        body    body  shuttleMarketFundsBody  true  "Amount of FIL to add"
+// @Router       /admin/shuttle/{handle}/market/add [post]
+func (s *Server) handleShuttleAddMarketFunds(c echo.Context) error {
+	return s.sendShuttleMarketFunds(c, drpc.CMD_AddMarketFunds)
+}
+
+// handleShuttleWithdrawMarketFunds godoc
+// @Summary      Withdraw funds from a shuttles market escrow
+// @Description  This endpoint has a connected shuttle move unlocked FIL from its storage market escrow back to its deal address.
+// @Tags         admin
+// @Produce      json
+// @Param        handle  path  string                  true  "Shuttle handle"
+// @Param        body    body  shuttleMarketFundsBody  true  "Amount of FIL to withdraw"
+// @Router       /admin/shuttle/{handle}/market/withdraw [post]
+func (s *Server) handleShuttleWithdrawMarketFunds(c echo.Context) error {
+	return s.sendShuttleMarketFunds(c, drpc.CMD_WithdrawMarketFunds)
+}
+
+func (s *Server) sendShuttleMarketFunds(c echo.Context, op string) error {
+	var body shuttleMarketFundsBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	amt, err := types.ParseFIL(body.Amount)
+	if err != nil || types.BigCmp(types.BigInt(amt), big.Zero()) <= 0 {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("amount must be a positive FIL value, got %q", body.Amount),
+		}
+	}
+
+	if err := s.CM.sendShuttleCommand(c.Request().Context(), c.Param("handle"), &drpc.Command{
+		Op: op,
+		Params: drpc.CmdParams{
+			MarketFunds: &drpc.MarketFunds{Amount: abi.TokenAmount(amt)},
+		},
+	}); err != nil {
+		if xerrors.Is(err, ErrNoShuttleConnection) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("shuttle %s is not connected", c.Param("handle")),
+			}
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &body)
+}
+
 func (s *Server) handleShuttleList(c echo.Context) error {
 	var shuttles []Shuttle
 	if err := s.DB.Find(&shuttles).Error; err != nil {
@@ -4359,6 +4699,7 @@ func (s *Server) handleShuttleList(c echo.Context) error {
 
 	var out []util.ShuttleListResponse
 	for _, d := range shuttles {
+		addr, retrievalAddr := s.CM.shuttleWalletAddrs(d.Handle)
 		out = append(out, util.ShuttleListResponse{
 			Handle:         d.Handle,
 			Token:          d.Token,
@@ -4367,6 +4708,10 @@ func (s *Server) handleShuttleList(c echo.Context) error {
 			AddrInfo:       s.CM.shuttleAddrInfo(d.Handle),
 			Hostname:       s.CM.shuttleHostName(d.Handle),
 			StorageStats:   s.CM.shuttleStorageStats(d.Handle),
+			Stats:          s.CM.shuttleStats(d.Handle),
+
+			Address:          addr,
+			RetrievalAddress: retrievalAddr,
 		})
 	}
 
@@ -4384,6 +4729,11 @@ func (s *Server) handleShuttleConnection(c echo.Context) error {
 		return err
 	}
 
+	if err := s.checkShuttleCert(c.Request(), shuttle.Handle); err != nil {
+		log.Warnw("shuttle client certificate rejected", "handle", shuttle.Handle, "err", err)
+		return err
+	}
+
 	websocket.Handler(func(ws *websocket.Conn) {
 		ws.MaxPayloadBytes = 128 << 20
 
@@ -4403,16 +4753,136 @@ func (s *Server) handleShuttleConnection(c echo.Context) error {
 		}
 		defer unreg()
 
+		// messages can be received in any encoding, the shuttle is told which
+		// one it may use before any other command is sent
+		codec := drpc.NewCodec(drpc.EncodingJSON, "")
+		enc := selectRpcEncoding(hello.RpcEncodings)
+		compression := selectRpcCompression(hello.RpcCompressions)
+		if enc != drpc.EncodingJSON || compression != "" {
+			if err := codec.Send(ws, &drpc.Command{
+				Op: drpc.CMD_SetRpcEncoding,
+				Params: drpc.CmdParams{
+					SetRpcEncoding: &drpc.SetRpcEncoding{
+						Encoding:    enc,
+						Compression: compression,
+					},
+				},
+			}); err != nil {
+				log.Errorf("failed to send rpc encoding to shuttle: %s", err)
+				return
+			}
+		}
+
+		// shuttles that check JWT api keys themselves need the key they are
+		// signed with, and which of them were revoked
+		if hello.LocalAuth {
+			sak, err := s.shuttleAuthKey()
+			if err != nil {
+				log.Errorf("failed to list revoked api keys for shuttle: %s", err)
+				return
+			}
+			if err := codec.Send(ws, &drpc.Command{
+				Op:     drpc.CMD_SetAuthKey,
+				Params: drpc.CmdParams{SetAuthKey: sak},
+			}); err != nil {
+				log.Errorf("failed to send auth key to shuttle: %s", err)
+				return
+			}
+		}
+
+		if hello.Webhooks {
+			sw, err := s.shuttleWebhooks(0)
+			if err != nil {
+				log.Errorf("failed to list webhooks for shuttle: %s", err)
+				return
+			}
+			if err := codec.Send(ws, &drpc.Command{
+				Op:     drpc.CMD_SetWebhooks,
+				Params: drpc.CmdParams{SetWebhooks: sw},
+			}); err != nil {
+				log.Errorf("failed to send webhooks to shuttle: %s", err)
+				return
+			}
+		}
+
+		// an empty ack tells the shuttle that its messages will be acknowledged
+		if hello.RpcAcks {
+			if err := codec.Send(ws, &drpc.Command{
+				Op: drpc.CMD_AckMessages,
+				Params: drpc.CmdParams{
+					AckMessages: &drpc.AckMessages{},
+				},
+			}); err != nil {
+				log.Errorf("failed to confirm message acks to shuttle: %s", err)
+				return
+			}
+		}
+
+		// heartbeats are only sent to shuttles that ask for them, the first
+		// one right away so the shuttle starts sending its own
+		var heartbeat <-chan time.Time
+		if hello.HeartbeatInterval > 0 {
+			if hello.HeartbeatInterval < minHeartbeatInterval {
+				hello.HeartbeatInterval = minHeartbeatInterval
+			}
+			if err := codec.Send(ws, &drpc.Command{Op: drpc.CMD_Heartbeat}); err != nil {
+				log.Errorf("failed to send heartbeat to shuttle: %s", err)
+				return
+			}
+
+			hbTicker := time.NewTicker(hello.HeartbeatInterval)
+			defer hbTicker.Stop()
+			heartbeat = hbTicker.C
+		}
+
+		acks := make(chan uint64, 128)
 		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+
+			var pending []uint64
+			flushAcks := func() error {
+				if len(pending) == 0 {
+					return nil
+				}
+				err := codec.Send(ws, &drpc.Command{
+					Op: drpc.CMD_AckMessages,
+					Params: drpc.CmdParams{
+						AckMessages: &drpc.AckMessages{IDs: pending},
+					},
+				})
+				pending = nil
+				return err
+			}
+
 			for {
 				select {
 				case cmd := <-cmds:
 					// Write
-					err := websocket.JSON.Send(ws, cmd)
+					err := codec.Send(ws, cmd)
 					if err != nil {
 						log.Errorf("failed to write command to shuttle: %s", err)
 						return
 					}
+				case id := <-acks:
+					pending = append(pending, id)
+					if len(pending) < maxAckBatch {
+						continue
+					}
+					if err := flushAcks(); err != nil {
+						log.Errorf("failed to write acks to shuttle: %s", err)
+						return
+					}
+				case <-ticker.C:
+					if err := flushAcks(); err != nil {
+						log.Errorf("failed to write acks to shuttle: %s", err)
+						return
+					}
+				case <-heartbeat:
+					if err := codec.Send(ws, &drpc.Command{Op: drpc.CMD_Heartbeat}); err != nil {
+						log.Errorf("failed to send heartbeat to shuttle: %s", err)
+						return
+					}
 				case <-done:
 					return
 				}
@@ -4421,22 +4891,72 @@ func (s *Server) handleShuttleConnection(c echo.Context) error {
 
 		go s.RestartAllTransfersForLocation(context.TODO(), shuttle.Handle)
 
+		if hello.HeartbeatTimeout > 0 {
+			if err := ws.SetReadDeadline(time.Now().Add(hello.HeartbeatTimeout)); err != nil {
+				log.Errorf("failed to set the shuttle connection's read deadline: %s", err)
+			}
+		}
+
 		for {
 			var msg drpc.Message
-			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			if err := codec.Receive(ws, &msg); err != nil {
 				log.Errorf("failed to read message from shuttle: %s", err)
 				return
 			}
 
+			if hello.HeartbeatTimeout > 0 {
+				if err := ws.SetReadDeadline(time.Now().Add(hello.HeartbeatTimeout)); err != nil {
+					log.Errorf("failed to set the shuttle connection's read deadline: %s", err)
+				}
+			}
+			if msg.Op == drpc.OP_Heartbeat {
+				continue
+			}
+
 			go func(msg *drpc.Message) {
 				msg.Handle = shuttle.Handle
-				s.CM.IncomingRPCMessages <- msg
+				if !s.CM.receiveShuttleMessage(msg, done) {
+					return
+				}
+
+				select {
+				case acks <- msg.ID:
+				case <-done:
+				}
 			}(&msg)
 		}
 	}).ServeHTTP(c.Response(), c.Request())
 	return nil
 }
 
+// maxAckBatch is the most message ids acknowledged with a single command
+const maxAckBatch = 1000
+
+// minHeartbeatInterval bounds how often shuttles can ask for heartbeats
+const minHeartbeatInterval = time.Second
+
+// selectRpcEncoding picks the encoding shuttle messages are sent in from the
+// ones the shuttle offered
+func selectRpcEncoding(offered []string) string {
+	for _, enc := range offered {
+		if enc == drpc.EncodingCBOR {
+			return enc
+		}
+	}
+	return drpc.EncodingJSON
+}
+
+// selectRpcCompression picks the compression for shuttle messages from the
+// ones the shuttle offered, or none
+func selectRpcCompression(offered []string) string {
+	for _, c := range offered {
+		if c == drpc.CompressionGzip {
+			return c
+		}
+	}
+	return ""
+}
+
 // handleAutoretrieveInit godoc
 // @Summary      Register autoretrieve server
 // @Description  This endpoint registers a new autoretrieve server
@@ -4661,6 +5181,10 @@ func (s *Server) handleCreateContent(c echo.Context, u *User) error {
 		return err
 	}
 
+	if err := s.checkContentLocation(c, req.Location); err != nil {
+		return err
+	}
+
 	if c.QueryParam("ignore-dupes") == "true" {
 		isDup, err := s.isDupCIDContent(c, rootCID, u)
 		if err != nil || isDup {
@@ -4683,7 +5207,8 @@ func (s *Server) handleCreateContent(c echo.Context, u *User) error {
 		Cid:         util.DbCID{CID: rootCID},
 		Name:        req.Name,
 		Active:      false,
-		Pinning:     false,
+		Pinning:     req.Pinning,
+		PinMeta:     req.PinMeta,
 		UserID:      u.ID,
 		Replication: s.CM.Replication,
 		Location:    req.Location,
@@ -4699,6 +5224,14 @@ func (s *Server) handleCreateContent(c echo.Context, u *User) error {
 		}
 
 		sp, err := sanitizePath(req.CollectionDir)
+		if req.CollectionPath != "" {
+			sp, err = sanitizePath(req.CollectionPath)
+			if err == nil && strings.HasSuffix(sp, "/") {
+				// the directories of the path show up in the collection
+				// once content is linked under them
+				sp += req.Name
+			}
+		}
 		if err != nil {
 			return err
 		}
@@ -5114,6 +5647,11 @@ func (s *Server) withShuttleAuth() echo.MiddlewareFunc {
 					Reason: util.ERR_NOT_AUTHORIZED,
 				}
 			}
+
+			if err := s.checkShuttleCert(c.Request(), sh.Handle); err != nil {
+				log.Warnw("shuttle client certificate rejected", "handle", sh.Handle, "err", err)
+				return err
+			}
 			return next(c)
 		}
 	}
@@ -5150,45 +5688,6 @@ func (s *Server) handleShuttleRepinAll(c echo.Context) error {
 	return nil
 }
 
-// this is required as ipfs pinning spec has strong requirements on response format
-func openApiMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		err := next(c)
-		if err == nil {
-			return nil
-		}
-
-		var httpRespErr *util.HttpError
-		if xerrors.As(err, &httpRespErr) {
-			log.Errorf("handler error: %s", err)
-			return c.JSON(httpRespErr.Code, &util.HttpErrorResponse{
-				Error: util.HttpError{
-					Reason:  httpRespErr.Reason,
-					Details: httpRespErr.Details,
-				},
-			})
-		}
-
-		var echoErr *echo.HTTPError
-		if xerrors.As(err, &echoErr) {
-			return c.JSON(echoErr.Code, &util.HttpErrorResponse{
-				Error: util.HttpError{
-					Reason:  http.StatusText(echoErr.Code),
-					Details: echoErr.Message.(string),
-				},
-			})
-		}
-
-		log.Errorf("handler error: %s", err)
-		return c.JSON(http.StatusInternalServerError, &util.HttpErrorResponse{
-			Error: util.HttpError{
-				Reason:  http.StatusText(http.StatusInternalServerError),
-				Details: err.Error(),
-			},
-		})
-	}
-}
-
 type CidType string
 
 const (
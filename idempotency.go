@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+)
+
+// idempotencyCleanInterval is how often expired idempotency keys are removed
+const idempotencyCleanInterval = time.Hour
+
+// idempotent makes retries of an add with the same Idempotency-Key return
+// the content the first request added rather than adding it again
+func (s *Server) idempotent(endpoint string) echo.MiddlewareFunc {
+	return util.Idempotent(s.DB, endpoint, func(c echo.Context) uint {
+		if u, ok := c.Get("user").(*User); ok {
+			return u.ID
+		}
+		return 0
+	})
+}
+
+func (s *Server) runIdempotencyKeyCleaner(ctx context.Context) {
+	ticker := time.NewTicker(idempotencyCleanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		n, err := util.ExpireIdempotencyKeys(s.DB, time.Now())
+		if err != nil {
+			log.Errorf("failed to remove expired idempotency keys: %s", err)
+			continue
+		}
+		if n > 0 {
+			log.Debugw("removed expired idempotency keys", "count", n)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -79,6 +80,7 @@ func before(cctx *cli.Context) error {
 	_ = logging.SetLogLevel("bs-wal", level)
 	_ = logging.SetLogLevel("provider.batched", level)
 	_ = logging.SetLogLevel("bs-migrate", level)
+	_ = logging.SetLogLevel("bs-s3", level)
 	return nil
 }
 
@@ -102,6 +104,10 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.Node.NoBlockstoreCache = cctx.Bool("no-blockstore-cache")
 		case "write-log-truncate":
 			cfg.Node.WriteLogTruncate = cctx.Bool("write-log-truncate")
+		case "write-log-max-size":
+			cfg.Node.WriteLogMaxSize = cctx.Int64("write-log-max-size")
+		case "write-log-max-age":
+			cfg.Node.WriteLogMaxAge = cctx.Duration("write-log-max-age")
 		case "write-log-flush":
 			cfg.Node.HardFlushWriteLog = cctx.Bool("write-log-flush")
 		case "write-log":
@@ -116,12 +122,22 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.DatabaseConnString = cctx.String("database")
 		case "apilisten":
 			cfg.ApiListen = cctx.String("apilisten")
+		case "tls-cert":
+			cfg.TLS.CertFile = cctx.String("tls-cert")
+		case "tls-key":
+			cfg.TLS.KeyFile = cctx.String("tls-key")
+		case "shuttle-ca":
+			cfg.TLS.ShuttleCAFile = cctx.String("shuttle-ca")
 		case "announce":
 			_, err := multiaddr.NewMultiaddr(cctx.String("announce"))
 			if err != nil {
 				return fmt.Errorf("failed to parse announce address %s: %w", cctx.String("announce"), err)
 			}
 			cfg.Node.AnnounceAddrs = []string{cctx.String("announce")}
+		case "no-announce":
+			cfg.Node.NoAnnounceAddrs = cctx.StringSlice("no-announce")
+		case "swarm-key":
+			cfg.Node.SwarmKeyFile = cctx.String("swarm-key")
 		case "peering-peers":
 			//	The peer is an array of multiaddress so we need to allow
 			//	the user to specify ID and Addrs
@@ -154,6 +170,8 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.Content.DisableLocalAdding = cctx.Bool("disable-local-content-adding")
 		case "disable-content-adding":
 			cfg.Content.DisableGlobalAdding = cctx.Bool("disable-content-adding")
+		case "require-shuttle-signatures":
+			cfg.Content.RequireShuttleSignatures = cctx.Bool("require-shuttle-signatures")
 		case "jaeger-tracing":
 			cfg.Jaeger.EnableTracing = cctx.Bool("jaeger-tracing")
 		case "jaeger-provider-url":
@@ -168,6 +186,26 @@ func overrideSetOptions(flags []cli.Flag, cctx *cli.Context, cfg *config.Estuary
 			cfg.Node.Bitswap.MaxOutstandingBytesPerPeer = cctx.Int64("bitswap-max-work-per-peer")
 		case "bitswap-target-message-size":
 			cfg.Node.Bitswap.TargetMessageSize = cctx.Int("bitswap-target-message-size")
+		case "bitswap-engine-task-workers":
+			cfg.Node.Bitswap.EngineTaskWorkers = cctx.Int("bitswap-engine-task-workers")
+		case "bitswap-engine-blockstore-workers":
+			cfg.Node.Bitswap.EngineBlockstoreWorkers = cctx.Int("bitswap-engine-blockstore-workers")
+		case "bitswap-task-workers":
+			cfg.Node.Bitswap.TaskWorkers = cctx.Int("bitswap-task-workers")
+		case "bitswap-no-provide":
+			cfg.Node.Bitswap.NoProvide = cctx.Bool("bitswap-no-provide")
+		case "provide-strategy":
+			cfg.Node.Provider.Strategy = cctx.String("provide-strategy")
+		case "no-limiter":
+			cfg.Node.NoLimiter = cctx.Bool("no-limiter")
+		case "limit-memory":
+			cfg.Node.Limits.SystemLimit.MaxMemory = cctx.Int64("limit-memory")
+		case "limit-conns-inbound":
+			cfg.Node.Limits.SystemLimit.ConnsInbound = cctx.Int("limit-conns-inbound")
+		case "limit-streams-inbound":
+			cfg.Node.Limits.SystemLimit.StreamsInbound = cctx.Int("limit-streams-inbound")
+		case "limit-peer-streams-inbound":
+			cfg.Node.Limits.PeerLimit.StreamsInbound = cctx.Int("limit-peer-streams-inbound")
 		case "shuttle-message-handlers":
 			cfg.ShuttleMessageHandlers = cctx.Int("shuttle-message-handlers")
 		case "indexer-url":
@@ -243,11 +281,36 @@ func main() {
 			Value:   cfg.ApiListen,
 			EnvVars: []string{"ESTUARY_API_LISTEN"},
 		},
+		&cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "certificate file to serve the api over tls with, reloaded when it changes",
+			Value: cfg.TLS.CertFile,
+		},
+		&cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "key file of the tls certificate",
+			Value: cfg.TLS.KeyFile,
+		},
+		&cli.StringFlag{
+			Name:  "shuttle-ca",
+			Usage: "CA file that shuttle client certificates have to be signed by, requires tls-cert",
+			Value: cfg.TLS.ShuttleCAFile,
+		},
 		&cli.StringFlag{
 			Name:    "announce",
 			Usage:   "announce address for the libp2p server to listen on",
 			EnvVars: []string{"ESTUARY_ANNOUNCE"},
 		},
+		&cli.StringSliceFlag{
+			Name:  "no-announce",
+			Usage: "multiaddrs or ranges like /ip4/10.0.0.0/ipcidr/8 the libp2p server should not advertise",
+			Value: cli.NewStringSlice(cfg.Node.NoAnnounceAddrs...),
+		},
+		&cli.StringFlag{
+			Name:  "swarm-key",
+			Usage: "join the private libp2p network of this swarm.key file, every node of the deployment needs the same key",
+			Value: cfg.Node.SwarmKeyFile,
+		},
 		&cli.StringFlag{
 			Name:  "peering-peers",
 			Usage: "peering addresses for the libp2p server to listen on",
@@ -311,6 +374,11 @@ func main() {
 			Usage: "disallow new content ingestion globally",
 			Value: cfg.Content.DisableGlobalAdding,
 		},
+		&cli.BoolFlag{
+			Name:  "require-shuttle-signatures",
+			Usage: "only let shuttles create content on themselves with requests they signed",
+			Value: cfg.Content.RequireShuttleSignatures,
+		},
 		&cli.BoolFlag{
 			Name:  "disable-local-content-adding",
 			Usage: "disallow new content ingestion on this node (shuttles are unaffected)",
@@ -326,6 +394,16 @@ func main() {
 			Usage: "enables log truncating",
 			Value: cfg.Node.WriteLogTruncate,
 		},
+		&cli.Int64Flag{
+			Name:  "write-log-max-size",
+			Usage: "flush the write log out in full once it takes up this many bytes, 0 to disable",
+			Value: cfg.Node.WriteLogMaxSize,
+		},
+		&cli.DurationFlag{
+			Name:  "write-log-max-age",
+			Usage: "flush the write log out in full at least this often, 0 to disable",
+			Value: cfg.Node.WriteLogMaxAge,
+		},
 		&cli.BoolFlag{
 			Name:  "write-log-flush",
 			Usage: "enable hard flushing blockstore",
@@ -371,6 +449,56 @@ func main() {
 			Usage: "sets the bitswap target message size",
 			Value: cfg.Node.Bitswap.TargetMessageSize,
 		},
+		&cli.IntFlag{
+			Name:  "bitswap-engine-task-workers",
+			Usage: "sets the number of bitswap engine workers processing peer requests",
+			Value: cfg.Node.Bitswap.EngineTaskWorkers,
+		},
+		&cli.IntFlag{
+			Name:  "bitswap-engine-blockstore-workers",
+			Usage: "sets the number of bitswap workers reading blocks from the blockstore",
+			Value: cfg.Node.Bitswap.EngineBlockstoreWorkers,
+		},
+		&cli.IntFlag{
+			Name:  "bitswap-task-workers",
+			Usage: "sets the number of bitswap workers sending messages to peers",
+			Value: cfg.Node.Bitswap.TaskWorkers,
+		},
+		&cli.BoolFlag{
+			Name:  "bitswap-no-provide",
+			Usage: "stop bitswap from announcing the blocks it receives",
+			Value: cfg.Node.Bitswap.NoProvide,
+		},
+		&cli.StringFlag{
+			Name:  "provide-strategy",
+			Usage: "what to announce to the dht: disabled, roots, pinned (every block of stored content) or all (every block in the blockstore)",
+			Value: cfg.Node.Provider.Strategy,
+		},
+		&cli.BoolFlag{
+			Name:  "no-limiter",
+			Usage: "run the libp2p host without resource limits",
+			Value: cfg.Node.NoLimiter,
+		},
+		&cli.Int64Flag{
+			Name:  "limit-memory",
+			Usage: "sets the most memory libp2p may reserve, in bytes",
+			Value: cfg.Node.Limits.SystemLimit.MaxMemory,
+		},
+		&cli.IntFlag{
+			Name:  "limit-conns-inbound",
+			Usage: "sets the most inbound libp2p connections",
+			Value: cfg.Node.Limits.SystemLimit.ConnsInbound,
+		},
+		&cli.IntFlag{
+			Name:  "limit-streams-inbound",
+			Usage: "sets the most inbound libp2p streams",
+			Value: cfg.Node.Limits.SystemLimit.StreamsInbound,
+		},
+		&cli.IntFlag{
+			Name:  "limit-peer-streams-inbound",
+			Usage: "sets the most inbound libp2p streams a single peer may open",
+			Value: cfg.Node.Limits.PeerLimit.StreamsInbound,
+		},
 		&cli.IntFlag{
 			Name:  "shuttle-message-handlers",
 			Usage: "sets shuttle message handler count",
@@ -496,6 +624,22 @@ func main() {
 				}
 				return cfg.Save(configFile)
 			},
+		}, {
+			Name:      "migrate-blockstore",
+			Usage:     "Copies all blocks from one blockstore to another, run with estuary stopped",
+			ArgsUsage: "<from> <to>",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "delete",
+					Usage: "delete blocks from the source blockstore once copied",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				if cctx.Args().Len() != 2 {
+					return fmt.Errorf("must specify source and destination blockstores")
+				}
+				return node.MigrateBlockstore(cctx.Context, cctx.Args().Get(0), cctx.Args().Get(1), cctx.Bool("delete"))
+			},
 		},
 	}
 	app.Action = func(cctx *cli.Context) error {
@@ -572,6 +716,12 @@ func main() {
 			estuaryCfg:  cfg,
 		}
 
+		authKey, err := loadOrInitAuthKey(cfg.AuthKeyFile)
+		if err != nil {
+			return err
+		}
+		s.authKey = authKey
+
 		// TODO: this is an ugly self referential hack... should fix
 		pinmgr := pinner.NewPinManager(s.doPinning, s.PinStatusFunc, &pinner.PinManagerOpts{
 			MaxActivePerUser: 20,
@@ -632,6 +782,9 @@ func main() {
 
 		go cm.ContentWatcher()
 		go cm.handleShuttleMessages(cctx.Context, cfg.ShuttleMessageHandlers) // register workers/handlers to process shuttle rpc messages from a channel(queue)
+		go cm.sweepPartialPins(cctx.Context)
+		go cm.runDrainer(cctx.Context)
+		go s.runIdempotencyKeyCleaner(cctx.Context)
 
 		// refresh pin queue for local contents
 		if !cm.globalContentAddingDisabled {
@@ -703,6 +856,8 @@ func migrateSchemas(db *gorm.DB) error {
 		&util.ObjRef{},
 		&Collection{},
 		&CollectionRef{},
+		&PinBatch{},
+		&PinBatchRef{},
 		&contentDeal{},
 		&dfeRecord{},
 		&PieceCommRecord{},
@@ -713,6 +868,8 @@ func migrateSchemas(db *gorm.DB) error {
 		&storageMiner{},
 		&User{},
 		&AuthToken{},
+		&util.IdempotencyKey{},
+		&Webhook{},
 		&InviteCode{},
 		&Shuttle{},
 		&autoretrieve.Autoretrieve{}); err != nil {
@@ -734,6 +891,9 @@ type Server struct {
 	gwayHandler *gateway.GatewayHandler
 
 	cacher *memo.Cacher
+
+	// authKey signs JWT api keys
+	authKey ed25519.PrivateKey
 }
 
 func (s *Server) GarbageCollect(ctx context.Context) error {
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/application-research/estuary/util"
+)
+
+// serverTLSConfig serves the api with the configured certificate, asking
+// for client certificates when shuttles have to present one
+func (s *Server) serverTLSConfig() (*tls.Config, error) {
+	tlscfg := s.estuaryCfg.TLS
+
+	cr, err := util.NewCertReloader(tlscfg.CertFile, tlscfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if tlscfg.ShuttleCAFile != "" {
+		pool, err := util.LoadCertPool(tlscfg.ShuttleCAFile)
+		if err != nil {
+			return nil, err
+		}
+		// users connect without certificates, only the shuttle routes
+		// require one, see checkShuttleCert
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, nil
+}
+
+// checkShuttleCert makes sure that a shuttle connected with a certificate
+// issued for its handle, if shuttles have to present one
+func (s *Server) checkShuttleCert(r *http.Request, handle string) error {
+	if s.estuaryCfg.TLS.ShuttleCAFile == "" {
+		return nil
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return &util.HttpError{
+			Code:    http.StatusUnauthorized,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: "shuttles have to present a client certificate",
+		}
+	}
+
+	leaf := r.TLS.VerifiedChains[0][0]
+	if leaf.Subject.CommonName != handle && leaf.VerifyHostname(handle) != nil {
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: fmt.Sprintf("client certificate is not for shuttle %s", handle),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckShuttleCert(t *testing.T) {
+	s := &Server{estuaryCfg: &config.Estuary{}}
+	req := httptest.NewRequest("GET", "/shuttle/conn", nil)
+	assert.NoError(t, s.checkShuttleCert(req, "SHUTTLE1HANDLE"), "a certificate was required without a shuttle CA")
+
+	s.estuaryCfg.TLS.ShuttleCAFile = "ca.pem"
+	assert.Error(t, s.checkShuttleCert(req, "SHUTTLE1HANDLE"), "a shuttle connected without a certificate")
+
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "SHUTTLE1HANDLE"}}}},
+	}
+	assert.NoError(t, s.checkShuttleCert(req, "SHUTTLE1HANDLE"))
+	assert.Error(t, s.checkShuttleCert(req, "SHUTTLE2HANDLE"), "a shuttle used the certificate of another")
+
+	req.TLS.VerifiedChains[0][0] = &x509.Certificate{DNSNames: []string{"shuttle2handle"}}
+	assert.NoError(t, s.checkShuttleCert(req, "SHUTTLE2HANDLE"))
+}
@@ -0,0 +1,28 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrsFactory(t *testing.T) {
+	listening := []multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip4/10.0.0.5/tcp/6745"),
+		multiaddr.StringCast("/ip4/127.0.0.1/tcp/6745"),
+		multiaddr.StringCast("/ip4/203.0.113.7/tcp/6745"),
+	}
+
+	af, err := makeAddrsFactory(nil, []string{"/ip4/10.0.0.0/ipcidr/8", "/ip4/127.0.0.1/tcp/6745"})
+	require.NoError(t, err)
+	assert.Equal(t, listening[2:], af(listening))
+
+	af, err = makeAddrsFactory([]string{"/ip4/198.51.100.1/tcp/443", "/ip4/10.1.1.1/tcp/6745"}, []string{"/ip4/10.0.0.0/ipcidr/8"})
+	require.NoError(t, err)
+	assert.Equal(t, []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/198.51.100.1/tcp/443")}, af(listening))
+
+	_, err = makeAddrsFactory(nil, []string{"not an addr"})
+	assert.Error(t, err)
+}
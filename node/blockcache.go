@@ -0,0 +1,107 @@
+package node
+
+import (
+	"context"
+	"fmt"
+
+	lru "github.com/hashicorp/golang-lru"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	metri "github.com/ipfs/go-metrics-interface"
+)
+
+// BlockCache keeps the data of recently read blocks in an ARC cache in front
+// of a blockstore, so hot content served over bitswap and the gateway does
+// not go to disk every time. Only reads fill the cache, blocks that are
+// written or deleted are dropped from it.
+type BlockCache struct {
+	blockstore.Blockstore
+
+	cache        *lru.ARCCache
+	maxBlockSize int
+
+	hits  metri.Counter
+	total metri.Counter
+}
+
+var _ blockstore.Blockstore = (*BlockCache)(nil)
+
+// NewBlockCache caches up to size blocks of at most maxBlockSize bytes each
+func NewBlockCache(ctx context.Context, bs blockstore.Blockstore, size, maxBlockSize int) (*BlockCache, error) {
+	if size <= 0 || maxBlockSize <= 0 {
+		return nil, fmt.Errorf("block cache size and max block size must be positive")
+	}
+
+	cache, err := lru.NewARC(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockCache{
+		Blockstore:   bs,
+		cache:        cache,
+		maxBlockSize: maxBlockSize,
+
+		hits:  metri.NewCtx(ctx, "block_cache_hits", "total number of block reads served from memory").Counter(),
+		total: metri.NewCtx(ctx, "block_cache_total", "total number of block reads through the block cache").Counter(),
+	}, nil
+}
+
+func (bc *BlockCache) cached(c cid.Cid) (blocks.Block, bool) {
+	bc.total.Inc()
+	v, ok := bc.cache.Get(c.KeyString())
+	if !ok {
+		return nil, false
+	}
+	bc.hits.Inc()
+	return v.(blocks.Block), true
+}
+
+func (bc *BlockCache) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if blk, ok := bc.cached(c); ok {
+		return blk, nil
+	}
+
+	blk, err := bc.Blockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if len(blk.RawData()) <= bc.maxBlockSize {
+		bc.cache.Add(c.KeyString(), blk)
+	}
+	return blk, nil
+}
+
+func (bc *BlockCache) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if v, ok := bc.cache.Peek(c.KeyString()); ok {
+		return len(v.(blocks.Block).RawData()), nil
+	}
+	return bc.Blockstore.GetSize(ctx, c)
+}
+
+func (bc *BlockCache) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if bc.cache.Contains(c.KeyString()) {
+		return true, nil
+	}
+	return bc.Blockstore.Has(ctx, c)
+}
+
+// Put drops the cached copy of the block, a block written again usually
+// replaces a bad copy
+func (bc *BlockCache) Put(ctx context.Context, blk blocks.Block) error {
+	bc.cache.Remove(blk.Cid().KeyString())
+	return bc.Blockstore.Put(ctx, blk)
+}
+
+func (bc *BlockCache) PutMany(ctx context.Context, blks []blocks.Block) error {
+	for _, blk := range blks {
+		bc.cache.Remove(blk.Cid().KeyString())
+	}
+	return bc.Blockstore.PutMany(ctx, blks)
+}
+
+func (bc *BlockCache) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	bc.cache.Remove(c.KeyString())
+	return bc.Blockstore.DeleteBlock(ctx, c)
+}
@@ -0,0 +1,51 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCache(t *testing.T) {
+	ctx := context.Background()
+
+	under := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	bc, err := NewBlockCache(ctx, under, 16, 1024)
+	require.NoError(t, err)
+
+	small := blocks.NewBlock([]byte("small"))
+	large := blocks.NewBlock(bytes.Repeat([]byte("l"), 2048))
+	require.NoError(t, bc.PutMany(ctx, []blocks.Block{small, large}))
+	assert.False(t, bc.cache.Contains(small.Cid().KeyString()), "writes do not fill the cache")
+
+	got, err := bc.Get(ctx, small.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, small.RawData(), got.RawData())
+	assert.True(t, bc.cache.Contains(small.Cid().KeyString()))
+
+	_, err = bc.Get(ctx, large.Cid())
+	require.NoError(t, err)
+	assert.False(t, bc.cache.Contains(large.Cid().KeyString()), "blocks over the size limit are not cached")
+
+	// a block written again replaces the cached copy
+	replaced, err := blocks.NewBlockWithCid([]byte("replaced"), small.Cid())
+	require.NoError(t, err)
+	require.NoError(t, bc.Put(ctx, replaced))
+	got, err = bc.Get(ctx, small.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, replaced.RawData(), got.RawData())
+
+	require.NoError(t, bc.DeleteBlock(ctx, small.Cid()))
+	has, err := bc.Has(ctx, small.Cid())
+	require.NoError(t, err)
+	assert.False(t, has)
+	_, err = bc.Get(ctx, small.Cid())
+	assert.ErrorIs(t, err, blockstore.ErrNotFound)
+}
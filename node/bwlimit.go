@@ -0,0 +1,162 @@
+package node
+
+import (
+	"context"
+
+	"github.com/application-research/estuary/config"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"golang.org/x/time/rate"
+)
+
+// peerLimiters bounds how many peers have their own limiter at once, peers
+// that fall out start over with a full burst
+const peerLimiters = 10000
+
+// bandwidthLimiter charges the bytes written to the streams of a limited
+// host against a total and a per peer rate
+type bandwidthLimiter struct {
+	total *rate.Limiter
+
+	perPeer rate.Limit
+	peers   *lru.Cache
+}
+
+func newBandwidthLimiter(cfg config.Bandwidth) (*bandwidthLimiter, error) {
+	bl := &bandwidthLimiter{}
+	if cfg.MaxOut > 0 {
+		bl.total = rate.NewLimiter(rate.Limit(cfg.MaxOut), burstFor(cfg.MaxOut))
+	}
+	if cfg.MaxOutPerPeer > 0 {
+		peers, err := lru.New(peerLimiters)
+		if err != nil {
+			return nil, err
+		}
+		bl.perPeer = rate.Limit(cfg.MaxOutPerPeer)
+		bl.peers = peers
+	}
+	return bl, nil
+}
+
+// burstFor lets a second worth of bytes through at once, at least enough
+// for a bitswap message of the default size
+func burstFor(bps int64) int {
+	if bps < 1<<20 {
+		return 1 << 20
+	}
+	return int(bps)
+}
+
+func (bl *bandwidthLimiter) peer(p peer.ID) *rate.Limiter {
+	if v, ok := bl.peers.Get(p); ok {
+		return v.(*rate.Limiter)
+	}
+	lim := rate.NewLimiter(bl.perPeer, burstFor(int64(bl.perPeer)))
+	// another writer may have added one in the meantime, use theirs
+	if prev, ok, _ := bl.peers.PeekOrAdd(p, lim); ok {
+		return prev.(*rate.Limiter)
+	}
+	return lim
+}
+
+// chunk is the most that can be waited for in one go
+func (bl *bandwidthLimiter) chunk() int {
+	n := 1 << 30
+	if bl.total != nil && bl.total.Burst() < n {
+		n = bl.total.Burst()
+	}
+	if bl.peers != nil && burstFor(int64(bl.perPeer)) < n {
+		n = burstFor(int64(bl.perPeer))
+	}
+	return n
+}
+
+func (bl *bandwidthLimiter) wait(ctx context.Context, p peer.ID, n int) error {
+	if bl.peers != nil {
+		if err := bl.peer(p).WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	if bl.total != nil {
+		return bl.total.WaitN(ctx, n)
+	}
+	return nil
+}
+
+// LimitHost wraps h so the streams opened and handled through it are held to
+// the bandwidth caps in cfg. Bitswap and the deal transfers are set up on the
+// returned host, the protocols of libp2p itself are not limited. h is
+// returned as is when there are no caps.
+func LimitHost(h host.Host, cfg config.Bandwidth) (host.Host, error) {
+	if cfg.MaxOut <= 0 && cfg.MaxOutPerPeer <= 0 {
+		return h, nil
+	}
+
+	bl, err := newBandwidthLimiter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedHost{Host: h, bl: bl}, nil
+}
+
+type limitedHost struct {
+	host.Host
+
+	bl *bandwidthLimiter
+}
+
+func (lh *limitedHost) wrap(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		handler(&limitedStream{Stream: s, bl: lh.bl})
+	}
+}
+
+func (lh *limitedHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	lh.Host.SetStreamHandler(pid, lh.wrap(handler))
+}
+
+func (lh *limitedHost) SetStreamHandlerMatch(pid protocol.ID, m func(string) bool, handler network.StreamHandler) {
+	lh.Host.SetStreamHandlerMatch(pid, m, lh.wrap(handler))
+}
+
+func (lh *limitedHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := lh.Host.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedStream{Stream: s, bl: lh.bl}, nil
+}
+
+// limitedStream waits for the limiter before each write
+type limitedStream struct {
+	network.Stream
+
+	bl *bandwidthLimiter
+}
+
+func (ls *limitedStream) Write(b []byte) (int, error) {
+	p := ls.Conn().RemotePeer()
+	chunk := ls.bl.chunk()
+
+	var written int
+	for len(b) > 0 {
+		n := len(b)
+		if n > chunk {
+			n = chunk
+		}
+		if err := ls.bl.wait(context.Background(), p, n); err != nil {
+			return written, err
+		}
+
+		w, err := ls.Stream.Write(b[:n])
+		written += w
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,32 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	bl, err := newBandwidthLimiter(config.Bandwidth{MaxOut: 4 << 20, MaxOutPerPeer: 1 << 20})
+	require.NoError(t, err)
+	assert.Equal(t, 1<<20, bl.chunk())
+
+	a, b := peer.ID("a"), peer.ID("b")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	require.NoError(t, bl.wait(ctx, a, 1<<20))
+	assert.Error(t, bl.wait(ctx, a, 512<<10), "peer went past its cap")
+	assert.NoError(t, bl.wait(ctx, b, 1<<20), "peer was held to the cap of another")
+}
+
+func TestLimitHostWithoutCaps(t *testing.T) {
+	h, err := LimitHost(nil, config.Bandwidth{})
+	require.NoError(t, err)
+	assert.Nil(t, h)
+}
@@ -0,0 +1,138 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	metri "github.com/ipfs/go-metrics-interface"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMagic starts every zstd frame
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// CompressedBlockstore compresses blocks with zstd before writing them to the
+// underlying blockstore. Blocks that dont get smaller are stored as they are,
+// so a store can hold both and compression can be turned on for an existing
+// store. Since an uncompressed block may itself be a zstd frame, a block is
+// only taken to be compressed if the decompressed data matches its cid.
+type CompressedBlockstore struct {
+	EstuaryBlockstore
+
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+
+	bytesIn     int64
+	bytesStored int64
+
+	metBytesIn     metri.Counter
+	metBytesStored metri.Counter
+	metRatio       metri.Gauge
+}
+
+var _ blockstore.Blockstore = (*CompressedBlockstore)(nil)
+
+func NewCompressedBlockstore(ctx context.Context, bstore EstuaryBlockstore) (*CompressedBlockstore, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CompressedBlockstore{
+		EstuaryBlockstore: bstore,
+		enc:               enc,
+		dec:               dec,
+
+		metBytesIn:     metri.NewCtx(ctx, "compress_bytes_in", "total size of blocks written before compression").Counter(),
+		metBytesStored: metri.NewCtx(ctx, "compress_bytes_stored", "total size of blocks written after compression").Counter(),
+		metRatio:       metri.NewCtx(ctx, "compress_ratio", "size of written blocks before compression over their stored size").Gauge(),
+	}, nil
+}
+
+func (cb *CompressedBlockstore) compress(blk blocks.Block) (blocks.Block, error) {
+	data := blk.RawData()
+	out := cb.enc.EncodeAll(data, make([]byte, 0, len(data)))
+
+	stored := blk
+	if len(out) < len(data) {
+		b, err := blocks.NewBlockWithCid(out, blk.Cid())
+		if err != nil {
+			return nil, err
+		}
+		stored = b
+	}
+
+	in := atomic.AddInt64(&cb.bytesIn, int64(len(data)))
+	st := atomic.AddInt64(&cb.bytesStored, int64(len(stored.RawData())))
+	cb.metBytesIn.Add(float64(len(data)))
+	cb.metBytesStored.Add(float64(len(stored.RawData())))
+	if st > 0 {
+		cb.metRatio.Set(float64(in) / float64(st))
+	}
+	return stored, nil
+}
+
+func (cb *CompressedBlockstore) decompress(c cid.Cid, data []byte) []byte {
+	if !bytes.HasPrefix(data, zstdMagic) {
+		return data
+	}
+
+	out, err := cb.dec.DecodeAll(data, nil)
+	if err != nil {
+		// not a compressed block, just looks like one
+		return data
+	}
+
+	sum, err := c.Prefix().Sum(out)
+	if err != nil || !sum.Equals(c) {
+		return data
+	}
+	return out
+}
+
+func (cb *CompressedBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	stored, err := cb.compress(blk)
+	if err != nil {
+		return err
+	}
+	return cb.EstuaryBlockstore.Put(ctx, stored)
+}
+
+func (cb *CompressedBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	stored := make([]blocks.Block, 0, len(blks))
+	for _, blk := range blks {
+		s, err := cb.compress(blk)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, s)
+	}
+	return cb.EstuaryBlockstore.PutMany(ctx, stored)
+}
+
+func (cb *CompressedBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := cb.EstuaryBlockstore.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(cb.decompress(c, blk.RawData()), c)
+}
+
+// GetSize has to read the block, the stored size is that of the compressed
+// data
+func (cb *CompressedBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	blk, err := cb.Get(ctx, c)
+	if err != nil {
+		return -1, err
+	}
+	return len(blk.RawData()), nil
+}
@@ -0,0 +1,45 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedBlockstore(t *testing.T) {
+	ctx := context.Background()
+
+	under := &deleteManyWrap{blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))}
+	cbs, err := NewCompressedBlockstore(ctx, under)
+	require.NoError(t, err)
+
+	compressible := blocks.NewBlock(bytes.Repeat([]byte("estuary"), 1000))
+	require.NoError(t, cbs.Put(ctx, compressible))
+
+	stored, err := under.Get(ctx, compressible.Cid())
+	require.NoError(t, err)
+	assert.Less(t, len(stored.RawData()), len(compressible.RawData()))
+
+	got, err := cbs.Get(ctx, compressible.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, compressible.RawData(), got.RawData())
+
+	size, err := cbs.GetSize(ctx, compressible.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, len(compressible.RawData()), size)
+
+	// a block that is a zstd frame itself comes back as it was stored
+	frame := blocks.NewBlock(cbs.enc.EncodeAll(bytes.Repeat([]byte("x"), 4096), nil))
+	require.NoError(t, cbs.Put(ctx, frame))
+
+	got, err = cbs.Get(ctx, frame.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, frame.RawData(), got.RawData())
+}
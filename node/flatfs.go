@@ -0,0 +1,79 @@
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	flatfs "github.com/ipfs/go-ds-flatfs"
+)
+
+const defaultFlatfsShardFunc = "next-to-last/3"
+
+// go-ipfs switched its blockstore to multihash keys in repo version 12,
+// older repos key blocks by cid and cant be read by our blockstore
+const minIpfsRepoVersion = 12
+
+// openFlatfs opens the flatfs directory at path, creating it if needed. An
+// existing directory is adopted in place with the sharding it was created
+// with, and path may also point at the root of a go-ipfs repo, in which case
+// its blocks directory is used. The single optional param sets the shard
+// function, eg: next-to-last/2.
+func openFlatfs(path string, params []string) (*flatfs.Datastore, string, error) {
+	if len(params) > 1 {
+		return nil, "", fmt.Errorf("flatfs takes at most one param, the shard function (%d given)", len(params))
+	}
+
+	if isIpfsRepo(path) {
+		if err := checkIpfsRepoVersion(path); err != nil {
+			return nil, "", err
+		}
+		path = filepath.Join(path, "blocks")
+	}
+
+	var sf *flatfs.ShardIdV1
+	var err error
+	switch {
+	case len(params) == 1:
+		sf, err = flatfs.ParseShardFunc("/repo/flatfs/shard/v1/" + params[0])
+	default:
+		sf, err = flatfs.ReadShardFunc(path)
+		if err == flatfs.ErrShardingFileMissing {
+			sf, err = flatfs.ParseShardFunc("/repo/flatfs/shard/v1/" + defaultFlatfsShardFunc)
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	ds, err := flatfs.CreateOrOpen(path, sf, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return ds, path, nil
+}
+
+func isIpfsRepo(path string) bool {
+	_, err := os.Stat(filepath.Join(path, "blocks", flatfs.SHARDING_FN))
+	return err == nil
+}
+
+func checkIpfsRepoVersion(path string) error {
+	data, err := ioutil.ReadFile(filepath.Join(path, "version"))
+	if err != nil {
+		return fmt.Errorf("failed to read ipfs repo version: %w", err)
+	}
+
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid ipfs repo version %q: %w", data, err)
+	}
+
+	if v < minIpfsRepoVersion {
+		return fmt.Errorf("ipfs repo version %d keys blocks by cid, migrate it to version %d or later first", v, minIpfsRepoVersion)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package node
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdoptIpfsFlatfs(t *testing.T) {
+	ctx := context.Background()
+	repo := t.TempDir()
+
+	// lay out the blocks the way go-ipfs does
+	sf, err := flatfs.ParseShardFunc("/repo/flatfs/shard/v1/next-to-last/2")
+	require.NoError(t, err)
+	ds, err := flatfs.CreateOrOpen(filepath.Join(repo, "blocks"), sf, false)
+	require.NoError(t, err)
+
+	blk := blocks.NewBlock([]byte("from go-ipfs"))
+	require.NoError(t, blockstore.NewBlockstoreNoPrefix(ds).Put(ctx, blk))
+	require.NoError(t, ds.Close())
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(repo, "version"), []byte("11\n"), 0644))
+	_, _, err = constructBlockstore(":flatfs:" + repo)
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(repo, "version"), []byte("12\n"), 0644))
+	bs, dir, err := constructBlockstore(":flatfs:" + repo)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(repo, "blocks"), dir)
+
+	got, err := bs.Get(ctx, blk.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, blk.RawData(), got.RawData())
+
+	// asking for a different sharding than the directory has fails
+	_, _, err = constructBlockstore(":flatfs(next-to-last/3):" + filepath.Join(repo, "blocks"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,50 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateBlockstoreToBadger(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	from := ":flatfs:" + filepath.Join(dir, "flatfs")
+	to := ":badger:" + filepath.Join(dir, "badger")
+
+	src, _, err := constructBlockstore(from)
+	require.NoError(t, err)
+
+	var blks []blocks.Block
+	for i := 0; i < 10; i++ {
+		blk := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+		require.NoError(t, src.Put(ctx, blk))
+		blks = append(blks, blk)
+	}
+	closeBlockstore(src)
+
+	require.NoError(t, MigrateBlockstore(ctx, from, to, true))
+
+	src, _, err = constructBlockstore(from)
+	require.NoError(t, err)
+	defer closeBlockstore(src)
+
+	dest, _, err := constructBlockstore(to)
+	require.NoError(t, err)
+	defer closeBlockstore(dest)
+
+	for _, blk := range blks {
+		has, err := src.Has(ctx, blk.Cid())
+		require.NoError(t, err)
+		assert.False(t, has)
+
+		got, err := dest.Get(ctx, blk.Cid())
+		require.NoError(t, err)
+		assert.Equal(t, blk.RawData(), got.RawData())
+	}
+}
@@ -1,6 +1,8 @@
 package peering
 
 import (
+	"sync"
+
 	"github.com/ipfs/go-ipfs/peering"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -16,11 +18,21 @@ type PeeringPeer struct {
 // A wrapper for the `PeeringService` struct.
 type EstuaryPeeringService struct {
 	*peering.PeeringService
+
+	// peers added with AddPeer are kept until removed with RemovePeer,
+	// transient ones only as long as whoever added them needs them
+	lk        sync.Mutex
+	static    map[peer.ID]struct{}
+	transient map[peer.ID]struct{}
 }
 
 //	NewEstuaryPeeringService Construct a new Estuary Peering Service
 func NewEstuaryPeeringService(host host.Host) *EstuaryPeeringService {
-	return &EstuaryPeeringService{peering.NewPeeringService(host)}
+	return &EstuaryPeeringService{
+		PeeringService: peering.NewPeeringService(host),
+		static:         make(map[peer.ID]struct{}),
+		transient:      make(map[peer.ID]struct{}),
+	}
 }
 
 // Start this function starts the EstuaryPeeringService
@@ -40,11 +52,71 @@ func (ps *EstuaryPeeringService) ListPeers() []peer.AddrInfo {
 
 // AddPeer this function adds a peer on the current EstuaryPeeringService
 func (ps *EstuaryPeeringService) AddPeer(info peer.AddrInfo) {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	ps.static[info.ID] = struct{}{}
+	delete(ps.transient, info.ID)
 	ps.PeeringService.AddPeer(info)
 }
 
 // RemovePeer this function removes a peer on the current EstuaryPeeringService
 func (ps *EstuaryPeeringService) RemovePeer(peerId peer.ID) {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	delete(ps.static, peerId)
+	delete(ps.transient, peerId)
+	ps.PeeringService.RemovePeer(peerId)
+}
+
+// AddTransientPeer keeps a connection to a peer that is only needed for a
+// while, like a connected shuttle. Peers added with AddPeer are left as they
+// are.
+func (ps *EstuaryPeeringService) AddTransientPeer(info peer.AddrInfo) {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	ps.addTransient(info)
+}
+
+// RemoveTransientPeer stops peering with a peer added with AddTransientPeer,
+// unless it was also added with AddPeer
+func (ps *EstuaryPeeringService) RemoveTransientPeer(peerId peer.ID) {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+	ps.removeTransient(peerId)
+}
+
+// SetTransientPeers replaces all transient peers with the given ones
+func (ps *EstuaryPeeringService) SetTransientPeers(infos []peer.AddrInfo) {
+	ps.lk.Lock()
+	defer ps.lk.Unlock()
+
+	keep := make(map[peer.ID]struct{}, len(infos))
+	for _, info := range infos {
+		keep[info.ID] = struct{}{}
+	}
+	for id := range ps.transient {
+		if _, ok := keep[id]; !ok {
+			ps.removeTransient(id)
+		}
+	}
+	for _, info := range infos {
+		ps.addTransient(info)
+	}
+}
+
+func (ps *EstuaryPeeringService) addTransient(info peer.AddrInfo) {
+	if _, ok := ps.static[info.ID]; ok {
+		return
+	}
+	ps.transient[info.ID] = struct{}{}
+	ps.PeeringService.AddPeer(info)
+}
+
+func (ps *EstuaryPeeringService) removeTransient(peerId peer.ID) {
+	if _, ok := ps.transient[peerId]; !ok {
+		return
+	}
+	delete(ps.transient, peerId)
 	ps.PeeringService.RemovePeer(peerId)
 }
 
@@ -0,0 +1,45 @@
+package peering
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func peerIDs(ps *EstuaryPeeringService) map[peer.ID]bool {
+	out := make(map[peer.ID]bool)
+	for _, pi := range ps.ListPeers() {
+		out[pi.ID] = true
+	}
+	return out
+}
+
+func TestTransientPeers(t *testing.T) {
+	h, err := libp2p.New(libp2p.NoListenAddrs)
+	require.NoError(t, err)
+	defer h.Close()
+
+	ps := NewEstuaryPeeringService(h)
+
+	static := peer.ID("static")
+	shuttle := peer.ID("shuttle")
+	sibling := peer.ID("sibling")
+
+	ps.AddPeer(peer.AddrInfo{ID: static})
+	ps.SetTransientPeers([]peer.AddrInfo{{ID: static}, {ID: shuttle}, {ID: sibling}})
+	assert.Equal(t, map[peer.ID]bool{static: true, shuttle: true, sibling: true}, peerIDs(ps))
+
+	// configured peers stay when the transient list no longer has them
+	ps.SetTransientPeers([]peer.AddrInfo{{ID: sibling}})
+	assert.Equal(t, map[peer.ID]bool{static: true, sibling: true}, peerIDs(ps))
+
+	ps.RemoveTransientPeer(static)
+	ps.RemoveTransientPeer(sibling)
+	assert.Equal(t, map[peer.ID]bool{static: true}, peerIDs(ps))
+
+	ps.RemovePeer(static)
+	assert.Empty(t, peerIDs(ps))
+}
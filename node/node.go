@@ -4,6 +4,7 @@ import (
 	"context"
 	crand "crypto/rand"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -16,6 +17,7 @@ import (
 
 	rcmgr "github.com/application-research/estuary/node/modules/lp2p"
 	migratebs "github.com/application-research/estuary/util/migratebs"
+	"github.com/application-research/estuary/util/s3bs"
 	"github.com/application-research/filclient/keystore"
 	autobatch "github.com/application-research/go-bs-autobatch"
 	lmdb "github.com/filecoin-project/go-bs-lmdb"
@@ -27,7 +29,6 @@ import (
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	nsds "github.com/ipfs/go-datastore/namespace"
-	flatfs "github.com/ipfs/go-ds-flatfs"
 	levelds "github.com/ipfs/go-ds-leveldb"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	"github.com/ipfs/go-ipfs-provider/batched"
@@ -42,11 +43,15 @@ import (
 	metrics "github.com/libp2p/go-libp2p-core/metrics"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/pnet"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p-kad-dht/fullrt"
 	record "github.com/libp2p/go-libp2p-record"
+	tcp "github.com/libp2p/go-tcp-transport"
+	ws "github.com/libp2p/go-ws-transport"
 	"github.com/multiformats/go-multiaddr"
 	bsm "github.com/whyrusleeping/go-bs-measure"
+	mamask "github.com/whyrusleeping/multiaddr-filter"
 	"golang.org/x/xerrors"
 )
 
@@ -100,9 +105,9 @@ type Node struct {
 	FullRT   *fullrt.FullRT
 	FilDht   *dht.IpfsDHT
 	Host     host.Host
-	// Set for gathering disk usage
+	// Set for gathering disk usage, one per disk the blockstore is spread over
 
-	StorageDir string
+	StorageDirs []string
 	//Lmdb      *lmdb.Blockstore
 	Datastore datastore.Batching
 
@@ -116,6 +121,8 @@ type Node struct {
 	Peering  *peering.EstuaryPeeringService
 	Config   *config.Node
 	ArEngine *autoretrieve.AutoretrieveEngine
+
+	provTracker *provideTracker
 }
 
 func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
@@ -148,31 +155,68 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	listenAddrs := cfg.ListenAddrs
+	transports := libp2p.DefaultTransports
+	var psk pnet.PSK
+	if cfg.SwarmKeyFile != "" {
+		psk, err = loadSwarmKey(cfg.SwarmKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		// quic cant run on a private network
+		listenAddrs = withoutQuic(listenAddrs)
+		transports = libp2p.ChainOptions(
+			libp2p.Transport(tcp.NewTCPTransport),
+			libp2p.Transport(ws.New),
+		)
+		log.Infof("starting node on private network %s", swarmKeyFingerprint(psk))
+	}
+
 	opts := []libp2p.Option{
-		libp2p.ListenAddrStrings(cfg.ListenAddrs...),
+		libp2p.ListenAddrStrings(listenAddrs...),
 		libp2p.NATPortMap(),
 		libp2p.ConnectionManager(cmgr),
 		libp2p.Identity(peerkey),
 		libp2p.BandwidthReporter(bwc),
-		libp2p.DefaultTransports,
+		transports,
 		libp2p.ResourceManager(rcm),
 	}
 
-	if len(cfg.AnnounceAddrs) > 0 {
-		var addrs []multiaddr.Multiaddr
-		for _, anna := range cfg.AnnounceAddrs {
-			a, err := multiaddr.NewMultiaddr(anna)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse announce addr: %w", err)
-			}
-			addrs = append(addrs, a)
+	if psk != nil {
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+	}
+
+	if cfg.Relay.Client {
+		opts = append(opts, libp2p.EnableRelay())
+	} else {
+		opts = append(opts, libp2p.DisableRelay())
+	}
+
+	if cfg.Relay.Service {
+		opts = append(opts, libp2p.EnableRelayService())
+	}
+
+	if cfg.Relay.HolePunching {
+		if !cfg.Relay.Client {
+			return nil, fmt.Errorf("hole punching requires the relay client")
 		}
-		opts = append(opts, libp2p.AddrsFactory(func([]multiaddr.Multiaddr) []multiaddr.Multiaddr {
-			return addrs
-		}))
+		opts = append(opts, libp2p.EnableHolePunching())
+	}
+
+	if len(cfg.AnnounceAddrs) > 0 || len(cfg.NoAnnounceAddrs) > 0 {
+		af, err := makeAddrsFactory(cfg.AnnounceAddrs, cfg.NoAnnounceAddrs)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, libp2p.AddrsFactory(af))
 	}
 
 	h, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	//	peering service
 	peerServ := peering.NewEstuaryPeeringService(h)
@@ -195,10 +239,6 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 		log.Warn(errOnPeerStar)
 	}
 
-	if err != nil {
-		return nil, err
-	}
-
 	dhtopts := fullrt.DHTOption(
 		//dht.Validator(in.Validator),
 		dht.Datastore(ds),
@@ -231,7 +271,7 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 		return nil, err
 	}
 
-	mbs, stordir, err := loadBlockstore(cfg.Blockstore, cfg.WriteLogDir, cfg.HardFlushWriteLog, cfg.WriteLogTruncate, cfg.NoBlockstoreCache)
+	mbs, stordirs, err := loadBlockstore(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -243,23 +283,45 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 	}
 	blkst = wrapper
 
-	bsnet := bsnet.NewFromIpfsHost(h, frt)
+	// bitswap and everything set up on the node's host later, like the
+	// deal transfers, is held to the bandwidth caps
+	lh, err := LimitHost(h, cfg.Bandwidth)
+	if err != nil {
+		return nil, err
+	}
+
+	bsnet := bsnet.NewFromIpfsHost(lh, frt)
 
 	peerwork := cfg.Bitswap.MaxOutstandingBytesPerPeer
 	if peerwork == 0 {
 		peerwork = 5 << 20
 	}
 
+	bsworkers := cfg.Bitswap.EngineBlockstoreWorkers
+	if bsworkers == 0 {
+		bsworkers = 600
+	}
+
+	taskworkers := cfg.Bitswap.TaskWorkers
+	if taskworkers == 0 {
+		taskworkers = 600
+	}
+
 	bsopts := []bitswap.Option{
-		bitswap.EngineBlockstoreWorkerCount(600),
-		bitswap.TaskWorkerCount(600),
+		bitswap.EngineBlockstoreWorkerCount(bsworkers),
+		bitswap.TaskWorkerCount(taskworkers),
 		bitswap.MaxOutstandingBytesPerPeer(int(peerwork)),
+		bitswap.ProvideEnabled(!cfg.Bitswap.NoProvide && cfg.Provider.Strategy != config.ProvideDisabled),
 	}
 
 	if tms := cfg.Bitswap.TargetMessageSize; tms != 0 {
 		bsopts = append(bsopts, bitswap.WithTargetMessageSize(tms))
 	}
 
+	if etw := cfg.Bitswap.EngineTaskWorkers; etw != 0 {
+		bsopts = append(bsopts, bitswap.EngineTaskWorkerCount(etw))
+	}
+
 	bsctx := metri.CtxScope(ctx, "estuary.exch")
 	bswap := bitswap.New(bsctx, bsnet, blkst, bsopts...)
 
@@ -268,36 +330,47 @@ func Setup(ctx context.Context, init NodeInitializer) (*Node, error) {
 		return nil, err
 	}
 
-	provq, err := queue.NewQueue(context.Background(), "provq", ds)
+	provq, err := queue.NewQueue(context.Background(), provideQueueName, ds)
+	if err != nil {
+		return nil, err
+	}
+
+	keyProvider, err := keyProviderFor(cfg.Provider.Strategy, mbs, init.KeyProviderFunc)
 	if err != nil {
 		return nil, err
 	}
 
-	prov, err := batched.New(frt, provq,
-		batched.KeyProvider(init.KeyProviderFunc),
+	provTracker := &provideTracker{FullRT: frt}
+	prov, err := batched.New(provTracker, provq,
+		batched.KeyProvider(keyProvider),
 		batched.Datastore(ds),
 	)
 	if err != nil {
 		return nil, xerrors.Errorf("setup batched provider: %w", err)
 	}
 
-	prov.Run() // TODO: call close at some point
+	if cfg.Provider.Strategy == config.ProvideDisabled {
+		log.Warnf("providing is disabled, content will not be announced to the dht")
+	} else {
+		prov.Run() // TODO: call close at some point
+	}
 
 	return &Node{
 		Dht:        ipfsdht,
 		FilDht:     fildht,
 		FullRT:     frt,
 		Provider:   prov,
-		Host:       h,
+		Host:       lh,
 		Blockstore: mbs,
 		//Lmdb:       lmdbs,
-		Datastore:  ds,
-		Bitswap:    bswap.(*bitswap.Bitswap),
-		Wallet:     wallet,
-		Bwc:        bwc,
-		Config:     cfg,
-		StorageDir: stordir,
-		Peering:    peerServ,
+		Datastore:   ds,
+		Bitswap:     bswap.(*bitswap.Bitswap),
+		Wallet:      wallet,
+		Bwc:         bwc,
+		Config:      cfg,
+		StorageDirs: stordirs,
+		Peering:     peerServ,
+		provTracker: provTracker,
 	}, nil
 }
 
@@ -323,6 +396,51 @@ func toMultiAddresses(addrs []string) ([]multiaddr.Multiaddr, error) {
 	return multiAddrs, nil
 }
 
+// makeAddrsFactory builds the addresses the host advertises. The announce
+// addrs replace the ones it listens on, if any are set, and no announce addrs
+// are left out, either exact multiaddrs or ranges like /ip4/10.0.0.0/ipcidr/8
+func makeAddrsFactory(announce, noAnnounce []string) (func([]multiaddr.Multiaddr) []multiaddr.Multiaddr, error) {
+	var annAddrs []multiaddr.Multiaddr
+	for _, anna := range announce {
+		a, err := multiaddr.NewMultiaddr(anna)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse announce addr: %w", err)
+		}
+		annAddrs = append(annAddrs, a)
+	}
+
+	filters := multiaddr.NewFilters()
+	noAnnAddrs := make(map[string]bool)
+	for _, nanna := range noAnnounce {
+		if mask, err := mamask.NewMask(nanna); err == nil {
+			filters.AddFilter(*mask, multiaddr.ActionDeny)
+			continue
+		}
+
+		a, err := multiaddr.NewMultiaddr(nanna)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse no announce addr: %w", err)
+		}
+		noAnnAddrs[string(a.Bytes())] = true
+	}
+
+	return func(listening []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+		addrs := listening
+		if len(annAddrs) > 0 {
+			addrs = annAddrs
+		}
+
+		var out []multiaddr.Multiaddr
+		for _, a := range addrs {
+			if noAnnAddrs[string(a.Bytes())] || filters.AddrBlocked(a) {
+				continue
+			}
+			out = append(out, a)
+		}
+		return out
+	}, nil
+}
+
 func parseBsCfg(bscfg string) (string, []string, string, error) {
 	if bscfg[0] != ':' {
 		return "", nil, "", fmt.Errorf("cfg must start with colon")
@@ -364,6 +482,13 @@ func parseBsCfg(bscfg string) (string, []string, string, error) {
 
 /* format:
 :lmdb:/path/to/thing
+:flatfs:/path/to/thing
+:flatfs(next-to-last/2):/path/to/thing
+:flatfs:/path/to/ipfs/repo
+:badger:/path/to/thing
+:s3(:flatfs:/path/to/cache):https://endpoint/bucket/optional/prefix
+:sharded(:flatfs:/mnt/disk1/blocks,:flatfs:/mnt/disk2/blocks):
+:migrate(:lmdb:/old/thing,:badger:/new/thing):
 */
 func constructBlockstore(bscfg string) (EstuaryBlockstore, string, error) {
 	if !strings.HasPrefix(bscfg, ":") {
@@ -393,20 +518,64 @@ func constructBlockstore(bscfg string) (EstuaryBlockstore, string, error) {
 		}
 		return lmdbs, "", nil
 	case "flatfs":
+		ds, dir, err := openFlatfs(path, params)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return &deleteManyWrap{blockstore.NewBlockstoreNoPrefix(ds)}, dir, nil
+	case "badger":
 		if len(params) > 0 {
-			return nil, "", fmt.Errorf("flatfs params not yet supported")
+			return nil, "", fmt.Errorf("badger params not yet supported")
+		}
+
+		bbs, err := badgerbs.Open(badgerbs.DefaultOptions(path))
+		if err != nil {
+			return nil, "", err
+		}
+
+		return bbs, path, nil
+	case "s3":
+		if len(params) != 1 {
+			return nil, "", fmt.Errorf("s3 blockstore requires a local cache blockstore param (%d given)", len(params))
 		}
-		sf, err := flatfs.ParseShardFunc("/repo/flatfs/shard/v1/next-to-last/3")
+
+		cache, cacheDir, err := constructBlockstore(params[0])
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to construct cache blockstore for s3: %w", err)
+		}
+
+		sbs, err := s3bs.NewBlockstore(path, s3bs.CredentialsFromEnv(), cache)
 		if err != nil {
 			return nil, "", err
 		}
 
-		ds, err := flatfs.CreateOrOpen(path, sf, false)
+		// the cache is all that takes up local disk
+		return sbs, cacheDir, nil
+	case "sharded":
+		if len(params) == 0 {
+			return nil, "", fmt.Errorf("sharded blockstore requires at least one shard param")
+		}
+
+		var dirs []string
+		var stores []EstuaryBlockstore
+		for _, p := range params {
+			bs, dir, err := constructBlockstore(p)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to construct blockstore shard %q: %w", p, err)
+			}
+			dirs = append(dirs, dir)
+			stores = append(stores, bs)
+		}
+
+		// shards are identified by their spec, so blocks stay put for as
+		// long as the specs dont change
+		sbs, err := NewShardedBlockstore(params, dirs, stores)
 		if err != nil {
 			return nil, "", err
 		}
 
-		return &deleteManyWrap{blockstore.NewBlockstoreNoPrefix(ds)}, path, nil
+		return sbs, dirs[0], nil
 	case "migrate":
 		if len(params) != 2 {
 			return nil, "", fmt.Errorf("migrate blockstore requires two params (%d given)", len(params))
@@ -433,36 +602,116 @@ func constructBlockstore(bscfg string) (EstuaryBlockstore, string, error) {
 	}
 }
 
-func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool) (blockstore.Blockstore, string, error) {
-	bstore, dir, err := constructBlockstore(bscfg)
+// MigrateBlockstore copies every block from one blockstore spec to another,
+// deleting the blocks from the source as they are moved if del is set. Unlike
+// the :migrate(from,to): spec this runs to completion before returning, so it
+// is meant to be run while the node is stopped.
+func MigrateBlockstore(ctx context.Context, from, to string, del bool) error {
+	src, _, err := constructBlockstore(from)
 	if err != nil {
-		return nil, "", err
+		return fmt.Errorf("failed to construct source blockstore for migration: %w", err)
+	}
+	defer closeBlockstore(src)
+
+	dest, _, err := constructBlockstore(to)
+	if err != nil {
+		return fmt.Errorf("failed to construct dest blockstore for migration: %w", err)
+	}
+	defer closeBlockstore(dest)
+
+	count, fails, err := migratebs.Copy(ctx, src, dest, del)
+	if err != nil {
+		return err
+	}
+
+	if fails > 0 {
+		return fmt.Errorf("failed to migrate %d of %d blocks", fails, count)
+	}
+	return nil
+}
+
+// OpenBlockstore opens the main blockstore of cfg for offline use, while the
+// node is stopped. Blocks are read and written the way the node stores them,
+// but the write log and caches in front of it are left out, so blocks that
+// were not flushed from the log are missing. The returned func closes it.
+func OpenBlockstore(ctx context.Context, cfg *config.Node) (EstuaryBlockstore, func(), error) {
+	bstore, _, err := constructBlockstore(cfg.Blockstore)
+	if err != nil {
+		return nil, nil, err
 	}
+	closer := func() { closeBlockstore(bstore) }
 
-	if wal != "" {
-		opts := badgerbs.DefaultOptions(wal)
-		opts.Truncate = walTruncate
+	if !cfg.CompressBlocks {
+		return bstore, closer, nil
+	}
+
+	cbs, err := NewCompressedBlockstore(ctx, bstore)
+	if err != nil {
+		closer()
+		return nil, nil, err
+	}
+	return cbs, closer, nil
+}
+
+func closeBlockstore(bs EstuaryBlockstore) {
+	if c, ok := bs.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Errorf("failed to close blockstore: %s", err)
+		}
+	}
+}
+
+func loadBlockstore(cfg *config.Node) (blockstore.Blockstore, []string, error) {
+	bstore, dir, err := constructBlockstore(cfg.Blockstore)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dirs := []string{dir}
+	if sbs, ok := bstore.(*ShardedBlockstore); ok {
+		dirs = sbs.Dirs()
+	}
+
+	if cfg.CompressBlocks {
+		cbs, err := NewCompressedBlockstore(metri.CtxScope(context.TODO(), "estuary.bstore"), bstore)
+		if err != nil {
+			return nil, nil, err
+		}
+		bstore = cbs
+	}
+
+	if cfg.WriteLogDir != "" {
+		opts := badgerbs.DefaultOptions(cfg.WriteLogDir)
+		opts.Truncate = cfg.WriteLogTruncate
 
 		writelog, err := badgerbs.Open(opts)
 		if err != nil {
-			return nil, "", err
+			return nil, nil, err
 		}
 
-		ab, err := autobatch.NewBlockstore(bstore, writelog, 200, 200, flush)
+		wl := newWriteLog(metri.CtxScope(context.TODO(), "estuary.bstore"), writelog, cfg.WriteLogDir, bstore, cfg.WriteLogMaxSize, cfg.WriteLogMaxAge)
+		if err := wl.checkIntegrity(context.Background()); err != nil {
+			return nil, nil, fmt.Errorf("write log integrity check failed: %w", err)
+		}
+
+		ab, err := autobatch.NewBlockstore(bstore, writelog, 200, 200, cfg.HardFlushWriteLog)
 		if err != nil {
-			return nil, "", err
+			return nil, nil, err
 		}
 
-		if flush {
+		if cfg.HardFlushWriteLog {
 			if err := ab.Flush(context.Background()); err != nil {
-				return nil, "", err
+				return nil, nil, err
 			}
 		}
 
-		if walTruncate {
-			return nil, "", fmt.Errorf("truncation and full flush complete, halting execution")
+		if cfg.WriteLogTruncate {
+			return nil, nil, fmt.Errorf("truncation and full flush complete, halting execution")
 		}
 
+		wl.ab = ab
+		go wl.run(context.Background())
+
 		bstore = ab
 	}
 
@@ -470,14 +719,22 @@ func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool)
 
 	bstore = bsm.New("estuary.blks.base", bstore)
 
-	if !nocache {
+	if !cfg.NoBlockstoreCache {
+		bc := cfg.BlockstoreCache
 		cbstore, err := blockstore.CachedBlockstore(ctx, bstore, blockstore.CacheOpts{
-			//HasBloomFilterSize:   512 << 20,
-			//HasBloomFilterHashes: 7,
-			HasARCCacheSize: 8 << 20,
+			HasBloomFilterSize:   bc.BloomFilterSize,
+			HasBloomFilterHashes: bc.BloomFilterHashes,
+			HasARCCacheSize:      bc.HasCacheSize,
 		})
 		if err != nil {
-			return nil, "", err
+			return nil, nil, err
+		}
+
+		if bc.BlockCacheSize > 0 {
+			cbstore, err = NewBlockCache(ctx, cbstore, bc.BlockCacheSize, bc.BlockCacheMaxBlockSize)
+			if err != nil {
+				return nil, nil, err
+			}
 		}
 		bstore = &deleteManyWrap{cbstore}
 	}
@@ -487,7 +744,7 @@ func loadBlockstore(bscfg string, wal string, flush, walTruncate, nocache bool)
 
 	var blkst blockstore.Blockstore = mbs
 
-	return blkst, dir, nil
+	return blkst, dirs, nil
 }
 
 func loadOrInitPeerKey(kf string) (crypto.PrivKey, error) {
@@ -516,13 +773,17 @@ func loadOrInitPeerKey(kf string) (crypto.PrivKey, error) {
 	return crypto.UnmarshalPrivateKey(data)
 }
 
-func setupWallet(dir string) (*wallet.LocalWallet, error) {
+// OpenWallet opens the wallet kept in dir without creating a key in it
+func OpenWallet(dir string) (*wallet.LocalWallet, error) {
 	kstore, err := keystore.OpenOrInitKeystore(dir)
 	if err != nil {
 		return nil, err
 	}
+	return wallet.NewWallet(kstore)
+}
 
-	wallet, err := wallet.NewWallet(kstore)
+func setupWallet(dir string) (*wallet.LocalWallet, error) {
+	wallet, err := OpenWallet(dir)
 	if err != nil {
 		return nil, err
 	}
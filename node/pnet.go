@@ -0,0 +1,49 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/libp2p/go-libp2p-core/pnet"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// loadSwarmKey reads a private network key in the swarm.key format go-ipfs
+// uses, so the same key file can be shared with ipfs nodes
+func loadSwarmKey(path string) (pnet.PSK, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open swarm key: %w", err)
+	}
+	defer fi.Close()
+
+	psk, err := pnet.DecodeV1PSK(fi)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode swarm key: %w", err)
+	}
+	return psk, nil
+}
+
+// swarmKeyFingerprint identifies a network in logs without giving its key
+// away
+func swarmKeyFingerprint(psk pnet.PSK) string {
+	sum := sha256.Sum256(psk)
+	return hex.EncodeToString(sum[:8])
+}
+
+func withoutQuic(addrs []string) []string {
+	var out []string
+	for _, a := range addrs {
+		maddr, err := multiaddr.NewMultiaddr(a)
+		if err == nil {
+			if _, err := maddr.ValueForProtocol(multiaddr.P_QUIC); err == nil {
+				log.Warnf("not listening on %s, quic does not support private networks", a)
+				continue
+			}
+		}
+		out = append(out, a)
+	}
+	return out
+}
@@ -0,0 +1,34 @@
+package node
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSwarmKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "swarm.key")
+	key := "/key/swarm/psk/1.0.0/\n/base16/\n" + strings.Repeat("ab", 32) + "\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(key), 0600))
+
+	psk, err := loadSwarmKey(path)
+	require.NoError(t, err)
+	assert.Len(t, psk, 32)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("not a key"), 0600))
+	_, err = loadSwarmKey(path)
+	assert.Error(t, err)
+}
+
+func TestWithoutQuic(t *testing.T) {
+	addrs := withoutQuic([]string{
+		"/ip4/0.0.0.0/tcp/6745",
+		"/ip4/0.0.0.0/udp/6746/quic",
+		"/ip4/0.0.0.0/tcp/6747/ws",
+	})
+	assert.Equal(t, []string{"/ip4/0.0.0.0/tcp/6745", "/ip4/0.0.0.0/tcp/6747/ws"}, addrs)
+}
@@ -0,0 +1,107 @@
+package node
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/application-research/estuary/config"
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-ipfs-provider/simple"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"golang.org/x/xerrors"
+)
+
+// keyProviderFor returns what the reprovider announces under the strategy,
+// roots lists the roots of the stored content
+func keyProviderFor(strategy string, bs blockstore.Blockstore, roots simple.KeyChanFunc) (simple.KeyChanFunc, error) {
+	switch strategy {
+	case config.ProvideDisabled:
+		return func(context.Context) (<-chan cid.Cid, error) {
+			out := make(chan cid.Cid)
+			close(out)
+			return out, nil
+		}, nil
+	case config.ProvideRoots, "":
+		return roots, nil
+	case config.ProvidePinned:
+		return pinnedKeyProvider(bs, roots), nil
+	case config.ProvideAll:
+		return simple.NewBlockstoreProvider(bs), nil
+	default:
+		return nil, fmt.Errorf("unknown provide strategy %q", strategy)
+	}
+}
+
+// pinnedKeyProvider walks the dag of every root, each block is given once
+// even if it is part of several contents. Blocks missing from the
+// blockstore, like those below the depth of partial pins, are skipped.
+func pinnedKeyProvider(bs blockstore.Blockstore, roots simple.KeyChanFunc) simple.KeyChanFunc {
+	return func(ctx context.Context) (<-chan cid.Cid, error) {
+		rch, err := roots(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		dserv := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+		out := make(chan cid.Cid)
+		go func() {
+			defer close(out)
+
+			cset := cid.NewSet()
+			visit := func(c cid.Cid) bool {
+				if !cset.Visit(c) {
+					return false
+				}
+				select {
+				case out <- c:
+				case <-ctx.Done():
+				}
+				return true
+			}
+
+			for root := range rch {
+				err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipld.Link, error) {
+					if c.Type() == cid.Raw {
+						return nil, nil
+					}
+
+					node, err := dserv.Get(ctx, c)
+					if err != nil {
+						if xerrors.Is(err, ipld.ErrNotFound) {
+							return nil, nil
+						}
+						return nil, err
+					}
+					return util.FilterUnwalkableLinks(node.Links()), nil
+				}, root, visit)
+				if err != nil {
+					log.Warnf("failed to walk %s for reproviding: %s", root, err)
+				}
+
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}()
+		return out, nil
+	}
+}
+
+// ProvidesContent reports whether the node announces the content it stores
+func (nd *Node) ProvidesContent() bool {
+	return nd.Config.Provider.Strategy != config.ProvideDisabled
+}
+
+// ProvideRoot queues the root of newly stored content to be announced,
+// nothing is queued when providing is disabled
+func (nd *Node) ProvideRoot(c cid.Cid) error {
+	if !nd.ProvidesContent() {
+		return nil
+	}
+	return nd.Provider.Provide(c)
+}
@@ -0,0 +1,70 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func collectKeys(t *testing.T, kp func(context.Context) (<-chan cid.Cid, error)) []cid.Cid {
+	ch, err := kp(context.Background())
+	require.NoError(t, err)
+
+	var out []cid.Cid
+	for c := range ch {
+		out = append(out, c)
+	}
+	return out
+}
+
+func TestKeyProviderStrategies(t *testing.T) {
+	ctx := context.Background()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+
+	leaf := merkledag.NewRawNode([]byte("leaf"))
+	missing := merkledag.NewRawNode([]byte("not stored"))
+	root := &merkledag.ProtoNode{}
+	require.NoError(t, root.AddNodeLink("leaf", leaf))
+	require.NoError(t, root.AddNodeLink("missing", missing))
+	unreferenced := merkledag.NewRawNode([]byte("garbage"))
+
+	for _, b := range []blocks.Block{leaf, root, unreferenced} {
+		require.NoError(t, bs.Put(ctx, b))
+	}
+
+	roots := func(context.Context) (<-chan cid.Cid, error) {
+		out := make(chan cid.Cid, 1)
+		out <- root.Cid()
+		close(out)
+		return out, nil
+	}
+
+	kp, err := keyProviderFor(config.ProvideRoots, bs, roots)
+	require.NoError(t, err)
+	assert.Equal(t, []cid.Cid{root.Cid()}, collectKeys(t, kp))
+
+	// blocks missing from the blockstore are skipped
+	kp, err = keyProviderFor(config.ProvidePinned, bs, roots)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []cid.Cid{root.Cid(), leaf.Cid()}, collectKeys(t, kp))
+
+	kp, err = keyProviderFor(config.ProvideAll, bs, roots)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []cid.Cid{root.Cid(), leaf.Cid(), unreferenced.Cid()}, collectKeys(t, kp))
+
+	kp, err = keyProviderFor(config.ProvideDisabled, bs, roots)
+	require.NoError(t, err)
+	assert.Empty(t, collectKeys(t, kp))
+
+	_, err = keyProviderFor("everything", bs, roots)
+	assert.Error(t, err)
+}
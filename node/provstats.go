@@ -0,0 +1,126 @@
+package node
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-kad-dht/fullrt"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+// keys the batched provider keeps its queue and last reprovide time under
+const provideQueueName = "provq"
+
+var provideQueuePrefix = "/" + provideQueueName + "/queue"
+
+var lastReprovideKey = datastore.NewKey("/provider/reprovide/lastreprovide")
+
+// ProvideStats describes how announcing content to the dht is going
+type ProvideStats struct {
+	Strategy string `json:"strategy"`
+
+	// QueueLength is the number of newly stored roots waiting to be
+	// announced
+	QueueLength int `json:"queueLength"`
+
+	TotalProvides      int           `json:"totalProvides"`
+	AvgProvideDuration time.Duration `json:"avgProvideDuration"`
+	LastProvide        time.Time     `json:"lastProvide"`
+
+	// LastReprovide is when the last full reprovide cycle completed
+	LastReprovide          time.Time     `json:"lastReprovide"`
+	LastReprovideBatchSize int           `json:"lastReprovideBatchSize"`
+	LastReprovideDuration  time.Duration `json:"lastReprovideDuration"`
+
+	// Failures counts the batches the dht failed to announce since the node
+	// started
+	Failures      int64     `json:"failures"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// provideTracker sits between the batched provider and the dht to record
+// how its announcements go, the provider itself only logs failures
+type provideTracker struct {
+	*fullrt.FullRT
+
+	lk            sync.Mutex
+	failures      int64
+	lastProvide   time.Time
+	lastError     string
+	lastErrorTime time.Time
+}
+
+func (pt *provideTracker) ProvideMany(ctx context.Context, keys []multihash.Multihash) error {
+	err := pt.FullRT.ProvideMany(ctx, keys)
+
+	pt.lk.Lock()
+	defer pt.lk.Unlock()
+	if err != nil {
+		pt.failures++
+		pt.lastError = err.Error()
+		pt.lastErrorTime = time.Now()
+		return err
+	}
+	pt.lastProvide = time.Now()
+	return nil
+}
+
+// ProvideStats reports the state of the provide queue and of the last
+// provides and reprovides
+func (nd *Node) ProvideStats(ctx context.Context) (*ProvideStats, error) {
+	st := &ProvideStats{
+		Strategy: nd.Config.Provider.Strategy,
+	}
+
+	pst, err := nd.Provider.Stat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st.TotalProvides = pst.TotalProvides
+	st.AvgProvideDuration = pst.AvgProvideDuration
+	st.LastReprovideBatchSize = pst.LastReprovideBatchSize
+	st.LastReprovideDuration = pst.LastReprovideDuration
+
+	res, err := nd.Datastore.Query(ctx, query.Query{
+		Prefix:   provideQueuePrefix,
+		KeysOnly: true,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to query provide queue: %w", err)
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, xerrors.Errorf("failed to read provide queue: %w", r.Error)
+		}
+		st.QueueLength++
+	}
+
+	val, err := nd.Datastore.Get(ctx, lastReprovideKey)
+	switch {
+	case xerrors.Is(err, datastore.ErrNotFound):
+	case err != nil:
+		return nil, xerrors.Errorf("failed to get last reprovide time: %w", err)
+	default:
+		if ns, err := strconv.ParseInt(string(val), 10, 64); err == nil {
+			st.LastReprovide = time.Unix(0, ns)
+		}
+	}
+
+	if pt := nd.provTracker; pt != nil {
+		pt.lk.Lock()
+		st.Failures = pt.failures
+		st.LastProvide = pt.lastProvide
+		st.LastError = pt.lastError
+		st.LastErrorTime = pt.lastErrorTime
+		pt.lk.Unlock()
+	}
+
+	return st, nil
+}
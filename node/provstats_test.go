@@ -0,0 +1,51 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-ipfs-provider/batched"
+	"github.com/ipfs/go-ipfs-provider/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvideStats(t *testing.T) {
+	ctx := context.Background()
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, ds.Put(ctx, datastore.NewKey(fmt.Sprintf("%s/%d", provideQueuePrefix, i)), []byte("cid")))
+	}
+	reprovided := time.Unix(1650000000, 0)
+	require.NoError(t, ds.Put(ctx, lastReprovideKey, []byte(fmt.Sprint(reprovided.UnixNano()))))
+
+	// the queue gets a datastore of its own so it doesnt take the entries above
+	q, err := queue.NewQueue(ctx, provideQueueName, datastore.NewMapDatastore())
+	require.NoError(t, err)
+	defer q.Close()
+
+	pt := &provideTracker{failures: 2, lastError: "no peers"}
+	prov, err := batched.New(pt, q)
+	require.NoError(t, err)
+
+	nd := &Node{
+		Config:      &config.Node{Provider: config.Provider{Strategy: config.ProvideRoots}},
+		Datastore:   ds,
+		Provider:    prov,
+		provTracker: pt,
+	}
+
+	st, err := nd.ProvideStats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, config.ProvideRoots, st.Strategy)
+	assert.Equal(t, 3, st.QueueLength)
+	assert.True(t, reprovided.Equal(st.LastReprovide))
+	assert.Equal(t, int64(2), st.Failures)
+	assert.Equal(t, "no peers", st.LastError)
+}
@@ -0,0 +1,305 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"golang.org/x/xerrors"
+)
+
+type bsShard struct {
+	id  string
+	dir string
+	bs  EstuaryBlockstore
+}
+
+// ShardedBlockstore spreads blocks over several blockstores, usually one per
+// disk. Each block goes to the shard that ranks highest for its multihash
+// under rendezvous hashing, so adding a shard only moves the blocks that now
+// rank highest on it. Blocks written before a shard was added are still found
+// on the shard they were written to, reads fall back to asking every shard.
+type ShardedBlockstore struct {
+	shards []bsShard
+}
+
+var _ blockstore.Blockstore = (*ShardedBlockstore)(nil)
+
+// NewShardedBlockstore builds a sharded blockstore over the given stores. The
+// ids place blocks, so they have to stay the same for a store across restarts.
+func NewShardedBlockstore(ids []string, dirs []string, stores []EstuaryBlockstore) (*ShardedBlockstore, error) {
+	if len(stores) == 0 {
+		return nil, xerrors.Errorf("sharded blockstore needs at least one shard")
+	}
+	if len(ids) != len(stores) || len(dirs) != len(stores) {
+		return nil, xerrors.Errorf("sharded blockstore needs an id and a dir for each shard")
+	}
+
+	seen := make(map[string]bool)
+	var shards []bsShard
+	for i := range stores {
+		if seen[ids[i]] {
+			return nil, xerrors.Errorf("duplicate blockstore shard %q", ids[i])
+		}
+		seen[ids[i]] = true
+
+		shards = append(shards, bsShard{
+			id:  ids[i],
+			dir: dirs[i],
+			bs:  stores[i],
+		})
+	}
+
+	return &ShardedBlockstore{shards: shards}, nil
+}
+
+// Dirs returns the storage directory of every shard
+func (sb *ShardedBlockstore) Dirs() []string {
+	var dirs []string
+	for _, s := range sb.shards {
+		dirs = append(dirs, s.dir)
+	}
+	return dirs
+}
+
+func (sb *ShardedBlockstore) shardIndex(c cid.Cid) int {
+	mh := c.Hash()
+
+	var best int
+	var bestScore uint64
+	for i, s := range sb.shards {
+		h := sha256.New()
+		h.Write([]byte(s.id))
+		h.Write(mh)
+		score := binary.BigEndian.Uint64(h.Sum(nil))
+		if i == 0 || score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+	return best
+}
+
+func (sb *ShardedBlockstore) shardFor(c cid.Cid) EstuaryBlockstore {
+	return sb.shards[sb.shardIndex(c)].bs
+}
+
+// others calls f on every shard but the one c belongs on until f returns
+// true or an error
+func (sb *ShardedBlockstore) others(c cid.Cid, f func(EstuaryBlockstore) (bool, error)) error {
+	own := sb.shardIndex(c)
+	for i, s := range sb.shards {
+		if i == own {
+			continue
+		}
+		done, err := f(s.bs)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (sb *ShardedBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	has, err := sb.shardFor(c).Has(ctx, c)
+	if err != nil || has {
+		return has, err
+	}
+
+	err = sb.others(c, func(bs EstuaryBlockstore) (bool, error) {
+		has, err = bs.Has(ctx, c)
+		return has, err
+	})
+	return has, err
+}
+
+func (sb *ShardedBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := sb.shardFor(c).Get(ctx, c)
+	if !xerrors.Is(err, blockstore.ErrNotFound) {
+		return blk, err
+	}
+
+	err = sb.others(c, func(bs EstuaryBlockstore) (bool, error) {
+		blk, err = bs.Get(ctx, c)
+		if xerrors.Is(err, blockstore.ErrNotFound) {
+			return false, nil
+		}
+		return true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if blk == nil {
+		return nil, blockstore.ErrNotFound
+	}
+	return blk, nil
+}
+
+func (sb *ShardedBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	size, err := sb.shardFor(c).GetSize(ctx, c)
+	if !xerrors.Is(err, blockstore.ErrNotFound) {
+		return size, err
+	}
+
+	found := false
+	err = sb.others(c, func(bs EstuaryBlockstore) (bool, error) {
+		size, err = bs.GetSize(ctx, c)
+		if xerrors.Is(err, blockstore.ErrNotFound) {
+			return false, nil
+		}
+		found = err == nil
+		return true, err
+	})
+	if err != nil {
+		return -1, err
+	}
+	if !found {
+		return -1, blockstore.ErrNotFound
+	}
+	return size, nil
+}
+
+func (sb *ShardedBlockstore) Put(ctx context.Context, blk blocks.Block) error {
+	return sb.shardFor(blk.Cid()).Put(ctx, blk)
+}
+
+func (sb *ShardedBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	byShard := make(map[int][]blocks.Block)
+	for _, blk := range blks {
+		i := sb.shardIndex(blk.Cid())
+		byShard[i] = append(byShard[i], blk)
+	}
+
+	// the disks are written in parallel, that is the point of having several
+	var wg sync.WaitGroup
+	errs := make([]error, len(sb.shards))
+	for i, sblks := range byShard {
+		wg.Add(1)
+		go func(i int, sblks []blocks.Block) {
+			defer wg.Done()
+			errs[i] = sb.shards[i].bs.PutMany(ctx, sblks)
+		}(i, sblks)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteBlock removes the block from every shard, it may have been written to
+// another one before the shards changed
+func (sb *ShardedBlockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	for _, s := range sb.shards {
+		if err := s.bs.DeleteBlock(ctx, c); err != nil && !xerrors.Is(err, blockstore.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sb *ShardedBlockstore) DeleteMany(ctx context.Context, cids []cid.Cid) error {
+	for _, c := range cids {
+		if err := sb.DeleteBlock(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllKeysChan lists the keys of every shard. A block that was written to one
+// shard and later again to another is listed once, from the first shard that
+// would serve it.
+func (sb *ShardedBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var chans []<-chan cid.Cid
+	drain := func() {
+		cancel()
+		for _, ch := range chans {
+			for range ch {
+			}
+		}
+	}
+
+	for _, s := range sb.shards {
+		ch, err := s.bs.AllKeysChan(ctx)
+		if err != nil {
+			go drain()
+			return nil, err
+		}
+		chans = append(chans, ch)
+	}
+
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		defer drain()
+
+		for i, ch := range chans {
+			for c := range ch {
+				dup, err := sb.listedElsewhere(ctx, c, i)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					log.Errorf("failed to check for duplicate of %s on other shards: %s", c, err)
+					return
+				}
+				if dup {
+					continue
+				}
+
+				select {
+				case out <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// listedElsewhere reports whether a key found on shard i is also listed from
+// another shard. Keys on their own shard always belong to it, any other copy
+// is listed from its own shard if it is there or else from the lowest shard
+// holding it.
+func (sb *ShardedBlockstore) listedElsewhere(ctx context.Context, c cid.Cid, i int) (bool, error) {
+	own := sb.shardIndex(c)
+	if i == own {
+		return false, nil
+	}
+
+	has, err := sb.shards[own].bs.Has(ctx, c)
+	if err != nil || has {
+		return has, err
+	}
+
+	for j := 0; j < i; j++ {
+		if j == own {
+			continue
+		}
+		has, err := sb.shards[j].bs.Has(ctx, c)
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
+func (sb *ShardedBlockstore) HashOnRead(enabled bool) {
+	for _, s := range sb.shards {
+		s.bs.HashOnRead(enabled)
+	}
+}
@@ -0,0 +1,122 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMemShards(n int) ([]string, []string, []EstuaryBlockstore) {
+	var ids, dirs []string
+	var stores []EstuaryBlockstore
+	for i := 0; i < n; i++ {
+		ids = append(ids, fmt.Sprintf("shard-%d", i))
+		dirs = append(dirs, fmt.Sprintf("/mnt/disk%d", i))
+		stores = append(stores, &deleteManyWrap{blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))})
+	}
+	return ids, dirs, stores
+}
+
+func TestShardedBlockstore(t *testing.T) {
+	ctx := context.Background()
+
+	ids, dirs, stores := newMemShards(3)
+	sbs, err := NewShardedBlockstore(ids, dirs, stores)
+	require.NoError(t, err)
+	assert.Equal(t, dirs, sbs.Dirs())
+
+	var blks []blocks.Block
+	for i := 0; i < 300; i++ {
+		blks = append(blks, blocks.NewBlock([]byte(fmt.Sprintf("block %d", i))))
+	}
+	require.NoError(t, sbs.PutMany(ctx, blks))
+
+	// every block is on exactly one shard, and every shard got some
+	for _, st := range stores {
+		ch, err := st.AllKeysChan(ctx)
+		require.NoError(t, err)
+		var n int
+		for range ch {
+			n++
+		}
+		assert.Greater(t, n, 50)
+	}
+
+	// blocks written before a shard was added can still be read
+	ids4, dirs4, stores4 := newMemShards(4)
+	copy(stores4, stores)
+	sbs4, err := NewShardedBlockstore(ids4, dirs4, stores4)
+	require.NoError(t, err)
+
+	var moved int
+	for _, blk := range blks {
+		if sbs4.shardIndex(blk.Cid()) != sbs.shardIndex(blk.Cid()) {
+			assert.Equal(t, 3, sbs4.shardIndex(blk.Cid()))
+			moved++
+		}
+
+		got, err := sbs4.Get(ctx, blk.Cid())
+		require.NoError(t, err)
+		assert.Equal(t, blk.RawData(), got.RawData())
+	}
+	assert.Greater(t, moved, 0)
+	assert.Less(t, moved, len(blks)/2)
+
+	require.NoError(t, sbs4.DeleteMany(ctx, []cid.Cid{blks[0].Cid()}))
+	has, err := sbs4.Has(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	_, err = sbs4.Get(ctx, blks[0].Cid())
+	assert.ErrorIs(t, err, blockstore.ErrNotFound)
+}
+
+func TestShardedAllKeysChan(t *testing.T) {
+	ctx := context.Background()
+
+	ids, dirs, stores := newMemShards(3)
+	sbs, err := NewShardedBlockstore(ids, dirs, stores)
+	require.NoError(t, err)
+
+	var blks []blocks.Block
+	for i := 0; i < 100; i++ {
+		blks = append(blks, blocks.NewBlock([]byte(fmt.Sprintf("block %d", i))))
+	}
+	require.NoError(t, sbs.PutMany(ctx, blks))
+
+	// copies left on other shards, like after the shards changed
+	for _, blk := range blks[:20] {
+		other := (sbs.shardIndex(blk.Cid()) + 1) % len(stores)
+		require.NoError(t, stores[other].Put(ctx, blk))
+	}
+	require.NoError(t, stores[0].Put(ctx, blks[20]))
+	require.NoError(t, stores[1].Put(ctx, blks[20]))
+
+	ch, err := sbs.AllKeysChan(ctx)
+	require.NoError(t, err)
+	seen := make(map[cid.Cid]int)
+	for c := range ch {
+		seen[c]++
+	}
+	assert.Len(t, seen, len(blks))
+	for c, n := range seen {
+		assert.Equal(t, 1, n, "%s listed %d times", c, n)
+	}
+
+	// stopping early does not leave the shard listings blocked
+	cctx, cancel := context.WithCancel(ctx)
+	ch, err = sbs.AllKeysChan(cctx)
+	require.NoError(t, err)
+	<-ch
+	cancel()
+	for range ch {
+	}
+}
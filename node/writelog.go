@@ -0,0 +1,318 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/application-research/estuary/config"
+	badgerbs "github.com/filecoin-project/lotus/blockstore/badger"
+	"github.com/ipfs/go-cid"
+	metri "github.com/ipfs/go-metrics-interface"
+)
+
+const writeLogCheckInterval = time.Minute
+
+// blocks are removed from the write log in batches of this many
+const writeLogDeleteBatch = 1000
+
+type flusher interface {
+	Flush(context.Context) error
+}
+
+// writeLog keeps the badger write log in front of the main blockstore from
+// growing without bound. Blocks the batcher flushed into the main blockstore
+// are compacted out of the log and the space they took reclaimed, and the log
+// is rotated, flushed out in full, once it gets too big or too old.
+type writeLog struct {
+	log  *badgerbs.Blockstore
+	dir  string
+	main EstuaryBlockstore
+	ab   flusher
+
+	maxSize   int64
+	maxAge    time.Duration
+	lastFlush time.Time
+
+	metBlocks  metri.Gauge
+	metPending metri.Gauge
+	metSize    metri.Gauge
+	metCorrupt metri.Counter
+}
+
+func newWriteLog(ctx context.Context, wlog *badgerbs.Blockstore, dir string, main EstuaryBlockstore, maxSize int64, maxAge time.Duration) *writeLog {
+	return &writeLog{
+		log:       wlog,
+		dir:       dir,
+		main:      main,
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		lastFlush: time.Now(),
+
+		metBlocks:  metri.NewCtx(ctx, "writelog_blocks", "number of blocks held in the write log").Gauge(),
+		metPending: metri.NewCtx(ctx, "writelog_pending_blocks", "number of blocks in the write log not yet flushed to the blockstore").Gauge(),
+		metSize:    metri.NewCtx(ctx, "writelog_size", "size of the write log on disk").Gauge(),
+		metCorrupt: metri.NewCtx(ctx, "writelog_corrupt_blocks", "number of corrupt blocks dropped from the write log").Counter(),
+	}
+}
+
+// checkIntegrity drops every block from the log whose data doesnt match its
+// cid, before they get replayed into the main blockstore
+func (wl *writeLog) checkIntegrity(ctx context.Context) error {
+	ch, err := wl.log.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+
+	var checked int
+	var bad []cid.Cid
+	for c := range ch {
+		checked++
+		blk, err := wl.log.Get(ctx, c)
+		if err != nil {
+			log.Warnf("failed to read block %s from write log: %s", c, err)
+			bad = append(bad, c)
+			continue
+		}
+
+		if !blockMatches(c, blk.RawData()) {
+			bad = append(bad, c)
+		}
+	}
+
+	if len(bad) > 0 {
+		log.Warnf("dropping %d corrupt blocks from the write log", len(bad))
+		if err := wl.log.DeleteMany(ctx, bad); err != nil {
+			return err
+		}
+		wl.metCorrupt.Add(float64(len(bad)))
+	}
+
+	log.Infow("write log integrity check complete", "blocks", checked, "corrupt", len(bad))
+	return nil
+}
+
+func (wl *writeLog) run(ctx context.Context) {
+	ticker := time.NewTicker(writeLogCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := wl.maintain(ctx); err != nil {
+				log.Errorf("write log maintenance failed: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (wl *writeLog) maintain(ctx context.Context) error {
+	size, err := dirSize(wl.dir)
+	if err != nil {
+		return err
+	}
+	wl.metSize.Set(float64(size))
+
+	rotate := (wl.maxSize > 0 && size > wl.maxSize) || (wl.maxAge > 0 && time.Since(wl.lastFlush) > wl.maxAge)
+	if rotate {
+		log.Infow("rotating write log", "size", size, "since", wl.lastFlush)
+		if err := wl.ab.Flush(ctx); err != nil {
+			return err
+		}
+		wl.lastFlush = time.Now()
+	}
+
+	removed, err := wl.compact(ctx)
+	if err != nil {
+		return err
+	}
+
+	if removed > 0 {
+		if err := wl.log.CollectGarbage(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact removes the blocks that made it into the main blockstore from the
+// log, and returns how many it removed
+func (wl *writeLog) compact(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch, err := wl.log.AllKeysChan(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var total, pending, removed int
+	var flushed []cid.Cid
+	for c := range ch {
+		total++
+		has, err := wl.main.Has(ctx, c)
+		if err != nil {
+			return removed, err
+		}
+
+		if !has {
+			pending++
+			continue
+		}
+
+		flushed = append(flushed, c)
+		if len(flushed) >= writeLogDeleteBatch {
+			if err := wl.log.DeleteMany(ctx, flushed); err != nil {
+				return removed, err
+			}
+			removed += len(flushed)
+			flushed = flushed[:0]
+		}
+	}
+
+	if len(flushed) > 0 {
+		if err := wl.log.DeleteMany(ctx, flushed); err != nil {
+			return removed, err
+		}
+		removed += len(flushed)
+	}
+
+	wl.metBlocks.Set(float64(total - removed))
+	wl.metPending.Set(float64(pending))
+	return removed, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// WriteLogReport is the result of checking the write log against the main
+// blockstore
+type WriteLogReport struct {
+	// Blocks is the number of blocks in the write log, Corrupt the ones
+	// among them whose data doesnt match their cid
+	Blocks  int
+	Corrupt int
+
+	// Unflushed blocks are in the write log but not the main blockstore,
+	// Damaged ones are in both but the copy in the main blockstore doesnt
+	// match its cid
+	Unflushed int
+	Damaged   int
+
+	// Repaired is the number of blocks written from the log into the main
+	// blockstore
+	Repaired int
+}
+
+// VerifyWriteLog replays the write log of cfg against its main blockstore,
+// counting the blocks that never made it there or got damaged on the way.
+// With repair set they are written again from the log, and corrupt blocks
+// are dropped from the log. It is meant to be run while the node is stopped,
+// e.g. after a crash.
+func VerifyWriteLog(ctx context.Context, cfg *config.Node, repair bool) (*WriteLogReport, error) {
+	if cfg.WriteLogDir == "" {
+		return nil, fmt.Errorf("no write log is configured")
+	}
+
+	wlog, err := badgerbs.Open(badgerbs.DefaultOptions(cfg.WriteLogDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write log: %w", err)
+	}
+	defer wlog.Close()
+
+	main, closer, err := OpenBlockstore(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	return verifyWriteLog(ctx, wlog, main, repair)
+}
+
+func verifyWriteLog(ctx context.Context, wlog *badgerbs.Blockstore, main EstuaryBlockstore, repair bool) (*WriteLogReport, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch, err := wlog.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rep WriteLogReport
+	var corrupt []cid.Cid
+	for c := range ch {
+		rep.Blocks++
+
+		blk, err := wlog.Get(ctx, c)
+		if err != nil || !blockMatches(c, blk.RawData()) {
+			log.Warnf("block %s in the write log is corrupt", c)
+			rep.Corrupt++
+			corrupt = append(corrupt, c)
+			continue
+		}
+
+		has, err := main.Has(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		if has {
+			stored, err := main.Get(ctx, c)
+			if err == nil && blockMatches(c, stored.RawData()) {
+				continue
+			}
+			log.Warnf("block %s in the blockstore does not match the write log", c)
+			rep.Damaged++
+		} else {
+			log.Debugf("block %s was not flushed from the write log", c)
+			rep.Unflushed++
+		}
+
+		if !repair {
+			continue
+		}
+
+		// the blockstore skips writes of blocks it already has
+		if has {
+			if err := main.DeleteBlock(ctx, c); err != nil {
+				return nil, err
+			}
+		}
+		if err := main.Put(ctx, blk); err != nil {
+			return nil, err
+		}
+		rep.Repaired++
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if repair && len(corrupt) > 0 {
+		if err := wlog.DeleteMany(ctx, corrupt); err != nil {
+			return nil, err
+		}
+	}
+	return &rep, nil
+}
+
+// blockMatches reports whether data hashes to c
+func blockMatches(c cid.Cid, data []byte) bool {
+	sum, err := c.Prefix().Sum(data)
+	return err == nil && sum.Equals(c)
+}
@@ -0,0 +1,92 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	badgerbs "github.com/filecoin-project/lotus/blockstore/badger"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteLogMaintenance(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	wlog, err := badgerbs.Open(badgerbs.DefaultOptions(dir))
+	require.NoError(t, err)
+	defer wlog.Close()
+
+	main := &deleteManyWrap{blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))}
+	wl := newWriteLog(ctx, wlog, dir, main, 0, 0)
+
+	flushed := blocks.NewBlock([]byte("flushed"))
+	pending := blocks.NewBlock([]byte("pending"))
+	corrupt, err := blocks.NewBlockWithCid([]byte("not what the cid says"), blocks.NewBlock([]byte("corrupt")).Cid())
+	require.NoError(t, err)
+
+	require.NoError(t, wlog.PutMany(ctx, []blocks.Block{flushed, pending, corrupt}))
+	require.NoError(t, main.Put(ctx, flushed))
+
+	require.NoError(t, wl.checkIntegrity(ctx))
+	has, err := wlog.Has(ctx, corrupt.Cid())
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	removed, err := wl.compact(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	has, err = wlog.Has(ctx, flushed.Cid())
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	has, err = wlog.Has(ctx, pending.Cid())
+	require.NoError(t, err)
+	assert.True(t, has)
+}
+
+func TestVerifyWriteLog(t *testing.T) {
+	ctx := context.Background()
+
+	wlog, err := badgerbs.Open(badgerbs.DefaultOptions(t.TempDir()))
+	require.NoError(t, err)
+	defer wlog.Close()
+
+	main := &deleteManyWrap{blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))}
+
+	flushed := blocks.NewBlock([]byte("flushed"))
+	unflushed := blocks.NewBlock([]byte("unflushed"))
+	damaged := blocks.NewBlock([]byte("damaged"))
+	corrupt, err := blocks.NewBlockWithCid([]byte("not what the cid says"), blocks.NewBlock([]byte("corrupt")).Cid())
+	require.NoError(t, err)
+
+	require.NoError(t, wlog.PutMany(ctx, []blocks.Block{flushed, unflushed, damaged, corrupt}))
+	torn, err := blocks.NewBlockWithCid([]byte("dam"), damaged.Cid())
+	require.NoError(t, err)
+	require.NoError(t, main.PutMany(ctx, []blocks.Block{flushed, torn}))
+
+	rep, err := verifyWriteLog(ctx, wlog, main, false)
+	require.NoError(t, err)
+	assert.Equal(t, WriteLogReport{Blocks: 4, Corrupt: 1, Unflushed: 1, Damaged: 1}, *rep)
+
+	has, err := main.Has(ctx, unflushed.Cid())
+	require.NoError(t, err)
+	assert.False(t, has, "nothing is written without repair")
+
+	rep, err = verifyWriteLog(ctx, wlog, main, true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, rep.Repaired)
+
+	got, err := main.Get(ctx, damaged.Cid())
+	require.NoError(t, err)
+	assert.Equal(t, damaged.RawData(), got.RawData())
+
+	rep, err = verifyWriteLog(ctx, wlog, main, false)
+	require.NoError(t, err)
+	assert.Equal(t, WriteLogReport{Blocks: 3}, *rep)
+}
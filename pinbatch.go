@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	drpc "github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/labstack/echo/v4"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// maxPinBatchSize bounds the number of pins a single batch request may add
+const maxPinBatchSize = 1000
+
+// PinBatch groups the contents added by one batch pin request, so their
+// progress can be followed through a single handle
+type PinBatch struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	UUID   string `gorm:"index" json:"uuid"`
+	UserID uint   `gorm:"index" json:"userId"`
+}
+
+type PinBatchRef struct {
+	ID      uint `gorm:"primaryKey"`
+	Batch   uint `gorm:"index;not null"`
+	Content uint `gorm:"not null"`
+}
+
+type batchPin struct {
+	root     cid.Cid
+	filename string
+	origins  []*peer.AddrInfo
+	depth    int
+}
+
+type pinBatchResponse struct {
+	UUID      string    `json:"uuid"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	// Status is queued until any pin started, pinning until all of them
+	// finished, then failed if any failed and pinned otherwise
+	Status types.PinningStatus            `json:"status"`
+	Counts map[types.PinningStatus]int    `json:"counts"`
+	Pins   []*types.IpfsPinStatusResponse `json:"pins"`
+}
+
+// pinBatch creates a content for each pin and queues them all on the same
+// location, with a single command for shuttles
+func (cm *ContentManager) pinBatch(ctx context.Context, user uint, pins []batchPin, origins []*peer.AddrInfo, makeDeal bool) (*PinBatch, error) {
+	ctx, span := cm.tracer.Start(ctx, "pinBatch")
+	defer span.End()
+
+	loc, err := cm.selectLocationForContent(ctx, pins[0].root, user)
+	if err != nil {
+		return nil, xerrors.Errorf("selecting location for content failed: %w", err)
+	}
+
+	batch := &PinBatch{
+		UUID:   uuid.New().String(),
+		UserID: user,
+	}
+	contents := make([]util.Content, len(pins))
+	peers := make([][]*peer.AddrInfo, len(pins))
+	if err := cm.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(batch).Error; err != nil {
+			return err
+		}
+
+		for i, p := range pins {
+			peers[i] = append(append([]*peer.AddrInfo{}, p.origins...), origins...)
+
+			var originsStr string
+			if len(peers[i]) > 0 {
+				b, err := json.Marshal(peers[i])
+				if err != nil {
+					return err
+				}
+				originsStr = string(b)
+			}
+
+			contents[i] = util.Content{
+				Cid:         util.DbCID{CID: p.root},
+				Name:        p.filename,
+				UserID:      user,
+				Replication: cm.Replication,
+				Pinning:     true,
+				Location:    loc,
+				Origins:     originsStr,
+				MaxDepth:    p.depth,
+			}
+		}
+
+		if err := tx.Create(&contents).Error; err != nil {
+			return err
+		}
+
+		refs := make([]PinBatchRef, len(contents))
+		for i, c := range contents {
+			refs[i] = PinBatchRef{Batch: batch.ID, Content: c.ID}
+		}
+		return tx.Create(&refs).Error
+	}); err != nil {
+		return nil, err
+	}
+
+	if loc == constants.ContentLocationLocal {
+		for i, c := range contents {
+			cm.addPinToQueue(c, peers[i], 0, makeDeal && c.MaxDepth == 0)
+		}
+		return batch, nil
+	}
+
+	addPins := &drpc.AddPins{Peers: origins}
+	for i, c := range contents {
+		addPins.Pins = append(addPins.Pins, drpc.AddPin{
+			DBID:     c.ID,
+			UserId:   c.UserID,
+			Cid:      c.Cid.CID,
+			Peers:    pins[i].origins,
+			MaxDepth: c.MaxDepth,
+		})
+	}
+
+	if err := cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_AddPins,
+		Params: drpc.CmdParams{
+			AddPins: addPins,
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	for i, c := range contents {
+		cm.trackShuttlePin(c, peers[i], 0, loc, makeDeal && c.MaxDepth == 0)
+	}
+	return batch, nil
+}
+
+// pinBatchStatus summarizes the pins of a batch
+func (cm *ContentManager) pinBatchStatus(batch *PinBatch) (*pinBatchResponse, error) {
+	var contents []util.Content
+	if err := cm.DB.Model(util.Content{}).
+		Joins("inner join pin_batch_refs on pin_batch_refs.content = contents.id").
+		Where("pin_batch_refs.batch = ?", batch.ID).
+		Order("contents.id").
+		Find(&contents).Error; err != nil {
+		return nil, err
+	}
+
+	resp := &pinBatchResponse{
+		UUID:      batch.UUID,
+		CreatedAt: batch.CreatedAt,
+		Counts:    make(map[types.PinningStatus]int),
+		Pins:      make([]*types.IpfsPinStatusResponse, 0, len(contents)),
+	}
+	for _, c := range contents {
+		st, err := cm.pinStatus(c, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp.Counts[st.Status]++
+		resp.Pins = append(resp.Pins, st)
+	}
+
+	switch {
+	case resp.Counts[types.PinningStatusQueued] == len(contents):
+		resp.Status = types.PinningStatusQueued
+	case resp.Counts[types.PinningStatusQueued] > 0 || resp.Counts[types.PinningStatusPinning] > 0:
+		resp.Status = types.PinningStatusPinning
+	case resp.Counts[types.PinningStatusFailed] > 0:
+		resp.Status = types.PinningStatusFailed
+	default:
+		resp.Status = types.PinningStatusPinned
+	}
+	return resp, nil
+}
+
+// handleAddIpfsBatch godoc
+// @Summary      Add a batch of IPFS objects
+// @Description  This endpoint pins several IPFS objects at once and returns a handle to follow them as a group.
+// @Tags         content
+// @Produce      json
+// @Param        body body util.ContentAddIpfsBatchBody true "IPFS Batch Body"
+// @Router       /content/add-ipfs/batch [post]
+func (s *Server) handleAddIpfsBatch(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	if err := util.ErrorIfContentAddingDisabled(s.isContentAddingDisabled(u)); err != nil {
+		return err
+	}
+
+	var params util.ContentAddIpfsBatchBody
+	if err := c.Bind(&params); err != nil {
+		return err
+	}
+
+	if len(params.Pins) == 0 || len(params.Pins) > maxPinBatchSize {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("a batch must have between 1 and %d pins", maxPinBatchSize),
+		}
+	}
+
+	origins, err := parseOrigins(params.Peers)
+	if err != nil {
+		return err
+	}
+
+	pins := make([]batchPin, 0, len(params.Pins))
+	for _, p := range params.Pins {
+		root, err := cid.Decode(p.Root)
+		if err != nil {
+			return &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid root cid %q: %s", p.Root, err),
+			}
+		}
+
+		porigins, err := parseOrigins(p.Peers)
+		if err != nil {
+			return err
+		}
+
+		if err := util.ValidatePinDepth(p.Depth); err != nil {
+			return err
+		}
+
+		filename := p.Name
+		if filename == "" {
+			filename = p.Root
+		}
+
+		pins = append(pins, batchPin{
+			root:     root,
+			filename: filename,
+			origins:  porigins,
+			depth:    p.Depth,
+		})
+	}
+
+	batch, err := s.CM.pinBatch(ctx, u.ID, pins, origins, true)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.CM.pinBatchStatus(batch)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, resp)
+}
+
+// handleGetPinBatch godoc
+// @Summary      Get the status of a batch of pins
+// @Description  This endpoint returns the status of every pin added by a batch request, and of the batch as a whole.
+// @Tags         content
+// @Produce      json
+// @Param        uuid path string true "Batch UUID"
+// @Router       /content/add-ipfs/batch/{uuid} [get]
+func (s *Server) handleGetPinBatch(c echo.Context, u *User) error {
+	var batch PinBatch
+	if err := s.DB.First(&batch, "uuid = ? and user_id = ?", c.Param("uuid"), u.ID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("pin batch %s not found", c.Param("uuid")),
+			}
+		}
+		return err
+	}
+
+	resp, err := s.CM.pinBatchStatus(&batch)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func parseOrigins(addrs []string) ([]*peer.AddrInfo, error) {
+	var origins []*peer.AddrInfo
+	for _, a := range addrs {
+		ai, err := peer.AddrInfoFromString(a)
+		if err != nil {
+			return nil, &util.HttpError{
+				Code:    http.StatusBadRequest,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("invalid origin %q: %s", a, err),
+			}
+		}
+		origins = append(origins, ai)
+	}
+	return origins, nil
+}
@@ -0,0 +1,214 @@
+package pinner
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+)
+
+// PinEstimate is where a queued pin stands in line and when it is expected
+// to start, or how fast a running pin fetches and when it is expected to
+// complete. The times are rough, they assume pins take about as long as the
+// ones before them did.
+type PinEstimate struct {
+	// Position is the place of a queued pin in line, 1 starts next. It is
+	// zero once the pin runs.
+	Position       int        `json:"position,omitempty"`
+	EstimatedStart *time.Time `json:"estimatedStart,omitempty"`
+
+	// set for running pins, the completion time only if the size of the
+	// dag is known
+	BytesPerSecond      float64    `json:"bytesPerSecond,omitempty"`
+	EstimatedCompletion *time.Time `json:"estimatedCompletion,omitempty"`
+}
+
+// AddInfo adds the estimate to the info of a pinning service api pin status,
+// whose values are strings
+func (est *PinEstimate) AddInfo(info map[string]interface{}) {
+	if est == nil {
+		return
+	}
+	if est.Position > 0 {
+		info["queue_position"] = strconv.Itoa(est.Position)
+	}
+	if est.EstimatedStart != nil {
+		info["estimated_start"] = est.EstimatedStart.UTC().Format(time.RFC3339)
+	}
+	if est.BytesPerSecond > 0 {
+		info["bytes_per_second"] = fmt.Sprintf("%.0f", est.BytesPerSecond)
+	}
+	if est.EstimatedCompletion != nil {
+		info["estimated_completion"] = est.EstimatedCompletion.UTC().Format(time.RFC3339)
+	}
+}
+
+// pinTimeWeight is the weight of the latest pin in the moving average of
+// pin times
+const pinTimeWeight = 0.2
+
+// recordPinTime adds how long op took to fetch to the moving average, once
+// it completed
+func (pm *PinManager) recordPinTime(op *PinningOperation) {
+	op.lk.Lock()
+	if op.Status != types.PinningStatusPinned || op.fetchStarted.IsZero() {
+		op.lk.Unlock()
+		return
+	}
+	took := op.EndTime.Sub(op.fetchStarted)
+	op.lk.Unlock()
+
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	if pm.avgPinTime == 0 {
+		pm.avgPinTime = took
+		return
+	}
+	pm.avgPinTime += time.Duration(pinTimeWeight * float64(took-pm.avgPinTime))
+}
+
+// SetExpectedSize records the size of the dag once it is known
+func (po *PinningOperation) SetExpectedSize(size int64) {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	po.ExpectedSize = size
+}
+
+// SetEstimate records the estimate reported for a pin run elsewhere
+func (po *PinningOperation) SetEstimate(est *PinEstimate) {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	po.estimate = est
+}
+
+// ReportedEstimate returns the estimate last reported for a pin run
+// elsewhere, nil if there is none
+func (po *PinningOperation) ReportedEstimate() *PinEstimate {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	return po.estimate
+}
+
+func (po *PinningOperation) queued() bool {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	return po.Status == types.PinningStatusQueued || po.Status == ""
+}
+
+// runningEstimate extrapolates the rate op fetched at so far
+func (po *PinningOperation) runningEstimate(now time.Time) *PinEstimate {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+
+	est := &PinEstimate{}
+	elapsed := now.Sub(po.fetchStarted).Seconds()
+	if po.fetchStarted.IsZero() || elapsed <= 0 || po.SizeFetched == 0 {
+		return est
+	}
+
+	est.BytesPerSecond = float64(po.SizeFetched) / elapsed
+	if po.ExpectedSize > po.SizeFetched {
+		left := float64(po.ExpectedSize-po.SizeFetched) / est.BytesPerSecond
+		done := now.Add(time.Duration(left * float64(time.Second)))
+		est.EstimatedCompletion = &done
+	}
+	return est
+}
+
+// queuedBefore reports whether the queued pin a starts before b. Pins
+// that were not put in the queue yet came in after the ones that were.
+func queuedBefore(a, b *PinningOperation) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if a.seq == 0 || b.seq == 0 {
+		return a.seq != 0
+	}
+	return a.seq < b.seq
+}
+
+// queuedEstimate estimates when the pin with ahead pins before it starts,
+// must be called with pinQueueLk held. Pins start in waves as large as the
+// number of workers, each taking about as long as the average pin.
+func (pm *PinManager) queuedEstimate(ahead, workers int, now time.Time) *PinEstimate {
+	est := &PinEstimate{Position: ahead + 1}
+	if pm.avgPinTime == 0 || workers <= 0 {
+		return est
+	}
+
+	var active int
+	for _, n := range pm.activePins {
+		active += n
+	}
+
+	var wait time.Duration
+	if free := workers - active; ahead >= free {
+		waves := (ahead-free)/workers + 1
+		wait = time.Duration(waves) * pm.avgPinTime
+	}
+	start := now.Add(wait)
+	est.EstimatedStart = &start
+	return est
+}
+
+// Estimate returns the queue position and estimated start of the pin for the
+// given content while it is queued, and its rate and estimated completion
+// once it runs. It returns false if the pin manager has no such pin, or the
+// pin already finished.
+func (pm *PinManager) Estimate(contID uint, now time.Time) (*PinEstimate, bool) {
+	workers := pm.Workers()
+
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	op, ok := pm.ops[contID]
+	if !ok {
+		return nil, false
+	}
+
+	status, _, _ := op.Progress()
+	if status == types.PinningStatusPinning {
+		return op.runningEstimate(now), true
+	}
+	if !op.queued() {
+		return nil, false
+	}
+
+	var ahead int
+	for _, other := range pm.ops {
+		if other != op && other.queued() && queuedBefore(other, op) {
+			ahead++
+		}
+	}
+	return pm.queuedEstimate(ahead, workers, now), true
+}
+
+// QueuedEstimates returns the estimates of the first max queued pins, keyed
+// by content
+func (pm *PinManager) QueuedEstimates(now time.Time, max int) map[uint]*PinEstimate {
+	workers := pm.Workers()
+
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	var queued []*PinningOperation
+	for _, op := range pm.ops {
+		if op.queued() {
+			queued = append(queued, op)
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		return queuedBefore(queued[i], queued[j])
+	})
+	if len(queued) > max {
+		queued = queued[:max]
+	}
+
+	out := make(map[uint]*PinEstimate, len(queued))
+	for i, op := range queued {
+		out[op.ContId] = pm.queuedEstimate(i, workers, now)
+	}
+	return out
+}
@@ -0,0 +1,99 @@
+package pinner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueuedEstimate(t *testing.T) {
+	pm := NewPinManager(nil, nil, &PinManagerOpts{MaxActivePerUser: 10})
+	pm.workers = 2
+	pm.avgPinTime = time.Minute
+
+	for i := uint(1); i <= 5; i++ {
+		op := &PinningOperation{ContId: i, UserId: 1, Status: types.PinningStatusQueued}
+		if i == 3 {
+			op.Priority = PriorityHigh
+		}
+		pm.ops[i] = op
+		pm.enqueuePinOp(op)
+	}
+
+	now := time.Now()
+	est, ok := pm.Estimate(3, now)
+	require.True(t, ok)
+	assert.Equal(t, 1, est.Position, "more important pins go first")
+	require.NotNil(t, est.EstimatedStart)
+	assert.Equal(t, now, *est.EstimatedStart, "pins start right away while workers are free")
+
+	est, ok = pm.Estimate(5, now)
+	require.True(t, ok)
+	assert.Equal(t, 5, est.Position)
+	assert.Equal(t, now.Add(2*time.Minute), *est.EstimatedStart)
+
+	pm.activePins[1] = 2
+	est, _ = pm.Estimate(3, now)
+	assert.Equal(t, now.Add(time.Minute), *est.EstimatedStart, "pins wait for a worker to free up")
+
+	queued := pm.QueuedEstimates(now, 2)
+	require.Len(t, queued, 2)
+	assert.Equal(t, 1, queued[3].Position)
+	assert.Equal(t, 2, queued[1].Position)
+
+	_, ok = pm.Estimate(42, now)
+	assert.False(t, ok)
+}
+
+func TestRunningEstimate(t *testing.T) {
+	now := time.Now()
+	op := &PinningOperation{
+		Status:       types.PinningStatusPinning,
+		SizeFetched:  100,
+		ExpectedSize: 300,
+		fetchStarted: now.Add(-10 * time.Second),
+	}
+
+	est := op.runningEstimate(now)
+	assert.Equal(t, 0, est.Position)
+	assert.InDelta(t, 10, est.BytesPerSecond, 0.001)
+	require.NotNil(t, est.EstimatedCompletion)
+	assert.WithinDuration(t, now.Add(20*time.Second), *est.EstimatedCompletion, time.Millisecond)
+
+	op.ExpectedSize = 0
+	assert.Nil(t, op.runningEstimate(now).EstimatedCompletion, "pins of unknown size get no completion time")
+
+	info := make(map[string]interface{})
+	est.AddInfo(info)
+	assert.Equal(t, "10", info["bytes_per_second"])
+	assert.Contains(t, info, "estimated_completion")
+	assert.NotContains(t, info, "queue_position")
+}
+
+func TestRecordPinTime(t *testing.T) {
+	pm := NewPinManager(nil, nil, nil)
+	start := time.Now()
+
+	pin := func(took time.Duration) *PinningOperation {
+		return &PinningOperation{
+			Status:       types.PinningStatusPinned,
+			fetchStarted: start,
+			EndTime:      start.Add(took),
+		}
+	}
+
+	pm.recordPinTime(pin(time.Minute))
+	assert.Equal(t, time.Minute, pm.avgPinTime)
+
+	pm.recordPinTime(pin(2 * time.Minute))
+	avg := pm.avgPinTime
+	assert.InDelta(t, float64(72*time.Second), float64(avg), float64(time.Millisecond))
+
+	failed := pin(time.Hour)
+	failed.Status = types.PinningStatusFailed
+	pm.recordPinTime(failed)
+	assert.Equal(t, avg, pm.avgPinTime, "only completed pins count")
+}
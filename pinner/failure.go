@@ -0,0 +1,55 @@
+package pinner
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"github.com/application-research/estuary/pinner/types"
+	blocks "github.com/ipfs/go-block-format"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+)
+
+type failureError struct {
+	reason types.PinFailureReason
+	err    error
+}
+
+func (fe *failureError) Error() string {
+	return fe.err.Error()
+}
+
+func (fe *failureError) Unwrap() error {
+	return fe.err
+}
+
+// WithFailureReason marks err as a pin failure of the given reason, for
+// failures ClassifyFailure can not tell apart from the error alone
+func WithFailureReason(reason types.PinFailureReason, err error) error {
+	return &failureError{reason: reason, err: err}
+}
+
+// ClassifyFailure returns why a pin failed with err. fetched is whether any
+// block of the pin arrived, a pin that ran out of time without a single
+// block found nobody to fetch it from.
+func ClassifyFailure(err error, fetched bool) types.PinFailureReason {
+	var fe *failureError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &fe):
+		return fe.reason
+	case errors.Is(err, syscall.ENOSPC):
+		return types.PinFailureBlockstoreFull
+	case errors.Is(err, blocks.ErrWrongHash), errors.Is(err, merkledag.ErrNotProtobuf):
+		return types.PinFailureBadDAG
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ipld.ErrNotFound):
+		if !fetched {
+			return types.PinFailureNoProviders
+		}
+		return types.PinFailureTimeout
+	default:
+		return types.PinFailureUnknown
+	}
+}
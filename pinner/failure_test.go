@@ -0,0 +1,35 @@
+package pinner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/application-research/estuary/pinner/types"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	full := &os.PathError{Op: "write", Path: "/blocks/x", Err: syscall.ENOSPC}
+
+	for _, tc := range []struct {
+		err     error
+		fetched bool
+		reason  types.PinFailureReason
+	}{
+		{nil, false, ""},
+		{errors.Wrap(context.DeadlineExceeded, "failed to fetch"), false, types.PinFailureNoProviders},
+		{xerrors.Errorf("walking dag: %w", context.DeadlineExceeded), true, types.PinFailureTimeout},
+		{fmt.Errorf("put block: %w", full), true, types.PinFailureBlockstoreFull},
+		{errors.Wrap(blocks.ErrWrongHash, "get block"), true, types.PinFailureBadDAG},
+		{WithFailureReason(types.PinFailureTooLarge, fmt.Errorf("too big")), false, types.PinFailureTooLarge},
+		{fmt.Errorf("something else"), true, types.PinFailureUnknown},
+	} {
+		assert.Equal(t, tc.reason, ClassifyFailure(tc.err, tc.fetched), "%v", tc.err)
+	}
+}
@@ -32,11 +32,15 @@ func NewPinManager(pinfunc PinFunc, scf PinStatusFunc, opts *PinManagerOpts) *Pi
 	}
 
 	return &PinManager{
-		pinQueue:         make(map[uint][]*PinningOperation),
+		pinQueue:         make(map[uint]*pinQueue),
+		ops:              make(map[uint]*PinningOperation),
 		activePins:       make(map[uint]int),
 		pinQueueIn:       make(chan *PinningOperation, 64),
 		pinQueueOut:      make(chan *PinningOperation),
 		pinComplete:      make(chan *PinningOperation, 64),
+		stopWorker:       make(chan struct{}),
+		drain:            make(chan struct{}),
+		drained:          make(chan struct{}),
 		RunPinFunc:       pinfunc,
 		StatusChangeFunc: scf,
 		maxActivePerUser: opts.MaxActivePerUser,
@@ -55,12 +59,26 @@ type PinManager struct {
 	pinQueueIn       chan *PinningOperation
 	pinQueueOut      chan *PinningOperation
 	pinComplete      chan *PinningOperation
-	pinQueue         map[uint][]*PinningOperation
+	pinQueue         map[uint]*pinQueue
 	activePins       map[uint]int
+	ops              map[uint]*PinningOperation
+	nextSeq          uint64
 	pinQueueLk       sync.Mutex
 	RunPinFunc       PinFunc
 	StatusChangeFunc PinStatusFunc
 	maxActivePerUser int
+
+	// moving average of how long completed pins took to fetch, guarded by
+	// pinQueueLk
+	avgPinTime time.Duration
+
+	workersLk  sync.Mutex
+	workers    int
+	stopWorker chan struct{}
+
+	drain     chan struct{}
+	drained   chan struct{}
+	drainOnce sync.Once
 }
 
 // TODO: some of these fields are overkill for the generalized pin manager
@@ -86,10 +104,38 @@ type PinningOperation struct {
 	FetchErr    error
 	EndTime     time.Time
 
+	// FailureReason is why the pin failed, set along with FetchErr
+	FailureReason types.PinFailureReason
+
+	// ExpectedSize is the size of the dag when it is known before fetching
+	// it, running pins of a known size get an estimated completion time
+	ExpectedSize int64
+
+	// when the pin started fetching, Started is when it was requested
+	fetchStarted time.Time
+
+	// estimate is the queue position and times reported for a pin run
+	// elsewhere, on a shuttle
+	estimate *PinEstimate
+
 	Location string
 
 	SkipLimiter bool
 
+	// Priority decides the order queued pins are started in
+	Priority PinPriority
+
+	// MaxDepth limits the pin to that many levels of the dag, 1 pins only
+	// the root block. Zero pins the whole dag.
+	MaxDepth int
+
+	// position in the queue, set while the operation is queued
+	seq   uint64
+	index int
+
+	cancel    context.CancelFunc
+	cancelled bool
+
 	lk sync.Mutex
 
 	MakeDeal bool
@@ -98,6 +144,7 @@ type PinningOperation struct {
 func (po *PinningOperation) fail(err error) {
 	po.lk.Lock()
 	po.FetchErr = err
+	po.FailureReason = ClassifyFailure(err, po.NumFetched > 0)
 	po.EndTime = time.Now()
 	po.Status = types.PinningStatusFailed
 	po.LastUpdate = time.Now()
@@ -113,6 +160,13 @@ func (po *PinningOperation) complete() {
 	po.Status = types.PinningStatusPinned
 }
 
+// Cancelled reports whether the pin was cancelled
+func (po *PinningOperation) Cancelled() bool {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	return po.cancelled
+}
+
 func (po *PinningOperation) SetStatus(st types.PinningStatus) {
 	po.lk.Lock()
 	defer po.lk.Unlock()
@@ -121,6 +175,37 @@ func (po *PinningOperation) SetStatus(st types.PinningStatus) {
 	po.LastUpdate = time.Now()
 }
 
+// Progress returns the status of the pin and how many blocks, and bytes,
+// it fetched so far
+func (po *PinningOperation) Progress() (types.PinningStatus, int, int64) {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	return po.Status, po.NumFetched, po.SizeFetched
+}
+
+// Failure returns why the pin failed, empty unless it did
+func (po *PinningOperation) Failure() types.PinFailureReason {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	return po.FailureReason
+}
+
+// SetFailure records why a pin run elsewhere, on a shuttle, failed
+func (po *PinningOperation) SetFailure(reason types.PinFailureReason) {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	po.FailureReason = reason
+}
+
+// SetProgress records how far a pin made elsewhere, on a shuttle, got
+func (po *PinningOperation) SetProgress(blocks int, size int64) {
+	po.lk.Lock()
+	defer po.lk.Unlock()
+	po.NumFetched = blocks
+	po.SizeFetched = size
+	po.LastUpdate = time.Now()
+}
+
 func (po *PinningOperation) PinStatus() *types.IpfsPinStatusResponse {
 	po.lk.Lock()
 	defer po.lk.Unlock()
@@ -142,6 +227,11 @@ func (po *PinningOperation) PinStatus() *types.IpfsPinStatusResponse {
 		}
 	}
 
+	info := make(map[string]interface{}, 0)
+	if po.Status == types.PinningStatusFailed && po.FailureReason != "" {
+		info["failure_reason"] = string(po.FailureReason)
+	}
+
 	return &types.IpfsPinStatusResponse{
 		RequestID: fmt.Sprint(po.ContId),
 		Status:    po.Status,
@@ -152,7 +242,7 @@ func (po *PinningOperation) PinStatus() *types.IpfsPinStatusResponse {
 			Origins: originStrs,
 			Meta:    meta,
 		},
-		Info: make(map[string]interface{}, 0),
+		Info: info,
 		/* Ref: https://github.com/ipfs/go-pinning-service-http-client/issues/12
 		Info: map[string]interface{}{
 			"obj_fetched":  po.NumFetched,
@@ -167,24 +257,240 @@ func (pm *PinManager) PinQueueSize() int {
 	pm.pinQueueLk.Lock()
 	defer pm.pinQueueLk.Unlock()
 	for _, pq := range pm.pinQueue {
-		count += len(pq)
+		count += pq.Len()
+	}
+	return count
+}
+
+// FetchedBytes returns how much the running pins of a user have fetched so
+// far
+func (pm *PinManager) FetchedBytes(user uint) int64 {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	var size int64
+	for _, op := range pm.ops {
+		if op.UserId != user {
+			continue
+		}
+		op.lk.Lock()
+		if op.Status == types.PinningStatusPinning {
+			size += op.SizeFetched
+		}
+		op.lk.Unlock()
+	}
+	return size
+}
+
+// PinProgress is how far a running pin got
+type PinProgress struct {
+	ContID      uint
+	NumFetched  int
+	SizeFetched int64
+	Estimate    *PinEstimate
+}
+
+// RunningProgress returns the progress of the pins being fetched
+func (pm *PinManager) RunningProgress() []PinProgress {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	now := time.Now()
+	var out []PinProgress
+	for _, op := range pm.ops {
+		status, blocks, size := op.Progress()
+		if status == types.PinningStatusPinning {
+			out = append(out, PinProgress{
+				ContID:      op.ContId,
+				NumFetched:  blocks,
+				SizeFetched: size,
+				Estimate:    op.runningEstimate(now),
+			})
+		}
+	}
+	return out
+}
+
+// Boost raises the priority of the queued pin for the given content. It
+// returns false if no such pin is waiting to be started.
+func (pm *PinManager) Boost(contID uint, prio PinPriority) bool {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	for _, pq := range pm.pinQueue {
+		for _, op := range *pq {
+			if op.ContId != contID {
+				continue
+			}
+
+			if prio > op.Priority {
+				op.Priority = prio
+				pq.fix(op)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// ActivePinCount returns the number of pins currently being fetched
+func (pm *PinManager) ActivePinCount() int {
+	var count int
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+	for _, n := range pm.activePins {
+		count += n
 	}
 	return count
 }
 
+// Drain stops the pin manager from starting any more pins and waits for the
+// ones currently running to finish, or until ctx is done. Pins that have not
+// started yet stay queued.
+func (pm *PinManager) Drain(ctx context.Context) error {
+	pm.drainOnce.Do(func() {
+		close(pm.drain)
+	})
+
+	select {
+	case <-pm.drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		n := pm.ActivePinCount()
+		if n == 0 {
+			return nil
+		}
+		log.Infof("waiting for %d active pins to finish", n)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Cancel aborts the pin for the given content. A queued pin is dropped from
+// the queue, a running one has its context cancelled. Either way the pin is
+// reported with the cancelled status rather than as failed. It returns false
+// if the pin manager has no pin for the content.
+func (pm *PinManager) Cancel(contID uint) bool {
+	pm.pinQueueLk.Lock()
+	op, ok := pm.ops[contID]
+	if !ok {
+		pm.pinQueueLk.Unlock()
+		return false
+	}
+	delete(pm.ops, contID)
+	queued := pm.removeQueued(op)
+	pm.pinQueueLk.Unlock()
+
+	op.lk.Lock()
+	op.cancelled = true
+	cancel := op.cancel
+	op.lk.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+
+	// pins that are running, or about to, report the cancellation once
+	// they stopped
+	if queued {
+		pm.reportCancelled(op)
+	}
+	return true
+}
+
+func (pm *PinManager) reportCancelled(op *PinningOperation) {
+	op.SetStatus(types.PinningStatusCancelled)
+	if err := pm.StatusChangeFunc(op.ContId, op.Location, types.PinningStatusCancelled); err != nil {
+		log.Errorf("failed to report cancelled pin %d: %s", op.ContId, err)
+	}
+}
+
+// removeQueued takes op out of the queue if it is waiting in it, must be
+// called with pinQueueLk held
+func (pm *PinManager) removeQueued(op *PinningOperation) bool {
+	u := op.UserId
+	if op.SkipLimiter {
+		u = 0
+	}
+
+	pq, ok := pm.pinQueue[u]
+	if !ok || op.index < 0 || op.index >= pq.Len() || (*pq)[op.index] != op {
+		return false
+	}
+
+	pq.remove(op)
+	if pq.Len() == 0 {
+		delete(pm.pinQueue, u)
+	}
+	return true
+}
+
+// forget drops op from the pins that can be cancelled once it finished
+func (pm *PinManager) forget(op *PinningOperation) {
+	pm.pinQueueLk.Lock()
+	defer pm.pinQueueLk.Unlock()
+
+	if pm.ops[op.ContId] == op {
+		delete(pm.ops, op.ContId)
+	}
+}
+
 func (pm *PinManager) Add(op *PinningOperation) {
+	pm.pinQueueLk.Lock()
+	pm.ops[op.ContId] = op
+	pm.pinQueueLk.Unlock()
+
 	go func() {
 		pm.pinQueueIn <- op
 	}()
 }
 
+// AddAll queues ops in the given order, pins of the same priority and user
+// are started in that order
+func (pm *PinManager) AddAll(ops []*PinningOperation) {
+	pm.pinQueueLk.Lock()
+	for _, op := range ops {
+		pm.ops[op.ContId] = op
+	}
+	pm.pinQueueLk.Unlock()
+
+	go func() {
+		for _, op := range ops {
+			pm.pinQueueIn <- op
+		}
+	}()
+}
+
 var maxTimeout = 24 * time.Hour
 
 func (pm *PinManager) doPinning(op *PinningOperation) error {
 	ctx, cancel := context.WithTimeout(context.Background(), maxTimeout)
 	defer cancel()
 
-	op.SetStatus(types.PinningStatusPinning)
+	op.lk.Lock()
+	if op.cancelled {
+		op.lk.Unlock()
+		pm.reportCancelled(op)
+		return nil
+	}
+	op.cancel = cancel
+	op.lk.Unlock()
+
+	op.lk.Lock()
+	op.Status = types.PinningStatusPinning
+	op.LastUpdate = time.Now()
+	op.fetchStarted = op.LastUpdate
+	op.lk.Unlock()
+
 	if err := pm.StatusChangeFunc(op.ContId, op.Location, types.PinningStatusPinning); err != nil {
 		return err
 	}
@@ -195,6 +501,11 @@ func (pm *PinManager) doPinning(op *PinningOperation) error {
 		op.NumFetched++
 		op.SizeFetched += size
 	}); err != nil {
+		if op.Cancelled() {
+			pm.reportCancelled(op)
+			return nil
+		}
+
 		op.fail(err)
 		if err2 := pm.StatusChangeFunc(op.ContId, op.Location, types.PinningStatusFailed); err2 != nil {
 			return err2
@@ -205,62 +516,110 @@ func (pm *PinManager) doPinning(op *PinningOperation) error {
 	return pm.StatusChangeFunc(op.ContId, op.Location, types.PinningStatusPinned)
 }
 
+// popNextPinOp picks the pin to start next out of the users that are below
+// their limit of active pins. The most important pin wins, among equally
+// important ones pins that skip the limiter go first, then those of users
+// with the fewest active pins.
 func (pm *PinManager) popNextPinOp() *PinningOperation {
-	if len(pm.pinQueue) == 0 {
-		return nil
-	}
-
-	var minCount int = 10000
 	var user uint
-	for u := range pm.pinQueue {
+	var next *PinningOperation
+	for u, pq := range pm.pinQueue {
 		active := pm.activePins[u]
-		if active < minCount {
-			minCount = active
-			user = u
+		if u != 0 && active >= pm.maxActivePerUser {
+			continue
 		}
-	}
 
-	_, ok := pm.pinQueue[0]
-	if ok {
-		user = 0
+		head := pq.peek()
+		if next == nil || pm.startsBefore(head, u, next, user) {
+			user = u
+			next = head
+		}
 	}
 
-	if minCount >= pm.maxActivePerUser && user != 0 {
+	if next == nil {
 		return nil
 	}
 
 	pq := pm.pinQueue[user]
-
-	next := pq[0]
-
-	if len(pq) == 1 {
+	pq.pop()
+	if pq.Len() == 0 {
 		delete(pm.pinQueue, user)
-	} else {
-		pm.pinQueue[user] = pq[1:]
 	}
 
 	return next
 }
 
+func (pm *PinManager) startsBefore(a *PinningOperation, userA uint, b *PinningOperation, userB uint) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if (userA == 0) != (userB == 0) {
+		return userA == 0
+	}
+	if pm.activePins[userA] != pm.activePins[userB] {
+		return pm.activePins[userA] < pm.activePins[userB]
+	}
+	return pinsBefore(a, b)
+}
+
 func (pm *PinManager) enqueuePinOp(po *PinningOperation) {
 	u := po.UserId
 	if po.SkipLimiter {
 		u = 0
 	}
 
-	q := pm.pinQueue[u]
-	pm.pinQueue[u] = append(q, po)
+	// ops put back after being popped keep their place in line
+	if po.seq == 0 {
+		pm.nextSeq++
+		po.seq = pm.nextSeq
+	}
+
+	q, ok := pm.pinQueue[u]
+	if !ok {
+		q = &pinQueue{}
+		pm.pinQueue[u] = q
+	}
+	q.push(po)
 }
 
-func (pm *PinManager) Run(workers int) {
-	for i := 0; i < workers; i++ {
+// SetWorkers changes the number of pins fetched at once. Surplus workers
+// stop once they finish their current pin.
+func (pm *PinManager) SetWorkers(n int) {
+	pm.workersLk.Lock()
+	defer pm.workersLk.Unlock()
+
+	for ; pm.workers < n; pm.workers++ {
 		go pm.pinWorker()
 	}
 
+	if pm.workers > n {
+		stop := pm.workers - n
+		pm.workers = n
+		go func() {
+			for i := 0; i < stop; i++ {
+				pm.stopWorker <- struct{}{}
+			}
+		}()
+	}
+}
+
+// Workers returns the number of pins fetched at once
+func (pm *PinManager) Workers() int {
+	pm.workersLk.Lock()
+	defer pm.workersLk.Unlock()
+	return pm.workers
+}
+
+func (pm *PinManager) Run(workers int) {
+	pm.SetWorkers(workers)
+
 	var next *PinningOperation
 
 	var send chan *PinningOperation
 
+	drain := pm.drain
+	var draining bool
+
 	next = pm.popNextPinOp()
 	if next != nil {
 		send = pm.pinQueueOut
@@ -268,10 +627,45 @@ func (pm *PinManager) Run(workers int) {
 
 	for {
 		select {
+		case <-drain:
+			draining = true
+			drain = nil
+			send = nil
+
+			pm.pinQueueLk.Lock()
+			if next != nil {
+				pm.enqueuePinOp(next)
+				next = nil
+			}
+			pm.pinQueueLk.Unlock()
+			close(pm.drained)
 		case op := <-pm.pinQueueIn:
-			if next == nil {
-				next = op
-				send = pm.pinQueueOut
+			if draining {
+				pm.pinQueueLk.Lock()
+				pm.enqueuePinOp(op)
+				pm.pinQueueLk.Unlock()
+			} else if next == nil {
+				// go through the queue so the op doesnt skip ahead of
+				// queued ones or past its users limit
+				pm.pinQueueLk.Lock()
+				pm.enqueuePinOp(op)
+				next = pm.popNextPinOp()
+				pm.pinQueueLk.Unlock()
+				if next != nil {
+					send = pm.pinQueueOut
+				}
+			} else if op.Priority > next.Priority {
+				// dont make a more important pin wait behind the one
+				// ready to go, but pick it through the queue so it
+				// still counts against its users limit
+				pm.pinQueueLk.Lock()
+				pm.enqueuePinOp(next)
+				pm.enqueuePinOp(op)
+				next = pm.popNextPinOp()
+				pm.pinQueueLk.Unlock()
+				if next == nil {
+					send = nil
+				}
 			} else {
 				pm.pinQueueLk.Lock()
 				pm.enqueuePinOp(op)
@@ -290,7 +684,7 @@ func (pm *PinManager) Run(workers int) {
 			pm.pinQueueLk.Lock()
 			pm.activePins[op.UserId]--
 
-			if next == nil {
+			if next == nil && !draining {
 				next = pm.popNextPinOp()
 				if next != nil {
 					send = pm.pinQueueOut
@@ -303,10 +697,17 @@ func (pm *PinManager) Run(workers int) {
 }
 
 func (pm *PinManager) pinWorker() {
-	for op := range pm.pinQueueOut {
-		if err := pm.doPinning(op); err != nil {
-			log.Errorf("pinning queue error: %+v", err)
+	for {
+		select {
+		case <-pm.stopWorker:
+			return
+		case op := <-pm.pinQueueOut:
+			if err := pm.doPinning(op); err != nil {
+				log.Errorf("pinning queue error: %+v", err)
+			}
+			pm.recordPinTime(op)
+			pm.forget(op)
+			pm.pinComplete <- op
 		}
-		pm.pinComplete <- op
 	}
 }
@@ -0,0 +1,264 @@
+package pinner
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainLeavesQueuedPins(t *testing.T) {
+	started := make(chan uint, 10)
+	release := make(chan struct{})
+
+	pm := NewPinManager(func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		started <- op.ContId
+		<-release
+		return nil
+	}, nil, &PinManagerOpts{MaxActivePerUser: 1})
+	go pm.Run(1)
+
+	pm.Add(&PinningOperation{ContId: 1, UserId: 1})
+	select {
+	case <-started:
+	case <-time.After(time.Second * 5):
+		t.Fatal("first pin never started")
+	}
+
+	pm.Add(&PinningOperation{ContId: 2, UserId: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	assert.Error(t, pm.Drain(ctx), "drain should time out while a pin is active")
+
+	close(release)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, pm.Drain(ctx))
+
+	assert.Eventually(t, func() bool {
+		return pm.PinQueueSize() == 1
+	}, time.Second, time.Millisecond*10)
+	assert.Len(t, started, 0, "no new pins may start after draining")
+}
+
+func TestPinQueuePriority(t *testing.T) {
+	pm := NewPinManager(nil, nil, &PinManagerOpts{MaxActivePerUser: 10})
+
+	pm.enqueuePinOp(&PinningOperation{ContId: 1, UserId: 1, Priority: PriorityBackfill})
+	pm.enqueuePinOp(&PinningOperation{ContId: 2, UserId: 1})
+	pm.enqueuePinOp(&PinningOperation{ContId: 3, UserId: 2})
+	pm.enqueuePinOp(&PinningOperation{ContId: 4, UserId: 1, Priority: PriorityHigh})
+	pm.enqueuePinOp(&PinningOperation{ContId: 5, UserId: 2, Priority: PriorityBackfill})
+
+	assert.True(t, pm.Boost(5, PriorityUrgent))
+	assert.False(t, pm.Boost(42, PriorityUrgent))
+
+	var order []uint
+	for op := pm.popNextPinOp(); op != nil; op = pm.popNextPinOp() {
+		order = append(order, op.ContId)
+	}
+	assert.Equal(t, []uint{5, 4, 2, 3, 1}, order)
+}
+
+func TestPinQueueUserLimit(t *testing.T) {
+	pm := NewPinManager(nil, nil, &PinManagerOpts{MaxActivePerUser: 1})
+	pm.activePins[1] = 1
+
+	pm.enqueuePinOp(&PinningOperation{ContId: 1, UserId: 1, Priority: PriorityUrgent})
+	pm.enqueuePinOp(&PinningOperation{ContId: 2, UserId: 2})
+
+	op := pm.popNextPinOp()
+	require.NotNil(t, op)
+	assert.Equal(t, uint(2), op.ContId, "users at their limit have to wait regardless of priority")
+	assert.Nil(t, pm.popNextPinOp())
+}
+
+func TestUrgentPinKeepsUserLimit(t *testing.T) {
+	started := make(chan uint, 10)
+	release := map[uint]chan struct{}{}
+	for i := uint(1); i <= 4; i++ {
+		release[i] = make(chan struct{})
+	}
+
+	pm := NewPinManager(func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		started <- op.ContId
+		<-release[op.ContId]
+		return nil
+	}, nil, &PinManagerOpts{MaxActivePerUser: 1})
+	go pm.Run(2)
+
+	waitStart := func() uint {
+		select {
+		case c := <-started:
+			return c
+		case <-time.After(time.Second * 5):
+			t.Fatal("pin never started")
+			return 0
+		}
+	}
+
+	pm.Add(&PinningOperation{ContId: 1, UserId: 1})
+	require.Equal(t, uint(1), waitStart())
+	pm.Add(&PinningOperation{ContId: 2, UserId: 2})
+	require.Equal(t, uint(2), waitStart())
+
+	// both workers are busy, 3 waits ready to go when the urgent pin of
+	// a user already at their limit comes in
+	pm.Add(&PinningOperation{ContId: 3, UserId: 3})
+	time.Sleep(time.Millisecond * 50)
+	pm.Add(&PinningOperation{ContId: 4, UserId: 1, Priority: PriorityUrgent})
+	time.Sleep(time.Millisecond * 50)
+
+	close(release[2])
+	assert.Equal(t, uint(3), waitStart(), "the urgent pin may not go past its users limit")
+
+	close(release[1])
+	assert.Equal(t, uint(4), waitStart())
+	close(release[3])
+	close(release[4])
+}
+
+func TestSetWorkers(t *testing.T) {
+	var running int32
+	release := make(chan struct{})
+
+	pm := NewPinManager(func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		<-release
+		return nil
+	}, nil, &PinManagerOpts{MaxActivePerUser: 100})
+	go pm.Run(1)
+
+	for i := uint(1); i <= 6; i++ {
+		pm.Add(&PinningOperation{ContId: i, UserId: 1})
+	}
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&running) == 1
+	}, time.Second, time.Millisecond*10)
+
+	pm.SetWorkers(4)
+	assert.Equal(t, 4, pm.Workers())
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&running) == 4
+	}, time.Second, time.Millisecond*10)
+
+	// scaling down lets running pins finish
+	pm.SetWorkers(1)
+	assert.Equal(t, 1, pm.Workers())
+	assert.Equal(t, int32(4), atomic.LoadInt32(&running))
+	close(release)
+	assert.Eventually(t, func() bool {
+		return pm.PinQueueSize() == 0 && atomic.LoadInt32(&running) == 0
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestCancelPin(t *testing.T) {
+	started := make(chan uint, 10)
+	cancelled := make(chan uint, 10)
+
+	pm := NewPinManager(func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		started <- op.ContId
+		<-ctx.Done()
+		return ctx.Err()
+	}, func(contID uint, location string, status types.PinningStatus) error {
+		switch status {
+		case types.PinningStatusCancelled:
+			cancelled <- contID
+		case types.PinningStatusFailed:
+			t.Errorf("pin %d reported as failed", contID)
+		}
+		return nil
+	}, &PinManagerOpts{MaxActivePerUser: 1})
+	go pm.Run(1)
+
+	pm.Add(&PinningOperation{ContId: 1, UserId: 1})
+	select {
+	case <-started:
+	case <-time.After(time.Second * 5):
+		t.Fatal("first pin never started")
+	}
+
+	pm.Add(&PinningOperation{ContId: 2, UserId: 1})
+	require.True(t, pm.Cancel(2))
+	require.True(t, pm.Cancel(1))
+
+	got := make(map[uint]bool)
+	for len(got) < 2 {
+		select {
+		case c := <-cancelled:
+			got[c] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("pins not reported as cancelled, got %v", got)
+		}
+	}
+
+	assert.Len(t, started, 0, "cancelled queued pin must not start")
+	assert.Equal(t, 0, pm.PinQueueSize())
+	assert.False(t, pm.Cancel(1), "cancelled pins are forgotten")
+	assert.False(t, pm.Cancel(42))
+}
+
+func TestAddAllKeepsOrder(t *testing.T) {
+	started := make(chan uint, 100)
+
+	pm := NewPinManager(func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		started <- op.ContId
+		return nil
+	}, nil, &PinManagerOpts{MaxActivePerUser: 1})
+
+	var ops []*PinningOperation
+	for i := uint(1); i <= 50; i++ {
+		ops = append(ops, &PinningOperation{ContId: i, UserId: 1})
+	}
+	pm.AddAll(ops)
+	go pm.Run(1)
+
+	for i := uint(1); i <= 50; i++ {
+		select {
+		case c := <-started:
+			require.Equal(t, i, c)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("pin %d never started", i)
+		}
+	}
+}
+
+func TestFetchedBytes(t *testing.T) {
+	release := make(chan struct{})
+	fetched := make(chan struct{}, 10)
+
+	pm := NewPinManager(func(ctx context.Context, op *PinningOperation, cb PinProgressCB) error {
+		cb(100)
+		cb(50)
+		fetched <- struct{}{}
+		<-release
+		return nil
+	}, nil, &PinManagerOpts{MaxActivePerUser: 1})
+	go pm.Run(2)
+
+	pm.Add(&PinningOperation{ContId: 1, UserId: 1})
+	pm.Add(&PinningOperation{ContId: 2, UserId: 2})
+	<-fetched
+	<-fetched
+
+	assert.Equal(t, int64(150), pm.FetchedBytes(1))
+	assert.Equal(t, int64(0), pm.FetchedBytes(3))
+
+	progress := pm.RunningProgress()
+	require.Len(t, progress, 2)
+	assert.Equal(t, 2, progress[0].NumFetched)
+	assert.Equal(t, int64(150), progress[0].SizeFetched)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		return pm.FetchedBytes(1) == 0
+	}, time.Second*5, time.Millisecond*10)
+	assert.Empty(t, pm.RunningProgress())
+}
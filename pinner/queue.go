@@ -0,0 +1,77 @@
+package pinner
+
+import "container/heap"
+
+// PinPriority orders queued pins, higher priorities are started first. Pins
+// with the same priority are started in the order they were added.
+type PinPriority int
+
+const (
+	// PriorityBackfill is for bulk work such as content moved between nodes
+	// that should not hold up pins users are waiting on
+	PriorityBackfill PinPriority = -1
+	PriorityNormal   PinPriority = 0
+	PriorityHigh     PinPriority = 1
+	// PriorityUrgent is for pins an admin explicitly boosted
+	PriorityUrgent PinPriority = 2
+)
+
+// pinQueue is a heap of pinning operations, ordered by priority and then by
+// the order they were queued in
+type pinQueue []*PinningOperation
+
+func (pq pinQueue) Len() int { return len(pq) }
+
+func (pq pinQueue) Less(i, j int) bool {
+	return pinsBefore(pq[i], pq[j])
+}
+
+func (pq pinQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
+
+func (pq *pinQueue) Push(x interface{}) {
+	op := x.(*PinningOperation)
+	op.index = len(*pq)
+	*pq = append(*pq, op)
+}
+
+func (pq *pinQueue) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	op := old[n-1]
+	old[n-1] = nil
+	op.index = -1
+	*pq = old[:n-1]
+	return op
+}
+
+func (pq pinQueue) peek() *PinningOperation {
+	return pq[0]
+}
+
+// pinsBefore reports whether a should be started before b
+func pinsBefore(a, b *PinningOperation) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.seq < b.seq
+}
+
+func (pq *pinQueue) push(op *PinningOperation) {
+	heap.Push(pq, op)
+}
+
+func (pq *pinQueue) pop() *PinningOperation {
+	return heap.Pop(pq).(*PinningOperation)
+}
+
+func (pq *pinQueue) fix(op *PinningOperation) {
+	heap.Fix(pq, op.index)
+}
+
+func (pq *pinQueue) remove(op *PinningOperation) {
+	heap.Remove(pq, op.index)
+}
@@ -15,6 +15,29 @@ const (
 	PinningStatusPinned  PinningStatus = "pinned"
 	PinningStatusFailed  PinningStatus = "failed"
 	PinningStatusQueued  PinningStatus = "queued"
+
+	// PinningStatusCancelled is not part of the pinning service API, it is
+	// used between estuary nodes for pins an admin aborted
+	PinningStatusCancelled PinningStatus = "cancelled"
+)
+
+// PinFailureReason categorizes why a pin failed
+type PinFailureReason string
+
+const (
+	// PinFailureNoProviders is for pins that did not get a single block,
+	// no peer could be found to fetch them from
+	PinFailureNoProviders PinFailureReason = "no_providers"
+	// PinFailureTimeout is for pins that stopped making progress before
+	// they completed
+	PinFailureTimeout        PinFailureReason = "timeout"
+	PinFailureBlockstoreFull PinFailureReason = "blockstore_full"
+	// PinFailureBadDAG is for dags with blocks that do not match their cid
+	// or can not be decoded
+	PinFailureBadDAG PinFailureReason = "bad_dag"
+	// PinFailureTooLarge is for pins larger than a node takes
+	PinFailureTooLarge PinFailureReason = "too_large"
+	PinFailureUnknown  PinFailureReason = "unknown"
 )
 
 type IpfsPin struct {
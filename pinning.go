@@ -78,12 +78,16 @@ func (cm *ContentManager) pinStatus(cont util.Content, origins []*peer.AddrInfo)
 
 		if cont.Failed {
 			ps.Status = types.PinningStatusFailed
+			if cont.FailureReason != "" {
+				ps.Info["failure_reason"] = cont.FailureReason
+			}
 		}
 		return ps, nil
 	}
 
 	status := po.PinStatus()
 	status.Delegates = delegates
+	cm.pinEstimate(cont, po).AddInfo(status.Info)
 	return status, nil
 }
 
@@ -138,7 +142,7 @@ func (s *Server) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 	dserv := merkledag.NewDAGService(bserv)
 	dsess := dserv.Session(ctx)
 
-	if err := s.CM.addDatabaseTrackingToContent(ctx, op.ContId, dsess, op.Obj, cb); err != nil {
+	if err := s.CM.addDatabaseTrackingToContent(ctx, op.ContId, dsess, op.Obj, op.MaxDepth, cb); err != nil {
 		return err
 	}
 
@@ -146,20 +150,24 @@ func (s *Server) doPinning(ctx context.Context, op *pinner.PinningOperation, cb
 		s.CM.ToCheck <- op.ContId
 	}
 
+	if !s.Node.ProvidesContent() {
+		return nil
+	}
+
 	// this provide call goes out immediately
 	if err := s.Node.FullRT.Provide(ctx, op.Obj, true); err != nil {
 		log.Warnf("provider broadcast failed: %s", err)
 	}
 
 	// this one adds to a queue
-	if err := s.Node.Provider.Provide(op.Obj); err != nil {
+	if err := s.Node.ProvideRoot(op.Obj); err != nil {
 		log.Warnf("providing failed: %s", err)
 	}
 	return nil
 }
 
 func (s *Server) PinStatusFunc(contID uint, location string, status types.PinningStatus) error {
-	return s.CM.UpdatePinStatus(location, contID, status)
+	return s.CM.UpdatePinStatus(location, contID, status, "")
 }
 
 func (cm *ContentManager) refreshPinQueue(ctx context.Context, contentLoc string) error {
@@ -196,7 +204,12 @@ func (cm *ContentManager) refreshPinQueue(ctx context.Context, contentLoc string
 	return nil
 }
 
-func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid, filename string, cols []*CollectionRef, origins []*peer.AddrInfo, replaceID uint, meta map[string]interface{}, makeDeal bool) (*types.IpfsPinStatusResponse, error) {
+func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid, filename string, cols []*CollectionRef, origins []*peer.AddrInfo, replaceID uint, meta map[string]interface{}, depth int, makeDeal bool) (*types.IpfsPinStatusResponse, error) {
+	if depth > 0 {
+		// a partial dag cannot be put in a deal
+		makeDeal = false
+	}
+
 	loc, err := cm.selectLocationForContent(ctx, obj, user)
 	if err != nil {
 		return nil, xerrors.Errorf("selecting location for content failed: %w", err)
@@ -237,6 +250,7 @@ func (cm *ContentManager) pinContent(ctx context.Context, user uint, obj cid.Cid
 		PinMeta:     metaStr,
 		Location:    loc,
 		Origins:     originsStr,
+		MaxDepth:    depth,
 	}
 	if err := cm.DB.Create(&cont).Error; err != nil {
 		return nil, err
@@ -282,6 +296,7 @@ func (cm *ContentManager) addPinToQueue(cont util.Content, peers []*peer.AddrInf
 		Location: cont.Location,
 		MakeDeal: makeDeal,
 		Meta:     cont.PinMeta,
+		MaxDepth: cont.MaxDepth,
 	}
 
 	cm.pinLk.Lock()
@@ -303,16 +318,24 @@ func (cm *ContentManager) pinContentOnShuttle(ctx context.Context, cont util.Con
 		Op: drpc.CMD_AddPin,
 		Params: drpc.CmdParams{
 			AddPin: &drpc.AddPin{
-				DBID:   cont.ID,
-				UserId: cont.UserID,
-				Cid:    cont.Cid.CID,
-				Peers:  peers,
+				DBID:     cont.ID,
+				UserId:   cont.UserID,
+				Cid:      cont.Cid.CID,
+				Peers:    peers,
+				MaxDepth: cont.MaxDepth,
 			},
 		},
 	}); err != nil {
 		return err
 	}
 
+	cm.trackShuttlePin(cont, peers, replaceID, handle, makeDeal)
+	return nil
+}
+
+// trackShuttlePin keeps track of a pin sent to a shuttle so its status can be
+// reported until the shuttle completes it
+func (cm *ContentManager) trackShuttlePin(cont util.Content, peers []*peer.AddrInfo, replaceID uint, handle string, makeDeal bool) {
 	op := &pinner.PinningOperation{
 		ContId:   cont.ID,
 		UserId:   cont.UserID,
@@ -325,14 +348,13 @@ func (cm *ContentManager) pinContentOnShuttle(ctx context.Context, cont util.Con
 		Location: handle,
 		MakeDeal: makeDeal,
 		Meta:     cont.PinMeta,
+		MaxDepth: cont.MaxDepth,
 	}
 
 	cm.pinLk.Lock()
 	// TODO: check if we are overwriting anything here
 	cm.pinJobs[cont.ID] = op
 	cm.pinLk.Unlock()
-
-	return nil
 }
 
 func (cm *ContentManager) selectLocationForContent(ctx context.Context, obj cid.Cid, uid uint) (string, error) {
@@ -346,11 +368,17 @@ func (cm *ContentManager) selectLocationForContent(ctx context.Context, obj cid.
 
 	allShuttlesLowSpace := true
 	lowSpace := make(map[string]bool)
+	overloaded := make(map[string]bool)
 	var activeShuttles []string
 	cm.shuttlesLk.Lock()
 	for d, sh := range cm.shuttles {
+		if sh.shuttingDown || sh.addingPaused || sh.draining {
+			continue
+		}
+
 		if !sh.private {
 			lowSpace[d] = sh.spaceLow
+			overloaded[d] = sh.overloaded
 			activeShuttles = append(activeShuttles, d)
 		} else {
 			allShuttlesLowSpace = false
@@ -363,16 +391,17 @@ func (cm *ContentManager) selectLocationForContent(ctx context.Context, obj cid.
 		return "", err
 	}
 
-	// prefer shuttles that are not low on blockstore space
+	// prefer shuttles that are not low on blockstore space, then ones that
+	// are not overloaded
 	sort.SliceStable(shuttles, func(i, j int) bool {
 		lsI := lowSpace[shuttles[i].Handle]
 		lsJ := lowSpace[shuttles[j].Handle]
 
-		if lsI == lsJ {
-			return false
+		if lsI != lsJ {
+			return lsJ
 		}
 
-		return lsJ
+		return overloaded[shuttles[j].Handle] && !overloaded[shuttles[i].Handle]
 	})
 
 	if len(shuttles) == 0 {
@@ -673,7 +702,7 @@ func filterForStatusQuery(q *gorm.DB, statuses map[types.PinningStatus]bool) (*g
 
 // handleAddPin  godoc
 // @Summary      Add and pin object
-// @Description  This endpoint adds a pin to the IPFS daemon.
+// @Description  This endpoint adds a pin to the IPFS daemon. A "depth" in the pin meta limits the pin to that many levels of the dag, 1 pins only the root block.
 // @Tags         pinning
 // @Produce      json
 // @in           200,400,default  string  Token "token"
@@ -732,9 +761,14 @@ func (s *Server) handleAddPin(e echo.Context, u *User) error {
 		return err
 	}
 
+	depth, err := util.PinDepthFromMeta(pin.Meta)
+	if err != nil {
+		return err
+	}
+
 	makeDeal := true
 	// TODO pinning should be async
-	status, err := s.CM.pinContent(ctx, u.ID, obj, pin.Name, cols, origins, 0, pin.Meta, makeDeal)
+	status, err := s.CM.pinContent(ctx, u.ID, obj, pin.Name, cols, origins, 0, pin.Meta, depth, makeDeal)
 	if err != nil {
 		return err
 	}
@@ -830,8 +864,13 @@ func (s *Server) handleReplacePin(e echo.Context, u *User) error {
 		return err
 	}
 
+	depth, err := util.PinDepthFromMeta(pin.Meta)
+	if err != nil {
+		return err
+	}
+
 	makeDeal := true
-	status, err := s.CM.pinContent(e.Request().Context(), u.ID, pinCID, pin.Name, nil, origins, uint(pinID), pin.Meta, makeDeal)
+	status, err := s.CM.pinContent(e.Request().Context(), u.ID, pinCID, pin.Name, nil, origins, uint(pinID), pin.Meta, depth, makeDeal)
 	if err != nil {
 		return err
 	}
@@ -881,7 +920,10 @@ func (s *Server) handleDeletePin(e echo.Context, u *User) error {
 	return e.NoContent(http.StatusAccepted)
 }
 
-func (cm *ContentManager) UpdatePinStatus(location string, contID uint, status types.PinningStatus) error {
+// UpdatePinStatus records a change of the status of a pin. The reason a
+// failed pin failed is taken from the pinning operation when it is not given,
+// for pins run on this node.
+func (cm *ContentManager) UpdatePinStatus(location string, contID uint, status types.PinningStatus, reason types.PinFailureReason) error {
 	cm.pinLk.Lock()
 	op, ok := cm.pinJobs[contID]
 
@@ -900,21 +942,86 @@ func (cm *ContentManager) UpdatePinStatus(location string, contID uint, status t
 			return fmt.Errorf("got failed pin status message from location: %s where content(%d) was already active, refusing to do anything", location, contID)
 		}
 
+		if reason == "" {
+			reason = op.Failure()
+		}
+		if reason == "" {
+			reason = types.PinFailureUnknown
+		}
+		op.SetFailure(reason)
+
 		if err := cm.DB.Model(util.Content{}).Where("id = ?", contID).UpdateColumns(map[string]interface{}{
-			"active":  false,
-			"pinning": false,
-			"failed":  true,
+			"active":         false,
+			"pinning":        false,
+			"failed":         true,
+			"failure_reason": reason,
 		}).Error; err != nil {
 			log.Errorf("failed to mark content as failed in database: %s", err)
 		}
 	}
+
+	if status == types.PinningStatusCancelled {
+		// a cancelled pin is not a failed one, the content is left neither
+		// pinning nor failed so it can be pinned again
+		if err := cm.DB.Model(util.Content{}).Where("id = ? and not active", contID).UpdateColumns(map[string]interface{}{
+			"pinning": false,
+		}).Error; err != nil {
+			log.Errorf("failed to mark content as cancelled in database: %s", err)
+		}
+	}
+	// the shuttle reports a new estimate for pins that are still running
+	op.SetEstimate(nil)
 	op.SetStatus(status)
+	cm.pinWatchers.notify(contID)
 	return nil
 }
 
+// cancelPin aborts the pin of a content that has not completed yet, on this
+// node or on the shuttle the content is pinned on
+func (cm *ContentManager) cancelPin(ctx context.Context, contID uint) error {
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content %d not found", contID),
+			}
+		}
+		return err
+	}
+
+	if !cont.Pinning || cont.Active {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("content %d is not being pinned", contID),
+		}
+	}
+
+	if cont.Location == constants.ContentLocationLocal {
+		if !cm.pinMgr.Cancel(contID) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("no pin in progress for content %d", contID),
+			}
+		}
+		return nil
+	}
+
+	return cm.sendShuttleCommand(ctx, cont.Location, &drpc.Command{
+		Op: drpc.CMD_CancelPin,
+		Params: drpc.CmdParams{
+			CancelPin: &drpc.CancelPin{DBID: contID},
+		},
+	})
+}
+
 func (cm *ContentManager) handlePinningComplete(ctx context.Context, handle string, pincomp *drpc.PinComplete) error {
 	ctx, span := cm.tracer.Start(ctx, "handlePinningComplete")
 	defer span.End()
+	defer cm.pinWatchers.notify(pincomp.DBID)
 
 	var cont util.Content
 	if err := cm.DB.First(&cont, "id = ?", pincomp.DBID).Error; err != nil {
@@ -960,3 +1067,145 @@ func (cm *ContentManager) handlePinningComplete(ctx context.Context, handle stri
 
 	return nil
 }
+
+// partialPinTimeout is how long the parts of a pin complete are kept around
+// waiting for the rest of them. Pin completes dropped after it, or lost to a
+// restart, are sent again in full by the shuttle when its pin queue is
+// refreshed on reconnect.
+const partialPinTimeout = time.Hour
+
+// maxPartialPinsPerShuttle bounds the pin completes a single shuttle can
+// have in flight
+const maxPartialPinsPerShuttle = 64
+
+// partialPin collects a pin complete that a shuttle sends in parts. The
+// messages are handled concurrently so they may come in any order.
+type partialPin struct {
+	begun     bool
+	committed bool
+	size      int64
+	numParts  int
+	parts     map[int][]drpc.PinObj
+	started   time.Time
+}
+
+func (pp *partialPin) complete() bool {
+	if !pp.begun || !pp.committed {
+		return false
+	}
+	for i := 0; i < pp.numParts; i++ {
+		if _, ok := pp.parts[i]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (pp *partialPin) begin(param *drpc.PinCompleteBegin) error {
+	if param.Parts <= 0 || param.Parts > drpc.MaxPinCompleteParts {
+		return fmt.Errorf("invalid number of pin complete parts: %d", param.Parts)
+	}
+	for i := range pp.parts {
+		if i >= param.Parts {
+			return fmt.Errorf("pin complete part %d received for %d parts", i, param.Parts)
+		}
+	}
+
+	pp.begun = true
+	pp.size = param.Size
+	pp.numParts = param.Parts
+	return nil
+}
+
+func (pp *partialPin) addPart(param *drpc.PinCompletePart) error {
+	if param.Part < 0 || param.Part >= drpc.MaxPinCompleteParts || (pp.begun && param.Part >= pp.numParts) {
+		return fmt.Errorf("invalid pin complete part: %d", param.Part)
+	}
+	if len(param.Objects) > drpc.PinCompletePartSize {
+		return fmt.Errorf("pin complete part %d has too many objects: %d", param.Part, len(param.Objects))
+	}
+
+	pp.parts[param.Part] = param.Objects
+	return nil
+}
+
+// updatePartialPin applies update to the partially received pin complete for
+// content and handles it once all of it has arrived. A pin complete that
+// fails to update is dropped.
+func (cm *ContentManager) updatePartialPin(ctx context.Context, handle string, content uint, update func(pp *partialPin) error) error {
+	cm.partialPinsLk.Lock()
+	pins := cm.partialPins[handle]
+	if pins == nil {
+		pins = make(map[uint]*partialPin)
+		cm.partialPins[handle] = pins
+	}
+
+	pp, ok := pins[content]
+	if !ok {
+		if len(pins) >= maxPartialPinsPerShuttle {
+			cm.partialPinsLk.Unlock()
+			return fmt.Errorf("shuttle %s has too many pin completes in progress, dropping parts for content %d", handle, content)
+		}
+
+		pp = &partialPin{
+			parts:   make(map[int][]drpc.PinObj),
+			started: time.Now(),
+		}
+		pins[content] = pp
+	}
+
+	if err := update(pp); err != nil {
+		delete(pins, content)
+		cm.partialPinsLk.Unlock()
+		return fmt.Errorf("dropping pin complete for content %d from shuttle %s: %w", content, handle, err)
+	}
+
+	if !pp.complete() {
+		cm.partialPinsLk.Unlock()
+		return nil
+	}
+	delete(pins, content)
+	cm.partialPinsLk.Unlock()
+
+	var objs []drpc.PinObj
+	for i := 0; i < pp.numParts; i++ {
+		objs = append(objs, pp.parts[i]...)
+	}
+
+	if err := cm.handlePinningComplete(ctx, handle, &drpc.PinComplete{
+		DBID:    content,
+		Size:    pp.size,
+		Objects: objs,
+	}); err != nil {
+		log.Errorw("handling pin complete message failed", "shuttle", handle, "err", err)
+	}
+	return nil
+}
+
+// sweepPartialPins drops pin completes whose parts stopped arriving
+func (cm *ContentManager) sweepPartialPins(ctx context.Context) {
+	ticker := time.NewTicker(partialPinTimeout / 6)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		cm.partialPinsLk.Lock()
+		for handle, pins := range cm.partialPins {
+			for content, pp := range pins {
+				if time.Since(pp.started) > partialPinTimeout {
+					log.Warnw("dropping incomplete pin complete", "shuttle", handle, "content", content, "parts", len(pp.parts))
+					delete(pins, content)
+				}
+			}
+			if len(pins) == 0 {
+				delete(cm.partialPins, handle)
+			}
+		}
+		cm.partialPinsLk.Unlock()
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
+	"github.com/application-research/estuary/drpc"
 	"github.com/application-research/estuary/pinner/types"
 	"github.com/stretchr/testify/assert"
 )
@@ -66,3 +67,20 @@ func TestStatusFilterQuery(t *testing.T) {
 	assert.Equal("SELECT * FROM `conts` WHERE pinning and not active and not failed",
 		resp.Find([]Conts{}).Statement.SQL.String())
 }
+
+func TestPartialPinValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	pp := &partialPin{parts: make(map[int][]drpc.PinObj)}
+	assert.NoError(pp.addPart(&drpc.PinCompletePart{Part: 2}))
+	assert.Error(pp.addPart(&drpc.PinCompletePart{Part: -1}))
+	assert.Error(pp.addPart(&drpc.PinCompletePart{Part: drpc.MaxPinCompleteParts}))
+
+	// a part seen before the begin must fit in the parts announced
+	assert.Error(pp.begin(&drpc.PinCompleteBegin{Parts: 2}))
+	assert.Error(pp.begin(&drpc.PinCompleteBegin{Parts: drpc.MaxPinCompleteParts + 1}))
+	assert.NoError(pp.begin(&drpc.PinCompleteBegin{Parts: 3}))
+
+	assert.Error(pp.addPart(&drpc.PinCompletePart{Part: 3}))
+	assert.Error(pp.addPart(&drpc.PinCompletePart{Part: 0, Objects: make([]drpc.PinObj, drpc.PinCompletePartSize+1)}))
+}
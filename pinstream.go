@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/pinner"
+	"github.com/application-research/estuary/pinner/types"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+const (
+	// pinStreamRefresh is how often a status stream rechecks the pin without
+	// being told it changed, which picks up the progress of local pins
+	pinStreamRefresh = 5 * time.Second
+
+	// pinStreamKeepalive is how long a status stream may stay silent before a
+	// comment is sent to keep proxies from closing it
+	pinStreamKeepalive = 30 * time.Second
+)
+
+// pinWatchers wakes up the status streams of a content when its pin changes.
+// Notifications are coalesced, a stream only learns that something changed
+// and looks up the current status itself.
+type pinWatchers struct {
+	lk   sync.Mutex
+	subs map[uint]map[chan struct{}]struct{}
+}
+
+func newPinWatchers() *pinWatchers {
+	return &pinWatchers{
+		subs: make(map[uint]map[chan struct{}]struct{}),
+	}
+}
+
+func (pw *pinWatchers) subscribe(contID uint) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	pw.lk.Lock()
+	defer pw.lk.Unlock()
+	if pw.subs[contID] == nil {
+		pw.subs[contID] = make(map[chan struct{}]struct{})
+	}
+	pw.subs[contID][ch] = struct{}{}
+
+	return ch, func() {
+		pw.lk.Lock()
+		defer pw.lk.Unlock()
+		delete(pw.subs[contID], ch)
+		if len(pw.subs[contID]) == 0 {
+			delete(pw.subs, contID)
+		}
+	}
+}
+
+func (pw *pinWatchers) notify(contID uint) {
+	pw.lk.Lock()
+	defer pw.lk.Unlock()
+	for ch := range pw.subs[contID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handlePinProgress records the progress of pins running on a shuttle and
+// where its queued pins stand
+func (cm *ContentManager) handlePinProgress(pp *drpc.PinProgress) {
+	for _, p := range pp.Pins {
+		cm.pinLk.Lock()
+		op, ok := cm.pinJobs[p.DBID]
+		cm.pinLk.Unlock()
+		if !ok {
+			continue
+		}
+
+		op.SetProgress(p.Blocks, p.Bytes)
+		op.SetEstimate(&pinner.PinEstimate{
+			BytesPerSecond:      p.BytesPerSecond,
+			EstimatedCompletion: p.EstimatedCompletion,
+		})
+		cm.pinWatchers.notify(p.DBID)
+	}
+
+	for _, q := range pp.Queued {
+		cm.pinLk.Lock()
+		op, ok := cm.pinJobs[q.DBID]
+		cm.pinLk.Unlock()
+		if !ok {
+			continue
+		}
+
+		op.SetEstimate(&pinner.PinEstimate{
+			Position:       q.Position,
+			EstimatedStart: q.EstimatedStart,
+		})
+		cm.pinWatchers.notify(q.DBID)
+	}
+}
+
+// pinEstimate returns the queue position and estimated times of the pin of
+// cont, computed here for local pins and as last reported by the shuttle
+// for the others
+func (cm *ContentManager) pinEstimate(cont util.Content, op *pinner.PinningOperation) *pinner.PinEstimate {
+	if cont.Location == constants.ContentLocationLocal {
+		est, _ := cm.pinMgr.Estimate(cont.ID, time.Now())
+		return est
+	}
+	return op.ReportedEstimate()
+}
+
+type pinStatusEvent struct {
+	Content       uint                `json:"content"`
+	Status        types.PinningStatus `json:"status"`
+	Location      string              `json:"location"`
+	FetchedBlocks int                 `json:"fetchedBlocks"`
+	FetchedBytes  int64               `json:"fetchedBytes"`
+
+	Estimate *pinner.PinEstimate `json:"estimate,omitempty"`
+
+	// FailureReason is why a failed pin failed
+	FailureReason string `json:"failureReason,omitempty"`
+}
+
+func (ev *pinStatusEvent) done() bool {
+	switch ev.Status {
+	case types.PinningStatusPinned, types.PinningStatusFailed, types.PinningStatusCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// pinStatusEvent returns the current status of the pin of a content
+func (cm *ContentManager) pinStatusEvent(contID uint) (*pinStatusEvent, error) {
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ?", contID).Error; err != nil {
+		return nil, err
+	}
+
+	ev := &pinStatusEvent{
+		Content:  cont.ID,
+		Status:   types.PinningStatusPinning,
+		Location: cont.Location,
+	}
+
+	cm.pinLk.Lock()
+	op, ok := cm.pinJobs[contID]
+	cm.pinLk.Unlock()
+	if ok {
+		ev.Status, ev.FetchedBlocks, ev.FetchedBytes = op.Progress()
+		ev.Estimate = cm.pinEstimate(cont, op)
+	}
+
+	switch {
+	case cont.Active:
+		ev.Status = types.PinningStatusPinned
+	case cont.Failed:
+		ev.Status = types.PinningStatusFailed
+		ev.FailureReason = cont.FailureReason
+	case !cont.Pinning:
+		ev.Status = types.PinningStatusCancelled
+	}
+	if ev.done() {
+		ev.Estimate = nil
+	}
+	return ev, nil
+}
+
+func writeServerSentEvent(resp *echo.Response, event string, data []byte) error {
+	if _, err := fmt.Fprintf(resp, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	resp.Flush()
+	return nil
+}
+
+// handleContentStatusStream godoc
+// @Summary      Stream the pin status of a content
+// @Description  This endpoint streams the pin status of a content as server-sent events. A status event with the status, location, fetched blocks and bytes and, while the pin is queued or running, its queue position and estimated start or completion is sent right away and then whenever the pin makes progress or changes state. The stream ends after the pin is pinned, failed or cancelled.
+// @Tags         content
+// @Produce      text/event-stream
+// @Param        id  path  int  true  "Content ID"
+// @Router       /content/{id}/status/stream [get]
+func (s *Server) handleContentStatusStream(c echo.Context, u *User) error {
+	contID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid content id %q", c.Param("id")),
+		}
+	}
+
+	var content util.Content
+	if err := s.DB.First(&content, "id = ?", contID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_CONTENT_NOT_FOUND,
+				Details: fmt.Sprintf("content with ID(%d) was not found", contID),
+			}
+		}
+		return err
+	}
+
+	if err := util.IsContentOwner(u.ID, content.UserID); err != nil {
+		return err
+	}
+
+	// subscribe before the first lookup so no change is missed
+	changed, unsub := s.CM.pinWatchers.subscribe(content.ID)
+	defer unsub()
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.Header().Set("X-Accel-Buffering", "no")
+	resp.WriteHeader(http.StatusOK)
+
+	refresh := time.NewTicker(pinStreamRefresh)
+	defer refresh.Stop()
+
+	var last []byte
+	lastWrite := time.Now()
+	for {
+		ev, err := s.CM.pinStatusEvent(content.ID)
+		if err != nil {
+			log.Errorf("failed to look up pin status of content %d: %s", content.ID, err)
+			return writeServerSentEvent(resp, "error", []byte(`{"error":"failed to look up pin status"}`))
+		}
+
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(data, last) {
+			if err := writeServerSentEvent(resp, "status", data); err != nil {
+				return nil
+			}
+			last = data
+			lastWrite = time.Now()
+		} else if time.Since(lastWrite) >= pinStreamKeepalive {
+			if _, err := fmt.Fprint(resp, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+			resp.Flush()
+			lastWrite = time.Now()
+		}
+
+		if ev.done() {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-refresh.C:
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	}
+}
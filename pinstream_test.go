@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinWatchers(t *testing.T) {
+	assert := assert.New(t)
+
+	pw := newPinWatchers()
+	a, unsubA := pw.subscribe(1)
+	b, unsubB := pw.subscribe(1)
+	other, unsubOther := pw.subscribe(2)
+	defer unsubOther()
+
+	// notifications are coalesced and never block
+	pw.notify(1)
+	pw.notify(1)
+
+	for _, ch := range []<-chan struct{}{a, b} {
+		select {
+		case <-ch:
+		default:
+			t.Fatal("expected a notification")
+		}
+		select {
+		case <-ch:
+			t.Fatal("expected notifications to be coalesced")
+		default:
+		}
+	}
+
+	select {
+	case <-other:
+		t.Fatal("got a notification for another content")
+	default:
+	}
+
+	unsubA()
+	pw.notify(1)
+	select {
+	case <-a:
+		t.Fatal("got a notification after unsubscribing")
+	default:
+	}
+	<-b
+
+	unsubB()
+	assert.NotContains(pw.subs, uint(1))
+	assert.Contains(pw.subs, uint(2))
+}
@@ -118,6 +118,8 @@ type ContentManager struct {
 	pinJobs map[uint]*pinner.PinningOperation
 	pinLk   sync.Mutex
 
+	pinWatchers *pinWatchers
+
 	pinMgr *pinner.PinManager
 
 	shuttlesLk sync.Mutex
@@ -125,6 +127,21 @@ type ContentManager struct {
 
 	remoteTransferStatus *lru.ARCCache
 
+	// rpcSeen remembers recently processed shuttle message ids, shuttles
+	// resend messages we may already have processed after reconnecting.
+	// rpcInflight are the ids being processed right now.
+	rpcSeen       *lru.Cache
+	rpcInflightLk sync.Mutex
+	rpcInflight   map[shuttleMessageKey]bool
+
+	// pin completes from shuttles that are being received in parts
+	partialPinsLk sync.Mutex
+	partialPins   map[string]map[uint]*partialPin
+
+	// contents sent off draining shuttles and when, see runDrainer
+	drainLk   sync.Mutex
+	drainSent map[uint]time.Time
+
 	inflightCids   map[cid.Cid]uint
 	inflightCidsLk sync.Mutex
 
@@ -132,7 +149,7 @@ type ContentManager struct {
 
 	DisableFilecoinStorage bool
 
-	IncomingRPCMessages chan *drpc.Message
+	IncomingRPCMessages chan *incomingShuttleMessage
 
 	EnabledDealProtocolsVersions map[protocol.ID]bool
 }
@@ -290,6 +307,11 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 		return nil, err
 	}
 
+	rpcSeen, err := lru.New(100000)
+	if err != nil {
+		return nil, err
+	}
+
 	cm := &ContentManager{
 		Provider:                     prov,
 		DB:                           db,
@@ -304,8 +326,13 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 		retrievalsInProgress:         make(map[uint]*util.RetrievalProgress),
 		buckets:                      make(map[uint][]*contentStagingZone),
 		pinJobs:                      make(map[uint]*pinner.PinningOperation),
+		pinWatchers:                  newPinWatchers(),
 		pinMgr:                       pinmgr,
 		remoteTransferStatus:         cache,
+		rpcSeen:                      rpcSeen,
+		rpcInflight:                  make(map[shuttleMessageKey]bool),
+		partialPins:                  make(map[string]map[uint]*partialPin),
+		drainSent:                    make(map[uint]time.Time),
 		shuttles:                     make(map[string]*ShuttleConnection),
 		contentSizeLimit:             constants.DefaultContentSizeLimit,
 		hostname:                     cfg.Hostname,
@@ -318,7 +345,7 @@ func NewContentManager(db *gorm.DB, api api.Gateway, fc *filclient.FilClient, tb
 		Replication:                  cfg.Replication,
 		tracer:                       otel.Tracer("replicator"),
 		DisableFilecoinStorage:       cfg.DisableFilecoinStorage,
-		IncomingRPCMessages:          make(chan *drpc.Message),
+		IncomingRPCMessages:          make(chan *incomingShuttleMessage),
 		EnabledDealProtocolsVersions: cfg.Deal.EnabledDealProtocolsVersions,
 	}
 	qm := newQueueManager(func(c uint) {
@@ -759,7 +786,7 @@ func (cm *ContentManager) estimatePrice(ctx context.Context, repl int, pieceSize
 	))
 	defer span.End()
 
-	miners, err := cm.pickMiners(ctx, repl, pieceSize, nil, false)
+	miners, err := cm.pickMiners(ctx, repl, pieceSize, nil, false, verified)
 	if err != nil {
 		return nil, err
 	}
@@ -822,7 +849,7 @@ func (cm *ContentManager) pickMinerDist(n int) (int, int) {
 	return n - (n / 2), n / 2
 }
 
-func (cm *ContentManager) pickMiners(ctx context.Context, n int, pieceSize abi.PaddedPieceSize, exclude map[address.Address]bool, filterByPrice bool) ([]miner, error) {
+func (cm *ContentManager) pickMiners(ctx context.Context, n int, pieceSize abi.PaddedPieceSize, exclude map[address.Address]bool, filterByPrice bool, verified bool) ([]miner, error) {
 	ctx, span := cm.tracer.Start(ctx, "pickMiners", trace.WithAttributes(
 		attribute.Int("count", n),
 	))
@@ -836,16 +863,16 @@ func (cm *ContentManager) pickMiners(ctx context.Context, n int, pieceSize abi.P
 	// give miners more of a chance to prove themselves
 	_, nrand := cm.pickMinerDist(n)
 
-	out, err := cm.randomMinerListForDeal(ctx, nrand, pieceSize, exclude, filterByPrice)
+	out, err := cm.randomMinerListForDeal(ctx, nrand, pieceSize, exclude, filterByPrice, verified)
 	if err != nil {
 		return nil, err
 	}
-	return cm.sortedMinersForDeal(ctx, out, n, pieceSize, exclude, filterByPrice)
+	return cm.sortedMinersForDeal(ctx, out, n, pieceSize, exclude, filterByPrice, verified)
 }
 
 //TODO - this is currently not used, if we choose to use it,
 //add a check to make sure miners selected is still active in db
-func (cm *ContentManager) sortedMinersForDeal(ctx context.Context, out []miner, n int, pieceSize abi.PaddedPieceSize, exclude map[address.Address]bool, filterByPrice bool) ([]miner, error) {
+func (cm *ContentManager) sortedMinersForDeal(ctx context.Context, out []miner, n int, pieceSize abi.PaddedPieceSize, exclude map[address.Address]bool, filterByPrice bool, verified bool) ([]miner, error) {
 	sortedMiners, _, err := cm.sortedMinerList()
 	if err != nil {
 		return nil, err
@@ -890,8 +917,8 @@ func (cm *ContentManager) sortedMinersForDeal(ctx context.Context, out []miner,
 		}
 
 		if filterByPrice {
-			price := ask.GetPrice(cm.VerifiedDeal)
-			if cm.priceIsTooHigh(price, cm.VerifiedDeal) {
+			price := ask.GetPrice(verified)
+			if cm.priceIsTooHigh(price, verified) {
 				continue
 			}
 		}
@@ -904,7 +931,7 @@ func (cm *ContentManager) sortedMinersForDeal(ctx context.Context, out []miner,
 	return out, nil
 }
 
-func (cm *ContentManager) randomMinerListForDeal(ctx context.Context, n int, pieceSize abi.PaddedPieceSize, exclude map[address.Address]bool, filterByPrice bool) ([]miner, error) {
+func (cm *ContentManager) randomMinerListForDeal(ctx context.Context, n int, pieceSize abi.PaddedPieceSize, exclude map[address.Address]bool, filterByPrice bool, verified bool) ([]miner, error) {
 	var dbminers []storageMiner
 	if err := cm.DB.Find(&dbminers, "not suspended").Error; err != nil {
 		return nil, err
@@ -946,8 +973,8 @@ func (cm *ContentManager) randomMinerListForDeal(ctx context.Context, n int, pie
 		}
 
 		if filterByPrice {
-			price := ask.GetPrice(cm.VerifiedDeal)
-			if cm.priceIsTooHigh(price, cm.VerifiedDeal) {
+			price := ask.GetPrice(verified)
+			if cm.priceIsTooHigh(price, verified) {
 				continue
 			}
 		}
@@ -1224,7 +1251,7 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 	))
 	defer span.End()
 
-	verified := cm.VerifiedDeal
+	verified := cm.dealVerified(content)
 
 	if content.AggregatedIn > 0 {
 		// This content is aggregated inside another piece of content, nothing to do here
@@ -1236,6 +1263,11 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 		return nil
 	}
 
+	if content.MaxDepth > 0 {
+		// Only part of the dag is pinned, there is nothing complete to make deals with
+		return nil
+	}
+
 	// if it's a shuttle content and the shuttle is not online, do not proceed
 	if content.Location != constants.ContentLocationLocal && !cm.shuttleIsOnline(content.Location) {
 		log.Debugf("content shuttle: %s, is not online", content.Location)
@@ -1243,6 +1275,12 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 		return nil
 	}
 
+	// the content is moving to another shuttle, deals are made from there
+	if content.Location != constants.ContentLocationLocal && cm.shuttleIsDraining(content.Location) {
+		done(time.Minute * 15)
+		return nil
+	}
+
 	if cm.contentInStagingZone(ctx, content) {
 		// This content is already scheduled to be aggregated and is waiting in a bucket
 		return nil
@@ -1274,6 +1312,13 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 		return err
 	}
 
+	if aggrMax := cm.shuttleAggregateMaxSize(content.Location); len(deals) == 0 &&
+		aggrMax > 0 && content.Size <= aggrMax &&
+		!content.Aggregate && !content.DagSplit {
+		// the shuttle aggregates it, see handleRpcAggregateStaged
+		return nil
+	}
+
 	if len(deals) == 0 &&
 		content.Size < int64(constants.IndividualDealThreshold) &&
 		!content.Aggregate &&
@@ -1307,6 +1352,7 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 	// check on each of the existing deals, see if they need fixing
 	var countLk sync.Mutex
 	var numSealed, numPublished, numProgress int
+	var sealed []drpc.StorageDeal
 	errs := make([]error, len(deals))
 	var wg sync.WaitGroup
 	for i := range deals {
@@ -1335,6 +1381,9 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 				}
 			case DEAL_CHECK_SECTOR_ON_CHAIN:
 				numSealed++
+				if maddr, err := d.MinerAddr(); err == nil {
+					sealed = append(sealed, drpc.StorageDeal{Miner: maddr, DealID: d.DealID})
+				}
 			case DEAL_CHECK_DEALID_ON_CHAIN:
 				numPublished++
 			case DEAL_CHECK_PROGRESS:
@@ -1408,7 +1457,7 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 
 			if bl.VerifiedClientBalance.LessThan(big.NewIntUnsigned(uint64(abi.UnpaddedPieceSize(content.Size).Padded()))) {
 				// how do we notify admin to top up datacap?
-				return errors.Wrapf(err, "will not make deal, client address dataCap:%d GiB is lower than content size:%d GiB", big.Div(*bl.VerifiedClientBalance, big.NewIntUnsigned(uint64(1073741824))), abi.UnpaddedPieceSize(content.Size).Padded()/1073741824)
+				return errors.Errorf("will not make deal, client address dataCap:%d GiB is lower than content size:%d GiB", big.Div(*bl.VerifiedClientBalance, big.NewIntUnsigned(uint64(1073741824))), abi.UnpaddedPieceSize(content.Size).Padded()/1073741824)
 			}
 		}
 
@@ -1423,6 +1472,16 @@ func (cm *ContentManager) ensureStorage(ctx context.Context, content util.Conten
 		return nil
 	}
 
+	if content.Location != constants.ContentLocationLocal {
+		if min := cm.shuttleTieringMinDeals(content.Location); min > 0 && len(sealed) >= min {
+			go func() {
+				if err := cm.sendTierContentCmd(context.Background(), content.Location, content.ID, sealed); err != nil {
+					log.Errorf("failed to send tier content command for %d: %s", content.ID, err)
+				}
+			}()
+		}
+	}
+
 	if numSealed >= replicationFactor {
 		done(time.Hour * 24)
 	} else if numSealed+numPublished >= replicationFactor {
@@ -2007,6 +2066,22 @@ func init() {
 	priceMax = abi.TokenAmount(max)
 }
 
+// dealVerified decides whether deals for content use datacap. A setting on the
+// content wins over the one of the shuttle holding it, which wins over the
+// default of the node.
+func (cm *ContentManager) dealVerified(content util.Content) bool {
+	if content.VerifiedDeal != nil {
+		return *content.VerifiedDeal
+	}
+
+	if content.Location != constants.ContentLocationLocal {
+		if v := cm.shuttleVerifiedDeals(content.Location); v != nil {
+			return *v
+		}
+	}
+	return cm.VerifiedDeal
+}
+
 func (cm *ContentManager) priceIsTooHigh(price abi.TokenAmount, verified bool) bool {
 	if verified {
 		return types.BigCmp(price, abi.NewTokenAmount(0)) > 0
@@ -2043,7 +2118,7 @@ func (cm *ContentManager) makeDealsForContent(ctx context.Context, content util.
 		return xerrors.Errorf("failed to compute piece commitment while making deals %d: %w", content.ID, err)
 	}
 
-	miners, err := cm.pickMiners(ctx, count*2, pieceSize.Padded(), exclude, true)
+	miners, err := cm.pickMiners(ctx, count*2, pieceSize.Padded(), exclude, true, verified)
 	if err != nil {
 		return err
 	}
@@ -3202,9 +3277,10 @@ func (cm *ContentManager) sendConsolidateContentCmd(ctx context.Context, loc str
 		fromLocs[c.Location] = struct{}{}
 
 		tc.Contents = append(tc.Contents, drpc.ContentFetch{
-			ID:     c.ID,
-			Cid:    c.Cid.CID,
-			UserID: c.UserID,
+			ID:       c.ID,
+			Cid:      c.Cid.CID,
+			UserID:   c.UserID,
+			Location: c.Location,
 		})
 	}
 
@@ -3241,6 +3317,18 @@ func (cm *ContentManager) sendUnpinCmd(ctx context.Context, loc string, conts []
 	})
 }
 
+func (cm *ContentManager) sendTierContentCmd(ctx context.Context, loc string, cont uint, deals []drpc.StorageDeal) error {
+	return cm.sendShuttleCommand(ctx, loc, &drpc.Command{
+		Op: drpc.CMD_TierContent,
+		Params: drpc.CmdParams{
+			TierContent: &drpc.TierContent{
+				Content: cont,
+				Deals:   deals,
+			},
+		},
+	})
+}
+
 func (cm *ContentManager) dealMakingDisabled() bool {
 	cm.dealDisabledLk.Lock()
 	defer cm.dealDisabledLk.Unlock()
@@ -3289,7 +3377,7 @@ func (cm *ContentManager) splitContentLocal(ctx context.Context, cont util.Conte
 			return xerrors.Errorf("failed to track new content in database: %w", err)
 		}
 
-		if err := cm.addDatabaseTrackingToContent(ctx, content.ID, dserv, c, func(int64) {}); err != nil {
+		if err := cm.addDatabaseTrackingToContent(ctx, content.ID, dserv, c, 0, func(int64) {}); err != nil {
 			return err
 		}
 
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-blockservice"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// The S3 api maps the buckets of a user to their collections, by name, and
+// objects to the content of a collection, keyed by its path without the
+// leading slash. Requests authenticate with an api key as the access key id,
+// signatures are not checked since the key is sent in the clear anyway.
+// Multipart uploads are not supported.
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+const s3MaxKeys = 1000
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Status   int      `xml:"-"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func s3ErrNoSuchBucket(bucket string) *s3Error {
+	return &s3Error{Status: http.StatusNotFound, Code: "NoSuchBucket", Message: fmt.Sprintf("bucket %s does not exist", bucket)}
+}
+
+func s3ErrEntityTooLarge(limit int64) *s3Error {
+	return &s3Error{
+		Status:  http.StatusBadRequest,
+		Code:    "EntityTooLarge",
+		Message: fmt.Sprintf("object is over the upload size limit of %d bytes, and content splitting is not enabled", limit),
+	}
+}
+
+func s3ErrNoSuchKey(key string) *s3Error {
+	return &s3Error{Status: http.StatusNotFound, Code: "NoSuchKey", Message: fmt.Sprintf("key %s does not exist", key)}
+}
+
+// s3Handler writes the errors of f the way S3 clients expect them, as xml
+// with an S3 error code
+func (s *Server) s3Handler(f func(echo.Context, *User) error) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		u, err := s.s3Auth(c)
+		if err == nil {
+			err = f(c, u)
+		}
+		if err == nil {
+			return nil
+		}
+
+		var s3err *s3Error
+		var herr *util.HttpError
+		switch {
+		case xerrors.As(err, &s3err):
+		case xerrors.As(err, &herr):
+			code := "InvalidRequest"
+			switch herr.Code {
+			case http.StatusUnauthorized, http.StatusForbidden:
+				code = "AccessDenied"
+			case http.StatusNotFound:
+				code = "NoSuchKey"
+			}
+			s3err = &s3Error{Status: herr.Code, Code: code, Message: herr.Details}
+		default:
+			log.Errorf("s3 request %s %s failed: %s", c.Request().Method, c.Request().URL.Path, err)
+			s3err = &s3Error{Status: http.StatusInternalServerError, Code: "InternalError", Message: "we encountered an internal error, please try again"}
+		}
+		s3err.Resource = c.Request().URL.Path
+
+		if c.Request().Method == http.MethodHead {
+			return c.NoContent(s3err.Status)
+		}
+		return c.XML(s3err.Status, s3err)
+	}
+}
+
+// s3AccessKey returns the access key id of an S3 request, signed with either
+// version of the aws signature, in the header or the query string
+func s3AccessKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "AWS4-HMAC-SHA256 "):
+		for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+			part = strings.TrimSpace(part)
+			if cred := strings.TrimPrefix(part, "Credential="); cred != part {
+				return strings.SplitN(cred, "/", 2)[0]
+			}
+		}
+	case strings.HasPrefix(auth, "AWS "):
+		return strings.SplitN(strings.TrimPrefix(auth, "AWS "), ":", 2)[0]
+	case strings.HasPrefix(auth, "Bearer "):
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	q := r.URL.Query()
+	if cred := q.Get("X-Amz-Credential"); cred != "" {
+		return strings.SplitN(cred, "/", 2)[0]
+	}
+	return q.Get("AWSAccessKeyId")
+}
+
+func (s *Server) s3Auth(c echo.Context) (*User, error) {
+	key := s3AccessKey(c.Request())
+	if key == "" {
+		return nil, &s3Error{Status: http.StatusForbidden, Code: "AccessDenied", Message: "no access key was specified"}
+	}
+
+	u, err := s.checkTokenAuth(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// upload keys may put objects but not create buckets, read or remove
+	// anything, read keys may only read
+	required := util.DefaultScopes(util.PermLevelUser, c.Request().Method)
+	if c.Request().Method == http.MethodPut && c.Param("*") != "" {
+		required = []string{util.ScopeUpload}
+	}
+	if !util.ScopesAllow(u.authToken.scopes(), required) {
+		return nil, &s3Error{Status: http.StatusForbidden, Code: "AccessDenied", Message: "api key does not allow this request"}
+	}
+	return u, nil
+}
+
+func (s *Server) s3Bucket(u *User, bucket string) (*Collection, error) {
+	var col Collection
+	if err := s.DB.First(&col, "name = ? and user_id = ?", bucket, u.ID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, s3ErrNoSuchBucket(bucket)
+		}
+		return nil, err
+	}
+	return &col, nil
+}
+
+// s3Key returns the object key of the request, unescaped
+func s3Key(c echo.Context) (string, error) {
+	key, err := url.PathUnescape(c.Param("*"))
+	if err != nil {
+		return "", &s3Error{Status: http.StatusBadRequest, Code: "InvalidURI", Message: err.Error()}
+	}
+	if key == "" || path.Clean("/"+key) != "/"+strings.TrimSuffix(key, "/") {
+		return "", &s3Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: fmt.Sprintf("invalid object key %q", key)}
+	}
+	return key, nil
+}
+
+type s3Object struct {
+	util.Content
+	Path      string
+	RefID     uint
+	RefCreate time.Time
+}
+
+func (s *Server) s3Object(col *Collection, key string) (*s3Object, error) {
+	var objs []s3Object
+	if err := s.DB.Model(CollectionRef{}).
+		Where("collection_refs.collection = ? and collection_refs.path = ?", col.ID, "/"+key).
+		Joins("left join contents on contents.id = collection_refs.content").
+		Select("contents.*, collection_refs.path as path, collection_refs.id as ref_id, collection_refs.created_at as ref_create").
+		Order("collection_refs.id desc").
+		Limit(1).
+		Scan(&objs).Error; err != nil {
+		return nil, err
+	}
+	if len(objs) == 0 || objs[0].ID == 0 {
+		return nil, s3ErrNoSuchKey(key)
+	}
+	return &objs[0], nil
+}
+
+type s3Bucket struct {
+	Name         string    `xml:"Name"`
+	CreationDate time.Time `xml:"CreationDate"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+func (s *Server) handleS3ListBuckets(c echo.Context, u *User) error {
+	var cols []Collection
+	if err := s.DB.Order("name").Find(&cols, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+
+	out := &s3ListBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{ID: strconv.Itoa(int(u.ID)), DisplayName: u.Username},
+	}
+	for _, col := range cols {
+		out.Buckets = append(out.Buckets, s3Bucket{Name: col.Name, CreationDate: col.CreatedAt})
+	}
+	return c.XML(http.StatusOK, out)
+}
+
+func (s *Server) handleS3CreateBucket(c echo.Context, u *User) error {
+	bucket := c.Param("bucket")
+	if _, err := s.s3Bucket(u, bucket); err == nil {
+		return &s3Error{Status: http.StatusConflict, Code: "BucketAlreadyOwnedByYou", Message: fmt.Sprintf("bucket %s already exists", bucket)}
+	} else if !xerrors.As(err, new(*s3Error)) {
+		return err
+	}
+
+	col := &Collection{
+		UUID:   uuid.New().String(),
+		Name:   bucket,
+		UserID: u.ID,
+	}
+	if err := s.DB.Create(col).Error; err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("Location", "/"+bucket)
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) handleS3HeadBucket(c echo.Context, u *User) error {
+	if _, err := s.s3Bucket(u, c.Param("bucket")); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) handleS3DeleteBucket(c echo.Context, u *User) error {
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	if err := s.DB.Model(CollectionRef{}).Where("collection = ?", col.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return &s3Error{Status: http.StatusConflict, Code: "BucketNotEmpty", Message: fmt.Sprintf("bucket %s still has objects", col.Name)}
+	}
+
+	if err := s.DB.Delete(col).Error; err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+type s3Content struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+	StorageClass string    `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListObjectsResult struct {
+	XMLName        xml.Name         `xml:"ListBucketResult"`
+	Xmlns          string           `xml:"xmlns,attr"`
+	Name           string           `xml:"Name"`
+	Prefix         string           `xml:"Prefix"`
+	Delimiter      string           `xml:"Delimiter,omitempty"`
+	MaxKeys        int              `xml:"MaxKeys"`
+	IsTruncated    bool             `xml:"IsTruncated"`
+	Contents       []s3Content      `xml:"Contents"`
+	CommonPrefixes []s3CommonPrefix `xml:"CommonPrefixes,omitempty"`
+
+	// list-type=2 requests page with continuation tokens, others with
+	// markers
+	KeyCount              *int    `xml:"KeyCount,omitempty"`
+	ContinuationToken     string  `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string  `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string  `xml:"StartAfter,omitempty"`
+	Marker                *string `xml:"Marker,omitempty"`
+	NextMarker            string  `xml:"NextMarker,omitempty"`
+}
+
+// listS3Objects pages through objs, sorted by key, the way ListObjects does:
+// keys after start that have prefix, those with delimiter after the prefix
+// rolled up into common prefixes. It returns the last key or prefix listed
+// if there are more.
+func listS3Objects(objs []s3Object, prefix, delimiter, start string, maxKeys int) ([]s3Content, []s3CommonPrefix, string) {
+	var contents []s3Content
+	var prefixes []s3CommonPrefix
+	var last string
+	for _, o := range objs {
+		key := strings.TrimPrefix(o.Path, "/")
+		if !strings.HasPrefix(key, prefix) || key <= start {
+			continue
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				cp := key[:len(prefix)+i+len(delimiter)]
+				if cp <= start || (len(prefixes) > 0 && prefixes[len(prefixes)-1].Prefix == cp) {
+					continue
+				}
+				if len(contents)+len(prefixes) == maxKeys {
+					return contents, prefixes, last
+				}
+				prefixes = append(prefixes, s3CommonPrefix{Prefix: cp})
+				last = cp
+				continue
+			}
+		}
+
+		if len(contents)+len(prefixes) == maxKeys {
+			return contents, prefixes, last
+		}
+		contents = append(contents, s3Content{
+			Key:          key,
+			LastModified: o.RefCreate.UTC(),
+			ETag:         fmt.Sprintf("%q", o.Cid.CID.String()),
+			Size:         o.Size,
+			StorageClass: "STANDARD",
+		})
+		last = key
+	}
+	return contents, prefixes, ""
+}
+
+func (s *Server) handleS3ListObjects(c echo.Context, u *User) error {
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	q := c.QueryParams()
+	maxKeys := s3MaxKeys
+	if mk := q.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			return &s3Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: "max-keys must be a non negative number"}
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	out := &s3ListObjectsResult{
+		Xmlns:     s3Namespace,
+		Name:      col.Name,
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		MaxKeys:   maxKeys,
+	}
+
+	v2 := q.Get("list-type") == "2"
+	var start string
+	if v2 {
+		out.StartAfter = q.Get("start-after")
+		start = out.StartAfter
+		if tok := q.Get("continuation-token"); tok != "" {
+			b, err := base64.StdEncoding.DecodeString(tok)
+			if err != nil {
+				return &s3Error{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: "invalid continuation token"}
+			}
+			out.ContinuationToken = tok
+			start = string(b)
+		}
+	} else {
+		marker := q.Get("marker")
+		out.Marker = &marker
+		start = marker
+	}
+
+	var objs []s3Object
+	if err := s.DB.Model(CollectionRef{}).
+		Where("collection_refs.collection = ?", col.ID).
+		Joins("left join contents on contents.id = collection_refs.content").
+		Select("contents.*, collection_refs.path as path, collection_refs.id as ref_id, collection_refs.created_at as ref_create").
+		Scan(&objs).Error; err != nil {
+		return err
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		return objs[i].Path < objs[j].Path
+	})
+
+	var next string
+	out.Contents, out.CommonPrefixes, next = listS3Objects(objs, out.Prefix, out.Delimiter, start, maxKeys)
+	out.IsTruncated = next != ""
+	if v2 {
+		n := len(out.Contents) + len(out.CommonPrefixes)
+		out.KeyCount = &n
+		if next != "" {
+			out.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(next))
+		}
+	} else {
+		out.NextMarker = next
+	}
+	return c.XML(http.StatusOK, out)
+}
+
+func (s *Server) handleS3PutObject(c echo.Context, u *User) error {
+	ctx := c.Request().Context()
+
+	if c.QueryParams().Has("uploadId") || c.QueryParams().Has("partNumber") {
+		return &s3Error{Status: http.StatusNotImplemented, Code: "NotImplemented", Message: "multipart uploads are not supported"}
+	}
+	if c.Request().Header.Get("X-Amz-Copy-Source") != "" {
+		return &s3Error{Status: http.StatusNotImplemented, Code: "NotImplemented", Message: "copying objects is not supported"}
+	}
+
+	if err := util.ErrorIfContentAddingDisabled(s.isContentAddingDisabled(u)); err != nil {
+		return err
+	}
+	if s.CM.localContentAddingDisabled {
+		return &s3Error{Status: http.StatusServiceUnavailable, Code: "ServiceUnavailable", Message: "content adding is disabled on this node"}
+	}
+
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	key, err := s3Key(c)
+	if err != nil {
+		return err
+	}
+
+	size := c.Request().ContentLength
+	if dl := c.Request().Header.Get("X-Amz-Decoded-Content-Length"); dl != "" {
+		size, _ = strconv.ParseInt(dl, 10, 64)
+	}
+	if !u.FlagSplitContent() && size > s.CM.contentSizeLimit {
+		return s3ErrEntityTooLarge(s.CM.contentSizeLimit)
+	}
+
+	var body io.Reader = c.Request().Body
+	if strings.HasPrefix(c.Request().Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		body = newAwsChunkedReader(body)
+	}
+
+	// the declared sizes are up to the client, the limit holds for what is
+	// actually sent
+	var limited *s3LimitedReader
+	if !u.FlagSplitContent() {
+		limited = &s3LimitedReader{r: body, limit: s.CM.contentSizeLimit, remaining: s.CM.contentSizeLimit}
+		body = limited
+	}
+
+	bsid, bs, err := s.StagingMgr.AllocNew()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		go func() {
+			if err := s.StagingMgr.CleanUp(bsid); err != nil {
+				log.Errorf("failed to clean up staging blockstore: %s", err)
+			}
+		}()
+	}()
+
+	bserv := blockservice.New(bs, nil)
+	dserv := merkledag.NewDAGService(bserv)
+
+	nd, err := s.importFile(ctx, dserv, body)
+	if limited != nil && limited.exceeded {
+		return s3ErrEntityTooLarge(limited.limit)
+	}
+	if err != nil {
+		return err
+	}
+
+	content, err := s.CM.addDatabaseTracking(ctx, u, dserv, nd.Cid(), path.Base(key), s.CM.Replication)
+	if err != nil {
+		return xerrors.Errorf("encountered problem computing object references: %w", err)
+	}
+
+	// objects are overwritten by pointing their key at the new content, the
+	// content they pointed at goes away with its last object
+	fullPath := "/" + key
+	var replaced []uint
+	if err := s.DB.Transaction(func(tx *gorm.DB) error {
+		replaced = nil
+
+		var oldRefs []CollectionRef
+		if err := tx.Where("collection = ? and path = ?", col.ID, fullPath).Find(&oldRefs).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("collection = ? and path = ?", col.ID, fullPath).Delete(&CollectionRef{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&CollectionRef{
+			Collection: col.ID,
+			Content:    content.ID,
+			Path:       &fullPath,
+		}).Error; err != nil {
+			return err
+		}
+
+		for _, ref := range oldRefs {
+			var refs int64
+			if err := tx.Model(CollectionRef{}).Where("content = ?", ref.Content).Count(&refs).Error; err != nil {
+				return err
+			}
+			if refs > 0 {
+				continue
+			}
+
+			res := tx.Model(&util.Content{}).Where("id = ? and user_id = ?", ref.Content, u.ID).Update("replace", true)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected > 0 {
+				replaced = append(replaced, ref.Content)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, id := range replaced {
+		go func(id uint) {
+			if err := s.CM.unpinContent(context.Background(), id); err != nil {
+				log.Errorf("could not unpinContent(%d): %s", id, err)
+			}
+		}(id)
+	}
+
+	if err := s.dumpBlockstoreTo(ctx, bs, s.Node.Blockstore); err != nil {
+		return xerrors.Errorf("failed to move data from staging to main blockstore: %w", err)
+	}
+
+	go func() {
+		s.CM.ToCheck <- content.ID
+	}()
+
+	go func() {
+		if err := s.Node.ProvideRoot(nd.Cid()); err != nil {
+			log.Warnf("failed to announce providers: %s", err)
+		}
+	}()
+
+	c.Response().Header().Set("ETag", fmt.Sprintf("%q", nd.Cid().String()))
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) setS3ObjectHeaders(c echo.Context, obj *s3Object) {
+	h := c.Response().Header()
+	h.Set("ETag", fmt.Sprintf("%q", obj.Cid.CID.String()))
+	h.Set("Last-Modified", obj.RefCreate.UTC().Format(http.TimeFormat))
+	h.Set("X-Amz-Meta-Cid", obj.Cid.CID.String())
+}
+
+// handleS3GetObject serves objects stored here, and redirects to the
+// gateway of the shuttle holding the others
+func (s *Server) handleS3GetObject(c echo.Context, u *User) error {
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	key, err := s3Key(c)
+	if err != nil {
+		return err
+	}
+
+	obj, err := s.s3Object(col, key)
+	if err != nil {
+		return err
+	}
+
+	if obj.Offloaded {
+		return &s3Error{Status: http.StatusForbidden, Code: "InvalidObjectState", Message: "object has been offloaded and must be retrieved first"}
+	}
+
+	s.setS3ObjectHeaders(c, obj)
+	if obj.Location != constants.ContentLocationLocal {
+		if c.Request().Method == http.MethodHead {
+			c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(obj.Size, 10))
+			return c.NoContent(http.StatusOK)
+		}
+
+		redir, err := s.checkGatewayRedirect("ipfs", obj.Cid.CID, nil)
+		if err != nil {
+			return err
+		}
+		if redir != "" {
+			return c.Redirect(http.StatusTemporaryRedirect, redir)
+		}
+	}
+
+	ctx := c.Request().Context()
+	dserv := merkledag.NewDAGService(blockservice.New(s.Node.Blockstore, offline.Exchange(s.Node.Blockstore)))
+	nd, err := dserv.Get(ctx, obj.Cid.CID)
+	if err != nil {
+		return err
+	}
+
+	r, err := uio.NewDagReader(ctx, nd, dserv)
+	if err != nil {
+		return &s3Error{Status: http.StatusBadRequest, Code: "InvalidRequest", Message: fmt.Sprintf("object can not be read as a file: %s", err)}
+	}
+	defer r.Close()
+
+	http.ServeContent(c.Response(), c.Request(), path.Base(key), obj.RefCreate, r)
+	return nil
+}
+
+func (s *Server) handleS3DeleteObject(c echo.Context, u *User) error {
+	col, err := s.s3Bucket(u, c.Param("bucket"))
+	if err != nil {
+		return err
+	}
+
+	key, err := s3Key(c)
+	if err != nil {
+		return err
+	}
+
+	obj, err := s.s3Object(col, key)
+	if err != nil {
+		// deleting a missing key succeeds
+		if xerrors.As(err, new(*s3Error)) {
+			return c.NoContent(http.StatusNoContent)
+		}
+		return err
+	}
+
+	if err := s.DB.Where("collection = ? and path = ?", col.ID, "/"+key).Delete(&CollectionRef{}).Error; err != nil {
+		return err
+	}
+
+	// the content goes away with its last object
+	var refs int64
+	if err := s.DB.Model(CollectionRef{}).Where("content = ?", obj.ID).Count(&refs).Error; err != nil {
+		return err
+	}
+	if refs == 0 && obj.UserID == u.ID {
+		if err := s.DB.Model(&util.Content{}).Where("id = ?", obj.ID).Update("replace", true).Error; err != nil {
+			return err
+		}
+
+		go func() {
+			if err := s.CM.unpinContent(context.Background(), obj.ID); err != nil {
+				log.Errorf("could not unpinContent(%d): %s", obj.ID, err)
+			}
+		}()
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// s3LimitedReader fails reads once more than limit bytes have been read, and
+// remembers that it did so
+type s3LimitedReader struct {
+	r         io.Reader
+	limit     int64
+	remaining int64
+	exceeded  bool
+}
+
+func (lr *s3LimitedReader) Read(p []byte) (int, error) {
+	if lr.exceeded {
+		return 0, s3ErrEntityTooLarge(lr.limit)
+	}
+
+	// read one byte more than allowed to tell an object of exactly limit
+	// bytes from a larger one
+	if int64(len(p)) > lr.remaining+1 {
+		p = p[:lr.remaining+1]
+	}
+
+	n, err := lr.r.Read(p)
+	if int64(n) <= lr.remaining {
+		lr.remaining -= int64(n)
+		return n, err
+	}
+
+	n = int(lr.remaining)
+	lr.remaining = 0
+	lr.exceeded = true
+	return n, s3ErrEntityTooLarge(lr.limit)
+}
+
+// awsChunkedReader decodes the aws-chunked bodies S3 clients stream uploads
+// with, each chunk is prefixed with its hex size and signature:
+//
+//	<size>;chunk-signature=<sig>\r\n<data>\r\n ... 0;chunk-signature=<sig>\r\n\r\n
+type awsChunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func newAwsChunkedReader(r io.Reader) *awsChunkedReader {
+	return &awsChunkedReader{r: bufio.NewReader(r)}
+}
+
+func (cr *awsChunkedReader) Read(p []byte) (int, error) {
+	for cr.left == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+
+		line, err := cr.r.ReadString('\n')
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			// the line break after the data of the previous chunk
+			continue
+		}
+
+		size, err := strconv.ParseInt(strings.SplitN(line, ";", 2)[0], 16, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("invalid aws-chunked chunk header %q", line)
+		}
+		if size == 0 {
+			cr.done = true
+			continue
+		}
+		cr.left = size
+	}
+
+	if int64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.r.Read(p)
+	cr.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3AccessKey(t *testing.T) {
+	assert := assert.New(t)
+
+	req := httptest.NewRequest("GET", "/s3", nil)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=ESTKEYARY/20220701/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=abc")
+	assert.Equal("ESTKEYARY", s3AccessKey(req))
+
+	req.Header.Set("Authorization", "AWS ESTKEYARY:c2lnbmF0dXJl")
+	assert.Equal("ESTKEYARY", s3AccessKey(req))
+
+	req = httptest.NewRequest("GET", "/s3/bucket/key?X-Amz-Credential=ESTKEYARY%2F20220701%2Fus-east-1%2Fs3%2Faws4_request", nil)
+	assert.Equal("ESTKEYARY", s3AccessKey(req))
+
+	req = httptest.NewRequest("GET", "/s3", nil)
+	assert.Equal("", s3AccessKey(req))
+}
+
+func TestListS3Objects(t *testing.T) {
+	assert := assert.New(t)
+
+	var objs []s3Object
+	for _, p := range []string{"/a.txt", "/dir/b.txt", "/dir/c.txt", "/dir/sub/d.txt", "/e.txt"} {
+		objs = append(objs, s3Object{Content: util.Content{ID: 1}, Path: p})
+	}
+
+	keys := func(cs []s3Content) []string {
+		var out []string
+		for _, c := range cs {
+			out = append(out, c.Key)
+		}
+		return out
+	}
+
+	contents, prefixes, next := listS3Objects(objs, "", "", "", 1000)
+	assert.Equal([]string{"a.txt", "dir/b.txt", "dir/c.txt", "dir/sub/d.txt", "e.txt"}, keys(contents))
+	assert.Empty(prefixes)
+	assert.Equal("", next)
+
+	contents, prefixes, next = listS3Objects(objs, "", "/", "", 1000)
+	assert.Equal([]string{"a.txt", "e.txt"}, keys(contents))
+	assert.Equal([]s3CommonPrefix{{Prefix: "dir/"}}, prefixes)
+	assert.Equal("", next)
+
+	contents, prefixes, _ = listS3Objects(objs, "dir/", "/", "", 1000)
+	assert.Equal([]string{"dir/b.txt", "dir/c.txt"}, keys(contents))
+	assert.Equal([]s3CommonPrefix{{Prefix: "dir/sub/"}}, prefixes)
+
+	// paging continues after the last key or prefix of the previous page
+	contents, prefixes, next = listS3Objects(objs, "", "/", "", 2)
+	assert.Equal([]string{"a.txt"}, keys(contents))
+	assert.Equal("dir/", next)
+	contents, prefixes, next = listS3Objects(objs, "", "/", next, 2)
+	assert.Equal([]string{"e.txt"}, keys(contents))
+	assert.Empty(prefixes)
+	assert.Equal("", next)
+}
+
+func TestAwsChunkedReader(t *testing.T) {
+	body := "5;chunk-signature=aaa\r\nhello\r\n" +
+		"6;chunk-signature=bbb\r\n world\r\n" +
+		"0;chunk-signature=ccc\r\n\r\n"
+
+	out, err := io.ReadAll(newAwsChunkedReader(strings.NewReader(body)))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(out))
+
+	_, err = io.ReadAll(newAwsChunkedReader(strings.NewReader("5;chunk-signature=aaa\r\nhel")))
+	assert.Error(t, err)
+
+	_, err = io.ReadAll(newAwsChunkedReader(strings.NewReader("zz;chunk-signature=aaa\r\n")))
+	assert.Error(t, err)
+}
+
+func TestS3LimitedReader(t *testing.T) {
+	lr := &s3LimitedReader{r: strings.NewReader("hello"), limit: 5, remaining: 5}
+	out, err := io.ReadAll(lr)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(out))
+	assert.False(t, lr.exceeded)
+
+	lr = &s3LimitedReader{r: strings.NewReader("hello world"), limit: 5, remaining: 5}
+	out, err = io.ReadAll(lr)
+	assert.Error(t, err)
+	assert.Equal(t, "hello", string(out))
+	assert.True(t, lr.exceeded)
+}
@@ -11,11 +11,14 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 
+	"github.com/application-research/estuary/constants"
 	drpc "github.com/application-research/estuary/drpc"
 	"github.com/application-research/estuary/util"
 	"github.com/application-research/filclient"
 	"github.com/filecoin-project/go-address"
 	datatransfer "github.com/filecoin-project/go-data-transfer"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
@@ -34,6 +37,10 @@ type Shuttle struct {
 	Open bool
 
 	Priority int
+
+	// VerifiedDeals is the shuttle's choice of verified deals for its
+	// content, unset to follow the primary
+	VerifiedDeals *bool
 }
 
 type ShuttleConnection struct {
@@ -43,15 +50,52 @@ type ShuttleConnection struct {
 
 	hostname string
 	addrInfo peer.AddrInfo
-	address  address.Address
 
-	private bool
+	// address is the wallet address the shuttle makes deals with,
+	// retrievalAddress the one it pays for retrievals from
+	address          address.Address
+	retrievalAddress address.Address
+
+	private       bool
+	verifiedDeals *bool
+
+	// tieringMinDeals is how many sealed deals content needs before the
+	// shuttle wants to hear about them, zero if it does not tier content
+	tieringMinDeals int
+
+	// aggregateMaxSize is the size up to which the shuttle aggregates its
+	// content itself, zero if it leaves that to the staging zones
+	aggregateMaxSize int64
+
+	// set once the shuttle said goodbye, no new content should be placed
+	// on it
+	shuttingDown bool
+
+	// addingPaused is set while the shuttle refuses new content because its
+	// disks are past their high watermark
+	addingPaused bool
+
+	// draining is set while the shuttle is being emptied, its content is
+	// moved to other shuttles
+	draining bool
+
+	// region and storageClass are labels from the shuttle's config
+	region       string
+	storageClass string
 
 	spaceLow       bool
 	blockstoreSize uint64
 	blockstoreFree uint64
 	pinCount       int64
 	pinQueueLength int64
+
+	// overloaded is set while the shuttle reports running at full cpu, new
+	// content goes elsewhere if possible
+	overloaded bool
+	lastUpdate *drpc.ShuttleUpdate
+
+	// webhooks is set if the shuttle delivers webhook events
+	webhooks bool
 }
 
 func (sc *ShuttleConnection) sendMessage(ctx context.Context, cmd *drpc.Command) error {
@@ -85,6 +129,7 @@ func (cm *ContentManager) registerShuttleConnection(handle string, hello *drpc.H
 		"peer_id":         hello.AddrInfo.ID.String(),
 		"last_connection": time.Now(),
 		"private":         hello.Private,
+		"verified_deals":  hello.VerifiedDeals,
 	}).Error; err != nil {
 		return nil, nil, err
 	}
@@ -99,6 +144,16 @@ func (cm *ContentManager) registerShuttleConnection(handle string, hello *drpc.H
 		cmds:     make(chan *drpc.Command, 32),
 		ctx:      ctx,
 		private:  hello.Private,
+
+		retrievalAddress: hello.RetrievalAddress,
+
+		verifiedDeals:    hello.VerifiedDeals,
+		tieringMinDeals:  hello.TieringMinDeals,
+		aggregateMaxSize: hello.AggregateMaxSize,
+		draining:         hello.Draining,
+		region:           hello.Region,
+		storageClass:     hello.StorageClass,
+		webhooks:         hello.Webhooks,
 	}
 
 	// when a shuttle connects, refresh its pin queue
@@ -112,21 +167,136 @@ func (cm *ContentManager) registerShuttleConnection(handle string, hello *drpc.H
 
 	cm.shuttles[handle] = sc
 
+	if cm.Node != nil && cm.Node.Peering != nil && hello.AddrInfo.ID != "" {
+		cm.Node.Peering.AddTransientPeer(hello.AddrInfo)
+	}
+	go cm.updateShuttlePeers(context.Background())
+
 	return sc.cmds, func() {
 		cancel()
 		cm.shuttlesLk.Lock()
 		outd, ok := cm.shuttles[handle]
-		if ok {
-			if outd == sc {
-				delete(cm.shuttles, handle)
-			}
+		removed := ok && outd == sc
+		if removed {
+			delete(cm.shuttles, handle)
 		}
 		cm.shuttlesLk.Unlock()
+
+		if removed {
+			if cm.Node != nil && cm.Node.Peering != nil && sc.addrInfo.ID != "" {
+				cm.Node.Peering.RemoveTransientPeer(sc.addrInfo.ID)
+			}
+			go cm.updateShuttlePeers(context.Background())
+		}
 	}, nil
 }
 
+// updateShuttlePeers tells every connected shuttle to stay peered with the
+// primary and the other shuttles, so pins can be fetched from siblings
+// without a dht lookup first
+func (cm *ContentManager) updateShuttlePeers(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	var primary []peer.AddrInfo
+	if cm.Host != nil {
+		primary = append(primary, peer.AddrInfo{ID: cm.Host.ID(), Addrs: cm.Host.Addrs()})
+	}
+
+	cm.shuttlesLk.Lock()
+	conns := make([]*ShuttleConnection, 0, len(cm.shuttles))
+	for _, sc := range cm.shuttles {
+		conns = append(conns, sc)
+	}
+	cm.shuttlesLk.Unlock()
+
+	for _, sc := range conns {
+		peers := append([]peer.AddrInfo{}, primary...)
+		for _, o := range conns {
+			if o != sc && o.addrInfo.ID != "" && o.addrInfo.ID != sc.addrInfo.ID {
+				peers = append(peers, o.addrInfo)
+			}
+		}
+
+		if err := sc.sendMessage(ctx, &drpc.Command{
+			Op: drpc.CMD_SetPeers,
+			Params: drpc.CmdParams{
+				SetPeers: &drpc.SetPeers{Peers: peers},
+			},
+		}); err != nil {
+			log.Warnf("failed to send peers to shuttle %s: %s", sc.handle, err)
+		}
+	}
+}
+
 var ErrNilParams = fmt.Errorf("shuttle message had nil params")
 
+type shuttleMessageKey struct {
+	handle string
+	id     uint64
+}
+
+// incomingShuttleMessage is a message read from a shuttle connection, the
+// result of processing it is sent on done
+type incomingShuttleMessage struct {
+	msg  *drpc.Message
+	done chan error
+}
+
+// receiveShuttleMessage hands msg to the message handlers and waits until it
+// is processed, or stop is closed. It reports whether msg can be
+// acknowledged, which is once it was processed successfully, now or before.
+// Shuttles keep messages on disk until we acknowledge them and resend them
+// after reconnecting, so failed messages are retried and acks lost with a
+// connection lead to duplicates, which are skipped.
+func (cm *ContentManager) receiveShuttleMessage(msg *drpc.Message, stop <-chan struct{}) bool {
+	key := shuttleMessageKey{handle: msg.Handle, id: msg.ID}
+	if msg.ID != 0 {
+		if cm.rpcSeen.Contains(key) {
+			return true
+		}
+
+		// a resend of a message still being processed is acknowledged
+		// along with the original
+		cm.rpcInflightLk.Lock()
+		if cm.rpcInflight[key] {
+			cm.rpcInflightLk.Unlock()
+			return false
+		}
+		cm.rpcInflight[key] = true
+		cm.rpcInflightLk.Unlock()
+
+		defer func() {
+			cm.rpcInflightLk.Lock()
+			delete(cm.rpcInflight, key)
+			cm.rpcInflightLk.Unlock()
+		}()
+	}
+
+	done := make(chan error, 1)
+	select {
+	case cm.IncomingRPCMessages <- &incomingShuttleMessage{msg: msg, done: done}:
+	case <-stop:
+		return false
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Errorf("failed to process message from shuttle: %s", err)
+			return false
+		}
+	case <-stop:
+		return false
+	}
+
+	if msg.ID == 0 {
+		return false
+	}
+	cm.rpcSeen.Add(key, nil)
+	return true
+}
+
 func (cm *ContentManager) handleShuttleMessages(ctx context.Context, numHandlers int) {
 	for i := 1; i <= numHandlers; i++ {
 		go func() {
@@ -134,10 +304,8 @@ func (cm *ContentManager) handleShuttleMessages(ctx context.Context, numHandlers
 				select {
 				case <-ctx.Done():
 					return
-				case msg := <-cm.IncomingRPCMessages:
-					if err := cm.processShuttleMessage(msg.Handle, msg); err != nil {
-						log.Errorf("failed to process message from shuttle: %s", err)
-					}
+				case in := <-cm.IncomingRPCMessages:
+					in.done <- cm.processShuttleMessage(in.msg.Handle, in.msg)
 				}
 			}
 		}()
@@ -163,7 +331,23 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 		if ups == nil {
 			return ErrNilParams
 		}
-		return cm.UpdatePinStatus(handle, ups.DBID, ups.Status)
+		return cm.UpdatePinStatus(handle, ups.DBID, ups.Status, ups.Reason)
+	case drpc.OP_PinAbandoned:
+		param := msg.Params.PinAbandoned
+		if param == nil {
+			return ErrNilParams
+		}
+
+		log.Warnw("shuttle gave up on pin", "shuttle", handle, "content", param.DBID, "attempts", param.Attempts, "errors", param.Errors)
+		return nil
+	case drpc.OP_PinProgress:
+		param := msg.Params.PinProgress
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handlePinProgress(param)
+		return nil
 	case drpc.OP_PinComplete:
 		param := msg.Params.PinComplete
 		if param == nil {
@@ -174,6 +358,34 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 			log.Errorw("handling pin complete message failed", "shuttle", handle, "err", err)
 		}
 		return nil
+	case drpc.OP_PinCompleteBegin:
+		param := msg.Params.PinCompleteBegin
+		if param == nil {
+			return ErrNilParams
+		}
+
+		return cm.updatePartialPin(ctx, handle, param.DBID, func(pp *partialPin) error {
+			return pp.begin(param)
+		})
+	case drpc.OP_PinCompletePart:
+		param := msg.Params.PinCompletePart
+		if param == nil {
+			return ErrNilParams
+		}
+
+		return cm.updatePartialPin(ctx, handle, param.DBID, func(pp *partialPin) error {
+			return pp.addPart(param)
+		})
+	case drpc.OP_PinCompleteCommit:
+		param := msg.Params.PinCompleteCommit
+		if param == nil {
+			return ErrNilParams
+		}
+
+		return cm.updatePartialPin(ctx, handle, param.DBID, func(pp *partialPin) error {
+			pp.committed = true
+			return nil
+		})
 	case drpc.OP_CommPComplete:
 		param := msg.Params.CommPComplete
 		if param == nil {
@@ -204,6 +416,24 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 			log.Errorf("handling transfer status message from shuttle %s: %s", handle, err)
 		}
 		return nil
+	case drpc.OP_ContentMigrated:
+		param := msg.Params.ContentMigrated
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcContentMigrated(ctx, handle, param); err != nil {
+			log.Errorf("handling content migrated message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_TransferRestarted:
+		param := msg.Params.TransferRestarted
+		if param == nil {
+			return ErrNilParams
+		}
+
+		cm.handleRpcTransferRestarted(ctx, handle, param)
+		return nil
 	case drpc.OP_ShuttleUpdate:
 		param := msg.Params.ShuttleUpdate
 		if param == nil {
@@ -234,6 +464,56 @@ func (cm *ContentManager) processShuttleMessage(handle string, msg *drpc.Message
 			log.Errorf("handling split complete message from shuttle %s: %s", handle, err)
 		}
 		return nil
+	case drpc.OP_ContentExpired:
+		param := msg.Params.ContentExpired
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcContentExpired(ctx, handle, param); err != nil {
+			log.Errorf("handling content expired message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_ContentRemoved:
+		param := msg.Params.ContentRemoved
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcContentRemoved(ctx, handle, param); err != nil {
+			log.Errorf("handling content removed message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_AggregateStaged:
+		param := msg.Params.AggregateStaged
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcAggregateStaged(ctx, handle, param); err != nil {
+			log.Errorf("handling aggregate staged message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_WalletAddresses:
+		param := msg.Params.WalletAddresses
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcWalletAddresses(ctx, handle, param); err != nil {
+			log.Errorf("handling wallet addresses message from shuttle %s: %s", handle, err)
+		}
+		return nil
+	case drpc.OP_Goodbye:
+		param := msg.Params.Goodbye
+		if param == nil {
+			return ErrNilParams
+		}
+
+		if err := cm.handleRpcGoodbye(ctx, handle, param); err != nil {
+			log.Errorf("handling goodbye message from shuttle %s: %s", handle, err)
+		}
+		return nil
 	default:
 		return fmt.Errorf("unrecognized message op: %q", msg.Op)
 	}
@@ -256,6 +536,42 @@ func (cm *ContentManager) sendShuttleCommand(ctx context.Context, handle string,
 	return ErrNoShuttleConnection
 }
 
+// broadcastShuttleCommand sends cmd to every connected shuttle, logging
+// the shuttles it could not be delivered to
+func (cm *ContentManager) broadcastShuttleCommand(ctx context.Context, cmd *drpc.Command) {
+	cm.shuttlesLk.Lock()
+	handles := make([]string, 0, len(cm.shuttles))
+	for h := range cm.shuttles {
+		handles = append(handles, h)
+	}
+	cm.shuttlesLk.Unlock()
+
+	for _, h := range handles {
+		if err := cm.sendShuttleCommand(ctx, h, cmd); err != nil {
+			log.Warnf("failed to send %s command to shuttle %s: %s", cmd.Op, h, err)
+		}
+	}
+}
+
+// invalidateShuttleAuth makes shuttles drop cached auth results for the
+// given tokens so revoked tokens stop working there right away
+func (cm *ContentManager) invalidateShuttleAuth(ctx context.Context, userID uint, tokens ...string) {
+	hashes := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		hashes = append(hashes, util.GetTokenHash(t))
+	}
+
+	cm.broadcastShuttleCommand(ctx, &drpc.Command{
+		Op: drpc.CMD_InvalidateAuth,
+		Params: drpc.CmdParams{
+			InvalidateAuth: &drpc.InvalidateAuth{
+				TokenHashes: hashes,
+				UserID:      userID,
+			},
+		},
+	})
+}
+
 func (cm *ContentManager) shuttleIsOnline(handle string) bool {
 	cm.shuttlesLk.Lock()
 	sc, ok := cm.shuttles[handle]
@@ -272,6 +588,42 @@ func (cm *ContentManager) shuttleIsOnline(handle string) bool {
 	}
 }
 
+// shuttleVerifiedDeals returns whether the shuttle asked for verified deals
+// for its content, nil if it has no preference or isnt connected
+func (cm *ContentManager) shuttleVerifiedDeals(handle string) *bool {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	if ok {
+		return d.verifiedDeals
+	}
+	return nil
+}
+
+// shuttleAggregateMaxSize returns the size up to which the shuttle
+// aggregates content itself, zero if it does not
+func (cm *ContentManager) shuttleAggregateMaxSize(handle string) int64 {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	if ok {
+		return d.aggregateMaxSize
+	}
+	return 0
+}
+
+// shuttleTieringMinDeals returns how many sealed deals content needs before
+// the shuttle holding it tiers it, zero if it does not tier content
+func (cm *ContentManager) shuttleTieringMinDeals(handle string) int {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	if ok {
+		return d.tieringMinDeals
+	}
+	return 0
+}
+
 func (cm *ContentManager) shuttleAddrInfo(handle string) *peer.AddrInfo {
 	cm.shuttlesLk.Lock()
 	defer cm.shuttlesLk.Unlock()
@@ -300,12 +652,71 @@ func (cm *ContentManager) shuttleStorageStats(handle string) *util.ShuttleStorag
 		return nil
 	}
 
-	return &util.ShuttleStorageStats{
+	stats := &util.ShuttleStorageStats{
 		BlockstoreSize: d.blockstoreSize,
 		BlockstoreFree: d.blockstoreFree,
 		PinCount:       d.pinCount,
 		PinQueueLength: d.pinQueueLength,
 	}
+	if d.lastUpdate != nil {
+		for _, disk := range d.lastUpdate.BlockstoreDisks {
+			stats.Disks = append(stats.Disks, util.ShuttleDiskStats{
+				Dir:  disk.Dir,
+				Size: disk.Size,
+				Free: disk.Free,
+			})
+		}
+	}
+	return stats
+}
+
+func (cm *ContentManager) shuttleStats(handle string) *util.ShuttleStats {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	if !ok || d.lastUpdate == nil {
+		return nil
+	}
+
+	upd := d.lastUpdate
+	st := &util.ShuttleStats{
+		Version:         upd.Version,
+		CPUUsage:        upd.CPUUsage,
+		NumCPU:          upd.NumCPU,
+		MemoryUsed:      upd.MemoryUsed,
+		ActiveTransfers: upd.ActiveTransfers,
+		TransferRate:    upd.TransferRate,
+		PinFailures:     upd.PinFailures,
+		CommandFailures: upd.CommandFailures,
+		SendErrors:      upd.SendErrors,
+		Overloaded:      d.overloaded,
+		Draining:        d.draining,
+		Region:          d.region,
+		StorageClass:    d.storageClass,
+		IngestRate:      upd.IngestRate,
+		FreeSpaceTrend:  upd.FreeSpaceTrend,
+	}
+	if upd.Bitswap != nil {
+		st.BitswapPeers = upd.Bitswap.Peers
+		st.BitswapDataSent = upd.Bitswap.DataSent
+		st.BitswapDataReceived = upd.Bitswap.DataReceived
+	}
+	if upd.Provider != nil {
+		st.ProvideStrategy = upd.Provider.Strategy
+		st.ProvideQueueLength = upd.Provider.QueueLength
+		st.LastReprovide = upd.Provider.LastReprovide
+		st.ProvideFailures = upd.Provider.Failures
+	}
+	if m := upd.Market; m != nil {
+		st.Market = &util.ShuttleMarketBalance{
+			Address:   m.Address,
+			Balance:   types.FIL(m.Balance),
+			Escrow:    types.FIL(m.Escrow),
+			Locked:    types.FIL(m.Locked),
+			Available: types.FIL(big.Sub(m.Escrow, m.Locked)),
+		}
+	}
+	return st
 }
 
 func (cm *ContentManager) handleRpcCommPComplete(ctx context.Context, handle string, resp *drpc.CommPComplete) error {
@@ -385,6 +796,67 @@ func (cm *ContentManager) handleRpcTransferStatus(ctx context.Context, handle st
 	return nil
 }
 
+// handleRpcTransferRestarted logs the restarts of deal transfers a shuttle
+// does on its own, the deal is only failed once the shuttle gives up on it
+func (cm *ContentManager) handleRpcTransferRestarted(ctx context.Context, handle string, param *drpc.TransferRestarted) {
+	if param.Error != "" {
+		log.Warnw("shuttle failed to restart deal transfer", "shuttle", handle, "deal", param.DealDBID, "chanid", param.Chanid, "attempt", param.Attempt, "reason", param.Reason, "err", param.Error)
+		return
+	}
+	log.Infow("shuttle restarted deal transfer", "shuttle", handle, "deal", param.DealDBID, "chanid", param.Chanid, "attempt", param.Attempt, "reason", param.Reason)
+}
+
+// shuttleOverloadedCPU is the share of its cores a shuttle has to keep busy
+// to be considered overloaded
+const shuttleOverloadedCPU = 0.9
+
+// uploadHints is what uploads are pointed at a shuttle by, from its config
+// and its last update
+type uploadHints struct {
+	inRegion   bool
+	spaceLow   bool
+	overloaded bool
+
+	// untilFull is how long the shuttle lasts at the rate its free space
+	// goes down, zero if it does not go down
+	untilFull time.Duration
+}
+
+func (sc *ShuttleConnection) uploadHints(region string) uploadHints {
+	h := uploadHints{
+		inRegion:   region != "" && sc.region == region,
+		spaceLow:   sc.spaceLow,
+		overloaded: sc.overloaded,
+	}
+	if sc.lastUpdate != nil && sc.lastUpdate.FreeSpaceTrend < 0 {
+		h.untilFull = time.Duration(float64(sc.blockstoreFree)/float64(-sc.lastUpdate.FreeSpaceTrend)) * time.Second
+	}
+	return h
+}
+
+// better reports whether a shuttle with hints h and the given priority is a
+// better place for uploads than one with hints o. Shuttles in the region of
+// the upload come first, then ones with space and spare cpu, then those the
+// operator prefers, then the ones that fill up last.
+func (h uploadHints) better(o uploadHints, prio, oprio int) bool {
+	if h.inRegion != o.inRegion {
+		return h.inRegion
+	}
+	if h.spaceLow != o.spaceLow {
+		return o.spaceLow
+	}
+	if h.overloaded != o.overloaded {
+		return o.overloaded
+	}
+	if prio != oprio {
+		return prio > oprio
+	}
+	if (h.untilFull == 0) != (o.untilFull == 0) {
+		return h.untilFull == 0
+	}
+	return h.untilFull > o.untilFull
+}
+
 func (cm *ContentManager) handleRpcShuttleUpdate(ctx context.Context, handle string, param *drpc.ShuttleUpdate) error {
 	cm.shuttlesLk.Lock()
 	defer cm.shuttlesLk.Unlock()
@@ -394,14 +866,75 @@ func (cm *ContentManager) handleRpcShuttleUpdate(ctx context.Context, handle str
 	}
 
 	d.spaceLow = (param.BlockstoreFree < (param.BlockstoreSize / 10))
+	// blocks are spread evenly, so one full disk is enough to fail writes
+	for _, disk := range param.BlockstoreDisks {
+		if disk.Free < disk.Size/10 {
+			d.spaceLow = true
+		}
+	}
+	if param.AddingPaused != d.addingPaused {
+		log.Infow("shuttle changed whether it takes new content", "shuttle", handle, "paused", param.AddingPaused)
+	}
+	d.addingPaused = param.AddingPaused
+	if param.Draining != d.draining {
+		log.Infow("shuttle changed whether it is draining", "shuttle", handle, "draining", param.Draining)
+	}
+	d.draining = param.Draining
 	d.blockstoreFree = param.BlockstoreFree
 	d.blockstoreSize = param.BlockstoreSize
 	d.pinCount = param.NumPins
 	d.pinQueueLength = int64(param.PinQueueSize)
+	d.overloaded = param.NumCPU > 0 && param.CPUUsage > shuttleOverloadedCPU*float64(param.NumCPU)
+	if ic := param.Integrity; ic != nil && ic.Corrupted+ic.Missing > ic.Repaired {
+		if d.lastUpdate == nil || d.lastUpdate.Integrity == nil || !d.lastUpdate.Integrity.Finished.Equal(ic.Finished) {
+			log.Warnw("shuttle integrity check found blocks it could not repair", "shuttle", handle,
+				"corrupted", ic.Corrupted, "missing", ic.Missing, "repaired", ic.Repaired, "flaggedPins", ic.FlaggedPins)
+		}
+	}
+	d.lastUpdate = param
+
+	return nil
+}
+
+func (cm *ContentManager) handleRpcGoodbye(ctx context.Context, handle string, param *drpc.Goodbye) error {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	if !ok {
+		return fmt.Errorf("shuttle connection not found while handling goodbye for %q", handle)
+	}
 
+	log.Infow("shuttle is shutting down", "shuttle", handle, "reason", param.Reason)
+	d.shuttingDown = true
 	return nil
 }
 
+func (cm *ContentManager) handleRpcWalletAddresses(ctx context.Context, handle string, param *drpc.WalletAddresses) error {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	if !ok {
+		return fmt.Errorf("shuttle connection not found while handling wallet addresses for %q", handle)
+	}
+
+	log.Infow("shuttle wallet addresses changed", "shuttle", handle, "deals", param.Deals, "retrieval", param.Retrieval)
+	d.address = param.Deals
+	d.retrievalAddress = param.Retrieval
+	return nil
+}
+
+// shuttleWalletAddrs returns the deal and retrieval wallet addresses of a
+// connected shuttle
+func (cm *ContentManager) shuttleWalletAddrs(handle string) (address.Address, address.Address) {
+	cm.shuttlesLk.Lock()
+	defer cm.shuttlesLk.Unlock()
+	d, ok := cm.shuttles[handle]
+	if !ok {
+		return address.Undef, address.Undef
+	}
+	return d.address, d.retrievalAddress
+}
+
 func (cm *ContentManager) handleRpcGarbageCheck(ctx context.Context, handle string, param *drpc.GarbageCheck) error {
 	var tounpin []uint
 	for _, c := range param.Contents {
@@ -422,6 +955,131 @@ func (cm *ContentManager) handleRpcGarbageCheck(ctx context.Context, handle stri
 	return cm.sendUnpinCmd(ctx, handle, tounpin)
 }
 
+// handleRpcContentExpired removes the records of contents a shuttle unpinned
+// because they expired, the same way deleting them through the api does
+func (cm *ContentManager) handleRpcContentExpired(ctx context.Context, handle string, param *drpc.ContentExpired) error {
+	return cm.removeShuttleContents(ctx, handle, "expired", param.Contents)
+}
+
+// handleRpcContentRemoved removes the records of contents whose pins were
+// deleted through the pinning api of a shuttle
+func (cm *ContentManager) handleRpcContentRemoved(ctx context.Context, handle string, param *drpc.ContentRemoved) error {
+	return cm.removeShuttleContents(ctx, handle, "removed", param.Contents)
+}
+
+// removeShuttleContents removes the records of contents the shuttle at handle
+// already unpinned, why tells the logs what happened to them
+func (cm *ContentManager) removeShuttleContents(ctx context.Context, handle string, why string, contents []uint) error {
+	for _, c := range contents {
+		var cont util.Content
+		if err := cm.DB.First(&cont, "id = ?", c).Error; err != nil {
+			if xerrors.Is(err, gorm.ErrRecordNotFound) {
+				continue
+			}
+			return err
+		}
+
+		if cont.Location != handle {
+			log.Warnw("shuttle reported content it does not hold as "+why, "shuttle", handle, "content", c, "location", cont.Location)
+			continue
+		}
+
+		if err := cm.DB.Model(&util.Content{}).Where("id = ?", c).Update("replace", true).Error; err != nil {
+			return err
+		}
+
+		if err := cm.unpinContent(ctx, c); err != nil {
+			return fmt.Errorf("failed to remove %s content %d: %w", why, c, err)
+		}
+	}
+	return nil
+}
+
+// handleRpcContentMigrated moves content to the shuttle that took it once
+// all of it is there, and has the shuttle it came from release its copy
+func (cm *ContentManager) handleRpcContentMigrated(ctx context.Context, handle string, param *drpc.ContentMigrated) error {
+	var cont util.Content
+	if err := cm.DB.First(&cont, "id = ?", param.Content).Error; err != nil {
+		return err
+	}
+
+	if cont.Location != param.From {
+		// already moved, or moved elsewhere since
+		return nil
+	}
+
+	if err := cm.DB.Model(util.Content{}).Where("id = ?", cont.ID).UpdateColumn("location", handle).Error; err != nil {
+		return err
+	}
+	log.Infow("content migrated between shuttles", "content", cont.ID, "from", param.From, "to", handle)
+
+	if param.From == constants.ContentLocationLocal {
+		// blocks on the primary are left to its garbage collection
+		return nil
+	}
+	return cm.sendUnpinCmd(ctx, param.From, []uint{cont.ID})
+}
+
+// handleRpcAggregateStaged creates the content of an aggregate a shuttle made
+// of small contents and tells the shuttle to pin it. Contents that were
+// aggregated here in the meantime stay in the aggregate they are in.
+func (cm *ContentManager) handleRpcAggregateStaged(ctx context.Context, handle string, param *drpc.AggregateStaged) error {
+	var existing util.Content
+	err := cm.DB.First(&existing, "cid = ? and location = ? and aggregate", util.DbCID{CID: param.Root}, handle).Error
+	switch {
+	case err == nil:
+		// the shuttle sent it again before hearing back
+		var ids []uint
+		if err := cm.DB.Model(util.Content{}).Where("aggregated_in = ?", existing.ID).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		return cm.sendAggregateCmd(ctx, handle, existing, ids, param.ObjData)
+	case !xerrors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	}
+
+	var conts []util.Content
+	if err := cm.DB.Find(&conts, "id in ? and user_id = ? and location = ? and active", param.Contents, param.UserID, handle).Error; err != nil {
+		return err
+	}
+
+	var ids []uint
+	for _, c := range conts {
+		if c.AggregatedIn > 0 {
+			log.Warnw("shuttle aggregated content that is already aggregated", "shuttle", handle, "content", c.ID, "aggregatedIn", c.AggregatedIn)
+			continue
+		}
+		ids = append(ids, c.ID)
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("none of the %d contents of aggregate %s can be aggregated", len(param.Contents), param.Root)
+	}
+
+	content := &util.Content{
+		Cid:         util.DbCID{CID: param.Root},
+		Size:        param.Size,
+		Name:        "aggregate",
+		Active:      false,
+		Pinning:     true,
+		UserID:      param.UserID,
+		Replication: cm.Replication,
+		Aggregate:   true,
+		Location:    handle,
+	}
+	if err := cm.DB.Create(content).Error; err != nil {
+		return err
+	}
+
+	if err := cm.DB.Model(util.Content{}).
+		Where("id in ? and aggregated_in = 0", ids).
+		UpdateColumn("aggregated_in", content.ID).Error; err != nil {
+		return err
+	}
+
+	log.Infow("shuttle aggregated content", "shuttle", handle, "aggregate", content.ID, "contents", len(ids), "size", param.Size)
+	return cm.sendAggregateCmd(ctx, handle, *content, ids, param.ObjData)
+}
+
 func (cm *ContentManager) handleRpcSplitComplete(ctx context.Context, handle string, param *drpc.SplitComplete) error {
 	if param.ID == 0 {
 		return fmt.Errorf("split complete send with ID = 0")
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadHints(t *testing.T) {
+	filling := &ShuttleConnection{region: "eu", blockstoreFree: 3600, lastUpdate: &drpc.ShuttleUpdate{FreeSpaceTrend: -1}}
+	assert.Equal(t, time.Hour, filling.uploadHints("eu").untilFull)
+	assert.True(t, filling.uploadHints("eu").inRegion)
+	assert.False(t, filling.uploadHints("").inRegion)
+
+	steady := &ShuttleConnection{region: "us", blockstoreFree: 100}
+	assert.False(t, steady.uploadHints("eu").better(filling.uploadHints("eu"), 0, 0), "region was not preferred")
+	assert.True(t, steady.uploadHints("").better(filling.uploadHints(""), 0, 0), "shuttle that does not fill up was not preferred")
+	assert.True(t, filling.uploadHints("").better(steady.uploadHints(""), 1, 0), "priority was not preferred")
+
+	steady.spaceLow = true
+	assert.True(t, filling.uploadHints("").better(steady.uploadHints(""), 0, 1), "shuttle low on space was preferred")
+}
+
+func TestReceiveShuttleMessageAcksOnceProcessed(t *testing.T) {
+	rpcSeen, err := lru.New(10)
+	require.NoError(t, err)
+	cm := &ContentManager{
+		rpcSeen:             rpcSeen,
+		rpcInflight:         make(map[shuttleMessageKey]bool),
+		IncomingRPCMessages: make(chan *incomingShuttleMessage),
+	}
+
+	var processed int
+	fail := true
+	go func() {
+		for in := range cm.IncomingRPCMessages {
+			processed++
+			if fail {
+				in.done <- fmt.Errorf("database is down")
+				continue
+			}
+			in.done <- nil
+		}
+	}()
+	defer close(cm.IncomingRPCMessages)
+
+	stop := make(chan struct{})
+	msg := &drpc.Message{ID: 7, Handle: "shuttle"}
+	assert.False(t, cm.receiveShuttleMessage(msg, stop), "failed messages may not be acknowledged")
+
+	fail = false
+	assert.True(t, cm.receiveShuttleMessage(msg, stop), "the resend was not processed")
+	assert.True(t, cm.receiveShuttleMessage(msg, stop), "duplicates of processed messages are acknowledged")
+	assert.Equal(t, 2, processed, "duplicates of processed messages are processed again")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/constants"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+)
+
+// maxSignedBody bounds the body of requests signed by shuttles, which are
+// small json documents
+const maxSignedBody = 4 << 20
+
+// shuttleSignatureMiddleware checks the signature of requests shuttles make
+// on behalf of users and notes the shuttle in the context, see
+// util.SignShuttleRequest. Requests without a signature pass through.
+func (s *Server) shuttleSignatureMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		handle := r.Header.Get(util.ShuttleHandleHeader)
+		if handle == "" {
+			return next(c)
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+		if err != nil {
+			return err
+		}
+		if len(body) > maxSignedBody {
+			return &util.HttpError{
+				Code:    http.StatusRequestEntityTooLarge,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("signed requests are limited to %d bytes", maxSignedBody),
+			}
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var sh Shuttle
+		if err := s.DB.First(&sh, "handle = ?", handle).Error; err != nil {
+			log.Warnw("signed request from unknown shuttle", "handle", handle)
+			return &util.HttpError{
+				Code:    http.StatusUnauthorized,
+				Reason:  util.ERR_NOT_AUTHORIZED,
+				Details: "request signed by unknown shuttle",
+			}
+		}
+
+		userToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if err := util.VerifyShuttleRequest(r, sh.Token, body, userToken, time.Now()); err != nil {
+			log.Warnw("shuttle request signature rejected", "handle", handle, "path", r.URL.Path, "err", err)
+			return &util.HttpError{
+				Code:    http.StatusUnauthorized,
+				Reason:  util.ERR_NOT_AUTHORIZED,
+				Details: fmt.Sprintf("invalid shuttle signature: %s", err),
+			}
+		}
+
+		c.Set("shuttle", handle)
+		return next(c)
+	}
+}
+
+// checkContentLocation makes sure content located on a shuttle is created
+// by that shuttle. Shuttles sign the requests they make for users, so a
+// shuttle cannot place content on another one.
+func (s *Server) checkContentLocation(c echo.Context, location string) error {
+	if location == "" || location == constants.ContentLocationLocal {
+		return nil
+	}
+
+	signer, _ := c.Get("shuttle").(string)
+	switch {
+	case signer == location:
+		return nil
+	case signer != "":
+		log.Warnw("shuttle tried to create content on another shuttle", "shuttle", signer, "location", location)
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: fmt.Sprintf("shuttle %s cannot create content on %s", signer, location),
+		}
+	case s.estuaryCfg.Content.RequireShuttleSignatures:
+		return &util.HttpError{
+			Code:    http.StatusForbidden,
+			Reason:  util.ERR_NOT_AUTHORIZED,
+			Details: "content on a shuttle has to be created with a request signed by it",
+		}
+	default:
+		return nil
+	}
+}
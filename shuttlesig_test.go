@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/application-research/estuary/config"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckContentLocation(t *testing.T) {
+	s := &Server{estuaryCfg: &config.Estuary{}}
+	e := echo.New()
+	newCtx := func(signer string) echo.Context {
+		c := e.NewContext(httptest.NewRequest("POST", "/content/create", nil), httptest.NewRecorder())
+		if signer != "" {
+			c.Set("shuttle", signer)
+		}
+		return c
+	}
+
+	assert.NoError(t, s.checkContentLocation(newCtx(""), "local"))
+	assert.NoError(t, s.checkContentLocation(newCtx(""), "SHUTTLE1HANDLE"), "unsigned requests were refused without requiring signatures")
+	assert.NoError(t, s.checkContentLocation(newCtx("SHUTTLE1HANDLE"), "SHUTTLE1HANDLE"))
+	assert.Error(t, s.checkContentLocation(newCtx("SHUTTLE2HANDLE"), "SHUTTLE1HANDLE"), "a shuttle created content on another")
+
+	s.estuaryCfg.Content.RequireShuttleSignatures = true
+	assert.Error(t, s.checkContentLocation(newCtx(""), "SHUTTLE1HANDLE"))
+	assert.NoError(t, s.checkContentLocation(newCtx("SHUTTLE1HANDLE"), "SHUTTLE1HANDLE"))
+	assert.NoError(t, s.checkContentLocation(newCtx(""), ""))
+}
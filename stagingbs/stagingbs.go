@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -73,3 +74,48 @@ func (sbmgr *StagingBSMgr) CleanUp(bsid BSID) error {
 
 	return os.RemoveAll(string(bsid))
 }
+
+// Usage is how many staging blockstores there are and how much disk they take
+type Usage struct {
+	Open  int   `json:"open"`
+	Dirs  int   `json:"dirs"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Usage walks the staging directory, blockstores left over from before a
+// restart are counted as dirs but not as open
+func (sbmgr *StagingBSMgr) Usage() (*Usage, error) {
+	sbmgr.olk.Lock()
+	u := &Usage{Open: len(sbmgr.open)}
+	sbmgr.olk.Unlock()
+
+	entries, err := ioutil.ReadDir(sbmgr.RootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		u.Dirs++
+
+		err := filepath.Walk(filepath.Join(sbmgr.RootDir, e.Name()), func(_ string, fi os.FileInfo, err error) error {
+			if err != nil {
+				// blockstores are cleaned up while we walk
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !fi.IsDir() {
+				u.Bytes += fi.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
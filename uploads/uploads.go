@@ -0,0 +1,323 @@
+package uploads
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/atomicfile"
+	"github.com/google/uuid"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("uploads")
+
+var (
+	ErrUploadNotFound  = errors.New("upload not found")
+	ErrOffsetMismatch  = errors.New("upload offset does not match current upload size")
+	ErrUploadLocked    = errors.New("upload is currently being written to")
+	ErrUploadTooLarge  = errors.New("upload data exceeds declared upload length")
+	ErrInvalidUploadID = errors.New("invalid upload id")
+)
+
+// Info describes a partial upload. It is persisted next to the upload data
+// so that uploads survive a restart of the shuttle.
+type Info struct {
+	ID        string            `json:"id"`
+	UserID    uint              `json:"userId"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// Manager keeps track of resumable uploads stored in a directory on disk.
+type Manager struct {
+	RootDir string
+
+	lk     sync.Mutex
+	active map[string]bool
+}
+
+func NewManager(dir string) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &Manager{
+		RootDir: dir,
+		active:  make(map[string]bool),
+	}, nil
+}
+
+func (m *Manager) infoPath(id string) string {
+	return filepath.Join(m.RootDir, id+".info")
+}
+
+func (m *Manager) dataPath(id string) string {
+	return filepath.Join(m.RootDir, id+".bin")
+}
+
+func validID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+// Create registers a new upload of the given length and returns its info.
+func (m *Manager) Create(user uint, length int64, meta map[string]string) (*Info, error) {
+	if length < 0 {
+		return nil, fmt.Errorf("invalid upload length: %d", length)
+	}
+
+	info := &Info{
+		ID:        uuid.New().String(),
+		UserID:    user,
+		Length:    length,
+		Metadata:  meta,
+		CreatedAt: time.Now(),
+	}
+
+	f, err := os.OpenFile(m.dataPath(info.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := m.writeInfo(info); err != nil {
+		_ = os.Remove(m.dataPath(info.ID))
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (m *Manager) writeInfo(info *Info) error {
+	f, err := atomicfile.New(m.infoPath(info.ID), 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(info); err != nil {
+		_ = f.Abort()
+		return err
+	}
+	return f.Close()
+}
+
+// Get returns the info for the upload with the given id.
+func (m *Manager) Get(id string) (*Info, error) {
+	if !validID(id) {
+		return nil, ErrInvalidUploadID
+	}
+
+	data, err := ioutil.ReadFile(m.infoPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+
+	var info Info
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("failed to decode upload info for %s: %w", id, err)
+	}
+	return &info, nil
+}
+
+// Offset returns the number of bytes received so far for the given upload.
+func (m *Manager) Offset(id string) (int64, error) {
+	if !validID(id) {
+		return 0, ErrInvalidUploadID
+	}
+
+	st, err := os.Stat(m.dataPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrUploadNotFound
+		}
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+func (m *Manager) lock(id string) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.active[id] {
+		return ErrUploadLocked
+	}
+	m.active[id] = true
+	return nil
+}
+
+func (m *Manager) unlock(id string) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	delete(m.active, id)
+}
+
+// CompleteFunc is called with the data of an upload once all of it was
+// received. The upload is removed when it returns without an error.
+type CompleteFunc func(info *Info, data *os.File) error
+
+// Append writes the data from r to the upload, starting at the given offset.
+// Whatever was successfully written is kept on disk even if reading from r
+// fails, so that the client may resume from the new offset. The new offset
+// is returned.
+//
+// If the upload is complete after the write, complete is called before the
+// upload is unlocked, so concurrent requests finishing the same upload can
+// not both import it. An error from complete is returned as is and the data
+// is kept so the client can retry with an empty chunk at the final offset.
+func (m *Manager) Append(id string, offset int64, r io.Reader, complete CompleteFunc) (int64, error) {
+	info, err := m.Get(id)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := m.lock(id); err != nil {
+		return 0, err
+	}
+	defer m.unlock(id)
+
+	// the upload may have been completed and removed while we waited
+	cur, err := m.Offset(id)
+	if err != nil {
+		return 0, err
+	}
+
+	if cur != offset {
+		return cur, ErrOffsetMismatch
+	}
+
+	f, err := os.OpenFile(m.dataPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return cur, err
+	}
+
+	remaining := info.Length - cur
+	n, copyErr := io.Copy(f, io.LimitReader(r, remaining))
+	if err := f.Close(); err != nil {
+		return cur + n, err
+	}
+
+	if copyErr != nil {
+		return cur + n, copyErr
+	}
+
+	if n == remaining {
+		// make sure the client isnt sending more than it told us about
+		var extra [1]byte
+		if k, _ := r.Read(extra[:]); k > 0 {
+			return cur + n, ErrUploadTooLarge
+		}
+	}
+
+	if cur+n < info.Length || complete == nil {
+		return cur + n, nil
+	}
+
+	data, err := os.Open(m.dataPath(id))
+	if err != nil {
+		return cur + n, err
+	}
+	defer data.Close()
+
+	if err := complete(info, data); err != nil {
+		return cur + n, err
+	}
+
+	if err := m.remove(id); err != nil {
+		log.Errorf("failed to remove completed upload %s: %s", id, err)
+	}
+	return cur + n, nil
+}
+
+// Open returns a reader over the data received for the given upload.
+func (m *Manager) Open(id string) (*os.File, error) {
+	if !validID(id) {
+		return nil, ErrInvalidUploadID
+	}
+
+	f, err := os.Open(m.dataPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// Remove deletes all state for the given upload. It fails with
+// ErrUploadLocked while data is being written to the upload or it is being
+// imported.
+func (m *Manager) Remove(id string) error {
+	if !validID(id) {
+		return ErrInvalidUploadID
+	}
+
+	if err := m.lock(id); err != nil {
+		return err
+	}
+	defer m.unlock(id)
+
+	return m.remove(id)
+}
+
+func (m *Manager) remove(id string) error {
+	if err := os.Remove(m.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Remove(m.infoPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RemoveStale deletes uploads that were created more than maxAge ago and
+// returns the number of uploads removed.
+func (m *Manager) RemoveStale(maxAge time.Duration) (int, error) {
+	entries, err := ioutil.ReadDir(m.RootDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".info") {
+			continue
+		}
+
+		id := strings.TrimSuffix(e.Name(), ".info")
+		info, err := m.Get(id)
+		if err != nil {
+			continue
+		}
+
+		if time.Since(info.CreatedAt) < maxAge {
+			continue
+		}
+
+		if err := m.Remove(id); err != nil {
+			if err == ErrUploadLocked {
+				continue
+			}
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,103 @@
+package uploads
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumeUpload(t *testing.T) {
+	m, err := NewManager(t.TempDir())
+	require.NoError(t, err)
+
+	info, err := m.Create(1, 10, map[string]string{"filename": "test.txt"})
+	require.NoError(t, err)
+
+	off, err := m.Append(info.ID, 0, bytes.NewReader([]byte("hello")), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), off)
+
+	_, err = m.Append(info.ID, 3, bytes.NewReader([]byte("world")), nil)
+	assert.Equal(t, ErrOffsetMismatch, err)
+
+	off, err = m.Append(info.ID, 5, bytes.NewReader([]byte("world")), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), off)
+
+	f, err := m.Open(info.ID)
+	require.NoError(t, err)
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "helloworld", string(data))
+
+	got, err := m.Get(info.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "test.txt", got.Metadata["filename"])
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	m, err := NewManager(t.TempDir())
+	require.NoError(t, err)
+
+	info, err := m.Create(1, 4, nil)
+	require.NoError(t, err)
+
+	_, err = m.Append(info.ID, 0, bytes.NewReader([]byte("toolong")), nil)
+	assert.Equal(t, ErrUploadTooLarge, err)
+}
+
+func TestRemoveStale(t *testing.T) {
+	m, err := NewManager(t.TempDir())
+	require.NoError(t, err)
+
+	info, err := m.Create(1, 4, nil)
+	require.NoError(t, err)
+
+	n, err := m.RemoveStale(time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = m.RemoveStale(0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = m.Get(info.ID)
+	assert.Equal(t, ErrUploadNotFound, err)
+}
+
+func TestCompleteUploadOnce(t *testing.T) {
+	m, err := NewManager(t.TempDir())
+	require.NoError(t, err)
+
+	info, err := m.Create(1, 5, nil)
+	require.NoError(t, err)
+
+	var completed int
+	complete := func(info *Info, data *os.File) error {
+		completed++
+		b, err := ioutil.ReadAll(data)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+
+		// the upload stays locked while it is imported
+		assert.Equal(t, ErrUploadLocked, m.Remove(info.ID))
+		return nil
+	}
+
+	off, err := m.Append(info.ID, 0, bytes.NewReader([]byte("hello")), complete)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), off)
+	assert.Equal(t, 1, completed)
+
+	// a retry at the final offset finds the upload gone
+	_, err = m.Append(info.ID, 5, bytes.NewReader(nil), complete)
+	assert.Equal(t, ErrUploadNotFound, err)
+	assert.Equal(t, 1, completed)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"time"
 
 	"github.com/application-research/estuary/util"
@@ -23,6 +24,7 @@ type User struct {
 	Flags     int
 
 	StorageDisabled bool
+	MaxUploadSize   int64 // overrides the shuttles upload size limit if set
 }
 
 func (u *User) FlagSplitContent() bool {
@@ -35,6 +37,20 @@ type AuthToken struct {
 	User       uint
 	UploadOnly bool
 	Expiry     time.Time
+
+	// Scopes is a comma separated list of the scopes the key is limited to,
+	// empty for a key that can do anything its user can
+	Scopes string
+}
+
+func (t *AuthToken) scopes() []string {
+	if t.Scopes != "" {
+		return strings.Split(t.Scopes, ",")
+	}
+	if t.UploadOnly {
+		return []string{util.ScopeUpload}
+	}
+	return nil
 }
 
 type InviteCode struct {
@@ -2,8 +2,10 @@ package util
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 func isEntityOwner(uID, entityID uint, entity string) error {
@@ -28,4 +30,81 @@ func IsContentOwner(uID, entityID uint) error {
 func GetPasswordHash(password, salt string) string {
 	passHashBytes := sha256.Sum256([]byte(password + "." + salt))
 	return string(passHashBytes[:])
-}
\ No newline at end of file
+}
+
+// GetTokenHash returns a hex encoded hash of an api token, used to refer to
+// tokens without passing the token itself around
+func GetTokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Scopes an api key can be limited to. A key without scopes can do anything
+// its user can.
+const (
+	ScopeUpload = "upload"
+	ScopeRead   = "read"
+	ScopeAdmin  = "admin"
+)
+
+// ParseScopes parses a comma separated list of scopes. "all" gives a key
+// without scopes.
+func ParseScopes(s string) ([]string, error) {
+	if s == "" || s == "all" {
+		return nil, nil
+	}
+
+	var out []string
+	seen := make(map[string]bool)
+	for _, sc := range strings.Split(s, ",") {
+		sc = strings.TrimSpace(sc)
+		switch sc {
+		case ScopeUpload, ScopeRead, ScopeAdmin:
+		default:
+			return nil, fmt.Errorf("invalid scope: %q", sc)
+		}
+		if !seen[sc] {
+			seen[sc] = true
+			out = append(out, sc)
+		}
+	}
+	return out, nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, sc := range scopes {
+		if sc == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultScopes returns the scopes of which a key needs one to call a route
+// that needs perm level with method, for routes that do not name their own.
+// Admin routes need admin keys and read keys may call routes that do not
+// change anything. Upload keys may only call the routes naming their scope.
+func DefaultScopes(level int, method string) []string {
+	if level >= PermLevelAdmin {
+		return []string{ScopeAdmin}
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return []string{ScopeRead}
+	}
+	return nil
+}
+
+// ScopesAllow reports whether a key limited to scopes has one of the scopes
+// a route requires. Keys without scopes and admin keys may call anything,
+// routes that require none only take those.
+func ScopesAllow(scopes []string, required []string) bool {
+	if len(scopes) == 0 || hasScope(scopes, ScopeAdmin) {
+		return true
+	}
+	for _, sc := range required {
+		if hasScope(scopes, sc) {
+			return true
+		}
+	}
+	return false
+}
@@ -15,3 +15,45 @@ func TestIsContentOwner(t *testing.T) {
 	require.Nil(t, IsContentOwner(290, 290))
 	assert.Equal(t, IsContentOwner(1, 2).Error(), "ERR_NOT_AUTHORIZED: User (1) is not authorized for content (2)")
 }
+
+func TestGetTokenHash(t *testing.T) {
+	assert.Equal(t, GetTokenHash("EST-abc-ARY"), GetTokenHash("EST-abc-ARY"))
+	assert.NotEqual(t, GetTokenHash("EST-abc-ARY"), GetTokenHash("EST-abd-ARY"))
+	assert.Len(t, GetTokenHash("EST-abc-ARY"), 64)
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("all")
+	require.NoError(t, err)
+	assert.Empty(t, scopes)
+
+	scopes, err = ParseScopes("upload, read,upload")
+	require.NoError(t, err)
+	assert.Equal(t, []string{ScopeUpload, ScopeRead}, scopes)
+
+	_, err = ParseScopes("upload,delete")
+	assert.Error(t, err)
+}
+
+func TestScopesAllow(t *testing.T) {
+	assert.True(t, ScopesAllow(nil, DefaultScopes(PermLevelAdmin, "POST")))
+
+	upload := []string{ScopeUpload}
+	assert.True(t, ScopesAllow(upload, []string{ScopeUpload}))
+	assert.False(t, ScopesAllow(upload, DefaultScopes(PermLevelUpload, "POST")), "upload keys only call routes naming their scope")
+	assert.False(t, ScopesAllow(upload, DefaultScopes(PermLevelUpload, "GET")))
+	assert.False(t, ScopesAllow(upload, DefaultScopes(PermLevelUpload, "DELETE")))
+	assert.False(t, ScopesAllow(upload, DefaultScopes(PermLevelAdmin, "GET")))
+
+	read := []string{ScopeRead}
+	assert.True(t, ScopesAllow(read, DefaultScopes(PermLevelUser, "GET")))
+	assert.True(t, ScopesAllow(read, DefaultScopes(PermLevelUpload, "HEAD")))
+	assert.True(t, ScopesAllow(read, []string{ScopeRead}))
+	assert.False(t, ScopesAllow(read, []string{ScopeUpload}))
+	assert.False(t, ScopesAllow(read, DefaultScopes(PermLevelUpload, "POST")))
+	assert.False(t, ScopesAllow(read, DefaultScopes(PermLevelUser, "DELETE")))
+	assert.False(t, ScopesAllow(read, DefaultScopes(PermLevelAdmin, "GET")))
+
+	assert.True(t, ScopesAllow([]string{ScopeAdmin}, DefaultScopes(PermLevelAdmin, "DELETE")))
+	assert.True(t, ScopesAllow([]string{ScopeAdmin}, nil))
+}
@@ -0,0 +1,62 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// AuthClaims are the claims of api keys issued as JWTs. They are signed by
+// the primary so shuttles can check them without asking it, and carry what
+// the shuttles would otherwise get from /viewer, as of when the key was made.
+type AuthClaims struct {
+	jwt.StandardClaims
+
+	Username        string   `json:"usr"`
+	Perms           int      `json:"perms"`
+	Scopes          []string `json:"scopes,omitempty"`
+	Flags           int      `json:"flags,omitempty"`
+	MaxUploadSize   int64    `json:"maxUploadSize,omitempty"`
+	StorageDisabled bool     `json:"storageDisabled,omitempty"`
+}
+
+// UserID is the id of the user the key belongs to
+func (c *AuthClaims) UserID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid subject %q: %w", c.Subject, err)
+	}
+	return uint(id), nil
+}
+
+// IsJWT tells signed api keys apart from the opaque EST...ARY ones
+func IsJWT(token string) bool {
+	return strings.HasPrefix(token, "ey") && strings.Count(token, ".") == 2
+}
+
+// SignAuthToken makes a JWT api key of claims
+func SignAuthToken(key ed25519.PrivateKey, claims *AuthClaims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(key)
+}
+
+// VerifyAuthToken checks the signature and expiry of a JWT api key and
+// returns its claims
+func VerifyAuthToken(key ed25519.PublicKey, token string) (*AuthClaims, error) {
+	var claims AuthClaims
+	if _, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, fmt.Errorf("unexpected signing method %q", t.Header["alg"])
+		}
+		return key, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if _, err := claims.UserID(); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
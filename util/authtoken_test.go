@@ -0,0 +1,53 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthToken(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tok, err := SignAuthToken(priv, &AuthClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "42",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Username: "alice",
+		Perms:    PermLevelUser,
+		Scopes:   []string{ScopeUpload},
+	})
+	require.NoError(t, err)
+	assert.True(t, IsJWT(tok))
+	assert.False(t, IsJWT("EST1c4e6b2a-ffff-4c3d-9a3e-1d2c3b4a5f6eARY"))
+
+	claims, err := VerifyAuthToken(pub, tok)
+	require.NoError(t, err)
+	uid, err := claims.UserID()
+	require.NoError(t, err)
+	assert.Equal(t, uint(42), uid)
+	assert.Equal(t, "alice", claims.Username)
+	assert.Equal(t, []string{ScopeUpload}, claims.Scopes)
+
+	_, err = VerifyAuthToken(otherPub, tok)
+	assert.Error(t, err, "a key signed by another key verified")
+
+	expired, err := SignAuthToken(priv, &AuthClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "42",
+			ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+		},
+	})
+	require.NoError(t, err)
+	_, err = VerifyAuthToken(pub, expired)
+	assert.Error(t, err, "an expired key verified")
+}
@@ -0,0 +1,174 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// CopyOptions tunes CopyBlockstore
+type CopyOptions struct {
+	// Workers is the number of goroutines reading blocks from the source and
+	// the number writing batches to the destination
+	Workers int
+
+	// MaxBatchBlocks and MaxBatchBytes bound a single PutMany call
+	MaxBatchBlocks int
+	MaxBatchBytes  int64
+
+	// TargetBatchTime is how long a single PutMany should take. Writers
+	// shrink their batches when writes take longer and grow them back up to
+	// the maximum when they are fast.
+	TargetBatchTime time.Duration
+}
+
+var DefaultCopyOptions = CopyOptions{
+	Workers:         8,
+	MaxBatchBlocks:  1024,
+	MaxBatchBytes:   32 << 20,
+	TargetBatchTime: time.Second,
+}
+
+const minCopyBatchBlocks = 16
+
+func (opts CopyOptions) withDefaults() CopyOptions {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultCopyOptions.Workers
+	}
+	if opts.MaxBatchBlocks <= 0 {
+		opts.MaxBatchBlocks = DefaultCopyOptions.MaxBatchBlocks
+	}
+	if opts.MaxBatchBytes <= 0 {
+		opts.MaxBatchBytes = DefaultCopyOptions.MaxBatchBytes
+	}
+	if opts.TargetBatchTime <= 0 {
+		opts.TargetBatchTime = DefaultCopyOptions.TargetBatchTime
+	}
+	return opts
+}
+
+// CopyBlockstore copies every block of from into to. Blocks are read by a
+// pool of workers ahead of the writers, which put them into the destination
+// in batches sized by both block count and bytes.
+func CopyBlockstore(ctx context.Context, from, to blockstore.Blockstore, opts CopyOptions) error {
+	opts = opts.withDefaults()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var errOnce sync.Once
+	var copyErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			copyErr = err
+			cancel()
+		})
+	}
+
+	keys, err := from.AllKeysChan(ctx)
+	if err != nil {
+		return err
+	}
+
+	// buffer enough blocks that writers always have a full batch waiting
+	blks := make(chan blocks.Block, opts.MaxBatchBlocks)
+
+	var readers sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for k := range keys {
+				blk, err := from.Get(ctx, k)
+				if err != nil {
+					fail(err)
+					return
+				}
+
+				select {
+				case blks <- blk:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		readers.Wait()
+		close(blks)
+	}()
+
+	var writers sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			if err := copyBatches(ctx, to, blks, opts); err != nil {
+				fail(err)
+			}
+		}()
+	}
+	writers.Wait()
+
+	if copyErr != nil {
+		return copyErr
+	}
+	// AllKeysChan closes its channel early if the parent context is done
+	return ctx.Err()
+}
+
+func copyBatches(ctx context.Context, to blockstore.Blockstore, blks <-chan blocks.Block, opts CopyOptions) error {
+	limit := opts.MaxBatchBlocks
+	batch := make([]blocks.Block, 0, limit)
+	var batchBytes int64
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		start := time.Now()
+		if err := to.PutMany(ctx, batch); err != nil {
+			return err
+		}
+
+		switch took := time.Since(start); {
+		case took > opts.TargetBatchTime && limit > minCopyBatchBlocks:
+			limit /= 2
+			if limit < minCopyBatchBlocks {
+				limit = minCopyBatchBlocks
+			}
+		case took < opts.TargetBatchTime/2 && limit < opts.MaxBatchBlocks:
+			limit *= 2
+			if limit > opts.MaxBatchBlocks {
+				limit = opts.MaxBatchBlocks
+			}
+		}
+
+		// the destination may keep the slice it was given, like a write log
+		// or an async store, so the next batch gets its own
+		batch = make([]blocks.Block, 0, limit)
+		batchBytes = 0
+		return nil
+	}
+
+	for blk := range blks {
+		batch = append(batch, blk)
+		batchBytes += int64(len(blk.RawData()))
+
+		if len(batch) >= limit || batchBytes >= opts.MaxBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
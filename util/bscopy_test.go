@@ -0,0 +1,51 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyBlockstore(t *testing.T) {
+	ctx := context.Background()
+
+	from := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	to := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+
+	var blks []blocks.Block
+	for i := 0; i < 2000; i++ {
+		blk := blocks.NewBlock([]byte(fmt.Sprintf("block %d", i)))
+		blks = append(blks, blk)
+	}
+	require.NoError(t, from.PutMany(ctx, blks))
+
+	require.NoError(t, CopyBlockstore(ctx, from, to, CopyOptions{
+		Workers:        4,
+		MaxBatchBlocks: 64,
+		MaxBatchBytes:  1024,
+	}))
+
+	for _, blk := range blks {
+		has, err := to.Has(ctx, blk.Cid())
+		require.NoError(t, err)
+		assert.True(t, has, "block %s was not copied", blk.Cid())
+	}
+}
+
+func TestCopyBlockstoreCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	from := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	to := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	require.NoError(t, from.Put(context.Background(), blocks.NewBlock([]byte("data"))))
+
+	assert.Error(t, CopyBlockstore(ctx, from, to, DefaultCopyOptions))
+}
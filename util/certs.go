@@ -0,0 +1,97 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate from files, loading it again once they
+// change so certificates can be rotated without a restart
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	lk      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.Certificate(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *CertReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		st, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if st.ModTime().After(latest) {
+			latest = st.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Certificate returns the current certificate. If the files cannot be read
+// the last certificate loaded is kept.
+func (cr *CertReloader) Certificate() (*tls.Certificate, error) {
+	cr.lk.Lock()
+	defer cr.lk.Unlock()
+
+	mod, err := cr.modified()
+	if err != nil {
+		if cr.cert != nil {
+			return cr.cert, nil
+		}
+		return nil, err
+	}
+	if cr.cert != nil && !mod.After(cr.modTime) {
+		return cr.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		// the files may be half way through being replaced
+		if cr.cert != nil {
+			return cr.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load certificate %s: %w", cr.certFile, err)
+	}
+	cr.cert = &cert
+	cr.modTime = mod
+	return cr.cert, nil
+}
+
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.Certificate()
+}
+
+func (cr *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return cr.Certificate()
+}
+
+// LoadCertPool reads the PEM encoded CA certificates in file
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestCert(t *testing.T, dir, name string, mod time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600))
+	require.NoError(t, os.Chtimes(certFile, mod, mod))
+	require.NoError(t, os.Chtimes(keyFile, mod, mod))
+}
+
+func certName(t *testing.T, cr *CertReloader) string {
+	cert, err := cr.Certificate()
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeTestCert(t, dir, "first", now.Add(-time.Minute))
+
+	cr, err := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	require.NoError(t, err)
+	assert.Equal(t, "first", certName(t, cr))
+
+	writeTestCert(t, dir, "rotated", now)
+	assert.Equal(t, "rotated", certName(t, cr))
+
+	// a broken replacement keeps the last good certificate
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cert.pem"), []byte("garbage"), 0600))
+	assert.Equal(t, "rotated", certName(t, cr))
+
+	_, err = NewCertReloader(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "key.pem"))
+	assert.Error(t, err)
+}
@@ -3,6 +3,8 @@ package util
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -26,6 +28,11 @@ const (
 type ContentInCollection struct {
 	CollectionID  string `json:"coluuid"`
 	CollectionDir string `json:"dir"`
+
+	// CollectionPath is where the content lands in the collection, a path
+	// ending in / is the directory it is put in under its own name. It takes
+	// precedence over CollectionDir, which is the full path of the content.
+	CollectionPath string `json:"collectionPath,omitempty"`
 }
 
 type ContentAddIpfsBody struct {
@@ -33,6 +40,23 @@ type ContentAddIpfsBody struct {
 	Root  string   `json:"root"`
 	Name  string   `json:"filename"`
 	Peers []string `json:"peers"`
+	// Depth limits the pin to that many levels of the dag, 1 pins only the
+	// root block
+	Depth int `json:"depth"`
+}
+
+// ContentAddIpfsBatchBody pins several objects at once, Peers are origin
+// hints shared by all of them
+type ContentAddIpfsBatchBody struct {
+	Pins  []ContentAddIpfsBatchPin `json:"pins"`
+	Peers []string                 `json:"peers"`
+}
+
+type ContentAddIpfsBatchPin struct {
+	Root  string   `json:"root"`
+	Name  string   `json:"filename"`
+	Peers []string `json:"peers"`
+	Depth int      `json:"depth"`
 }
 
 type ContentAddResponse struct {
@@ -40,6 +64,13 @@ type ContentAddResponse struct {
 	RetrievalURL string   `json:"retrieval_url"`
 	EstuaryId    uint     `json:"estuaryId"`
 	Providers    []string `json:"providers"`
+	CidVersion   uint64   `json:"cid_version,omitempty"`
+	Codec        string   `json:"codec,omitempty"`
+	HashFunction string   `json:"hash_function,omitempty"`
+
+	// IsDuplicate is set when the user already had the root and the existing
+	// content was returned instead of adding it again
+	IsDuplicate bool `json:"isDuplicate,omitempty"`
 }
 
 type ContentCreateBody struct {
@@ -49,6 +80,11 @@ type ContentCreateBody struct {
 	Name     string      `json:"name"`
 	Location string      `json:"location"`
 	Type     ContentType `json:"type"`
+
+	// Pinning and PinMeta are set by shuttles creating the content of a pin
+	// they were asked for through the pinning service api
+	Pinning bool   `json:"pinning,omitempty"`
+	PinMeta string `json:"pinMeta,omitempty"`
 }
 
 type ContentCreateResponse struct {
@@ -80,8 +116,18 @@ type Content struct {
 	PinMeta string `json:"pinMeta"`
 	Replace bool   `json:"replace" gorm:"default:0"`
 	Origins string `json:"origins"`
+	// MaxDepth is the number of levels of the dag that are pinned, zero if
+	// the whole dag is. Partially pinned content is not put in deals.
+	MaxDepth int `json:"maxDepth"`
+
+	// VerifiedDeal overrides whether deals for this content are verified,
+	// when unset the shuttle holding it or the node default decides
+	VerifiedDeal *bool `json:"verifiedDeal,omitempty"`
 
 	Failed bool `json:"failed"`
+	// FailureReason is why the pin of failed content failed, like
+	// no_providers or timeout
+	FailureReason string `json:"failureReason,omitempty"`
 
 	Location string `json:"location"`
 	// TODO: shift location tracking to just use the ID of the shuttle
@@ -103,6 +149,19 @@ type ContentWithPath struct {
 	Path string `json:"path"`
 }
 
+// FullPath returns the path of the content in its collection, content added
+// with only a directory is put in it under its name
+func (r ContentWithPath) FullPath() string {
+	p := r.Path
+	if p == "" {
+		p = "/"
+	}
+	if strings.HasSuffix(p, "/") {
+		p += r.Name
+	}
+	return path.Clean(p)
+}
+
 type Object struct {
 	ID         uint  `gorm:"primarykey"`
 	Cid        DbCID `gorm:"index"`
@@ -189,3 +248,40 @@ func EnsurePathIsLinked(dirs []string, rootNode *merkledag.ProtoNode, ds format.
 func CreateRetrievalURL(cid string) string {
 	return fmt.Sprintf("https://dweb.link/ipfs/%s", cid)
 }
+
+// ValidatePinDepth checks the number of dag levels a pin was requested with,
+// zero pins the whole dag
+func ValidatePinDepth(depth int) error {
+	if depth < 0 {
+		return &HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid pin depth %d, must not be negative", depth),
+		}
+	}
+	return nil
+}
+
+// PinDepthFromMeta reads the depth of a pin from the "depth" key of its
+// pinning service meta
+func PinDepthFromMeta(meta map[string]interface{}) (int, error) {
+	v, ok := meta["depth"]
+	if !ok {
+		return 0, nil
+	}
+
+	f, ok := v.(float64)
+	if !ok || f != float64(int(f)) {
+		return 0, &HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid pin depth %v, must be a whole number", v),
+		}
+	}
+
+	depth := int(f)
+	if err := ValidatePinDepth(depth); err != nil {
+		return 0, err
+	}
+	return depth, nil
+}
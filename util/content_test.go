@@ -0,0 +1,41 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinDepthFromMeta(t *testing.T) {
+	assert := assert.New(t)
+
+	depth, err := PinDepthFromMeta(nil)
+	assert.NoError(err)
+	assert.Equal(0, depth)
+
+	depth, err = PinDepthFromMeta(map[string]interface{}{"depth": float64(1)})
+	assert.NoError(err)
+	assert.Equal(1, depth)
+
+	_, err = PinDepthFromMeta(map[string]interface{}{"depth": float64(-1)})
+	assert.Error(err)
+
+	_, err = PinDepthFromMeta(map[string]interface{}{"depth": 1.5})
+	assert.Error(err)
+
+	_, err = PinDepthFromMeta(map[string]interface{}{"depth": "1"})
+	assert.Error(err)
+}
+
+func TestContentWithPathFullPath(t *testing.T) {
+	assert := assert.New(t)
+
+	r := ContentWithPath{Content: Content{Name: "file.txt"}}
+	assert.Equal("/file.txt", r.FullPath())
+
+	r.Path = "/docs/"
+	assert.Equal("/docs/file.txt", r.FullPath())
+
+	r.Path = "/docs/renamed.txt"
+	assert.Equal("/docs/renamed.txt", r.FullPath())
+}
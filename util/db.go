@@ -10,7 +10,26 @@ import (
 	"gorm.io/gorm"
 )
 
+// DatabasePool configures the connection pool of a database, zero values
+// leave the database/sql defaults
+type DatabasePool struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+var DefaultDatabasePool = DatabasePool{
+	MaxOpenConns:    99,
+	MaxIdleConns:    80,
+	ConnMaxIdleTime: time.Hour,
+}
+
 func SetupDatabase(dbval string) (*gorm.DB, error) {
+	return SetupDatabaseWithPool(dbval, DefaultDatabasePool)
+}
+
+func SetupDatabaseWithPool(dbval string, pool DatabasePool) (*gorm.DB, error) {
 	parts := strings.SplitN(dbval, "=", 2)
 	if len(parts) == 1 {
 		return nil, fmt.Errorf("format for database string is 'DBTYPE=PARAMS'")
@@ -38,9 +57,18 @@ func SetupDatabase(dbval string) (*gorm.DB, error) {
 		return nil, err
 	}
 
-	sqldb.SetMaxIdleConns(80)
-	sqldb.SetMaxOpenConns(99)
-	sqldb.SetConnMaxIdleTime(time.Hour)
+	if pool.MaxIdleConns > 0 {
+		sqldb.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	if pool.MaxOpenConns > 0 {
+		sqldb.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		sqldb.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
+	if pool.ConnMaxIdleTime > 0 {
+		sqldb.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+	}
 
 	return db, nil
 }
@@ -0,0 +1,233 @@
+// Package dbmigrate applies versioned migrations to a database and rolls
+// them back, recording which ones were applied in the schema_migrations
+// table.
+package dbmigrate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"gorm.io/gorm"
+)
+
+var log = logging.Logger("db-migrate")
+
+// ErrIrreversible is returned when rolling back a migration without a Down
+var ErrIrreversible = errors.New("migration cannot be rolled back")
+
+// Migration is one versioned change of the schema or the data of a database.
+// Up and Down run in a transaction together with recording the change, so a
+// migration that fails leaves nothing behind on databases with transactional
+// DDL. Down may be nil for migrations that cannot be undone.
+type Migration struct {
+	ID   string
+	Up   func(tx *gorm.DB) error
+	Down func(tx *gorm.DB) error
+}
+
+// Record is a migration applied to the database
+type Record struct {
+	ID        string `gorm:"primarykey"`
+	AppliedAt time.Time
+}
+
+func (Record) TableName() string {
+	return "schema_migrations"
+}
+
+// Status is the state of a migration. Unknown migrations were applied by
+// another version of the program, they are not in its list.
+type Status struct {
+	ID        string     `json:"id"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+	Unknown   bool       `json:"unknown,omitempty"`
+}
+
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// New returns a migrator for the given migrations, which are applied in the
+// order given
+func New(db *gorm.DB, migrations []Migration) (*Migrator, error) {
+	seen := make(map[string]bool)
+	for _, m := range migrations {
+		if m.ID == "" {
+			return nil, fmt.Errorf("migration without an id")
+		}
+		if seen[m.ID] {
+			return nil, fmt.Errorf("duplicate migration %q", m.ID)
+		}
+		if m.Up == nil {
+			return nil, fmt.Errorf("migration %q has no up step", m.ID)
+		}
+		seen[m.ID] = true
+	}
+
+	if err := db.AutoMigrate(&Record{}); err != nil {
+		return nil, fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+func (m *Migrator) applied() (map[string]time.Time, error) {
+	var recs []Record
+	if err := m.db.Find(&recs).Error; err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]time.Time, len(recs))
+	for _, r := range recs {
+		out[r.ID] = r.AppliedAt
+	}
+	return out, nil
+}
+
+// Status lists every migration in order, followed by the unknown ones
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Status
+	for _, mig := range m.migrations {
+		st := Status{ID: mig.ID}
+		if at, ok := applied[mig.ID]; ok {
+			st.Applied = true
+			st.AppliedAt = &at
+			delete(applied, mig.ID)
+		}
+		out = append(out, st)
+	}
+
+	var unknown []string
+	for id := range applied {
+		unknown = append(unknown, id)
+	}
+	sort.Strings(unknown)
+	for _, id := range unknown {
+		at := applied[id]
+		out = append(out, Status{ID: id, Applied: true, AppliedAt: &at, Unknown: true})
+	}
+	return out, nil
+}
+
+// Pending returns the ids of the migrations not applied yet
+func (m *Migrator) Pending() ([]string, error) {
+	sts, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, st := range sts {
+		if !st.Applied {
+			out = append(out, st.ID)
+		}
+	}
+	return out, nil
+}
+
+func (m *Migrator) checkUnknown(sts []Status) error {
+	for _, st := range sts {
+		if st.Unknown {
+			return fmt.Errorf("database has migration %q applied which this version does not know, it was probably migrated by a newer version", st.ID)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) index(id string) int {
+	for i, mig := range m.migrations {
+		if mig.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Up applies the pending migrations up to and including the one with id to,
+// or all of them if to is empty. It returns the ids of the migrations it
+// applied.
+func (m *Migrator) Up(to string) ([]string, error) {
+	last := len(m.migrations) - 1
+	if to != "" {
+		last = m.index(to)
+		if last < 0 {
+			return nil, fmt.Errorf("unknown migration %q", to)
+		}
+	}
+
+	sts, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkUnknown(sts); err != nil {
+		return nil, err
+	}
+
+	var done []string
+	for i := 0; i <= last; i++ {
+		if sts[i].Applied {
+			continue
+		}
+
+		mig := m.migrations[i]
+		log.Infof("applying database migration %s", mig.ID)
+		start := time.Now()
+		if err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := mig.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&Record{ID: mig.ID, AppliedAt: time.Now().UTC()}).Error
+		}); err != nil {
+			return done, fmt.Errorf("migration %s failed: %w", mig.ID, err)
+		}
+		log.Infof("applied database migration %s in %s", mig.ID, time.Since(start))
+		done = append(done, mig.ID)
+	}
+	return done, nil
+}
+
+// Down rolls back the last steps applied migrations, latest first. It
+// returns the ids of the migrations it rolled back.
+func (m *Migrator) Down(steps int) ([]string, error) {
+	sts, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkUnknown(sts); err != nil {
+		return nil, err
+	}
+
+	var done []string
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		if !sts[i].Applied {
+			continue
+		}
+
+		mig := m.migrations[i]
+		if mig.Down == nil {
+			return done, fmt.Errorf("%s: %w", mig.ID, ErrIrreversible)
+		}
+
+		log.Infof("rolling back database migration %s", mig.ID)
+		if err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := mig.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&Record{ID: mig.ID}).Error
+		}); err != nil {
+			return done, fmt.Errorf("rolling back migration %s failed: %w", mig.ID, err)
+		}
+		done = append(done, mig.ID)
+	}
+	return done, nil
+}
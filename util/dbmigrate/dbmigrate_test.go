@@ -0,0 +1,151 @@
+package dbmigrate
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type thing struct {
+	ID   uint
+	Name string
+}
+
+func testMigrations() []Migration {
+	return []Migration{
+		{
+			ID:   "0001_things",
+			Up:   func(tx *gorm.DB) error { return tx.Migrator().CreateTable(&thing{}) },
+			Down: func(tx *gorm.DB) error { return tx.Migrator().DropTable(&thing{}) },
+		},
+		{
+			ID: "0002_default_thing",
+			Up: func(tx *gorm.DB) error { return tx.Create(&thing{Name: "default"}).Error },
+			Down: func(tx *gorm.DB) error {
+				return tx.Where("name = ?", "default").Delete(&thing{}).Error
+			},
+		},
+	}
+}
+
+func openDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	require.NoError(t, err)
+	return db
+}
+
+func TestUpAndDown(t *testing.T) {
+	db := openDB(t)
+
+	m, err := New(db, testMigrations())
+	require.NoError(t, err)
+
+	pending, err := m.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0001_things", "0002_default_thing"}, pending)
+
+	done, err := m.Up("0001_things")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0001_things"}, done)
+
+	done, err = m.Up("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0002_default_thing"}, done)
+
+	var count int64
+	require.NoError(t, db.Model(&thing{}).Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+
+	// applying again does nothing
+	done, err = m.Up("")
+	require.NoError(t, err)
+	assert.Empty(t, done)
+
+	done, err = m.Down(1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0002_default_thing"}, done)
+	require.NoError(t, db.Model(&thing{}).Count(&count).Error)
+	assert.Zero(t, count)
+
+	done, err = m.Down(5)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0001_things"}, done)
+	assert.False(t, db.Migrator().HasTable(&thing{}))
+}
+
+func TestFailedMigrationIsNotRecorded(t *testing.T) {
+	db := openDB(t)
+
+	migs := testMigrations()
+	migs = append(migs, Migration{
+		ID: "0003_broken",
+		Up: func(tx *gorm.DB) error { return errors.New("broken") },
+	})
+
+	m, err := New(db, migs)
+	require.NoError(t, err)
+
+	done, err := m.Up("")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"0001_things", "0002_default_thing"}, done)
+
+	pending, err := m.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0003_broken"}, pending)
+}
+
+func TestUnknownMigrations(t *testing.T) {
+	db := openDB(t)
+
+	m, err := New(db, testMigrations())
+	require.NoError(t, err)
+	_, err = m.Up("")
+	require.NoError(t, err)
+
+	// an older version only knows the first migration
+	old, err := New(db, testMigrations()[:1])
+	require.NoError(t, err)
+
+	sts, err := old.Status()
+	require.NoError(t, err)
+	require.Len(t, sts, 2)
+	assert.True(t, sts[1].Unknown)
+
+	_, err = old.Up("")
+	assert.Error(t, err)
+	_, err = old.Down(1)
+	assert.Error(t, err)
+}
+
+func TestIrreversible(t *testing.T) {
+	db := openDB(t)
+
+	m, err := New(db, []Migration{{
+		ID: "0001_once",
+		Up: func(tx *gorm.DB) error { return nil },
+	}})
+	require.NoError(t, err)
+	_, err = m.Up("")
+	require.NoError(t, err)
+
+	_, err = m.Down(1)
+	assert.ErrorIs(t, err, ErrIrreversible)
+}
+
+func TestInvalidMigrations(t *testing.T) {
+	db := openDB(t)
+
+	_, err := New(db, []Migration{
+		{ID: "a", Up: func(tx *gorm.DB) error { return nil }},
+		{ID: "a", Up: func(tx *gorm.DB) error { return nil }},
+	})
+	assert.Error(t, err)
+
+	_, err = New(db, []Migration{{ID: "b"}})
+	assert.Error(t, err)
+}
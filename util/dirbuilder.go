@@ -0,0 +1,121 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+type dirEntry struct {
+	node     ipld.Node
+	children map[string]*dirEntry
+}
+
+func (de *dirEntry) isDir() bool {
+	return de.children != nil
+}
+
+// CleanUploadPath normalizes a relative file path given by an uploader,
+// rejecting paths that would escape the directory root.
+func CleanUploadPath(p string) (string, error) {
+	p = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(p, "\\", "/")), "/")
+	if p == "" || p == "." {
+		return "", fmt.Errorf("empty path")
+	}
+
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return "", fmt.Errorf("path %q escapes the directory root", p)
+		}
+	}
+	return p, nil
+}
+
+// BuildUnixFSDirectory assembles a unixfs directory tree out of already
+// imported nodes, keyed by their slash separated path relative to the root,
+// and returns the root directory node. Directory nodes are built with the cid
+// prefix selected by params.
+func BuildUnixFSDirectory(ctx context.Context, dserv ipld.DAGService, files map[string]ipld.Node, params ImportParams) (ipld.Node, error) {
+	prefix, err := params.Prefix()
+	if err != nil {
+		return nil, err
+	}
+
+	root := &dirEntry{children: make(map[string]*dirEntry)}
+
+	for p, nd := range files {
+		cp, err := CleanUploadPath(p)
+		if err != nil {
+			return nil, err
+		}
+
+		segs := strings.Split(cp, "/")
+		cur := root
+		for i, seg := range segs {
+			next, ok := cur.children[seg]
+			if i == len(segs)-1 {
+				if ok {
+					return nil, fmt.Errorf("duplicate entry for path %q", cp)
+				}
+				cur.children[seg] = &dirEntry{node: nd}
+				break
+			}
+
+			if !ok {
+				next = &dirEntry{children: make(map[string]*dirEntry)}
+				cur.children[seg] = next
+			}
+
+			if !next.isDir() {
+				return nil, fmt.Errorf("path %q conflicts with a file of the same name", cp)
+			}
+			cur = next
+		}
+	}
+
+	return buildDirNode(ctx, dserv, root, prefix)
+}
+
+func buildDirNode(ctx context.Context, dserv ipld.DAGService, de *dirEntry, prefix cid.Prefix) (ipld.Node, error) {
+	dir := uio.NewDirectory(dserv)
+	dir.SetCidBuilder(prefix)
+
+	names := make([]string, 0, len(de.children))
+	for name := range de.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := de.children[name]
+
+		nd := child.node
+		if child.isDir() {
+			var err error
+			nd, err = buildDirNode(ctx, dserv, child, prefix)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if err := dir.AddChild(ctx, name, nd); err != nil {
+			return nil, err
+		}
+	}
+
+	nd, err := dir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dserv.Add(ctx, nd); err != nil {
+		return nil, err
+	}
+	return nd, nil
+}
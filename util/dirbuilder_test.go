@@ -0,0 +1,75 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanUploadPath(t *testing.T) {
+	for in, out := range map[string]string{
+		"a.txt":         "a.txt",
+		"/dir/a.txt":    "dir/a.txt",
+		"dir//b/../a":   "dir/a",
+		"dir\\win\\a.c": "dir/win/a.c",
+	} {
+		p, err := CleanUploadPath(in)
+		require.NoError(t, err)
+		assert.Equal(t, out, p)
+	}
+
+	_, err := CleanUploadPath("")
+	assert.Error(t, err)
+}
+
+func TestBuildUnixFSDirectory(t *testing.T) {
+	ctx := context.Background()
+
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	a, err := ImportFile(dserv, bytes.NewReader([]byte("file a")))
+	require.NoError(t, err)
+	b, err := ImportFile(dserv, bytes.NewReader([]byte("file b")))
+	require.NoError(t, err)
+
+	root, err := BuildUnixFSDirectory(ctx, dserv, map[string]ipld.Node{
+		"a.txt":     a,
+		"sub/b.txt": b,
+	}, ImportParams{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), root.Cid().Version())
+
+	dir, err := uio.NewDirectoryFromNode(dserv, root)
+	require.NoError(t, err)
+
+	nd, err := dir.Find(ctx, "a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, a.Cid(), nd.Cid())
+
+	sub, err := dir.Find(ctx, "sub")
+	require.NoError(t, err)
+
+	subdir, err := uio.NewDirectoryFromNode(dserv, sub)
+	require.NoError(t, err)
+
+	nd, err = subdir.Find(ctx, "b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, b.Cid(), nd.Cid())
+
+	_, err = BuildUnixFSDirectory(ctx, dserv, map[string]ipld.Node{
+		"x":   a,
+		"x/y": b,
+	}, ImportParams{})
+	assert.Error(t, err)
+}
@@ -4,8 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,7 +19,7 @@ import (
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	mdagipld "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-merkledag"
-	"github.com/ipfs/go-path"
+	ipath "github.com/ipfs/go-path"
 	resolver "github.com/ipfs/go-path/resolver"
 	unixfs "github.com/ipfs/go-unixfs"
 	uio "github.com/ipfs/go-unixfs/io"
@@ -57,24 +61,45 @@ func NewGatewayHandler(bs blockstore.Blockstore) *GatewayHandler {
 	}
 }
 
+func (e *httpError) Error() string {
+	return e.Message
+}
+
 func (gw *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := gw.handleRequest(r.Context(), w, r); err != nil {
-		http.Error(w, "error: "+err.Error(), 500)
+		code := http.StatusInternalServerError
+		var herr *httpError
+		switch {
+		case xerrors.As(err, &herr):
+			code = herr.Code
+		case mdagipld.IsNotFound(err), xerrors.Is(err, os.ErrNotExist):
+			code = http.StatusNotFound
+		}
+		http.Error(w, "error: "+err.Error(), code)
 		return
 	}
 }
 
 func (gw *GatewayHandler) handleRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return &httpError{Code: http.StatusMethodNotAllowed, Message: "method not allowed"}
+	}
+
 	cc, err := gw.resolvePath(ctx, r.URL.Path)
 	if err != nil {
 		return fmt.Errorf("path resolution failed: %w", err)
 	}
 
 	output := "unixfs"
+	if r.URL.Query().Get("format") == "raw" || r.Header.Get("Accept") == rawBlockContentType {
+		output = "raw"
+	}
 
 	switch output {
 	case "unixfs":
 		return gw.serveUnixfs(ctx, cc, w, r)
+	case "raw":
+		return gw.serveRawBlock(ctx, cc, w, r)
 	default:
 		return fmt.Errorf("requested output type unsupported")
 	}
@@ -86,6 +111,10 @@ func (gw *GatewayHandler) serveUnixfs(ctx context.Context, cc cid.Cid, w http.Re
 		return err
 	}
 
+	// content under /ipfs/ never changes
+	w.Header().Set("Etag", `"`+cc.String()+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=29030400, immutable")
+
 	switch nd := nd.(type) {
 	case *merkledag.ProtoNode:
 		n, err := unixfs.FSNodeFromBytes(nd.Data())
@@ -108,11 +137,52 @@ func (gw *GatewayHandler) serveUnixfs(ctx context.Context, cc cid.Cid, w http.Re
 		return err
 	}
 
-	http.ServeContent(w, req, cc.String(), time.Time{}, dr)
+	// ServeContent handles range requests and guesses the content type from
+	// the file extension of the last path segment, or by sniffing the data
+	http.ServeContent(w, req, servedName(req.URL.Path, cc), time.Time{}, dr)
 	return nil
 }
 
+const rawBlockContentType = "application/vnd.ipld.raw"
+
+// serveRawBlock writes the block itself, clients walking dags fetch blocks
+// like this and check them against their cid
+func (gw *GatewayHandler) serveRawBlock(ctx context.Context, cc cid.Cid, w http.ResponseWriter, req *http.Request) error {
+	blk, err := gw.bs.Get(ctx, cc)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", rawBlockContentType)
+	w.Header().Set("Etag", `"`+cc.String()+`.raw"`)
+	w.Header().Set("Cache-Control", "public, max-age=29030400, immutable")
+	w.Header().Set("Content-Length", strconv.Itoa(len(blk.RawData())))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+
+	_, err = w.Write(blk.RawData())
+	return err
+}
+
+func servedName(p string, cc cid.Cid) string {
+	_, _, segs, err := ParsePath(p)
+	if err != nil || len(segs) == 0 || segs[len(segs)-1] == "" {
+		return cc.String()
+	}
+	return segs[len(segs)-1]
+}
+
 func (gw *GatewayHandler) serveUnixfsDir(ctx context.Context, n mdagipld.Node, w http.ResponseWriter, req *http.Request) error {
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		// relative links in the listing only resolve under a trailing slash.
+		// The location is relative as the handler may be mounted under a prefix
+		w.Header().Set("Location", path.Base(req.URL.Path)+"/")
+		w.WriteHeader(http.StatusMovedPermanently)
+		return nil
+	}
+
 	// TODO: something less ugly
 	dir, err := uio.NewDirectoryFromNode(gw.dserv, n)
 	if err != nil {
@@ -135,10 +205,11 @@ func (gw *GatewayHandler) serveUnixfsDir(ctx context.Context, n mdagipld.Node, w
 
 	}
 
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	fmt.Fprintf(w, "<html><body><ul>")
 
 	if err := dir.ForEachLink(ctx, func(lnk *mdagipld.Link) error {
-		fmt.Fprintf(w, "<li><a href=\"./%s\">%s</a></li>", lnk.Name, lnk.Name)
+		fmt.Fprintf(w, "<li><a href=\"./%s\">%s</a></li>", html.EscapeString(url.PathEscape(lnk.Name)), html.EscapeString(lnk.Name))
 		return nil
 	}); err != nil {
 		return err
@@ -151,12 +222,12 @@ func (gw *GatewayHandler) serveUnixfsDir(ctx context.Context, n mdagipld.Node, w
 func (gw *GatewayHandler) resolvePath(ctx context.Context, p string) (cid.Cid, error) {
 	proto, _, _, err := ParsePath(p) // a sanity check
 	if err != nil {
-		return cid.Undef, fmt.Errorf("failed to parse request path: %w", err)
+		return cid.Undef, &httpError{Code: http.StatusBadRequest, Message: fmt.Sprintf("failed to parse request path: %s", err)}
 	}
 
-	pp, err := path.ParsePath(p)
+	pp, err := ipath.ParsePath(p)
 	if err != nil {
-		return cid.Undef, fmt.Errorf("failed to parse request path: %w", err)
+		return cid.Undef, &httpError{Code: http.StatusBadRequest, Message: fmt.Sprintf("failed to parse request path: %s", err)}
 	}
 
 	cc, segs, err := gw.resolver.ResolveToLastNode(ctx, pp)
@@ -171,7 +242,7 @@ func (gw *GatewayHandler) resolvePath(ctx context.Context, p string) (cid.Cid, e
 		}
 		return cc, nil
 	default:
-		return cid.Undef, fmt.Errorf("unsupported protocol: %s", proto)
+		return cid.Undef, &httpError{Code: http.StatusBadRequest, Message: fmt.Sprintf("unsupported protocol: %s", proto)}
 	}
 }
 
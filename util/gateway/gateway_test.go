@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/application-research/estuary/util"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-datastore"
+	dss "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGatewayServesUnixfs(t *testing.T) {
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	data := []byte("<html><body>hello from the shuttle</body></html>")
+	file, err := util.ImportFile(dserv, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	root, err := util.BuildUnixFSDirectory(context.Background(), dserv, map[string]ipld.Node{
+		"page.html": file,
+	}, util.ImportParams{})
+	require.NoError(t, err)
+
+	gw := NewGatewayHandler(bs)
+
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ipfs/"+root.Cid().String()+"/page.html", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, data, rec.Body.Bytes())
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+
+	req := httptest.NewRequest(http.MethodGet, "/ipfs/"+file.Cid().String(), nil)
+	req.Header.Set("Range", "bytes=6-10")
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, data[6:11], rec.Body.Bytes())
+
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ipfs/"+root.Cid().String(), nil))
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ipfs/not-a-cid", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestGatewayServesRawBlocks(t *testing.T) {
+	bs := blockstore.NewBlockstore(dss.MutexWrap(datastore.NewMapDatastore()))
+	dserv := merkledag.NewDAGService(blockservice.New(bs, nil))
+
+	file, err := util.ImportFile(dserv, bytes.NewReader([]byte("raw block data")))
+	require.NoError(t, err)
+
+	gw := NewGatewayHandler(bs)
+
+	rec := httptest.NewRecorder()
+	gw.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ipfs/"+file.Cid().String()+"?format=raw", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, file.RawData(), rec.Body.Bytes())
+	assert.Equal(t, "application/vnd.ipld.raw", rec.Header().Get("Content-Type"))
+
+	req := httptest.NewRequest(http.MethodGet, "/ipfs/"+file.Cid().String(), nil)
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+	rec = httptest.NewRecorder()
+	gw.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, file.RawData(), rec.Body.Bytes())
+}
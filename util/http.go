@@ -42,6 +42,17 @@ const (
 	ERR_INVALID_PINNING_STATUS     = "ERR_INVALID_PINNING_STATUS"
 	ERR_INVALID_QUERY_PARAM_VALUE  = "ERR_INVALID_QUERY_PARAM_VALUE"
 	ERR_CONTENT_LENGTH_REQUIRED    = "ERR_CONTENT_LENGTH_REQUIRED"
+	ERR_UPLOAD_NOT_FOUND           = "ERR_UPLOAD_NOT_FOUND"
+	ERR_UPLOAD_OFFSET_MISMATCH     = "ERR_UPLOAD_OFFSET_MISMATCH"
+	ERR_UPLOAD_IN_PROGRESS         = "ERR_UPLOAD_IN_PROGRESS"
+	ERR_SHUTTING_DOWN              = "ERR_SHUTTING_DOWN"
+	ERR_RATE_LIMITED               = "ERR_RATE_LIMITED"
+	ERR_FETCH_NOT_FOUND            = "ERR_FETCH_NOT_FOUND"
+	ERR_IMPORT_NOT_FOUND           = "ERR_IMPORT_NOT_FOUND"
+	ERR_EXPORT_NOT_FOUND           = "ERR_EXPORT_NOT_FOUND"
+	ERR_EXPORT_IN_PROGRESS         = "ERR_EXPORT_IN_PROGRESS"
+	ERR_IDEMPOTENCY_IN_PROGRESS    = "ERR_IDEMPOTENCY_IN_PROGRESS"
+	ERR_IDEMPOTENCY_KEY_REUSED     = "ERR_IDEMPOTENCY_KEY_REUSED"
 )
 
 type HttpError struct {
@@ -129,6 +140,7 @@ type UserSettings struct {
 	ContentAddingDisabled bool          `json:"contentAddingDisabled"`
 	DealMakingDisabled    bool          `json:"dealMakingDisabled"`
 	UploadEndpoints       []string      `json:"uploadEndpoints"`
+	MaxUploadSize         int64         `json:"maxUploadSize,omitempty"`
 	Flags                 int           `json:"flags"`
 }
 
@@ -140,6 +152,10 @@ type ViewerResponse struct {
 	Miners     []string     `json:"miners,omitempty"`
 	AuthExpiry time.Time    `json:"auth_expiry,omitempty"`
 	Settings   UserSettings `json:"settings"`
+
+	// Scopes are what the api key is limited to, none for a key that can do
+	// anything its user can
+	Scopes []string `json:"scopes,omitempty"`
 }
 
 func ErrorHandler(err error, ctx echo.Context) {
@@ -180,3 +196,43 @@ func ErrorHandler(err error, ctx echo.Context) {
 		return
 	}
 }
+
+// OpenApiMiddleware formats handler errors as the ipfs pinning service api
+// expects them, this is required as ipfs pinning spec has strong requirements on response format
+func OpenApiMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		if err == nil {
+			return nil
+		}
+
+		var httpRespErr *HttpError
+		if xerrors.As(err, &httpRespErr) {
+			log.Errorf("handler error: %s", err)
+			return c.JSON(httpRespErr.Code, &HttpErrorResponse{
+				Error: HttpError{
+					Reason:  httpRespErr.Reason,
+					Details: httpRespErr.Details,
+				},
+			})
+		}
+
+		var echoErr *echo.HTTPError
+		if xerrors.As(err, &echoErr) {
+			return c.JSON(echoErr.Code, &HttpErrorResponse{
+				Error: HttpError{
+					Reason:  http.StatusText(echoErr.Code),
+					Details: echoErr.Message.(string),
+				},
+			})
+		}
+
+		log.Errorf("handler error: %s", err)
+		return c.JSON(http.StatusInternalServerError, &HttpErrorResponse{
+			Error: HttpError{
+				Reason:  http.StatusText(http.StatusInternalServerError),
+				Details: err.Error(),
+			},
+		})
+	}
+}
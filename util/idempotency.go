@@ -0,0 +1,158 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+const (
+	// IdempotencyHeader carries the key a client picks for a request it may
+	// retry, retries with the same key get the response of the first request
+	IdempotencyHeader = "Idempotency-Key"
+
+	// IdempotencyReplayedHeader is set on responses replayed for a key
+	IdempotencyReplayedHeader = "Idempotency-Replayed"
+
+	// IdempotencyKeyTTL is how long the response for a key is kept
+	IdempotencyKeyTTL = 24 * time.Hour
+
+	// IdempotencyPendingTimeout is how long a request for a key may run before
+	// it is taken to be abandoned, after a crash say, and the key can be
+	// used again
+	IdempotencyPendingTimeout = 2 * time.Hour
+
+	maxIdempotencyKeyLen = 255
+)
+
+// IdempotencyKey is the result of a request made with an Idempotency-Key
+// header. The row is created before the request runs and is done once it
+// succeeded, failed requests remove it again so they can be retried.
+type IdempotencyKey struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"index"`
+
+	UserID     uint   `gorm:"uniqueIndex:idx_idempotency_user_key"`
+	RequestKey string `gorm:"uniqueIndex:idx_idempotency_user_key"`
+	Endpoint   string
+
+	Done     bool
+	Status   int
+	Response []byte
+}
+
+// ExpireIdempotencyKeys removes the keys that expired by now
+func ExpireIdempotencyKeys(db *gorm.DB, now time.Time) (int64, error) {
+	res := db.Where("expires_at < ?", now).Delete(&IdempotencyKey{})
+	return res.RowsAffected, res.Error
+}
+
+type capturingWriter struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	w.buf.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Idempotent makes a route replay its response to requests repeating the
+// Idempotency-Key of an earlier request of the same user, instead of running
+// again. userID returns the user of an authenticated request, the
+// middleware has to run after authentication. Requests without the header
+// are not affected.
+func Idempotent(db *gorm.DB, endpoint string, userID func(echo.Context) uint) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(IdempotencyHeader)
+			if key == "" {
+				return next(c)
+			}
+			if len(key) > maxIdempotencyKeyLen {
+				return &HttpError{
+					Code:    http.StatusBadRequest,
+					Reason:  ERR_INVALID_INPUT,
+					Details: fmt.Sprintf("%s must be at most %d characters", IdempotencyHeader, maxIdempotencyKeyLen),
+				}
+			}
+
+			uid := userID(c)
+			now := time.Now()
+
+			var prev IdempotencyKey
+			err := db.First(&prev, "user_id = ? and request_key = ?", uid, key).Error
+			switch {
+			case err == nil:
+				if prev.ExpiresAt.Before(now) || (!prev.Done && prev.CreatedAt.Add(IdempotencyPendingTimeout).Before(now)) {
+					if err := db.Delete(&prev).Error; err != nil {
+						return err
+					}
+					break
+				}
+				if prev.Endpoint != endpoint {
+					return &HttpError{
+						Code:    http.StatusUnprocessableEntity,
+						Reason:  ERR_IDEMPOTENCY_KEY_REUSED,
+						Details: fmt.Sprintf("%s %q was already used for another endpoint", IdempotencyHeader, key),
+					}
+				}
+				if !prev.Done {
+					return &HttpError{
+						Code:    http.StatusConflict,
+						Reason:  ERR_IDEMPOTENCY_IN_PROGRESS,
+						Details: fmt.Sprintf("a request with %s %q is still in progress", IdempotencyHeader, key),
+					}
+				}
+				c.Response().Header().Set(IdempotencyReplayedHeader, "true")
+				return c.JSONBlob(prev.Status, prev.Response)
+			case !xerrors.Is(err, gorm.ErrRecordNotFound):
+				return err
+			}
+
+			rec := &IdempotencyKey{
+				UserID:     uid,
+				RequestKey: key,
+				Endpoint:   endpoint,
+				ExpiresAt:  now.Add(IdempotencyKeyTTL),
+			}
+			if err := db.Create(rec).Error; err != nil {
+				// most likely a concurrent request with the same key got in
+				// first
+				return &HttpError{
+					Code:    http.StatusConflict,
+					Reason:  ERR_IDEMPOTENCY_IN_PROGRESS,
+					Details: fmt.Sprintf("a request with %s %q is already in progress", IdempotencyHeader, key),
+				}
+			}
+
+			resp := c.Response()
+			cw := &capturingWriter{ResponseWriter: resp.Writer}
+			resp.Writer = cw
+			err = next(c)
+			resp.Writer = cw.ResponseWriter
+
+			if err != nil || resp.Status < 200 || resp.Status >= 300 {
+				if derr := db.Delete(rec).Error; derr != nil {
+					log.Errorw("failed to release idempotency key", "user", uid, "key", key, "err", derr)
+				}
+				return err
+			}
+
+			if uerr := db.Model(rec).Updates(map[string]interface{}{
+				"done":     true,
+				"status":   resp.Status,
+				"response": cw.buf.Bytes(),
+			}).Error; uerr != nil {
+				log.Errorw("failed to store idempotent response", "user", uid, "key", key, "err", uerr)
+			}
+			return nil
+		}
+	}
+}
@@ -34,10 +34,18 @@ func NewBlockstore(from, to blockstore.Blockstore, del bool) (*Blockstore, error
 }
 
 func (bs *Blockstore) migrateData(ctx context.Context) {
-	ch, err := bs.src.AllKeysChan(ctx)
+	if _, _, err := Copy(ctx, bs.src, bs.dest, bs.del); err != nil {
+		log.Errorf("blockstore migration failed: %s", err)
+	}
+}
+
+// Copy moves every block in from over to to, deleting it from the source after
+// the write if del is set. Blocks that fail to copy are logged and skipped, the
+// number of blocks seen and of failures are returned
+func Copy(ctx context.Context, from, to blockstore.Blockstore, del bool) (int, int, error) {
+	ch, err := from.AllKeysChan(ctx)
 	if err != nil {
-		log.Errorf("failed to get keys chan: %s", err)
-		return
+		return 0, 0, xerrors.Errorf("failed to get keys chan: %w", err)
 	}
 
 	log.Infof("starting blockstore migration...")
@@ -48,7 +56,7 @@ func (bs *Blockstore) migrateData(ctx context.Context) {
 		if count%20 == 0 {
 			log.Infof("migration progress: %d (%d)", count, fails)
 		}
-		blk, err := bs.src.Get(ctx, c)
+		blk, err := from.Get(ctx, c)
 		if err != nil {
 			log.Errorf("failed to read from source blockstore: %s", err)
 			fails++
@@ -56,21 +64,25 @@ func (bs *Blockstore) migrateData(ctx context.Context) {
 			continue
 		}
 
-		if err := bs.dest.Put(ctx, blk); err != nil {
+		if err := to.Put(ctx, blk); err != nil {
 			log.Errorf("failed to write to target blockstore: %s", err)
 			fails++
 			time.Sleep(time.Millisecond * 100)
 			continue
 		}
 
-		if bs.del {
-			if err := bs.src.DeleteBlock(ctx, blk.Cid()); err != nil {
+		if del {
+			if err := from.DeleteBlock(ctx, blk.Cid()); err != nil {
 				fails++
 				log.Errorf("failed to delete block from source blockstore: %s", err)
 			}
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return count, fails, err
+	}
 	log.Infof("Migration complete! (count=%d, fails=%d)", count, fails)
+	return count, fails, nil
 }
 
 func (bs *Blockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
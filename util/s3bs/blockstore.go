@@ -0,0 +1,276 @@
+package s3bs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	logging "github.com/ipfs/go-log/v2"
+	"golang.org/x/xerrors"
+)
+
+var log = logging.Logger("bs-s3")
+
+// putWorkers bounds the number of concurrent uploads of a PutMany
+const putWorkers = 16
+
+// CacheBlockstore is the local store kept in front of the object store
+type CacheBlockstore interface {
+	blockstore.Blockstore
+	DeleteMany(context.Context, []cid.Cid) error
+}
+
+// Blockstore keeps blocks as objects in an S3 compatible bucket, one object
+// per block keyed by its multihash, with a local blockstore in front of it as
+// a read cache. Blocks are only ever added to the cache once they are in the
+// bucket, so anything in the cache is known to be stored.
+//
+// Nothing is evicted from the cache, it is meant to sit on the local disk of a
+// node that can be thrown away, and be sized for the working set.
+type Blockstore struct {
+	client *client
+	prefix string
+	cache  CacheBlockstore
+}
+
+var _ blockstore.Blockstore = (*Blockstore)(nil)
+
+// NewBlockstore opens the bucket at location, given as
+// http(s)://endpoint/bucket[/key/prefix]
+func NewBlockstore(location string, creds Credentials, cache CacheBlockstore) (*Blockstore, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object store location %q: %w", location, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("object store location must be an http(s) url: %q", location)
+	}
+
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, fmt.Errorf("object store location has no bucket: %q", location)
+	}
+
+	var prefix string
+	if len(parts) == 2 && parts[1] != "" {
+		prefix = parts[1] + "/"
+	}
+
+	return &Blockstore{
+		client: &client{
+			http:     &http.Client{Timeout: time.Minute * 5},
+			endpoint: &url.URL{Scheme: u.Scheme, Host: u.Host},
+			bucket:   parts[0],
+			creds:    creds,
+		},
+		prefix: prefix,
+		cache:  cache,
+	}, nil
+}
+
+func (bs *Blockstore) key(c cid.Cid) string {
+	return bs.prefix + dshelp.MultihashToDsKey(c.Hash()).String()[1:]
+}
+
+func (bs *Blockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	has, err := bs.cache.Has(ctx, c)
+	if err != nil {
+		return false, err
+	}
+	if has {
+		return true, nil
+	}
+
+	if _, err := bs.client.headObject(ctx, bs.key(c)); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (bs *Blockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := bs.cache.Get(ctx, c)
+	if err == nil {
+		return blk, nil
+	}
+	if !xerrors.Is(err, blockstore.ErrNotFound) {
+		return nil, err
+	}
+
+	data, err := bs.client.getObject(ctx, bs.key(c))
+	if err != nil {
+		if isNotFound(err) {
+			return nil, blockstore.ErrNotFound
+		}
+		return nil, err
+	}
+
+	// whatever comes back from the bucket is checked before it gets cached
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, blockstore.ErrHashMismatch
+	}
+
+	blk, err = blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bs.cache.Put(ctx, blk); err != nil {
+		log.Warnf("failed to cache block %s: %s", c, err)
+	}
+	return blk, nil
+}
+
+func (bs *Blockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	size, err := bs.cache.GetSize(ctx, c)
+	if err == nil {
+		return size, nil
+	}
+	if !xerrors.Is(err, blockstore.ErrNotFound) {
+		return -1, err
+	}
+
+	osize, err := bs.client.headObject(ctx, bs.key(c))
+	if err != nil {
+		if isNotFound(err) {
+			return -1, blockstore.ErrNotFound
+		}
+		return -1, err
+	}
+	return int(osize), nil
+}
+
+func (bs *Blockstore) Put(ctx context.Context, blk blocks.Block) error {
+	has, err := bs.cache.Has(ctx, blk.Cid())
+	if err != nil {
+		return err
+	}
+	if has {
+		return nil
+	}
+
+	if err := bs.client.putObject(ctx, bs.key(blk.Cid()), blk.RawData()); err != nil {
+		return fmt.Errorf("failed to write block %s to object store: %w", blk.Cid(), err)
+	}
+
+	return bs.cache.Put(ctx, blk)
+}
+
+func (bs *Blockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var errLk sync.Mutex
+	var firstErr error
+
+	sem := make(chan struct{}, putWorkers)
+	for _, blk := range blks {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(blk blocks.Block) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := bs.Put(ctx, blk); err != nil {
+				errLk.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				errLk.Unlock()
+			}
+		}(blk)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+func (bs *Blockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	if err := bs.client.deleteObject(ctx, bs.key(c)); err != nil {
+		return err
+	}
+
+	if err := bs.cache.DeleteBlock(ctx, c); err != nil && !xerrors.Is(err, blockstore.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (bs *Blockstore) DeleteMany(ctx context.Context, cids []cid.Cid) error {
+	for _, c := range cids {
+		if err := bs.DeleteBlock(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllKeysChan lists the bucket, the cids it returns are all raw cids as the
+// objects are only keyed by multihash
+func (bs *Blockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+
+		var token string
+		for {
+			keys, next, err := bs.client.listObjects(ctx, bs.prefix, token)
+			if err != nil {
+				log.Errorf("failed to list object store blocks: %s", err)
+				return
+			}
+
+			for _, k := range keys {
+				mh, err := dshelp.DsKeyToMultihash(datastore.NewKey(strings.TrimPrefix(k, bs.prefix)))
+				if err != nil {
+					log.Warnf("skipping object with invalid key %q: %s", k, err)
+					continue
+				}
+
+				select {
+				case out <- cid.NewCidV1(cid.Raw, mh):
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if next == "" {
+				return
+			}
+			token = next
+		}
+	}()
+	return out, nil
+}
+
+func (bs *Blockstore) HashOnRead(enabled bool) {
+	bs.cache.HashOnRead(enabled)
+}
@@ -0,0 +1,174 @@
+package s3bs
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 serves a single bucket out of memory, with list pages of two keys
+type fakeS3 struct {
+	lk      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	if path == "" {
+		f.list(w, r)
+		return
+	}
+	key := strings.TrimPrefix(path, "/")
+
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, r.URL.Query().Get("prefix")) && k > r.URL.Query().Get("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var res listBucketResult
+	if len(keys) > 2 {
+		keys = keys[:2]
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[1]
+	}
+	for _, k := range keys {
+		res.Contents = append(res.Contents, struct{ Key string }{k})
+	}
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+type memCache struct {
+	blockstore.Blockstore
+}
+
+func (mc *memCache) DeleteMany(ctx context.Context, cids []cid.Cid) error {
+	for _, c := range cids {
+		if err := mc.DeleteBlock(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newMemCache() *memCache {
+	return &memCache{blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))}
+}
+
+func TestS3Blockstore(t *testing.T) {
+	ctx := context.Background()
+
+	fake := &fakeS3{bucket: "blocks", objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	creds := Credentials{AccessKey: "key", SecretKey: "secret", Region: "us-east-1"}
+	bs, err := NewBlockstore(srv.URL+"/blocks/shuttle-1", creds, newMemCache())
+	require.NoError(t, err)
+
+	var blks []blocks.Block
+	for i := 0; i < 5; i++ {
+		blks = append(blks, blocks.NewBlock([]byte(fmt.Sprintf("block %d", i))))
+	}
+	require.NoError(t, bs.PutMany(ctx, blks))
+	assert.Len(t, fake.objects, 5)
+	for k := range fake.objects {
+		assert.True(t, strings.HasPrefix(k, "shuttle-1/"))
+	}
+
+	// a fresh cache has to go to the bucket
+	bs, err = NewBlockstore(srv.URL+"/blocks/shuttle-1", creds, newMemCache())
+	require.NoError(t, err)
+
+	got, err := bs.Get(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	assert.Equal(t, blks[0].RawData(), got.RawData())
+
+	has, err := bs.cache.Has(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	size, err := bs.GetSize(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	assert.Equal(t, len(blks[1].RawData()), size)
+
+	ch, err := bs.AllKeysChan(ctx)
+	require.NoError(t, err)
+	var listed int
+	for c := range ch {
+		has, err := bs.Has(ctx, c)
+		require.NoError(t, err)
+		assert.True(t, has)
+		listed++
+	}
+	assert.Equal(t, 5, listed)
+
+	require.NoError(t, bs.DeleteBlock(ctx, blks[0].Cid()))
+	_, err = bs.Get(ctx, blks[0].Cid())
+	assert.ErrorIs(t, err, blockstore.ErrNotFound)
+
+	// corrupted objects are not served or cached
+	fake.objects[bs.key(blks[2].Cid())] = []byte("garbage")
+	_, err = bs.Get(ctx, blks[2].Cid())
+	assert.ErrorIs(t, err, blockstore.ErrHashMismatch)
+}
+
+func TestNewBlockstoreLocation(t *testing.T) {
+	_, err := NewBlockstore("https://s3.example.com", Credentials{}, newMemCache())
+	assert.Error(t, err)
+
+	_, err = NewBlockstore("s3://bucket", Credentials{}, newMemCache())
+	assert.Error(t, err)
+
+	bs, err := NewBlockstore("https://s3.example.com/bucket", Credentials{}, newMemCache())
+	require.NoError(t, err)
+	assert.Equal(t, "bucket", bs.client.bucket)
+	assert.Equal(t, "", bs.prefix)
+}
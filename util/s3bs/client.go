@@ -0,0 +1,288 @@
+package s3bs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Credentials sign requests to the object store
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Region       string
+}
+
+// CredentialsFromEnv reads credentials from the standard AWS environment
+// variables
+func CredentialsFromEnv() Credentials {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return Credentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Region:       region,
+	}
+}
+
+// client is a minimal S3 client for the handful of calls the blockstore
+// needs. Buckets are always addressed path style, which every S3 compatible
+// store supports.
+type client struct {
+	http     *http.Client
+	endpoint *url.URL
+	bucket   string
+	creds    Credentials
+}
+
+// statusError is returned for any response outside of the 2xx range
+type statusError struct {
+	Code int
+	Body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("object store request failed (%d): %s", e.Code, e.Body)
+}
+
+func isNotFound(err error) bool {
+	serr, ok := err.(*statusError)
+	return ok && serr.Code == http.StatusNotFound
+}
+
+func (c *client) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	c.sign(req, body, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &statusError{Code: resp.StatusCode, Body: string(msg)}
+	}
+	return resp, nil
+}
+
+// sign adds an AWS signature version 4 authorization header to req
+func (c *client) sign(req *http.Request, body []byte, now time.Time) {
+	amzdate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+
+	req.Header.Set("x-amz-date", amzdate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if c.creds.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.creds.SessionToken)
+	}
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for k := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.creds.Region + "/s3/aws4_request"
+	reqHash := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.creds.SecretKey), date)
+	key = hmacSHA256(key, c.creds.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.creds.AccessKey, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode escapes everything but the unreserved characters of RFC 3986, as
+// the signature requires. Slashes are kept unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), query[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (c *client) getObject(ctx context.Context, key string) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// headObject returns the size of the object under key
+func (c *client) headObject(ctx context.Context, key string) (int64, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.ContentLength, nil
+}
+
+func (c *client) putObject(ctx context.Context, key string, data []byte) error {
+	resp, err := c.do(ctx, http.MethodPut, key, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *client) deleteObject(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// listObjects returns one page of the keys under prefix, and the token to
+// fetch the next one with, empty on the last page
+func (c *client) listObjects(ctx context.Context, prefix, token string) ([]string, string, error) {
+	query := url.Values{
+		"list-type": []string{"2"},
+		"prefix":    []string{prefix},
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "", query, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var res listBucketResult
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, "", fmt.Errorf("failed to decode object listing: %w", err)
+	}
+
+	keys := make([]string, 0, len(res.Contents))
+	for _, o := range res.Contents {
+		keys = append(keys, o.Key)
+	}
+
+	if !res.IsTruncated {
+		return keys, "", nil
+	}
+	return keys, res.NextContinuationToken, nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/application-research/filclient"
 	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
@@ -18,6 +19,54 @@ type ShuttleStorageStats struct {
 	BlockstoreFree uint64 `json:"blockstoreFree"`
 	PinCount       int64  `json:"pinCount"`
 	PinQueueLength int64  `json:"pinQueueLength"`
+
+	// Disks is set for shuttles that spread their blockstore over more than
+	// one disk
+	Disks []ShuttleDiskStats `json:"disks,omitempty"`
+}
+
+type ShuttleDiskStats struct {
+	Dir  string `json:"dir"`
+	Size uint64 `json:"size"`
+	Free uint64 `json:"free"`
+}
+
+// ShuttleStats is the load and health a shuttle last reported
+type ShuttleStats struct {
+	Version             string    `json:"version"`
+	CPUUsage            float64   `json:"cpuUsage"`
+	NumCPU              int       `json:"numCpu"`
+	MemoryUsed          uint64    `json:"memoryUsed"`
+	ActiveTransfers     int       `json:"activeTransfers"`
+	TransferRate        uint64    `json:"transferRate"`
+	BitswapPeers        int       `json:"bitswapPeers"`
+	BitswapDataSent     uint64    `json:"bitswapDataSent"`
+	BitswapDataReceived uint64    `json:"bitswapDataReceived"`
+	ProvideStrategy     string    `json:"provideStrategy,omitempty"`
+	ProvideQueueLength  int       `json:"provideQueueLength"`
+	LastReprovide       time.Time `json:"lastReprovide"`
+	ProvideFailures     int64     `json:"provideFailures"`
+	PinFailures         int64     `json:"pinFailures"`
+	CommandFailures     int64     `json:"commandFailures"`
+	SendErrors          int64     `json:"sendErrors"`
+	Overloaded          bool      `json:"overloaded"`
+	Draining            bool      `json:"draining"`
+	Region              string    `json:"region,omitempty"`
+	StorageClass        string    `json:"storageClass,omitempty"`
+	IngestRate          uint64    `json:"ingestRate"`
+	FreeSpaceTrend      int64     `json:"freeSpaceTrend"`
+
+	Market *ShuttleMarketBalance `json:"market,omitempty"`
+}
+
+// ShuttleMarketBalance is the wallet and storage market escrow balance of a
+// shuttle's deal address
+type ShuttleMarketBalance struct {
+	Address   address.Address `json:"address"`
+	Balance   types.FIL       `json:"balance"`
+	Escrow    types.FIL       `json:"escrow"`
+	Locked    types.FIL       `json:"locked"`
+	Available types.FIL       `json:"available"`
 }
 
 type ShuttleListResponse struct {
@@ -29,7 +78,11 @@ type ShuttleListResponse struct {
 	Address        address.Address `json:"address"`
 	Hostname       string          `json:"hostname"`
 
+	// RetrievalAddress pays for the shuttle's retrievals
+	RetrievalAddress address.Address `json:"retrievalAddress"`
+
 	StorageStats *ShuttleStorageStats `json:"storageStats"`
+	Stats        *ShuttleStats        `json:"stats,omitempty"`
 }
 
 type ShuttleCreateContentBody struct {
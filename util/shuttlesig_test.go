@@ -0,0 +1,29 @@
+package util
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShuttleRequestSignature(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"root":"bafy"}`)
+
+	req := httptest.NewRequest("POST", "/content/create?ignore-dupes=true", nil)
+	req.Header.Set("Authorization", "Bearer EST-user-ARY")
+	SignShuttleRequest(req, "SHUTTLE1HANDLE", "SECRET", body, now)
+	assert.Equal(t, "SHUTTLE1HANDLE", req.Header.Get(ShuttleHandleHeader))
+
+	assert.NoError(t, VerifyShuttleRequest(req, "SECRET", body, "EST-user-ARY", now.Add(time.Minute)))
+	assert.Error(t, VerifyShuttleRequest(req, "OTHER", body, "EST-user-ARY", now), "signed with another shuttle's token")
+	assert.Error(t, VerifyShuttleRequest(req, "SECRET", []byte(`{"root":"bafz"}`), "EST-user-ARY", now), "body was changed")
+	assert.Error(t, VerifyShuttleRequest(req, "SECRET", body, "EST-other-ARY", now), "signature was used for another user")
+	assert.Error(t, VerifyShuttleRequest(req, "SECRET", body, "EST-user-ARY", now.Add(time.Hour)), "signature was replayed later")
+
+	other := httptest.NewRequest("POST", "/content/create", nil)
+	other.Header = req.Header.Clone()
+	assert.Error(t, VerifyShuttleRequest(other, "SECRET", body, "EST-user-ARY", now), "signature was used for another request")
+}
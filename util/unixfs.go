@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-cidutil"
 	chunker "github.com/ipfs/go-ipfs-chunker"
 	ipld "github.com/ipfs/go-ipld-format"
@@ -17,14 +20,175 @@ import (
 
 var DefaultHashFunction = uint64(mh.SHA2_256)
 
+// SupportedHashFunctions are the multihash functions an uploader may pick
+// for the DAG built from their data.
+var SupportedHashFunctions = map[string]uint64{
+	"sha2-256":    mh.SHA2_256,
+	"sha2-512":    mh.SHA2_512,
+	"sha3-256":    mh.SHA3_256,
+	"sha3-512":    mh.SHA3_512,
+	"blake2b-256": mh.BLAKE2B_MIN + 31,
+	"blake2s-256": mh.BLAKE2S_MIN + 31,
+	"blake3":      mh.BLAKE3,
+}
+
+const (
+	DefaultChunkSize = 1024 * 1024
+	MinChunkSize     = 1024
+)
+
+// ImportParams controls how data is laid out when importing a file
+type ImportParams struct {
+	// Chunker is a chunking strategy in the format used by go-ipfs, e.g.
+	// "size-262144", "rabin-65536-262144-1048576" or "buzhash". An empty
+	// string selects fixed size chunks of DefaultChunkSize bytes.
+	Chunker string
+
+	// CidVersion selects the CID version of the DAG nodes, 0 or 1. Zero
+	// value params select CIDv1; use CidVersionSet to request CIDv0.
+	CidVersion    int
+	CidVersionSet bool
+
+	// HashFunction is the name of a multihash function out of
+	// SupportedHashFunctions, empty selects DefaultHashFunction.
+	HashFunction string
+}
+
+// Prefix returns the cid prefix DAG nodes built with these params should use
+func (p ImportParams) Prefix() (cid.Prefix, error) {
+	version := 1
+	if p.CidVersionSet {
+		version = p.CidVersion
+	}
+
+	if version != 0 && version != 1 {
+		return cid.Prefix{}, fmt.Errorf("unsupported cid version %d", version)
+	}
+
+	hash := DefaultHashFunction
+	if p.HashFunction != "" {
+		h, ok := SupportedHashFunctions[strings.ToLower(p.HashFunction)]
+		if !ok {
+			return cid.Prefix{}, fmt.Errorf("unsupported hash function %q", p.HashFunction)
+		}
+		hash = h
+	}
+
+	if version == 0 && hash != mh.SHA2_256 {
+		return cid.Prefix{}, fmt.Errorf("cid version 0 only supports sha2-256")
+	}
+
+	prefix, err := merkledag.PrefixForCidVersion(version)
+	if err != nil {
+		return cid.Prefix{}, err
+	}
+	prefix.MhType = hash
+	return prefix, nil
+}
+
+// Validate checks that the params are usable, with chunks no larger than
+// maxChunkSize bytes.
+func (p ImportParams) Validate(maxChunkSize int64) error {
+	if err := ValidateChunker(p.Chunker, maxChunkSize); err != nil {
+		return err
+	}
+
+	_, err := p.Prefix()
+	return err
+}
+
+// ValidateChunker checks that the given chunker spec is well formed and that
+// no chunk it produces can be larger than maxSize bytes.
+func ValidateChunker(spec string, maxSize int64) error {
+	if spec == "" {
+		return nil
+	}
+
+	parts := strings.Split(spec, "-")
+	parseSizes := func(vals []string) ([]int64, error) {
+		out := make([]int64, 0, len(vals))
+		for _, v := range vals {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid chunk size %q in chunker %q", v, spec)
+			}
+			if n < MinChunkSize {
+				return nil, fmt.Errorf("chunk size %d in chunker %q is below minimum of %d bytes", n, spec, MinChunkSize)
+			}
+			out = append(out, n)
+		}
+		return out, nil
+	}
+
+	var max int64
+	switch parts[0] {
+	case "size":
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid chunker %q, expected size-<bytes>", spec)
+		}
+		sizes, err := parseSizes(parts[1:])
+		if err != nil {
+			return err
+		}
+		max = sizes[0]
+	case "rabin":
+		switch len(parts) {
+		case 1:
+			max = chunker.DefaultBlockSize + chunker.DefaultBlockSize/2
+		case 2:
+			sizes, err := parseSizes(parts[1:])
+			if err != nil {
+				return err
+			}
+			max = sizes[0] + sizes[0]/2
+		case 4:
+			sizes, err := parseSizes(parts[1:])
+			if err != nil {
+				return err
+			}
+			if !(sizes[0] <= sizes[1] && sizes[1] <= sizes[2]) {
+				return fmt.Errorf("invalid chunker %q, sizes must satisfy min <= avg <= max", spec)
+			}
+			max = sizes[2]
+		default:
+			return fmt.Errorf("invalid chunker %q, expected rabin-<min>-<avg>-<max>", spec)
+		}
+	case "buzhash":
+		if len(parts) != 1 {
+			return fmt.Errorf("invalid chunker %q, buzhash takes no parameters", spec)
+		}
+		// buzhash always cuts chunks of at most 512KiB
+		max = 512 << 10
+	default:
+		return fmt.Errorf("unrecognized chunker %q", spec)
+	}
+
+	if max > maxSize {
+		return fmt.Errorf("chunker %q may produce chunks of %d bytes, over the limit of %d bytes", spec, max, maxSize)
+	}
+	return nil
+}
+
 func ImportFile(dserv ipld.DAGService, fi io.Reader) (ipld.Node, error) {
-	prefix, err := merkledag.PrefixForCidVersion(1)
+	return ImportFileWithParams(dserv, fi, ImportParams{})
+}
+
+func ImportFileWithParams(dserv ipld.DAGService, fi io.Reader, params ImportParams) (ipld.Node, error) {
+	prefix, err := params.Prefix()
 	if err != nil {
 		return nil, err
 	}
-	prefix.MhType = DefaultHashFunction
 
-	spl := chunker.NewSizeSplitter(fi, 1024*1024)
+	var spl chunker.Splitter
+	if params.Chunker == "" {
+		spl = chunker.NewSizeSplitter(fi, DefaultChunkSize)
+	} else {
+		spl, err = chunker.FromString(fi, params.Chunker)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	dbp := ihelper.DagBuilderParams{
 		Maxlinks:  1024,
 		RawLeaves: true,
@@ -37,6 +201,12 @@ func ImportFile(dserv ipld.DAGService, fi io.Reader) (ipld.Node, error) {
 		Dagserv: dserv,
 	}
 
+	if prefix.Version == 0 {
+		// CIDv0 can neither address raw leaves nor inlined identity hashes
+		dbp.RawLeaves = false
+		dbp.CidBuilder = prefix
+	}
+
 	db, err := dbp.New(spl)
 	if err != nil {
 		return nil, err
@@ -45,6 +215,22 @@ func ImportFile(dserv ipld.DAGService, fi io.Reader) (ipld.Node, error) {
 	return balanced.Layout(db)
 }
 
+// DescribeCid returns the human readable codec and hash function names of c
+func DescribeCid(c cid.Cid) (codec string, hash string) {
+	pref := c.Prefix()
+
+	codec, ok := cid.CodecToStr[pref.Codec]
+	if !ok {
+		codec = fmt.Sprintf("0x%x", pref.Codec)
+	}
+
+	hash, ok = mh.Codes[pref.MhType]
+	if !ok {
+		hash = fmt.Sprintf("0x%x", pref.MhType)
+	}
+	return codec, hash
+}
+
 func TryExtractFSNode(nd ipld.Node) (*unixfs.FSNode, error) {
 	switch nd := nd.(type) {
 	case *merkledag.ProtoNode:
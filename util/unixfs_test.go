@@ -0,0 +1,61 @@
+package util
+
+import (
+	"testing"
+
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/assert"
+)
+
+type validateChunkerTest struct {
+	spec  string
+	valid bool
+}
+
+var validateChunkerTests = []validateChunkerTest{
+	{"", true},
+	{"size-262144", true},
+	{"size-1048576", true},
+	{"size-2097152", false}, // over limit
+	{"size-10", false},      // under minimum
+	{"size-abc", false},
+	{"rabin", true},
+	{"rabin-262144", true},
+	{"rabin-131072-262144-524288", true},
+	{"rabin-524288-262144-131072", false}, // min > max
+	{"rabin-1-2", false},
+	{"buzhash", true},
+	{"buzhash-1024", false},
+	{"fixed-1024", false},
+}
+
+func TestValidateChunker(t *testing.T) {
+	for _, test := range validateChunkerTests {
+		err := ValidateChunker(test.spec, DefaultChunkSize)
+		assert.Equal(t, test.valid, err == nil, "chunker %q", test.spec)
+	}
+}
+
+func TestImportParamsPrefix(t *testing.T) {
+	prefix, err := ImportParams{}.Prefix()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), prefix.Version)
+	assert.Equal(t, DefaultHashFunction, prefix.MhType)
+
+	prefix, err = ImportParams{HashFunction: "blake2b-256"}.Prefix()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(mh.BLAKE2B_MIN+31), prefix.MhType)
+
+	prefix, err = ImportParams{CidVersionSet: true}.Prefix()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), prefix.Version)
+
+	_, err = ImportParams{CidVersionSet: true, HashFunction: "sha3-256"}.Prefix()
+	assert.Error(t, err)
+
+	_, err = ImportParams{CidVersion: 2, CidVersionSet: true}.Prefix()
+	assert.Error(t, err)
+
+	_, err = ImportParams{HashFunction: "md5"}.Prefix()
+	assert.Error(t, err)
+}
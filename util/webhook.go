@@ -0,0 +1,144 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events webhooks can subscribe to
+const (
+	WebhookPinComplete    = "pin.complete"
+	WebhookPinFailed      = "pin.failed"
+	WebhookTransferStatus = "transfer.status"
+)
+
+var WebhookEvents = []string{WebhookPinComplete, WebhookPinFailed, WebhookTransferStatus}
+
+// Headers of webhook deliveries
+const (
+	WebhookEventHeader     = "X-Estuary-Event"
+	WebhookDeliveryHeader  = "X-Estuary-Delivery"
+	WebhookSignatureHeader = "X-Estuary-Signature"
+)
+
+// WebhookEvent is the body posted to a webhook
+type WebhookEvent struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"createdAt"`
+	Shuttle   string    `json:"shuttle"`
+
+	Content uint   `json:"content"`
+	Cid     string `json:"cid,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Reason is why a pin failed, like no_providers or timeout
+	Reason string `json:"reason,omitempty"`
+
+	// set for transfer events
+	Deal           uint   `json:"deal,omitempty"`
+	TransferStatus string `json:"transferStatus,omitempty"`
+	Message        string `json:"message,omitempty"`
+}
+
+// ParseWebhookEvents checks the events a webhook subscribes to, none means
+// all of them
+func ParseWebhookEvents(events []string) ([]string, error) {
+	if len(events) == 0 {
+		return WebhookEvents, nil
+	}
+
+	seen := make(map[string]bool, len(events))
+	out := make([]string, 0, len(events))
+	for _, ev := range events {
+		ev = strings.TrimSpace(ev)
+		known := false
+		for _, k := range WebhookEvents {
+			if ev == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown webhook event %q, must be one of %s", ev, strings.Join(WebhookEvents, ", "))
+		}
+		if !seen[ev] {
+			seen[ev] = true
+			out = append(out, ev)
+		}
+	}
+	return out, nil
+}
+
+// ValidateWebhookURL checks that u is an absolute http or https url
+func ValidateWebhookURL(u string) error {
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+		return fmt.Errorf("invalid webhook url %q, must be an http or https url", u)
+	}
+	return nil
+}
+
+// NewWebhookSecret returns a random secret to sign the deliveries of a
+// webhook with
+func NewWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// WebhookSignature is the value of the signature header of a delivery, the
+// time it was sent and the HMAC-SHA256 of the time and the body keyed with
+// the webhook's secret, like "t=1660000000,v1=<hex>"
+func WebhookSignature(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// VerifyWebhookSignature checks the signature header of a delivery, which
+// must not be older than maxAge. Receivers can use it to tell deliveries
+// from forged requests.
+func VerifyWebhookSignature(secret, header string, body []byte, maxAge time.Duration, now time.Time) error {
+	var ts int64
+	var sig string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			v, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid signature timestamp: %w", err)
+			}
+			ts = v
+		case "v1":
+			sig = kv[1]
+		}
+	}
+	if ts == 0 || sig == "" {
+		return fmt.Errorf("malformed webhook signature")
+	}
+
+	if d := now.Sub(time.Unix(ts, 0)); d > maxAge || d < -maxAge {
+		return fmt.Errorf("signature time is %s off", d)
+	}
+
+	want := WebhookSignature(secret, ts, body)
+	if !hmac.Equal([]byte(want), []byte(fmt.Sprintf("t=%d,v1=%s", ts, sig))) {
+		return fmt.Errorf("webhook signature does not match")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"event":"pin.complete"}`)
+
+	sig := WebhookSignature("whsec_a", now.Unix(), body)
+	assert.NoError(t, VerifyWebhookSignature("whsec_a", sig, body, 5*time.Minute, now.Add(time.Minute)))
+	assert.Error(t, VerifyWebhookSignature("whsec_b", sig, body, 5*time.Minute, now), "signed with another secret")
+	assert.Error(t, VerifyWebhookSignature("whsec_a", sig, []byte(`{}`), 5*time.Minute, now), "body was changed")
+	assert.Error(t, VerifyWebhookSignature("whsec_a", sig, body, 5*time.Minute, now.Add(time.Hour)), "delivery was replayed later")
+	assert.Error(t, VerifyWebhookSignature("whsec_a", "v1=00", body, 5*time.Minute, now))
+}
+
+func TestParseWebhookEvents(t *testing.T) {
+	evs, err := ParseWebhookEvents(nil)
+	require.NoError(t, err)
+	assert.Equal(t, WebhookEvents, evs)
+
+	evs, err = ParseWebhookEvents([]string{WebhookPinFailed, " pin.failed"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{WebhookPinFailed}, evs)
+
+	_, err = ParseWebhookEvents([]string{"pin.removed"})
+	assert.Error(t, err)
+
+	assert.NoError(t, ValidateWebhookURL("https://example.com/hook"))
+	assert.Error(t, ValidateWebhookURL("ftp://example.com/hook"))
+	assert.Error(t, ValidateWebhookURL("/hook"))
+}
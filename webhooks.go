@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/application-research/estuary/drpc"
+	"github.com/application-research/estuary/util"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/xerrors"
+	"gorm.io/gorm"
+)
+
+// maxWebhooksPerUser bounds the webhooks a user can register
+const maxWebhooksPerUser = 10
+
+// Webhook is a url the shuttles post a user's pin and transfer events to.
+// The events are signed with Secret, see util.WebhookSignature.
+type Webhook struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	UserID    uint      `gorm:"index" json:"-"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+
+	// Events is the comma separated list of events the webhook gets
+	Events string `json:"-"`
+}
+
+func (wh *Webhook) events() []string {
+	if wh.Events == "" {
+		return nil
+	}
+	return strings.Split(wh.Events, ",")
+}
+
+func (wh *Webhook) rpcWebhook() drpc.Webhook {
+	return drpc.Webhook{
+		ID:     wh.ID,
+		UserID: wh.UserID,
+		URL:    wh.URL,
+		Secret: wh.Secret,
+		Events: wh.events(),
+	}
+}
+
+type webhookResp struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+
+	// Secret is only returned when the webhook is created
+	Secret string `json:"secret,omitempty"`
+}
+
+type createWebhookBody struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// shuttleWebhooks lists the webhooks of a user, or of every user if userID
+// is zero, for the shuttles
+func (s *Server) shuttleWebhooks(userID uint) (*drpc.SetWebhooks, error) {
+	q := s.DB.Model(&Webhook{})
+	if userID != 0 {
+		q = q.Where("user_id = ?", userID)
+	}
+
+	var hooks []Webhook
+	if err := q.Find(&hooks).Error; err != nil {
+		return nil, err
+	}
+
+	out := &drpc.SetWebhooks{
+		All:      userID == 0,
+		UserID:   userID,
+		Webhooks: make([]drpc.Webhook, 0, len(hooks)),
+	}
+	for _, wh := range hooks {
+		out.Webhooks = append(out.Webhooks, wh.rpcWebhook())
+	}
+	return out, nil
+}
+
+// syncShuttleWebhooks sends the webhooks of a user to the shuttles that
+// deliver webhook events
+func (s *Server) syncShuttleWebhooks(ctx context.Context, userID uint) {
+	sw, err := s.shuttleWebhooks(userID)
+	if err != nil {
+		log.Errorf("failed to list webhooks of user %d for shuttles: %s", userID, err)
+		return
+	}
+
+	s.CM.shuttlesLk.Lock()
+	var handles []string
+	for h, sc := range s.CM.shuttles {
+		if sc.webhooks {
+			handles = append(handles, h)
+		}
+	}
+	s.CM.shuttlesLk.Unlock()
+
+	for _, h := range handles {
+		if err := s.CM.sendShuttleCommand(ctx, h, &drpc.Command{
+			Op:     drpc.CMD_SetWebhooks,
+			Params: drpc.CmdParams{SetWebhooks: sw},
+		}); err != nil {
+			log.Warnf("failed to send webhooks to shuttle %s: %s", h, err)
+		}
+	}
+}
+
+// handleUserCreateWebhook godoc
+// @Summary      Register a webhook
+// @Description  This endpoint registers a url the shuttles post pin and transfer events of the user's content to. Events is a list of pin.complete, pin.failed and transfer.status, all of them if empty. Deliveries are signed with the returned secret in the X-Estuary-Signature header, as t=<unix time>,v1=<hex HMAC-SHA256 of the time, a dot and the body>. The secret is only returned here.
+// @Tags         User
+// @Accept       json
+// @Produce      json
+// @Param        body  body  createWebhookBody  true  "Url and events of the webhook"
+// @Success      200  {object}  webhookResp
+// @Failure      400  {object}  util.HttpError
+// @Router       /user/webhooks [post]
+func (s *Server) handleUserCreateWebhook(c echo.Context, u *User) error {
+	var body createWebhookBody
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	if err := util.ValidateWebhookURL(body.URL); err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	events, err := util.ParseWebhookEvents(body.Events)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: err.Error(),
+		}
+	}
+
+	var count int64
+	if err := s.DB.Model(&Webhook{}).Where("user_id = ?", u.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count >= maxWebhooksPerUser {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("users can register at most %d webhooks", maxWebhooksPerUser),
+		}
+	}
+
+	secret, err := util.NewWebhookSecret()
+	if err != nil {
+		return err
+	}
+
+	wh := &Webhook{
+		UserID: u.ID,
+		URL:    body.URL,
+		Secret: secret,
+		Events: strings.Join(events, ","),
+	}
+	if err := s.DB.Create(wh).Error; err != nil {
+		return err
+	}
+
+	s.syncShuttleWebhooks(c.Request().Context(), u.ID)
+
+	return c.JSON(http.StatusOK, &webhookResp{
+		ID:        wh.ID,
+		CreatedAt: wh.CreatedAt,
+		URL:       wh.URL,
+		Events:    events,
+		Secret:    secret,
+	})
+}
+
+// handleUserGetWebhooks godoc
+// @Summary      List webhooks
+// @Description  This endpoint lists the webhooks of the user, without their secrets
+// @Tags         User
+// @Produce      json
+// @Success      200  {object}  []webhookResp
+// @Router       /user/webhooks [get]
+func (s *Server) handleUserGetWebhooks(c echo.Context, u *User) error {
+	var hooks []Webhook
+	if err := s.DB.Order("id").Find(&hooks, "user_id = ?", u.ID).Error; err != nil {
+		return err
+	}
+
+	out := make([]webhookResp, 0, len(hooks))
+	for _, wh := range hooks {
+		out = append(out, webhookResp{
+			ID:        wh.ID,
+			CreatedAt: wh.CreatedAt,
+			URL:       wh.URL,
+			Events:    wh.events(),
+		})
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+// handleUserDeleteWebhook godoc
+// @Summary      Remove a webhook
+// @Description  This endpoint removes a webhook of the user, deliveries the shuttles have not made yet are dropped
+// @Tags         User
+// @Param        id  path  int  true  "Webhook id"
+// @Router       /user/webhooks/{id} [delete]
+func (s *Server) handleUserDeleteWebhook(c echo.Context, u *User) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return &util.HttpError{
+			Code:    http.StatusBadRequest,
+			Reason:  util.ERR_INVALID_INPUT,
+			Details: fmt.Sprintf("invalid webhook id %q", c.Param("id")),
+		}
+	}
+
+	var wh Webhook
+	if err := s.DB.First(&wh, "id = ? and user_id = ?", id, u.ID).Error; err != nil {
+		if xerrors.Is(err, gorm.ErrRecordNotFound) {
+			return &util.HttpError{
+				Code:    http.StatusNotFound,
+				Reason:  util.ERR_INVALID_INPUT,
+				Details: fmt.Sprintf("no webhook %d", id),
+			}
+		}
+		return err
+	}
+
+	if err := s.DB.Delete(&wh).Error; err != nil {
+		return err
+	}
+
+	s.syncShuttleWebhooks(c.Request().Context(), u.ID)
+
+	return c.NoContent(http.StatusOK)
+}